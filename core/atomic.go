@@ -0,0 +1,228 @@
+package core
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Locked and implicitly locked read-modify-write instructions. Processors sharing physical
+// memory share a Bus; a locked instruction holds it from its first read to its last write.
+
+// Bus serializes the locked instructions of the processors attached to it
+type Bus struct {
+	sync.Mutex
+}
+
+// lockable reports whether the instruction after a LOCK prefix accepts it: one of the
+// read-modify-write instructions with a memory destination. code8 reads the instruction
+// bytes; long skips the REX prefixes of 64-bit mode.
+func lockable(code8 func(offset int) uint8, long bool) bool {
+	offset := 0
+	code := code8(offset)
+	for isPrefix(code) || long && code&0xf0 == 0x40 {
+		offset++
+		code = code8(offset)
+	}
+	twoByte := code == 0x0f
+	if twoByte {
+		offset++
+		code = code8(offset)
+	}
+	modrm := code8(offset + 1)
+	if modrm>>6 == 3 {
+		return false
+	}
+	op := modrm >> 3 & 7
+	if !twoByte {
+		switch {
+		case code < 0x38 && code&6 == 0: // ADD, OR, ADC, SBB, AND, SUB and XOR r/m, r
+			return true
+		case code >= 0x80 && code <= 0x83:
+			return op != 7
+		case code == 0x86 || code == 0x87:
+			return true
+		case code == 0xf6 || code == 0xf7: // NOT and NEG
+			return op == 2 || op == 3
+		case code == 0xfe || code == 0xff: // INC and DEC
+			return op <= 1
+		}
+		return false
+	}
+	switch code {
+	case 0xab, 0xb3, 0xbb, 0xb0, 0xb1, 0xc0, 0xc1:
+		return true
+	case 0xba:
+		return op >= bitTestSet
+	case 0xc7:
+		return op == 1
+	}
+	return false
+}
+
+func isPrefix(code uint8) bool {
+	switch code {
+	case 0x26, 0x2e, 0x36, 0x3e, 0x64, 0x65, 0x66, 0x67, 0xf0, 0xf2, 0xf3:
+		return true
+	}
+	return false
+}
+
+// busLock takes the bus for an implicitly locked memory operand, unless a LOCK prefix
+// already holds it, and returns the function releasing it
+func (a *ALU) busLock(modrm *ModRM) func() {
+	reg := a.reg
+	if modrm.Mod == 3 || reg.lockPrefix {
+		return func() {}
+	}
+	reg.bus.Lock()
+	return reg.bus.Unlock
+}
+
+// arithFlags CF, OF, AF, ZF, SF and PF of v1 + v2, or v1 - v2 when sub, on width bits
+func arithFlags(v1 uint32, v2 uint32, width uint, sub bool) uint32 {
+	mask := laneMask(width)
+	a, b := uint64(v1)&mask, uint64(v2)&mask
+	result := a + b
+	overflow := (a ^ result) & (b ^ result)
+	if sub {
+		result = a - b
+		overflow = (a ^ b) & (a ^ result)
+	}
+	flags := resultFlags(result, width) | carryFlag(result>>width&1 != 0)
+	if (a^b^result)&0x10 != 0 {
+		flags |= FlagAF
+	}
+	if overflow>>(width-1)&1 != 0 {
+		flags |= FlagOF
+	}
+	return flags
+}
+
+const arithFlagsMask = FlagCF | FlagPF | FlagAF | FlagZF | FlagSF | FlagOF
+
+func (r *X86Registers) accumulator(width uint) uint32 {
+	return r.EAX & uint32(laneMask(width))
+}
+
+func (r *X86Registers) setAccumulator(width uint, value uint32) {
+	switch width {
+	case 8:
+		r.Set8ByIndex(0, uint8(value))
+	case 16:
+		r.Set16ByIndex(0, uint16(value))
+	default:
+		r.EAX = value
+	}
+}
+
+// xchg XCHG r/m, r (86, 87), locked with a memory operand
+func (a *ALU) xchg(width uint) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		defer a.busLock(&modrm)()
+		value := getRM(&modrm, width)
+		setRM(&modrm, width, getR(&modrm, width))
+		setR(&modrm, width, value)
+	}
+}
+
+// xchgAccumulator XCHG eAX, r (91-97)
+func (a *ALU) xchgAccumulator(width uint) func() {
+	return func() {
+		reg := a.reg
+		index := a.mem.GetCode8(0) & 7
+		reg.EIP += 1
+		if width == 16 {
+			value := reg.Get16ByIndex(index)
+			reg.Set16ByIndex(index, uint16(reg.EAX))
+			reg.Set16ByIndex(0, value)
+			return
+		}
+		value := reg.GetByIndex(index)
+		reg.SetByIndex(index, reg.EAX)
+		reg.EAX = value
+	}
+}
+
+// cmpxchg CMPXCHG r/m, r (0F B0, B1): compares the accumulator with r/m like CMP; when
+// equal r/m = r, else the accumulator = r/m. A memory operand is written either way.
+func (a *ALU) cmpxchg(width uint) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		value := getRM(&modrm, width)
+		flags := arithFlags(reg.accumulator(width), value, width, true)
+		if flags&FlagZF != 0 {
+			setRM(&modrm, width, getR(&modrm, width))
+		} else {
+			setRM(&modrm, width, value)
+			reg.setAccumulator(width, value)
+		}
+		reg.setEFlags(flags, arithFlagsMask)
+	}
+}
+
+// xadd XADD r/m, r (0F C0, C1): r/m = r/m + r and r = the old r/m, with the flags of ADD
+func (a *ALU) xadd(width uint) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		dst, src := getRM(&modrm, width), getR(&modrm, width)
+		setRM(&modrm, width, dst+src)
+		setR(&modrm, width, dst)
+		reg.setEFlags(arithFlags(dst, src, width, false), arithFlagsMask)
+	}
+}
+
+// cmpxchg8b CMPXCHG8B m64 (0F C7 /1): compares EDX:EAX with m64; when equal m64 = ECX:EBX
+// and ZF is set, else EDX:EAX = m64. The operand is written either way.
+func (a *ALU) cmpxchg8b(modrm *ModRM) {
+	reg := a.reg
+	mem := a.mem
+	if reg.features().Leaf1EDX&FeatureCX8 == 0 || modrm.Mod == 3 {
+		raise(ExceptionUD)
+	}
+	address := modrm.calcAddress(8, true)
+	low, high := mem.Read32(address), mem.Read32(address+4)
+	if low == reg.EAX && high == reg.EDX {
+		mem.Write32(address, reg.EBX)
+		mem.Write32(address+4, reg.ECX)
+		reg.setEFlags(FlagZF, FlagZF)
+		return
+	}
+	mem.Write32(address, low)
+	mem.Write32(address+4, high)
+	reg.EAX, reg.EDX = low, high
+	reg.setEFlags(0, FlagZF)
+}
+
+// group9 0F C7: CMPXCHG8B (/1), RDRAND (/6) and RDSEED (/7)
+func (a *ALU) group9(width uint) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		switch modrm.Opcode {
+		case 1:
+			a.cmpxchg8b(&modrm)
+		case 6, 7:
+			a.random(&modrm, width)
+		default:
+			raise(ExceptionUD)
+		}
+	}
+}
+
+// pause NOP (90), and PAUSE (F3 90), which gives the host thread up to the other
+// processors spinning on the bus
+func (a *ALU) pause() {
+	reg := a.reg
+	if reg.repPrefix == 0xf3 {
+		runtime.Gosched()
+	}
+	reg.EIP += 1
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// TestLockedIncrement runs two processors on the same ram and bus, each adding 1 to the
+// dword at 0x1800 0x4000 times with a locked instruction: no increment may be lost
+func TestLockedIncrement(t *testing.T) {
+	const increments = 0x4000
+	// two threads, so that they interleave even on a single host processor
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	tests := []struct {
+		name string
+		code []byte
+	}{
+		{"inc", []byte{
+			0xb9, 0x00, 0x40, 0x00, 0x00, // mov $0x4000,%ecx
+			0xf0, 0xff, 0x05, 0x00, 0x18, 0x00, 0x00, // 1: lock incl 0x1800
+			0x49,       // dec %ecx
+			0x75, 0xf6, // jnz 1b
+			0xf4, // hlt
+		}},
+		{"xadd", []byte{
+			0xb9, 0x00, 0x40, 0x00, 0x00, // mov $0x4000,%ecx
+			0xb8, 0x01, 0x00, 0x00, 0x00, // 1: mov $1,%eax
+			0xf0, 0x0f, 0xc1, 0x05, 0x00, 0x18, 0x00, 0x00, // lock xadd %eax,0x1800
+			0x49,       // dec %ecx
+			0x75, 0xf0, // jnz 1b
+			0xf4, // hlt
+		}},
+		{"cmpxchg", []byte{
+			0xb9, 0x00, 0x40, 0x00, 0x00, // mov $0x4000,%ecx
+			0xa1, 0x00, 0x18, 0x00, 0x00, // 1: mov 0x1800,%eax
+			0x8d, 0x50, 0x01, // 2: lea 1(%eax),%edx
+			0xf0, 0x0f, 0xb1, 0x15, 0x00, 0x18, 0x00, 0x00, // lock cmpxchg %edx,0x1800
+			0x75, 0xf3, // jnz 2b
+			0x49,       // dec %ecx
+			0x75, 0xeb, // jnz 1b
+			0xf4, // hlt
+		}},
+	}
+	for _, test := range tests {
+		ram := make([]byte, 0x1000)
+		copy(ram, test.code)
+		bus := &Bus{}
+		var cpus [2]*Emulator
+		for i := range cpus {
+			emu, err := NewEmulator(32, 0x1000, 0x2000, ram, false, WithBus(bus))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cpus[i] = emu
+		}
+		var wg sync.WaitGroup
+		errs := make([]error, len(cpus))
+		for i, emu := range cpus {
+			wg.Add(1)
+			go func(i int, emu *Emulator) {
+				defer wg.Done()
+				errs[i] = emu.Run()
+			}(i, emu)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		if total := cpus[0].cpu.(*CPU).mem.ReadPhys32(0x1800); total != 2*increments {
+			t.Errorf("%s: total %#x, want %#x", test.name, total, 2*increments)
+		}
+	}
+}
@@ -0,0 +1,586 @@
+package core
+
+// vexPrefix the fields of a VEX prefix (C4 or C5): the extra source register, the vector
+// length, VEX.W and the mandatory prefix it implies
+type vexPrefix struct {
+	present bool
+	vvvv    uint8 // register, already inverted; 0 when unused
+	l       uint8 // 0 for 128-bit, 1 for 256-bit operations
+	w       bool
+	pp      uint8
+}
+
+// YMM 256-bit AVX register as four quadwords, the low one first. Its low half is the XMM
+// register of the same number.
+type YMM [4]uint64
+
+// lane the i-th lane of width bits
+func (y YMM) lane(i uint, width uint) uint64 {
+	return y[i*width/64] >> (i * width % 64) & laneMask(width)
+}
+
+func (y *YMM) setLane(i uint, width uint, value uint64) {
+	q, s := i*width/64, i*width%64
+	y[q] = y[q]&^(laneMask(width)<<s) | value&laneMask(width)<<s
+}
+
+// half the low (0) or high (1) 128 bits
+func (y YMM) half(h int) XMM {
+	return XMM{y[2*h], y[2*h+1]}
+}
+
+func (y *YMM) setHalf(h int, x XMM) {
+	y[2*h], y[2*h+1] = x[0], x[1]
+}
+
+// YMM the AVX register i; legacy SSE instructions leave its upper half alone
+func (r *X86Registers) YMM(i uint8) YMM {
+	return YMM{r.XMM[i][0], r.XMM[i][1], r.YMMH[i][0], r.YMMH[i][1]}
+}
+
+func (r *X86Registers) SetYMM(i uint8, value YMM) {
+	r.XMM[i] = value.half(0)
+	r.YMMH[i] = value.half(1)
+}
+
+// vectorRegisters the number of XMM and YMM registers: XMM8-XMM15 only exist in 64-bit mode
+func (r *X86Registers) vectorRegisters() int {
+	if r.mode64 {
+		return 16
+	}
+	return 8
+}
+
+// Features required by the VEX instructions
+const (
+	avxFloat   = iota // AVX at both lengths
+	avxInteger        // AVX at 128 bits, AVX2 at 256 bits
+	avx2              // AVX2 only
+)
+
+// AVX AVX and AVX2 instructions: the VEX forms of SSE and SSE2 on the XMM and YMM
+// registers, with a non-destructive source in VEX.vvvv, and the AVX permutes, broadcasts,
+// masked moves and gathers. Results always clear the register bits above their length.
+type AVX struct {
+	reg *X86Registers
+	mem IMemory
+	sse *SSE
+}
+
+func NewAVX(reg *X86Registers, mem IMemory) *AVX {
+	return &AVX{
+		reg: reg,
+		mem: mem,
+		sse: NewSSE(reg, mem),
+	}
+}
+
+// check VEX instructions raise #UD without their feature or unless the OS enabled the SSE
+// and AVX state with CR4.OSXSAVE and XCR0, and #NM with CR0.TS
+func (a *AVX) check(kind int) {
+	reg := a.reg
+	features := reg.features()
+	supported := features.Leaf1ECX&FeatureAVX != 0
+	if kind == avx2 || kind == avxInteger && reg.vex.l == 1 {
+		supported = features.Leaf7EBX&FeatureAVX2 != 0
+	}
+	if !supported || reg.CR4&CR4OSXSAVE == 0 || reg.XCR0&(xstateSSE|xstateAVX) != xstateSSE|xstateAVX {
+		raise(ExceptionUD)
+	}
+	if reg.CR0&CR0TS != 0 {
+		raise(ExceptionNM)
+	}
+}
+
+// decode checks the instruction and decodes the ModRM byte after the opcode byte
+func (a *AVX) decode(kind int) ModRM {
+	reg := a.reg
+	a.check(kind)
+	reg.EIP += 1
+	return NewModRM(reg, a.mem)
+}
+
+// noSource instructions without a VEX.vvvv operand raise #UD unless it is 1111b
+func (a *AVX) noSource() {
+	if a.reg.vex.vvvv != 0 {
+		raise(ExceptionUD)
+	}
+}
+
+// only128 instructions without a 256-bit form raise #UD with VEX.L
+func (a *AVX) only128() {
+	if a.reg.vex.l != 0 {
+		raise(ExceptionUD)
+	}
+}
+
+// only256 instructions without a 128-bit form raise #UD without VEX.L
+func (a *AVX) only256() {
+	if a.reg.vex.l == 0 {
+		raise(ExceptionUD)
+	}
+}
+
+// w0 instructions defined with VEX.W0 raise #UD with VEX.W
+func (a *AVX) w0() {
+	if a.reg.vex.w {
+		raise(ExceptionUD)
+	}
+}
+
+// halves the 128-bit halves of the vector length
+func (a *AVX) halves() int {
+	return int(a.reg.vex.l) + 1
+}
+
+// size bytes of the vector length
+func (a *AVX) size() uint32 {
+	return 16 << a.reg.vex.l
+}
+
+// src1 the first source, the register in VEX.vvvv
+func (a *AVX) src1() YMM {
+	return a.reg.YMM(a.reg.vex.vvvv)
+}
+
+// address linear address of a memory operand of size bytes; the aligned forms raise #GP(0)
+// unless it is aligned on its size
+func (a *AVX) address(modrm *ModRM, size uint32, write bool, aligned bool) uint64 {
+	address := modrm.linear(size, write)
+	if aligned && address&uint64(size-1) != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	return address
+}
+
+// read the r/m operand: the low size bytes of memory zero-extended, or a register cut to
+// 128 bits for operands up to 16 bytes
+func (a *AVX) read(modrm *ModRM, size uint32, aligned bool) YMM {
+	if modrm.Mod == 3 {
+		return a.register(modrm.Rm, size)
+	}
+	return a.load(a.address(modrm, size, false, aligned), size)
+}
+
+// write the low size bytes of value to the r/m operand; a register is written whole
+func (a *AVX) write(modrm *ModRM, size uint32, aligned bool, value YMM) {
+	if modrm.Mod == 3 {
+		a.reg.SetYMM(modrm.Rm, value)
+		return
+	}
+	a.store(a.address(modrm, size, true, aligned), size, value)
+}
+
+// register the register i cut to 128 bits for sizes up to 16 bytes
+func (a *AVX) register(i uint8, size uint32) YMM {
+	value := a.reg.YMM(i)
+	if size <= 16 {
+		value[2], value[3] = 0, 0
+	}
+	return value
+}
+
+func (a *AVX) load(address uint64, size uint32) YMM {
+	mem := a.mem
+	switch size {
+	case 1:
+		return YMM{uint64(mem.ReadLinear(address, 1))}
+	case 2:
+		return YMM{uint64(readWord(mem, address))}
+	case 32:
+		return YMM{readQword(mem, address), readQword(mem, address+8),
+			readQword(mem, address+16), readQword(mem, address+24)}
+	}
+	x := a.sse.load(address, size)
+	return YMM{x[0], x[1]}
+}
+
+func (a *AVX) store(address uint64, size uint32, value YMM) {
+	if size == 32 {
+		a.sse.store(address, 16, value.half(0))
+		a.sse.store(address+16, 16, value.half(1))
+		return
+	}
+	a.sse.store(address, size, value.half(0))
+}
+
+// lanes128 applies op to the 128-bit halves of src1 and the r/m operand
+func (a *AVX) lanes128(modrm *ModRM, op func(x XMM, y XMM, h int) XMM) YMM {
+	src1 := a.src1()
+	src2 := a.read(modrm, a.size(), false)
+	var result YMM
+	for h := 0; h < a.halves(); h++ {
+		result.setHalf(h, op(src1.half(h), src2.half(h), h))
+	}
+	return result
+}
+
+// Mov VMOVUPS, VMOVAPS, VMOVUPD, VMOVAPD, VMOVDQU and VMOVDQA xmm/ymm, r/m (0F 10, 28, 6F)
+func (a *AVX) Mov(aligned bool) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		a.noSource()
+		reg.SetYMM(modrm.RegIndex, a.read(&modrm, a.size(), aligned))
+	}
+}
+
+// MovStore the stores r/m, xmm/ymm of Mov (0F 11, 29, 7F)
+func (a *AVX) MovStore(aligned bool) func() {
+	return func() {
+		modrm := a.decode(avxFloat)
+		a.noSource()
+		a.write(&modrm, a.size(), aligned, a.register(modrm.RegIndex, a.size()))
+	}
+}
+
+// Movnt VMOVNTPS, VMOVNTPD and VMOVNTDQ m, xmm/ymm (0F 2B, E7)
+func (a *AVX) Movnt() {
+	modrm := a.decode(avxFloat)
+	a.noSource()
+	if modrm.Mod == 3 {
+		raise(ExceptionUD)
+	}
+	a.write(&modrm, a.size(), true, a.register(modrm.RegIndex, a.size()))
+}
+
+// MovScalar VMOVSS and VMOVSD (F3/F2 0F 10): the register form merges the low lane of r/m
+// into src1, the memory form zero-extends
+func (a *AVX) MovScalar(width uint) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		if modrm.Mod == 3 {
+			result := a.register(a.reg.vex.vvvv, 16)
+			result.setLane(0, width, reg.XMM[modrm.Rm].lane(0, width))
+			reg.SetYMM(modrm.RegIndex, result)
+			return
+		}
+		a.noSource()
+		reg.SetYMM(modrm.RegIndex, a.read(&modrm, uint32(width/8), false))
+	}
+}
+
+// MovScalarStore VMOVSS and VMOVSD r/m, xmm (F3/F2 0F 11); the register form merges into
+// src1 like MovScalar
+func (a *AVX) MovScalarStore(width uint) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		value := reg.XMM[modrm.RegIndex]
+		if modrm.Mod == 3 {
+			result := a.register(a.reg.vex.vvvv, 16)
+			result.setLane(0, width, value.lane(0, width))
+			reg.SetYMM(modrm.Rm, result)
+			return
+		}
+		a.noSource()
+		a.store(a.address(&modrm, uint32(width/8), true, false), uint32(width/8), YMM{value[0]})
+	}
+}
+
+// MovHalf VMOVLPS, VMOVLPD, VMOVHPS and VMOVHPD xmm, xmm, m64 (0F 12, 16): the quadword
+// half from memory, the other one from src1. The register forms of the PS encodings are
+// VMOVHLPS and VMOVLHPS.
+func (a *AVX) MovHalf(width uint, half int) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		a.only128()
+		result := a.register(reg.vex.vvvv, 16)
+		if modrm.Mod == 3 {
+			if width != 32 {
+				raise(ExceptionUD)
+			}
+			result[half] = reg.XMM[modrm.Rm][1-half]
+		} else {
+			result[half] = readQword(a.mem, a.address(&modrm, 8, false, false))
+		}
+		reg.SetYMM(modrm.RegIndex, result)
+	}
+}
+
+// MovHalfStore VMOVLPS, VMOVLPD, VMOVHPS and VMOVHPD m64, xmm (0F 13, 17)
+func (a *AVX) MovHalfStore(half int) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		a.only128()
+		a.noSource()
+		if modrm.Mod == 3 {
+			raise(ExceptionUD)
+		}
+		writeQword(a.mem, a.address(&modrm, 8, true, false), reg.XMM[modrm.RegIndex][half])
+	}
+}
+
+// Movmsk VMOVMSKPS and VMOVMSKPD r32, xmm/ymm (0F 50)
+func (a *AVX) Movmsk(width uint) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		a.noSource()
+		if modrm.Mod != 3 {
+			raise(ExceptionUD)
+		}
+		src := reg.YMM(modrm.Rm)
+		var mask uint32
+		for h := 0; h < a.halves(); h++ {
+			mask |= laneSigns(src.half(h), width) << (uint(h) * 128 / width)
+		}
+		modrm.SetR32(mask)
+	}
+}
+
+// MovdXMMRM32 VMOVD xmm, r/m32 (66 0F 6E), VMOVQ xmm, r/m64 with VEX.W in 64-bit mode
+func (a *AVX) MovdXMMRM32() {
+	reg := a.reg
+	modrm := a.decode(avxFloat)
+	a.only128()
+	a.noSource()
+	reg.SetYMM(modrm.RegIndex, YMM{modrm.GetRMW()})
+}
+
+// MovdRM32XMM VMOVD r/m32, xmm (66 0F 7E), VMOVQ r/m64, xmm with VEX.W in 64-bit mode
+func (a *AVX) MovdRM32XMM() {
+	reg := a.reg
+	modrm := a.decode(avxFloat)
+	a.only128()
+	a.noSource()
+	modrm.SetRMW(reg.XMM[modrm.RegIndex][0])
+}
+
+// MovqXMMRM64 VMOVQ xmm, xmm/m64 (F3 0F 7E)
+func (a *AVX) MovqXMMRM64() {
+	reg := a.reg
+	modrm := a.decode(avxFloat)
+	a.only128()
+	a.noSource()
+	reg.SetYMM(modrm.RegIndex, YMM{a.read(&modrm, 8, false)[0]})
+}
+
+// MovqRM64XMM VMOVQ xmm/m64, xmm (66 0F D6)
+func (a *AVX) MovqRM64XMM() {
+	reg := a.reg
+	modrm := a.decode(avxFloat)
+	a.only128()
+	a.noSource()
+	a.write(&modrm, 8, false, YMM{reg.XMM[modrm.RegIndex][0]})
+}
+
+// Maskmovdqu VMASKMOVDQU xmm, xmm (66 0F F7)
+func (a *AVX) Maskmovdqu() {
+	reg := a.reg
+	modrm := a.decode(avxFloat)
+	a.only128()
+	a.noSource()
+	if modrm.Mod != 3 {
+		raise(ExceptionUD)
+	}
+	data, mask := reg.XMM[modrm.RegIndex], reg.XMM[modrm.Rm]
+	maskedStore(reg, a.mem, data[:], mask[:])
+}
+
+// Logic VANDPS, VANDNPS, VORPS, VXORPS and their PD forms (0F 54-57) with the packedOps
+// operation code
+func (a *AVX) Logic(code uint8) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		reg.SetYMM(modrm.RegIndex, a.lanes128(&modrm, func(x XMM, y XMM, h int) XMM {
+			return packed128(code, x, y)
+		}))
+	}
+}
+
+// Packed the VEX forms of the packedOps instructions (66 0F 60-6D, 74-76, D4-FE), on each
+// 128-bit half
+func (a *AVX) Packed(code uint8) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxInteger)
+		reg.SetYMM(modrm.RegIndex, a.lanes128(&modrm, func(x XMM, y XMM, h int) XMM {
+			return packed128(code, x, y)
+		}))
+	}
+}
+
+// Unpack VUNPCKLPS, VUNPCKHPS, VUNPCKLPD and VUNPCKHPD (0F 14, 15)
+func (a *AVX) Unpack(width uint, half int) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		reg.SetYMM(modrm.RegIndex, a.lanes128(&modrm, func(x XMM, y XMM, h int) XMM {
+			return unpackFloat(x, y, width, half)
+		}))
+	}
+}
+
+// Shift VPSRL, VPSRA and VPSLL xmm/ymm, xmm/ymm, xmm/m128 by the count in the low quadword
+func (a *AVX) Shift(width uint, kind uint8) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxInteger)
+		src1 := a.src1()
+		count := a.read(&modrm, 16, false)[0]
+		var result YMM
+		for h := 0; h < a.halves(); h++ {
+			result.setHalf(h, shift128(src1.half(h), count, width, kind))
+		}
+		reg.SetYMM(modrm.RegIndex, result)
+	}
+}
+
+// ShiftImm groups 12-14 (66 0F 71-73) shifting the r/m register by imm8 into VEX.vvvv
+func (a *AVX) ShiftImm(width uint) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxInteger)
+		if modrm.Mod != 3 {
+			raise(ExceptionUD)
+		}
+		src := reg.YMM(modrm.Rm)
+		count := uint64(a.sse.imm8())
+		var result YMM
+		for h := 0; h < a.halves(); h++ {
+			result.setHalf(h, shiftImm128(src.half(h), count, width, modrm.Opcode))
+		}
+		reg.SetYMM(reg.vex.vvvv, result)
+	}
+}
+
+// Pshufd VPSHUFD xmm/ymm, r/m, imm8 (66 0F 70)
+func (a *AVX) Pshufd() {
+	reg := a.reg
+	modrm := a.decode(avxInteger)
+	a.noSource()
+	src := a.read(&modrm, a.size(), false)
+	order := a.sse.imm8()
+	var result YMM
+	for h := 0; h < a.halves(); h++ {
+		result.setHalf(h, shuffleDwords(src.half(h), src.half(h), order))
+	}
+	reg.SetYMM(modrm.RegIndex, result)
+}
+
+// PshufHalf VPSHUFLW and VPSHUFHW xmm/ymm, r/m, imm8 (F2/F3 0F 70)
+func (a *AVX) PshufHalf(half int) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxInteger)
+		a.noSource()
+		src := a.read(&modrm, a.size(), false)
+		order := a.sse.imm8()
+		for h := 0; h < a.halves(); h++ {
+			src[2*h+half] = shuffleWords(src[2*h+half], order)
+		}
+		reg.SetYMM(modrm.RegIndex, src)
+	}
+}
+
+// Pinsrw VPINSRW xmm, xmm, r32/m16, imm8 (66 0F C4)
+func (a *AVX) Pinsrw() {
+	reg := a.reg
+	modrm := a.decode(avxFloat)
+	a.only128()
+	value := uint64(modrm.GetRM16())
+	result := a.register(reg.vex.vvvv, 16)
+	result.setLane(uint(a.sse.imm8()&7), 16, value)
+	reg.SetYMM(modrm.RegIndex, result)
+}
+
+// Pextrw VPEXTRW r32, xmm, imm8 (66 0F C5)
+func (a *AVX) Pextrw() {
+	reg := a.reg
+	modrm := a.decode(avxFloat)
+	a.only128()
+	a.noSource()
+	if modrm.Mod != 3 {
+		raise(ExceptionUD)
+	}
+	value := reg.XMM[modrm.Rm].lane(uint(a.sse.imm8()&7), 16)
+	modrm.SetR32(uint32(value))
+}
+
+// Pmovmskb VPMOVMSKB r32, xmm/ymm (66 0F D7)
+func (a *AVX) Pmovmskb() {
+	reg := a.reg
+	modrm := a.decode(avxInteger)
+	a.noSource()
+	if modrm.Mod != 3 {
+		raise(ExceptionUD)
+	}
+	src := reg.YMM(modrm.Rm)
+	var mask uint32
+	for q := 0; q < 2*a.halves(); q++ {
+		mask |= byteSigns(src[q]) << (8 * uint(q))
+	}
+	modrm.SetR32(mask)
+}
+
+// Shufps VSHUFPS xmm/ymm, xmm/ymm, r/m, imm8 (0F C6): each half like SHUFPS
+func (a *AVX) Shufps() {
+	reg := a.reg
+	modrm := a.decode(avxFloat)
+	src1 := a.src1()
+	src2 := a.read(&modrm, a.size(), false)
+	order := a.sse.imm8()
+	var result YMM
+	for h := 0; h < a.halves(); h++ {
+		result.setHalf(h, shuffleDwords(src1.half(h), src2.half(h), order))
+	}
+	reg.SetYMM(modrm.RegIndex, result)
+}
+
+// Shufpd VSHUFPD xmm/ymm, xmm/ymm, r/m, imm8 (66 0F C6): two bits of imm8 per half
+func (a *AVX) Shufpd() {
+	reg := a.reg
+	modrm := a.decode(avxFloat)
+	src1 := a.src1()
+	src2 := a.read(&modrm, a.size(), false)
+	order := a.sse.imm8()
+	var result YMM
+	for h := 0; h < a.halves(); h++ {
+		bits := order >> (2 * uint(h))
+		result.setHalf(h, XMM{src1[2*h+int(bits&1)], src2[2*h+int(bits>>1&1)]})
+	}
+	reg.SetYMM(modrm.RegIndex, result)
+}
+
+// Zeroupper VZEROUPPER (VEX.L0 0F 77) clears bits 255:128 of the registers, VZEROALL
+// (VEX.L1) clears them whole
+func (a *AVX) Zeroupper() {
+	reg := a.reg
+	a.check(avxFloat)
+	a.noSource()
+	reg.EIP += 1
+	for i := 0; i < reg.vectorRegisters(); i++ {
+		if reg.vex.l == 1 {
+			reg.XMM[i] = XMM{}
+		}
+		reg.YMMH[i] = XMM{}
+	}
+}
+
+// Group15 VLDMXCSR (VEX 0F AE /2) and VSTMXCSR (/3)
+func (a *AVX) Group15() {
+	reg := a.reg
+	modrm := a.decode(avxFloat)
+	a.only128()
+	a.noSource()
+	if modrm.Mod == 3 {
+		raise(ExceptionUD)
+	}
+	switch modrm.Opcode {
+	case 2:
+		value := readDword(a.mem, modrm.linear(4, false))
+		if value&^mxcsrMask != 0 {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		reg.MXCSR = value
+	case 3:
+		writeDword(a.mem, modrm.linear(4, true), reg.MXCSR)
+	default:
+		raise(ExceptionUD)
+	}
+}
@@ -0,0 +1,204 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+// dwords a YMM register from its eight doubleword lanes, the low one first
+func dwords(d ...uint32) YMM {
+	var y YMM
+	for i, v := range d {
+		y.setLane(uint(i), 32, uint64(v))
+	}
+	return y
+}
+
+// avxCPU a flat 32-bit CPU running code at 0x1000 with the SSE and AVX state enabled by
+// CR4 and XCR0; data goes at 0x1800
+func avxCPU(t *testing.T, code []byte) (*Emulator, *CPU) {
+	t.Helper()
+	emu := newBare(t, 32, code)
+	cpu := emu.cpu.(*CPU)
+	cpu.reg.CR4 |= CR4OSFXSR | CR4OSXMMEXCPT | CR4OSXSAVE
+	cpu.reg.XCR0 = xstateX87 | xstateSSE | xstateAVX
+	return emu, cpu
+}
+
+func TestAVX(t *testing.T) {
+	counting := dwords(1, 2, 3, 4, 5, 6, 7, 8)
+	tens := dwords(10, 20, 30, 40, 50, 60, 70, 80)
+	table := []uint32{100, 101, 102, 103, 104, 105, 106, 107}
+	tests := []struct {
+		name  string
+		code  []byte
+		setup func(reg *X86Registers)
+		in    map[uint8]YMM
+		data  []uint32 // at 0x1800
+		want  map[uint8]YMM
+		err   string
+	}{
+		{"vpaddd ymm", []byte{0xc5, 0xf5, 0xfe, 0xc2}, // vpaddd %ymm2,%ymm1,%ymm0
+			nil, map[uint8]YMM{1: counting, 2: tens}, nil,
+			map[uint8]YMM{0: dwords(11, 22, 33, 44, 55, 66, 77, 88)}, ""},
+		// a 128-bit VEX result clears the upper half, a legacy SSE one keeps it
+		{"vaddps xmm", []byte{0xc5, 0xf0, 0x58, 0xc2}, // vaddps %xmm2,%xmm1,%xmm0
+			nil, map[uint8]YMM{0: {^uint64(0), ^uint64(0), ^uint64(0), ^uint64(0)},
+				1: dwords(0x3f800000, 0x3f800000, 0x3f800000, 0x3f800000),
+				2: dwords(0x40000000, 0x40000000, 0x40000000, 0x40000000)}, nil,
+			map[uint8]YMM{0: dwords(0x40400000, 0x40400000, 0x40400000, 0x40400000)}, ""},
+		{"addps", []byte{0x0f, 0x58, 0xc1}, // addps %xmm1,%xmm0
+			nil, map[uint8]YMM{0: dwords(0x3f800000, 0x3f800000, 0x3f800000, 0x3f800000, 9, 9, 9, 9),
+				1: dwords(0x40000000, 0x40000000, 0x40000000, 0x40000000)}, nil,
+			map[uint8]YMM{0: dwords(0x40400000, 0x40400000, 0x40400000, 0x40400000, 9, 9, 9, 9)}, ""},
+		{"vpermd", []byte{0xc4, 0xe2, 0x75, 0x36, 0xc2}, // vpermd %ymm2,%ymm1,%ymm0
+			nil, map[uint8]YMM{1: dwords(7, 6, 5, 4, 3, 2, 1, 8), 2: tens}, nil,
+			map[uint8]YMM{0: dwords(80, 70, 60, 50, 40, 30, 20, 10)}, ""},
+		{"vpermq", []byte{0xc4, 0xe3, 0xfd, 0x00, 0xc1, 0x1b}, // vpermq $0x1b,%ymm1,%ymm0
+			nil, map[uint8]YMM{1: {1, 2, 3, 4}}, nil,
+			map[uint8]YMM{0: {4, 3, 2, 1}}, ""},
+		{"vperm2i128", []byte{0xc4, 0xe3, 0x75, 0x46, 0xc2, 0x31}, // vperm2i128 $0x31,%ymm2,%ymm1,%ymm0
+			nil, map[uint8]YMM{1: {1, 2, 3, 4}, 2: {5, 6, 7, 8}}, nil,
+			map[uint8]YMM{0: {3, 4, 7, 8}}, ""},
+		{"vperm2i128 zero", []byte{0xc4, 0xe3, 0x75, 0x46, 0xc2, 0x28}, // vperm2i128 $0x28,%ymm2,%ymm1,%ymm0
+			nil, map[uint8]YMM{1: {1, 2, 3, 4}, 2: {5, 6, 7, 8}}, nil,
+			map[uint8]YMM{0: {0, 0, 5, 6}}, ""},
+		{"vbroadcastss", []byte{0xc4, 0xe2, 0x7d, 0x18, 0x05, 0x00, 0x18, 0x00, 0x00}, // vbroadcastss 0x1800,%ymm0
+			nil, nil, []uint32{0x12345678},
+			map[uint8]YMM{0: dwords(0x12345678, 0x12345678, 0x12345678, 0x12345678,
+				0x12345678, 0x12345678, 0x12345678, 0x12345678)}, ""},
+		{"vextracti128", []byte{0xc4, 0xe3, 0x7d, 0x39, 0xc8, 0x01}, // vextracti128 $1,%ymm1,%xmm0
+			nil, map[uint8]YMM{0: {9, 9, 9, 9}, 1: {1, 2, 3, 4}}, nil,
+			map[uint8]YMM{0: {3, 4, 0, 0}}, ""},
+		{"vinserti128", []byte{0xc4, 0xe3, 0x75, 0x38, 0xc2, 0x01}, // vinserti128 $1,%xmm2,%ymm1,%ymm0
+			nil, map[uint8]YMM{1: {1, 2, 3, 4}, 2: {5, 6, 7, 8}}, nil,
+			map[uint8]YMM{0: {1, 2, 5, 6}}, ""},
+		// the shuffle stays within each 128-bit lane
+		{"vpshufd", []byte{0xc5, 0xfd, 0x70, 0xc1, 0x1b}, // vpshufd $0x1b,%ymm1,%ymm0
+			nil, map[uint8]YMM{1: counting}, nil,
+			map[uint8]YMM{0: dwords(4, 3, 2, 1, 8, 7, 6, 5)}, ""},
+		{"vpsllvd", []byte{0xc4, 0xe2, 0x75, 0x47, 0xc2}, // vpsllvd %ymm2,%ymm1,%ymm0
+			nil, map[uint8]YMM{1: dwords(1, 1, 1, 1, 1, 1, 1, 1), 2: dwords(0, 1, 2, 3, 31, 32, 33, 4)}, nil,
+			map[uint8]YMM{0: dwords(1, 2, 4, 8, 0x80000000, 0, 0, 16)}, ""},
+		{"vblendvps", []byte{0xc4, 0xe3, 0x75, 0x4a, 0xc2, 0x30}, // vblendvps %ymm3,%ymm2,%ymm1,%ymm0
+			nil, map[uint8]YMM{1: counting, 2: tens,
+				3: dwords(0x80000000, 0, 0x80000000, 0, 0x80000000, 0, 0x80000000, 0)}, nil,
+			map[uint8]YMM{0: dwords(10, 2, 30, 4, 50, 6, 70, 8)}, ""},
+		// lanes whose mask has the sign bit set are loaded, the others kept; the mask is cleared
+		{"vpgatherdd", []byte{0xc4, 0xe2, 0x6d, 0x90, 0x04, 0x8d, 0x00, 0x18, 0x00, 0x00}, // vpgatherdd %ymm2,0x1800(,%ymm1,4),%ymm0
+			nil, map[uint8]YMM{0: counting, 1: dwords(7, 6, 5, 4, 3, 2, 1, 0),
+				2: dwords(0x80000000, 0, 0x80000000, 0, 0x80000000, 0, 0x80000000, 0)}, table,
+			map[uint8]YMM{0: dwords(107, 2, 105, 4, 103, 6, 101, 8), 2: {}}, ""},
+		{"vpgatherdd same register", []byte{0xc4, 0xe2, 0x7d, 0x90, 0x04, 0x8d, 0x00, 0x18, 0x00, 0x00}, // vpgatherdd %ymm0,0x1800(,%ymm1,4),%ymm0
+			nil, nil, nil, nil, "#UD"},
+		// masked-off lanes read as zero
+		{"vmaskmovps", []byte{0xc4, 0xe2, 0x75, 0x2c, 0x05, 0x00, 0x18, 0x00, 0x00}, // vmaskmovps 0x1800,%ymm1,%ymm0
+			nil, map[uint8]YMM{0: counting, 1: dwords(^uint32(0), 0, ^uint32(0), 0, 0, 0, 0, 0x80000000)}, table,
+			map[uint8]YMM{0: dwords(100, 0, 102, 0, 0, 0, 0, 107)}, ""},
+		{"vzeroupper", []byte{0xc5, 0xf8, 0x77}, // vzeroupper
+			nil, map[uint8]YMM{0: {1, 2, 3, 4}, 7: {5, 6, 7, 8}}, nil,
+			map[uint8]YMM{0: {1, 2, 0, 0}, 7: {5, 6, 0, 0}}, ""},
+		{"vzeroall", []byte{0xc5, 0xfc, 0x77}, // vzeroall
+			nil, map[uint8]YMM{0: {1, 2, 3, 4}, 7: {5, 6, 7, 8}}, nil,
+			map[uint8]YMM{0: {}, 7: {}}, ""},
+		// VEX.L on an instruction without a 256-bit form
+		{"vmovd vex.l", []byte{0xc5, 0xfd, 0x6e, 0xc0}, // vmovd %eax,%xmm0 with VEX.L
+			nil, nil, nil, nil, "#UD"},
+		// a 66, F2, F3 or LOCK prefix before VEX is #UD
+		{"66 vex", []byte{0x66, 0xc5, 0xf5, 0xfe, 0xc2}, nil, nil, nil, nil, "#UD"},
+		{"f3 vex", []byte{0xf3, 0xc5, 0xf5, 0xfe, 0xc2}, nil, nil, nil, nil, "#UD"},
+		{"lock vex", []byte{0xf0, 0xc5, 0xf5, 0xfe, 0xc2}, nil, nil, nil, nil, "#UD"},
+		// XCR0 and CR4.OSXSAVE gate every VEX instruction
+		{"xcr0 without avx", []byte{0xc5, 0xf5, 0xfe, 0xc2},
+			func(reg *X86Registers) { reg.XCR0 = xstateX87 | xstateSSE }, nil, nil, nil, "#UD"},
+		{"cr4 without osxsave", []byte{0xc5, 0xf5, 0xfe, 0xc2},
+			func(reg *X86Registers) { reg.CR4 &^= CR4OSXSAVE }, nil, nil, nil, "#UD"},
+		{"cr0.ts", []byte{0xc5, 0xf5, 0xfe, 0xc2},
+			func(reg *X86Registers) { reg.CR0 |= CR0TS }, nil, nil, nil, "#NM"},
+	}
+	for _, test := range tests {
+		emu, cpu := avxCPU(t, append(test.code, 0xf4))
+		reg := cpu.reg
+		for i, v := range test.data {
+			cpu.mem.Write32(0x1800+uint32(i)*4, v)
+		}
+		for i, y := range test.in {
+			reg.SetYMM(i, y)
+		}
+		if test.setup != nil {
+			test.setup(reg)
+		}
+		err := emu.Run()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for i, want := range test.want {
+			if got := reg.YMM(i); got != want {
+				t.Errorf("%s: YMM%d = %016X, want %016X", test.name, i, got, want)
+			}
+		}
+	}
+}
+
+// VEX only exists in protected mode: in real mode C4 and C5 are LES and LDS, and their
+// register forms are #UD
+func TestVEXRealMode(t *testing.T) {
+	emu := newBare(t, 16, []byte{0xc4, 0x06, 0x00, 0x7e, 0xf4}) // les ax, [0x7e00]
+	cpu := emu.cpu.(*CPU)
+	cpu.reg.CR4 |= CR4OSXSAVE
+	cpu.reg.XCR0 = xstateX87 | xstateSSE | xstateAVX
+	cpu.mem.Write32(0x7e00, 0x56781234)
+	if err := emu.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if reg := cpu.reg; uint16(reg.EAX) != 0x1234 || reg.ES != 0x5678 {
+		t.Errorf("AX, ES = %04X, %04X, want 1234, 5678", uint16(reg.EAX), reg.ES)
+	}
+	if _, err := runBare(t, 16, []byte{0xc5, 0xf5, 0xfe, 0xc2, 0xf4}); err == nil ||
+		!strings.Contains(err.Error(), "#UD") {
+		t.Errorf("c5 f5 fe c2: error %v, want #UD", err)
+	}
+}
+
+// CPUID reports AVX and AVX2 only along with XSAVE, and OSXSAVE from CR4
+func TestAVXFeatures(t *testing.T) {
+	tests := []struct {
+		name    string
+		leaf1   uint32
+		osxsave bool
+		want    uint32
+	}{
+		{"xsave", FeatureXSAVE | FeatureAVX, false, FeatureXSAVE | FeatureAVX},
+		{"osxsave", FeatureXSAVE | FeatureAVX, true, FeatureXSAVE | FeatureAVX | FeatureOSXSAVE},
+		{"no xsave", FeatureAVX, true, 0},
+	}
+	for _, test := range tests {
+		profile := &Profile{Name: test.name, Vendor: "GenuineIntel", Family: 6, MaxLeaf: 0xd,
+			Features: Features{Leaf1EDX: FeatureFPU | FeatureFXSR | FeatureSSE | FeatureSSE2,
+				Leaf1ECX: test.leaf1, Leaf7EBX: FeatureAVX2}}
+		emu, err := NewEmulator(32, 0x1000, 0x2000, make([]byte, 0x1000), false, WithProfile(profile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reg := emu.cpu.(*CPU).reg
+		if test.osxsave {
+			reg.CR4 |= CR4OSXSAVE
+		}
+		_, _, ecx, _ := cpuid(reg, 1, 0)
+		_, ebx, _, _ := cpuid(reg, 7, 0)
+		mask := uint32(FeatureXSAVE | FeatureAVX | FeatureOSXSAVE)
+		if ecx&mask != test.want {
+			t.Errorf("%s: leaf 1 ECX = %#x, want %#x", test.name, ecx&mask, test.want)
+		}
+		if avx2 := ebx&FeatureAVX2 != 0; avx2 != (test.want&FeatureAVX != 0) {
+			t.Errorf("%s: AVX2 reported %v", test.name, avx2)
+		}
+	}
+}
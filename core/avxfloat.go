@@ -0,0 +1,104 @@
+package core
+
+// VEX forms of the SIMD floating-point instructions. Packed forms work on both halves of a
+// YMM register, scalar ones take the upper lanes of the result from src1.
+
+// Arith VADD, VSUB, VMUL, VDIV, VMIN, VMAX, VSQRT, VRCP and VRSQRT on the lanes of shape
+// (0F 51-53, 58, 59, 5C-5F). The packed unary forms have no src1.
+func (a *AVX) Arith(op uint8, shape vecShape) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		halves, size := a.halves(), a.size()
+		if shape.scalar {
+			halves, size = 1, shape.size()
+		} else if op >= simdSqrt {
+			a.noSource()
+		}
+		src1 := a.src1()
+		src2 := a.read(&modrm, size, false)
+		var result YMM
+		var flags uint16
+		for h := 0; h < halves; h++ {
+			r, f := a.sse.arithLanes(op, shape, src1.half(h), src2.half(h))
+			result.setHalf(h, r)
+			flags |= f
+		}
+		a.sse.signal(flags)
+		reg.SetYMM(modrm.RegIndex, result)
+	}
+}
+
+// Cmp VCMPPS, VCMPPD, VCMPSS and VCMPSD xmm/ymm, xmm/ymm, r/m, imm8 (0F C2) with the 32
+// predicates of imm8
+func (a *AVX) Cmp(shape vecShape) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		halves, size := a.halves(), a.size()
+		if shape.scalar {
+			halves, size = 1, shape.size()
+		}
+		src1 := a.src1()
+		src2 := a.read(&modrm, size, false)
+		predicate := a.sse.imm8() & 31
+		var result YMM
+		var flags uint16
+		for h := 0; h < halves; h++ {
+			r, f := a.sse.compareLanes(predicate, shape, src1.half(h), src2.half(h))
+			result.setHalf(h, r)
+			flags |= f
+		}
+		a.sse.signal(flags)
+		reg.SetYMM(modrm.RegIndex, result)
+	}
+}
+
+// Comis VCOMISS, VCOMISD, VUCOMISS and VUCOMISD xmm, xmm/m (0F 2E, 2F)
+func (a *AVX) Comis(width uint, quiet bool) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		a.noSource()
+		src := a.read(&modrm, uint32(width/8), false)
+		a.sse.compareFlags(width, quiet, reg.XMM[modrm.RegIndex].lane(0, width), src.lane(0, width))
+	}
+}
+
+// Convert the VEX forms of the XMM and general register conversions (0F 2A, 2C, 2D, 5A,
+// 5B, E6). VEX.L doubles the lanes of the packed ones; scalar results merge into src1.
+func (a *AVX) Convert(c conversion) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		c := c.widen(&modrm)
+		count, size := c.count, c.size
+		if c.count > 1 && reg.vex.l == 1 {
+			count, size = 2*count, 2*size
+		}
+		if !c.merge {
+			a.noSource()
+		}
+		var src YMM
+		if c.src == operandGPR {
+			src = YMM{modrm.GetRMW()}
+		} else {
+			src = a.read(&modrm, size, false)
+		}
+		result, flags := a.sse.convertLanes(c, count, src)
+		a.sse.signal(flags)
+		switch {
+		case c.dst == operandGPR:
+			modrm.SetRW(result[0])
+		case c.merge:
+			merged := a.register(reg.vex.vvvv, 16)
+			merged.setLane(0, c.to, result.lane(0, c.to))
+			reg.SetYMM(modrm.RegIndex, merged)
+		default:
+			if count*c.to <= 128 {
+				result[2], result[3] = 0, 0
+			}
+			reg.SetYMM(modrm.RegIndex, result)
+		}
+	}
+}
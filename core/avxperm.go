@@ -0,0 +1,373 @@
+package core
+
+// AVX and AVX2 instructions of the 0F38 and 0F3A maps: permutes, blends, broadcasts, masked
+// moves, variable shifts and gathers
+
+// Permilvar VPERMILPS and VPERMILPD xmm/ymm, xmm/ymm, r/m (66 0F38 0C, 0D): each lane of a
+// half selected from the same half of src1 by the low bits of the r/m lane
+func (a *AVX) Permilvar(width uint) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		a.w0()
+		n := 128 / width
+		reg.SetYMM(modrm.RegIndex, a.lanes128(&modrm, func(x XMM, y XMM, h int) XMM {
+			var r XMM
+			for i := uint(0); i < n; i++ {
+				selector := y.lane(i, width)
+				if width == 64 {
+					selector >>= 1
+				}
+				r.setLane(i, width, x.lane(uint(selector)&(n-1), width))
+			}
+			return r
+		}))
+	}
+}
+
+// PermilImm VPERMILPS and VPERMILPD xmm/ymm, r/m, imm8 (66 0F3A 04, 05): VPERMILPS selects
+// with two bits of imm8 per lane in both halves, VPERMILPD with one bit per lane
+func (a *AVX) PermilImm(width uint) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		a.w0()
+		a.noSource()
+		src := a.read(&modrm, a.size(), false)
+		order := a.sse.imm8()
+		var result YMM
+		for h := 0; h < a.halves(); h++ {
+			x := src.half(h)
+			if width == 32 {
+				result.setHalf(h, shuffleDwords(x, x, order))
+				continue
+			}
+			bits := order >> (2 * uint(h))
+			result.setHalf(h, XMM{x[bits&1], x[bits>>1&1]})
+		}
+		reg.SetYMM(modrm.RegIndex, result)
+	}
+}
+
+// Test VTESTPS and VTESTPD xmm/ymm, r/m (66 0F38 0E, 0F): ZF when the sign bits of the
+// AND of the operands are clear, CF when those of the ANDN are; the other flags clear
+func (a *AVX) Test(width uint) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		a.w0()
+		a.noSource()
+		dst := a.register(modrm.RegIndex, a.size())
+		src := a.read(&modrm, a.size(), false)
+		var and, andn uint64
+		for q := 0; q < 2*a.halves(); q++ {
+			and |= dst[q] & src[q]
+			andn |= ^dst[q] & src[q]
+		}
+		sign := uint64(1)<<63 | uint64(1)<<(width-1)
+		var flags uint32
+		if and&sign == 0 {
+			flags |= FlagZF
+		}
+		if andn&sign == 0 {
+			flags |= FlagCF
+		}
+		reg.setEFlags(flags, FlagZF|FlagPF|FlagCF|FlagOF|FlagSF|FlagAF)
+	}
+}
+
+// Perm VPERMD and VPERMPS ymm, ymm, ymm/m256 (66 0F38 36, 16): each dword of the r/m operand
+// selected across the register by the low three bits of the dword of src1
+func (a *AVX) Perm() {
+	reg := a.reg
+	modrm := a.decode(avx2)
+	a.w0()
+	a.only256()
+	index := a.src1()
+	src := a.read(&modrm, 32, false)
+	var result YMM
+	for i := uint(0); i < 8; i++ {
+		result.setLane(i, 32, src.lane(uint(index.lane(i, 32)&7), 32))
+	}
+	reg.SetYMM(modrm.RegIndex, result)
+}
+
+// PermQ VPERMQ and VPERMPD ymm, ymm/m256, imm8 (66 0F3A 00, 01): each quadword selected by
+// two bits of imm8
+func (a *AVX) PermQ() {
+	reg := a.reg
+	modrm := a.decode(avx2)
+	if !reg.vex.w {
+		raise(ExceptionUD)
+	}
+	a.only256()
+	a.noSource()
+	src := a.read(&modrm, 32, false)
+	order := a.sse.imm8()
+	var result YMM
+	for i := uint(0); i < 4; i++ {
+		result[i] = src[order>>(2*i)&3]
+	}
+	reg.SetYMM(modrm.RegIndex, result)
+}
+
+// Perm2x128 VPERM2F128 and VPERM2I128 ymm, ymm, ymm/m256, imm8 (66 0F3A 06, 46): each half
+// of the result is the half of src1 or r/m selected by imm8 bits 1:0 and 5:4, or zero
+// with bit 3 or 7
+func (a *AVX) Perm2x128(kind int) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(kind)
+		a.w0()
+		a.only256()
+		src1 := a.src1()
+		src2 := a.read(&modrm, 32, false)
+		control := a.sse.imm8()
+		halves := [4]XMM{src1.half(0), src1.half(1), src2.half(0), src2.half(1)}
+		var result YMM
+		for h := 0; h < 2; h++ {
+			bits := control >> (4 * uint(h))
+			if bits&8 == 0 {
+				result.setHalf(h, halves[bits&3])
+			}
+		}
+		reg.SetYMM(modrm.RegIndex, result)
+	}
+}
+
+// Insert128 VINSERTF128 and VINSERTI128 ymm, ymm, xmm/m128, imm8 (66 0F3A 18, 38): src1
+// with the half selected by imm8 bit 0 replaced
+func (a *AVX) Insert128(kind int) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(kind)
+		a.w0()
+		a.only256()
+		src := a.read(&modrm, 16, false)
+		result := a.src1()
+		result.setHalf(int(a.sse.imm8()&1), src.half(0))
+		reg.SetYMM(modrm.RegIndex, result)
+	}
+}
+
+// Extract128 VEXTRACTF128 and VEXTRACTI128 xmm/m128, ymm, imm8 (66 0F3A 19, 39)
+func (a *AVX) Extract128(kind int) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(kind)
+		a.w0()
+		a.only256()
+		a.noSource()
+		src := reg.YMM(modrm.RegIndex)
+		half := src.half(int(a.sse.imm8() & 1))
+		a.write(&modrm, 16, false, YMM{half[0], half[1]})
+	}
+}
+
+// Blendd VPBLENDD xmm/ymm, xmm/ymm, r/m, imm8 (66 0F3A 02): dword i from r/m when imm8 bit i
+// is set, else from src1
+func (a *AVX) Blendd() {
+	reg := a.reg
+	modrm := a.decode(avx2)
+	a.w0()
+	result := a.register(reg.vex.vvvv, a.size())
+	src := a.read(&modrm, a.size(), false)
+	mask := a.sse.imm8()
+	for i := uint(0); i < uint(a.size()/4); i++ {
+		if mask>>i&1 != 0 {
+			result.setLane(i, 32, src.lane(i, 32))
+		}
+	}
+	reg.SetYMM(modrm.RegIndex, result)
+}
+
+// Blendv VBLENDVPS and VBLENDVPD xmm/ymm, xmm/ymm, r/m, xmm/ymm (66 0F3A 4A, 4B): lanes
+// from r/m where the sign bit of the lane of the register in imm8 bits 7:4 is set
+func (a *AVX) Blendv(width uint) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avxFloat)
+		a.w0()
+		result := a.register(reg.vex.vvvv, a.size())
+		src := a.read(&modrm, a.size(), false)
+		mask := reg.YMM(a.sse.imm8() >> 4 & 7)
+		for i := uint(0); i < uint(a.size()*8)/width; i++ {
+			if mask.lane(i, width)>>(width-1) != 0 {
+				result.setLane(i, width, src.lane(i, width))
+			}
+		}
+		reg.SetYMM(modrm.RegIndex, result)
+	}
+}
+
+// Broadcast VBROADCASTSS, VBROADCASTSD, VBROADCASTF128, VPBROADCASTB/W/D/Q and
+// VBROADCASTI128 (66 0F38 18-1A, 58-5A, 78, 79): the low lane of width bits of the source
+// in every lane. Register sources need AVX2 and do not exist for the 128-bit broadcasts;
+// wide ones have no 128-bit form.
+func (a *AVX) Broadcast(kind int, width uint, wide bool) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(kind)
+		a.w0()
+		a.noSource()
+		if wide {
+			a.only256()
+		}
+		if modrm.Mod == 3 {
+			if width == 128 {
+				raise(ExceptionUD)
+			}
+			a.check(avx2)
+		}
+		src := a.read(&modrm, uint32(width/8), false)
+		if width == 128 {
+			reg.SetYMM(modrm.RegIndex, YMM{src[0], src[1], src[0], src[1]})
+			return
+		}
+		var result YMM
+		for i := uint(0); i < uint(a.size()*8)/width; i++ {
+			result.setLane(i, width, src.lane(0, width))
+		}
+		reg.SetYMM(modrm.RegIndex, result)
+	}
+}
+
+// elementWidth the width of the integer elements selected by VEX.W
+func (a *AVX) elementWidth() uint {
+	if a.reg.vex.w {
+		return 64
+	}
+	return 32
+}
+
+// MaskMov VMASKMOVPS, VMASKMOVPD, VPMASKMOVD and VPMASKMOVQ (66 0F38 2C-2F, 8C, 8E): moves
+// the lanes whose src1 mask lane has its sign bit set. Loads clear the other lanes; lanes
+// left out never fault. Width 0 takes the integer width from VEX.W.
+func (a *AVX) MaskMov(kind int, width uint, store bool) func() {
+	return func() {
+		reg := a.reg
+		mem := a.mem
+		modrm := a.decode(kind)
+		if width == 0 {
+			width = a.elementWidth()
+		} else {
+			a.w0()
+		}
+		if modrm.Mod == 3 {
+			raise(ExceptionUD)
+		}
+		mask := a.src1()
+		offset, segment := modrm.calcOffset()
+		segment = reg.dataSegment(segment)
+		var base uint64
+		if modrm.long {
+			base = reg.dataBase() + modrm.offset64()
+		}
+		bytes := uint32(width / 8)
+		data := a.register(modrm.RegIndex, a.size())
+		var result YMM
+		for i := uint(0); i < uint(a.size())/uint(bytes); i++ {
+			if mask.lane(i, width)>>(width-1) == 0 {
+				continue
+			}
+			address := modrm.element(base+uint64(i)*uint64(bytes), segment, offset+uint32(i)*bytes, bytes, store)
+			if store {
+				if width == 64 {
+					writeQword(mem, address, data.lane(i, 64))
+				} else {
+					writeDword(mem, address, uint32(data.lane(i, 32)))
+				}
+				continue
+			}
+			if width == 64 {
+				result.setLane(i, 64, readQword(mem, address))
+			} else {
+				result.setLane(i, 32, uint64(readDword(mem, address)))
+			}
+		}
+		if !store {
+			reg.SetYMM(modrm.RegIndex, result)
+		}
+	}
+}
+
+// ShiftVar VPSRLVD/Q, VPSRAVD and VPSLLVD/Q xmm/ymm, xmm/ymm, r/m (66 0F38 45-47): each lane
+// of src1 shifted by the count in the lane of r/m
+func (a *AVX) ShiftVar(kind uint8) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decode(avx2)
+		width := a.elementWidth()
+		if kind == shiftRightArithmetic && width == 64 {
+			raise(ExceptionUD)
+		}
+		src1 := a.src1()
+		counts := a.read(&modrm, a.size(), false)
+		var result YMM
+		for i := uint(0); i < uint(a.size()*8)/width; i++ {
+			result.setLane(i, width, shiftLanes(src1.lane(i, width), counts.lane(i, width), width, kind))
+		}
+		reg.SetYMM(modrm.RegIndex, result)
+	}
+}
+
+// Gather VPGATHERDD/DQ/QD/QQ and VGATHERDPS/DPD/QPS/QPD (66 0F38 90-93): loads the elements
+// whose mask lane in VEX.vvvv has its sign bit set from base + index*scale, the indexes
+// being the dwords or quadwords of the vector register in the SIB index. Each element
+// loaded clears its mask lane, so a fault leaves a restartable state; the mask ends up
+// cleared. Destination, index and mask must be distinct registers.
+func (a *AVX) Gather(indexWidth uint) func() {
+	return func() {
+		reg := a.reg
+		mem := a.mem
+		modrm := a.decode(avx2)
+		if modrm.Mod == 3 || modrm.Rm != 4 || modrm.Address16 {
+			raise(ExceptionUD)
+		}
+		dst, index, maskReg := modrm.RegIndex, modrm.Sib>>3&7|reg.rex&2<<2, reg.vex.vvvv
+		if dst == index || dst == maskReg || index == maskReg {
+			raise(ExceptionUD)
+		}
+		width := a.elementWidth()
+		count := uint(a.size()*8) / width
+		if indexWidth > width {
+			count = uint(a.size()*8) / indexWidth
+		}
+		base, segment := modrm.sibBase()
+		segment = reg.dataSegment(segment)
+		var base64 uint64
+		if modrm.long {
+			base64 = reg.dataBase() + modrm.sibBase64()
+		}
+		scale := modrm.Sib >> 6
+		indexes := reg.YMM(index)
+		bytes := uint32(width / 8)
+		for i := uint(0); i < count; i++ {
+			mask := reg.YMM(maskReg)
+			if mask.lane(i, width)>>(width-1) == 0 {
+				continue
+			}
+			displacement := indexes.lane(i, indexWidth)
+			if indexWidth == 32 {
+				displacement = uint64(int64(int32(displacement)))
+			}
+			address := modrm.element(base64+displacement<<scale, segment,
+				base+uint32(displacement)<<scale, bytes, false)
+			value := uint64(readDword(mem, address))
+			if width == 64 {
+				value = readQword(mem, address)
+			}
+			result := reg.YMM(dst)
+			result.setLane(i, width, value)
+			reg.SetYMM(dst, result)
+			mask.setLane(i, width, 0)
+			reg.SetYMM(maskReg, mask)
+		}
+		reg.SetYMM(maskReg, YMM{})
+		result := reg.YMM(dst)
+		for i := count; i < 256/width; i++ {
+			result.setLane(i, width, 0)
+		}
+		reg.SetYMM(dst, result)
+	}
+}
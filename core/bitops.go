@@ -0,0 +1,447 @@
+package core
+
+import "math/bits"
+
+// Bit test, bit scan, double shift and bit count instructions, and the VEX-encoded BMI1
+// and BMI2 instructions on the general registers. The legacy forms take their operand
+// size from the table they are installed in.
+
+// Bit test operations, the /4-/7 of group 8
+const (
+	bitTestOnly  = 4 // BT
+	bitTestSet   = 5 // BTS
+	bitTestReset = 6 // BTR
+	bitTestFlip  = 7 // BTC
+)
+
+func getRM(modrm *ModRM, width uint) uint32 {
+	switch width {
+	case 8:
+		return uint32(modrm.GetRM8())
+	case 16:
+		return uint32(modrm.GetRM16())
+	}
+	return modrm.GetRM32()
+}
+
+func setRM(modrm *ModRM, width uint, value uint32) {
+	switch width {
+	case 8:
+		modrm.SetRM8(uint8(value))
+	case 16:
+		modrm.SetRM16(uint16(value))
+	default:
+		modrm.SetRM32(value)
+	}
+}
+
+func getR(modrm *ModRM, width uint) uint32 {
+	switch width {
+	case 8:
+		return uint32(modrm.GetR8())
+	case 16:
+		return uint32(modrm.GetR16())
+	}
+	return modrm.GetR32()
+}
+
+func setR(modrm *ModRM, width uint, value uint32) {
+	switch width {
+	case 8:
+		modrm.SetR8(uint8(value))
+	case 16:
+		modrm.SetR16(uint16(value))
+	default:
+		modrm.SetR32(value)
+	}
+}
+
+// resultFlags ZF, SF and PF of a result of width bits
+func resultFlags(result uint64, width uint) uint32 {
+	var flags uint32
+	result &= laneMask(width)
+	if result == 0 {
+		flags |= FlagZF
+	}
+	if result>>(width-1) != 0 {
+		flags |= FlagSF
+	}
+	if bits.OnesCount8(uint8(result))%2 == 0 {
+		flags |= FlagPF
+	}
+	return flags
+}
+
+func carryFlag(carry bool) uint32 {
+	if carry {
+		return FlagCF
+	}
+	return 0
+}
+
+// bitChange applies the bit test operation op to bit of value, returning the old bit
+func bitChange(value uint32, bit uint, op uint8) (uint32, bool) {
+	old := value>>bit&1 != 0
+	switch op {
+	case bitTestSet:
+		value |= 1 << bit
+	case bitTestReset:
+		value &^= 1 << bit
+	case bitTestFlip:
+		value ^= 1 << bit
+	}
+	return value, old
+}
+
+// bitTest BT, BTS, BTR and BTC r/m, r (0F A3, AB, B3, BB): CF is the selected bit, which
+// BTS sets, BTR clears and BTC complements. With a memory operand the bit offset in the
+// register is signed and may select any operand relative to the effective address.
+func (a *ALU) bitTest(width uint, op uint8) func() {
+	return func() {
+		reg := a.reg
+		mem := a.mem
+		reg.EIP += 1
+		modrm := NewModRM(reg, mem)
+		offset := getR(&modrm, width)
+		if modrm.Mod == 3 {
+			a.bitTestRM(&modrm, width, op, uint(offset)%width)
+			return
+		}
+		displacement := int32(offset)
+		if width == 16 {
+			displacement = int32(int16(offset))
+		}
+		effective, segment := modrm.calcOffset()
+		effective += uint32(displacement>>bits.TrailingZeros(width)) * uint32(width/8)
+		if modrm.Address16 {
+			effective &= 0xffff
+		}
+		address := reg.segmentAddress(reg.dataSegment(segment), effective, uint32(width/8), op != bitTestOnly)
+		var value uint32
+		if width == 16 {
+			value = uint32(mem.Read16(address))
+		} else {
+			value = mem.Read32(address)
+		}
+		result, old := bitChange(value, uint(offset)%width, op)
+		if op != bitTestOnly {
+			if width == 16 {
+				mem.Write16(address, uint16(result))
+			} else {
+				mem.Write32(address, result)
+			}
+		}
+		reg.setEFlags(carryFlag(old), FlagCF)
+	}
+}
+
+// bitTestRM the bit test operation op on bit of the r/m operand itself
+func (a *ALU) bitTestRM(modrm *ModRM, width uint, op uint8, bit uint) {
+	reg := a.reg
+	result, old := bitChange(getRM(modrm, width), bit, op)
+	if op != bitTestOnly {
+		setRM(modrm, width, result)
+	}
+	reg.setEFlags(carryFlag(old), FlagCF)
+}
+
+// group8 BT, BTS, BTR and BTC r/m, imm8 (0F BA /4-/7): the offset is taken modulo the
+// operand size
+func (a *ALU) group8(width uint) func() {
+	return func() {
+		reg := a.reg
+		mem := a.mem
+		reg.EIP += 1
+		modrm := NewModRM(reg, mem)
+		if modrm.Opcode < bitTestOnly {
+			raise(ExceptionUD)
+		}
+		bit := uint(mem.GetCode8(0)) % width
+		reg.EIP += 1
+		a.bitTestRM(&modrm, width, modrm.Opcode, bit)
+	}
+}
+
+// bitScan BSF and BSR r, r/m (0F BC, BD): the index of the lowest or highest set bit. A zero
+// source sets ZF and leaves the destination alone. With F3, processors with BMI1 or ABM run
+// TZCNT and LZCNT instead.
+func (a *ALU) bitScan(width uint, reverse bool) func() {
+	return func() {
+		reg := a.reg
+		if reg.repPrefix == 0xf3 && (!reverse && reg.features().Leaf7EBX&FeatureBMI1 != 0 ||
+			reverse && reg.features().ExtECX&FeatureABM != 0) {
+			a.countZeros(width, reverse)
+			return
+		}
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		src := getRM(&modrm, width)
+		if src == 0 {
+			reg.setEFlags(FlagZF, FlagZF)
+			return
+		}
+		index := bits.TrailingZeros32(src)
+		if reverse {
+			index = 31 - bits.LeadingZeros32(src)
+		}
+		setR(&modrm, width, uint32(index))
+		reg.setEFlags(0, FlagZF)
+	}
+}
+
+// countZeros TZCNT and LZCNT r, r/m (F3 0F BC, BD): the operand size for a zero source,
+// which sets CF; ZF for a zero count
+func (a *ALU) countZeros(width uint, leading bool) {
+	reg := a.reg
+	reg.EIP += 1
+	modrm := NewModRM(reg, a.mem)
+	src := getRM(&modrm, width)
+	count := uint32(bits.TrailingZeros32(src | 1<<width))
+	if leading {
+		count = uint32(bits.LeadingZeros32(src)) - uint32(32-width)
+	}
+	setR(&modrm, width, count)
+	var flags uint32
+	if count == 0 {
+		flags |= FlagZF
+	}
+	reg.setEFlags(flags|carryFlag(src == 0), FlagZF|FlagCF)
+}
+
+// popcnt POPCNT r, r/m (F3 0F B8): ZF for a zero source, the other flags cleared. 0F B8
+// without F3 is JMPE, which only exists on the Itanium.
+func (a *ALU) popcnt(width uint) func() {
+	return func() {
+		reg := a.reg
+		if reg.repPrefix != 0xf3 || reg.features().Leaf1ECX&FeaturePOPCNT == 0 {
+			raise(ExceptionUD)
+		}
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		src := getRM(&modrm, width)
+		setR(&modrm, width, uint32(bits.OnesCount32(src)))
+		var flags uint32
+		if src == 0 {
+			flags = FlagZF
+		}
+		reg.setEFlags(flags, FlagZF|FlagSF|FlagPF|FlagCF|FlagOF|FlagAF)
+	}
+}
+
+// doubleShift SHLD and SHRD r/m, r, imm8/CL (0F A4, A5, AC, AD): shifts r/m, filling the
+// vacated bits from r. The count is taken modulo 32 and a zero count changes nothing; 16-bit
+// counts above 16 give an undefined result.
+func (a *ALU) doubleShift(width uint, left bool, immediate bool) func() {
+	return func() {
+		reg := a.reg
+		mem := a.mem
+		reg.EIP += 1
+		modrm := NewModRM(reg, mem)
+		count := uint(reg.Get8ByIndex(1))
+		if immediate {
+			count = uint(mem.GetCode8(0))
+			reg.EIP += 1
+		}
+		count &= 31
+		dst := uint64(getRM(&modrm, width))
+		if count == 0 {
+			return
+		}
+		src := uint64(getR(&modrm, width))
+		var result uint64
+		var carry bool
+		if left {
+			wide := dst<<width | src
+			result = wide << count >> width
+			carry = wide>>(2*width-count)&1 != 0
+		} else {
+			wide := src<<width | dst
+			result = wide >> count
+			carry = wide>>(count-1)&1 != 0
+		}
+		result &= laneMask(width)
+		setRM(&modrm, width, uint32(result))
+		flags := resultFlags(result, width) | carryFlag(carry)
+		if (result^dst)>>(width-1)&1 != 0 {
+			flags |= FlagOF
+		}
+		reg.setEFlags(flags, FlagZF|FlagSF|FlagPF|FlagCF|FlagOF)
+	}
+}
+
+// decodeBMI checks a VEX-encoded BMI instruction and decodes its ModRM byte, returning it
+// with the operand size: 64 bits with VEX.W in 64-bit mode, 32 otherwise. They work on the
+// general registers, so need neither CR4.OSXSAVE nor the AVX state; VEX.L raises #UD.
+func (a *ALU) decodeBMI(feature uint32) (ModRM, uint) {
+	reg := a.reg
+	if reg.features().Leaf7EBX&feature == 0 || reg.vex.l != 0 {
+		raise(ExceptionUD)
+	}
+	reg.EIP += 1
+	modrm := NewModRM(reg, a.mem)
+	if modrm.wide() {
+		return modrm, 64
+	}
+	return modrm, 32
+}
+
+// vvvv the general register in VEX.vvvv, one of 16 in 64-bit mode
+func (a *ALU) vvvv(width uint) uint64 {
+	reg := a.reg
+	if reg.mode64 {
+		return reg.X64.Get(reg.vex.vvvv, width, true)
+	}
+	return uint64(reg.GetByIndex(reg.vex.vvvv))
+}
+
+// setVvvv writes the general register in VEX.vvvv
+func (a *ALU) setVvvv(width uint, value uint64) {
+	reg := a.reg
+	if reg.mode64 {
+		reg.X64.Set(reg.vex.vvvv, width, true, value)
+		return
+	}
+	reg.SetByIndex(reg.vex.vvvv, uint32(value))
+}
+
+// logicFlags sets SF, ZF and PF from result, CF as given and clears OF
+func (a *ALU) logicFlags(result uint64, width uint, carry bool) {
+	a.reg.setEFlags(resultFlags(result, width)|carryFlag(carry), FlagZF|FlagSF|FlagPF|FlagCF|FlagOF)
+}
+
+// andn ANDN r, r, r/m (VEX 0F38 F2): NOT vvvv AND r/m
+func (a *ALU) andn() {
+	modrm, width := a.decodeBMI(FeatureBMI1)
+	result := ^a.vvvv(width) & modrm.GetRMW() & laneMask(width)
+	modrm.SetRW(result)
+	a.logicFlags(result, width, false)
+}
+
+// bextr BEXTR r, r/m, r (VEX 0F38 F7): the field of r/m starting at bit 7:0 of vvvv with
+// the length in bits 15:8
+func (a *ALU) bextr() {
+	modrm, width := a.decodeBMI(FeatureBMI1)
+	control := a.vvvv(width)
+	start, length := uint(control&0xff), uint(control>>8&0xff)
+	var result uint64
+	if start < width {
+		result = modrm.GetRMW() >> start
+		if length < width {
+			result &= 1<<length - 1
+		}
+	}
+	modrm.SetRW(result)
+	a.logicFlags(result, width, false)
+}
+
+// group17 BLSR (/1), BLSMSK (/2) and BLSI (/3) vvvv, r/m (VEX 0F38 F3): clear, mask up to,
+// or isolate the lowest set bit
+func (a *ALU) group17() {
+	modrm, width := a.decodeBMI(FeatureBMI1)
+	src := modrm.GetRMW()
+	var result uint64
+	switch modrm.Opcode {
+	case 1:
+		result = src & (src - 1)
+	case 2:
+		result = src ^ (src - 1)
+	case 3:
+		result = src & -src
+	default:
+		raise(ExceptionUD)
+	}
+	result &= laneMask(width)
+	a.setVvvv(width, result)
+	a.logicFlags(result, width, (src == 0) != (modrm.Opcode == 3))
+}
+
+// bzhi BZHI r, r/m, r (VEX 0F38 F5): clears the bits of r/m from the index in bits 7:0 of
+// vvvv; CF when the index is beyond the operand
+func (a *ALU) bzhi() {
+	modrm, width := a.decodeBMI(FeatureBMI2)
+	index := uint(a.vvvv(width) & 0xff)
+	result := modrm.GetRMW()
+	if index < width {
+		result &= 1<<index - 1
+	}
+	modrm.SetRW(result)
+	a.logicFlags(result, width, index >= width)
+}
+
+// pdep PDEP r, r, r/m (F2 VEX 0F38 F5): the low bits of vvvv deposited at the set bits of
+// the r/m mask
+func (a *ALU) pdep() {
+	modrm, width := a.decodeBMI(FeatureBMI2)
+	src, mask := a.vvvv(width), modrm.GetRMW()
+	var result uint64
+	for m := mask; m != 0; m &= m - 1 {
+		if src&1 != 0 {
+			result |= m & -m
+		}
+		src >>= 1
+	}
+	modrm.SetRW(result)
+}
+
+// pext PEXT r, r, r/m (F3 VEX 0F38 F5): the bits of vvvv at the set bits of the r/m mask,
+// packed into the low bits
+func (a *ALU) pext() {
+	modrm, width := a.decodeBMI(FeatureBMI2)
+	src, mask := a.vvvv(width), modrm.GetRMW()
+	var result uint64
+	bit := uint(0)
+	for m := mask; m != 0; m &= m - 1 {
+		if src&(m&-m) != 0 {
+			result |= 1 << bit
+		}
+		bit++
+	}
+	modrm.SetRW(result)
+}
+
+// mulx MULX r, r, r/m (F2 VEX 0F38 F6): rDX times r/m, the high half to r and the low half
+// to vvvv, without touching the flags
+func (a *ALU) mulx() {
+	reg := a.reg
+	modrm, width := a.decodeBMI(FeatureBMI2)
+	if width == 64 {
+		high, low := bits.Mul64(reg.X64.RDX, modrm.GetRM64())
+		a.setVvvv(width, low)
+		modrm.SetR64(high)
+		return
+	}
+	edx := uint64(reg.EDX)
+	if reg.mode64 {
+		edx = reg.X64.RDX & 0xffffffff
+	}
+	result := edx * modrm.GetRMW()
+	a.setVvvv(width, result&0xffffffff)
+	modrm.SetRW(result >> 32)
+}
+
+// rorx RORX r, r/m, imm8 (F2 VEX 0F3A F0): rotates without touching the flags
+func (a *ALU) rorx() {
+	reg := a.reg
+	modrm, width := a.decodeBMI(FeatureBMI2)
+	if reg.vex.vvvv != 0 {
+		raise(ExceptionUD)
+	}
+	src := modrm.GetRMW()
+	count := uint(a.mem.GetCode8(0)) & (width - 1)
+	reg.EIP += 1
+	if width == 64 {
+		modrm.SetRW(bits.RotateLeft64(src, -int(count)))
+		return
+	}
+	modrm.SetRW(uint64(bits.RotateLeft32(uint32(src), -int(count))))
+}
+
+// shiftx SARX, SHLX and SHRX r, r/m, r (F3, 66 and F2 VEX 0F38 F7): shifts by vvvv modulo
+// the operand size without touching the flags
+func (a *ALU) shiftx(kind uint8) func() {
+	return func() {
+		modrm, width := a.decodeBMI(FeatureBMI2)
+		count := a.vvvv(width) & uint64(width-1)
+		modrm.SetRW(shiftLanes(modrm.GetRMW(), count, width, kind))
+	}
+}
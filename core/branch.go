@@ -17,7 +17,7 @@ func (b *Branch) JoRel8() {
 	diff := uint32(2)
 	if reg.IsOF() {
 		mem := b.mem
-		diff += uint32(mem.GetCode8(1))
+		diff += uint32(mem.GetSignCode8(1))
 	}
 	reg.EIP += diff
 }
@@ -27,7 +27,7 @@ func (b *Branch) JnoRel8() {
 	diff := uint32(2)
 	if !reg.IsOF() {
 		mem := b.mem
-		diff += uint32(mem.GetCode8(1))
+		diff += uint32(mem.GetSignCode8(1))
 	}
 	reg.EIP += diff
 }
@@ -37,7 +37,7 @@ func (b *Branch) JcRel8() {
 	diff := uint32(2)
 	if reg.IsCF() {
 		mem := b.mem
-		diff += uint32(mem.GetCode8(1))
+		diff += uint32(mem.GetSignCode8(1))
 	}
 	reg.EIP += diff
 }
@@ -47,7 +47,7 @@ func (b *Branch) JncRel8() {
 	diff := uint32(2)
 	if !reg.IsCF() {
 		mem := b.mem
-		diff += uint32(mem.GetCode8(1))
+		diff += uint32(mem.GetSignCode8(1))
 	}
 	reg.EIP += diff
 }
@@ -57,7 +57,7 @@ func (b *Branch) JzRel8() {
 	diff := uint32(2)
 	if reg.IsZF() {
 		mem := b.mem
-		diff += uint32(mem.GetCode8(1))
+		diff += uint32(mem.GetSignCode8(1))
 	}
 	reg.EIP += diff
 }
@@ -67,7 +67,7 @@ func (b *Branch) JnzRel8() {
 	diff := uint32(2)
 	if !reg.IsZF() {
 		mem := b.mem
-		diff += uint32(mem.GetCode8(1))
+		diff += uint32(mem.GetSignCode8(1))
 	}
 	reg.EIP += diff
 }
@@ -97,7 +97,7 @@ func (b *Branch) JsRel8() {
 	diff := uint32(2)
 	if reg.IsSF() {
 		mem := b.mem
-		diff += uint32(mem.GetCode8(1))
+		diff += uint32(mem.GetSignCode8(1))
 	}
 	reg.EIP += diff
 }
@@ -107,7 +107,7 @@ func (b *Branch) JnsRel8() {
 	diff := uint32(2)
 	if !reg.IsSF() {
 		mem := b.mem
-		diff += uint32(mem.GetCode8(1))
+		diff += uint32(mem.GetSignCode8(1))
 	}
 	reg.EIP += diff
 }
@@ -117,7 +117,7 @@ func (b *Branch) JlRel8() {
 	diff := uint32(2)
 	if reg.IsSF() != reg.IsOF() {
 		mem := b.mem
-		diff += uint32(mem.GetCode8(1))
+		diff += uint32(mem.GetSignCode8(1))
 	}
 	reg.EIP += diff
 }
@@ -127,7 +127,7 @@ func (b *Branch) JleRel8() {
 	diff := uint32(2)
 	if reg.IsZF() || (reg.IsSF() != reg.IsOF()) {
 		mem := b.mem
-		diff += uint32(mem.GetCode8(1))
+		diff += uint32(mem.GetSignCode8(1))
 	}
 	reg.EIP += diff
 }
@@ -149,8 +149,8 @@ func (b *Branch) JmpRel16() {
 func (b *Branch) JmpRel8() {
 	reg := b.reg
 	mem := b.mem
-	diff := mem.GetCode8(1)
-	reg.EIP += uint32(diff + 2)
+	diff := mem.GetSignCode8(1)
+	reg.EIP += uint32(diff) + 2
 }
 
 func (b *Branch) Ret32() {
@@ -198,3 +198,428 @@ func (b *Branch) CallRel16() {
 	mem.Push16(uint16(reg.EIP + 3))
 	reg.EIP += uint32(diff) + 3
 }
+
+func (b *Branch) JmpFar16() {
+	reg := b.reg
+	mem := b.mem
+	offset := mem.GetCode16(1)
+	selector := mem.GetCode16(3)
+	b.jumpFar(selector, uint32(offset), reg.EIP+5)
+}
+
+func (b *Branch) JmpFar32() {
+	reg := b.reg
+	mem := b.mem
+	offset := mem.GetCode32(1)
+	selector := mem.GetCode16(5)
+	b.jumpFar(selector, offset, reg.EIP+7)
+}
+
+func (b *Branch) CallFar16() {
+	reg := b.reg
+	mem := b.mem
+	offset := mem.GetCode16(1)
+	selector := mem.GetCode16(3)
+	b.callFar(selector, uint32(offset), 2, reg.EIP+5)
+}
+
+func (b *Branch) CallFar32() {
+	reg := b.reg
+	mem := b.mem
+	offset := mem.GetCode32(1)
+	selector := mem.GetCode16(5)
+	b.callFar(selector, offset, 4, reg.EIP+7)
+}
+
+func (b *Branch) RetFar16() {
+	b.returnFar(2, 0)
+}
+
+func (b *Branch) RetFar32() {
+	b.returnFar(4, 0)
+}
+
+// RetFarImm16b16 RETF imm16 (CA): releases imm16 bytes of parameters from the stack
+func (b *Branch) RetFarImm16b16() {
+	mem := b.mem
+	b.returnFar(2, uint32(mem.GetCode16(1)))
+}
+
+func (b *Branch) RetFarImm16b32() {
+	mem := b.mem
+	b.returnFar(4, uint32(mem.GetCode16(1)))
+}
+
+// farTarget reads the descriptor referenced by the selector of a far JMP or CALL
+func (b *Branch) farTarget(selector uint16) (uint32, Descriptor) {
+	reg := b.reg
+	mem := b.mem
+	if selector&^3 == 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	address := descriptorAddress(reg, selector)
+	return address, readDescriptor(mem, address)
+}
+
+// callGate checks a call gate and the code segment it refers to
+func (b *Branch) callGate(selector uint16, address uint32) (Gate, uint32, Descriptor) {
+	reg := b.reg
+	mem := b.mem
+	cpl := reg.CPL()
+	gate := readGate(mem, address)
+	errorCode := uint32(selector &^ 3)
+	if gate.DPL() < cpl || gate.DPL() < uint8(selector&3) {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	if !gate.IsPresent() {
+		raiseWithCode(ExceptionNP, errorCode)
+	}
+	codeAddress, desc := b.farTarget(gate.Selector)
+	codeError := uint32(gate.Selector &^ 3)
+	if !desc.IsCode() || desc.DPL() > cpl {
+		raiseWithCode(ExceptionGP, codeError)
+	}
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionNP, codeError)
+	}
+	if !gate.Is32() {
+		gate.Offset &= 0xffff
+	}
+	if gate.Offset > desc.Limit {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	return gate, codeAddress, desc
+}
+
+func isCallGate(desc *Descriptor) bool {
+	return desc.IsSystem() && (desc.Type() == descCallGate16 || desc.Type() == descCallGate32)
+}
+
+// taskTransfer JMP or CALL to a TSS descriptor or to a task gate. The current task is
+// saved with EIP pointing to next.
+func (b *Branch) taskTransfer(selector uint16, address uint32, desc Descriptor, next uint32, source taskSource) {
+	reg := b.reg
+	mem := b.mem
+	cpl := reg.CPL()
+	errorCode := uint32(selector &^ 3)
+	if desc.DPL() < cpl || desc.DPL() < uint8(selector&3) {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	switch {
+	case desc.isTSS():
+	case desc.Type() == descTaskGate:
+		if !desc.IsPresent() {
+			raiseWithCode(ExceptionNP, errorCode)
+		}
+		selector = readGate(mem, address).Selector
+		address, desc = taskDescriptor(reg, mem, selector, ExceptionGP)
+	default:
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	reg.EIP = next
+	switchTask(reg, mem, selector, address, desc, source)
+}
+
+// jumpFar JMP to selector:offset: a code segment, a call gate, a TSS or a task gate
+func (b *Branch) jumpFar(selector uint16, offset uint32, next uint32) {
+	reg := b.reg
+	mem := b.mem
+	if reg.realSegments() {
+		reg.loadRealModeSegment(SegCS, selector)
+		reg.EIP = offset
+		return
+	}
+	cpl := reg.CPL()
+	address, desc := b.farTarget(selector)
+	if isCallGate(&desc) {
+		gate, codeAddress, code := b.callGate(selector, address)
+		// a jump never changes the privilege level
+		if !code.IsConforming() && code.DPL() != cpl {
+			raiseWithCode(ExceptionGP, uint32(gate.Selector&^3))
+		}
+		setCodeSegment(reg, mem, gate.Selector, codeAddress, code, cpl)
+		reg.EIP = gate.Offset
+		return
+	}
+	if desc.IsSystem() {
+		b.taskTransfer(selector, address, desc, next, taskJump)
+		return
+	}
+	checkCodeTarget(&desc, selector, cpl)
+	if offset > desc.Limit {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	setCodeSegment(reg, mem, selector, address, desc, cpl)
+	reg.EIP = offset
+}
+
+// callFar CALL to selector:offset pushing the return address next with size bytes slots.
+// A TSS or a task gate starts a nested task instead.
+// A call gate to a more privileged non-conforming segment switches to the stack saved in
+// the TSS and copies the gate parameters to it.
+func (b *Branch) callFar(selector uint16, offset uint32, size uint32, next uint32) {
+	reg := b.reg
+	mem := b.mem
+	if reg.realSegments() {
+		b.pushReturn(size, uint32(reg.CS), next)
+		reg.loadRealModeSegment(SegCS, selector)
+		reg.EIP = offset
+		return
+	}
+	cpl := reg.CPL()
+	address, desc := b.farTarget(selector)
+	if !isCallGate(&desc) {
+		if desc.IsSystem() {
+			b.taskTransfer(selector, address, desc, next, taskCall)
+			return
+		}
+		checkCodeTarget(&desc, selector, cpl)
+		if offset > desc.Limit {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		b.pushReturn(size, uint32(reg.CS), next)
+		setCodeSegment(reg, mem, selector, address, desc, cpl)
+		reg.EIP = offset
+		return
+	}
+
+	gate, codeAddress, code := b.callGate(selector, address)
+	size = 2
+	if gate.Is32() {
+		size = 4
+	}
+	if code.IsConforming() || code.DPL() == cpl {
+		b.pushReturn(size, uint32(reg.CS), next)
+		setCodeSegment(reg, mem, gate.Selector, codeAddress, code, cpl)
+		reg.EIP = gate.Offset
+		return
+	}
+
+	newCPL := code.DPL()
+	ss, esp := tssStack(reg, mem, newCPL)
+	ssAddress, ssDesc := checkStackSegment(reg, mem, ss, newCPL, ExceptionTS)
+	params := make([]uint32, gate.ParamCount)
+	for i := range params {
+		params[i] = readStack(reg, mem, uint32(i)*size, size)
+	}
+	oldSS, oldESP, oldCS := reg.SS, reg.ESP, reg.CS
+	// the frame goes to the stack of the inner level, written at its privilege
+	defer mem.Implicit()()
+	setStackSegment(reg, mem, ss, ssAddress, ssDesc)
+	reg.ESP = esp
+	b.pushReturn(size, uint32(oldSS), oldESP)
+	for i := len(params) - 1; i >= 0; i-- {
+		b.push(size, params[i])
+	}
+	b.pushReturn(size, uint32(oldCS), next)
+	setCodeSegment(reg, mem, gate.Selector, codeAddress, code, newCPL)
+	reg.EIP = gate.Offset
+}
+
+func (b *Branch) push(size uint32, value uint32) {
+	mem := b.mem
+	if size == 4 {
+		mem.Push32(value)
+	} else {
+		mem.Push16(uint16(value))
+	}
+}
+
+// pushReturn pushes a far pointer: the selector first, then the offset
+func (b *Branch) pushReturn(size uint32, selector uint32, offset uint32) {
+	b.push(size, selector)
+	b.push(size, offset)
+}
+
+// returnFar RETF popping size bytes slots, then releasing release bytes of parameters.
+// A return to an outer privilege level also pops the outer SS:ESP.
+func (b *Branch) returnFar(size uint32, release uint32) {
+	reg := b.reg
+	mem := b.mem
+	eip := readStack(reg, mem, 0, size)
+	selector := uint16(readStack(reg, mem, size, size))
+	if reg.realSegments() {
+		reg.SetStackPointer(reg.StackPointer() + 2*size + release)
+		reg.loadRealModeSegment(SegCS, selector)
+		reg.EIP = eip
+		return
+	}
+
+	cpl := reg.CPL()
+	rpl := uint8(selector & 3)
+	errorCode := uint32(selector &^ 3)
+	if rpl < cpl {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	address, desc := b.farTarget(selector)
+	if !desc.IsCode() {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	if desc.IsConforming() && desc.DPL() > rpl || !desc.IsConforming() && desc.DPL() != rpl {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionNP, errorCode)
+	}
+	if eip > desc.Limit {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	if rpl == cpl {
+		reg.SetStackPointer(reg.StackPointer() + 2*size + release)
+		setCodeSegment(reg, mem, selector, address, desc, cpl)
+		reg.EIP = eip
+		return
+	}
+
+	esp := readStack(reg, mem, 2*size+release, size)
+	ss := uint16(readStack(reg, mem, 3*size+release, size))
+	ssAddress, ssDesc := checkStackSegment(reg, mem, ss, rpl, ExceptionGP)
+	setCodeSegment(reg, mem, selector, address, desc, rpl)
+	reg.EIP = eip
+	setStackSegment(reg, mem, ss, ssAddress, ssDesc)
+	reg.SetStackPointer(esp + release)
+	clearOuterSegments(reg)
+}
+
+// RetImm16b16 RET imm16 (C2): releases imm16 bytes of parameters from the stack
+func (b *Branch) RetImm16b16() {
+	b.returnNear(2)
+}
+
+func (b *Branch) RetImm16b32() {
+	b.returnNear(4)
+}
+
+func (b *Branch) returnNear(size uint32) {
+	reg := b.reg
+	mem := b.mem
+	release := uint32(mem.GetCode16(1))
+	eip := readStack(reg, mem, 0, size)
+	reg.SetStackPointer(reg.StackPointer() + size + release)
+	reg.EIP = eip
+}
+
+// jcc Jcc rel8 (70-7F) and Jcc rel16/rel32 (0F 80-8F); a 16-bit operand size keeps the
+// target within 64 KiB
+func (b *Branch) jcc(width uint, size uint) func() {
+	return func() {
+		reg := b.reg
+		mem := b.mem
+		cc := mem.GetCode8(0) & 0xf
+		var diff uint32
+		switch size {
+		case 1:
+			diff = uint32(mem.GetSignCode8(1))
+		case 2:
+			diff = uint32(mem.GetSignCode16(1))
+		default:
+			diff = mem.GetCode32(1)
+		}
+		next := reg.EIP + 1 + uint32(size)
+		if reg.condition(cc) {
+			next += diff
+		}
+		if width == 16 {
+			next &= 0xffff
+		}
+		reg.EIP = next
+	}
+}
+
+// loop LOOPNE, LOOPE and LOOP (E0-E2) decrement eCX, of the address size, without changing
+// the flags; JCXZ and JECXZ (E3) test it
+func (b *Branch) loop(width uint) func() {
+	return func() {
+		reg := b.reg
+		mem := b.mem
+		code := mem.GetCode8(0)
+		mask := reg.addressMask()
+		count := reg.ECX & mask
+		if code != 0xe3 {
+			count = (count - 1) & mask
+			reg.ECX = reg.ECX&^mask | count
+		}
+		var taken bool
+		switch code {
+		case 0xe0:
+			taken = count != 0 && !reg.IsZF()
+		case 0xe1:
+			taken = count != 0 && reg.IsZF()
+		case 0xe2:
+			taken = count != 0
+		default:
+			taken = count == 0
+		}
+		next := reg.EIP + 2
+		if taken {
+			next += uint32(mem.GetSignCode8(1))
+		}
+		if width == 16 {
+			next &= 0xffff
+		}
+		reg.EIP = next
+	}
+}
+
+// group5 INC, DEC, CALL, CALL far, JMP, JMP far and PUSH r/m (FF)
+func (b *Branch) group5(width uint) func() {
+	return func() {
+		reg := b.reg
+		mem := b.mem
+		reg.EIP += 1
+		modrm := NewModRM(reg, mem)
+		size := uint32(width / 8)
+		switch modrm.Opcode {
+		case 0, 1:
+			incDecRM(reg, &modrm, width)
+		case 2:
+			target := getRM(&modrm, width)
+			b.push(size, reg.EIP)
+			reg.EIP = target
+		case 3, 5:
+			if modrm.Mod == 3 {
+				raise(ExceptionUD)
+			}
+			address := modrm.calcAddress(size+2, false)
+			offset := readOperand(mem, address, width)
+			selector := mem.Read16(address + size)
+			if modrm.Opcode == 3 {
+				b.callFar(selector, offset, size, reg.EIP)
+			} else {
+				b.jumpFar(selector, offset, reg.EIP)
+			}
+		case 4:
+			reg.EIP = getRM(&modrm, width)
+		case 6:
+			b.push(size, getRM(&modrm, width))
+		default:
+			raise(ExceptionUD)
+		}
+	}
+}
+
+// enter ENTER imm16, imm8 (C8): pushes eBP, copies the frame pointers of imm8-1 enclosing
+// procedures and reserves imm16 bytes for the new frame
+func (b *Branch) enter(width uint) func() {
+	return func() {
+		reg := b.reg
+		mem := b.mem
+		defer keepStack(reg)()
+		reserve := uint32(mem.GetCode16(1))
+		level := uint32(mem.GetCode8(3)) % 32
+		size := uint32(width / 8)
+		b.push(size, reg.EBP)
+		frame := reg.StackPointer()
+		if level > 0 {
+			pointer := reg.EBP & reg.stackMask()
+			for i := uint32(1); i < level; i++ {
+				pointer = (pointer - size) & reg.stackMask()
+				b.push(size, readOperand(mem, reg.segmentAddress(SegSS, pointer, size, false), width))
+			}
+			b.push(size, frame)
+		}
+		reg.setRegister(5, width, frame)
+		reg.SetStackPointer(reg.StackPointer() - reserve)
+		reg.EIP += 4
+	}
+}
@@ -6,33 +6,56 @@ import (
 )
 
 type CPU struct {
-	mem      IMemory
-	reg      *X86Registers
-	debug    bool
-	instrSet [0x100]func()
-	stack    *Stack
-	branch   *Branch
-	transfer *Transfer
-	io       *IO
-	alu      *ALU
+	mem          IMemory
+	reg          *X86Registers
+	debug        bool
+	instrSet16   [0x100]func()
+	instrSet32   [0x100]func()
+	instrSet0F16 [0x100]func()
+	instrSet0F32 [0x100]func()
+	instrSet0F38 [0x100]func()
+	instrSet0F3A [0x100]func()
+	instrSetVEX  [3][0x100]func() // 0F, 0F38 and 0F3A maps
+	instrSet64   [0x100]func()
+	instrSet0F64 [0x100]func()
+	stack        *Stack
+	branch       *Branch
+	transfer     *Transfer
+	io           *IO
+	alu          *ALU
+	system       *System
+	interrupt    *Interrupt
+	fpu          *FPU
+	mmx          *MMX
+	sse          *SSE
+	avx          *AVX
+	long         *Long
 }
 
-func NewCPU(reg *X86Registers, mem IMemory, bitMode int, debug bool) *CPU {
+func NewCPU(reg *X86Registers, mem IMemory, debug bool) *CPU {
 	cpu := &CPU{
-		mem:      mem,
-		reg:      reg,
-		debug:    debug,
-		stack:    NewStack(reg, mem),
-		branch:   NewBranch(reg, mem),
-		transfer: NewTransfer(reg, mem),
-		io:       NewIO(reg, mem),
-		alu:      NewALU(reg, mem),
-	}
-	if bitMode == 16 {
-		cpu.createTable16()
-	} else {
-		cpu.createTable32()
+		mem:       mem,
+		reg:       reg,
+		debug:     debug,
+		stack:     NewStack(reg, mem),
+		branch:    NewBranch(reg, mem),
+		transfer:  NewTransfer(reg, mem),
+		io:        NewIO(reg, mem),
+		alu:       NewALU(reg, mem),
+		system:    NewSystem(reg, mem),
+		interrupt: NewInterrupt(reg, mem),
+		fpu:       NewFPU(reg, mem),
+		mmx:       NewMMX(reg, mem),
+		sse:       NewSSE(reg, mem),
+		avx:       NewAVX(reg, mem),
+		long:      NewLong(reg, mem),
 	}
+	cpu.createTable16()
+	cpu.createTable32()
+	cpu.createTable0F()
+	cpu.createTable0F3()
+	cpu.createTableVEX()
+	cpu.createTable64()
 	return cpu
 }
 
@@ -41,271 +64,1114 @@ func (cpu *CPU) Init() error {
 	return nil
 }
 
-func (cpu *CPU) Exec(code uint8) error {
+// instrSet returns the opcode table for the operand size of the current instruction
+func (cpu *CPU) instrSet() *[0x100]func() {
+	reg := cpu.reg
+	if reg.IsCode32() != reg.opOverride {
+		return &cpu.instrSet32
+	}
+	return &cpu.instrSet16
+}
+
+// instrSet0F returns the two-byte opcode table for the operand size of the current instruction
+func (cpu *CPU) instrSet0F() *[0x100]func() {
+	reg := cpu.reg
+	if reg.IsCode32() != reg.opOverride {
+		return &cpu.instrSet0F32
+	}
+	return &cpu.instrSet0F16
+}
+
+// Step fetches and executes the instruction at CS:EIP, then delivers its debug traps
+func (cpu *CPU) Step() (err error) {
+	reg := cpu.reg
+	reg.syncMode()
+	if reg.mode64 {
+		return cpu.step64()
+	}
+	defer cpu.catch(reg.EIP, &err)
+	reg.retired++
+	cpu.instructionBreakpoint()
+	tf := reg.IsTF()
+	code := cpu.mem.GetCode8(0)
+	if err := cpu.Exec(code); err != nil {
+		return err
+	}
+	return cpu.debugTrap(tf)
+}
+
+func (cpu *CPU) Exec(code uint8) (err error) {
+	reg := cpu.reg
+	defer cpu.catch(reg.EIP, &err)
 	if cpu.debug {
-		log.Printf("EIP = 0x%X, Opcode = 0x%02X\n", cpu.reg.EIP, code)
+		log.Printf("CS:EIP = %04X:%X%s, Opcode = 0x%02X\n", reg.CS, reg.EIP, reg.codeSymbol(uint64(reg.EIP)), code)
 	}
-	if instr := cpu.instrSet[code]; instr == nil {
-		return fmt.Errorf("Not Implemented: 0x%x\n", code)
-	} else {
-		instr()
+	reg.resetPrefixes()
+	instr := cpu.instrSet()[code]
+	if instr == nil {
+		raise(ExceptionUD)
 	}
+	instr()
+	if !reg.IsCode32() {
+		reg.EIP &= 0xffff
+	}
+	if reg.CR0&CR0PG != 0 {
+		// linear addresses are checked by the page walk
+		return nil
+	}
+	address := reg.CodeAddress(0)
+	if address <= cpu.mem.GetAddressBase() {
+		return fmt.Errorf("No mapping area [reg.EIP]: 0x%X\n", address)
+	}
+	if uint32(cpu.mem.GetAddressEnd()) <= address {
+		return fmt.Errorf("No mapping area [mappingEnd]: 0x%X\n", address)
+	}
+	return nil
+}
+
+// catch delivers an exception raised by an instruction.
+// EIP is restored to the faulting instruction before the handler is called.
+func (cpu *CPU) catch(eip uint32, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	e, ok := r.(*Exception)
+	if !ok {
+		panic(r)
+	}
+	cpu.reg.EIP = eip
+	cpu.reg.pendingDB = 0
+	*err = cpu.exception(e)
+}
+
+// exception delivers e. An exception raised meanwhile is delivered instead, or escalates
+// to a double fault; a fault while delivering the double fault shuts the processor down
+// and resets it.
+func (cpu *CPU) exception(e *Exception) error {
+	reg := cpu.reg
+	first := e
+	for {
+		if cpu.debug {
+			log.Printf("Exception %s at %04X:%X%s\n", e.Error(), reg.CS, reg.ip(), reg.codeSymbol(reg.ip()))
+		}
+		if cpu.unhandled(e) {
+			return fmt.Errorf("Unhandled exception %s at %04X:%X%s\n", e.Error(), reg.CS, reg.ip(), reg.codeSymbol(reg.ip()))
+		}
+		fault := cpu.deliver(e)
+		if fault == nil {
+			return nil
+		}
+		switch {
+		case e.Vector == ExceptionDF:
+			cs, eip, symbol := reg.CS, reg.ip(), reg.codeSymbol(reg.ip())
+			cpu.reset()
+			return fmt.Errorf("Triple fault after %s at %04X:%X%s, processor reset\n", first.Error(), cs, eip, symbol)
+		case isDoubleFault(e.Vector, fault.Vector):
+			e = &Exception{Vector: ExceptionDF, HasErrorCode: true}
+		default:
+			e = fault
+		}
+	}
+}
+
+// unhandled tells if the real-mode vector of exception e still points to the default
+// handler of a bare-metal program, which would halt without a trace of the exception
+func (cpu *CPU) unhandled(e *Exception) bool {
 	reg := cpu.reg
-	if reg.EIP <= cpu.mem.GetAddressBase() {
-		return fmt.Errorf("No mapping area [reg.EIP]: 0x%X\n", reg.EIP)
+	if reg.personality != nil || !reg.IsRealMode() || e.Vector >= 32 {
+		return false
 	}
-	if uint32(cpu.mem.GetAddressEnd()) <= reg.EIP {
-		return fmt.Errorf("No mapping area [mappingEnd]: 0x%X\n", reg.EIP)
+	offset := uint32(e.Vector) * 4
+	if offset+3 > uint32(reg.IDTR.Limit) {
+		return false
 	}
+	ip := cpu.mem.Read16(reg.IDTR.Base + offset)
+	cs := cpu.mem.Read16(reg.IDTR.Base + offset + 2)
+	return uint32(cs)<<4+uint32(ip) == defaultHandler
+}
+
+// deliver calls the handler of e and returns the exception raised during the delivery.
+// The stack pointer and the register file are restored when the delivery fails, and so are
+// the stack segment and EFLAGS unless a task switch took place.
+func (cpu *CPU) deliver(e *Exception) (fault *Exception) {
+	reg := cpu.reg
+	esp := reg.ESP
+	mode64, rsp := reg.mode64, reg.X64.RSP
+	tr, flags := reg.TR, reg.EFlags
+	ss, ssCache := reg.SS, reg.Segments[SegSS]
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		f, ok := r.(*Exception)
+		if !ok {
+			panic(r)
+		}
+		reg.X64.RSP = rsp
+		reg.setMode64(mode64)
+		reg.ESP = esp
+		if reg.TR == tr {
+			reg.EFlags = flags
+			reg.SS, reg.Segments[SegSS] = ss, ssCache
+		}
+		fault = f
+	}()
+	cpu.interrupt.Deliver(e, false)
 	return nil
 }
 
+// reset puts the processor back in its power-on state, as the chipset does after a shutdown
+func (cpu *CPU) reset() {
+	cpu.reg.Reset()
+	cpu.mem.FlushTLB(false)
+	cpu.system.halted = false
+}
+
+// IsHalted HLT stopped the processor, or the program run in user mode has ended
+func (cpu *CPU) IsHalted() bool {
+	if p := cpu.reg.personality; p != nil && p.done() {
+		return true
+	}
+	return cpu.system.IsHalted()
+}
+
 func (cpu *CPU) Dump() {
 	cpu.reg.Dump()
 }
 
 func (cpu *CPU) createTable16() {
-	cpu.instrSet[0x00] = cpu.alu.addRM8R8
-	cpu.instrSet[0x01] = cpu.alu.addRM16R16
-	cpu.instrSet[0x02] = cpu.alu.addR8RM8
-	cpu.instrSet[0x03] = cpu.alu.addR16RM16
-	cpu.instrSet[0x04] = cpu.alu.addALImm8
-	cpu.instrSet[0x05] = cpu.alu.addAXImm16
-	cpu.instrSet[0x06] = cpu.stack.Push16ES
-	cpu.instrSet[0x07] = cpu.stack.Pop16ES
-	cpu.instrSet[0x08] = cpu.alu.orRM8R8
-	cpu.instrSet[0x09] = cpu.alu.orRM16R16
-	cpu.instrSet[0x0a] = cpu.alu.orR8RM8
-	cpu.instrSet[0x0b] = cpu.alu.orR16RM16
-	cpu.instrSet[0x0c] = cpu.alu.orALImm8
-	cpu.instrSet[0x0d] = cpu.alu.orAXImm16
-	cpu.instrSet[0x0e] = cpu.stack.Push16CS
-	cpu.instrSet[0x0f] = cpu.stack.Code0F16
-
-	cpu.instrSet[0x16] = cpu.stack.Push16SS
-	cpu.instrSet[0x17] = cpu.stack.Pop16SS
-	cpu.instrSet[0x1e] = cpu.stack.Push16DS
-	cpu.instrSet[0x1f] = cpu.stack.Pop16DS
-
-	cpu.instrSet[0x21] = cpu.alu.andRM16R16 //TODO VERIFY
-	cpu.instrSet[0x22] = cpu.alu.andR8RM8   //TODO VERIFY
-	cpu.instrSet[0x23] = cpu.alu.andR16RM16 //TODO VERIFY
-	cpu.instrSet[0x24] = cpu.alu.andALImm8  //TODO VERIFY
-	cpu.instrSet[0x25] = cpu.alu.andAXImm16 //TODO VERIFY
-
-	cpu.instrSet[0x28] = cpu.alu.subRM8R8 //TODO VERIFY
-	cpu.instrSet[0x29] = cpu.alu.subRM16R16
-	cpu.instrSet[0x2a] = cpu.alu.subR8RM8 //TODO VERIFY
-	cpu.instrSet[0x2b] = cpu.alu.subR16RM16
-	cpu.instrSet[0x2c] = cpu.alu.subALImm8 //TODO VERIFY
-	cpu.instrSet[0x2d] = cpu.alu.subAXImm16
-
-	cpu.instrSet[0x30] = cpu.alu.xorRM8R8 //TODO VERIFY
-	cpu.instrSet[0x31] = cpu.alu.xorRM16R16
-	cpu.instrSet[0x32] = cpu.alu.xorR8RM8 //TODO VERIFY
-	cpu.instrSet[0x33] = cpu.alu.xorR16RM16
-	cpu.instrSet[0x34] = cpu.alu.xorALImm8 //TODO VERIFY
-	cpu.instrSet[0x35] = cpu.alu.xorAXImm16
-
-	cpu.instrSet[0x3b] = cpu.alu.cmpR16RM16
-	cpu.instrSet[0x3c] = cpu.alu.cmpALImm8
-	cpu.instrSet[0x3d] = cpu.alu.cmpAXImm16
+	cpu.instrSet16[0x00] = cpu.alu.arith(0x00, 16)
+	cpu.instrSet16[0x01] = cpu.alu.arith(0x01, 16)
+	cpu.instrSet16[0x02] = cpu.alu.arith(0x02, 16)
+	cpu.instrSet16[0x03] = cpu.alu.arith(0x03, 16)
+	cpu.instrSet16[0x04] = cpu.alu.arith(0x04, 16)
+	cpu.instrSet16[0x05] = cpu.alu.arith(0x05, 16)
+	cpu.instrSet16[0x06] = cpu.stack.Push16ES
+	cpu.instrSet16[0x07] = cpu.stack.Pop16ES
+	cpu.instrSet16[0x08] = cpu.alu.arith(0x08, 16)
+	cpu.instrSet16[0x09] = cpu.alu.arith(0x09, 16)
+	cpu.instrSet16[0x0a] = cpu.alu.arith(0x0a, 16)
+	cpu.instrSet16[0x0b] = cpu.alu.arith(0x0b, 16)
+	cpu.instrSet16[0x0c] = cpu.alu.arith(0x0c, 16)
+	cpu.instrSet16[0x0d] = cpu.alu.arith(0x0d, 16)
+	cpu.instrSet16[0x0e] = cpu.stack.Push16CS
+	cpu.instrSet16[0x0f] = cpu.code0F
+	cpu.instrSet16[0x10] = cpu.alu.arith(0x10, 16)
+	cpu.instrSet16[0x11] = cpu.alu.arith(0x11, 16)
+	cpu.instrSet16[0x12] = cpu.alu.arith(0x12, 16)
+	cpu.instrSet16[0x13] = cpu.alu.arith(0x13, 16)
+	cpu.instrSet16[0x14] = cpu.alu.arith(0x14, 16)
+	cpu.instrSet16[0x15] = cpu.alu.arith(0x15, 16)
+	cpu.instrSet16[0x16] = cpu.stack.Push16SS
+	cpu.instrSet16[0x17] = cpu.stack.Pop16SS
+	cpu.instrSet16[0x18] = cpu.alu.arith(0x18, 16)
+	cpu.instrSet16[0x19] = cpu.alu.arith(0x19, 16)
+	cpu.instrSet16[0x1a] = cpu.alu.arith(0x1a, 16)
+	cpu.instrSet16[0x1b] = cpu.alu.arith(0x1b, 16)
+	cpu.instrSet16[0x1c] = cpu.alu.arith(0x1c, 16)
+	cpu.instrSet16[0x1d] = cpu.alu.arith(0x1d, 16)
+	cpu.instrSet16[0x1e] = cpu.stack.Push16DS
+	cpu.instrSet16[0x1f] = cpu.stack.Pop16DS
+	cpu.instrSet16[0x20] = cpu.alu.arith(0x20, 16)
+	cpu.instrSet16[0x21] = cpu.alu.arith(0x21, 16)
+	cpu.instrSet16[0x22] = cpu.alu.arith(0x22, 16)
+	cpu.instrSet16[0x23] = cpu.alu.arith(0x23, 16)
+	cpu.instrSet16[0x24] = cpu.alu.arith(0x24, 16)
+	cpu.instrSet16[0x25] = cpu.alu.arith(0x25, 16)
+	cpu.instrSet16[0x26] = cpu.overrideSegment(SegES)
+	cpu.instrSet16[0x27] = cpu.alu.decimalAdjust(false)
+	cpu.instrSet16[0x28] = cpu.alu.arith(0x28, 16)
+	cpu.instrSet16[0x29] = cpu.alu.arith(0x29, 16)
+	cpu.instrSet16[0x2a] = cpu.alu.arith(0x2a, 16)
+	cpu.instrSet16[0x2b] = cpu.alu.arith(0x2b, 16)
+	cpu.instrSet16[0x2c] = cpu.alu.arith(0x2c, 16)
+	cpu.instrSet16[0x2d] = cpu.alu.arith(0x2d, 16)
+	cpu.instrSet16[0x2e] = cpu.overrideSegment(SegCS)
+	cpu.instrSet16[0x2f] = cpu.alu.decimalAdjust(true)
+	cpu.instrSet16[0x30] = cpu.alu.arith(0x30, 16)
+	cpu.instrSet16[0x31] = cpu.alu.arith(0x31, 16)
+	cpu.instrSet16[0x32] = cpu.alu.arith(0x32, 16)
+	cpu.instrSet16[0x33] = cpu.alu.arith(0x33, 16)
+	cpu.instrSet16[0x34] = cpu.alu.arith(0x34, 16)
+	cpu.instrSet16[0x35] = cpu.alu.arith(0x35, 16)
+	cpu.instrSet16[0x36] = cpu.overrideSegment(SegSS)
+	cpu.instrSet16[0x37] = cpu.alu.asciiAdjust(false)
+	cpu.instrSet16[0x38] = cpu.alu.arith(0x38, 16)
+	cpu.instrSet16[0x39] = cpu.alu.arith(0x39, 16)
+	cpu.instrSet16[0x3a] = cpu.alu.arith(0x3a, 16)
+	cpu.instrSet16[0x3b] = cpu.alu.arith(0x3b, 16)
+	cpu.instrSet16[0x3c] = cpu.alu.arith(0x3c, 16)
+	cpu.instrSet16[0x3d] = cpu.alu.arith(0x3d, 16)
+	cpu.instrSet16[0x3e] = cpu.overrideSegment(SegDS)
+	cpu.instrSet16[0x3f] = cpu.alu.asciiAdjust(true)
 
 	for i := 0; i < 8; i++ {
-		cpu.instrSet[0x40+i] = cpu.alu.incR16
+		cpu.instrSet16[0x40+i] = cpu.alu.incDecR(16)
 	}
 
 	for i := 0; i < 8; i++ {
-		cpu.instrSet[0x48+i] = cpu.alu.decR16
+		cpu.instrSet16[0x48+i] = cpu.alu.incDecR(16)
 	}
 
 	for i := 0; i < 8; i++ {
-		cpu.instrSet[0x50+i] = cpu.stack.PushR16
+		cpu.instrSet16[0x50+i] = cpu.stack.PushR16
 	}
 
 	for i := 0; i < 8; i++ {
-		cpu.instrSet[0x58+i] = cpu.stack.PopR16
+		cpu.instrSet16[0x58+i] = cpu.stack.PopR16
 	}
 
-	cpu.instrSet[0x66] = cpu.overrideOperandTo32
-	cpu.instrSet[0x68] = cpu.stack.Push16Imm16
-	cpu.instrSet[0x6a] = cpu.stack.Push16Imm8
+	cpu.instrSet16[0x60] = cpu.stack.pusha(16)
+	cpu.instrSet16[0x61] = cpu.stack.popa(16)
+	cpu.instrSet16[0x64] = cpu.overrideSegment(SegFS)
+	cpu.instrSet16[0x65] = cpu.overrideSegment(SegGS)
+	cpu.instrSet16[0x66] = cpu.overrideOperand
+	cpu.instrSet16[0x67] = cpu.overrideAddress
+	cpu.instrSet16[0x68] = cpu.stack.Push16Imm16
+	cpu.instrSet16[0x69] = cpu.alu.imulImm(16, 2)
+	cpu.instrSet16[0x6a] = cpu.stack.Push16Imm8
+	cpu.instrSet16[0x6b] = cpu.alu.imulImm(16, 1)
 
-	cpu.instrSet[0x70] = cpu.branch.JoRel8
-	cpu.instrSet[0x71] = cpu.branch.JnoRel8
-	cpu.instrSet[0x72] = cpu.branch.JcRel8
-	cpu.instrSet[0x73] = cpu.branch.JncRel8
-	cpu.instrSet[0x74] = cpu.branch.JzRel8
-	cpu.instrSet[0x75] = cpu.branch.JnzRel8
-	cpu.instrSet[0x78] = cpu.branch.JsRel8
-	cpu.instrSet[0x79] = cpu.branch.JnsRel8
-	cpu.instrSet[0x7c] = cpu.branch.JlRel8
-	cpu.instrSet[0x7e] = cpu.branch.JleRel8
-	cpu.instrSet[0x83] = cpu.alu.code83b16
+	cpu.instrSet16[0x70] = cpu.branch.JoRel8
+	cpu.instrSet16[0x71] = cpu.branch.JnoRel8
+	cpu.instrSet16[0x72] = cpu.branch.JcRel8
+	cpu.instrSet16[0x73] = cpu.branch.JncRel8
+	cpu.instrSet16[0x74] = cpu.branch.JzRel8
+	cpu.instrSet16[0x75] = cpu.branch.JnzRel8
+	cpu.instrSet16[0x76] = cpu.branch.jcc(16, 1)
+	cpu.instrSet16[0x77] = cpu.branch.jcc(16, 1)
+	cpu.instrSet16[0x78] = cpu.branch.JsRel8
+	cpu.instrSet16[0x79] = cpu.branch.JnsRel8
+	cpu.instrSet16[0x7a] = cpu.branch.jcc(16, 1)
+	cpu.instrSet16[0x7b] = cpu.branch.jcc(16, 1)
+	cpu.instrSet16[0x7c] = cpu.branch.JlRel8
+	cpu.instrSet16[0x7d] = cpu.branch.jcc(16, 1)
+	cpu.instrSet16[0x7e] = cpu.branch.JleRel8
+	cpu.instrSet16[0x7f] = cpu.branch.jcc(16, 1)
+	cpu.instrSet16[0x80] = cpu.alu.group1(0x80, 16)
+	cpu.instrSet16[0x81] = cpu.alu.group1(0x81, 16)
+	cpu.instrSet16[0x82] = cpu.alu.group1(0x82, 16)
+	cpu.instrSet16[0x83] = cpu.alu.group1(0x83, 16)
+	cpu.instrSet16[0x84] = cpu.alu.test(8)
+	cpu.instrSet16[0x85] = cpu.alu.test(16)
+	cpu.instrSet16[0x86] = cpu.alu.xchg(8)
+	cpu.instrSet16[0x87] = cpu.alu.xchg(16)
+	cpu.instrSet16[0x88] = cpu.transfer.MovRM8R8
+	cpu.instrSet16[0x89] = cpu.transfer.MovRM16R16
+	cpu.instrSet16[0x8a] = cpu.transfer.MovR8RM8
+	cpu.instrSet16[0x8b] = cpu.transfer.MovR16RM16
+	cpu.instrSet16[0x8c] = cpu.transfer.MovRM16Sreg
+	cpu.instrSet16[0x8d] = cpu.alu.lea(16)
+	cpu.instrSet16[0x8e] = cpu.transfer.MovSregRM16
+	cpu.instrSet16[0x8f] = cpu.stack.popRM(16)
 
-	cpu.instrSet[0x88] = cpu.transfer.MovRM8R8
-	cpu.instrSet[0x89] = cpu.transfer.MovRM16R16
-	cpu.instrSet[0x8a] = cpu.transfer.MovR8RM8
-	cpu.instrSet[0x8b] = cpu.transfer.MovR16RM16
+	cpu.instrSet16[0x90] = cpu.alu.pause
+	for i := 1; i < 8; i++ {
+		cpu.instrSet16[0x90+i] = cpu.alu.xchgAccumulator(16)
+	}
+	cpu.instrSet16[0x98] = cpu.alu.convert(16)
+	cpu.instrSet16[0x99] = cpu.alu.convertDouble(16)
+	cpu.instrSet16[0x9a] = cpu.branch.CallFar16
+	cpu.instrSet16[0x9b] = cpu.fpu.Fwait
+	cpu.instrSet16[0x9c] = cpu.stack.Pushf16
+	cpu.instrSet16[0x9d] = cpu.stack.Popf16
+	cpu.instrSet16[0x9e] = cpu.alu.sahf
+	cpu.instrSet16[0x9f] = cpu.alu.lahf
 
-	cpu.instrSet[0x90] = cpu.alu.nop
+	cpu.instrSet16[0xa0] = cpu.transfer.movOffset(8, false)
+	cpu.instrSet16[0xa1] = cpu.transfer.movOffset(16, false)
+	cpu.instrSet16[0xa2] = cpu.transfer.movOffset(8, true)
+	cpu.instrSet16[0xa3] = cpu.transfer.movOffset(16, true)
+	cpu.instrSet16[0xa4] = cpu.alu.str(stringMovs, 8)
+	cpu.instrSet16[0xa5] = cpu.alu.str(stringMovs, 16)
+	cpu.instrSet16[0xa6] = cpu.alu.str(stringCmps, 8)
+	cpu.instrSet16[0xa7] = cpu.alu.str(stringCmps, 16)
+	cpu.instrSet16[0xa8] = cpu.alu.testAccumulator(8)
+	cpu.instrSet16[0xa9] = cpu.alu.testAccumulator(16)
+	cpu.instrSet16[0xaa] = cpu.alu.str(stringStos, 8)
+	cpu.instrSet16[0xab] = cpu.alu.str(stringStos, 16)
+	cpu.instrSet16[0xac] = cpu.alu.str(stringLods, 8)
+	cpu.instrSet16[0xad] = cpu.alu.str(stringLods, 16)
+	cpu.instrSet16[0xae] = cpu.alu.str(stringScas, 8)
+	cpu.instrSet16[0xaf] = cpu.alu.str(stringScas, 16)
 
 	for i := 0; i < 8; i++ {
-		cpu.instrSet[0xb0+i] = cpu.transfer.MovR8Imm8
+		cpu.instrSet16[0xb0+i] = cpu.transfer.MovR8Imm8
 	}
 
 	for i := 0; i < 8; i++ {
-		cpu.instrSet[0xb8+i] = cpu.transfer.MovR16Imm16
-	}
-
-	cpu.instrSet[0xc3] = cpu.branch.Ret16
-	cpu.instrSet[0xc7] = cpu.transfer.MovRM16Imm16
-	cpu.instrSet[0xc9] = cpu.branch.Leave16
-	/*
-		0xd8 - 0xdf: x87 FPU Instructions //TODO
-	*/
-	cpu.instrSet[0xe8] = cpu.branch.CallRel16
-	cpu.instrSet[0xe9] = cpu.branch.JmpRel16
-	cpu.instrSet[0xeb] = cpu.branch.JmpRel8
+		cpu.instrSet16[0xb8+i] = cpu.transfer.MovR16Imm16
+	}
+
+	cpu.instrSet16[0xc0] = cpu.alu.group2(8, shiftImm)
+	cpu.instrSet16[0xc1] = cpu.alu.group2(16, shiftImm)
+	cpu.instrSet16[0xc2] = cpu.branch.RetImm16b16
+	cpu.instrSet16[0xc3] = cpu.branch.Ret16
+	cpu.instrSet16[0xc4] = cpu.vex(0xc4, cpu.transfer.loadFar(SegES, 16))
+	cpu.instrSet16[0xc5] = cpu.vex(0xc5, cpu.transfer.loadFar(SegDS, 16))
+	cpu.instrSet16[0xc6] = cpu.transfer.MovRM8Imm8
+	cpu.instrSet16[0xc7] = cpu.transfer.MovRM16Imm16
+	cpu.instrSet16[0xc8] = cpu.branch.enter(16)
+	cpu.instrSet16[0xc9] = cpu.branch.Leave16
+	cpu.instrSet16[0xca] = cpu.branch.RetFarImm16b16
+	cpu.instrSet16[0xcb] = cpu.branch.RetFar16
+	cpu.instrSet16[0xcc] = cpu.interrupt.Int3
+	cpu.instrSet16[0xcd] = cpu.interrupt.IntImm8
+	cpu.instrSet16[0xce] = cpu.interrupt.Into
+	cpu.instrSet16[0xcf] = cpu.interrupt.Iret16
+
+	cpu.instrSet16[0xd0] = cpu.alu.group2(8, shiftOne)
+	cpu.instrSet16[0xd1] = cpu.alu.group2(16, shiftOne)
+	cpu.instrSet16[0xd2] = cpu.alu.group2(8, shiftCL)
+	cpu.instrSet16[0xd3] = cpu.alu.group2(16, shiftCL)
+	cpu.instrSet16[0xd4] = cpu.alu.aam
+	cpu.instrSet16[0xd5] = cpu.alu.aad
+	cpu.instrSet16[0xd7] = cpu.alu.xlat
+	for i := 0; i < 8; i++ {
+		cpu.instrSet16[0xd8+i] = cpu.fpu.Escape
+	}
+
+	for i := 0; i < 4; i++ {
+		cpu.instrSet16[0xe0+i] = cpu.branch.loop(16)
+	}
+	cpu.instrSet16[0xe4] = cpu.io.InALImm8
+	cpu.instrSet16[0xe5] = cpu.io.in(16, true)
+	cpu.instrSet16[0xe6] = cpu.io.OutImm8AL
+	cpu.instrSet16[0xe7] = cpu.io.out(16, true)
+	cpu.instrSet16[0xe8] = cpu.branch.CallRel16
+	cpu.instrSet16[0xe9] = cpu.branch.JmpRel16
+	cpu.instrSet16[0xea] = cpu.branch.JmpFar16
+	cpu.instrSet16[0xeb] = cpu.branch.JmpRel8
+	cpu.instrSet16[0xec] = cpu.io.InALDX
+	cpu.instrSet16[0xed] = cpu.io.in(16, false)
+	cpu.instrSet16[0xee] = cpu.io.OutDXAL
+	cpu.instrSet16[0xef] = cpu.io.out(16, false)
+	cpu.instrSet16[0xf0] = cpu.lock
+	cpu.instrSet16[0xf1] = cpu.interrupt.Int1
+	cpu.instrSet16[0xf2] = cpu.overrideRepeat(0xf2)
+	cpu.instrSet16[0xf3] = cpu.overrideRepeat(0xf3)
+	cpu.instrSet16[0xf4] = cpu.system.Hlt
+	cpu.instrSet16[0xf5] = cpu.alu.cmc
+	cpu.instrSet16[0xf6] = cpu.alu.group3(8)
+	cpu.instrSet16[0xf7] = cpu.alu.group3(16)
+	cpu.instrSet16[0xf8] = cpu.alu.clc
+	cpu.instrSet16[0xf9] = cpu.alu.stc
+	cpu.instrSet16[0xfa] = cpu.system.Cli
+	cpu.instrSet16[0xfb] = cpu.system.Sti
+	cpu.instrSet16[0xfc] = cpu.alu.cld
+	cpu.instrSet16[0xfd] = cpu.alu.std
+	cpu.instrSet16[0xfe] = cpu.alu.group4
+	cpu.instrSet16[0xff] = cpu.branch.group5(16)
 }
 
 func (cpu *CPU) createTable32() {
-	cpu.instrSet[0x00] = cpu.alu.addRM8R8
-	cpu.instrSet[0x01] = cpu.alu.addRM32R32
-	cpu.instrSet[0x02] = cpu.alu.addR8RM8
-	cpu.instrSet[0x03] = cpu.alu.addR32RM32
-	cpu.instrSet[0x04] = cpu.alu.addALImm8
-	cpu.instrSet[0x05] = cpu.alu.addEAXImm32
-	cpu.instrSet[0x06] = cpu.stack.Push32ES
-	cpu.instrSet[0x07] = cpu.stack.Pop32ES
-	cpu.instrSet[0x08] = cpu.alu.orRM8R8
-	cpu.instrSet[0x09] = cpu.alu.orRM32R32
-	cpu.instrSet[0x0a] = cpu.alu.orR8RM8
-	cpu.instrSet[0x0b] = cpu.alu.orR32RM32
-	cpu.instrSet[0x0c] = cpu.alu.orALImm8
-	cpu.instrSet[0x0d] = cpu.alu.orEAXImm32
-	cpu.instrSet[0x0e] = cpu.stack.Push32CS
-	cpu.instrSet[0x0f] = cpu.stack.Code0Fb32
-
-	cpu.instrSet[0x16] = cpu.stack.Push32SS
-	cpu.instrSet[0x17] = cpu.stack.Pop32SS
-	cpu.instrSet[0x1e] = cpu.stack.Push32DS
-	cpu.instrSet[0x1f] = cpu.stack.Pop32DS
-
-	cpu.instrSet[0x21] = cpu.alu.andRM32R32  //TODO VERIFY
-	cpu.instrSet[0x22] = cpu.alu.andR8RM8    //TODO VERIFY
-	cpu.instrSet[0x23] = cpu.alu.andR32RM32  //TODO VERIFY
-	cpu.instrSet[0x24] = cpu.alu.andALImm8   //TODO VERIFY
-	cpu.instrSet[0x25] = cpu.alu.andEAXImm32 //TODO VERIFY
-
-	cpu.instrSet[0x28] = cpu.alu.subRM8R8 //TODO VERIFY
-	cpu.instrSet[0x29] = cpu.alu.subRM32R32
-	cpu.instrSet[0x2a] = cpu.alu.subR8RM8 //TODO VERIFY
-	cpu.instrSet[0x2b] = cpu.alu.subR32RM32
-	cpu.instrSet[0x2c] = cpu.alu.subALImm8 //TODO VERIFY
-	cpu.instrSet[0x2d] = cpu.alu.subEAXImm32
-
-	cpu.instrSet[0x30] = cpu.alu.xorRM8R8 //TODO VERIFY
-	cpu.instrSet[0x31] = cpu.alu.xorRM32R32
-	cpu.instrSet[0x32] = cpu.alu.xorR8RM8 //TODO VERIFY
-	cpu.instrSet[0x33] = cpu.alu.xorR32RM32
-	cpu.instrSet[0x34] = cpu.alu.xorALImm8 //TODO VERIFY
-	cpu.instrSet[0x35] = cpu.alu.xorEAXImm32
-
-	cpu.instrSet[0x3b] = cpu.alu.cmpR32RM32
-	cpu.instrSet[0x3c] = cpu.alu.cmpALImm8
-	cpu.instrSet[0x3d] = cpu.alu.cmpEAXImm32
+	cpu.instrSet32[0x00] = cpu.alu.arith(0x00, 32)
+	cpu.instrSet32[0x01] = cpu.alu.arith(0x01, 32)
+	cpu.instrSet32[0x02] = cpu.alu.arith(0x02, 32)
+	cpu.instrSet32[0x03] = cpu.alu.arith(0x03, 32)
+	cpu.instrSet32[0x04] = cpu.alu.arith(0x04, 32)
+	cpu.instrSet32[0x05] = cpu.alu.arith(0x05, 32)
+	cpu.instrSet32[0x06] = cpu.stack.Push32ES
+	cpu.instrSet32[0x07] = cpu.stack.Pop32ES
+	cpu.instrSet32[0x08] = cpu.alu.arith(0x08, 32)
+	cpu.instrSet32[0x09] = cpu.alu.arith(0x09, 32)
+	cpu.instrSet32[0x0a] = cpu.alu.arith(0x0a, 32)
+	cpu.instrSet32[0x0b] = cpu.alu.arith(0x0b, 32)
+	cpu.instrSet32[0x0c] = cpu.alu.arith(0x0c, 32)
+	cpu.instrSet32[0x0d] = cpu.alu.arith(0x0d, 32)
+	cpu.instrSet32[0x0e] = cpu.stack.Push32CS
+	cpu.instrSet32[0x0f] = cpu.code0F
+	cpu.instrSet32[0x10] = cpu.alu.arith(0x10, 32)
+	cpu.instrSet32[0x11] = cpu.alu.arith(0x11, 32)
+	cpu.instrSet32[0x12] = cpu.alu.arith(0x12, 32)
+	cpu.instrSet32[0x13] = cpu.alu.arith(0x13, 32)
+	cpu.instrSet32[0x14] = cpu.alu.arith(0x14, 32)
+	cpu.instrSet32[0x15] = cpu.alu.arith(0x15, 32)
+	cpu.instrSet32[0x16] = cpu.stack.Push32SS
+	cpu.instrSet32[0x17] = cpu.stack.Pop32SS
+	cpu.instrSet32[0x18] = cpu.alu.arith(0x18, 32)
+	cpu.instrSet32[0x19] = cpu.alu.arith(0x19, 32)
+	cpu.instrSet32[0x1a] = cpu.alu.arith(0x1a, 32)
+	cpu.instrSet32[0x1b] = cpu.alu.arith(0x1b, 32)
+	cpu.instrSet32[0x1c] = cpu.alu.arith(0x1c, 32)
+	cpu.instrSet32[0x1d] = cpu.alu.arith(0x1d, 32)
+	cpu.instrSet32[0x1e] = cpu.stack.Push32DS
+	cpu.instrSet32[0x1f] = cpu.stack.Pop32DS
+	cpu.instrSet32[0x20] = cpu.alu.arith(0x20, 32)
+	cpu.instrSet32[0x21] = cpu.alu.arith(0x21, 32)
+	cpu.instrSet32[0x22] = cpu.alu.arith(0x22, 32)
+	cpu.instrSet32[0x23] = cpu.alu.arith(0x23, 32)
+	cpu.instrSet32[0x24] = cpu.alu.arith(0x24, 32)
+	cpu.instrSet32[0x25] = cpu.alu.arith(0x25, 32)
+	cpu.instrSet32[0x26] = cpu.overrideSegment(SegES)
+	cpu.instrSet32[0x27] = cpu.alu.decimalAdjust(false)
+	cpu.instrSet32[0x28] = cpu.alu.arith(0x28, 32)
+	cpu.instrSet32[0x29] = cpu.alu.arith(0x29, 32)
+	cpu.instrSet32[0x2a] = cpu.alu.arith(0x2a, 32)
+	cpu.instrSet32[0x2b] = cpu.alu.arith(0x2b, 32)
+	cpu.instrSet32[0x2c] = cpu.alu.arith(0x2c, 32)
+	cpu.instrSet32[0x2d] = cpu.alu.arith(0x2d, 32)
+	cpu.instrSet32[0x2e] = cpu.overrideSegment(SegCS)
+	cpu.instrSet32[0x2f] = cpu.alu.decimalAdjust(true)
+	cpu.instrSet32[0x30] = cpu.alu.arith(0x30, 32)
+	cpu.instrSet32[0x31] = cpu.alu.arith(0x31, 32)
+	cpu.instrSet32[0x32] = cpu.alu.arith(0x32, 32)
+	cpu.instrSet32[0x33] = cpu.alu.arith(0x33, 32)
+	cpu.instrSet32[0x34] = cpu.alu.arith(0x34, 32)
+	cpu.instrSet32[0x35] = cpu.alu.arith(0x35, 32)
+	cpu.instrSet32[0x36] = cpu.overrideSegment(SegSS)
+	cpu.instrSet32[0x37] = cpu.alu.asciiAdjust(false)
+	cpu.instrSet32[0x38] = cpu.alu.arith(0x38, 32)
+	cpu.instrSet32[0x39] = cpu.alu.arith(0x39, 32)
+	cpu.instrSet32[0x3a] = cpu.alu.arith(0x3a, 32)
+	cpu.instrSet32[0x3b] = cpu.alu.arith(0x3b, 32)
+	cpu.instrSet32[0x3c] = cpu.alu.arith(0x3c, 32)
+	cpu.instrSet32[0x3d] = cpu.alu.arith(0x3d, 32)
+	cpu.instrSet32[0x3e] = cpu.overrideSegment(SegDS)
+	cpu.instrSet32[0x3f] = cpu.alu.asciiAdjust(true)
+
+	for i := 0; i < 8; i++ {
+		cpu.instrSet32[0x40+i] = cpu.alu.incDecR(32)
+	}
 
 	for i := 0; i < 8; i++ {
-		cpu.instrSet[0x40+i] = cpu.alu.incR32
+		cpu.instrSet32[0x48+i] = cpu.alu.incDecR(32)
 	}
 
 	for i := 0; i < 8; i++ {
-		cpu.instrSet[0x48+i] = cpu.alu.decR32
+		cpu.instrSet32[0x50+i] = cpu.stack.PushR32
 	}
 
 	for i := 0; i < 8; i++ {
-		cpu.instrSet[0x50+i] = cpu.stack.PushR32
+		cpu.instrSet32[0x58+i] = cpu.stack.PopR32
+	}
+
+	cpu.instrSet32[0x60] = cpu.stack.pusha(32)
+	cpu.instrSet32[0x61] = cpu.stack.popa(32)
+	cpu.instrSet32[0x64] = cpu.overrideSegment(SegFS)
+	cpu.instrSet32[0x65] = cpu.overrideSegment(SegGS)
+	cpu.instrSet32[0x66] = cpu.overrideOperand
+	cpu.instrSet32[0x67] = cpu.overrideAddress
+	cpu.instrSet32[0x68] = cpu.stack.Push32Imm32
+	cpu.instrSet32[0x69] = cpu.alu.imulImm(32, 4)
+	cpu.instrSet32[0x6a] = cpu.stack.Push32Imm8
+	cpu.instrSet32[0x6b] = cpu.alu.imulImm(32, 1)
+
+	cpu.instrSet32[0x70] = cpu.branch.JoRel8
+	cpu.instrSet32[0x71] = cpu.branch.JnoRel8
+	cpu.instrSet32[0x72] = cpu.branch.JcRel8
+	cpu.instrSet32[0x73] = cpu.branch.JncRel8
+	cpu.instrSet32[0x74] = cpu.branch.JzRel8
+	cpu.instrSet32[0x75] = cpu.branch.JnzRel8
+	cpu.instrSet32[0x76] = cpu.branch.jcc(32, 1)
+	cpu.instrSet32[0x77] = cpu.branch.jcc(32, 1)
+	cpu.instrSet32[0x78] = cpu.branch.JsRel8
+	cpu.instrSet32[0x79] = cpu.branch.JnsRel8
+	cpu.instrSet32[0x7a] = cpu.branch.jcc(32, 1)
+	cpu.instrSet32[0x7b] = cpu.branch.jcc(32, 1)
+	cpu.instrSet32[0x7c] = cpu.branch.JlRel8
+	cpu.instrSet32[0x7d] = cpu.branch.jcc(32, 1)
+	cpu.instrSet32[0x7e] = cpu.branch.JleRel8
+	cpu.instrSet32[0x7f] = cpu.branch.jcc(32, 1)
+	cpu.instrSet32[0x80] = cpu.alu.group1(0x80, 32)
+	cpu.instrSet32[0x81] = cpu.alu.group1(0x81, 32)
+	cpu.instrSet32[0x82] = cpu.alu.group1(0x82, 32)
+	cpu.instrSet32[0x83] = cpu.alu.group1(0x83, 32)
+	cpu.instrSet32[0x84] = cpu.alu.test(8)
+	cpu.instrSet32[0x85] = cpu.alu.test(32)
+	cpu.instrSet32[0x86] = cpu.alu.xchg(8)
+	cpu.instrSet32[0x87] = cpu.alu.xchg(32)
+	cpu.instrSet32[0x88] = cpu.transfer.MovRM8R8
+	cpu.instrSet32[0x89] = cpu.transfer.MovRM32R32
+	cpu.instrSet32[0x8a] = cpu.transfer.MovR8RM8
+	cpu.instrSet32[0x8b] = cpu.transfer.MovR32RM32
+	cpu.instrSet32[0x8c] = cpu.transfer.MovRM16Sreg
+	cpu.instrSet32[0x8d] = cpu.alu.lea(32)
+	cpu.instrSet32[0x8e] = cpu.transfer.MovSregRM16
+	cpu.instrSet32[0x8f] = cpu.stack.popRM(32)
+
+	cpu.instrSet32[0x90] = cpu.alu.pause
+	for i := 1; i < 8; i++ {
+		cpu.instrSet32[0x90+i] = cpu.alu.xchgAccumulator(32)
 	}
+	cpu.instrSet32[0x98] = cpu.alu.convert(32)
+	cpu.instrSet32[0x99] = cpu.alu.convertDouble(32)
+	cpu.instrSet32[0x9a] = cpu.branch.CallFar32
+	cpu.instrSet32[0x9b] = cpu.fpu.Fwait
+	cpu.instrSet32[0x9c] = cpu.stack.Pushf32
+	cpu.instrSet32[0x9d] = cpu.stack.Popf32
+	cpu.instrSet32[0x9e] = cpu.alu.sahf
+	cpu.instrSet32[0x9f] = cpu.alu.lahf
+
+	cpu.instrSet32[0xa0] = cpu.transfer.movOffset(8, false)
+	cpu.instrSet32[0xa1] = cpu.transfer.movOffset(32, false)
+	cpu.instrSet32[0xa2] = cpu.transfer.movOffset(8, true)
+	cpu.instrSet32[0xa3] = cpu.transfer.movOffset(32, true)
+	cpu.instrSet32[0xa4] = cpu.alu.str(stringMovs, 8)
+	cpu.instrSet32[0xa5] = cpu.alu.str(stringMovs, 32)
+	cpu.instrSet32[0xa6] = cpu.alu.str(stringCmps, 8)
+	cpu.instrSet32[0xa7] = cpu.alu.str(stringCmps, 32)
+	cpu.instrSet32[0xa8] = cpu.alu.testAccumulator(8)
+	cpu.instrSet32[0xa9] = cpu.alu.testAccumulator(32)
+	cpu.instrSet32[0xaa] = cpu.alu.str(stringStos, 8)
+	cpu.instrSet32[0xab] = cpu.alu.str(stringStos, 32)
+	cpu.instrSet32[0xac] = cpu.alu.str(stringLods, 8)
+	cpu.instrSet32[0xad] = cpu.alu.str(stringLods, 32)
+	cpu.instrSet32[0xae] = cpu.alu.str(stringScas, 8)
+	cpu.instrSet32[0xaf] = cpu.alu.str(stringScas, 32)
 
 	for i := 0; i < 8; i++ {
-		cpu.instrSet[0x58+i] = cpu.stack.PopR32
-	}
-
-	cpu.instrSet[0x66] = cpu.overrideOperandTo16
-	cpu.instrSet[0x68] = cpu.stack.Push32Imm32
-	// cpu.instrSet[0x69] = cpu.imulR32RM32Imm32 //TODO
-	cpu.instrSet[0x6a] = cpu.stack.Push32Imm8
-	// cpu.instrSet[0x6b] = cpu.imulR32RM32Imm8 //TODO
-
-	cpu.instrSet[0x70] = cpu.branch.JoRel8
-	cpu.instrSet[0x71] = cpu.branch.JnoRel8
-	cpu.instrSet[0x72] = cpu.branch.JcRel8
-	cpu.instrSet[0x73] = cpu.branch.JncRel8
-	cpu.instrSet[0x74] = cpu.branch.JzRel8
-	cpu.instrSet[0x75] = cpu.branch.JnzRel8
-	cpu.instrSet[0x78] = cpu.branch.JsRel8
-	cpu.instrSet[0x79] = cpu.branch.JnsRel8
-	cpu.instrSet[0x7c] = cpu.branch.JlRel8
-	cpu.instrSet[0x7e] = cpu.branch.JleRel8
-	cpu.instrSet[0x81] = cpu.alu.code81b32
-	cpu.instrSet[0x83] = cpu.alu.code83b32
-	// cpu.instrSet[0x84] = cpu.testRM8R8 //TODO
-	// cpu.instrSet[0x85] = cpu.testRM32R32 //TODO
-	// cpu.instrSet[0x86] = cpu.xchgR8RM8 //TODO
-	// cpu.instrSet[0x87] = cpu.xchgR32RM32 //TODO
-	cpu.instrSet[0x88] = cpu.transfer.MovRM8R8
-	cpu.instrSet[0x89] = cpu.transfer.MovRM32R32
-	cpu.instrSet[0x8a] = cpu.transfer.MovR8RM8
-	cpu.instrSet[0x8b] = cpu.transfer.MovR32RM32
-
-	cpu.instrSet[0x90] = cpu.alu.nop
-
-	// cpu.instrSet[0xa8] = cpu.testALImm8 //TODO
-	// cpu.instrSet[0xa9] = cpu.testEAXImm32 //TODO
+		cpu.instrSet32[0xb0+i] = cpu.transfer.MovR8Imm8
+	}
 
 	for i := 0; i < 8; i++ {
-		cpu.instrSet[0xb0+i] = cpu.transfer.MovR8Imm8
+		cpu.instrSet32[0xb8+i] = cpu.transfer.MovR32Imm32
 	}
 
+	cpu.instrSet32[0xc0] = cpu.alu.group2(8, shiftImm)
+	cpu.instrSet32[0xc1] = cpu.alu.group2(32, shiftImm)
+	cpu.instrSet32[0xc2] = cpu.branch.RetImm16b32
+	cpu.instrSet32[0xc3] = cpu.branch.Ret32
+	cpu.instrSet32[0xc4] = cpu.vex(0xc4, cpu.transfer.loadFar(SegES, 32))
+	cpu.instrSet32[0xc5] = cpu.vex(0xc5, cpu.transfer.loadFar(SegDS, 32))
+	cpu.instrSet32[0xc6] = cpu.transfer.MovRM8Imm8
+	cpu.instrSet32[0xc7] = cpu.transfer.MovRM32Imm32
+	cpu.instrSet32[0xc8] = cpu.branch.enter(32)
+	cpu.instrSet32[0xc9] = cpu.branch.Leave32
+	cpu.instrSet32[0xca] = cpu.branch.RetFarImm16b32
+	cpu.instrSet32[0xcb] = cpu.branch.RetFar32
+	cpu.instrSet32[0xcc] = cpu.interrupt.Int3
+	cpu.instrSet32[0xcd] = cpu.interrupt.IntImm8
+	cpu.instrSet32[0xce] = cpu.interrupt.Into
+	cpu.instrSet32[0xcf] = cpu.interrupt.Iret32
+
+	cpu.instrSet32[0xd0] = cpu.alu.group2(8, shiftOne)
+	cpu.instrSet32[0xd1] = cpu.alu.group2(32, shiftOne)
+	cpu.instrSet32[0xd2] = cpu.alu.group2(8, shiftCL)
+	cpu.instrSet32[0xd3] = cpu.alu.group2(32, shiftCL)
+	cpu.instrSet32[0xd4] = cpu.alu.aam
+	cpu.instrSet32[0xd5] = cpu.alu.aad
+	cpu.instrSet32[0xd7] = cpu.alu.xlat
 	for i := 0; i < 8; i++ {
-		cpu.instrSet[0xb8+i] = cpu.transfer.MovR32Imm32
-	}
-
-	cpu.instrSet[0xc3] = cpu.branch.Ret32
-	cpu.instrSet[0xc7] = cpu.transfer.MovRM32Imm32
-	cpu.instrSet[0xc9] = cpu.branch.Leave32
-	/*
-		0xd8 - 0xdf: x87 FPU Instructions
-	*/
-	cpu.instrSet[0xe8] = cpu.branch.CallRel32
-	cpu.instrSet[0xe9] = cpu.branch.JmpRel32
-	cpu.instrSet[0xeb] = cpu.branch.JmpRel8
-	cpu.instrSet[0xec] = cpu.io.InALDX
-	cpu.instrSet[0xed] = cpu.io.InEAXDX
-	cpu.instrSet[0xee] = cpu.io.OutDXAL
-	cpu.instrSet[0xef] = cpu.io.OutDXEAX
-	cpu.instrSet[0xff] = cpu.alu.codeFFb32
+		cpu.instrSet32[0xd8+i] = cpu.fpu.Escape
+	}
+
+	for i := 0; i < 4; i++ {
+		cpu.instrSet32[0xe0+i] = cpu.branch.loop(32)
+	}
+	cpu.instrSet32[0xe4] = cpu.io.InALImm8
+	cpu.instrSet32[0xe5] = cpu.io.in(32, true)
+	cpu.instrSet32[0xe6] = cpu.io.OutImm8AL
+	cpu.instrSet32[0xe7] = cpu.io.out(32, true)
+	cpu.instrSet32[0xe8] = cpu.branch.CallRel32
+	cpu.instrSet32[0xe9] = cpu.branch.JmpRel32
+	cpu.instrSet32[0xea] = cpu.branch.JmpFar32
+	cpu.instrSet32[0xeb] = cpu.branch.JmpRel8
+	cpu.instrSet32[0xec] = cpu.io.InALDX
+	cpu.instrSet32[0xed] = cpu.io.InEAXDX
+	cpu.instrSet32[0xee] = cpu.io.OutDXAL
+	cpu.instrSet32[0xef] = cpu.io.OutDXEAX
+	cpu.instrSet32[0xf0] = cpu.lock
+	cpu.instrSet32[0xf1] = cpu.interrupt.Int1
+	cpu.instrSet32[0xf2] = cpu.overrideRepeat(0xf2)
+	cpu.instrSet32[0xf3] = cpu.overrideRepeat(0xf3)
+	cpu.instrSet32[0xf4] = cpu.system.Hlt
+	cpu.instrSet32[0xf5] = cpu.alu.cmc
+	cpu.instrSet32[0xf6] = cpu.alu.group3(8)
+	cpu.instrSet32[0xf7] = cpu.alu.group3(32)
+	cpu.instrSet32[0xf8] = cpu.alu.clc
+	cpu.instrSet32[0xf9] = cpu.alu.stc
+	cpu.instrSet32[0xfa] = cpu.system.Cli
+	cpu.instrSet32[0xfb] = cpu.system.Sti
+	cpu.instrSet32[0xfc] = cpu.alu.cld
+	cpu.instrSet32[0xfd] = cpu.alu.std
+	cpu.instrSet32[0xfe] = cpu.alu.group4
+	cpu.instrSet32[0xff] = cpu.branch.group5(32)
 }
 
-func (cpu *CPU) overrideOperandTo16() {
+func (cpu *CPU) createTable0F() {
+	cpu.instrSet0F16[0x00] = cpu.system.Code0F00
+	cpu.instrSet0F16[0x01] = cpu.system.Code0F01b16
+	cpu.instrSet0F16[0x06] = cpu.system.Clts
+	cpu.instrSet0F16[0x20] = cpu.system.MovR32CR
+	cpu.instrSet0F16[0x21] = cpu.system.MovR32DR
+	cpu.instrSet0F16[0x22] = cpu.system.MovCRR32
+	cpu.instrSet0F16[0x23] = cpu.system.MovDRR32
+	cpu.instrSet0F16[0x30] = cpu.system.Wrmsr
+	cpu.instrSet0F16[0x31] = cpu.system.Rdtsc
+	cpu.instrSet0F16[0x32] = cpu.system.Rdmsr
+	cpu.instrSet0F16[0x34] = cpu.system.Sysenter
+	cpu.instrSet0F16[0x35] = cpu.system.Sysexit
+	cpu.instrSet0F16[0xa0] = cpu.stack.Push16FS
+	cpu.instrSet0F16[0xa1] = cpu.stack.Pop16FS
+	cpu.instrSet0F16[0xa2] = cpu.system.Cpuid
+	cpu.instrSet0F16[0xa8] = cpu.stack.Push16GS
+	cpu.instrSet0F16[0xa9] = cpu.stack.Pop16GS
+
+	cpu.instrSet0F32[0x00] = cpu.system.Code0F00
+	cpu.instrSet0F32[0x01] = cpu.system.Code0F01b32
+	cpu.instrSet0F32[0x06] = cpu.system.Clts
+	cpu.instrSet0F32[0x20] = cpu.system.MovR32CR
+	cpu.instrSet0F32[0x21] = cpu.system.MovR32DR
+	cpu.instrSet0F32[0x22] = cpu.system.MovCRR32
+	cpu.instrSet0F32[0x23] = cpu.system.MovDRR32
+	cpu.instrSet0F32[0x30] = cpu.system.Wrmsr
+	cpu.instrSet0F32[0x31] = cpu.system.Rdtsc
+	cpu.instrSet0F32[0x32] = cpu.system.Rdmsr
+	cpu.instrSet0F32[0x34] = cpu.system.Sysenter
+	cpu.instrSet0F32[0x35] = cpu.system.Sysexit
+	cpu.instrSet0F32[0xa0] = cpu.stack.Push32FS
+	cpu.instrSet0F32[0xa1] = cpu.stack.Pop32FS
+	cpu.instrSet0F32[0xa2] = cpu.system.Cpuid
+	cpu.instrSet0F32[0xa8] = cpu.stack.Push32GS
+	cpu.instrSet0F32[0xa9] = cpu.stack.Pop32GS
+
+	alu := cpu.alu
+	for width, table := range map[uint]*[0x100]func(){16: &cpu.instrSet0F16, 32: &cpu.instrSet0F32} {
+		table[0xa3] = alu.bitTest(width, bitTestOnly)
+		table[0xa4] = alu.doubleShift(width, true, true)
+		table[0xa5] = alu.doubleShift(width, true, false)
+		table[0xab] = alu.bitTest(width, bitTestSet)
+		table[0xac] = alu.doubleShift(width, false, true)
+		table[0xad] = alu.doubleShift(width, false, false)
+		table[0xb0] = alu.cmpxchg(8)
+		table[0xb1] = alu.cmpxchg(width)
+		table[0xb3] = alu.bitTest(width, bitTestReset)
+		table[0xb8] = alu.popcnt(width)
+		table[0xba] = alu.group8(width)
+		table[0xbb] = alu.bitTest(width, bitTestFlip)
+		table[0xbc] = alu.bitScan(width, false)
+		table[0xbd] = alu.bitScan(width, true)
+		table[0xc0] = alu.xadd(8)
+		table[0xc1] = alu.xadd(width)
+		table[0xc7] = alu.group9(width)
+		table[0x0d] = alu.hintNop
+		for code := 0x19; code <= 0x1f; code++ {
+			table[code] = alu.hintNop
+		}
+		for cc := 0; cc < 0x10; cc++ {
+			table[0x40+cc] = alu.cmov(width)
+			table[0x80+cc] = cpu.branch.jcc(width, width/8)
+			table[0x90+cc] = alu.setcc
+		}
+		table[0xaf] = alu.imul(width)
+		table[0xb2] = cpu.transfer.loadFar(SegSS, width)
+		table[0xb4] = cpu.transfer.loadFar(SegFS, width)
+		table[0xb5] = cpu.transfer.loadFar(SegGS, width)
+		table[0xb6] = alu.movExtend(width, 8, false)
+		table[0xb7] = alu.movExtend(width, 16, false)
+		table[0xbe] = alu.movExtend(width, 8, true)
+		table[0xbf] = alu.movExtend(width, 16, true)
+		for i := 0; i < 8; i++ {
+			table[0xc8+i] = alu.bswap(width)
+		}
+	}
+
+	mmx := cpu.mmx
+	sse := cpu.sse
+	for _, table := range []*[0x100]func(){&cpu.instrSet0F16, &cpu.instrSet0F32} {
+		table[0x10] = cpu.prefixed(sse.Mov(FeatureSSE, false), sse.Mov(FeatureSSE2, false),
+			sse.MovScalar(32), sse.MovScalar(64))
+		table[0x11] = cpu.prefixed(sse.MovStore(FeatureSSE, false), sse.MovStore(FeatureSSE2, false),
+			sse.MovScalarStore(32), sse.MovScalarStore(64))
+		table[0x12] = cpu.prefixed(sse.MovHalf(FeatureSSE, 0), sse.MovHalf(FeatureSSE2, 0), nil, nil)
+		table[0x13] = cpu.prefixed(sse.MovHalfStore(FeatureSSE, 0), sse.MovHalfStore(FeatureSSE2, 0), nil, nil)
+		table[0x14] = cpu.prefixed(sse.Unpack(32, 0), sse.Unpack(64, 0), nil, nil)
+		table[0x15] = cpu.prefixed(sse.Unpack(32, 1), sse.Unpack(64, 1), nil, nil)
+		table[0x16] = cpu.prefixed(sse.MovHalf(FeatureSSE, 1), sse.MovHalf(FeatureSSE2, 1), nil, nil)
+		table[0x17] = cpu.prefixed(sse.MovHalfStore(FeatureSSE, 1), sse.MovHalfStore(FeatureSSE2, 1), nil, nil)
+		table[0x18] = sse.Prefetch
+		table[0x38] = cpu.code0F3(&cpu.instrSet0F38)
+		table[0x3a] = cpu.code0F3(&cpu.instrSet0F3A)
+		table[0x28] = cpu.prefixed(sse.Mov(FeatureSSE, true), sse.Mov(FeatureSSE2, true), nil, nil)
+		table[0x29] = cpu.prefixed(sse.MovStore(FeatureSSE, true), sse.MovStore(FeatureSSE2, true), nil, nil)
+		table[0x2a] = cpu.prefixed(sse.Convert(cvtpi2ps), sse.Convert(cvtpi2pd),
+			sse.Convert(cvtsi2ss), sse.Convert(cvtsi2sd))
+		table[0x2b] = cpu.prefixed(sse.Movnt(FeatureSSE), sse.Movnt(FeatureSSE2), nil, nil)
+		table[0x2c] = cpu.prefixed(sse.Convert(cvttps2pi), sse.Convert(cvttpd2pi),
+			sse.Convert(cvttss2si), sse.Convert(cvttsd2si))
+		table[0x2d] = cpu.prefixed(sse.Convert(cvtps2pi), sse.Convert(cvtpd2pi),
+			sse.Convert(cvtss2si), sse.Convert(cvtsd2si))
+		table[0x2e] = cpu.prefixed(sse.Comis(32, true), sse.Comis(64, true), nil, nil)
+		table[0x2f] = cpu.prefixed(sse.Comis(32, false), sse.Comis(64, false), nil, nil)
+		table[0x50] = cpu.prefixed(sse.Movmsk(32), sse.Movmsk(64), nil, nil)
+		table[0x51] = cpu.arith(simdSqrt)
+		table[0x52] = cpu.prefixed(sse.Arith(simdRsqrt, shapePS), nil, sse.Arith(simdRsqrt, shapeSS), nil)
+		table[0x53] = cpu.prefixed(sse.Arith(simdRcp, shapePS), nil, sse.Arith(simdRcp, shapeSS), nil)
+		for code := uint8(0x54); code <= 0x57; code++ {
+			op := [4]uint8{0xdb, 0xdf, 0xeb, 0xef}[code-0x54]
+			table[code] = cpu.prefixed(sse.Logic(FeatureSSE, op), sse.Logic(FeatureSSE2, op), nil, nil)
+		}
+		table[0x58] = cpu.arith(fpAdd)
+		table[0x59] = cpu.arith(fpMul)
+		table[0x5a] = cpu.prefixed(sse.Convert(cvtps2pd), sse.Convert(cvtpd2ps),
+			sse.Convert(cvtss2sd), sse.Convert(cvtsd2ss))
+		table[0x5b] = cpu.prefixed(sse.Convert(cvtdq2ps), sse.Convert(cvtps2dq), sse.Convert(cvttps2dq), nil)
+		table[0x5c] = cpu.arith(fpSub)
+		table[0x5d] = cpu.arith(simdMin)
+		table[0x5e] = cpu.arith(fpDiv)
+		table[0x5f] = cpu.arith(simdMax)
+		for code := range packedOps {
+			table[code] = cpu.prefixed(mmx.Packed, sse.Packed, nil, nil)
+		}
+		table[0x6c] = cpu.prefixed(nil, sse.Packed, nil, nil)
+		table[0x6d] = cpu.prefixed(nil, sse.Packed, nil, nil)
+		table[0x6e] = cpu.prefixed(mmx.MovdMMRM32, sse.MovdXMMRM32, nil, nil)
+		table[0x6f] = cpu.prefixed(mmx.MovqMMRM64, sse.Mov(FeatureSSE2, true), sse.Mov(FeatureSSE2, false), nil)
+		table[0x70] = cpu.prefixed(mmx.Pshufw, sse.Pshufd, sse.PshufHalf(1), sse.PshufHalf(0))
+		table[0x71] = cpu.prefixed(mmx.ShiftImm, sse.ShiftImm, nil, nil)
+		table[0x72] = cpu.prefixed(mmx.ShiftImm, sse.ShiftImm, nil, nil)
+		table[0x73] = cpu.prefixed(mmx.ShiftImm, sse.ShiftImm, nil, nil)
+		table[0x77] = cpu.prefixed(mmx.Emms, nil, nil, nil)
+		table[0x7e] = cpu.prefixed(mmx.MovdRM32MM, sse.MovdRM32XMM, sse.MovqXMMRM64, nil)
+		table[0x7f] = cpu.prefixed(mmx.MovqRM64MM, sse.MovStore(FeatureSSE2, true),
+			sse.MovStore(FeatureSSE2, false), nil)
+		table[0xae] = sse.Group15
+		table[0xc2] = cpu.prefixed(sse.Cmp(shapePS), sse.Cmp(shapePD), sse.Cmp(shapeSS), sse.Cmp(shapeSD))
+		table[0xc3] = cpu.prefixed(sse.Movnti, nil, nil, nil)
+		table[0xc4] = cpu.prefixed(mmx.Pinsrw, sse.Pinsrw, nil, nil)
+		table[0xc5] = cpu.prefixed(mmx.Pextrw, sse.Pextrw, nil, nil)
+		table[0xc6] = cpu.prefixed(sse.Shufps, sse.Shufpd, nil, nil)
+		for code := range packedShifts {
+			table[code] = cpu.prefixed(mmx.Shift, sse.Shift, nil, nil)
+		}
+		table[0xd6] = cpu.prefixed(nil, sse.MovqRM64XMM, sse.Movq2dq, sse.Movdq2q)
+		table[0xd7] = cpu.prefixed(mmx.Pmovmskb, sse.Pmovmskb, nil, nil)
+		table[0xe6] = cpu.prefixed(nil, sse.Convert(cvttpd2dq), sse.Convert(cvtdq2pd), sse.Convert(cvtpd2dq))
+		table[0xe7] = cpu.prefixed(mmx.Movntq, sse.Movnt(FeatureSSE2), nil, nil)
+		table[0xf7] = cpu.prefixed(mmx.Maskmovq, sse.Maskmovdqu, nil, nil)
+	}
+}
+
+// createTable0F3 the three-byte opcodes 0F 38 and 0F 3A, which do not depend on the
+// operand size
+func (cpu *CPU) createTable0F3() {
+	sse := cpu.sse
+	table38 := &cpu.instrSet0F38
+	table38[0xc8] = cpu.prefixed(sse.SHA(sha1Nexte), nil, nil, nil)
+	table38[0xc9] = cpu.prefixed(sse.SHA(sha1Msg1), nil, nil, nil)
+	table38[0xca] = cpu.prefixed(sse.SHA(sha1Msg2), nil, nil, nil)
+	table38[0xcb] = cpu.prefixed(sse.SHA(sse.sha256Rounds2), nil, nil, nil)
+	table38[0xcc] = cpu.prefixed(sse.SHA(sha256Msg1), nil, nil, nil)
+	table38[0xcd] = cpu.prefixed(sse.SHA(sha256Msg2), nil, nil, nil)
+	for code := 0xdb; code <= 0xdf; code++ {
+		table38[code] = cpu.prefixed(nil, sse.AES(uint8(code)), nil, nil)
+	}
+
+	table3A := &cpu.instrSet0F3A
+	table3A[0x44] = cpu.prefixed(nil, sse.Pclmulqdq(), nil, nil)
+	table3A[0xcc] = cpu.prefixed(sse.Sha1rnds4(), nil, nil, nil)
+	table3A[0xdf] = cpu.prefixed(nil, sse.Aeskeygenassist(), nil, nil)
+}
+
+func (cpu *CPU) createTableVEX() {
+	avx := cpu.avx
+	table := &cpu.instrSetVEX[0]
+	table[0x10] = cpu.prefixed(avx.Mov(false), avx.Mov(false), avx.MovScalar(32), avx.MovScalar(64))
+	table[0x11] = cpu.prefixed(avx.MovStore(false), avx.MovStore(false),
+		avx.MovScalarStore(32), avx.MovScalarStore(64))
+	table[0x12] = cpu.prefixed(avx.MovHalf(32, 0), avx.MovHalf(64, 0), nil, nil)
+	table[0x13] = cpu.prefixed(avx.MovHalfStore(0), avx.MovHalfStore(0), nil, nil)
+	table[0x14] = cpu.prefixed(avx.Unpack(32, 0), avx.Unpack(64, 0), nil, nil)
+	table[0x15] = cpu.prefixed(avx.Unpack(32, 1), avx.Unpack(64, 1), nil, nil)
+	table[0x16] = cpu.prefixed(avx.MovHalf(32, 1), avx.MovHalf(64, 1), nil, nil)
+	table[0x17] = cpu.prefixed(avx.MovHalfStore(1), avx.MovHalfStore(1), nil, nil)
+	table[0x28] = cpu.prefixed(avx.Mov(true), avx.Mov(true), nil, nil)
+	table[0x29] = cpu.prefixed(avx.MovStore(true), avx.MovStore(true), nil, nil)
+	table[0x2a] = cpu.prefixed(nil, nil, avx.Convert(cvtsi2ss), avx.Convert(cvtsi2sd))
+	table[0x2b] = cpu.prefixed(avx.Movnt, avx.Movnt, nil, nil)
+	table[0x2c] = cpu.prefixed(nil, nil, avx.Convert(cvttss2si), avx.Convert(cvttsd2si))
+	table[0x2d] = cpu.prefixed(nil, nil, avx.Convert(cvtss2si), avx.Convert(cvtsd2si))
+	table[0x2e] = cpu.prefixed(avx.Comis(32, true), avx.Comis(64, true), nil, nil)
+	table[0x2f] = cpu.prefixed(avx.Comis(32, false), avx.Comis(64, false), nil, nil)
+	table[0x50] = cpu.prefixed(avx.Movmsk(32), avx.Movmsk(64), nil, nil)
+	table[0x51] = cpu.vexArith(simdSqrt)
+	table[0x52] = cpu.prefixed(avx.Arith(simdRsqrt, shapePS), nil, avx.Arith(simdRsqrt, shapeSS), nil)
+	table[0x53] = cpu.prefixed(avx.Arith(simdRcp, shapePS), nil, avx.Arith(simdRcp, shapeSS), nil)
+	for code := uint8(0x54); code <= 0x57; code++ {
+		op := [4]uint8{0xdb, 0xdf, 0xeb, 0xef}[code-0x54]
+		table[code] = cpu.prefixed(avx.Logic(op), avx.Logic(op), nil, nil)
+	}
+	table[0x58] = cpu.vexArith(fpAdd)
+	table[0x59] = cpu.vexArith(fpMul)
+	table[0x5a] = cpu.prefixed(avx.Convert(cvtps2pd), avx.Convert(cvtpd2ps),
+		avx.Convert(cvtss2sd), avx.Convert(cvtsd2ss))
+	table[0x5b] = cpu.prefixed(avx.Convert(cvtdq2ps), avx.Convert(cvtps2dq), avx.Convert(cvttps2dq), nil)
+	table[0x5c] = cpu.vexArith(fpSub)
+	table[0x5d] = cpu.vexArith(simdMin)
+	table[0x5e] = cpu.vexArith(fpDiv)
+	table[0x5f] = cpu.vexArith(simdMax)
+	for code := range packedOps {
+		table[code] = cpu.prefixed(nil, avx.Packed(code), nil, nil)
+	}
+	table[0x6c] = cpu.prefixed(nil, avx.Packed(0x6c), nil, nil)
+	table[0x6d] = cpu.prefixed(nil, avx.Packed(0x6d), nil, nil)
+	table[0x6e] = cpu.prefixed(nil, avx.MovdXMMRM32, nil, nil)
+	table[0x6f] = cpu.prefixed(nil, avx.Mov(true), avx.Mov(false), nil)
+	table[0x70] = cpu.prefixed(nil, avx.Pshufd, avx.PshufHalf(1), avx.PshufHalf(0))
+	table[0x71] = cpu.prefixed(nil, avx.ShiftImm(16), nil, nil)
+	table[0x72] = cpu.prefixed(nil, avx.ShiftImm(32), nil, nil)
+	table[0x73] = cpu.prefixed(nil, avx.ShiftImm(64), nil, nil)
+	table[0x77] = cpu.prefixed(avx.Zeroupper, nil, nil, nil)
+	table[0x7e] = cpu.prefixed(nil, avx.MovdRM32XMM, avx.MovqXMMRM64, nil)
+	table[0x7f] = cpu.prefixed(nil, avx.MovStore(true), avx.MovStore(false), nil)
+	table[0xae] = cpu.prefixed(avx.Group15, nil, nil, nil)
+	table[0xc2] = cpu.prefixed(avx.Cmp(shapePS), avx.Cmp(shapePD), avx.Cmp(shapeSS), avx.Cmp(shapeSD))
+	table[0xc4] = cpu.prefixed(nil, avx.Pinsrw, nil, nil)
+	table[0xc5] = cpu.prefixed(nil, avx.Pextrw, nil, nil)
+	table[0xc6] = cpu.prefixed(avx.Shufps, avx.Shufpd, nil, nil)
+	for code, shift := range packedShifts {
+		table[code] = cpu.prefixed(nil, avx.Shift(shift.width, shift.kind), nil, nil)
+	}
+	table[0xd6] = cpu.prefixed(nil, avx.MovqRM64XMM, nil, nil)
+	table[0xd7] = cpu.prefixed(nil, avx.Pmovmskb, nil, nil)
+	table[0xe6] = cpu.prefixed(nil, avx.Convert(cvttpd2dq), avx.Convert(cvtdq2pd), avx.Convert(cvtpd2dq))
+	table[0xe7] = cpu.prefixed(nil, avx.Movnt, nil, nil)
+	table[0xf7] = cpu.prefixed(nil, avx.Maskmovdqu, nil, nil)
+
+	// the 0F38 and 0F3A maps only have 66 forms
+	table38 := &cpu.instrSetVEX[1]
+	table38[0x0c] = avx.Permilvar(32)
+	table38[0x0d] = avx.Permilvar(64)
+	table38[0x0e] = avx.Test(32)
+	table38[0x0f] = avx.Test(64)
+	table38[0x16] = avx.Perm
+	table38[0x18] = avx.Broadcast(avxFloat, 32, false)
+	table38[0x19] = avx.Broadcast(avxFloat, 64, true)
+	table38[0x1a] = avx.Broadcast(avxFloat, 128, true)
+	table38[0x2c] = avx.MaskMov(avxFloat, 32, false)
+	table38[0x2d] = avx.MaskMov(avxFloat, 64, false)
+	table38[0x2e] = avx.MaskMov(avxFloat, 32, true)
+	table38[0x2f] = avx.MaskMov(avxFloat, 64, true)
+	table38[0x36] = avx.Perm
+	table38[0x45] = avx.ShiftVar(shiftRightLogical)
+	table38[0x46] = avx.ShiftVar(shiftRightArithmetic)
+	table38[0x47] = avx.ShiftVar(shiftLeft)
+	table38[0x58] = avx.Broadcast(avx2, 32, false)
+	table38[0x59] = avx.Broadcast(avx2, 64, false)
+	table38[0x5a] = avx.Broadcast(avx2, 128, true)
+	table38[0x78] = avx.Broadcast(avx2, 8, false)
+	table38[0x79] = avx.Broadcast(avx2, 16, false)
+	table38[0x8c] = avx.MaskMov(avx2, 0, false)
+	table38[0x8e] = avx.MaskMov(avx2, 0, true)
+	table38[0x90] = avx.Gather(32)
+	table38[0x91] = avx.Gather(64)
+	table38[0x92] = avx.Gather(32)
+	table38[0x93] = avx.Gather(64)
+	for code := 0xdb; code <= 0xdf; code++ {
+		table38[code] = avx.AES(uint8(code))
+	}
+
+	table3A := &cpu.instrSetVEX[2]
+	table3A[0x00] = avx.PermQ
+	table3A[0x01] = avx.PermQ
+	table3A[0x02] = avx.Blendd
+	table3A[0x04] = avx.PermilImm(32)
+	table3A[0x05] = avx.PermilImm(64)
+	table3A[0x06] = avx.Perm2x128(avxFloat)
+	table3A[0x44] = avx.Pclmulqdq
+	table3A[0x18] = avx.Insert128(avxFloat)
+	table3A[0x19] = avx.Extract128(avxFloat)
+	table3A[0x38] = avx.Insert128(avx2)
+	table3A[0x39] = avx.Extract128(avx2)
+	table3A[0x46] = avx.Perm2x128(avx2)
+	table3A[0x4a] = avx.Blendv(32)
+	table3A[0x4b] = avx.Blendv(64)
+	table3A[0xdf] = avx.Aeskeygenassist
+	for _, t := range []*[0x100]func(){table38, table3A} {
+		for code, instr := range t {
+			if instr != nil {
+				t[code] = cpu.prefixed(nil, instr, nil, nil)
+			}
+		}
+	}
+
+	// BMI1 and BMI2 on the general registers
+	alu := cpu.alu
+	table38[0xf2] = cpu.prefixed(alu.andn, nil, nil, nil)
+	table38[0xf3] = cpu.prefixed(alu.group17, nil, nil, nil)
+	table38[0xf5] = cpu.prefixed(alu.bzhi, nil, alu.pext, alu.pdep)
+	table38[0xf6] = cpu.prefixed(nil, nil, nil, alu.mulx)
+	table38[0xf7] = cpu.prefixed(alu.bextr, alu.shiftx(shiftLeft), alu.shiftx(shiftRightArithmetic),
+		alu.shiftx(shiftRightLogical))
+	table3A[0xf0] = cpu.prefixed(nil, nil, nil, alu.rorx)
+}
+
+// prefixed dispatches a two-byte opcode on its mandatory prefix: none, 66, F3 or F2.
+// Forms without a handler raise #UD.
+func (cpu *CPU) prefixed(none func(), p66 func(), pF3 func(), pF2 func()) func() {
+	return func() {
+		var instr func()
+		switch cpu.reg.mandatoryPrefix() {
+		case 0:
+			instr = none
+		case 0x66:
+			instr = p66
+		case 0xf3:
+			instr = pF3
+		case 0xf2:
+			instr = pF2
+		}
+		if instr == nil {
+			raise(ExceptionUD)
+		}
+		instr()
+	}
+}
+
+// arith an SSE floating-point operation in its PS, PD, SS and SD forms
+func (cpu *CPU) arith(op uint8) func() {
+	sse := cpu.sse
+	return cpu.prefixed(sse.Arith(op, shapePS), sse.Arith(op, shapePD), sse.Arith(op, shapeSS), sse.Arith(op, shapeSD))
+}
+
+// vexArith an AVX floating-point operation in its PS, PD, SS and SD forms
+func (cpu *CPU) vexArith(op uint8) func() {
+	avx := cpu.avx
+	return cpu.prefixed(avx.Arith(op, shapePS), avx.Arith(op, shapePD), avx.Arith(op, shapeSS), avx.Arith(op, shapeSD))
+}
+
+// code0F two-byte opcode escape: handlers see EIP on the second opcode byte
+func (cpu *CPU) code0F() {
 	reg := cpu.reg
+	mem := cpu.mem
 	reg.EIP += 1
+	code := mem.GetCode8(0)
+	instr := cpu.instrSet0F()[code]
+	if instr == nil {
+		raise(ExceptionUD)
+	}
+	instr()
+}
+
+// code0F3 three-byte opcode escapes 0F 38 and 0F 3A: handlers see EIP on the third
+// opcode byte
+func (cpu *CPU) code0F3(table *[0x100]func()) func() {
+	return func() {
+		reg := cpu.reg
+		reg.EIP += 1
+		instr := table[cpu.mem.GetCode8(0)]
+		if instr == nil {
+			raise(ExceptionUD)
+		}
+		instr()
+	}
+}
+
+func (cpu *CPU) execNext() {
 	mem := cpu.mem
 	code := mem.GetCode8(0)
-	if cpu.instrSet[code] == nil {
-		log.Fatalf("Not Implemented: 0x%x\n", code)
+	instr := cpu.instrSet()[code]
+	if instr == nil {
+		raise(ExceptionUD)
 	}
-	cpu.instrSet[code]()
+	instr()
 }
 
-func (cpu *CPU) overrideOperandTo32() {
+func (cpu *CPU) overrideOperand() {
 	reg := cpu.reg
 	reg.EIP += 1
-	mem := cpu.mem
-	code := mem.GetCode8(0)
-	if cpu.instrSet[code] == nil {
-		log.Fatalf("Not Implemented: 0x%x\n", code)
+	reg.opOverride = true
+	cpu.execNext()
+}
+
+func (cpu *CPU) overrideAddress() {
+	reg := cpu.reg
+	reg.EIP += 1
+	reg.addrOverride = true
+	cpu.execNext()
+}
+
+func (cpu *CPU) overrideSegment(index uint8) func() {
+	return func() {
+		reg := cpu.reg
+		reg.EIP += 1
+		reg.segOverride = int8(index)
+		cpu.execNext()
+	}
+}
+
+// overrideRepeat REPNE (F2) and REP (F3) prefixes; the last one wins
+func (cpu *CPU) overrideRepeat(prefix uint8) func() {
+	return func() {
+		reg := cpu.reg
+		reg.EIP += 1
+		reg.repPrefix = prefix
+		cpu.execNext()
+	}
+}
+
+// lock the LOCK prefix (F0): #UD unless the instruction is lockable, which then holds the
+// bus until it completes
+func (cpu *CPU) lock() {
+	reg := cpu.reg
+	reg.EIP += 1
+	if !lockable(cpu.mem.GetCode8, false) {
+		raise(ExceptionUD)
+	}
+	if reg.lockPrefix {
+		cpu.execNext()
+		return
+	}
+	reg.lockPrefix = true
+	reg.bus.Lock()
+	defer reg.bus.Unlock()
+	cpu.execNext()
+}
+
+// vex the VEX prefixes C4 and C5, which select the opcode map and carry the mandatory
+// prefix, VEX.vvvv, VEX.L and VEX.W. In real and virtual-8086 mode, or unless the next byte
+// has both high bits set, these are LES and LDS, run by legacy. A 66, F2 or F3 prefix before
+// VEX raises #UD. Handlers see EIP on the opcode byte. In 64-bit mode, where they are always
+// VEX, R, X and B extend the registers like REX and VEX.vvvv has 16 registers.
+func (cpu *CPU) vex(prefix uint8, legacy func()) func() {
+	return func() {
+		reg := cpu.reg
+		mem := cpu.mem
+		payload := mem.GetCode8(1)
+		if !reg.mode64 && (reg.realSegments() || payload < 0xc0) {
+			legacy()
+			return
+		}
+		if reg.opOverride || reg.repPrefix != 0 || reg.rex != 0 {
+			raise(ExceptionUD)
+		}
+		v := vexPrefix{present: true}
+		opcodeMap := uint8(1)
+		last := payload
+		// R, X and B are stored inverted; C5 only has R
+		rxb := ^payload >> 7 & 1 << 2
+		if prefix == 0xc4 {
+			opcodeMap = payload & 0x1f
+			rxb = ^payload >> 5 & 7
+			last = mem.GetCode8(2)
+			v.w = last&0x80 != 0
+			reg.EIP += 3
+		} else {
+			reg.EIP += 2
+		}
+		// outside 64-bit mode the high bit of VEX.vvvv is ignored
+		v.vvvv = ^last >> 3 & 7
+		v.l = last >> 2 & 1
+		v.pp = last & 3
+		if opcodeMap < 1 || opcodeMap > 3 {
+			raise(ExceptionUD)
+		}
+		if reg.mode64 {
+			v.vvvv = ^last >> 3 & 15
+			reg.rex = 0x40 | rxb
+			if v.w {
+				reg.rex |= 8
+			}
+			reg.immediate = immediateSize(opcodeMap, mem.GetCode8(0))
+		}
+		reg.vex = v
+		instr := cpu.instrSetVEX[opcodeMap-1][mem.GetCode8(0)]
+		if instr == nil {
+			raise(ExceptionUD)
+		}
+		instr()
 	}
-	cpu.instrSet[code]()
 }
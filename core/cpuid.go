@@ -0,0 +1,301 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CPUID leaf 1 EDX feature bits
+const (
+	FeatureFPU   = 1 << 0  // x87 FPU on chip
+	FeatureVME   = 1 << 1  // Virtual-8086 Mode Extensions
+	FeatureDE    = 1 << 2  // Debugging Extensions
+	FeaturePSE   = 1 << 3  // Page Size Extension
+	FeatureTSC   = 1 << 4  // Time Stamp Counter
+	FeatureMSR   = 1 << 5  // RDMSR and WRMSR
+	FeaturePAE   = 1 << 6  // Physical Address Extension
+	FeatureMCE   = 1 << 7  // Machine Check Exception
+	FeatureCX8   = 1 << 8  // CMPXCHG8B
+	FeatureAPIC  = 1 << 9  // APIC on chip
+	FeatureSEP   = 1 << 11 // SYSENTER and SYSEXIT
+	FeatureMTRR  = 1 << 12 // Memory Type Range Registers
+	FeaturePGE   = 1 << 13 // Page Global Enable
+	FeatureMCA   = 1 << 14 // Machine Check Architecture
+	FeatureCMOV  = 1 << 15 // conditional moves
+	FeaturePAT   = 1 << 16 // Page Attribute Table
+	FeaturePSE36 = 1 << 17 // 36-bit Page Size Extension
+	FeatureCLFSH = 1 << 19 // CLFLUSH
+	FeatureMMX   = 1 << 23 // MMX technology
+	FeatureFXSR  = 1 << 24 // FXSAVE and FXRSTOR
+	FeatureSSE   = 1 << 25 // SSE
+	FeatureSSE2  = 1 << 26 // SSE2
+)
+
+// CPUID leaf 1 ECX feature bits
+const (
+	FeatureSSE3      = 1 << 0  // SSE3
+	FeaturePCLMULQDQ = 1 << 1  // carry-less multiplication
+	FeatureSSSE3     = 1 << 9  // Supplemental SSE3
+	FeatureFMA       = 1 << 12 // fused multiply-add
+	FeatureCX16      = 1 << 13 // CMPXCHG16B
+	FeatureSSE41     = 1 << 19 // SSE4.1
+	FeatureSSE42     = 1 << 20 // SSE4.2
+	FeatureMOVBE     = 1 << 22 // MOVBE
+	FeaturePOPCNT    = 1 << 23 // POPCNT
+	FeatureAES       = 1 << 25 // AES-NI
+	FeatureXSAVE     = 1 << 26 // XSAVE, XRSTOR, XSETBV, XGETBV
+	FeatureOSXSAVE   = 1 << 27 // CR4.OSXSAVE, reported from CR4
+	FeatureAVX       = 1 << 28 // AVX
+	FeatureF16C      = 1 << 29 // half-precision conversions
+	FeatureRDRAND    = 1 << 30 // RDRAND
+)
+
+// CPUID leaf 7 EBX feature bits
+const (
+	FeatureBMI1   = 1 << 3  // BMI1
+	FeatureAVX2   = 1 << 5  // AVX2
+	FeatureBMI2   = 1 << 8  // BMI2
+	FeatureRDSEED = 1 << 18 // RDSEED
+	FeatureADX    = 1 << 19 // ADCX and ADOX
+	FeatureSHA    = 1 << 29 // SHA extensions
+)
+
+// CPUID leaf 0x80000001 ECX and EDX feature bits
+const (
+	FeatureLAHF    = 1 << 0  // ECX: LAHF and SAHF in 64-bit mode
+	FeatureABM     = 1 << 5  // ECX: LZCNT
+	FeatureSYSCALL = 1 << 11 // EDX: SYSCALL and SYSRET
+	FeatureNX      = 1 << 20 // EDX: execute disable
+	FeaturePage1GB = 1 << 26 // EDX: 1 GiB pages in long mode
+	FeatureRDTSCP  = 1 << 27 // EDX: RDTSCP
+	FeatureLM      = 1 << 29 // EDX: long mode
+)
+
+// Features CPUID feature words
+type Features struct {
+	Leaf1ECX uint32
+	Leaf1EDX uint32
+	Leaf7EBX uint32
+	Leaf7ECX uint32
+	Leaf7EDX uint32
+	ExtECX   uint32
+	ExtEDX   uint32
+}
+
+func (f Features) and(g Features) Features {
+	return Features{
+		Leaf1ECX: f.Leaf1ECX & g.Leaf1ECX,
+		Leaf1EDX: f.Leaf1EDX & g.Leaf1EDX,
+		Leaf7EBX: f.Leaf7EBX & g.Leaf7EBX,
+		Leaf7ECX: f.Leaf7ECX & g.Leaf7ECX,
+		Leaf7EDX: f.Leaf7EDX & g.Leaf7EDX,
+		ExtECX:   f.ExtECX & g.ExtECX,
+		ExtEDX:   f.ExtEDX & g.ExtEDX,
+	}
+}
+
+// implementedFeatures the features the emulator executes. CPUID never advertises more,
+// whatever the profile claims, so guests do not take paths into unimplemented opcodes.
+var implementedFeatures = Features{
+	Leaf1ECX: FeaturePCLMULQDQ | FeatureCX16 | FeaturePOPCNT | FeatureAES | FeatureXSAVE | FeatureAVX | FeatureRDRAND,
+	Leaf1EDX: FeatureFPU | FeatureVME | FeatureDE | FeaturePSE | FeatureTSC | FeatureMSR | FeaturePAE | FeatureCX8 | FeatureSEP | FeatureMTRR |
+		FeaturePGE | FeatureCMOV | FeaturePAT | FeaturePSE36 | FeatureMMX | FeatureFXSR | FeatureSSE | FeatureSSE2,
+	Leaf7EBX: FeatureBMI1 | FeatureAVX2 | FeatureBMI2 | FeatureRDSEED | FeatureSHA,
+	ExtECX:   FeatureLAHF | FeatureABM,
+	ExtEDX:   FeatureSYSCALL | FeatureNX | FeaturePage1GB | FeatureRDTSCP | FeatureLM,
+}
+
+// Profile the identity and the features a processor model reports through CPUID
+type Profile struct {
+	Name     string
+	Vendor   string // 12 characters
+	Brand    string // up to 48 characters
+	Family   uint32
+	Model    uint32
+	Stepping uint32
+	MaxLeaf  uint32 // highest basic leaf
+	Features Features
+}
+
+// Supported returns the features of the profile that the emulator implements. AVX needs
+// XSAVE to enable its state, so it is only reported along with it.
+func (p *Profile) Supported() Features {
+	f := p.Features.and(implementedFeatures)
+	if f.Leaf1ECX&FeatureXSAVE == 0 {
+		f.Leaf1ECX &^= FeatureAVX
+		f.Leaf7EBX &^= FeatureAVX2
+	}
+	return f
+}
+
+// features the CPUID features of the processor, which gate the optional instructions
+func (r *X86Registers) features() Features {
+	return r.profile.Supported()
+}
+
+var profiles = map[string]*Profile{
+	"486": {
+		Name: "486", Vendor: "GenuineIntel", Brand: "Intel486 DX4",
+		Family: 4, Model: 8, Stepping: 0, MaxLeaf: 1,
+		Features: Features{
+			Leaf1EDX: FeatureFPU | FeatureVME,
+		},
+	},
+	"pentium": {
+		Name: "pentium", Vendor: "GenuineIntel", Brand: "Intel Pentium with MMX Technology",
+		Family: 5, Model: 4, Stepping: 3, MaxLeaf: 1,
+		Features: Features{
+			Leaf1EDX: FeatureFPU | FeatureVME | FeatureDE | FeaturePSE | FeatureTSC | FeatureMSR |
+				FeatureMCE | FeatureCX8 | FeatureMMX,
+		},
+	},
+	"pentium3": {
+		Name: "pentium3", Vendor: "GenuineIntel", Brand: "Intel Pentium III",
+		Family: 6, Model: 8, Stepping: 3, MaxLeaf: 2,
+		Features: Features{
+			Leaf1EDX: FeatureFPU | FeatureVME | FeatureDE | FeaturePSE | FeatureTSC | FeatureMSR |
+				FeaturePAE | FeatureMCE | FeatureCX8 | FeatureAPIC | FeatureSEP | FeatureMTRR |
+				FeaturePGE | FeatureMCA | FeatureCMOV | FeaturePAT | FeaturePSE36 | FeatureMMX |
+				FeatureFXSR | FeatureSSE,
+		},
+	},
+	"pentium4": {
+		Name: "pentium4", Vendor: "GenuineIntel", Brand: "Intel Pentium 4 CPU 3.00GHz",
+		Family: 15, Model: 4, Stepping: 1, MaxLeaf: 5,
+		Features: Features{
+			Leaf1EDX: FeatureFPU | FeatureVME | FeatureDE | FeaturePSE | FeatureTSC | FeatureMSR |
+				FeaturePAE | FeatureMCE | FeatureCX8 | FeatureAPIC | FeatureSEP | FeatureMTRR |
+				FeaturePGE | FeatureMCA | FeatureCMOV | FeaturePAT | FeaturePSE36 | FeatureCLFSH |
+				FeatureMMX | FeatureFXSR | FeatureSSE | FeatureSSE2,
+			Leaf1ECX: FeatureSSE3 | FeatureCX16,
+			ExtEDX:   FeatureSYSCALL | FeatureNX | FeatureLM,
+			ExtECX:   FeatureLAHF,
+		},
+	},
+	"haswell": {
+		Name: "haswell", Vendor: "GenuineIntel", Brand: "Intel Core i7-4770 CPU @ 3.40GHz",
+		Family: 6, Model: 60, Stepping: 3, MaxLeaf: 0xd,
+		Features: Features{
+			Leaf1EDX: FeatureFPU | FeatureVME | FeatureDE | FeaturePSE | FeatureTSC | FeatureMSR |
+				FeaturePAE | FeatureMCE | FeatureCX8 | FeatureAPIC | FeatureSEP | FeatureMTRR |
+				FeaturePGE | FeatureMCA | FeatureCMOV | FeaturePAT | FeaturePSE36 | FeatureCLFSH |
+				FeatureMMX | FeatureFXSR | FeatureSSE | FeatureSSE2,
+			Leaf1ECX: FeatureSSE3 | FeaturePCLMULQDQ | FeatureSSSE3 | FeatureFMA | FeatureCX16 |
+				FeatureSSE41 | FeatureSSE42 | FeatureMOVBE | FeaturePOPCNT | FeatureAES |
+				FeatureXSAVE | FeatureAVX | FeatureF16C | FeatureRDRAND,
+			Leaf7EBX: FeatureBMI1 | FeatureAVX2 | FeatureBMI2,
+			ExtEDX:   FeatureSYSCALL | FeatureNX | FeaturePage1GB | FeatureRDTSCP | FeatureLM,
+			ExtECX:   FeatureLAHF | FeatureABM,
+		},
+	},
+	"max": {
+		Name: "max", Vendor: "GenuineIntel", Brand: "ia32emu virtual CPU",
+		Family: 6, Model: 158, Stepping: 10, MaxLeaf: 0xd,
+		Features: Features{
+			Leaf1ECX: ^uint32(0), Leaf1EDX: ^uint32(0),
+			Leaf7EBX: ^uint32(0), Leaf7ECX: ^uint32(0), Leaf7EDX: ^uint32(0),
+			ExtECX: ^uint32(0), ExtEDX: ^uint32(0),
+		},
+	},
+}
+
+// DefaultProfile the profile used when none is chosen: everything the emulator implements
+const DefaultProfile = "max"
+
+// LookupProfile returns the CPU profile called name
+func LookupProfile(name string) (*Profile, error) {
+	p, ok := profiles[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown CPU profile %q, available: %s", name, strings.Join(ProfileNames(), ", "))
+	}
+	return p, nil
+}
+
+// ProfileNames names of the built-in CPU profiles
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+const (
+	extendedLeaves = 0x80000000
+	maxExtLeaf     = 0x80000008
+)
+
+// Cpuid CPUID (0F A2): processor identification for the leaf in EAX and the subleaf in ECX
+func (s *System) Cpuid() {
+	reg := s.reg
+	reg.EIP += 1
+	reg.EAX, reg.EBX, reg.ECX, reg.EDX = cpuid(reg, reg.EAX, reg.ECX)
+}
+
+// cpuid returns EAX, EBX, ECX and EDX of a leaf. Leaves above the highest basic or extended
+// leaf return the highest basic leaf, like Intel processors do.
+func cpuid(reg *X86Registers, leaf uint32, subleaf uint32) (uint32, uint32, uint32, uint32) {
+	p := reg.profile
+	features := reg.features()
+	if leaf > p.MaxLeaf && leaf < extendedLeaves || leaf > maxExtLeaf {
+		leaf = p.MaxLeaf
+	}
+	switch leaf {
+	case 0:
+		return p.MaxLeaf, registerString(p.Vendor, 0), registerString(p.Vendor, 8), registerString(p.Vendor, 4)
+	case 1:
+		family, extFamily := p.Family, uint32(0)
+		if family > 15 {
+			family, extFamily = 15, p.Family-15
+		}
+		model := p.Model
+		eax := p.Stepping | (model&0xf)<<4 | family<<8 | (model>>4)<<16 | extFamily<<20
+		ebx := uint32(1) << 16 // one logical processor, APIC ID 0
+		if features.Leaf1EDX&FeatureCLFSH != 0 {
+			ebx |= 8 << 8 // CLFLUSH line size in quadwords
+		}
+		ecx := features.Leaf1ECX &^ FeatureOSXSAVE
+		if ecx&FeatureXSAVE != 0 && reg.CR4&CR4OSXSAVE != 0 {
+			ecx |= FeatureOSXSAVE
+		}
+		return eax, ebx, ecx, features.Leaf1EDX
+	case 2:
+		// one iteration, no cache or TLB descriptors
+		return 1, 0, 0, 0
+	case 7:
+		if subleaf != 0 {
+			return 0, 0, 0, 0
+		}
+		return 0, features.Leaf7EBX, features.Leaf7ECX, features.Leaf7EDX
+	case 0xd:
+		return xsaveLeaf(reg, subleaf)
+	case extendedLeaves:
+		return maxExtLeaf, 0, 0, 0
+	case extendedLeaves + 1:
+		return 0, 0, features.ExtECX, features.ExtEDX
+	case extendedLeaves + 2, extendedLeaves + 3, extendedLeaves + 4:
+		offset := int(leaf-extendedLeaves-2) * 16
+		return registerString(p.Brand, offset), registerString(p.Brand, offset+4),
+			registerString(p.Brand, offset+8), registerString(p.Brand, offset+12)
+	case extendedLeaves + 8:
+		linear := uint32(32)
+		if features.ExtEDX&FeatureLM != 0 {
+			linear = 48
+		}
+		return linear<<8 | maxPhysAddr, 0, 0, 0
+	}
+	return 0, 0, 0, 0
+}
+
+// registerString packs 4 bytes of s from offset in a register, little-endian and padded with NUL
+func registerString(s string, offset int) uint32 {
+	var value uint32
+	for i := 0; i < 4; i++ {
+		if offset+i < len(s) {
+			value |= uint32(s[offset+i]) << (8 * i)
+		}
+	}
+	return value
+}
@@ -0,0 +1,45 @@
+package core
+
+import "testing"
+
+// BMI1, BMI2, RDRAND and RDSEED are reported in 64-bit mode too, which runs their 64-bit forms
+func TestLongModeFeatures(t *testing.T) {
+	reported := uint32(FeatureBMI1 | FeatureBMI2 | FeatureRDSEED)
+	for _, bitMode := range []int{32, 64} {
+		emu := newBare(t, bitMode, []byte{0xf4})
+		reg := emu.cpu.(*CPU).reg
+		_, _, ecx, _ := cpuid(reg, 1, 0)
+		_, ebx, _, _ := cpuid(reg, 7, 0)
+		if ebx&reported != reported || ecx&FeatureRDRAND == 0 {
+			t.Errorf("%d-bit: BMI1, BMI2, RDRAND or RDSEED not reported", bitMode)
+		}
+		if ecx&FeatureAES == 0 || ebx&FeatureAVX2 == 0 {
+			t.Errorf("%d-bit: AES or AVX2 not reported", bitMode)
+		}
+	}
+}
+
+// The x86-64 baseline, CMOV, CX8, FPU, FXSR, MMX, SSE and SSE2, and CMPXCHG16B are reported
+// and executed
+func TestBaselineFeatures(t *testing.T) {
+	code := []byte{
+		0xbe, 0x00, 0x18, 0x00, 0x00, // mov $0x1800, %esi
+		0x48, 0x0f, 0xc7, 0x0e, // cmpxchg16b (%rsi)
+		0xf4, // hlt
+	}
+	emu := newBare(t, 64, code)
+	cpu := emu.cpu.(*CPU)
+	reg := cpu.reg
+	_, _, ecx, edx := cpuid(reg, 1, 0)
+	baseline := uint32(FeatureCMOV | FeatureCX8 | FeatureFPU | FeatureFXSR | FeatureMMX | FeatureSSE | FeatureSSE2)
+	if edx&baseline != baseline || ecx&FeatureCX16 == 0 {
+		t.Errorf("leaf 1 EDX, ECX = %#x, %#x, missing %#x, %#x", edx, ecx, baseline&^edx, FeatureCX16&^ecx)
+	}
+	reg.X64.RBX, reg.X64.RCX = 1, 2
+	if err := emu.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if low, high := cpu.mem.ReadPhys64(0x1800), cpu.mem.ReadPhys64(0x1808); low != 1 || high != 2 || !reg.IsZF() {
+		t.Errorf("m128 = %#x:%#x, ZF %v, want 2:1, true", high, low, reg.IsZF())
+	}
+}
@@ -0,0 +1,392 @@
+package core
+
+import "math/bits"
+
+// AES-NI, PCLMULQDQ and SHA instructions on the XMM registers. The AES state is the
+// register in memory byte order, four bytes per column.
+
+var aesSbox, aesInvSbox [256]uint8
+
+func init() {
+	// walk the multiplicative group with generator 3: p = 3^i and q = 3^-i, so q is the
+	// inverse of p, then apply the affine transform
+	p, q := uint8(1), uint8(1)
+	for {
+		high := p & 0x80
+		p ^= p << 1
+		if high != 0 {
+			p ^= 0x1b
+		}
+		q ^= q << 1
+		q ^= q << 2
+		q ^= q << 4
+		if q&0x80 != 0 {
+			q ^= 0x09
+		}
+		x := q ^ bits.RotateLeft8(q, 1) ^ bits.RotateLeft8(q, 2) ^ bits.RotateLeft8(q, 3) ^ bits.RotateLeft8(q, 4)
+		aesSbox[p] = x ^ 0x63
+		if p == 1 {
+			break
+		}
+	}
+	aesSbox[0] = 0x63
+	for i, v := range aesSbox {
+		aesInvSbox[v] = uint8(i)
+	}
+}
+
+// gfMul multiplies in GF(2^8) modulo the AES polynomial
+func gfMul(a uint8, b uint8) uint8 {
+	var r uint8
+	for ; b != 0; b >>= 1 {
+		if b&1 != 0 {
+			r ^= a
+		}
+		high := a & 0x80
+		a <<= 1
+		if high != 0 {
+			a ^= 0x1b
+		}
+	}
+	return r
+}
+
+func xmmBytes(x XMM) [16]uint8 {
+	var b [16]uint8
+	for i := range b {
+		b[i] = uint8(x[i/8] >> (8 * uint(i%8)))
+	}
+	return b
+}
+
+func bytesXMM(b [16]uint8) XMM {
+	var x XMM
+	for i, v := range b {
+		x[i/8] |= uint64(v) << (8 * uint(i%8))
+	}
+	return x
+}
+
+// AES round steps
+var (
+	aesMix    = [4]uint8{2, 3, 1, 1}
+	aesInvMix = [4]uint8{14, 11, 13, 9}
+)
+
+func mixColumns(s [16]uint8, coefficients [4]uint8) [16]uint8 {
+	var r [16]uint8
+	for c := 0; c < 16; c += 4 {
+		for row := 0; row < 4; row++ {
+			var v uint8
+			for j := 0; j < 4; j++ {
+				v ^= gfMul(coefficients[(j-row+4)%4], s[c+j])
+			}
+			r[c+row] = v
+		}
+	}
+	return r
+}
+
+// shiftRows rotates row r left by r columns, or right when inverse, and substitutes the bytes
+func shiftRows(s [16]uint8, inverse bool) [16]uint8 {
+	var r [16]uint8
+	for row := 0; row < 4; row++ {
+		for c := 0; c < 4; c++ {
+			from := (c + row) % 4
+			if inverse {
+				from = (c - row + 4) % 4
+				r[row+4*c] = aesInvSbox[s[row+4*from]]
+			} else {
+				r[row+4*c] = aesSbox[s[row+4*from]]
+			}
+		}
+	}
+	return r
+}
+
+// aesRound AESENC, AESENCLAST, AESDEC, AESDECLAST and AESIMC by third opcode byte
+func aesRound(code uint8, state XMM, key XMM) XMM {
+	s := xmmBytes(state)
+	switch code {
+	case 0xdb:
+		return bytesXMM(mixColumns(s, aesInvMix))
+	case 0xdc:
+		s = mixColumns(shiftRows(s, false), aesMix)
+	case 0xdd:
+		s = shiftRows(s, false)
+	case 0xde:
+		s = mixColumns(shiftRows(s, true), aesInvMix)
+	case 0xdf:
+		s = shiftRows(s, true)
+	}
+	r := bytesXMM(s)
+	return XMM{r[0] ^ key[0], r[1] ^ key[1]}
+}
+
+func subWord(w uint32) uint32 {
+	var r uint32
+	for i := uint(0); i < 32; i += 8 {
+		r |= uint32(aesSbox[uint8(w>>i)]) << i
+	}
+	return r
+}
+
+// keygenAssist AESKEYGENASSIST: SubWord and RotWord of dwords 1 and 3, with rcon
+func keygenAssist(src XMM, rcon uint8) XMM {
+	x1, x3 := subWord(uint32(src.lane(1, 32))), subWord(uint32(src.lane(3, 32)))
+	var r XMM
+	r.setLane(0, 32, uint64(x1))
+	r.setLane(1, 32, uint64(bits.RotateLeft32(x1, -8)^uint32(rcon)))
+	r.setLane(2, 32, uint64(x3))
+	r.setLane(3, 32, uint64(bits.RotateLeft32(x3, -8)^uint32(rcon)))
+	return r
+}
+
+// clmul carry-less product of a and b
+func clmul(a uint64, b uint64) XMM {
+	var r XMM
+	for i := uint(0); i < 64; i++ {
+		if b>>i&1 != 0 {
+			r[0] ^= a << i
+			if i != 0 {
+				r[1] ^= a >> (64 - i)
+			}
+		}
+	}
+	return r
+}
+
+// pclmul PCLMULQDQ: the quadwords of a and b selected by imm8 bits 0 and 4
+func pclmul(a XMM, b XMM, imm uint8) XMM {
+	return clmul(a[imm&1], b[imm>>4&1])
+}
+
+// sha1Rounds SHA1RNDS4: four SHA-1 rounds on A-D in the dwords 3-0 of state, with the
+// message dwords and E of the first round in w, using the function and constant of imm8
+func sha1Rounds(state XMM, w XMM, imm uint8) XMM {
+	a, b, c, d := uint32(state.lane(3, 32)), uint32(state.lane(2, 32)), uint32(state.lane(1, 32)), uint32(state.lane(0, 32))
+	var e uint32
+	k := [4]uint32{0x5a827999, 0x6ed9eba1, 0x8f1bbcdc, 0xca62c1d6}[imm&3]
+	for i := uint(0); i < 4; i++ {
+		var f uint32
+		switch imm & 3 {
+		case 0:
+			f = b&c ^ ^b&d
+		case 2:
+			f = b&c ^ b&d ^ c&d
+		default:
+			f = b ^ c ^ d
+		}
+		t := f + bits.RotateLeft32(a, 5) + uint32(w.lane(3-i, 32)) + e + k
+		a, b, c, d, e = t, a, bits.RotateLeft32(b, 30), c, d
+	}
+	var r XMM
+	r.setLane(3, 32, uint64(a))
+	r.setLane(2, 32, uint64(b))
+	r.setLane(1, 32, uint64(c))
+	r.setLane(0, 32, uint64(d))
+	return r
+}
+
+// sha1Nexte SHA1NEXTE: E from A of the previous state rotated, added to dword 3 of w
+func sha1Nexte(state XMM, w XMM) XMM {
+	w.setLane(3, 32, uint64(uint32(w.lane(3, 32))+bits.RotateLeft32(uint32(state.lane(3, 32)), 30)))
+	return w
+}
+
+// sha1Msg1 SHA1MSG1: the XOR of message dwords i and i+2 for the next four ones
+func sha1Msg1(a XMM, b XMM) XMM {
+	w := [6]uint32{uint32(a.lane(3, 32)), uint32(a.lane(2, 32)), uint32(a.lane(1, 32)), uint32(a.lane(0, 32)),
+		uint32(b.lane(3, 32)), uint32(b.lane(2, 32))}
+	var r XMM
+	for i := uint(0); i < 4; i++ {
+		r.setLane(3-i, 32, uint64(w[i+2]^w[i]))
+	}
+	return r
+}
+
+// sha1Msg2 SHA1MSG2: the next four message dwords from SHA1MSG1 results and dwords 13-15
+func sha1Msg2(a XMM, b XMM) XMM {
+	w := [7]uint32{uint32(b.lane(2, 32)), uint32(b.lane(1, 32)), uint32(b.lane(0, 32))}
+	var r XMM
+	for i := uint(0); i < 4; i++ {
+		w[i+3] = bits.RotateLeft32(uint32(a.lane(3-i, 32))^w[i], 1)
+		r.setLane(3-i, 32, uint64(w[i+3]))
+	}
+	return r
+}
+
+// sha256Rounds SHA256RNDS2: two SHA-256 rounds with C, D, G and H in dwords 3-0 of cdgh,
+// A, B, E and F in those of abef, and the message plus constant dwords in wk; returns
+// the new A, B, E and F
+func sha256Rounds(cdgh XMM, abef XMM, wk XMM) XMM {
+	a, b, e, f := uint32(abef.lane(3, 32)), uint32(abef.lane(2, 32)), uint32(abef.lane(1, 32)), uint32(abef.lane(0, 32))
+	c, d, g, h := uint32(cdgh.lane(3, 32)), uint32(cdgh.lane(2, 32)), uint32(cdgh.lane(1, 32)), uint32(cdgh.lane(0, 32))
+	for i := uint(0); i < 2; i++ {
+		ch := e&f ^ ^e&g
+		maj := a&b ^ a&c ^ b&c
+		s0 := bits.RotateLeft32(a, -2) ^ bits.RotateLeft32(a, -13) ^ bits.RotateLeft32(a, -22)
+		s1 := bits.RotateLeft32(e, -6) ^ bits.RotateLeft32(e, -11) ^ bits.RotateLeft32(e, -25)
+		t := ch + s1 + uint32(wk.lane(i, 32)) + h
+		a, b, c, d, e, f, g, h = t+maj+s0, a, b, c, t+d, e, f, g
+	}
+	var r XMM
+	r.setLane(3, 32, uint64(a))
+	r.setLane(2, 32, uint64(b))
+	r.setLane(1, 32, uint64(e))
+	r.setLane(0, 32, uint64(f))
+	return r
+}
+
+// sha256Msg1 SHA256MSG1: message dword i plus sigma0 of dword i+1 for the next four ones
+func sha256Msg1(a XMM, b XMM) XMM {
+	var r XMM
+	for i := uint(0); i < 4; i++ {
+		next := b.lane(0, 32)
+		if i < 3 {
+			next = a.lane(i+1, 32)
+		}
+		w := uint32(next)
+		sigma := bits.RotateLeft32(w, -7) ^ bits.RotateLeft32(w, -18) ^ w>>3
+		r.setLane(i, 32, uint64(uint32(a.lane(i, 32))+sigma))
+	}
+	return r
+}
+
+// sha256Msg2 SHA256MSG2: the next four message dwords, adding sigma1 of dwords 14 and 15
+// of b and then of the first two new ones
+func sha256Msg2(a XMM, b XMM) XMM {
+	w := [6]uint32{uint32(b.lane(2, 32)), uint32(b.lane(3, 32))}
+	var r XMM
+	for i := uint(0); i < 4; i++ {
+		x := w[i]
+		sigma := bits.RotateLeft32(x, -17) ^ bits.RotateLeft32(x, -19) ^ x>>10
+		w[i+2] = uint32(a.lane(i, 32)) + sigma
+		r.setLane(i, 32, uint64(w[i+2]))
+	}
+	return r
+}
+
+// sha256Rounds2 SHA256RNDS2 with its implicit XMM0 operand
+func (s *SSE) sha256Rounds2(a XMM, b XMM) XMM {
+	return sha256Rounds(a, b, s.reg.XMM[0])
+}
+
+// decodeExtension like decode for the instructions of later extensions, whose CPUID bits
+// live outside leaf 1 EDX
+func (s *SSE) decodeExtension(supported bool) ModRM {
+	if !supported {
+		raise(ExceptionUD)
+	}
+	return s.decode(FeatureSSE2)
+}
+
+// cryptoOp xmm = op(xmm, xmm/m128) for the instructions of feature, which are in leaf 1 ECX
+// or leaf 7 EBX
+func (s *SSE) cryptoOp(leaf7 bool, feature uint32, op func(a XMM, b XMM) XMM) func() {
+	return func() {
+		reg := s.reg
+		features := reg.features()
+		supported := features.Leaf1ECX&feature != 0
+		if leaf7 {
+			supported = features.Leaf7EBX&feature != 0
+		}
+		modrm := s.decodeExtension(supported)
+		src := s.read(&modrm, 16, true)
+		reg.XMM[modrm.RegIndex] = op(reg.XMM[modrm.RegIndex], src)
+	}
+}
+
+// cryptoImm like cryptoOp with an imm8 operand
+func (s *SSE) cryptoImm(leaf7 bool, feature uint32, op func(a XMM, b XMM, imm uint8) XMM) func() {
+	return func() {
+		reg := s.reg
+		features := reg.features()
+		supported := features.Leaf1ECX&feature != 0
+		if leaf7 {
+			supported = features.Leaf7EBX&feature != 0
+		}
+		modrm := s.decodeExtension(supported)
+		src := s.read(&modrm, 16, true)
+		reg.XMM[modrm.RegIndex] = op(reg.XMM[modrm.RegIndex], src, s.imm8())
+	}
+}
+
+// AES AESENC, AESENCLAST, AESDEC, AESDECLAST (66 0F38 DC-DF) and AESIMC (66 0F38 DB)
+func (s *SSE) AES(code uint8) func() {
+	return s.cryptoOp(false, FeatureAES, func(a XMM, b XMM) XMM {
+		if code == 0xdb {
+			return aesRound(code, b, XMM{})
+		}
+		return aesRound(code, a, b)
+	})
+}
+
+// Aeskeygenassist AESKEYGENASSIST xmm, xmm/m128, imm8 (66 0F3A DF)
+func (s *SSE) Aeskeygenassist() func() {
+	return s.cryptoImm(false, FeatureAES, func(a XMM, b XMM, imm uint8) XMM {
+		return keygenAssist(b, imm)
+	})
+}
+
+// Pclmulqdq PCLMULQDQ xmm, xmm/m128, imm8 (66 0F3A 44)
+func (s *SSE) Pclmulqdq() func() {
+	return s.cryptoImm(false, FeaturePCLMULQDQ, pclmul)
+}
+
+// SHA SHA1NEXTE, SHA1MSG1, SHA1MSG2, SHA256RNDS2, SHA256MSG1 and SHA256MSG2 (0F38 C8-CD)
+func (s *SSE) SHA(op func(a XMM, b XMM) XMM) func() {
+	return s.cryptoOp(true, FeatureSHA, op)
+}
+
+// Sha1rnds4 SHA1RNDS4 xmm, xmm/m128, imm8 (0F3A CC)
+func (s *SSE) Sha1rnds4() func() {
+	return s.cryptoImm(true, FeatureSHA, sha1Rounds)
+}
+
+// AES the VEX.128 forms VAESENC, VAESENCLAST, VAESDEC, VAESDECLAST and VAESIMC, which also
+// need the AES feature
+func (a *AVX) AES(code uint8) func() {
+	return func() {
+		reg := a.reg
+		modrm := a.decodeCrypto(FeatureAES)
+		src := a.read(&modrm, 16, false).half(0)
+		var result XMM
+		if code == 0xdb {
+			a.noSource()
+			result = aesRound(code, src, XMM{})
+		} else {
+			result = aesRound(code, a.src1().half(0), src)
+		}
+		reg.SetYMM(modrm.RegIndex, YMM{result[0], result[1]})
+	}
+}
+
+// Aeskeygenassist VAESKEYGENASSIST xmm, xmm/m128, imm8
+func (a *AVX) Aeskeygenassist() {
+	reg := a.reg
+	modrm := a.decodeCrypto(FeatureAES)
+	a.noSource()
+	src := a.read(&modrm, 16, false).half(0)
+	result := keygenAssist(src, a.sse.imm8())
+	reg.SetYMM(modrm.RegIndex, YMM{result[0], result[1]})
+}
+
+// Pclmulqdq VPCLMULQDQ xmm, xmm, xmm/m128, imm8
+func (a *AVX) Pclmulqdq() {
+	reg := a.reg
+	modrm := a.decodeCrypto(FeaturePCLMULQDQ)
+	src := a.read(&modrm, 16, false).half(0)
+	result := pclmul(a.src1().half(0), src, a.sse.imm8())
+	reg.SetYMM(modrm.RegIndex, YMM{result[0], result[1]})
+}
+
+// decodeCrypto the VEX.128 AES and PCLMULQDQ forms need AVX and their leaf 1 ECX feature
+func (a *AVX) decodeCrypto(feature uint32) ModRM {
+	if a.reg.features().Leaf1ECX&feature == 0 {
+		raise(ExceptionUD)
+	}
+	modrm := a.decode(avxFloat)
+	a.only128()
+	return modrm
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// aesState the XMM register holding the state or round key written as in FIPS-197, bytes in
+// memory order
+func aesState(t *testing.T, s string) XMM {
+	t.Helper()
+	var b [16]uint8
+	if n, err := hex.Decode(b[:], []byte(s)); err != nil || n != 16 {
+		t.Fatalf("bad state %q", s)
+	}
+	return bytesXMM(b)
+}
+
+// shaWords the XMM register with dwords 3 to 0, as the SHA instructions list A to D
+func shaWords(d3, d2, d1, d0 uint32) XMM {
+	return XMM{uint64(d1)<<32 | uint64(d0), uint64(d3)<<32 | uint64(d2)}
+}
+
+// TestCrypto checks the AES, PCLMULQDQ and SHA instructions with the values of FIPS-197, the
+// Intel carry-less multiplication white paper and FIPS-180 on xmm1 and xmm2, and the round
+// constants in XMM0 for SHA256RNDS2
+func TestCrypto(t *testing.T) {
+	// FIPS-197 appendix B, the cipher example, and C.1, the AES-128 inverse cipher
+	state := func(s string) XMM { return aesState(t, s) }
+	clmulA := XMM{0x63746f725d53475d, 0x7b5b546573745665}
+	clmulB := XMM{0x5b477565726f6e5d, 0x4869285368617929}
+	tests := []struct {
+		name       string
+		code       []byte
+		xmm0       XMM
+		xmm1, xmm2 XMM
+		want       XMM // xmm1
+	}{
+		// the start of round 1 with its key gives the start of round 2, that of round 10 the output
+		{"aesenc", []byte{0x66, 0x0f, 0x38, 0xdc, 0xca}, XMM{},
+			state("193de3bea0f4e22b9ac68d2ae9f84808"), state("a0fafe1788542cb123a339392a6c7605"),
+			state("a49c7ff2689f352b6b5bea43026a5049")},
+		{"aesenclast", []byte{0x66, 0x0f, 0x38, 0xdd, 0xca}, XMM{},
+			state("eb40f21e592e38848ba113e71bc342d2"), state("d014f9a8c9ee2589e13f0cc8b6630ca6"),
+			state("3925841d02dc09fbdc118597196a0b32")},
+		// the equivalent inverse cipher: round 1 with InvMixColumns of the key of round 9
+		{"aesdec", []byte{0x66, 0x0f, 0x38, 0xde, 0xca}, XMM{},
+			state("7ad5fda789ef4e272bca100b3d9ff59f"), state("13aa29be9c8faff6f770f58000f7bf03"),
+			state("54d990a16ba09ab596bbf40ea111702f")},
+		{"aesdeclast", []byte{0x66, 0x0f, 0x38, 0xdf, 0xca}, XMM{},
+			state("6353e08c0960e104cd70b751bacad0e7"), state("000102030405060708090a0b0c0d0e0f"),
+			state("00112233445566778899aabbccddeeff")},
+		{"aesimc", []byte{0x66, 0x0f, 0x38, 0xdb, 0xca}, XMM{},
+			XMM{}, state("549932d1f08557681093ed9cbe2c974e"),
+			state("13aa29be9c8faff6f770f58000f7bf03")},
+		// SubWord and RotWord of w3 with Rcon[1], 8b84eb01 in dword 3, as the expansion of A.1
+		{"aeskeygenassist", []byte{0x66, 0x0f, 0x3a, 0xdf, 0xca, 0x01}, XMM{},
+			XMM{}, state("2b7e151628aed2a6abf7158809cf4f3c"),
+			state("34e4b524e5b52434018a84eb8b84eb01")},
+		// the four products of the quadwords of the example
+		{"pclmulqdq 00", []byte{0x66, 0x0f, 0x3a, 0x44, 0xca, 0x00}, XMM{},
+			clmulA, clmulB, XMM{0x929633d5d36f0451, 0x1d4d84c85c3440c0}},
+		{"pclmulqdq 01", []byte{0x66, 0x0f, 0x3a, 0x44, 0xca, 0x01}, XMM{},
+			clmulA, clmulB, XMM{0xbabf262df4b7d5c9, 0x1a2bf6db3a30862f}},
+		{"pclmulqdq 10", []byte{0x66, 0x0f, 0x3a, 0x44, 0xca, 0x10}, XMM{},
+			clmulA, clmulB, XMM{0x7fa540ac2a281315, 0x1bd17c8d556ab5a1}},
+		{"pclmulqdq 11", []byte{0x66, 0x0f, 0x3a, 0x44, 0xca, 0x11}, XMM{},
+			clmulA, clmulB, XMM{0xd66ee03e410fd4ed, 0x1d1e1f2c592e7c45}},
+		// FIPS-180 SHA-1 of "abc": rounds 0 to 3 from H0, E for rounds 4 to 7, W16 to W19
+		{"sha1rnds4", []byte{0x0f, 0x3a, 0xcc, 0xca, 0x00}, XMM{},
+			shaWords(0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476), shaWords(0x25354570, 0, 0, 0),
+			shaWords(0xcdd8e11b, 0xa1390f08, 0x626414db, 0xc045bf0c)},
+		{"sha1nexte", []byte{0x0f, 0x38, 0xc8, 0xca}, XMM{},
+			shaWords(0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476), XMM{},
+			shaWords(0x59d148c0, 0, 0, 0)},
+		{"sha1msg1", []byte{0x0f, 0x38, 0xc9, 0xca}, XMM{},
+			shaWords(0x61626380, 0, 0, 0), XMM{},
+			shaWords(0x61626380, 0, 0, 0)},
+		{"sha1msg2", []byte{0x0f, 0x38, 0xca, 0xca}, XMM{},
+			shaWords(0x61626380, 0, 0, 0), shaWords(0, 0, 0, 0x18),
+			shaWords(0xc2c4c700, 0, 0x30, 0x85898e01)},
+		// FIPS-180 SHA-256 of "abc": rounds 0 and 1 from H0, W16 to W19
+		{"sha256rnds2", []byte{0x0f, 0x38, 0xcb, 0xca}, shaWords(0, 0, 0x71374491, 0xa3ec9318),
+			shaWords(0x3c6ef372, 0xa54ff53a, 0x1f83d9ab, 0x5be0cd19), shaWords(0x6a09e667, 0xbb67ae85, 0x510e527f, 0x9b05688c),
+			shaWords(0x5a6ad9ad, 0x5d6aebcd, 0x78ce7989, 0xfa2a4622)},
+		{"sha256msg1", []byte{0x0f, 0x38, 0xcc, 0xca}, XMM{},
+			shaWords(0, 0, 0, 0x61626380), XMM{},
+			shaWords(0, 0, 0, 0x61626380)},
+		{"sha256msg2", []byte{0x0f, 0x38, 0xcd, 0xca}, XMM{},
+			shaWords(0, 0, 0, 0x61626380), shaWords(0x18, 0, 0, 0),
+			shaWords(0x600003c6, 0x7da86405, 0x000f0000, 0x61626380)},
+	}
+	for _, test := range tests {
+		emu := newBare(t, 32, append(test.code, 0xf4))
+		reg := emu.cpu.(*CPU).reg
+		reg.CR4 |= CR4OSFXSR | CR4OSXMMEXCPT
+		reg.XMM[0], reg.XMM[1], reg.XMM[2] = test.xmm0, test.xmm1, test.xmm2
+		if err := emu.Run(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if reg.XMM[1] != test.want {
+			t.Errorf("%s: xmm1 = %016x%016x, want %016x%016x", test.name,
+				reg.XMM[1][1], reg.XMM[1][0], test.want[1], test.want[0])
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package core
+
+// DR6 bits
+const (
+	DR6B0 = 1 << 0  // breakpoint 0 condition detected, B1-B3 follow
+	DR6BD = 1 << 13 // debug register access detected (DR7.GD)
+	DR6BS = 1 << 14 // single step (EFLAGS.TF)
+	DR6BT = 1 << 15 // task switch to a TSS with the T bit set
+
+	dr6Breakpoints = 0xf
+	dr6Reserved    = 0xffff0ff0 // bits read as 1
+)
+
+// DR7 bits
+const (
+	DR7GD = 1 << 13 // general detect: MOV DRn raises #DB
+
+	dr7Local    = 0x55  // L0-L3, the local enables cleared on a task switch
+	dr7Reserved = 0x400 // bit 10 reads as 1
+	dr7Mask     = 0xffff23ff
+)
+
+// Breakpoint conditions of the DR7 R/W fields
+const (
+	breakExecute   = 0 // instruction fetch
+	breakWrite     = 1 // data writes
+	breakIO        = 2 // I/O reads and writes, with CR4.DE
+	breakReadWrite = 3 // data reads and writes
+)
+
+// breakpoints returns the DR6 B0-B3 bits of the enabled breakpoints of DR0-DR3 whose
+// condition is one of kinds and whose range overlaps size bytes at address
+func (r *X86Registers) breakpoints(address uint32, size uint32, kinds ...uint32) uint32 {
+	var hits uint32
+	for i := uint32(0); i < 4; i++ {
+		if r.DR7>>(2*i)&3 == 0 {
+			continue
+		}
+		kind := r.DR7 >> (16 + 4*i) & 3
+		if kind == breakIO && r.CR4&CR4DE == 0 {
+			continue
+		}
+		length := uint32(1)
+		if kind != breakExecute {
+			// LEN 00, 01, 11, 10: 1, 2, 4 or 8 bytes, aligned
+			length = [4]uint32{1, 2, 8, 4}[r.DR7>>(18+4*i)&3]
+		}
+		start := r.DR[i] &^ (length - 1)
+		if address > start+length-1 || start > address+size-1 {
+			continue
+		}
+		for _, k := range kinds {
+			if k == kind {
+				hits |= 1 << i
+			}
+		}
+	}
+	return hits
+}
+
+// watchMemory records the data breakpoints hit by a byte access at a linear address,
+// reported by a #DB trap once the instruction completes
+func (r *X86Registers) watchMemory(address uint32, write bool) {
+	if r.DR7&0xff == 0 {
+		return
+	}
+	if write {
+		r.pendingDB |= r.breakpoints(address, 1, breakWrite, breakReadWrite)
+	} else {
+		r.pendingDB |= r.breakpoints(address, 1, breakReadWrite)
+	}
+}
+
+// watchIO records the I/O breakpoints hit by an access of size bytes at port
+func (r *X86Registers) watchIO(port uint16, size uint16) {
+	if r.DR7&0xff == 0 {
+		return
+	}
+	r.pendingDB |= r.breakpoints(uint32(port), uint32(size), breakIO)
+}
+
+// instructionBreakpoint raises the #DB fault of an instruction breakpoint at CS:EIP, unless
+// RF is set. RF is saved in the interrupt frame, so that the handler returns to the
+// instruction without hitting the breakpoint again; it is cleared once the check is done.
+func (cpu *CPU) instructionBreakpoint() {
+	reg := cpu.reg
+	reg.pendingDB = 0
+	if reg.IsRF() {
+		reg.RemoveRF()
+		return
+	}
+	if reg.DR7&0xff == 0 {
+		return
+	}
+	address := reg.CodeAddress(0)
+	if reg.mode64 {
+		// the debug registers hold 32-bit addresses
+		if reg.X64.RIP>>32 != 0 {
+			return
+		}
+		address = uint32(reg.X64.RIP)
+	}
+	if hits := reg.breakpoints(address, 1, breakExecute); hits != 0 {
+		reg.DR6 = reg.DR6&^dr6Breakpoints | hits
+		reg.SetRF()
+		raise(ExceptionDB)
+	}
+}
+
+// debugTrap delivers the #DB trap of the instruction just completed: data and I/O
+// breakpoints, the TSS T bit, and single-stepping when TF was set before it. An instruction
+// clearing TF (POPF, IRET) still traps; one setting it only traps after the next instruction.
+func (cpu *CPU) debugTrap(tf bool) error {
+	reg := cpu.reg
+	hits := reg.pendingDB
+	reg.pendingDB = 0
+	if tf {
+		hits |= DR6BS
+	}
+	if hits == 0 {
+		return nil
+	}
+	if hits&dr6Breakpoints != 0 {
+		reg.DR6 &^= dr6Breakpoints
+	}
+	reg.DR6 |= hits
+	return cpu.exception(&Exception{Vector: ExceptionDB})
+}
@@ -0,0 +1,454 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// DOS programs in real mode: a .COM file or an MZ executable is loaded after its program
+// segment prefix (PSP) in the conventional memory managed with memory control blocks (MCB),
+// as MS-DOS 5 does. INT 21h is served by the emulator with drive C: on a host directory; the
+// other interrupt vectors point to an IRET, the BIOS is absent.
+
+const (
+	// dosSystem the owner of the blocks of DOS
+	dosSystem = 0x0008
+	// dosFirstMCB the segment of the first memory control block
+	dosFirstMCB = 0x0100
+	// dosMemoryTop the segment ending the conventional memory, 640 KiB
+	dosMemoryTop = 0xa000
+	// dosIret F000:FF54, the IRET after the HLT of the default handler
+	dosIret = defaultHandler + 1
+	// dosPSPSize the paragraphs of the PSP
+	dosPSPSize = 0x10
+	// dosCOMSize the largest .COM program: the segment less the PSP and a stack word
+	dosCOMSize = 0xff00 - 2
+	// dosAborted the exit status of a program ended by an exception
+	dosAborted = 0xff
+	// dosHandles the size of the handle table of the program
+	dosHandles = 20
+)
+
+// Offsets in the program segment prefix
+const (
+	pspMemoryTop   = 0x02
+	pspVectors     = 0x0a // INT 22h, 23h and 24h
+	pspParent      = 0x16
+	pspHandles     = 0x18
+	pspEnvironment = 0x2c
+	pspHandleCount = 0x32
+	pspHandleTable = 0x34
+	pspDispatcher  = 0x50
+	pspFCB1        = 0x5c
+	pspFCB2        = 0x6c
+	pspCommandTail = 0x80
+)
+
+// Offsets in the MZ header
+const (
+	mzLastPage     = 0x02
+	mzPages        = 0x04
+	mzRelocations  = 0x06
+	mzHeaderSize   = 0x08
+	mzMinAlloc     = 0x0a
+	mzMaxAlloc     = 0x0c
+	mzSS           = 0x0e
+	mzSP           = 0x10
+	mzIP           = 0x14
+	mzCS           = 0x16
+	mzRelocTable   = 0x18
+	mzHeaderLength = 0x1c
+)
+
+// dos the MS-DOS personality
+type dos struct {
+	reg  *X86Registers
+	mem  *Memory
+	root string
+	name string
+	args []string
+	psp  uint16
+	// handles of the program, DOS handles being indexes
+	handles [dosHandles]*dosHandle
+	// input the console, pending the rest of the line read last; echo repeats the keys read
+	// when the host terminal does not
+	input   *bufio.Reader
+	pending []byte
+	echo    bool
+	// disk transfer area, and the searches of the find calls by DTA
+	dtaSegment uint16
+	dtaOffset  uint16
+	searches   map[uint32]*dosSearch
+	debug      bool
+	exited     bool
+	code       int
+	aborted    error
+}
+
+// WithDOS runs the program as a DOS .COM or MZ executable named name, args making its
+// command tail, with drive C: on the host directory root. INT 20h and INT 21h are served by
+// the emulator; the exceptions of the processor abort the program.
+func WithDOS(root string, name string, args []string) Option {
+	return func(reg *X86Registers) {
+		reg.personality = &dos{root: root, name: name, args: args}
+	}
+}
+
+// boot loads the program in the conventional memory after its environment and its PSP, and
+// starts it in real mode
+func (d *dos) boot(reg *X86Registers, prog *program, debug bool) (*Memory, error) {
+	if prog.elf {
+		return nil, errors.New("DOS runs .COM and MZ programs, not ELF")
+	}
+	mem := newRealModeMemory(reg, nil, 0, debug)
+	reg.Reset()
+	d.reg, d.mem, d.debug = reg, mem, debug
+	for vector := 0; vector < 0x100; vector++ {
+		d.write16(uint32(vector)*4, dosIret&0xffff)
+		d.write16(uint32(vector)*4+2, 0xf000)
+	}
+	d.writeMCB(dosFirstMCB, 'Z', 0, dosMemoryTop-dosFirstMCB-1)
+	environment, err := d.environment()
+	if err != nil {
+		return nil, err
+	}
+	file := prog.segments[0].data
+	if len(file) >= 2 && (string(file[:2]) == "MZ" || string(file[:2]) == "ZM") {
+		err = d.loadEXE(file)
+	} else {
+		err = d.loadCOM(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.own(environment)
+	d.writePSP(environment)
+	d.handles = [dosHandles]*dosHandle{{console: true}, {console: true}, {file: os.Stderr}, {}, {}}
+	d.input = bufio.NewReader(os.Stdin)
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice == 0 {
+		d.echo = true
+	}
+	d.dtaSegment, d.dtaOffset = d.psp, pspCommandTail
+	d.searches = map[uint32]*dosSearch{}
+	// registers as MS-DOS leaves them
+	reg.EAX, reg.EBX, reg.ECX = 0, 0, 0xff
+	reg.EDX = uint32(d.psp)
+	reg.ESI, reg.EDI, reg.EBP = reg.EIP, reg.ESP, 0x091c
+	reg.EFlags = 0x2 | FlagIF
+	return mem, nil
+}
+
+// environment allocates the environment block: the variables, then a count of 1 and the
+// path of the program
+func (d *dos) environment() (uint16, error) {
+	var block []byte
+	for _, variable := range []string{`COMSPEC=C:\COMMAND.COM`, `PATH=C:\`} {
+		block = append(append(block, variable...), 0)
+	}
+	block = append(block, 0, 1, 0)
+	block = append(append(block, `C:\`+strings.ToUpper(path.Base(d.name))...), 0)
+	segment, _, ok := d.allocate(uint16((len(block)+15)/16), dosSystem)
+	if !ok {
+		return 0, errors.New("no memory for the DOS environment")
+	}
+	copy(d.mem.ram[uint32(segment)<<4:], block)
+	return segment, nil
+}
+
+// loadCOM loads a .COM program at PSP:0100 in the largest block. CS, DS, ES and SS are the
+// PSP, SP is at the top of the segment on a zero word: a RET returns to the INT 20h at
+// PSP:0000.
+func (d *dos) loadCOM(file []byte) error {
+	if len(file) > dosCOMSize {
+		return fmt.Errorf(".COM program of %d bytes, larger than %d", len(file), dosCOMSize)
+	}
+	_, largest, _ := d.allocate(0xffff, dosSystem)
+	psp, _, ok := d.allocate(largest, dosSystem)
+	if !ok || uint32(largest)*16 < 0x100+uint32(len(file))+2 {
+		return errors.New("not enough memory to load the .COM program")
+	}
+	d.psp = psp
+	d.own(psp)
+	copy(d.mem.ram[uint32(psp)<<4+0x100:], file)
+	sp := uint32(0xfffe)
+	if uint32(largest) < 0x1000 {
+		sp = uint32(largest)*16 - 2
+	}
+	d.write16(uint32(psp)<<4+sp, 0)
+	reg := d.reg
+	for i := SegES; i <= SegDS; i++ {
+		reg.resetSegment(i, psp)
+	}
+	reg.ESP, reg.EIP = sp, 0x100
+	return nil
+}
+
+// loadEXE loads the image of an MZ executable after the PSP with its segments relocated,
+// in a block of the paragraphs its header asks for
+func (d *dos) loadEXE(file []byte) error {
+	if len(file) < mzHeaderLength {
+		return errors.New("truncated MZ header")
+	}
+	header := func(offset int) uint32 {
+		return uint32(binary.LittleEndian.Uint16(file[offset:]))
+	}
+	size := header(mzPages) * 512
+	if last := header(mzLastPage); last != 0 {
+		size -= 512 - last
+	}
+	start := header(mzHeaderSize) * 16
+	if size > uint32(len(file)) {
+		size = uint32(len(file))
+	}
+	if start > size {
+		return errors.New("MZ header larger than the program")
+	}
+	image := file[start:size]
+	needed := dosPSPSize + (uint32(len(image))+15)/16 + header(mzMinAlloc)
+	wanted := dosPSPSize + (uint32(len(image))+15)/16 + header(mzMaxAlloc)
+	if wanted > 0xffff {
+		wanted = 0xffff
+	}
+	_, largest, _ := d.allocate(0xffff, dosSystem)
+	if uint32(largest) < needed {
+		return fmt.Errorf("MZ program needs %d paragraphs, %d are free", needed, largest)
+	}
+	if uint32(largest) < wanted {
+		wanted = uint32(largest)
+	}
+	psp, _, _ := d.allocate(uint16(wanted), dosSystem)
+	d.psp = psp
+	d.own(psp)
+	load := uint32(psp) + dosPSPSize
+	copy(d.mem.ram[load<<4:], image)
+	table := header(mzRelocTable)
+	for i := uint32(0); i < header(mzRelocations); i++ {
+		entry := table + i*4
+		if entry+4 > uint32(len(file)) {
+			return errors.New("truncated MZ relocation table")
+		}
+		offset := uint32(binary.LittleEndian.Uint16(file[entry:]))
+		segment := uint32(binary.LittleEndian.Uint16(file[entry+2:]))
+		address := (load+segment)<<4 + offset
+		if address+2 > (uint32(psp)+wanted)<<4 {
+			return fmt.Errorf("MZ relocation %04X:%04X outside of the program", segment, offset)
+		}
+		d.write16(address, d.read16(address)+uint16(load))
+	}
+	reg := d.reg
+	reg.resetSegment(SegES, psp)
+	reg.resetSegment(SegDS, psp)
+	reg.resetSegment(SegSS, uint16(load+header(mzSS)))
+	reg.resetSegment(SegCS, uint16(load+header(mzCS)))
+	reg.ESP, reg.EIP = header(mzSP), header(mzIP)
+	return nil
+}
+
+// writePSP fills the PSP of the program: INT 20h, the top of its memory, the saved
+// vectors, the handle table with the standard handles, the parsed FCBs and the command tail
+func (d *dos) writePSP(environment uint16) {
+	base := uint32(d.psp) << 4
+	ram := d.mem.ram
+	copy(ram[base:], []byte{0xcd, 0x20})
+	d.write16(base+pspMemoryTop, d.psp+d.read16(uint32(d.psp-1)<<4+3))
+	for i, vector := range []uint32{0x22, 0x23, 0x24} {
+		copy(ram[base+pspVectors+uint32(i)*4:], ram[vector*4:vector*4+4])
+	}
+	d.write16(base+pspParent, d.psp)
+	handles := ram[base+pspHandles : base+pspHandles+dosHandles]
+	for i := range handles {
+		handles[i] = 0xff
+	}
+	copy(handles, []byte{1, 1, 1, 0, 2})
+	d.write16(base+pspEnvironment, environment)
+	d.write16(base+pspHandleCount, dosHandles)
+	d.write16(base+pspHandleTable, pspHandles)
+	d.write16(base+pspHandleTable+2, d.psp)
+	copy(ram[base+pspDispatcher:], []byte{0xcd, 0x21, 0xcb})
+	for i, offset := range []uint32{pspFCB1, pspFCB2} {
+		arg := ""
+		if i < len(d.args) {
+			arg = d.args[i]
+		}
+		drive, name := dosFCBName(arg)
+		ram[base+offset] = drive
+		copy(ram[base+offset+1:], name[:])
+	}
+	tail := ""
+	for _, arg := range d.args {
+		tail += " " + arg
+	}
+	if len(tail) > 126 {
+		tail = tail[:126]
+	}
+	ram[base+pspCommandTail] = byte(len(tail))
+	copy(ram[base+pspCommandTail+1:], tail+"\r")
+}
+
+// dosFCBName the drive, 1 for A:, and the blank-padded 8.3 name of a file control block
+// parsed from arg; '*' fills the rest of the name or extension with '?'
+func dosFCBName(arg string) (uint8, [11]byte) {
+	var drive uint8
+	name := [11]byte{}
+	copy(name[:], bytes.Repeat([]byte{' '}, 11))
+	arg = strings.ToUpper(arg)
+	if len(arg) >= 2 && arg[1] == ':' && 'A' <= arg[0] && arg[0] <= 'Z' {
+		drive, arg = arg[0]-'A'+1, arg[2:]
+	}
+	if strings.HasPrefix(arg, "/") {
+		return drive, name
+	}
+	base, extension, _ := strings.Cut(arg, ".")
+	fill := func(field []byte, part string) {
+		for i := 0; i < len(field) && i < len(part); i++ {
+			if part[i] == '*' {
+				copy(field[i:], bytes.Repeat([]byte{'?'}, len(field)-i))
+				return
+			}
+			field[i] = part[i]
+		}
+	}
+	fill(name[:8], base)
+	fill(name[8:], extension)
+	return drive, name
+}
+
+func (d *dos) read16(address uint32) uint16 {
+	return binary.LittleEndian.Uint16(d.mem.ram[address:])
+}
+
+func (d *dos) write16(address uint32, value uint16) {
+	binary.LittleEndian.PutUint16(d.mem.ram[address:], value)
+}
+
+// writeMCB the memory control block at segment, kind 'M' or 'Z' for the last one, of a
+// block of size paragraphs owned by the PSP owner, 0 when free
+func (d *dos) writeMCB(segment uint16, kind byte, owner uint16, size uint16) {
+	address := uint32(segment) << 4
+	d.mem.ram[address] = kind
+	d.write16(address+1, owner)
+	d.write16(address+3, size)
+}
+
+// allocate the first free block of paragraphs for owner, the rest of the block staying
+// free; false with the size of the largest free block when none is large enough
+func (d *dos) allocate(paragraphs uint16, owner uint16) (uint16, uint16, bool) {
+	var largest uint16
+	for segment := uint16(dosFirstMCB); ; {
+		address := uint32(segment) << 4
+		kind, size := d.mem.ram[address], d.read16(address+3)
+		if d.read16(address+1) == 0 {
+			// free blocks in a row are merged first
+			for next := uint32(segment) + 1 + uint32(size); kind == 'M' && d.read16(next<<4+1) == 0; next = uint32(segment) + 1 + uint32(size) {
+				kind = d.mem.ram[next<<4]
+				size += 1 + d.read16(next<<4+3)
+				d.writeMCB(segment, kind, 0, size)
+			}
+			if size >= paragraphs {
+				if size > paragraphs {
+					d.writeMCB(segment+1+paragraphs, kind, 0, size-paragraphs-1)
+					kind = 'M'
+				}
+				d.writeMCB(segment, kind, owner, paragraphs)
+				return segment + 1, paragraphs, true
+			}
+			if size > largest {
+				largest = size
+			}
+		}
+		if kind != 'M' {
+			return 0, largest, false
+		}
+		segment += 1 + size
+	}
+}
+
+// block the kind, owner and size of the memory block at segment; false when no MCB precedes it
+func (d *dos) block(segment uint16) (byte, uint16, uint16, bool) {
+	if segment <= dosFirstMCB || segment > dosMemoryTop {
+		return 0, 0, 0, false
+	}
+	address := uint32(segment-1) << 4
+	kind := d.mem.ram[address]
+	return kind, d.read16(address + 1), d.read16(address + 3), kind == 'M' || kind == 'Z'
+}
+
+// free releases the memory block at segment
+func (d *dos) free(segment uint16) bool {
+	kind, _, size, ok := d.block(segment)
+	if ok {
+		d.writeMCB(segment-1, kind, 0, size)
+	}
+	return ok
+}
+
+// resize the memory block at segment to paragraphs, taking from the free blocks following
+// it; false with the largest size possible when they are too small
+func (d *dos) resize(segment uint16, paragraphs uint16) (uint16, bool) {
+	kind, owner, size, _ := d.block(segment)
+	total := uint32(size)
+	for kind == 'M' {
+		next := (uint32(segment) + total) << 4
+		if d.read16(next+1) != 0 {
+			break
+		}
+		kind = d.mem.ram[next]
+		total += 1 + uint32(d.read16(next+3))
+	}
+	if total < uint32(paragraphs) {
+		return uint16(total), false
+	}
+	if total > uint32(paragraphs) {
+		d.writeMCB(segment+paragraphs, kind, 0, uint16(total-uint32(paragraphs)-1))
+		kind = 'M'
+	}
+	d.writeMCB(segment-1, kind, owner, paragraphs)
+	return paragraphs, true
+}
+
+// own gives block, allocated before the PSP of the program existed, to the program
+func (d *dos) own(block uint16) {
+	d.write16(uint32(block-1)<<4+1, d.psp)
+}
+
+func (d *dos) done() bool {
+	return d.exited
+}
+
+func (d *dos) status() (int, error) {
+	return d.code, d.aborted
+}
+
+// interrupt INT 20h ends the program, INT 21h calls DOS and the exceptions of the processor
+// abort the program; the other interrupts go through the IVT
+func (d *dos) interrupt(e *Exception, software bool) bool {
+	reg := d.reg
+	switch {
+	case software && e.Vector == 0x20:
+		d.exit(0)
+	case software && e.Vector == 0x21:
+		d.call()
+	case !software && e.Vector != ExceptionDB:
+		d.exited, d.code = true, dosAborted
+		d.aborted = fmt.Errorf("%s at %04X:%04X", e.Error(), reg.CS, reg.EIP)
+	default:
+		return false
+	}
+	return true
+}
+
+// systemCall SYSENTER and SYSCALL are not DOS system calls
+func (d *dos) systemCall(opcode uint8) bool {
+	return false
+}
+
+// exit ends the program with code
+func (d *dos) exit(code uint8) {
+	d.exited, d.code = true, int(code)
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDOSFiles(t *testing.T) {
+	root := t.TempDir()
+	status := runProgram(t, 16, "files16.com", WithDOS(root, "FILES16.COM", nil))
+	if status != 0 {
+		t.Fatalf("check %d of testdata/files16.s failed", status)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "FILES.OUT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello, dos\r\n" {
+		t.Errorf("FILES.OUT = %q", data)
+	}
+}
+
+// TestDOSExecutable loads testdata/exe16.exe at the paragraph after its PSP: the segments of
+// its header and the words of its relocation table get that load segment added
+func TestDOSExecutable(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "exe16.exe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err := NewEmulator(16, 0, 0, data, false, WithDOS(t.TempDir(), "EXE16.EXE", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := emu.personality.(*dos)
+	reg := d.reg
+	load := d.psp + dosPSPSize
+	if reg.CS != load+1 || reg.EIP != 0 || reg.SS != load+9 || reg.ESP != 0x100 {
+		t.Errorf("CS:IP, SS:SP = %04X:%04X, %04X:%04X, want %04X:0000, %04X:0100",
+			reg.CS, reg.EIP, reg.SS, reg.ESP, load+1, load+9)
+	}
+	if reg.DS != d.psp || reg.ES != d.psp {
+		t.Errorf("DS, ES = %04X, %04X, want the PSP %04X", reg.DS, reg.ES, d.psp)
+	}
+	// the data segment in MOV AX, the far pointer and the far jump, by image offset
+	for offset, segment := range map[uint32]uint16{0x14: 8, 0x84: 7, 0x60: 7} {
+		if got := d.read16(uint32(load)<<4 + offset); got != load+segment {
+			t.Errorf("word at image offset %#x = %04X, want %04X", offset, got, load+segment)
+		}
+	}
+	if err := emu.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := emu.ExitStatus(); status != 0 {
+		t.Fatalf("check %d of testdata/exe16.s failed", status)
+	}
+}
@@ -0,0 +1,345 @@
+package core
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"time"
+)
+
+// INT 21h functions of MS-DOS 5: character I/O on the console, file handles and directory
+// search on drive C:, memory blocks, date, time and version. Failing calls set CF with the
+// DOS error code in AX.
+
+// DOS error codes
+const (
+	dosInvalidFunction = 0x01
+	dosFileNotFound    = 0x02
+	dosPathNotFound    = 0x03
+	dosTooManyFiles    = 0x04
+	dosAccessDenied    = 0x05
+	dosInvalidHandle   = 0x06
+	dosNoMemory        = 0x08
+	dosInvalidBlock    = 0x09
+	dosInvalidAccess   = 0x0c
+	dosNoMoreFiles     = 0x12
+)
+
+// dosEOF Ctrl-Z, the key read at the end of the input
+const dosEOF = 0x1a
+
+// dosCalls the INT 21h functions by AH
+var dosCalls = map[uint8]func(*dos){
+	0x00: (*dos).terminate,
+	0x01: (*dos).readKeyEcho,
+	0x02: (*dos).writeChar,
+	0x06: (*dos).directConsole,
+	0x07: (*dos).readKey,
+	0x08: (*dos).readKey,
+	0x09: (*dos).writeString,
+	0x0a: (*dos).readLine,
+	0x19: (*dos).currentDrive,
+	0x1a: (*dos).setDTA,
+	0x25: (*dos).setVector,
+	0x2a: (*dos).getDate,
+	0x2c: (*dos).getTime,
+	0x2f: (*dos).getDTA,
+	0x30: (*dos).version,
+	0x35: (*dos).getVector,
+	0x3c: (*dos).create,
+	0x3d: (*dos).open,
+	0x3e: (*dos).close,
+	0x3f: (*dos).read,
+	0x40: (*dos).write,
+	0x41: (*dos).delete,
+	0x42: (*dos).seek,
+	0x48: (*dos).allocateBlock,
+	0x49: (*dos).freeBlock,
+	0x4a: (*dos).resizeBlock,
+	0x4c: (*dos).terminateCode,
+	0x4e: (*dos).findFirst,
+	0x4f: (*dos).findNext,
+	0x56: (*dos).rename,
+}
+
+// call the INT 21h function in AH
+func (d *dos) call() {
+	reg := d.reg
+	function := reg.Get8ByIndex(4)
+	if handler, ok := dosCalls[function]; ok {
+		handler(d)
+	} else {
+		d.fail(dosInvalidFunction)
+	}
+	if d.debug {
+		log.Printf("INT 21h AH=%02X: AX=%04X CF=%t\n", function, uint16(reg.EAX), reg.IsCF())
+	}
+}
+
+// succeed clears CF and returns ax
+func (d *dos) succeed(ax uint16) {
+	d.reg.Set16ByIndex(0, ax)
+	d.reg.RemoveCF()
+}
+
+// fail sets CF and returns the error code in AX
+func (d *dos) fail(code uint16) {
+	d.reg.Set16ByIndex(0, code)
+	d.reg.SetCF()
+}
+
+// bytes the n bytes of the program at segment:offset, less at the end of the memory
+func (d *dos) bytes(segment uint8, offset uint16, n uint32) []byte {
+	ram := d.mem.ram
+	address := d.reg.Segments[segment].Base + uint32(offset)
+	end := address + n
+	if end > uint32(len(ram)) {
+		end = uint32(len(ram))
+	}
+	if address > end {
+		address = end
+	}
+	return ram[address:end]
+}
+
+// asciz the NUL-terminated string of the program at segment:offset, a path of DOS
+func (d *dos) asciz(segment uint8, offset uint16) string {
+	data := d.bytes(segment, offset, 128)
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return string(data)
+}
+
+// fill reads a line of the console, ended by CR LF as DOS devices return it, once the line
+// read before is consumed; false at the end of the input
+func (d *dos) fill() bool {
+	if len(d.pending) > 0 {
+		return true
+	}
+	line, err := d.input.ReadBytes('\n')
+	if len(line) == 0 && err != nil {
+		return false
+	}
+	if bytes.HasSuffix(line, []byte("\n")) {
+		line = append(bytes.TrimSuffix(line[:len(line)-1], []byte("\r")), '\r', '\n')
+	}
+	d.pending = line
+	return true
+}
+
+// key a key typed on the console, Enter being CR; false at the end of the input
+func (d *dos) key() (byte, bool) {
+	if !d.fill() {
+		return 0, false
+	}
+	key := d.pending[0]
+	d.pending = d.pending[1:]
+	if key == '\r' && len(d.pending) > 0 && d.pending[0] == '\n' {
+		d.pending = d.pending[1:]
+	}
+	return key, true
+}
+
+// output writes data to the console
+func (d *dos) output(data []byte) {
+	os.Stdout.Write(data)
+}
+
+// terminate (00) ends the program
+func (d *dos) terminate() {
+	d.exit(0)
+}
+
+// terminateCode (4C) ends the program with the exit code in AL
+func (d *dos) terminateCode() {
+	d.exit(d.reg.Get8ByIndex(0))
+}
+
+// readKey (07, 08) reads a key in AL without echo, Ctrl-Z at the end of the input
+func (d *dos) readKey() {
+	key, ok := d.key()
+	if !ok {
+		key = dosEOF
+	}
+	d.reg.Set8ByIndex(0, key)
+}
+
+// readKeyEcho (01) reads a key in AL and echoes it
+func (d *dos) readKeyEcho() {
+	d.readKey()
+	if key := d.reg.Get8ByIndex(0); d.echo && key != dosEOF {
+		d.output([]byte{key})
+	}
+}
+
+// writeChar (02) writes DL on the console
+func (d *dos) writeChar() {
+	char := d.reg.Get8ByIndex(2)
+	d.output([]byte{char})
+	d.reg.Set8ByIndex(0, char)
+}
+
+// directConsole (06) reads a key when DL is FF, ZF set at the end of the input; writes DL
+// otherwise
+func (d *dos) directConsole() {
+	reg := d.reg
+	if reg.Get8ByIndex(2) != 0xff {
+		d.writeChar()
+		return
+	}
+	key, ok := d.key()
+	if !ok {
+		reg.Set8ByIndex(0, 0)
+		reg.SetZF()
+		return
+	}
+	reg.Set8ByIndex(0, key)
+	reg.RemoveZF()
+}
+
+// writeString (09) writes the string ended by '$' at DS:DX
+func (d *dos) writeString() {
+	data := d.bytes(SegDS, uint16(d.reg.EDX), 0x10000)
+	if i := bytes.IndexByte(data, '$'); i >= 0 {
+		data = data[:i]
+	}
+	d.output(data)
+	d.reg.Set8ByIndex(0, '$')
+}
+
+// readLine (0A) reads a line in the buffer at DS:DX: its size, then the count of characters
+// read and the characters ended by CR. Backspace erases the last character.
+func (d *dos) readLine() {
+	buffer := d.bytes(SegDS, uint16(d.reg.EDX), 0x101)
+	if len(buffer) < 3 || buffer[0] == 0 {
+		return
+	}
+	size := int(buffer[0])
+	var line []byte
+	for {
+		key, ok := d.key()
+		if !ok || key == '\r' {
+			break
+		}
+		switch {
+		case key == '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		case len(line) < size-1:
+			line = append(line, key)
+		}
+	}
+	if d.echo {
+		d.output(append(line, '\r', '\n'))
+	}
+	buffer[1] = byte(len(line))
+	copy(buffer[2:], append(line, '\r'))
+}
+
+// currentDrive (19) is C:, 2 in AL
+func (d *dos) currentDrive() {
+	d.reg.Set8ByIndex(0, 2)
+}
+
+// setDTA (1A) sets the disk transfer area to DS:DX
+func (d *dos) setDTA() {
+	d.dtaSegment, d.dtaOffset = d.reg.DS, uint16(d.reg.EDX)
+}
+
+// getDTA (2F) the disk transfer area in ES:BX
+func (d *dos) getDTA() {
+	d.reg.resetSegment(SegES, d.dtaSegment)
+	d.reg.Set16ByIndex(3, d.dtaOffset)
+}
+
+// dta the linear address of the disk transfer area
+func (d *dos) dta() uint32 {
+	return uint32(d.dtaSegment)<<4 + uint32(d.dtaOffset)
+}
+
+// setVector (25) sets the interrupt vector AL to DS:DX
+func (d *dos) setVector() {
+	reg := d.reg
+	vector := uint32(reg.Get8ByIndex(0)) * 4
+	d.write16(vector, uint16(reg.EDX))
+	d.write16(vector+2, reg.DS)
+}
+
+// getVector (35) the interrupt vector AL in ES:BX
+func (d *dos) getVector() {
+	reg := d.reg
+	vector := uint32(reg.Get8ByIndex(0)) * 4
+	reg.Set16ByIndex(3, d.read16(vector))
+	reg.resetSegment(SegES, d.read16(vector+2))
+}
+
+// getDate (2A) the date of the host: year in CX, month in DH, day in DL and day of the week
+// in AL
+func (d *dos) getDate() {
+	reg := d.reg
+	now := time.Now()
+	reg.Set16ByIndex(1, uint16(now.Year()))
+	reg.Set8ByIndex(6, uint8(now.Month()))
+	reg.Set8ByIndex(2, uint8(now.Day()))
+	reg.Set8ByIndex(0, uint8(now.Weekday()))
+}
+
+// getTime (2C) the time of the host: hours in CH, minutes in CL, seconds in DH and
+// hundredths in DL
+func (d *dos) getTime() {
+	reg := d.reg
+	now := time.Now()
+	reg.Set8ByIndex(5, uint8(now.Hour()))
+	reg.Set8ByIndex(1, uint8(now.Minute()))
+	reg.Set8ByIndex(6, uint8(now.Second()))
+	reg.Set8ByIndex(2, uint8(now.Nanosecond()/10000000))
+}
+
+// version (30) MS-DOS 5.0 in AX, the OEM MS-DOS FF in BH
+func (d *dos) version() {
+	reg := d.reg
+	reg.Set16ByIndex(0, 0x0005)
+	reg.Set16ByIndex(3, 0xff00)
+	reg.Set16ByIndex(1, 0)
+}
+
+// allocateBlock (48) allocates BX paragraphs, the segment in AX; the largest free block is
+// in BX when they are not available
+func (d *dos) allocateBlock() {
+	reg := d.reg
+	segment, largest, ok := d.allocate(uint16(reg.EBX), d.psp)
+	if !ok {
+		d.fail(dosNoMemory)
+		reg.Set16ByIndex(3, largest)
+		return
+	}
+	d.succeed(segment)
+}
+
+// freeBlock (49) releases the memory block at ES
+func (d *dos) freeBlock() {
+	if !d.free(d.reg.ES) {
+		d.fail(dosInvalidBlock)
+		return
+	}
+	d.succeed(d.reg.ES)
+}
+
+// resizeBlock (4A) resizes the memory block at ES to BX paragraphs, the largest size
+// possible in BX when it cannot grow
+func (d *dos) resizeBlock() {
+	reg := d.reg
+	if _, _, _, ok := d.block(reg.ES); !ok {
+		d.fail(dosInvalidBlock)
+		return
+	}
+	largest, ok := d.resize(reg.ES, uint16(reg.EBX))
+	if !ok {
+		d.fail(dosNoMemory)
+		reg.Set16ByIndex(3, largest)
+		return
+	}
+	d.succeed(reg.ES)
+}
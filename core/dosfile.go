@@ -0,0 +1,477 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Drive C: of DOS on a host directory. Each path component resolves to the host entry
+// having this 8.3 name: the host names valid in DOS are taken in capitals, the others get
+// an alias as Windows makes them, LONGNA~1.TXT.
+
+// dosNameChars the characters of DOS file names besides letters and digits
+const dosNameChars = "!#$%&'()-@^_`{}~"
+
+// Offsets in the disk transfer area filled by the find calls
+const (
+	dtaDrive     = 0x00
+	dtaAttribute = 0x15
+	dtaTime      = 0x16
+	dtaDate      = 0x18
+	dtaSize      = 0x1a
+	dtaName      = 0x1e
+	dtaLength    = 0x2b
+)
+
+// File attributes
+const (
+	dosReadOnly  = 0x01
+	dosDirectory = 0x10
+	dosArchive   = 0x20
+)
+
+// dosHandle a file or a device opened by the program: CON reads the console and writes the
+// standard output, a handle with neither file nor console is NUL
+type dosHandle struct {
+	file    *os.File
+	console bool
+}
+
+// dosSearch the entries found by a find call, next being the one to return
+type dosSearch struct {
+	names []string
+	infos []fs.FileInfo
+	next  int
+}
+
+// dosError the DOS error code of a host error
+func dosError(err error) uint16 {
+	if errors.Is(err, fs.ErrNotExist) {
+		return dosFileNotFound
+	}
+	return dosAccessDenied
+}
+
+// dosShortName name in capitals when it is a valid 8.3 name
+func dosShortName(name string) (string, bool) {
+	name = strings.ToUpper(name)
+	base, extension, _ := strings.Cut(name, ".")
+	if base == "" || len(base) > 8 || len(extension) > 3 || strings.Contains(extension, ".") {
+		return "", false
+	}
+	for _, c := range base + extension {
+		if !('A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune(dosNameChars, c)) {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// dosAliasPart the characters of part kept in an alias: capitals, spaces and dots removed,
+// other invalid characters replaced by '_'
+func dosAliasPart(part string) string {
+	var alias []rune
+	for _, c := range strings.ToUpper(part) {
+		switch {
+		case c == ' ' || c == '.':
+		case 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune(dosNameChars, c):
+			alias = append(alias, c)
+		default:
+			alias = append(alias, '_')
+		}
+	}
+	return string(alias)
+}
+
+// dosShortNames the names of the entries of the host directory dir by their 8.3 name
+func dosShortNames(dir string) map[string]string {
+	entries, _ := os.ReadDir(dir)
+	names := map[string]string{}
+	var long []string
+	for _, entry := range entries {
+		short, ok := dosShortName(entry.Name())
+		if _, taken := names[short]; ok && !taken {
+			names[short] = entry.Name()
+			continue
+		}
+		long = append(long, entry.Name())
+	}
+	for _, name := range long {
+		base, extension := name, ""
+		if i := strings.LastIndex(name, "."); i > 0 {
+			base, extension = name[:i], name[i+1:]
+		}
+		base, extension = dosAliasPart(base), dosAliasPart(extension)
+		if len(extension) > 3 {
+			extension = extension[:3]
+		}
+		for n := 1; ; n++ {
+			tail := fmt.Sprintf("~%d", n)
+			stem := base
+			if len(stem) > 8-len(tail) {
+				stem = stem[:8-len(tail)]
+			}
+			short := stem + tail
+			if extension != "" {
+				short += "." + extension
+			}
+			if _, taken := names[short]; !taken {
+				names[short] = name
+				break
+			}
+		}
+	}
+	return names
+}
+
+// hostPath the host file of the DOS path name on drive C:. The last component keeps its name
+// when no entry has it, for a file to create; the other components must exist, else the
+// DOS error code is returned. ".." stops at the root directory.
+func (d *dos) hostPath(name string) (string, uint16) {
+	name = strings.ToUpper(name)
+	if len(name) >= 2 && name[1] == ':' {
+		if name[0] != 'C' {
+			return "", dosPathNotFound
+		}
+		name = name[2:]
+	}
+	parts := strings.FieldsFunc(name, func(c rune) bool { return c == '\\' || c == '/' })
+	host := []string{d.root}
+	for i, part := range parts {
+		switch part {
+		case ".":
+			continue
+		case "..":
+			if len(host) > 1 {
+				host = host[:len(host)-1]
+			}
+			continue
+		}
+		entry, ok := dosShortNames(filepath.Join(host...))[part]
+		if !ok {
+			if i < len(parts)-1 {
+				return "", dosPathNotFound
+			}
+			entry = part
+		}
+		host = append(host, entry)
+	}
+	return filepath.Join(host...), 0
+}
+
+// dosDevice name is the device CON, NUL, AUX or PRN, whatever its directory and extension
+func dosDevice(name string) (string, bool) {
+	if i := strings.LastIndexAny(name, `\/:`); i >= 0 {
+		name = name[i+1:]
+	}
+	base, _, _ := strings.Cut(strings.ToUpper(name), ".")
+	switch base {
+	case "CON", "NUL", "AUX", "PRN":
+		return base, true
+	}
+	return "", false
+}
+
+// handle the open handle in BX
+func (d *dos) handle() (*dosHandle, bool) {
+	bx := uint16(d.reg.EBX)
+	if bx >= dosHandles || d.handles[bx] == nil {
+		return nil, false
+	}
+	return d.handles[bx], true
+}
+
+// create (3C) creates or truncates the file DS:DX, its handle in AX
+func (d *dos) create() {
+	d.openFile(os.O_RDWR | os.O_CREATE | os.O_TRUNC)
+}
+
+// open (3D) opens the file DS:DX for reading, writing or both as AL is 0, 1 or 2, its
+// handle in AX
+func (d *dos) open() {
+	modes := []int{os.O_RDONLY, os.O_WRONLY, os.O_RDWR}
+	mode := d.reg.Get8ByIndex(0) & 7
+	if int(mode) >= len(modes) {
+		d.fail(dosInvalidAccess)
+		return
+	}
+	d.openFile(modes[mode])
+}
+
+func (d *dos) openFile(flags int) {
+	handle := -1
+	for i := range d.handles {
+		if d.handles[i] == nil {
+			handle = i
+			break
+		}
+	}
+	if handle < 0 {
+		d.fail(dosTooManyFiles)
+		return
+	}
+	name := d.asciz(SegDS, uint16(d.reg.EDX))
+	if device, ok := dosDevice(name); ok {
+		d.handles[handle] = &dosHandle{console: device == "CON"}
+		d.succeed(uint16(handle))
+		return
+	}
+	host, code := d.hostPath(name)
+	if code != 0 {
+		d.fail(code)
+		return
+	}
+	if info, err := os.Stat(host); err == nil && info.IsDir() {
+		d.fail(dosAccessDenied)
+		return
+	}
+	f, err := os.OpenFile(host, flags, 0o666)
+	if err != nil {
+		d.fail(dosError(err))
+		return
+	}
+	d.handles[handle] = &dosHandle{file: f}
+	d.succeed(uint16(handle))
+}
+
+// close (3E) closes the handle BX; the standard streams of the host stay open
+func (d *dos) close() {
+	h, ok := d.handle()
+	if !ok {
+		d.fail(dosInvalidHandle)
+		return
+	}
+	if f := h.file; f != nil && f != os.Stdin && f != os.Stdout && f != os.Stderr {
+		f.Close()
+	}
+	d.handles[uint16(d.reg.EBX)] = nil
+	d.succeed(0)
+}
+
+// read (3F) reads CX bytes of the handle BX at DS:DX, the count read in AX. The console
+// returns a line at most, ended by CR LF.
+func (d *dos) read() {
+	reg := d.reg
+	h, ok := d.handle()
+	if !ok {
+		d.fail(dosInvalidHandle)
+		return
+	}
+	buffer := d.bytes(SegDS, uint16(reg.EDX), uint32(uint16(reg.ECX)))
+	n := 0
+	switch {
+	case h.console:
+		if d.fill() {
+			n = copy(buffer, d.pending)
+			d.pending = d.pending[n:]
+			if d.echo {
+				d.output(buffer[:n])
+			}
+		}
+	case h.file != nil:
+		var err error
+		n, err = io.ReadFull(h.file, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			d.fail(dosAccessDenied)
+			return
+		}
+	}
+	d.succeed(uint16(n))
+}
+
+// write (40) writes CX bytes at DS:DX to the handle BX, the count written in AX; a count
+// of 0 truncates a file at its position
+func (d *dos) write() {
+	reg := d.reg
+	h, ok := d.handle()
+	if !ok {
+		d.fail(dosInvalidHandle)
+		return
+	}
+	data := d.bytes(SegDS, uint16(reg.EDX), uint32(uint16(reg.ECX)))
+	switch {
+	case h.console:
+		d.output(data)
+	case h.file != nil && len(data) == 0:
+		position, err := h.file.Seek(0, io.SeekCurrent)
+		if err == nil {
+			err = h.file.Truncate(position)
+		}
+		if err != nil {
+			d.fail(dosAccessDenied)
+			return
+		}
+	case h.file != nil:
+		n, err := h.file.Write(data)
+		if err != nil && n == 0 {
+			d.fail(dosAccessDenied)
+			return
+		}
+		data = data[:n]
+	}
+	d.succeed(uint16(len(data)))
+}
+
+// delete (41) deletes the file DS:DX
+func (d *dos) delete() {
+	host, code := d.hostPath(d.asciz(SegDS, uint16(d.reg.EDX)))
+	if code != 0 {
+		d.fail(code)
+		return
+	}
+	info, err := os.Stat(host)
+	if err == nil && info.IsDir() {
+		err = fs.ErrPermission
+	}
+	if err == nil {
+		err = os.Remove(host)
+	}
+	if err != nil {
+		d.fail(dosError(err))
+		return
+	}
+	d.succeed(0)
+}
+
+// seek (42) moves the position of the handle BX by CX:DX from the start, the position or
+// the end as AL is 0, 1 or 2; the new position in DX:AX
+func (d *dos) seek() {
+	reg := d.reg
+	h, ok := d.handle()
+	if !ok {
+		d.fail(dosInvalidHandle)
+		return
+	}
+	whence := int(reg.Get8ByIndex(0))
+	if whence > io.SeekEnd {
+		d.fail(dosInvalidFunction)
+		return
+	}
+	var position int64
+	if h.file != nil {
+		offset := int64(int32(uint32(uint16(reg.ECX))<<16 | uint32(uint16(reg.EDX))))
+		var err error
+		if position, err = h.file.Seek(offset, whence); err != nil {
+			d.fail(dosAccessDenied)
+			return
+		}
+	}
+	d.succeed(uint16(position))
+	reg.Set16ByIndex(2, uint16(position>>16))
+}
+
+// rename (56) renames the file DS:DX to ES:DI, which must not exist
+func (d *dos) rename() {
+	reg := d.reg
+	from, code := d.hostPath(d.asciz(SegDS, uint16(reg.EDX)))
+	if code != 0 {
+		d.fail(code)
+		return
+	}
+	to, code := d.hostPath(d.asciz(SegES, uint16(reg.EDI)))
+	if code != 0 {
+		d.fail(code)
+		return
+	}
+	if _, err := os.Lstat(to); err == nil {
+		d.fail(dosAccessDenied)
+		return
+	}
+	if err := os.Rename(from, to); err != nil {
+		d.fail(dosError(err))
+		return
+	}
+	d.succeed(0)
+}
+
+// findFirst (4E) looks for the entries matching the wildcards of DS:DX, directories too when
+// CX has their attribute, and returns the first one in the DTA
+func (d *dos) findFirst() {
+	reg := d.reg
+	spec := d.asciz(SegDS, uint16(reg.EDX))
+	i := strings.LastIndexAny(spec, `\/:`)
+	dir, code := d.hostPath(spec[:i+1])
+	if code != 0 {
+		d.fail(code)
+		return
+	}
+	_, pattern := dosFCBName(spec[i+1:])
+	names := dosShortNames(dir)
+	search := &dosSearch{}
+	for short := range names {
+		_, name := dosFCBName(short)
+		match := true
+		for j := range pattern {
+			if pattern[j] != '?' && pattern[j] != name[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			search.names = append(search.names, short)
+		}
+	}
+	sort.Strings(search.names)
+	kept := search.names[:0]
+	for _, short := range search.names {
+		info, err := os.Stat(filepath.Join(dir, names[short]))
+		if err != nil || info.IsDir() && reg.ECX&dosDirectory == 0 {
+			continue
+		}
+		kept = append(kept, short)
+		search.infos = append(search.infos, info)
+	}
+	search.names = kept
+	d.searches[d.dta()] = search
+	d.findNext()
+}
+
+// findNext (4F) returns the next entry of the search of the DTA: attribute, time, date,
+// size and name
+func (d *dos) findNext() {
+	address := d.dta()
+	search, ok := d.searches[address]
+	if !ok || search.next >= len(search.names) || address+dtaLength > uint32(len(d.mem.ram)) {
+		delete(d.searches, address)
+		d.fail(dosNoMoreFiles)
+		return
+	}
+	name, info := search.names[search.next], search.infos[search.next]
+	search.next++
+	dta := d.mem.ram[address : address+dtaLength]
+	for i := range dta {
+		dta[i] = 0
+	}
+	dta[dtaDrive] = 3
+	attribute := uint8(dosArchive)
+	if info.IsDir() {
+		attribute = dosDirectory
+	}
+	if info.Mode().Perm()&0o200 == 0 {
+		attribute |= dosReadOnly
+	}
+	dta[dtaAttribute] = attribute
+	t := info.ModTime()
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.Local)
+	}
+	binary.LittleEndian.PutUint16(dta[dtaTime:], uint16(t.Hour()<<11|t.Minute()<<5|t.Second()/2))
+	binary.LittleEndian.PutUint16(dta[dtaDate:], uint16((t.Year()-1980)<<9|int(t.Month())<<5|t.Day()))
+	size := info.Size()
+	if info.IsDir() {
+		size = 0
+	} else if size > 0xffffffff {
+		size = 0xffffffff
+	}
+	binary.LittleEndian.PutUint32(dta[dtaSize:], uint32(size))
+	copy(dta[dtaName:dtaLength-1], name)
+	d.succeed(0)
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+)
+
+// ELF executables: the PT_LOAD segments are mapped at their virtual address with the BSS
+// zero-filled, and the program starts at the entry point of the header. Position-independent
+// executables are placed where Linux puts them.
+
+const (
+	// elfStackSize the stack of an ELF program run on bare metal, above its highest segment
+	elfStackSize = 0x10000
+	// elfDynBase32 and elfDynBase64 the load address of a position-independent executable
+	elfDynBase32 = 0x56555000
+	elfDynBase64 = 0x555555554000
+)
+
+// segment a part of a program mapped at address: data followed by zeros up to size bytes
+type segment struct {
+	address uint64
+	data    []byte
+	size    uint64
+	prot    uint64
+}
+
+// program the image of a program to run: a raw binary, or the segments of an ELF executable
+type program struct {
+	elf      bool
+	bitMode  int
+	entry    uint64
+	segments []segment
+	// headers the address of the ELF program headers in memory, 0 when they are not loaded
+	headers     uint64
+	headerSize  uint64
+	headerCount uint64
+	symbols     *symbolTable
+}
+
+// rawProgram binary loaded and started at base, readable, writable and executable
+func rawProgram(binary []byte, base uint32, bitMode int) *program {
+	return &program{
+		bitMode:  bitMode,
+		entry:    uint64(base),
+		segments: []segment{{address: uint64(base), data: binary, size: uint64(len(binary)), prot: protRead | protWrite | protExec}},
+	}
+}
+
+// isELF data starts with the ELF magic number
+func isELF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(elf.ELFMAG))
+}
+
+// parseELF the i386 or x86-64 executable in data. Programs needing an interpreter are
+// rejected, there is no dynamic linker.
+func parseELF(data []byte) (*program, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	p := &program{elf: true, headerCount: uint64(len(f.Progs))}
+	var bias, headerOffset uint64
+	switch {
+	case f.Class == elf.ELFCLASS32 && f.Machine == elf.EM_386:
+		p.bitMode, bias = 32, elfDynBase32
+		headerOffset = uint64(f.ByteOrder.Uint32(data[0x1c:]))
+		p.headerSize = uint64(f.ByteOrder.Uint16(data[0x2a:]))
+	case f.Class == elf.ELFCLASS64 && f.Machine == elf.EM_X86_64:
+		p.bitMode, bias = 64, elfDynBase64
+		headerOffset = f.ByteOrder.Uint64(data[0x20:])
+		p.headerSize = uint64(f.ByteOrder.Uint16(data[0x36:]))
+	default:
+		return nil, fmt.Errorf("ELF %s %s is not an i386 or x86-64 program", f.Class, f.Machine)
+	}
+	switch f.Type {
+	case elf.ET_EXEC:
+		bias = 0
+	case elf.ET_DYN:
+	default:
+		return nil, fmt.Errorf("ELF %s is not an executable", f.Type)
+	}
+	for _, ph := range f.Progs {
+		switch ph.Type {
+		case elf.PT_INTERP:
+			return nil, errors.New("dynamically linked ELF program, link it statically")
+		case elf.PT_PHDR:
+			p.headers = bias + ph.Vaddr
+		case elf.PT_LOAD:
+			if ph.Memsz == 0 {
+				continue
+			}
+			if ph.Memsz < ph.Filesz {
+				return nil, fmt.Errorf("ELF segment at 0x%X larger in the file than in memory", ph.Vaddr)
+			}
+			s := segment{address: bias + ph.Vaddr, data: make([]byte, ph.Filesz), size: ph.Memsz}
+			if _, err := ph.ReadAt(s.data, 0); err != nil && ph.Filesz != 0 {
+				return nil, fmt.Errorf("ELF segment at 0x%X: %w", ph.Vaddr, err)
+			}
+			if ph.Flags&elf.PF_R != 0 {
+				s.prot |= protRead
+			}
+			if ph.Flags&elf.PF_W != 0 {
+				s.prot |= protWrite
+			}
+			if ph.Flags&elf.PF_X != 0 {
+				s.prot |= protExec
+			}
+			p.segments = append(p.segments, s)
+			if p.headers == 0 && ph.Off <= headerOffset && headerOffset < ph.Off+ph.Filesz {
+				p.headers = s.address + headerOffset - ph.Off
+			}
+		}
+	}
+	if len(p.segments) == 0 {
+		return nil, errors.New("ELF program without PT_LOAD segment")
+	}
+	p.entry = bias + f.Entry
+	p.symbols = elfSymbols(f, bias)
+	return p, nil
+}
+
+// elfSymbols the functions, objects and labels of the symbol table of f, nil when stripped
+func elfSymbols(f *elf.File, bias uint64) *symbolTable {
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil
+	}
+	var table []symbol
+	for _, s := range symbols {
+		switch elf.ST_TYPE(s.Info) {
+		case elf.STT_FUNC, elf.STT_OBJECT, elf.STT_NOTYPE:
+		default:
+			continue
+		}
+		if s.Name == "" || s.Section == elf.SHN_UNDEF || s.Section == elf.SHN_ABS {
+			continue
+		}
+		table = append(table, symbol{name: s.Name, address: bias + s.Value, size: s.Size})
+	}
+	return newSymbolTable(table)
+}
+
+// image the segments of p laid out from the page of the lowest one, followed by the stack of
+// a program run on bare metal
+func (p *program) image() (ram []byte, base uint64, err error) {
+	base, end := ^uint64(0), uint64(0)
+	for _, s := range p.segments {
+		if s.address < base {
+			base = s.address
+		}
+		if s.address+s.size > end {
+			end = s.address + s.size
+		}
+	}
+	base &^= 0xfff
+	end = pageAlign(end) + elfStackSize
+	if end > 1<<32 {
+		return nil, 0, fmt.Errorf("ELF program at 0x%X-0x%X beyond 4 GiB on bare metal", base, end)
+	}
+	ram = make([]byte, end-base)
+	for _, s := range p.segments {
+		copy(ram[s.address-base:], s.data)
+	}
+	return ram, base, nil
+}
@@ -1,19 +1,147 @@
 package core
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// realModeMemorySize 1 MiB plus the high memory area reachable with A20 enabled
+	realModeMemorySize = 0x110000
+	resetVector        = 0xffff0
+	// defaultHandler F000:FF53, where a BIOS keeps its dummy interrupt handler
+	defaultHandler = 0xfff53
+)
+
 type Emulator struct {
 	cpu ICPU
 	mem IMemory
+	// operating system of a program run in user mode, nil on bare metal
+	personality personality
 	// TODO:  devices
 }
 
-func NewEmulator(bitMode int, baseAddress uint32, stackAddress uint32, ram []byte, debug bool) (*Emulator, error) {
+// Option configures an emulator built by NewEmulator
+type Option func(*X86Registers)
+
+// WithProfile selects the processor model reported by CPUID, DefaultProfile otherwise
+func WithProfile(profile *Profile) Option {
+	return func(reg *X86Registers) {
+		reg.profile = profile
+	}
+}
+
+// WithMSR installs msr at index, replacing the built-in model-specific register
+func WithMSR(index uint32, msr MSR) Option {
+	return func(reg *X86Registers) {
+		reg.msrs.Register(index, msr)
+	}
+}
+
+// WithClock drives the time-stamp counter with clock instead of the instruction count
+func WithClock(clock Clock) Option {
+	return func(reg *X86Registers) {
+		reg.clock = clock
+	}
+}
+
+// WithEntropy feeds RDRAND and RDSEED from entropy instead of a generator seeded with zero
+func WithEntropy(entropy Entropy) Option {
+	return func(reg *X86Registers) {
+		reg.entropy = entropy
+	}
+}
+
+// WithBus attaches the processor to bus, shared with the emulators running on the same ram
+// so their locked instructions are atomic among them
+func WithBus(bus *Bus) Option {
+	return func(reg *X86Registers) {
+		reg.bus = bus
+	}
+}
+
+func NewEmulator(bitMode int, baseAddress uint32, stackAddress uint32, ram []byte, debug bool, options ...Option) (*Emulator, error) {
 	reg := NewIA32registers(baseAddress, stackAddress, debug)
-	mem := NewMemory(reg, ram, baseAddress, debug)
-	cpu := NewCPU(reg, mem, bitMode, debug)
-	emu := &Emulator{cpu: cpu, mem: mem}
+	for _, option := range options {
+		option(reg)
+	}
+	prog := rawProgram(ram, baseAddress, bitMode)
+	if isELF(ram) {
+		var err error
+		if prog, err = parseELF(ram); err != nil {
+			return nil, err
+		}
+		bitMode = prog.bitMode
+		reg.symbols = prog.symbols
+		if reg.personality == nil {
+			// on bare metal the segments are laid out in ram, with a stack above them
+			var base uint64
+			if ram, base, err = prog.image(); err != nil {
+				return nil, err
+			}
+			baseAddress = uint32(base)
+			reg.EIP = uint32(prog.entry)
+			reg.ESP = baseAddress + uint32(len(ram))
+		}
+	}
+	var mem *Memory
+	switch {
+	case reg.personality != nil:
+		var err error
+		if mem, err = reg.personality.boot(reg, prog, debug); err != nil {
+			return nil, err
+		}
+	case bitMode == 16:
+		mem = newRealModeMemory(reg, ram, baseAddress, debug)
+		reg.Reset()
+		// SS:SP addresses stackAddress from the base of its 64 KiB segment
+		reg.resetSegment(SegSS, uint16(stackAddress>>16<<12))
+		reg.ESP = stackAddress & 0xffff
+	case bitMode == 64:
+		if reg.features().ExtEDX&FeatureLM == 0 {
+			return nil, fmt.Errorf("CPU profile %s has no long mode", reg.profile.Name)
+		}
+		mem = NewMemory(reg, ram, baseAddress, debug)
+		// only the program is mapped; no IDT, exceptions end in a triple fault
+		reg.enterLongMode(mem, uint64(baseAddress), mem.GetAddressEnd())
+		reg.IDTR = DescriptorTable{}
+	default:
+		mem = NewMemory(reg, ram, baseAddress, debug)
+		reg.flatMode()
+		reg.CR0 |= CR0PE
+		// no IDT until the program loads one: exceptions end in a triple fault
+		reg.IDTR = DescriptorTable{}
+	}
+	cpu := NewCPU(reg, mem, debug)
+	emu := &Emulator{cpu: cpu, mem: mem, personality: reg.personality}
 	return emu, nil
 }
 
+// newRealModeMemory maps ram at baseAddress inside the 1 MiB real-mode address space.
+// The reset vector at F000:FFF0 far jumps to the segment baseAddress>>4 at offset
+// baseAddress&0xF, like a BIOS handing off to a boot sector. A20 is disabled, so
+// addresses wrap at 1 MiB.
+// Every interrupt vector points to a HLT; IRET stub, there are no BIOS services. An
+// exception delivered to it stops the emulator with an error instead.
+func newRealModeMemory(reg *X86Registers, ram []byte, baseAddress uint32, debug bool) *Memory {
+	size := uint32(realModeMemorySize)
+	if end := baseAddress + uint32(len(ram)); end > size {
+		size = end
+	}
+	phys := make([]byte, size)
+	for vector := 0; vector < 0x100; vector++ {
+		binary.LittleEndian.PutUint16(phys[vector*4:], defaultHandler&0xffff)
+		binary.LittleEndian.PutUint16(phys[vector*4+2:], 0xf000)
+	}
+	copy(phys[defaultHandler:], []byte{0xf4, 0xcf})
+	copy(phys[baseAddress:], ram)
+	segment := baseAddress >> 4
+	copy(phys[resetVector:], []byte{0xea, byte(baseAddress & 0xf), 0x00, byte(segment), byte(segment >> 8)})
+	mem := NewMemory(reg, phys, 0, debug)
+	mem.SetA20(false)
+	return mem
+}
+
 func (emu *Emulator) SetRam(ram []byte) {
 	emu.mem.SetRam(ram)
 }
@@ -23,12 +151,25 @@ func (emu *Emulator) Run() error {
 		return err
 	}
 
-	for {
-		code := emu.mem.GetCode8(0)
-		if err := emu.cpu.Exec(code); err != nil {
+	for !emu.cpu.IsHalted() {
+		if err := emu.cpu.Step(); err != nil {
 			return err
 		}
 	}
+	if emu.personality != nil {
+		_, err := emu.personality.status()
+		return err
+	}
+	return nil
+}
+
+// ExitStatus the exit status of a program run in user mode, false on bare metal
+func (emu *Emulator) ExitStatus() (int, bool) {
+	if emu.personality == nil {
+		return 0, false
+	}
+	status, _ := emu.personality.status()
+	return status, true
 }
 
 func (emu *Emulator) Dump() {
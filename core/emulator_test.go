@@ -0,0 +1,129 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newBare loads code on bare metal at 0x7C00, or 0x1000 in 32-bit and 64-bit mode
+func newBare(t *testing.T, bitMode int, code []byte) *Emulator {
+	t.Helper()
+	base := uint32(0x7c00)
+	if bitMode != 16 {
+		base = 0x1000
+	}
+	ram := make([]byte, 0x1000)
+	copy(ram, code)
+	emu, err := NewEmulator(bitMode, base, base+uint32(len(ram)), ram, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return emu
+}
+
+// runBare runs code on bare metal until it halts
+func runBare(t *testing.T, bitMode int, code []byte) (*Emulator, error) {
+	t.Helper()
+	emu := newBare(t, bitMode, code)
+	return emu, emu.Run()
+}
+
+// runProgram runs testdata/name under a user-mode personality and returns its exit status
+func runProgram(t *testing.T, bitMode int, name string, option Option) int {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err := NewEmulator(bitMode, 0, 0, data, false, option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := emu.Run(); err != nil {
+		t.Fatal(err)
+	}
+	status, _ := emu.ExitStatus()
+	return status
+}
+
+func TestRealModeExceptions(t *testing.T) {
+	tests := []struct {
+		name string
+		code []byte
+		want string
+	}{
+		{"hlt", []byte{0xf4}, ""},
+		{"ud2", []byte{0x90, 0x0f, 0x0b}, "#UD at 07C0:1\n"},
+		{"divide", []byte{0x31, 0xc9, 0xf7, 0xf1}, "#DE at 07C0:2\n"},
+		// a handler of #UD installed by the program is called
+		{"handled", []byte{
+			0xc7, 0x06, 0x18, 0x00, 0x14, 0x00, // mov word [0x18], 0x14
+			0x8c, 0x0e, 0x1a, 0x00, // mov [0x1a], cs
+			0x0f, 0x0b, // ud2
+			0xf4, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90,
+			0xf4, // handler: hlt
+		}, ""},
+		// POPF setting TF traps after the next instruction
+		{"step set", []byte{0x68, 0x00, 0x01, 0x9d, 0x90, 0xf4}, "#DB at 07C0:5\n"},
+		// POPF clearing TF still traps
+		{"step clear", []byte{0x6a, 0x00, 0x68, 0x00, 0x01, 0x9d, 0x9d, 0xf4}, "#DB at 07C0:7\n"},
+	}
+	for _, test := range tests {
+		_, err := runBare(t, 16, test.code)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s: error %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+// The reset vector jumps to the segment of the base address and SS:SP points at the stack
+// address, wherever they are in the first megabyte
+func TestRealModeLoad(t *testing.T) {
+	emu, err := NewEmulator(16, 0x12340, 0x23456, []byte{0x50, 0xf4}, false) // push ax; hlt
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := emu.cpu.(*CPU)
+	cpu.reg.EAX = 0xbeef
+	if err := emu.Run(); err != nil {
+		t.Fatal(err)
+	}
+	reg := cpu.reg
+	if reg.CS != 0x1234 || reg.SS != 0x2000 || reg.ESP != 0x3454 {
+		t.Errorf("CS, SS:SP = %04X, %04X:%04X, want 1234, 2000:3454", reg.CS, reg.SS, reg.ESP)
+	}
+	if got := uint16(cpu.mem.ReadPhys32(0x23454)); got != 0xbeef {
+		t.Errorf("pushed %#x, want 0xbeef", got)
+	}
+}
+
+// A repeated 66 or 67 prefix acts as a single one
+func TestRepeatedPrefixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		bitMode int
+		code    []byte
+		want    uint32
+	}{
+		{"66 66 32-bit", 32, []byte{0x66, 0x66, 0xb8, 0x34, 0x12, 0xf4}, 0x1234},                 // mov ax, 0x1234
+		{"66 66 16-bit", 16, []byte{0x66, 0x66, 0xb8, 0x78, 0x56, 0x34, 0x12, 0xf4}, 0x12345678}, // mov eax, 0x12345678
+		{"67 67 32-bit", 32, []byte{0x67, 0x67, 0xa1, 0x00, 0x18, 0xf4}, 0xcafe},                 // mov eax, [0x1800]
+	}
+	for _, test := range tests {
+		emu := newBare(t, test.bitMode, test.code)
+		cpu := emu.cpu.(*CPU)
+		cpu.mem.Write32(0x1800, 0xcafe)
+		if err := emu.Run(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if cpu.reg.EAX != test.want {
+			t.Errorf("%s: EAX = %#x, want %#x", test.name, cpu.reg.EAX, test.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package core
+
+import "fmt"
+
+// Exception vectors
+const (
+	ExceptionDE = 0  // Divide Error
+	ExceptionDB = 1  // Debug
+	ExceptionBP = 3  // Breakpoint
+	ExceptionOF = 4  // Overflow
+	ExceptionBR = 5  // BOUND Range Exceeded
+	ExceptionUD = 6  // Invalid Opcode
+	ExceptionNM = 7  // Device Not Available
+	ExceptionDF = 8  // Double Fault
+	ExceptionTS = 10 // Invalid TSS
+	ExceptionNP = 11 // Segment Not Present
+	ExceptionSS = 12 // Stack-Segment Fault
+	ExceptionGP = 13 // General Protection
+	ExceptionPF = 14 // Page Fault
+	ExceptionMF = 16 // x87 Floating-Point Error
+	ExceptionAC = 17 // Alignment Check
+	ExceptionXM = 19 // SIMD Floating-Point
+)
+
+var exceptionNames = map[uint8]string{
+	ExceptionDE: "#DE",
+	ExceptionDB: "#DB",
+	ExceptionBP: "#BP",
+	ExceptionOF: "#OF",
+	ExceptionBR: "#BR",
+	ExceptionUD: "#UD",
+	ExceptionNM: "#NM",
+	ExceptionDF: "#DF",
+	ExceptionTS: "#TS",
+	ExceptionNP: "#NP",
+	ExceptionSS: "#SS",
+	ExceptionGP: "#GP",
+	ExceptionPF: "#PF",
+	ExceptionMF: "#MF",
+	ExceptionAC: "#AC",
+	ExceptionXM: "#XM",
+}
+
+// Exception CPU exception raised by an instruction handler
+type Exception struct {
+	Vector       uint8
+	ErrorCode    uint32
+	HasErrorCode bool
+}
+
+func (e *Exception) Error() string {
+	name, ok := exceptionNames[e.Vector]
+	if !ok {
+		name = fmt.Sprintf("#%d", e.Vector)
+	}
+	if e.HasErrorCode {
+		return fmt.Sprintf("%s(0x%X)", name, e.ErrorCode)
+	}
+	return name
+}
+
+// raise aborts the current instruction with an exception without error code
+func raise(vector uint8) {
+	panic(&Exception{Vector: vector})
+}
+
+// raiseWithCode aborts the current instruction with an exception pushing an error code
+func raiseWithCode(vector uint8, errorCode uint32) {
+	panic(&Exception{Vector: vector, ErrorCode: errorCode, HasErrorCode: true})
+}
+
+// isContributory exceptions that turn into a double fault when raised while delivering each other
+func isContributory(vector uint8) bool {
+	switch vector {
+	case ExceptionDE, ExceptionTS, ExceptionNP, ExceptionSS, ExceptionGP:
+		return true
+	}
+	return false
+}
+
+// isDoubleFault second raised while delivering first must be replaced by #DF
+func isDoubleFault(first uint8, second uint8) bool {
+	if isContributory(first) {
+		return isContributory(second)
+	}
+	if first == ExceptionPF {
+		return isContributory(second) || second == ExceptionPF
+	}
+	return false
+}
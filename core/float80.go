@@ -0,0 +1,618 @@
+package core
+
+import "math/big"
+
+// Float80 x87 double extended precision value: sign, 15-bit biased exponent and a 64-bit
+// significand with an explicit integer bit
+type Float80 struct {
+	Sign bool
+	Exp  uint16
+	Mant uint64
+}
+
+const (
+	float80Bias   = 16383
+	float80MaxExp = 0x7fff
+	integerBit    = 1 << 63
+	quietBit      = 1 << 62
+)
+
+// float80Indefinite QNaN returned by masked invalid operations
+var float80Indefinite = Float80{Sign: true, Exp: float80MaxExp, Mant: integerBit | quietBit}
+
+// floatClass kind of value held by a Float80
+type floatClass int
+
+const (
+	classZero floatClass = iota
+	classDenormal
+	classNormal
+	classInfinity
+	classNaN
+	// classUnsupported pseudo-NaN, pseudo-infinity and unnormal encodings
+	classUnsupported
+)
+
+func (f Float80) class() floatClass {
+	switch f.Exp {
+	case 0:
+		if f.Mant == 0 {
+			return classZero
+		}
+		return classDenormal
+	case float80MaxExp:
+		if f.Mant&integerBit == 0 {
+			return classUnsupported
+		}
+		if f.Mant<<1 == 0 {
+			return classInfinity
+		}
+		return classNaN
+	}
+	if f.Mant&integerBit == 0 {
+		return classUnsupported
+	}
+	return classNormal
+}
+
+func (f Float80) isNaN() bool {
+	return f.class() == classNaN
+}
+
+func (f Float80) isSNaN() bool {
+	return f.isNaN() && f.Mant&quietBit == 0
+}
+
+func (f Float80) isFinite() bool {
+	c := f.class()
+	return c == classZero || c == classDenormal || c == classNormal
+}
+
+func (f Float80) neg() Float80 {
+	f.Sign = !f.Sign
+	return f
+}
+
+func float80Inf(sign bool) Float80 {
+	return Float80{Sign: sign, Exp: float80MaxExp, Mant: integerBit}
+}
+
+// floatFormat precision and exponent range a result is rounded to; values are 1.f * 2^e
+type floatFormat struct {
+	prec uint
+	emin int
+	emax int
+}
+
+var (
+	formatSingle   = floatFormat{24, -126, 127}
+	formatDouble   = floatFormat{53, -1022, 1023}
+	formatExtended = floatFormat{64, -16382, 16383}
+)
+
+// x87 exception flags, as in the status word; fswC1 reports a result rounded up in magnitude
+const (
+	fswIE = 1 << 0  // invalid operation
+	fswDE = 1 << 1  // denormal operand
+	fswZE = 1 << 2  // zero divide
+	fswOE = 1 << 3  // overflow
+	fswUE = 1 << 4  // underflow
+	fswPE = 1 << 5  // precision
+	fswSF = 1 << 6  // stack fault
+	fswES = 1 << 7  // error summary
+	fswC0 = 1 << 8  // condition code 0
+	fswC1 = 1 << 9  // condition code 1
+	fswC2 = 1 << 10 // condition code 2
+	fswC3 = 1 << 14 // condition code 3
+	fswB  = 1 << 15 // FPU busy
+
+	fswExceptions = 0x3f
+)
+
+// roundingMode maps the RC field of the control word
+func roundingMode(rc uint16) big.RoundingMode {
+	switch rc & 3 {
+	case 0:
+		return big.ToNearestEven
+	case 1:
+		return big.ToNegativeInf
+	case 2:
+		return big.ToPositiveInf
+	}
+	return big.ToZero
+}
+
+// big the exact value of a finite f
+func (f Float80) big() *big.Float {
+	exp := int(f.Exp) - float80Bias - 63
+	if f.Exp == 0 {
+		exp = 1 - float80Bias - 63
+	}
+	z := new(big.Float).SetPrec(64).SetUint64(f.Mant)
+	z.SetMantExp(z, exp)
+	if f.Sign {
+		z.Neg(z)
+	}
+	return z
+}
+
+// packFloat80 converts a value representable in extended precision
+func packFloat80(z *big.Float) Float80 {
+	if z.Sign() == 0 {
+		return Float80{Sign: z.Signbit()}
+	}
+	mant := new(big.Float)
+	exp := z.MantExp(mant) - 1
+	mant.Abs(mant)
+	m, _ := mant.SetMantExp(mant, 64).Uint64()
+	biased := exp + float80Bias
+	if biased <= 0 {
+		// denormal
+		return Float80{Sign: z.Signbit(), Mant: m >> uint(1-biased)}
+	}
+	return Float80{Sign: z.Signbit(), Exp: uint16(biased), Mant: m}
+}
+
+// maxFinite the largest finite value of format
+func maxFinite(format floatFormat, sign bool) Float80 {
+	return Float80{Sign: sign, Exp: uint16(format.emax + float80Bias), Mant: ^uint64(0) << (64 - format.prec)}
+}
+
+// roundedUp the rounded value is larger in magnitude than the exact one
+func roundedUp(z *big.Float) bool {
+	return z.Acc() == big.Above && z.Sign() > 0 || z.Acc() == big.Below && z.Sign() < 0
+}
+
+// round computes op at the precision of format and rounds it with rc. A tiny result is
+// computed again with the bits left to the denormal, so that it is rounded only once.
+// The flags are PE, UE, OE and C1 when the magnitude was rounded up.
+func round(op func(z *big.Float) *big.Float, format floatFormat, rc uint16) (Float80, uint16) {
+	mode := roundingMode(rc)
+	z := op(new(big.Float).SetPrec(format.prec).SetMode(mode))
+	if z.Sign() == 0 {
+		return Float80{Sign: z.Signbit()}, 0
+	}
+	var flags uint16
+	exp := z.MantExp(nil) - 1
+	if exp < format.emin {
+		prec := int(format.prec) - (format.emin - exp)
+		if prec < 1 {
+			return roundTiny(z, format, mode), fswUE | fswPE
+		}
+		z = op(new(big.Float).SetPrec(uint(prec)).SetMode(mode))
+		if z.Acc() != big.Exact {
+			flags |= fswUE
+		}
+	}
+	if z.Acc() != big.Exact {
+		flags |= fswPE
+		if roundedUp(z) {
+			flags |= fswC1
+		}
+	}
+	if z.MantExp(nil)-1 > format.emax {
+		return overflow(z.Signbit(), format, mode)
+	}
+	return packFloat80(z), flags
+}
+
+// roundTiny rounds a value below the smallest denormal of format: the result is zero or
+// that denormal
+func roundTiny(z *big.Float, format floatFormat, mode big.RoundingMode) Float80 {
+	neg := z.Signbit()
+	quantum := format.emin - int(format.prec) + 1
+	var up bool
+	switch mode {
+	case big.ToNearestEven:
+		if z.MantExp(nil)-1 == quantum-1 {
+			// above half the smallest denormal, unless exactly half or rounded up to it
+			half := new(big.Float).SetMantExp(big.NewFloat(1), quantum-1)
+			exactHalf := new(big.Float).Abs(z).Cmp(half) == 0
+			up = !exactHalf || z.Acc() != big.Exact && !roundedUp(z)
+		}
+	case big.ToPositiveInf:
+		up = !neg
+	case big.ToNegativeInf:
+		up = neg
+	}
+	if !up {
+		return Float80{Sign: neg}
+	}
+	denormal := new(big.Float).SetMantExp(big.NewFloat(1), quantum)
+	if neg {
+		denormal.Neg(denormal)
+	}
+	return packFloat80(denormal)
+}
+
+// overflow the masked response to an overflow: infinity or the largest finite value,
+// depending on the rounding direction
+func overflow(neg bool, format floatFormat, mode big.RoundingMode) (Float80, uint16) {
+	flags := uint16(fswOE | fswPE)
+	if mode == big.ToNearestEven || mode == big.ToPositiveInf && !neg || mode == big.ToNegativeInf && neg {
+		return float80Inf(neg), flags | fswC1
+	}
+	return maxFinite(format, neg), flags
+}
+
+// operandFlags the exceptions raised by reading an operand: IE for SNaN and unsupported
+// encodings, DE for denormals
+func operandFlags(operands ...Float80) uint16 {
+	var flags uint16
+	for _, f := range operands {
+		switch f.class() {
+		case classUnsupported:
+			flags |= fswIE
+		case classNaN:
+			if f.isSNaN() {
+				flags |= fswIE
+			}
+		case classDenormal:
+			flags |= fswDE
+		}
+	}
+	return flags
+}
+
+// propagateNaN the result of an operation with a NaN or unsupported operand: the quieted
+// NaN with the larger significand, or the indefinite
+func propagateNaN(a Float80, b Float80) Float80 {
+	if a.class() == classUnsupported || b.class() == classUnsupported {
+		return float80Indefinite
+	}
+	quiet := func(f Float80) Float80 {
+		f.Mant |= quietBit
+		return f
+	}
+	switch {
+	case a.isNaN() && b.isNaN():
+		if a.Mant<<1 >= b.Mant<<1 {
+			return quiet(a)
+		}
+		return quiet(b)
+	case a.isNaN():
+		return quiet(a)
+	}
+	return quiet(b)
+}
+
+func hasNaN(a Float80, b Float80) bool {
+	return a.isNaN() || b.isNaN() || a.class() == classUnsupported || b.class() == classUnsupported
+}
+
+// x87 arithmetic operations, numbered like the reg field of D8: b is the source operand
+const (
+	fpAdd  = 0
+	fpMul  = 1
+	fpSub  = 4 // a - b
+	fpSubR = 5 // b - a
+	fpDiv  = 6 // a / b
+	fpDivR = 7 // b / a
+)
+
+// arith performs a basic operation rounded to format with rc
+func arith(op uint8, a Float80, b Float80, format floatFormat, rc uint16) (Float80, uint16) {
+	flags := operandFlags(a, b)
+	if hasNaN(a, b) {
+		return propagateNaN(a, b), flags
+	}
+	switch op {
+	case fpSubR:
+		a, b, op = b, a, fpSub
+	case fpDivR:
+		a, b, op = b, a, fpDiv
+	}
+	if op == fpSub {
+		b = b.neg()
+	}
+	aInf, bInf := a.class() == classInfinity, b.class() == classInfinity
+	aZero, bZero := a.class() == classZero, b.class() == classZero
+	sign := a.Sign != b.Sign
+	switch op {
+	case fpAdd, fpSub:
+		switch {
+		case aInf && bInf && a.Sign != b.Sign:
+			return float80Indefinite, flags | fswIE
+		case aInf:
+			return a, flags
+		case bInf:
+			return b, flags
+		case aZero && bZero:
+			// the sum of zeros of opposite signs is -0 only when rounding down
+			return Float80{Sign: a.Sign && b.Sign || a.Sign != b.Sign && rc&3 == 1}, flags
+		}
+		result, f := round(func(z *big.Float) *big.Float { return z.Add(a.big(), b.big()) }, format, rc)
+		if result.class() == classZero && a.Sign != b.Sign {
+			result.Sign = rc&3 == 1
+		}
+		return result, flags | f
+	case fpMul:
+		switch {
+		case aInf && bZero || aZero && bInf:
+			return float80Indefinite, flags | fswIE
+		case aInf || bInf:
+			return float80Inf(sign), flags
+		case aZero || bZero:
+			return Float80{Sign: sign}, flags
+		}
+		result, f := round(func(z *big.Float) *big.Float { return z.Mul(a.big(), b.big()) }, format, rc)
+		return result, flags | f
+	}
+	switch {
+	case aInf && bInf || aZero && bZero:
+		return float80Indefinite, flags | fswIE
+	case aInf:
+		return float80Inf(sign), flags
+	case bInf:
+		return Float80{Sign: sign}, flags
+	case bZero:
+		return float80Inf(sign), flags | fswZE
+	case aZero:
+		return Float80{Sign: sign}, flags
+	}
+	result, f := round(func(z *big.Float) *big.Float { return z.Quo(a.big(), b.big()) }, format, rc)
+	return result, flags | f
+}
+
+// sqrt80 square root rounded to format with rc. The integer square root of the scaled
+// significand plus a sticky half bit rounds like the exact root.
+func sqrt80(a Float80, format floatFormat, rc uint16) (Float80, uint16) {
+	flags := operandFlags(a)
+	switch a.class() {
+	case classNaN, classUnsupported:
+		return propagateNaN(a, a), flags
+	case classZero:
+		return a, flags
+	}
+	if a.Sign {
+		return float80Indefinite, flags | fswIE
+	}
+	if a.class() == classInfinity {
+		return a, flags
+	}
+	mant := new(big.Float)
+	exp := a.big().MantExp(mant)
+	// a = m * 2^exp with m a 64-bit integer scaled by 2^shift, shift making exp-64-shift even
+	m, _ := mant.SetMantExp(mant, 64).Int(nil)
+	shift := 2*int(format.prec) + 4 - 64
+	if (exp-64-shift)&1 != 0 {
+		shift++
+	}
+	m.Lsh(m, uint(shift))
+	root := new(big.Int).Sqrt(m)
+	exact := new(big.Int).Mul(root, root).Cmp(m) == 0
+	rep := new(big.Float).SetPrec(uint(root.BitLen()) + 2).SetInt(root)
+	if !exact {
+		rep.Add(rep, big.NewFloat(0.5))
+	}
+	rep.SetMantExp(rep, (exp-64-shift)/2)
+	result, f := round(func(z *big.Float) *big.Float { return z.Set(rep) }, format, rc)
+	return result, flags | f
+}
+
+// Comparison results
+const (
+	cmpLess      = -1
+	cmpEqual     = 0
+	cmpGreater   = 1
+	cmpUnordered = 2
+)
+
+// compare80 orders a and b. NaN operands are unordered and raise IE, only for SNaN when quiet.
+func compare80(a Float80, b Float80, quiet bool) (int, uint16) {
+	flags := operandFlags(a, b)
+	if hasNaN(a, b) {
+		if !quiet {
+			flags |= fswIE
+		}
+		return cmpUnordered, flags
+	}
+	// infinities order like the largest finite values of their sign
+	value := func(f Float80) *big.Float {
+		if f.class() == classInfinity {
+			return new(big.Float).SetInf(f.Sign)
+		}
+		return f.big()
+	}
+	return value(a).Cmp(value(b)), flags
+}
+
+func cmpAbs(x *big.Float, y *big.Float) int {
+	return new(big.Float).Abs(x).Cmp(new(big.Float).Abs(y))
+}
+
+// roundToInteger rounds x to an integer with mode, reporting whether it was inexact
+func roundToInteger(x *big.Float, mode big.RoundingMode) (*big.Int, bool) {
+	t, acc := x.Int(nil)
+	if acc == big.Exact {
+		return t, false
+	}
+	one := big.NewInt(1)
+	switch mode {
+	case big.ToPositiveInf:
+		if x.Sign() > 0 {
+			t.Add(t, one)
+		}
+	case big.ToNegativeInf:
+		if x.Sign() < 0 {
+			t.Sub(t, one)
+		}
+	case big.ToNearestEven:
+		frac := new(big.Float).SetPrec(128).Sub(x, new(big.Float).SetInt(t))
+		frac.Abs(frac)
+		c := frac.Cmp(big.NewFloat(0.5))
+		if c > 0 || c == 0 && t.Bit(0) != 0 {
+			if x.Sign() > 0 {
+				t.Add(t, one)
+			} else {
+				t.Sub(t, one)
+			}
+		}
+	}
+	return t, true
+}
+
+// roundInt80 FRNDINT: rounds to an integral value with rc
+func roundInt80(a Float80, rc uint16) (Float80, uint16) {
+	flags := operandFlags(a)
+	switch a.class() {
+	case classNaN, classUnsupported:
+		return propagateNaN(a, a), flags
+	case classZero, classInfinity:
+		return a, flags
+	}
+	t, inexact := roundToInteger(a.big(), roundingMode(rc))
+	if inexact {
+		flags |= fswPE
+	}
+	if t.Sign() == 0 {
+		return Float80{Sign: a.Sign}, flags
+	}
+	result := packFloat80(new(big.Float).SetInt(t))
+	if inexact && cmpAbs(result.big(), a.big()) > 0 {
+		flags |= fswC1
+	}
+	return result, flags
+}
+
+// float80FromInt exact conversion of an integer
+func float80FromInt(value int64) Float80 {
+	return packFloat80(new(big.Float).SetInt64(value))
+}
+
+// toInt converts a to a signed integer of bits bits, rounded with rc or truncated.
+// Out of range values and NaN raise IE and give the integer indefinite.
+func (a Float80) toInt(bits uint, rc uint16, truncate bool) (int64, uint16) {
+	indefinite := int64(-1) << (bits - 1)
+	flags := operandFlags(a)
+	if !a.isFinite() {
+		return indefinite, flags | fswIE
+	}
+	mode := roundingMode(rc)
+	if truncate {
+		mode = big.ToZero
+	}
+	t, inexact := roundToInteger(a.big(), mode)
+	if !t.IsInt64() || t.Int64() < indefinite || t.Int64() > -(indefinite+1) {
+		return indefinite, flags | fswIE
+	}
+	if inexact {
+		flags |= fswPE
+		if cmpAbs(new(big.Float).SetInt(t), a.big()) > 0 {
+			flags |= fswC1
+		}
+	}
+	return t.Int64(), flags
+}
+
+// float80FromIEEE converts a single or double precision value; SNaN raises IE and is
+// quieted, denormals raise DE
+func float80FromIEEE(bits uint64, fracBits uint, expBits uint) (Float80, uint16) {
+	sign := bits>>(fracBits+expBits)&1 != 0
+	exp := int(bits >> fracBits & (1<<expBits - 1))
+	frac := bits & (1<<fracBits - 1)
+	maxExp := 1<<expBits - 1
+	bias := maxExp >> 1
+	switch {
+	case exp == maxExp:
+		f := Float80{Sign: sign, Exp: float80MaxExp, Mant: integerBit | frac<<(63-fracBits)}
+		if frac != 0 && f.Mant&quietBit == 0 {
+			f.Mant |= quietBit
+			return f, fswIE
+		}
+		return f, 0
+	case exp == 0:
+		if frac == 0 {
+			return Float80{Sign: sign}, 0
+		}
+		z := new(big.Float).SetUint64(frac)
+		z.SetMantExp(z, 1-bias-int(fracBits))
+		if sign {
+			z.Neg(z)
+		}
+		return packFloat80(z), fswDE
+	}
+	return Float80{Sign: sign, Exp: uint16(exp - bias + float80Bias), Mant: integerBit | frac<<(63-fracBits)}, 0
+}
+
+// toIEEE converts a to single or double precision, rounded with rc
+func (a Float80) toIEEE(format floatFormat, fracBits uint, expBits uint, rc uint16) (uint64, uint16) {
+	maxExp := uint64(1<<expBits - 1)
+	signBit := uint64(0)
+	if a.Sign {
+		signBit = 1 << (fracBits + expBits)
+	}
+	flags := operandFlags(a)
+	switch a.class() {
+	case classUnsupported:
+		a = float80Indefinite
+		signBit = 1 << (fracBits + expBits)
+		fallthrough
+	case classNaN:
+		return signBit | maxExp<<fracBits | (a.Mant|quietBit)<<1>>(64-fracBits), flags
+	case classInfinity:
+		return signBit | maxExp<<fracBits, flags
+	case classZero:
+		return signBit, flags
+	}
+	r, f := round(func(z *big.Float) *big.Float { return z.Set(a.big()) }, format, rc)
+	flags |= f
+	switch r.class() {
+	case classInfinity:
+		return signBit | maxExp<<fracBits, flags
+	case classZero:
+		return signBit, flags
+	}
+	exp := int(r.Exp) - float80Bias
+	if exp >= format.emin {
+		return signBit | uint64(exp-format.emin+1)<<fracBits | r.Mant<<1>>(64-fracBits), flags
+	}
+	// denormal: the integer bit moves into the fraction
+	return signBit | r.Mant>>uint(63-int(fracBits)+format.emin-exp), flags
+}
+
+// bcdMax the largest magnitude of an 18-digit packed BCD integer
+const bcdMax = 999999999999999999
+
+// float80FromBCD converts a packed BCD integer: nine bytes of two digits, least
+// significant first, and the sign in bit 7 of the tenth
+func float80FromBCD(b [10]byte) Float80 {
+	var v int64
+	for i := 8; i >= 0; i-- {
+		v = v*100 + int64(b[i]>>4)*10 + int64(b[i]&0xf)
+	}
+	f := float80FromInt(v)
+	f.Sign = b[9]&0x80 != 0
+	return f
+}
+
+// toBCD converts a to a packed BCD integer rounded with rc. Out of range values and NaN
+// raise IE and give the BCD indefinite.
+func (a Float80) toBCD(rc uint16) ([10]byte, uint16) {
+	var b [10]byte
+	flags := operandFlags(a)
+	var t *big.Int
+	var inexact bool
+	if a.isFinite() {
+		t, inexact = roundToInteger(a.big(), roundingMode(rc))
+	}
+	if t == nil || t.CmpAbs(big.NewInt(bcdMax)) > 0 {
+		b[7], b[8], b[9] = 0xc0, 0xff, 0xff
+		return b, flags | fswIE
+	}
+	if inexact {
+		flags |= fswPE
+		if cmpAbs(new(big.Float).SetInt(t), a.big()) > 0 {
+			flags |= fswC1
+		}
+	}
+	v := new(big.Int).Abs(t).Uint64()
+	for i := 0; i < 9; i++ {
+		b[i] = byte(v%10) | byte(v/10%10)<<4
+		v /= 100
+	}
+	if a.Sign {
+		b[9] = 0x80
+	}
+	return b, flags
+}
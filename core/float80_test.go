@@ -0,0 +1,105 @@
+package core
+
+import "testing"
+
+func TestArith80(t *testing.T) {
+	const (
+		nearest  = 0
+		down     = 1
+		up       = 2
+		truncate = 3
+	)
+	one, two, three, ten := float80FromInt(1), float80FromInt(2), float80FromInt(3), float80FromInt(10)
+	tests := []struct {
+		name   string
+		op     uint8
+		a, b   Float80
+		format floatFormat
+		rc     uint16
+		want   Float80
+		flags  uint16
+	}{
+		{"1+1", fpAdd, one, one, formatExtended, nearest, Float80{false, 0x4000, integerBit}, 0},
+		// C1 reports a result rounded up in magnitude
+		{"1/3 nearest", fpDiv, one, three, formatExtended, nearest,
+			Float80{false, 0x3ffd, 0xaaaaaaaaaaaaaaab}, fswPE | fswC1},
+		{"1/3 down", fpDiv, one, three, formatExtended, down,
+			Float80{false, 0x3ffd, 0xaaaaaaaaaaaaaaaa}, fswPE},
+		{"1/3 up", fpDiv, one, three, formatExtended, up,
+			Float80{false, 0x3ffd, 0xaaaaaaaaaaaaaaab}, fswPE | fswC1},
+		{"1/3 truncate", fpDiv, one, three, formatExtended, truncate,
+			Float80{false, 0x3ffd, 0xaaaaaaaaaaaaaaaa}, fswPE},
+		{"-1/3 down", fpDiv, one.neg(), three, formatExtended, down,
+			Float80{true, 0x3ffd, 0xaaaaaaaaaaaaaaab}, fswPE | fswC1},
+		{"3/1 reversed", fpDivR, one, three, formatExtended, nearest, three, 0},
+		// the precision control rounds to 53 and 24 bits
+		{"2/3 double", fpDiv, two, three, formatDouble, nearest,
+			Float80{false, 0x3ffe, 0xaaaaaaaaaaaaa800}, fswPE},
+		{"2/3 double up", fpDiv, two, three, formatDouble, up,
+			Float80{false, 0x3ffe, 0xaaaaaaaaaaaab000}, fswPE | fswC1},
+		{"1/10 single", fpDiv, one, ten, formatSingle, nearest,
+			Float80{false, 0x3ffb, 0xcccccd0000000000}, fswPE | fswC1},
+		// invalid operations give the indefinite, division by zero an infinity
+		{"0/0", fpDiv, Float80{}, Float80{}, formatExtended, nearest, float80Indefinite, fswIE},
+		{"inf-inf", fpSub, float80Inf(false), float80Inf(false), formatExtended, nearest,
+			float80Indefinite, fswIE},
+		{"1/0", fpDiv, one, Float80{}, formatExtended, nearest, float80Inf(false), fswZE},
+		{"-1/0", fpDiv, one.neg(), Float80{}, formatExtended, nearest, float80Inf(true), fswZE},
+	}
+	for _, test := range tests {
+		got, flags := arith(test.op, test.a, test.b, test.format, test.rc)
+		if got != test.want || flags != test.flags {
+			t.Errorf("%s: %v, %#x, want %v, %#x", test.name, got, flags, test.want, test.flags)
+		}
+	}
+}
+
+func TestSqrt80(t *testing.T) {
+	tests := []struct {
+		name  string
+		a     Float80
+		rc    uint16
+		want  Float80
+		flags uint16
+	}{
+		{"4", float80FromInt(4), 0, float80FromInt(2), 0},
+		{"2 nearest", float80FromInt(2), 0, Float80{false, 0x3fff, 0xb504f333f9de6484}, fswPE},
+		{"2 up", float80FromInt(2), 2, Float80{false, 0x3fff, 0xb504f333f9de6485}, fswPE | fswC1},
+		{"-0", Float80{Sign: true}, 0, Float80{Sign: true}, 0},
+		{"-1", float80FromInt(-1), 0, float80Indefinite, fswIE},
+	}
+	for _, test := range tests {
+		got, flags := sqrt80(test.a, formatExtended, test.rc)
+		if got != test.want || flags != test.flags {
+			t.Errorf("%s: %v, %#x, want %v, %#x", test.name, got, flags, test.want, test.flags)
+		}
+	}
+}
+
+func TestToInt80(t *testing.T) {
+	half := Float80{false, 0x4000, 0xa000000000000000} // 2.5
+	tests := []struct {
+		name     string
+		a        Float80
+		bits     uint
+		rc       uint16
+		truncate bool
+		want     int64
+		flags    uint16
+	}{
+		{"2.5 nearest", half, 32, 0, false, 2, fswPE},
+		{"3.5 nearest", Float80{false, 0x4000, 0xe000000000000000}, 32, 0, false, 4, fswPE | fswC1},
+		{"-2.5 down", half.neg(), 32, 1, false, -3, fswPE | fswC1},
+		{"2.5 up", half, 32, 2, false, 3, fswPE | fswC1},
+		{"2.5 truncated", half, 32, 2, true, 2, fswPE},
+		// out of range values give the integer indefinite
+		{"65536 word", float80FromInt(65536), 16, 0, false, -0x8000, fswIE},
+		{"nan", float80Indefinite, 64, 0, false, -1 << 63, fswIE},
+	}
+	for _, test := range tests {
+		got, flags := test.a.toInt(test.bits, test.rc, test.truncate)
+		if got != test.want || flags != test.flags {
+			t.Errorf("%s: %d, %#x, want %d, %#x", test.name, got, flags, test.want, test.flags)
+		}
+	}
+}
@@ -0,0 +1,1128 @@
+package core
+
+// x87 control word values
+const (
+	fcwInit  = 0x37f // FNINIT: exceptions masked, 64-bit precision, round to nearest
+	fcwReset = 0x40  // RESET: exceptions unmasked, 24-bit precision
+	fcwMask  = 0x1f7f
+)
+
+// Tag word values of a physical register
+const (
+	tagValid   = 0
+	tagZero    = 1
+	tagSpecial = 2 // NaN, infinity, denormal or unsupported
+	tagEmpty   = 3
+)
+
+// fpuIRQ13 vector of IRQ13 behind the second PIC (IRQ8-15 at 70h-77h), signalled through
+// FERR# when CR0.NE is clear
+const fpuIRQ13 = 0x75
+
+// FPUState x87 registers: the physical data registers R0-R7, addressed as a stack from the
+// TOP field of the status word, and the pointers of the last non-control instruction
+type FPUState struct {
+	Control uint16
+	Status  uint16
+	Tag     uint16
+	Regs    [8]Float80
+	FIP     uint32
+	FCS     uint16
+	FOP     uint16
+	FDP     uint32
+	FDS     uint16
+	// ferr the pending error was signalled as IRQ13: waiting instructions go ahead until it
+	// is cleared, as with IGNNE#
+	ferr bool
+}
+
+// init the state set by FNINIT
+func (s *FPUState) init() {
+	s.Control = fcwInit
+	s.Status = 0
+	s.Tag = 0xffff
+	s.FIP, s.FCS, s.FOP, s.FDP, s.FDS = 0, 0, 0, 0, 0
+	s.ferr = false
+}
+
+// reset the state after RESET: every register holds +0.0
+func (s *FPUState) reset() {
+	s.init()
+	s.Control = fcwReset
+	s.Tag = 0x5555
+	s.Regs = [8]Float80{}
+}
+
+func (s *FPUState) top() uint16 {
+	return s.Status >> 11 & 7
+}
+
+func (s *FPUState) setTop(top uint16) {
+	s.Status = s.Status&^(7<<11) | (top&7)<<11
+}
+
+// phys the physical register of ST(i)
+func (s *FPUState) phys(i uint8) uint16 {
+	return (s.top() + uint16(i)) & 7
+}
+
+func (s *FPUState) tag(p uint16) uint16 {
+	return s.Tag >> (2 * p) & 3
+}
+
+func (s *FPUState) setTag(p uint16, tag uint16) {
+	s.Tag = s.Tag&^(3<<(2*p)) | tag<<(2*p)
+}
+
+func tagOf(v Float80) uint16 {
+	switch v.class() {
+	case classNormal:
+		return tagValid
+	case classZero:
+		return tagZero
+	}
+	return tagSpecial
+}
+
+// retag recomputes the tags of the registers in use, after the tag word was loaded
+func (s *FPUState) retag() {
+	for p := uint16(0); p < 8; p++ {
+		if s.tag(p) != tagEmpty {
+			s.setTag(p, tagOf(s.Regs[p]))
+		}
+	}
+}
+
+func (s *FPUState) isEmpty(i uint8) bool {
+	return s.tag(s.phys(i)) == tagEmpty
+}
+
+func (s *FPUState) st(i uint8) Float80 {
+	return s.Regs[s.phys(i)]
+}
+
+func (s *FPUState) setST(i uint8, v Float80) {
+	p := s.phys(i)
+	s.Regs[p] = v
+	s.setTag(p, tagOf(v))
+}
+
+func (s *FPUState) push(v Float80) {
+	s.setTop(s.top() - 1)
+	s.setST(0, v)
+}
+
+func (s *FPUState) pop() {
+	s.setTag(s.phys(0), tagEmpty)
+	s.setTop(s.top() + 1)
+}
+
+// setCC replaces the condition codes C0-C3
+func (s *FPUState) setCC(cc uint16) {
+	s.Status = s.Status&^(fswC0|fswC1|fswC2|fswC3) | cc
+}
+
+// updateES sets the error summary when an exception flag is unmasked
+func (s *FPUState) updateES() {
+	if s.Status&fswExceptions&^s.Control != 0 {
+		s.Status |= fswES | fswB
+		return
+	}
+	s.Status &^= fswES | fswB
+	s.ferr = false
+}
+
+// conditionCodes C3, C2 and C0 of FCOM, FTST and friends
+func conditionCodes(order int) uint16 {
+	switch order {
+	case cmpLess:
+		return fswC0
+	case cmpEqual:
+		return fswC3
+	case cmpUnordered:
+		return fswC3 | fswC2 | fswC0
+	}
+	return 0
+}
+
+// FPU x87 floating-point unit: the D8-DF escapes and WAIT
+type FPU struct {
+	reg *X86Registers
+	mem IMemory
+}
+
+func NewFPU(reg *X86Registers, mem IMemory) *FPU {
+	return &FPU{
+		reg: reg,
+		mem: mem,
+	}
+}
+
+// fpuControl control instructions keep the last instruction and data pointers; the no-wait
+// ones among them (FNINIT, FNCLEX, FNSTSW, FNSTCW, FNSTENV, FNSAVE) do not report pending
+// exceptions either
+func fpuControl(code uint8, modrm *ModRM) (control bool, noWait bool) {
+	op := modrm.Opcode
+	switch {
+	case code == 0xd9 && modrm.Mod != 3 && op >= 4:
+		return true, op >= 6
+	case code == 0xdb && modrm.Mod == 3 && op == 4:
+		return true, true
+	case code == 0xdd && modrm.Mod != 3 && op >= 4:
+		return true, op >= 6
+	case code == 0xdf && modrm.Mod == 3 && op == 4:
+		return true, true
+	}
+	return false, false
+}
+
+// Escape D8-DF: x87 instructions raise #NM with CR0.EM or CR0.TS, and waiting ones first
+// report the unmasked exception left pending by a previous instruction
+func (f *FPU) Escape() {
+	reg := f.reg
+	mem := f.mem
+	s := &reg.FPU
+	if reg.CR0&(CR0EM|CR0TS) != 0 {
+		raise(ExceptionNM)
+	}
+	code := mem.GetCode8(0)
+	eip := uint32(reg.ip())
+	reg.EIP += 1
+	modrm := NewModRM(reg, mem)
+	if modrm.Mod == 3 {
+		// REX.B does not extend ST(i)
+		modrm.Rm &= 7
+	}
+	control, noWait := fpuControl(code, &modrm)
+	if !noWait {
+		fpuPending(reg)
+	}
+	if !control {
+		s.FIP, s.FCS = eip, reg.CS
+		s.FOP = uint16(code&7)<<8 | uint16(modrm.Mod)<<6 | uint16(modrm.Opcode)<<3 | uint16(modrm.Rm&7)
+		if modrm.Mod != 3 && modrm.long {
+			s.FDP, s.FDS = uint32(modrm.offset64()), 0
+		} else if modrm.Mod != 3 {
+			offset, segment := modrm.calcOffset()
+			s.FDP, s.FDS = offset, reg.GetSegment(reg.dataSegment(segment))
+		}
+	}
+	switch code {
+	case 0xd8:
+		f.codeD8(&modrm)
+	case 0xd9:
+		f.codeD9(&modrm)
+	case 0xda:
+		f.codeDA(&modrm)
+	case 0xdb:
+		f.codeDB(&modrm)
+	case 0xdc:
+		f.codeDC(&modrm)
+	case 0xdd:
+		f.codeDD(&modrm)
+	case 0xde:
+		f.codeDE(&modrm)
+	case 0xdf:
+		f.codeDF(&modrm)
+	}
+}
+
+// Fwait WAIT/FWAIT (9B): reports pending exceptions, #NM when CR0.MP and CR0.TS are set
+func (f *FPU) Fwait() {
+	reg := f.reg
+	if reg.CR0&(CR0MP|CR0TS) == CR0MP|CR0TS {
+		raise(ExceptionNM)
+	}
+	fpuPending(reg)
+	reg.EIP += 1
+}
+
+// fpuPending reports an unmasked x87 exception: #MF with CR0.NE, otherwise IRQ13 when
+// interrupts are enabled. The instruction restarts once the handler returns.
+func fpuPending(reg *X86Registers) {
+	s := &reg.FPU
+	if s.Status&fswES == 0 || s.ferr {
+		return
+	}
+	if reg.CR0&CR0NE != 0 {
+		raise(ExceptionMF)
+	}
+	if reg.IsEF() {
+		s.ferr = true
+		raise(fpuIRQ13)
+	}
+}
+
+// signal records the exception flags and C1 of an operation. It reports whether the result
+// may be stored: an unmasked invalid operation, denormal or zero divide leaves the
+// destination unchanged.
+func (f *FPU) signal(flags uint16) bool {
+	s := &f.reg.FPU
+	if flags&fswIE != 0 {
+		flags &^= fswDE
+	}
+	s.Status = s.Status&^fswC1 | flags&(fswC1|fswSF|fswExceptions)
+	unmasked := flags & fswExceptions &^ s.Control
+	if unmasked != 0 {
+		s.Status |= fswES | fswB
+	}
+	return unmasked&(fswIE|fswDE|fswZE) == 0
+}
+
+// signalStore signal for results written to memory, which an unmasked overflow or
+// underflow also suppresses
+func (f *FPU) signalStore(flags uint16) bool {
+	s := &f.reg.FPU
+	return f.signal(flags) && flags&(fswOE|fswUE)&^s.Control == 0
+}
+
+// operand ST(i); an empty register is a stack underflow and reads as the indefinite
+func (f *FPU) operand(i uint8) (Float80, uint16) {
+	s := &f.reg.FPU
+	if s.isEmpty(i) {
+		return float80Indefinite, fswIE | fswSF
+	}
+	return s.st(i), 0
+}
+
+// overflow a push overflows the stack when ST(7) is in use
+func (f *FPU) overflow() uint16 {
+	s := &f.reg.FPU
+	if !s.isEmpty(7) {
+		return fswIE | fswSF | fswC1
+	}
+	return 0
+}
+
+// load pushes v, or the indefinite on a stack overflow
+func (f *FPU) load(v Float80, flags uint16) {
+	s := &f.reg.FPU
+	if of := f.overflow(); of != 0 {
+		v, flags = float80Indefinite, of
+	}
+	if f.signal(flags) {
+		s.push(v)
+	}
+}
+
+// replacePush replaces ST(0) with a and pushes b: FPTAN, FSINCOS and FXTRACT
+func (f *FPU) replacePush(a Float80, b Float80, flags uint16) {
+	s := &f.reg.FPU
+	if of := f.overflow(); of != 0 {
+		a, b, flags = float80Indefinite, float80Indefinite, of
+	}
+	if f.signal(flags) {
+		s.setST(0, a)
+		s.push(b)
+	}
+}
+
+// precision the format of the PC field for the basic operations, with the extended
+// exponent range
+func (f *FPU) precision() floatFormat {
+	switch f.reg.FPU.Control >> 8 & 3 {
+	case 0:
+		return floatFormat{24, formatExtended.emin, formatExtended.emax}
+	case 2:
+		return floatFormat{53, formatExtended.emin, formatExtended.emax}
+	}
+	return formatExtended
+}
+
+// rc the RC field of the control word
+func (f *FPU) rc() uint16 {
+	return f.reg.FPU.Control >> 10 & 3
+}
+
+// arithmetic the operations of the reg field of D8, DA, DC and DE: ST(dest) = ST(0) op src,
+// or FCOM and FCOMP. It reports whether the result was stored.
+func (f *FPU) arithmetic(op uint8, src Float80, srcFlags uint16, dest uint8) bool {
+	s := &f.reg.FPU
+	switch op {
+	case 2:
+		return f.compare(src, srcFlags, false, 0)
+	case 3:
+		return f.compare(src, srcFlags, false, 1)
+	}
+	a, flags := f.operand(0)
+	result, g := arith(op, a, src, f.precision(), f.rc())
+	if !f.signal(flags | srcFlags | g) {
+		return false
+	}
+	s.setST(dest, result)
+	return true
+}
+
+// compare FCOM, FUCOM (quiet) and FTST: C3, C2, C0 = ST(0) compared with src, then pops
+func (f *FPU) compare(src Float80, srcFlags uint16, quiet bool, pops int) bool {
+	s := &f.reg.FPU
+	a, flags := f.operand(0)
+	order, g := compare80(a, src, quiet)
+	if !f.signal(flags | srcFlags | g) {
+		return false
+	}
+	s.setCC(conditionCodes(order))
+	for ; pops > 0; pops-- {
+		s.pop()
+	}
+	return true
+}
+
+// compareFlags FCOMI and FUCOMI (quiet): ZF, PF, CF = ST(0) compared with ST(i)
+func (f *FPU) compareFlags(i uint8, quiet bool, pop bool) {
+	reg := f.reg
+	s := &reg.FPU
+	a, flags := f.operand(0)
+	b, bFlags := f.operand(i)
+	order, g := compare80(a, b, quiet)
+	if !f.signal(flags | bFlags | g) {
+		return
+	}
+	var value uint32
+	switch order {
+	case cmpLess:
+		value = FlagCF
+	case cmpEqual:
+		value = FlagZF
+	case cmpUnordered:
+		value = FlagZF | FlagPF | FlagCF
+	}
+	reg.setEFlags(value, FlagZF|FlagPF|FlagCF|FlagOF|FlagSF|FlagAF)
+	if pop {
+		s.pop()
+	}
+}
+
+// fcmov FCMOVcc: ST(0) = ST(i) when cond holds
+func (f *FPU) fcmov(cond bool, i uint8) {
+	s := &f.reg.FPU
+	_, flags := f.operand(0)
+	v, vFlags := f.operand(i)
+	if f.signal(flags|vFlags) && cond {
+		s.setST(0, v)
+	}
+}
+
+// fcmovCondition the conditions of FCMOVB, FCMOVE, FCMOVBE and FCMOVU by reg field
+func (f *FPU) fcmovCondition(op uint8) bool {
+	reg := f.reg
+	switch op {
+	case 0:
+		return reg.IsCF()
+	case 1:
+		return reg.IsZF()
+	case 2:
+		return reg.IsCF() || reg.IsZF()
+	}
+	return reg.IsPF()
+}
+
+// unary replaces ST(0) with op(ST(0))
+func (f *FPU) unary(op func(a Float80) (Float80, uint16)) {
+	s := &f.reg.FPU
+	a, flags := f.operand(0)
+	result, g := op(a)
+	if f.signal(flags | g) {
+		s.setST(0, result)
+	}
+}
+
+// binaryPop ST(1) = op(ST(1), ST(0)), then pops: FYL2X, FYL2XP1 and FPATAN
+func (f *FPU) binaryPop(op func(st1 Float80, st0 Float80) (Float80, uint16)) {
+	s := &f.reg.FPU
+	a, flags := f.operand(0)
+	b, bFlags := f.operand(1)
+	result, g := op(b, a)
+	if f.signal(flags | bFlags | g) {
+		s.setST(1, result)
+		s.pop()
+	}
+}
+
+// trig FSIN, FCOS and FPTAN leave ST(0) unchanged and set C2 when |ST(0)| >= 2^63
+func (f *FPU) trig(op func(a Float80) (Float80, uint16)) {
+	s := &f.reg.FPU
+	if !s.isEmpty(0) && !trigRange(s.st(0)) {
+		s.Status |= fswC2
+		return
+	}
+	f.unary(op)
+	s.Status &^= fswC2
+}
+
+func (f *FPU) fsincos() {
+	s := &f.reg.FPU
+	if !s.isEmpty(0) && !trigRange(s.st(0)) {
+		s.Status |= fswC2
+		return
+	}
+	a, flags := f.operand(0)
+	sin, cos, g := sinCos80(a, f.rc())
+	f.replacePush(sin, cos, flags|g)
+	s.Status &^= fswC2
+}
+
+func (f *FPU) fptan() {
+	s := &f.reg.FPU
+	if !s.isEmpty(0) && !trigRange(s.st(0)) {
+		s.Status |= fswC2
+		return
+	}
+	a, flags := f.operand(0)
+	tan, g := tan80(a, f.rc())
+	one := fpuConstant(0, f.rc())
+	if !a.isFinite() {
+		one = tan
+	}
+	f.replacePush(tan, one, flags|g)
+	s.Status &^= fswC2
+}
+
+func (f *FPU) fxtract() {
+	a, flags := f.operand(0)
+	exp, mant, g := extract80(a)
+	f.replacePush(exp, mant, flags|g)
+}
+
+// fprem FPREM and FPREM1: C0, C3, C1 get the low quotient bits, C2 a partial remainder
+func (f *FPU) fprem(ieee bool) {
+	s := &f.reg.FPU
+	a, flags := f.operand(0)
+	b, bFlags := f.operand(1)
+	result, cc, g := remainder80(a, b, ieee)
+	if f.signal(flags | bFlags | g) {
+		s.setST(0, result)
+		s.setCC(cc)
+	}
+}
+
+// fxam FXAM: C3, C2, C0 classify ST(0), C1 is its sign
+func (f *FPU) fxam() {
+	s := &f.reg.FPU
+	v := s.st(0)
+	var cc uint16
+	if v.Sign {
+		cc |= fswC1
+	}
+	if s.isEmpty(0) {
+		s.setCC(cc | fswC3 | fswC0)
+		return
+	}
+	switch v.class() {
+	case classNaN:
+		cc |= fswC0
+	case classNormal:
+		cc |= fswC2
+	case classInfinity:
+		cc |= fswC2 | fswC0
+	case classZero:
+		cc |= fswC3
+	case classDenormal:
+		cc |= fswC3 | fswC2
+	}
+	s.setCC(cc)
+}
+
+// fxch FXCH: exchanges ST(0) and ST(i)
+func (f *FPU) fxch(i uint8) {
+	s := &f.reg.FPU
+	a, flags := f.operand(0)
+	b, bFlags := f.operand(i)
+	if f.signal(flags | bFlags) {
+		s.setST(0, b)
+		s.setST(i, a)
+	}
+}
+
+// fst FST and FSTP to ST(i)
+func (f *FPU) fst(i uint8, pop bool) {
+	s := &f.reg.FPU
+	v, flags := f.operand(0)
+	if f.signal(flags) {
+		s.setST(i, v)
+		if pop {
+			s.pop()
+		}
+	}
+}
+
+func (f *FPU) fninit() {
+	f.reg.FPU.init()
+}
+
+func (f *FPU) fnclex() {
+	s := &f.reg.FPU
+	s.Status &^= fswExceptions | fswSF | fswES | fswB
+	s.ferr = false
+}
+
+// readReal32 the m32fp operand
+func (f *FPU) readReal32(modrm *ModRM) (Float80, uint16) {
+	bits := readDword(f.mem, modrm.linear(4, false))
+	return float80FromIEEE(uint64(bits), 23, 8)
+}
+
+// readReal64 the m64fp operand
+func (f *FPU) readReal64(modrm *ModRM) (Float80, uint16) {
+	return float80FromIEEE(readQword(f.mem, modrm.linear(8, false)), 52, 11)
+}
+
+// readInt the m16int, m32int or m64int operand, converted exactly
+func (f *FPU) readInt(modrm *ModRM, size uint32) Float80 {
+	mem := f.mem
+	address := modrm.linear(size, false)
+	switch size {
+	case 2:
+		return float80FromInt(int64(int16(readWord(mem, address))))
+	case 4:
+		return float80FromInt(int64(int32(readDword(mem, address))))
+	}
+	return float80FromInt(int64(readQword(f.mem, address)))
+}
+
+// read80 reads a double extended precision value at a linear address
+func read80(mem IMemory, address uint64) Float80 {
+	se := readWord(mem, address+8)
+	return Float80{Sign: se&0x8000 != 0, Exp: se & 0x7fff, Mant: readQword(mem, address)}
+}
+
+func write80(mem IMemory, address uint64, v Float80) {
+	se := v.Exp
+	if v.Sign {
+		se |= 0x8000
+	}
+	writeQword(mem, address, v.Mant)
+	writeWord(mem, address+8, se)
+}
+
+// storeReal FST and FSTP to m32fp (size 4) or m64fp (size 8)
+func (f *FPU) storeReal(modrm *ModRM, size uint32, pop bool) {
+	s := &f.reg.FPU
+	address := modrm.linear(size, true)
+	v, flags := f.operand(0)
+	var bits uint64
+	var g uint16
+	if size == 4 {
+		bits, g = v.toIEEE(formatSingle, 23, 8, f.rc())
+	} else {
+		bits, g = v.toIEEE(formatDouble, 52, 11, f.rc())
+	}
+	if !f.signalStore(flags | g) {
+		return
+	}
+	if size == 4 {
+		writeDword(f.mem, address, uint32(bits))
+	} else {
+		writeQword(f.mem, address, bits)
+	}
+	if pop {
+		s.pop()
+	}
+}
+
+// storeInt FIST, FISTP and FISTTP (truncate) to an integer of size bytes
+func (f *FPU) storeInt(modrm *ModRM, size uint32, pop bool, truncate bool) {
+	s := &f.reg.FPU
+	mem := f.mem
+	address := modrm.linear(size, true)
+	v, flags := f.operand(0)
+	n, g := v.toInt(uint(size*8), f.rc(), truncate)
+	if !f.signal(flags | g) {
+		return
+	}
+	switch size {
+	case 2:
+		writeWord(mem, address, uint16(n))
+	case 4:
+		writeDword(mem, address, uint32(n))
+	default:
+		writeQword(f.mem, address, uint64(n))
+	}
+	if pop {
+		s.pop()
+	}
+}
+
+// fbld FBLD: pushes an 18-digit packed BCD integer
+func (f *FPU) fbld(modrm *ModRM) {
+	mem := f.mem
+	address := modrm.linear(10, false)
+	var b [10]byte
+	for i := range b {
+		b[i] = uint8(mem.ReadLinear(address+uint64(i), 1))
+	}
+	f.load(float80FromBCD(b), 0)
+}
+
+// fbstp FBSTP: stores ST(0) as a packed BCD integer and pops
+func (f *FPU) fbstp(modrm *ModRM) {
+	s := &f.reg.FPU
+	mem := f.mem
+	address := modrm.linear(10, true)
+	v, flags := f.operand(0)
+	b, g := v.toBCD(f.rc())
+	if !f.signal(flags | g) {
+		return
+	}
+	for i := range b {
+		mem.WriteLinear(address+uint64(i), 1, uint64(b[i]))
+	}
+	s.pop()
+}
+
+// envSize bytes of the FLDENV and FNSTENV image: 28 with a 32-bit operand size, 14 with 16.
+// 64-bit mode has the 32-bit format.
+func (f *FPU) envSize() uint32 {
+	reg := f.reg
+	if (reg.IsCode32() || reg.mode64) != reg.opOverride {
+		return 28
+	}
+	return 14
+}
+
+// storeEnv writes the environment in the format of the operand size and mode. Real and
+// virtual-8086 mode images hold 20-bit linear instruction and data pointers.
+func (f *FPU) storeEnv(address uint64) {
+	reg := f.reg
+	mem := f.mem
+	s := &reg.FPU
+	ip, dp := s.FIP, s.FDP
+	if reg.realSegments() {
+		ip += uint32(s.FCS) << 4
+		dp += uint32(s.FDS) << 4
+	}
+	if f.envSize() == 28 {
+		writeDword(mem, address, uint32(s.Control)|0xffff0000)
+		writeDword(mem, address+4, uint32(s.Status)|0xffff0000)
+		writeDword(mem, address+8, uint32(s.Tag)|0xffff0000)
+		if reg.realSegments() {
+			writeDword(mem, address+12, ip&0xffff|0xffff0000)
+			writeDword(mem, address+16, ip>>16<<12|uint32(s.FOP))
+			writeDword(mem, address+20, dp&0xffff|0xffff0000)
+			writeDword(mem, address+24, dp>>16<<12)
+			return
+		}
+		writeDword(mem, address+12, ip)
+		writeDword(mem, address+16, uint32(s.FOP)<<16|uint32(s.FCS))
+		writeDword(mem, address+20, dp)
+		writeDword(mem, address+24, uint32(s.FDS)|0xffff0000)
+		return
+	}
+	writeWord(mem, address, s.Control)
+	writeWord(mem, address+2, s.Status)
+	writeWord(mem, address+4, s.Tag)
+	if reg.realSegments() {
+		writeWord(mem, address+6, uint16(ip))
+		writeWord(mem, address+8, uint16(ip>>16&0xf)<<12|s.FOP)
+		writeWord(mem, address+10, uint16(dp))
+		writeWord(mem, address+12, uint16(dp>>16&0xf)<<12)
+		return
+	}
+	writeWord(mem, address+6, uint16(ip))
+	writeWord(mem, address+8, s.FCS)
+	writeWord(mem, address+10, uint16(dp))
+	writeWord(mem, address+12, s.FDS)
+}
+
+// loadEnv reads the environment written by storeEnv
+func (f *FPU) loadEnv(address uint64) {
+	reg := f.reg
+	mem := f.mem
+	s := &reg.FPU
+	if f.envSize() == 28 {
+		s.Control = uint16(readDword(mem, address))
+		s.Status = uint16(readDword(mem, address+4))
+		s.Tag = uint16(readDword(mem, address+8))
+		if reg.realSegments() {
+			s.FIP = readDword(mem, address+12)&0xffff | readDword(mem, address+16)>>12&0xffff<<16
+			s.FOP = uint16(readDword(mem, address+16) & 0x7ff)
+			s.FDP = readDword(mem, address+20)&0xffff | readDword(mem, address+24)>>12&0xffff<<16
+			s.FCS, s.FDS = 0, 0
+		} else {
+			s.FIP = readDword(mem, address+12)
+			s.FCS = uint16(readDword(mem, address+16))
+			s.FOP = uint16(readDword(mem, address+16) >> 16 & 0x7ff)
+			s.FDP = readDword(mem, address+20)
+			s.FDS = uint16(readDword(mem, address+24))
+		}
+	} else {
+		s.Control = readWord(mem, address)
+		s.Status = readWord(mem, address+2)
+		s.Tag = readWord(mem, address+4)
+		if reg.realSegments() {
+			s.FIP = uint32(readWord(mem, address+6)) | uint32(readWord(mem, address+8)>>12)<<16
+			s.FOP = readWord(mem, address+8) & 0x7ff
+			s.FDP = uint32(readWord(mem, address+10)) | uint32(readWord(mem, address+12)>>12)<<16
+			s.FCS, s.FDS = 0, 0
+		} else {
+			s.FIP = uint32(readWord(mem, address+6))
+			s.FCS = readWord(mem, address+8)
+			s.FDP = uint32(readWord(mem, address+10))
+			s.FDS = readWord(mem, address+12)
+		}
+	}
+	s.Control = s.Control&fcwMask | 0x40
+	s.updateES()
+}
+
+// fldenv FLDENV: a pending exception unmasked by the new state is reported by the next
+// waiting instruction
+func (f *FPU) fldenv(modrm *ModRM) {
+	s := &f.reg.FPU
+	f.loadEnv(modrm.linear(f.envSize(), false))
+	s.retag()
+}
+
+// fnstenv FNSTENV: stores the environment, then masks every exception
+func (f *FPU) fnstenv(modrm *ModRM) {
+	s := &f.reg.FPU
+	f.storeEnv(modrm.linear(f.envSize(), true))
+	s.Control |= fswExceptions
+}
+
+// fnsave FNSAVE: the environment and ST(0)-ST(7), then FNINIT
+func (f *FPU) fnsave(modrm *ModRM) {
+	s := &f.reg.FPU
+	size := f.envSize()
+	address := modrm.linear(size+80, true)
+	f.storeEnv(address)
+	for i := uint8(0); i < 8; i++ {
+		write80(f.mem, address+uint64(size+10*uint32(i)), s.st(i))
+	}
+	f.fninit()
+}
+
+// frstor FRSTOR: reloads the image of FNSAVE
+func (f *FPU) frstor(modrm *ModRM) {
+	s := &f.reg.FPU
+	size := f.envSize()
+	address := modrm.linear(size+80, false)
+	f.loadEnv(address)
+	for i := uint8(0); i < 8; i++ {
+		s.Regs[s.phys(i)] = read80(f.mem, address+uint64(size+10*uint32(i)))
+	}
+	s.retag()
+}
+
+func (f *FPU) fldcw(modrm *ModRM) {
+	s := &f.reg.FPU
+	s.Control = modrm.GetRM16()&fcwMask | 0x40
+	s.updateES()
+}
+
+// codeD8 arithmetic on ST(0) with m32fp or ST(i)
+func (f *FPU) codeD8(modrm *ModRM) {
+	if modrm.Mod == 3 {
+		v, flags := f.operand(modrm.Rm)
+		f.arithmetic(modrm.Opcode, v, flags, 0)
+		return
+	}
+	v, flags := f.readReal32(modrm)
+	f.arithmetic(modrm.Opcode, v, flags, 0)
+}
+
+// codeD9 FLD, FST, FSTP m32fp, the environment and control word, and the register forms
+// FLD, FXCH, FNOP, FCHS, FABS, FTST, FXAM, the constants and the transcendentals
+func (f *FPU) codeD9(modrm *ModRM) {
+	s := &f.reg.FPU
+	rc := f.rc()
+	if modrm.Mod != 3 {
+		switch modrm.Opcode {
+		case 0:
+			f.load(f.readReal32(modrm))
+		case 2, 3:
+			f.storeReal(modrm, 4, modrm.Opcode == 3)
+		case 4:
+			f.fldenv(modrm)
+		case 5:
+			f.fldcw(modrm)
+		case 6:
+			f.fnstenv(modrm)
+		case 7:
+			modrm.SetRM16(s.Control)
+		default:
+			raise(ExceptionUD)
+		}
+		return
+	}
+	i := modrm.Rm
+	switch modrm.Opcode {
+	case 0:
+		f.load(f.operand(i))
+	case 1:
+		f.fxch(i)
+	case 2:
+		if i != 0 {
+			raise(ExceptionUD)
+		}
+	case 3:
+		f.fst(i, true)
+	case 4:
+		switch i {
+		case 0:
+			f.unary(func(a Float80) (Float80, uint16) { return a.neg(), 0 })
+		case 1:
+			f.unary(func(a Float80) (Float80, uint16) {
+				a.Sign = false
+				return a, 0
+			})
+		case 4:
+			f.compare(Float80{}, 0, false, 0)
+		case 5:
+			f.fxam()
+		default:
+			raise(ExceptionUD)
+		}
+	case 5:
+		if i == 7 {
+			raise(ExceptionUD)
+		}
+		f.load(fpuConstant(i, rc), 0)
+	case 6:
+		switch i {
+		case 0:
+			f.unary(func(a Float80) (Float80, uint16) { return exp2m1(a, rc) })
+		case 1:
+			f.binaryPop(func(y Float80, x Float80) (Float80, uint16) { return log2Product(y, x, false, rc) })
+		case 2:
+			f.fptan()
+		case 3:
+			f.binaryPop(func(y Float80, x Float80) (Float80, uint16) { return atan80(y, x, rc) })
+		case 4:
+			f.fxtract()
+		case 5:
+			f.fprem(true)
+		case 6:
+			s.setTop(s.top() - 1)
+			s.Status &^= fswC1
+		case 7:
+			s.setTop(s.top() + 1)
+			s.Status &^= fswC1
+		}
+	case 7:
+		switch i {
+		case 0:
+			f.fprem(false)
+		case 1:
+			f.binaryPop(func(y Float80, x Float80) (Float80, uint16) { return log2Product(y, x, true, rc) })
+		case 2:
+			f.unary(func(a Float80) (Float80, uint16) { return sqrt80(a, f.precision(), rc) })
+		case 3:
+			f.fsincos()
+		case 4:
+			f.unary(func(a Float80) (Float80, uint16) { return roundInt80(a, rc) })
+		case 5:
+			a, flags := f.operand(0)
+			b, bFlags := f.operand(1)
+			result, g := scale80(a, b, rc)
+			if f.signal(flags | bFlags | g) {
+				s.setST(0, result)
+			}
+		case 6:
+			f.trig(func(a Float80) (Float80, uint16) {
+				sin, _, flags := sinCos80(a, rc)
+				return sin, flags
+			})
+		case 7:
+			f.trig(func(a Float80) (Float80, uint16) {
+				_, cos, flags := sinCos80(a, rc)
+				return cos, flags
+			})
+		}
+	}
+}
+
+// codeDA arithmetic with m32int, FCMOVB/E/BE/U and FUCOMPP
+func (f *FPU) codeDA(modrm *ModRM) {
+	if modrm.Mod != 3 {
+		f.arithmetic(modrm.Opcode, f.readInt(modrm, 4), 0, 0)
+		return
+	}
+	switch {
+	case modrm.Opcode < 4:
+		f.fcmov(f.fcmovCondition(modrm.Opcode), modrm.Rm)
+	case modrm.Opcode == 5 && modrm.Rm == 1:
+		v, flags := f.operand(1)
+		f.compare(v, flags, true, 2)
+	default:
+		raise(ExceptionUD)
+	}
+}
+
+// codeDB FILD, FISTTP, FIST, FISTP m32int, FLD and FSTP m80fp, FCMOVNcc, FNCLEX, FNINIT,
+// FUCOMI and FCOMI
+func (f *FPU) codeDB(modrm *ModRM) {
+	s := &f.reg.FPU
+	if modrm.Mod != 3 {
+		switch modrm.Opcode {
+		case 0:
+			f.load(f.readInt(modrm, 4), 0)
+		case 1:
+			f.storeInt(modrm, 4, true, true)
+		case 2, 3:
+			f.storeInt(modrm, 4, modrm.Opcode == 3, false)
+		case 5:
+			f.load(read80(f.mem, modrm.linear(10, false)), 0)
+		case 7:
+			address := modrm.linear(10, true)
+			v, flags := f.operand(0)
+			if f.signal(flags) {
+				write80(f.mem, address, v)
+				s.pop()
+			}
+		default:
+			raise(ExceptionUD)
+		}
+		return
+	}
+	switch modrm.Opcode {
+	case 0, 1, 2, 3:
+		f.fcmov(!f.fcmovCondition(modrm.Opcode), modrm.Rm)
+	case 4:
+		switch modrm.Rm {
+		case 0, 1, 4:
+			// FENI, FDISI and FSETPM do nothing after the 80287
+		case 2:
+			f.fnclex()
+		case 3:
+			f.fninit()
+		default:
+			raise(ExceptionUD)
+		}
+	case 5:
+		f.compareFlags(modrm.Rm, true, false)
+	case 6:
+		f.compareFlags(modrm.Rm, false, false)
+	default:
+		raise(ExceptionUD)
+	}
+}
+
+// codeDC arithmetic on ST(0) with m64fp, or into ST(i): FSUB and FSUBR, FDIV and FDIVR
+// trade their reg fields
+func (f *FPU) codeDC(modrm *ModRM) {
+	if modrm.Mod != 3 {
+		v, flags := f.readReal64(modrm)
+		f.arithmetic(modrm.Opcode, v, flags, 0)
+		return
+	}
+	v, flags := f.operand(modrm.Rm)
+	if modrm.Opcode == 2 || modrm.Opcode == 3 {
+		f.arithmetic(modrm.Opcode, v, flags, 0)
+		return
+	}
+	f.arithmetic(modrm.Opcode, v, flags, modrm.Rm)
+}
+
+// codeDD FLD, FISTTP, FST, FSTP m64fp, FRSTOR, FNSAVE, FNSTSW m16, FFREE, FST, FSTP,
+// FUCOM and FUCOMP
+func (f *FPU) codeDD(modrm *ModRM) {
+	s := &f.reg.FPU
+	if modrm.Mod != 3 {
+		switch modrm.Opcode {
+		case 0:
+			f.load(f.readReal64(modrm))
+		case 1:
+			f.storeInt(modrm, 8, true, true)
+		case 2, 3:
+			f.storeReal(modrm, 8, modrm.Opcode == 3)
+		case 4:
+			f.frstor(modrm)
+		case 6:
+			f.fnsave(modrm)
+		case 7:
+			modrm.SetRM16(s.Status)
+		default:
+			raise(ExceptionUD)
+		}
+		return
+	}
+	i := modrm.Rm
+	switch modrm.Opcode {
+	case 0:
+		s.setTag(s.phys(i), tagEmpty)
+	case 1:
+		f.fxch(i)
+	case 2, 3:
+		f.fst(i, modrm.Opcode == 3)
+	case 4, 5:
+		v, flags := f.operand(i)
+		f.compare(v, flags, true, int(modrm.Opcode-4))
+	default:
+		raise(ExceptionUD)
+	}
+}
+
+// codeDE arithmetic with m16int, or into ST(i) then pop, and FCOMPP
+func (f *FPU) codeDE(modrm *ModRM) {
+	s := &f.reg.FPU
+	if modrm.Mod != 3 {
+		f.arithmetic(modrm.Opcode, f.readInt(modrm, 2), 0, 0)
+		return
+	}
+	v, flags := f.operand(modrm.Rm)
+	switch modrm.Opcode {
+	case 2:
+		f.compare(v, flags, false, 1)
+	case 3:
+		if modrm.Rm != 1 {
+			raise(ExceptionUD)
+		}
+		f.compare(v, flags, false, 2)
+	default:
+		if f.arithmetic(modrm.Opcode, v, flags, modrm.Rm) {
+			s.pop()
+		}
+	}
+}
+
+// codeDF FILD, FISTTP, FIST, FISTP m16int, FBLD, FILD m64int, FBSTP, FISTP m64int, FFREEP,
+// FNSTSW AX, FUCOMIP and FCOMIP
+func (f *FPU) codeDF(modrm *ModRM) {
+	reg := f.reg
+	s := &reg.FPU
+	if modrm.Mod != 3 {
+		switch modrm.Opcode {
+		case 0:
+			f.load(f.readInt(modrm, 2), 0)
+		case 1:
+			f.storeInt(modrm, 2, true, true)
+		case 2, 3:
+			f.storeInt(modrm, 2, modrm.Opcode == 3, false)
+		case 4:
+			f.fbld(modrm)
+		case 5:
+			f.load(f.readInt(modrm, 8), 0)
+		case 6:
+			f.fbstp(modrm)
+		case 7:
+			f.storeInt(modrm, 8, true, false)
+		}
+		return
+	}
+	i := modrm.Rm
+	switch modrm.Opcode {
+	case 0:
+		s.setTag(s.phys(i), tagEmpty)
+		s.pop()
+	case 1:
+		f.fxch(i)
+	case 2, 3:
+		f.fst(i, true)
+	case 4:
+		if i != 0 {
+			raise(ExceptionUD)
+		}
+		if reg.mode64 {
+			reg.X64.Set(0, 16, false, uint64(s.Status))
+		} else {
+			reg.Set16ByIndex(0, s.Status)
+		}
+	case 5:
+		f.compareFlags(i, true, true)
+	case 6:
+		f.compareFlags(i, false, true)
+	default:
+		raise(ExceptionUD)
+	}
+}
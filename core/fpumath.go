@@ -0,0 +1,481 @@
+package core
+
+import "math/big"
+
+// fpuWorkPrec bits of the intermediate results of the transcendental instructions, well
+// beyond the 64 bits they are rounded to
+const fpuWorkPrec = 192
+
+// piReducePrec bits of pi used to reduce arguments up to 2^63 modulo pi/2
+const piReducePrec = 512
+
+const piDigits = "3.14159265358979323846264338327950288419716939937510582097494459230781640628620899862803482534211706798214808651328230664709384460955058223172535940812848111745028410270193852110555964462294895493038196"
+
+var (
+	bigPi   *big.Float
+	bigLn2  *big.Float
+	bigLn10 *big.Float
+	bigOne  = big.NewFloat(1)
+	bigTwo  = big.NewFloat(2)
+)
+
+func init() {
+	bigPi, _, _ = big.ParseFloat(piDigits, 10, piReducePrec, big.ToNearestEven)
+	// ln 2 = 2 atanh(1/3)
+	third := newWork().Quo(bigOne, big.NewFloat(3))
+	bigLn2 = atanhSeries(third)
+	bigLn2.Mul(bigLn2, bigTwo)
+	bigLn10 = lnWork(big.NewFloat(10))
+}
+
+func newWork() *big.Float {
+	return new(big.Float).SetPrec(fpuWorkPrec)
+}
+
+// negligible term no longer changes sum at the working precision
+func negligible(term *big.Float, sum *big.Float) bool {
+	return term.Sign() == 0 || sum.Sign() != 0 && term.MantExp(nil) < sum.MantExp(nil)-fpuWorkPrec-2
+}
+
+// atanhSeries z + z^3/3 + z^5/5 + ... for |z| well below 1
+func atanhSeries(z *big.Float) *big.Float {
+	sum := newWork().Set(z)
+	z2 := newWork().Mul(z, z)
+	power := newWork().Set(z)
+	for k := int64(3); ; k += 2 {
+		power.Mul(power, z2)
+		term := newWork().Quo(power, big.NewFloat(float64(k)))
+		if negligible(term, sum) {
+			return sum
+		}
+		sum.Add(sum, term)
+	}
+}
+
+// lnWork natural logarithm of x > 0: x = m * 2^e with m in [0.5, 1), ln m = 2 atanh((m-1)/(m+1))
+func lnWork(x *big.Float) *big.Float {
+	m := newWork()
+	e := x.MantExp(m)
+	z := newWork().Quo(newWork().Sub(m, bigOne), newWork().Add(m, bigOne))
+	r := atanhSeries(z)
+	r.Mul(r, bigTwo)
+	return r.Add(r, newWork().Mul(bigLn2, big.NewFloat(float64(e))))
+}
+
+// ln1pWork ln(1 + x), accurate for small x: 2 atanh(x / (2 + x))
+func ln1pWork(x *big.Float) *big.Float {
+	if cmpAbs(x, big.NewFloat(0.5)) >= 0 {
+		return lnWork(newWork().Add(bigOne, x))
+	}
+	r := atanhSeries(newWork().Quo(x, newWork().Add(bigTwo, x)))
+	return r.Mul(r, bigTwo)
+}
+
+// expm1Work e^x - 1 for |x| <= 1
+func expm1Work(x *big.Float) *big.Float {
+	sum := newWork()
+	term := newWork().SetInt64(1)
+	for k := int64(1); ; k++ {
+		term.Mul(term, x)
+		term.Quo(term, big.NewFloat(float64(k)))
+		if negligible(term, sum) {
+			return sum
+		}
+		sum.Add(sum, term)
+	}
+}
+
+// trigSeries the sine (first = x) or cosine (first = 1) Taylor series, for |x| <= pi/4
+func trigSeries(x *big.Float, cosine bool) *big.Float {
+	x2 := newWork().Mul(x, x)
+	term := newWork().Set(x)
+	k := int64(1)
+	if cosine {
+		term.SetInt64(1)
+		k = 0
+	}
+	sum := newWork().Set(term)
+	for {
+		term.Mul(term, x2)
+		term.Quo(term, big.NewFloat(float64((k+1)*(k+2))))
+		term.Neg(term)
+		k += 2
+		if negligible(term, sum) {
+			return sum
+		}
+		sum.Add(sum, term)
+	}
+}
+
+// sinCosWork sine and cosine of x, reduced modulo pi/2
+func sinCosWork(x *big.Float) (*big.Float, *big.Float) {
+	halfPi := new(big.Float).SetPrec(piReducePrec).Quo(bigPi, bigTwo)
+	q := new(big.Float).SetPrec(piReducePrec).Quo(x, halfPi)
+	k, _ := roundToInteger(q, big.ToNearestEven)
+	r := new(big.Float).SetPrec(piReducePrec).SetInt(k)
+	r.Mul(r, halfPi)
+	r.Sub(x, r)
+	r = newWork().Set(r)
+	sin, cos := trigSeries(r, false), trigSeries(r, true)
+	switch new(big.Int).And(k, big.NewInt(3)).Int64() {
+	case 1:
+		sin, cos = cos, sin.Neg(sin)
+	case 2:
+		sin, cos = sin.Neg(sin), cos.Neg(cos)
+	case 3:
+		sin, cos = cos.Neg(cos), sin
+	}
+	return sin, cos
+}
+
+// atanWork arctangent of x: arguments above 1 are inverted, then the angle is halved three
+// times with atan(a) = 2 atan(a / (1 + sqrt(1 + a^2))) before the series
+func atanWork(x *big.Float) *big.Float {
+	a := newWork().Abs(x)
+	invert := a.Cmp(bigOne) > 0
+	if invert {
+		a.Quo(bigOne, a)
+	}
+	for i := 0; i < 3; i++ {
+		t := newWork().Mul(a, a)
+		t.Add(t, bigOne)
+		t.Sqrt(t)
+		t.Add(t, bigOne)
+		a.Quo(a, t)
+	}
+	sum := newWork().Set(a)
+	a2 := newWork().Mul(a, a)
+	power := newWork().Set(a)
+	for k := int64(3); ; k += 2 {
+		power.Mul(power, a2)
+		power.Neg(power)
+		term := newWork().Quo(power, big.NewFloat(float64(k)))
+		if negligible(term, sum) {
+			break
+		}
+		sum.Add(sum, term)
+	}
+	sum.Mul(sum, big.NewFloat(8))
+	if invert {
+		sum.Sub(newWork().Quo(bigPi, bigTwo), sum)
+	}
+	if x.Sign() < 0 {
+		sum.Neg(sum)
+	}
+	return sum
+}
+
+// roundWork rounds an intermediate result to extended precision
+func roundWork(v *big.Float, rc uint16) (Float80, uint16) {
+	return round(func(z *big.Float) *big.Float { return z.Set(v) }, formatExtended, rc)
+}
+
+// piMultiple k pi / d rounded to extended precision
+func piMultiple(k int64, d int64, sign bool, rc uint16) Float80 {
+	v := newWork().Mul(bigPi, big.NewFloat(float64(k)))
+	v.Quo(v, big.NewFloat(float64(d)))
+	if sign {
+		v.Neg(v)
+	}
+	r, _ := roundWork(v, rc)
+	return r
+}
+
+// fpuConstant the constants of FLD1, FLDL2T, FLDL2E, FLDPI, FLDLG2, FLDLN2 and FLDZ (D9 E8-EE)
+func fpuConstant(index uint8, rc uint16) Float80 {
+	var v *big.Float
+	switch index {
+	case 0:
+		v = bigOne
+	case 1:
+		v = newWork().Quo(bigLn10, bigLn2)
+	case 2:
+		v = newWork().Quo(bigOne, bigLn2)
+	case 3:
+		v = bigPi
+	case 4:
+		v = newWork().Quo(bigLn2, bigLn10)
+	case 5:
+		v = bigLn2
+	default:
+		return Float80{}
+	}
+	r, _ := roundWork(v, rc)
+	return r
+}
+
+// trigRange the trigonometric instructions leave arguments of 2^63 and more unchanged and set C2
+func trigRange(a Float80) bool {
+	return a.class() != classNormal || int(a.Exp)-float80Bias < 63
+}
+
+// sinCos80 FSIN, FCOS and FSINCOS
+func sinCos80(a Float80, rc uint16) (Float80, Float80, uint16) {
+	flags := operandFlags(a)
+	switch a.class() {
+	case classNaN, classUnsupported:
+		nan := propagateNaN(a, a)
+		return nan, nan, flags
+	case classInfinity:
+		return float80Indefinite, float80Indefinite, flags | fswIE
+	case classZero:
+		return a, fpuConstant(0, rc), flags
+	}
+	s, c := sinCosWork(a.big())
+	sin, f := roundWork(s, rc)
+	cos, g := roundWork(c, rc)
+	return sin, cos, flags | f | g
+}
+
+// tan80 FPTAN
+func tan80(a Float80, rc uint16) (Float80, uint16) {
+	flags := operandFlags(a)
+	switch a.class() {
+	case classNaN, classUnsupported:
+		return propagateNaN(a, a), flags
+	case classInfinity:
+		return float80Indefinite, flags | fswIE
+	case classZero:
+		return a, flags
+	}
+	s, c := sinCosWork(a.big())
+	r, f := roundWork(newWork().Quo(s, c), rc)
+	return r, flags | f
+}
+
+// atan80 FPATAN: the angle of the point (x, y) = (ST0, ST1)
+func atan80(y Float80, x Float80, rc uint16) (Float80, uint16) {
+	flags := operandFlags(y, x)
+	if hasNaN(y, x) {
+		return propagateNaN(y, x), flags
+	}
+	yInf, xInf := y.class() == classInfinity, x.class() == classInfinity
+	switch {
+	case yInf && xInf:
+		if x.Sign {
+			return piMultiple(3, 4, y.Sign, rc), flags | fswPE
+		}
+		return piMultiple(1, 4, y.Sign, rc), flags | fswPE
+	case yInf || x.class() == classZero && y.class() != classZero:
+		return piMultiple(1, 2, y.Sign, rc), flags | fswPE
+	case xInf || y.class() == classZero:
+		if x.Sign {
+			return piMultiple(1, 1, y.Sign, rc), flags | fswPE
+		}
+		return Float80{Sign: y.Sign}, flags
+	}
+	angle := atanWork(newWork().Quo(y.big(), x.big()))
+	if x.Sign {
+		if y.Sign {
+			angle.Sub(angle, bigPi)
+		} else {
+			angle.Add(angle, bigPi)
+		}
+	}
+	r, f := roundWork(angle, rc)
+	return r, flags | f
+}
+
+// exp2m1 F2XM1: 2^x - 1
+func exp2m1(a Float80, rc uint16) (Float80, uint16) {
+	flags := operandFlags(a)
+	switch a.class() {
+	case classNaN, classUnsupported:
+		return propagateNaN(a, a), flags
+	case classZero:
+		return a, flags
+	case classInfinity:
+		if a.Sign {
+			return fpuConstant(0, rc).neg(), flags
+		}
+		return a, flags
+	}
+	x := a.big()
+	if cmpAbs(x, bigOne) <= 0 {
+		r, f := roundWork(expm1Work(newWork().Mul(x, bigLn2)), rc)
+		return r, flags | f
+	}
+	// outside [-1, 1]: 2^n * 2^f - 1 with n the integer part
+	n, _ := roundToInteger(x, big.ToNegativeInf)
+	frac := newWork().Sub(x, new(big.Float).SetInt(n))
+	v := expm1Work(frac.Mul(frac, bigLn2))
+	v.Add(v, bigOne)
+	v.SetMantExp(v, int(n.Int64()))
+	r, f := roundWork(v.Sub(v, bigOne), rc)
+	return r, flags | f
+}
+
+// log2Product FYL2X and FYL2XP1 (plusOne): y * log2(x) or y * log2(x + 1)
+func log2Product(y Float80, x Float80, plusOne bool, rc uint16) (Float80, uint16) {
+	flags := operandFlags(y, x)
+	if hasNaN(y, x) {
+		return propagateNaN(y, x), flags
+	}
+	arg := x
+	if plusOne && x.isFinite() {
+		sum, _ := arith(fpAdd, x, fpuConstant(0, rc), formatExtended, rc)
+		arg = sum
+	}
+	if arg.Sign && arg.class() != classZero {
+		return float80Indefinite, flags | fswIE
+	}
+	yZero, yInf := y.class() == classZero, y.class() == classInfinity
+	switch arg.class() {
+	case classZero:
+		if yZero {
+			return float80Indefinite, flags | fswIE
+		}
+		if yInf {
+			return float80Inf(!y.Sign), flags
+		}
+		return float80Inf(!y.Sign), flags | fswZE
+	case classInfinity:
+		if yZero {
+			return float80Indefinite, flags | fswIE
+		}
+		return float80Inf(y.Sign), flags
+	}
+	var log *big.Float
+	if plusOne {
+		log = ln1pWork(x.big())
+	} else {
+		log = lnWork(x.big())
+	}
+	log.Quo(log, bigLn2)
+	if yInf {
+		if log.Sign() == 0 {
+			return float80Indefinite, flags | fswIE
+		}
+		return float80Inf(y.Sign != (log.Sign() < 0)), flags
+	}
+	if yZero || log.Sign() == 0 {
+		return Float80{Sign: y.Sign != (log.Sign() < 0)}, flags
+	}
+	r, f := roundWork(log.Mul(log, y.big()), rc)
+	return r, flags | f
+}
+
+// scale80 FSCALE: a * 2^trunc(b)
+func scale80(a Float80, b Float80, rc uint16) (Float80, uint16) {
+	flags := operandFlags(a, b)
+	if hasNaN(a, b) {
+		return propagateNaN(a, b), flags
+	}
+	aZero, aInf := a.class() == classZero, a.class() == classInfinity
+	if b.class() == classInfinity {
+		switch {
+		case aZero && !b.Sign || aInf && b.Sign:
+			return float80Indefinite, flags | fswIE
+		case aZero || aInf:
+			return a, flags
+		case b.Sign:
+			return Float80{Sign: a.Sign}, flags
+		}
+		return float80Inf(a.Sign), flags
+	}
+	if aZero || aInf {
+		return a, flags
+	}
+	n, _ := roundToInteger(b.big(), big.ToZero)
+	// beyond 2^20 the result overflows or underflows anyway
+	limit := big.NewInt(1 << 20)
+	if n.CmpAbs(limit) > 0 {
+		n.Mul(limit, big.NewInt(int64(n.Sign())))
+	}
+	r, f := round(func(z *big.Float) *big.Float {
+		return z.SetMantExp(a.big(), int(n.Int64()))
+	}, formatExtended, rc)
+	return r, flags | f
+}
+
+// extract80 FXTRACT: the unbiased exponent and the significand of a
+func extract80(a Float80) (Float80, Float80, uint16) {
+	flags := operandFlags(a)
+	switch a.class() {
+	case classNaN, classUnsupported:
+		nan := propagateNaN(a, a)
+		return nan, nan, flags
+	case classZero:
+		return float80Inf(true), a, flags | fswZE
+	case classInfinity:
+		return float80Inf(false), a, flags
+	}
+	mant := new(big.Float)
+	exp := a.big().MantExp(mant) - 1
+	mant.SetMantExp(mant, 1)
+	return float80FromInt(int64(exp)), packFloat80(mant), flags
+}
+
+// remainder80 FPREM (truncated quotient) and FPREM1 (IEEE, quotient rounded to nearest).
+// Exponent differences of 64 and more give a partial remainder and set C2. C0, C3 and C1
+// hold the three low bits of the quotient.
+func remainder80(a Float80, b Float80, ieee bool) (Float80, uint16, uint16) {
+	flags := operandFlags(a, b)
+	if hasNaN(a, b) {
+		return propagateNaN(a, b), 0, flags
+	}
+	if a.class() == classInfinity || b.class() == classZero {
+		return float80Indefinite, 0, flags | fswIE
+	}
+	if b.class() == classInfinity || a.class() == classZero {
+		return a, 0, flags
+	}
+	am, bm := new(big.Float), new(big.Float)
+	ae := a.big().MantExp(am)
+	be := b.big().MantExp(bm)
+	// a = ma * 2^(ae-64), b = mb * 2^(be-64) with 64-bit integer significands
+	ma, _ := am.Abs(am).SetMantExp(am, 64).Int(nil)
+	mb, _ := bm.Abs(bm).SetMantExp(bm, 64).Int(nil)
+	d := ae - be
+	if d < 0 {
+		if ieee && d == -1 {
+			// |a| may still be above |b| / 2
+			ma.Lsh(ma, 1)
+			mb.Lsh(mb, 1)
+			d = 0
+			be--
+		} else {
+			return a, 0, flags
+		}
+	}
+	var cc uint16
+	shift := d
+	if d >= 64 {
+		// partial remainder: reduce by b * 2^(d-32)
+		shift = 32
+		cc |= fswC2
+	}
+	num := new(big.Int).Lsh(ma, uint(shift))
+	q, r := new(big.Int).QuoRem(num, mb, new(big.Int))
+	sign := a.Sign
+	if ieee && cc&fswC2 == 0 {
+		twice := new(big.Int).Lsh(r, 1)
+		if c := twice.Cmp(mb); c > 0 || c == 0 && q.Bit(0) != 0 {
+			q.Add(q, big.NewInt(1))
+			r.Sub(mb, r)
+			sign = !sign
+		}
+	}
+	if cc&fswC2 == 0 {
+		if q.Bit(0) != 0 {
+			cc |= fswC1
+		}
+		if q.Bit(1) != 0 {
+			cc |= fswC3
+		}
+		if q.Bit(2) != 0 {
+			cc |= fswC0
+		}
+	}
+	if r.Sign() == 0 {
+		return Float80{Sign: a.Sign}, cc, flags
+	}
+	// the remainder keeps the scale of the reduced dividend
+	v := new(big.Float).SetInt(r)
+	v.SetMantExp(v, ae-64-shift)
+	if sign {
+		v.Neg(v)
+	}
+	result, f := round(func(z *big.Float) *big.Float { return z.Set(v) }, formatExtended, 0)
+	return result, cc, flags | f&fswUE
+}
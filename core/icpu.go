@@ -3,5 +3,7 @@ package core
 type ICPU interface {
 	Init() error
 	Exec(code uint8) error
+	Step() error
+	IsHalted() bool
 	Dump()
 }
@@ -5,6 +5,17 @@ type IMemory interface {
 	RamSize() uint64
 	GetAddressBase() uint32
 	GetAddressEnd() uint64
+	SetA20(enabled bool)
+	IsA20() bool
+	FlushTLB(keepGlobal bool)
+	InvalidatePage(address uint64)
+	Implicit() (restore func())
+	ReadPhys8(address uint64) uint8
+	ReadPhys32(address uint64) uint32
+	ReadPhys64(address uint64) uint64
+	WritePhys8(address uint64, value uint8)
+	WritePhys32(address uint64, value uint32)
+	WritePhys64(address uint64, value uint64)
 	Read(address uint32) byte
 	Read8(address uint32) uint8
 	Read16(address uint32) uint16
@@ -13,6 +24,9 @@ type IMemory interface {
 	Write8(address uint32, value uint8)
 	Write16(address uint32, value uint16)
 	Write32(address uint32, value uint32)
+	ReadLinear(address uint64, size uint) uint64
+	WriteLinear(address uint64, size uint, value uint64)
+	FetchLinear(address uint64) uint8
 	GetCode8(offset int) uint8
 	GetSignCode8(offset int) int8
 	GetCode16(offset int) uint16
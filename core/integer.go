@@ -0,0 +1,573 @@
+package core
+
+import "math/bits"
+
+// Integer instructions of the 16-bit and 32-bit operand sizes, on the operations shared with
+// 64-bit mode. The handlers take their operand size from the table they are installed in;
+// the byte forms are installed with width 8.
+
+func (r *X86Registers) register(index uint8, width uint) uint32 {
+	switch width {
+	case 8:
+		return uint32(r.Get8ByIndex(index))
+	case 16:
+		return uint32(r.Get16ByIndex(index))
+	}
+	return r.GetByIndex(index)
+}
+
+func (r *X86Registers) setRegister(index uint8, width uint, value uint32) {
+	switch width {
+	case 8:
+		r.Set8ByIndex(index, uint8(value))
+	case 16:
+		r.Set16ByIndex(index, uint16(value))
+	default:
+		r.SetByIndex(index, value)
+	}
+}
+
+// addressMask the offsets of the address size: 16 or 32 bits
+func (r *X86Registers) addressMask() uint32 {
+	if r.isAddress32() {
+		return 0xffffffff
+	}
+	return 0xffff
+}
+
+func readOperand(mem IMemory, address uint32, width uint) uint32 {
+	switch width {
+	case 8:
+		return uint32(mem.Read8(address))
+	case 16:
+		return uint32(mem.Read16(address))
+	}
+	return mem.Read32(address)
+}
+
+func writeOperand(mem IMemory, address uint32, width uint, value uint32) {
+	switch width {
+	case 8:
+		mem.Write8(address, uint8(value))
+	case 16:
+		mem.Write16(address, uint16(value))
+	default:
+		mem.Write32(address, value)
+	}
+}
+
+// immediate reads the immediate of size bytes at EIP, sign-extended, and skips it
+func (a *ALU) immediate(size uint) uint32 {
+	reg := a.reg
+	mem := a.mem
+	var value uint32
+	switch size {
+	case 1:
+		value = uint32(mem.GetSignCode8(0))
+	case 2:
+		value = uint32(mem.GetSignCode16(0))
+	default:
+		value = mem.GetCode32(0)
+	}
+	reg.EIP += uint32(size)
+	return value
+}
+
+// operate applies op to dst and src, stores the result unless op is CMP and sets the flags
+func (a *ALU) operate(op uint8, dst uint32, src uint32, width uint, store func(value uint32)) {
+	reg := a.reg
+	result, flags := alu(op, uint64(dst), uint64(src), width, reg.IsCF())
+	if op != aluCmp {
+		store(uint32(result))
+	}
+	reg.setEFlags(flags, arithFlagsMask)
+}
+
+// arith ADD, OR, ADC, SBB, AND, SUB, XOR and CMP (00-3D): r/m, r; r, r/m; and the
+// accumulator with an immediate
+func (a *ALU) arith(code uint8, width uint) func() {
+	op, form := code>>3, code&7
+	if form&1 == 0 {
+		width = 8
+	}
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		switch form {
+		case 0, 1:
+			modrm := NewModRM(reg, a.mem)
+			a.operate(op, getRM(&modrm, width), getR(&modrm, width), width, func(v uint32) { setRM(&modrm, width, v) })
+		case 2, 3:
+			modrm := NewModRM(reg, a.mem)
+			a.operate(op, getR(&modrm, width), getRM(&modrm, width), width, func(v uint32) { setR(&modrm, width, v) })
+		default:
+			src := a.immediate(width / 8)
+			a.operate(op, reg.accumulator(width), src, width, func(v uint32) { reg.setAccumulator(width, v) })
+		}
+	}
+}
+
+// group1 the ALU operations on r/m with an immediate (80-83): a byte for 80 and its alias
+// 82, sign-extended for 83
+func (a *ALU) group1(code uint8, width uint) func() {
+	size := width / 8
+	if code != 0x81 {
+		size = 1
+	}
+	if code == 0x80 || code == 0x82 {
+		width = 8
+	}
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		src := a.immediate(size)
+		a.operate(modrm.Opcode, getRM(&modrm, width), src, width, func(v uint32) { setRM(&modrm, width, v) })
+	}
+}
+
+// test TEST r/m, r (84, 85)
+func (a *ALU) test(width uint) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		result := getRM(&modrm, width) & getR(&modrm, width)
+		reg.setEFlags(resultFlags(uint64(result), width), arithFlagsMask)
+	}
+}
+
+// testAccumulator TEST AL/AX/EAX, imm (A8, A9)
+func (a *ALU) testAccumulator(width uint) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		result := reg.accumulator(width) & a.immediate(width/8)
+		reg.setEFlags(resultFlags(uint64(result), width), arithFlagsMask)
+	}
+}
+
+// lea LEA r, m (8D): the offset of the operand, truncated to the operand size
+func (a *ALU) lea(width uint) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		if modrm.Mod == 3 {
+			raise(ExceptionUD)
+		}
+		offset, _ := modrm.calcOffset()
+		setR(&modrm, width, offset)
+	}
+}
+
+// movExtend MOVZX and MOVSX r, r/m8 and r/m16 (0F B6, B7, BE, BF)
+func (a *ALU) movExtend(width uint, from uint, signed bool) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		value := getRM(&modrm, from)
+		if signed {
+			value = uint32(signExtend(uint64(value), from))
+		}
+		setR(&modrm, width, value)
+	}
+}
+
+// convert CBW and CWDE (98): sign-extends the lower half of eAX into it
+func (a *ALU) convert(width uint) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		reg.setAccumulator(width, uint32(signExtend(uint64(reg.accumulator(width/2)), width/2)))
+	}
+}
+
+// convertDouble CWD and CDQ (99): fills eDX with the sign of eAX
+func (a *ALU) convertDouble(width uint) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		reg.setRegister(2, width, uint32(signExtend(uint64(reg.accumulator(width)), width)>>63))
+	}
+}
+
+// sahf SAHF (9E) loads SF, ZF, AF, PF and CF from AH
+func (a *ALU) sahf() {
+	reg := a.reg
+	reg.EIP += 1
+	reg.setEFlags(reg.EAX>>8, FlagSF|FlagZF|FlagAF|FlagPF|FlagCF)
+}
+
+// lahf LAHF (9F) stores them in AH
+func (a *ALU) lahf() {
+	reg := a.reg
+	reg.EIP += 1
+	flags := reg.EFlags&(FlagSF|FlagZF|FlagAF|FlagPF|FlagCF) | 0x2
+	reg.Set8ByIndex(4, uint8(flags))
+}
+
+// group2 ROL, ROR, RCL, RCR, SHL, SHR, SAL and SAR r/m (C0, C1, D0-D3). The count is masked
+// to 5 bits; a zero count changes no flags.
+func (a *ALU) group2(width uint, source int) func() {
+	return func() {
+		reg := a.reg
+		mem := a.mem
+		reg.EIP += 1
+		modrm := NewModRM(reg, mem)
+		count := uint(1)
+		switch source {
+		case shiftCL:
+			count = uint(reg.Get8ByIndex(1))
+		case shiftImm:
+			count = uint(mem.GetCode8(0))
+			reg.EIP += 1
+		}
+		count &= 31
+		value := getRM(&modrm, width)
+		if count == 0 {
+			return
+		}
+		result, flags, mask := shift(modrm.Opcode, uint64(value), count, width, reg.IsCF())
+		setRM(&modrm, width, uint32(result))
+		reg.setEFlags(flags, mask)
+	}
+}
+
+// incDecRM INC and DEC r/m (FE, FF /0, /1): CF is left alone
+func incDecRM(reg *X86Registers, modrm *ModRM, width uint) {
+	op := uint8(aluAdd)
+	if modrm.Opcode == 1 {
+		op = aluSub
+	}
+	result, flags := alu(op, uint64(getRM(modrm, width)), 1, width, false)
+	setRM(modrm, width, uint32(result))
+	reg.setEFlags(flags, arithFlagsMask&^FlagCF)
+}
+
+// group4 INC and DEC r/m8 (FE /0, /1)
+func (a *ALU) group4() {
+	reg := a.reg
+	reg.EIP += 1
+	modrm := NewModRM(reg, a.mem)
+	if modrm.Opcode > 1 {
+		raise(ExceptionUD)
+	}
+	incDecRM(reg, &modrm, 8)
+}
+
+// imul IMUL r, r/m (0F AF)
+func (a *ALU) imul(width uint) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		high, low := multiplyWide(uint64(getR(&modrm, width)), uint64(getRM(&modrm, width)), width, true)
+		setR(&modrm, width, uint32(low))
+		a.multiplyFlags(high, low, width, true)
+	}
+}
+
+// imulImm IMUL r, r/m, imm (69, and 6B with a sign-extended byte)
+func (a *ALU) imulImm(width uint, size uint) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		src := a.immediate(size)
+		high, low := multiplyWide(uint64(getRM(&modrm, width)), uint64(src), width, true)
+		setR(&modrm, width, uint32(low))
+		a.multiplyFlags(high, low, width, true)
+	}
+}
+
+// multiplyFlags CF and OF tell whether the upper half of the product is significant
+func (a *ALU) multiplyFlags(high uint64, low uint64, width uint, signed bool) {
+	significant := high != 0
+	if signed {
+		significant = high != uint64(signExtend(low, width)>>63)&laneMask(width)
+	}
+	var flags uint32
+	if significant {
+		flags = FlagCF | FlagOF
+	}
+	a.reg.setEFlags(flags|resultFlags(low, width), arithFlagsMask)
+}
+
+// cmov CMOVcc r, r/m (0F 40-4F): the source is read even when the condition is false
+func (a *ALU) cmov(width uint) func() {
+	return func() {
+		reg := a.reg
+		cc := a.mem.GetCode8(0) & 0xf
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		value := getRM(&modrm, width)
+		if reg.condition(cc) {
+			setR(&modrm, width, value)
+		}
+	}
+}
+
+// setcc SETcc r/m8 (0F 90-9F)
+func (a *ALU) setcc() {
+	reg := a.reg
+	cc := a.mem.GetCode8(0) & 0xf
+	reg.EIP += 1
+	modrm := NewModRM(reg, a.mem)
+	modrm.SetRM8(uint8(b2u(reg.condition(cc))))
+}
+
+// bswap BSWAP r (0F C8-CF); a 16-bit operand gives an undefined result, zero here
+func (a *ALU) bswap(width uint) func() {
+	return func() {
+		reg := a.reg
+		index := a.mem.GetCode8(0) & 7
+		reg.EIP += 1
+		if width == 16 {
+			reg.Set16ByIndex(index, 0)
+			return
+		}
+		reg.SetByIndex(index, bits.ReverseBytes32(reg.GetByIndex(index)))
+	}
+}
+
+// hintNop the multi-byte NOP and the prefetch hints without an effect here (0F 0D, 0F 19-1F)
+func (a *ALU) hintNop() {
+	reg := a.reg
+	reg.EIP += 1
+	NewModRM(reg, a.mem)
+}
+
+// xlat XLAT (D7): AL = [eBX + AL] in the data segment
+func (a *ALU) xlat() {
+	reg := a.reg
+	reg.EIP += 1
+	offset := (reg.EBX + reg.EAX&0xff) & reg.addressMask()
+	address := reg.segmentAddress(reg.dataSegment(SegDS), offset, 1, false)
+	reg.Set8ByIndex(0, a.mem.Read8(address))
+}
+
+// str MOVS, CMPS, STOS, LODS and SCAS (A4-A7, AA-AF) with REP, REPE and REPNE. eSI is in
+// the data segment, which the segment prefixes override, eDI in ES; the address size selects
+// SI, DI and CX or ESI, EDI and ECX. A repeated string runs to completion in one step.
+func (a *ALU) str(op int, width uint) func() {
+	return func() {
+		reg := a.reg
+		mem := a.mem
+		reg.EIP += 1
+		size := uint32(width / 8)
+		mask := reg.addressMask()
+		step := size
+		if reg.IsDF() {
+			step = -size
+		}
+		compare := op == stringCmps || op == stringScas
+		for {
+			if reg.repPrefix != 0 && reg.ECX&mask == 0 {
+				return
+			}
+			src := func() uint32 {
+				address := reg.segmentAddress(reg.dataSegment(SegDS), reg.ESI&mask, size, false)
+				return readOperand(mem, address, width)
+			}
+			dst := func(write bool) uint32 {
+				return reg.segmentAddress(SegES, reg.EDI&mask, size, write)
+			}
+			switch op {
+			case stringMovs:
+				writeOperand(mem, dst(true), width, src())
+			case stringCmps:
+				value := src()
+				_, flags := alu(aluCmp, uint64(value), uint64(readOperand(mem, dst(false), width)), width, false)
+				reg.setEFlags(flags, arithFlagsMask)
+			case stringStos:
+				writeOperand(mem, dst(true), width, reg.accumulator(width))
+			case stringLods:
+				reg.setAccumulator(width, src())
+			case stringScas:
+				_, flags := alu(aluCmp, uint64(reg.accumulator(width)), uint64(readOperand(mem, dst(false), width)), width, false)
+				reg.setEFlags(flags, arithFlagsMask)
+			}
+			if op == stringMovs || op == stringCmps || op == stringLods {
+				reg.ESI = reg.ESI&^mask | (reg.ESI+step)&mask
+			}
+			if op != stringLods {
+				reg.EDI = reg.EDI&^mask | (reg.EDI+step)&mask
+			}
+			if reg.repPrefix == 0 {
+				return
+			}
+			reg.ECX = reg.ECX&^mask | (reg.ECX-1)&mask
+			if compare && (reg.repPrefix == 0xf3) != reg.IsZF() {
+				return
+			}
+		}
+	}
+}
+
+// decimalAdjust DAA (27) and DAS (2F) adjust AL after an addition or subtraction of packed
+// BCD digits
+func (a *ALU) decimalAdjust(sub bool) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		al := reg.Get8ByIndex(0)
+		old, cf := al, reg.IsCF()
+		var flags uint32
+		if al&0xf > 9 || reg.IsAF() {
+			if sub {
+				flags |= carryFlag(cf || al < 6)
+				al -= 6
+			} else {
+				al += 6
+			}
+			flags |= FlagAF
+		}
+		if old > 0x99 || cf {
+			if sub {
+				al -= 0x60
+			} else {
+				al += 0x60
+			}
+			flags |= FlagCF
+		}
+		reg.Set8ByIndex(0, al)
+		reg.setEFlags(flags|resultFlags(uint64(al), 8), arithFlagsMask&^FlagOF)
+	}
+}
+
+// asciiAdjust AAA (37) and AAS (3F) adjust AX after an addition or subtraction of unpacked
+// BCD digits
+func (a *ALU) asciiAdjust(sub bool) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		ax := reg.Get16ByIndex(0)
+		var flags uint32
+		if ax&0xf > 9 || reg.IsAF() {
+			if sub {
+				ax -= 0x106
+			} else {
+				ax += 0x106
+			}
+			flags = FlagAF | FlagCF
+		}
+		reg.Set16ByIndex(0, ax&0xff0f)
+		reg.setEFlags(flags, FlagAF|FlagCF)
+	}
+}
+
+// aam AAM imm8 (D4) splits AL into the digits AH and AL of base imm8
+func (a *ALU) aam() {
+	reg := a.reg
+	base := a.mem.GetCode8(1)
+	if base == 0 {
+		raise(ExceptionDE)
+	}
+	reg.EIP += 2
+	al := reg.Get8ByIndex(0)
+	reg.Set16ByIndex(0, uint16(al/base)<<8|uint16(al%base))
+	reg.setEFlags(resultFlags(uint64(al%base), 8), FlagSF|FlagZF|FlagPF)
+}
+
+// aad AAD imm8 (D5) joins the digits AH and AL of base imm8 into AL
+func (a *ALU) aad() {
+	reg := a.reg
+	base := a.mem.GetCode8(1)
+	reg.EIP += 2
+	al := reg.Get8ByIndex(0) + reg.Get8ByIndex(4)*base
+	reg.Set16ByIndex(0, uint16(al))
+	reg.setEFlags(resultFlags(uint64(al), 8), FlagSF|FlagZF|FlagPF)
+}
+
+// incDecR INC and DEC r (40-4F): CF is left alone
+func (a *ALU) incDecR(width uint) func() {
+	return func() {
+		reg := a.reg
+		code := a.mem.GetCode8(0)
+		reg.EIP += 1
+		op := uint8(aluAdd)
+		if code&8 != 0 {
+			op = aluSub
+		}
+		result, flags := alu(op, uint64(reg.register(code&7, width)), 1, width, false)
+		reg.setRegister(code&7, width, uint32(result))
+		reg.setEFlags(flags, arithFlagsMask&^FlagCF)
+	}
+}
+
+// group3 TEST r/m, imm, NOT, NEG, MUL, IMUL, DIV and IDIV (F6, F7)
+func (a *ALU) group3(width uint) func() {
+	return func() {
+		reg := a.reg
+		reg.EIP += 1
+		modrm := NewModRM(reg, a.mem)
+		switch modrm.Opcode {
+		case 0, 1:
+			result := getRM(&modrm, width) & a.immediate(width/8)
+			reg.setEFlags(resultFlags(uint64(result), width), arithFlagsMask)
+		case 2:
+			setRM(&modrm, width, ^getRM(&modrm, width))
+		case 3:
+			result, flags := alu(aluSub, 0, uint64(getRM(&modrm, width)), width, false)
+			setRM(&modrm, width, uint32(result))
+			reg.setEFlags(flags, arithFlagsMask)
+		case 4, 5:
+			signed := modrm.Opcode == 5
+			_, acc := a.accumulatorPair(width)
+			high, low := multiplyWide(acc, uint64(getRM(&modrm, width)), width, signed)
+			a.setAccumulatorPair(width, high, low)
+			a.multiplyFlags(high, low, width, signed)
+		default:
+			a.divide(getRM(&modrm, width), width, modrm.Opcode == 7)
+		}
+	}
+}
+
+// accumulatorPair reads eDX:eAX, or AH:AL for byte operands
+func (a *ALU) accumulatorPair(width uint) (uint64, uint64) {
+	reg := a.reg
+	if width == 8 {
+		ax := uint64(reg.Get16ByIndex(0))
+		return ax >> 8, ax & 0xff
+	}
+	return uint64(reg.register(2, width)), uint64(reg.accumulator(width))
+}
+
+func (a *ALU) setAccumulatorPair(width uint, high uint64, low uint64) {
+	reg := a.reg
+	if width == 8 {
+		reg.Set16ByIndex(0, uint16(high<<8|low&0xff))
+		return
+	}
+	reg.setAccumulator(width, uint32(low))
+	reg.setRegister(2, width, uint32(high))
+}
+
+// divide DIV and IDIV r/m: eAX = eDX:eAX / src and eDX the remainder, AL and AH for byte
+// operands. #DE for a zero divisor or a quotient out of range.
+func (a *ALU) divide(src uint32, width uint, signed bool) {
+	high, low := a.accumulatorPair(width)
+	mask := laneMask(width)
+	divisor := uint64(src) & mask
+	if divisor == 0 {
+		raise(ExceptionDE)
+	}
+	dividend := high<<width | low
+	var quotient, remainder uint64
+	if signed {
+		n, d := signExtend(dividend, 2*width), signExtend(divisor, width)
+		q, r := n/d, n%d
+		if q != signExtend(uint64(q), width) {
+			raise(ExceptionDE)
+		}
+		quotient, remainder = uint64(q)&mask, uint64(r)&mask
+	} else {
+		quotient, remainder = dividend/divisor, dividend%divisor
+		if quotient > mask {
+			raise(ExceptionDE)
+		}
+	}
+	a.setAccumulatorPair(width, remainder, quotient)
+}
@@ -0,0 +1,10 @@
+package core
+
+import "testing"
+
+func TestInteger32(t *testing.T) {
+	status := runProgram(t, 32, "integer32.elf", WithLinux(t.TempDir(), []string{"integer32"}, nil))
+	if status != 0 {
+		t.Errorf("check %d of testdata/integer32.s failed", status)
+	}
+}
@@ -0,0 +1,378 @@
+package core
+
+// Interrupt INT n, INT3, INTO, INT1, IRET and the delivery of interrupts and exceptions
+type Interrupt struct {
+	reg *X86Registers
+	mem IMemory
+}
+
+func NewInterrupt(reg *X86Registers, mem IMemory) *Interrupt {
+	return &Interrupt{
+		reg: reg,
+		mem: mem,
+	}
+}
+
+// Int3 INT3 (CC): breakpoint trap, EIP points after the instruction
+func (intr *Interrupt) Int3() {
+	reg := intr.reg
+	reg.EIP += 1
+	intr.Deliver(&Exception{Vector: ExceptionBP}, true)
+}
+
+// IntImm8 INT imm8 (CD). In virtual-8086 mode it traps to the monitor with #GP(0) when IOPL
+// is below 3, unless VME redirects the vector to the IVT of the task.
+func (intr *Interrupt) IntImm8() {
+	reg := intr.reg
+	mem := intr.mem
+	vector := mem.GetCode8(1)
+	reg.EIP += 2
+	if reg.IsV86() {
+		if reg.CR4&CR4VME != 0 && interruptRedirected(reg, mem, vector) {
+			intr.deliverV86(vector)
+			return
+		}
+		if reg.IOPL() < 3 {
+			raiseWithCode(ExceptionGP, 0)
+		}
+	}
+	intr.Deliver(&Exception{Vector: vector}, true)
+}
+
+// Into INTO (CE): overflow trap when OF is set
+func (intr *Interrupt) Into() {
+	reg := intr.reg
+	reg.EIP += 1
+	if reg.IsOF() {
+		intr.Deliver(&Exception{Vector: ExceptionOF}, true)
+	}
+}
+
+// Int1 INT1/ICEBP (F1): debug trap delivered like a hardware event, without the gate DPL check
+func (intr *Interrupt) Int1() {
+	reg := intr.reg
+	reg.EIP += 1
+	intr.Deliver(&Exception{Vector: ExceptionDB}, false)
+}
+
+// Deliver transfers control to the handler of e.Vector through the IVT in real mode or the
+// IDT in protected mode and long mode. software is set for INT n, INT3 and INTO: the gate
+// DPL is checked against CPL and the EXT bit is clear in the error codes. A program run in
+// user mode hands them to its personality instead.
+func (intr *Interrupt) Deliver(e *Exception, software bool) {
+	reg := intr.reg
+	if reg.personality != nil && reg.personality.interrupt(e, software) {
+		return
+	}
+	if reg.IA32Efer&EFERLMA != 0 {
+		intr.deliverLong(e, software)
+		return
+	}
+	if reg.IsRealMode() {
+		intr.deliverReal(e.Vector)
+		return
+	}
+	intr.deliverProtected(e, software)
+}
+
+func (intr *Interrupt) deliverReal(vector uint8) {
+	reg := intr.reg
+	mem := intr.mem
+	offset := uint32(vector) * 4
+	if offset+3 > uint32(reg.IDTR.Limit) {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	ip := mem.Read16(reg.IDTR.Base + offset)
+	cs := mem.Read16(reg.IDTR.Base + offset + 2)
+	mem.Push16(uint16(reg.EFlags))
+	mem.Push16(reg.CS)
+	mem.Push16(uint16(reg.EIP))
+	reg.EFlags &^= FlagIF | FlagTF | FlagAC
+	reg.loadRealModeSegment(SegCS, cs)
+	reg.EIP = uint32(ip)
+}
+
+// deliverV86 INT n redirected by VME through the real-mode IVT at linear address 0. Below
+// IOPL 3 the pushed FLAGS show VIF as IF and IOPL 3, and VIF is cleared instead of IF.
+func (intr *Interrupt) deliverV86(vector uint8) {
+	reg := intr.reg
+	mem := intr.mem
+	offset := uint32(vector) * 4
+	ip := mem.Read16(offset)
+	cs := mem.Read16(offset + 2)
+	flags := reg.EFlags
+	virtual := reg.IOPL() < 3
+	if virtual {
+		flags = flags&^FlagIF | (flags&FlagVIF)>>10 | FlagIOPL
+	}
+	mem.Push16(uint16(flags))
+	mem.Push16(reg.CS)
+	mem.Push16(uint16(reg.EIP))
+	if virtual {
+		reg.EFlags &^= FlagVIF | FlagTF
+	} else {
+		reg.EFlags &^= FlagIF | FlagTF
+	}
+	reg.loadRealModeSegment(SegCS, cs)
+	reg.EIP = uint32(ip)
+}
+
+func (intr *Interrupt) deliverProtected(e *Exception, software bool) {
+	reg := intr.reg
+	mem := intr.mem
+	var ext uint32
+	if !software {
+		ext = 1
+	}
+	// error code referring to the IDT entry: index, IDT bit, EXT bit
+	idtCode := uint32(e.Vector)<<3 | 2 | ext
+	offset := uint32(e.Vector) * 8
+	if offset+7 > uint32(reg.IDTR.Limit) {
+		raiseWithCode(ExceptionGP, idtCode)
+	}
+	gate := readGate(mem, reg.IDTR.Base+offset)
+	switch gate.Type() {
+	case descIntGate16, descTrapGate16, descIntGate32, descTrapGate32, descTaskGate:
+	default:
+		raiseWithCode(ExceptionGP, idtCode)
+	}
+	cpl := reg.CPL()
+	if software && gate.DPL() < cpl {
+		raiseWithCode(ExceptionGP, idtCode)
+	}
+	if !gate.IsPresent() {
+		raiseWithCode(ExceptionNP, idtCode)
+	}
+	if gate.Type() == descTaskGate {
+		address, desc := taskDescriptor(reg, mem, gate.Selector, ExceptionTS)
+		switchTask(reg, mem, gate.Selector, address, desc, taskCall)
+		if e.HasErrorCode {
+			intr.push(reg.TRCache.is32TSS(), e.ErrorCode)
+		}
+		return
+	}
+
+	selector := gate.Selector
+	selectorCode := uint32(selector&^3) | ext
+	if selector&^3 == 0 {
+		raiseWithCode(ExceptionGP, ext)
+	}
+	address := descriptorAddress(reg, selector)
+	desc := readDescriptor(mem, address)
+	if !desc.IsCode() || desc.DPL() > cpl {
+		raiseWithCode(ExceptionGP, selectorCode)
+	}
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionNP, selectorCode)
+	}
+	newCPL := cpl
+	if !desc.IsConforming() {
+		newCPL = desc.DPL()
+	}
+	v86 := reg.IsVM()
+	// a virtual-8086 task is only left for a ring 0 handler through a 32-bit gate
+	if v86 && (newCPL != 0 || !gate.Is32()) {
+		raiseWithCode(ExceptionGP, selectorCode)
+	}
+	eip := gate.Offset
+	if !gate.Is32() {
+		eip &= 0xffff
+	}
+	if eip > desc.Limit {
+		raiseWithCode(ExceptionGP, ext)
+	}
+
+	flags := reg.EFlags
+	cs := reg.CS
+	if newCPL < cpl {
+		// inner privilege level: the handler runs on the stack saved in the TSS for its level,
+		// the frame is written at its privilege
+		defer mem.Implicit()()
+		ss, esp := tssStack(reg, mem, newCPL)
+		ssAddress, ssDesc := checkStackSegment(reg, mem, ss, newCPL, ExceptionTS)
+		oldSS, oldESP := reg.SS, reg.ESP
+		reg.EFlags &^= FlagVM
+		setStackSegment(reg, mem, ss, ssAddress, ssDesc)
+		reg.ESP = esp
+		if v86 {
+			// the data segments of the task are saved in the frame, then nulled
+			for _, index := range []uint8{SegGS, SegFS, SegDS, SegES} {
+				intr.push(true, uint32(reg.GetSegment(index)))
+			}
+		}
+		intr.push(gate.Is32(), uint32(oldSS))
+		intr.push(gate.Is32(), oldESP)
+	}
+	intr.push(gate.Is32(), flags)
+	intr.push(gate.Is32(), uint32(cs))
+	intr.push(gate.Is32(), reg.EIP)
+	if e.HasErrorCode {
+		intr.push(gate.Is32(), e.ErrorCode)
+	}
+	if v86 {
+		for _, index := range []uint8{SegES, SegDS, SegFS, SegGS} {
+			*reg.selectorIndex(index) = 0
+			reg.Segments[index] = SegmentCache{}
+		}
+	}
+	setCodeSegment(reg, mem, selector, address, desc, newCPL)
+	reg.EIP = eip
+	reg.EFlags &^= FlagTF | FlagNT | FlagRF | FlagVM
+	if gate.Type() == descIntGate16 || gate.Type() == descIntGate32 {
+		reg.EFlags &^= FlagIF
+	}
+}
+
+// push pushes a 32-bit or a 16-bit slot of the interrupt frame
+func (intr *Interrupt) push(is32 bool, value uint32) {
+	mem := intr.mem
+	if is32 {
+		mem.Push32(value)
+	} else {
+		mem.Push16(uint16(value))
+	}
+}
+
+// Iret16 IRET (CF) with a 16-bit frame
+func (intr *Interrupt) Iret16() {
+	intr.iret(2)
+}
+
+// Iret32 IRETD (CF) with a 32-bit frame
+func (intr *Interrupt) Iret32() {
+	intr.iret(4)
+}
+
+func (intr *Interrupt) iret(size uint32) {
+	reg := intr.reg
+	mem := intr.mem
+	if reg.IsV86() {
+		intr.iretV86(size)
+		return
+	}
+	if !reg.IsRealMode() && reg.IsNT() {
+		// return from a nested task to the task in the back link of the current TSS
+		link := taskLink(reg, mem)
+		address, desc := taskDescriptor(reg, mem, link, ExceptionTS)
+		reg.EIP += 1
+		switchTask(reg, mem, link, address, desc, taskIret)
+		return
+	}
+	eip := readStack(reg, mem, 0, size)
+	selector := uint16(readStack(reg, mem, size, size))
+	flags := readStack(reg, mem, 2*size, size)
+	mask := uint32(flagsMask &^ (FlagVM | FlagVIF | FlagVIP))
+	if size == 2 {
+		mask &= 0xffff
+	}
+
+	if reg.IsRealMode() {
+		reg.SetStackPointer(reg.StackPointer() + 3*size)
+		reg.loadRealModeSegment(SegCS, selector)
+		reg.EIP = eip
+		reg.setEFlags(flags, mask)
+		return
+	}
+
+	cpl := reg.CPL()
+	if cpl == 0 && size == 4 && flags&FlagVM != 0 {
+		intr.returnToV86(eip, selector, flags)
+		return
+	}
+	rpl := uint8(selector & 3)
+	errorCode := uint32(selector &^ 3)
+	if selector&^3 == 0 || rpl < cpl {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	address := descriptorAddress(reg, selector)
+	desc := readDescriptor(mem, address)
+	if !desc.IsCode() {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	if desc.IsConforming() && desc.DPL() > rpl || !desc.IsConforming() && desc.DPL() != rpl {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionNP, errorCode)
+	}
+	if eip > desc.Limit {
+		raiseWithCode(ExceptionGP, 0)
+	}
+
+	// IOPL is only restored at CPL 0 and IF when CPL <= IOPL, both judged at the old CPL
+	if cpl > 0 {
+		mask &^= FlagIOPL
+	}
+	if cpl > reg.IOPL() {
+		mask &^= FlagIF
+	}
+	if rpl == cpl {
+		reg.SetStackPointer(reg.StackPointer() + 3*size)
+		setCodeSegment(reg, mem, selector, address, desc, rpl)
+		reg.EIP = eip
+		reg.setEFlags(flags, mask)
+		return
+	}
+
+	// return to an outer privilege level: the frame also holds the outer SS:ESP
+	esp := readStack(reg, mem, 3*size, size)
+	ss := uint16(readStack(reg, mem, 4*size, size))
+	ssAddress, ssDesc := checkStackSegment(reg, mem, ss, rpl, ExceptionGP)
+	setCodeSegment(reg, mem, selector, address, desc, rpl)
+	reg.EIP = eip
+	reg.setEFlags(flags, mask)
+	setStackSegment(reg, mem, ss, ssAddress, ssDesc)
+	reg.SetStackPointer(esp)
+	clearOuterSegments(reg)
+}
+
+// returnToV86 IRETD at CPL 0 with VM set in the popped EFLAGS resumes a virtual-8086 task.
+// Below EIP, CS and EFLAGS the frame holds ESP, SS, ES, DS, FS and GS.
+func (intr *Interrupt) returnToV86(eip uint32, selector uint16, flags uint32) {
+	reg := intr.reg
+	mem := intr.mem
+	esp := readStack(reg, mem, 12, 4)
+	var selectors [6]uint16
+	for i, index := range []uint8{SegSS, SegES, SegDS, SegFS, SegGS} {
+		selectors[index] = uint16(readStack(reg, mem, 16+uint32(i)*4, 4))
+	}
+	selectors[SegCS] = selector
+	reg.setEFlags(flags, flagsMask)
+	for index := SegES; index <= SegGS; index++ {
+		reg.loadV86Segment(index, selectors[index])
+	}
+	reg.ESP = esp
+	reg.EIP = eip & 0xffff
+}
+
+// iretV86 IRET inside a virtual-8086 task. At IOPL 3 it pops a real-mode frame leaving IOPL
+// alone; below, VME lets a 16-bit IRET set VIF from the popped IF. Anything else traps to the
+// monitor with #GP(0).
+func (intr *Interrupt) iretV86(size uint32) {
+	reg := intr.reg
+	mem := intr.mem
+	eip := readStack(reg, mem, 0, size)
+	selector := uint16(readStack(reg, mem, size, size))
+	flags := readStack(reg, mem, 2*size, size)
+	mask := uint32(flagsMask &^ (FlagVM | FlagVIF | FlagVIP | FlagIOPL))
+	if size == 2 {
+		mask &= 0xffff
+	}
+	if eip > 0xffff {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	if reg.IOPL() < 3 {
+		if reg.CR4&CR4VME == 0 || size != 2 {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		if flags&FlagTF != 0 || flags&FlagIF != 0 && reg.IsVIP() {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		mask &^= FlagIF
+		reg.EFlags = reg.EFlags&^FlagVIF | (flags&FlagIF)<<10
+	}
+	reg.SetStackPointer(reg.StackPointer() + 3*size)
+	reg.loadRealModeSegment(SegCS, selector)
+	reg.EIP = eip
+	reg.setEFlags(flags, mask)
+}
@@ -22,38 +22,115 @@ func NewIO(reg *X86Registers, memory IMemory) *IO {
 func (i *IO) InALDX() {
 	reg := i.reg
 	address := uint16(reg.EDX & 0xffff)
-	value := ioIn8(address)
-	AH := reg.EAX & 0xff00
-	reg.EAX = AH + uint32(value)
+	i.access(address, 1)
+	value := i.ioIn8(address)
+	reg.Set8ByIndex(0, value)
 	reg.EIP += 1
 }
 
 func (i *IO) InEAXDX() {
 	reg := i.reg
 	address := uint16(reg.EDX & 0xffff)
-	value := ioIn32(address)
+	i.access(address, 4)
+	value := i.ioIn32(address)
 	reg.EAX = value
 	reg.EIP += 1
 }
 
+func (i *IO) InALImm8() {
+	reg := i.reg
+	mem := i.mem
+	address := uint16(mem.GetCode8(1))
+	i.access(address, 1)
+	value := i.ioIn8(address)
+	reg.Set8ByIndex(0, value)
+	reg.EIP += 2
+}
+
+func (i *IO) OutImm8AL() {
+	reg := i.reg
+	mem := i.mem
+	address := uint16(mem.GetCode8(1))
+	i.access(address, 1)
+	i.ioOut8(address, reg.Get8ByIndex(0))
+	reg.EIP += 2
+}
+
 func (i *IO) OutDXAL() {
 	reg := i.reg
 	address := uint16(reg.EDX & 0xffff)
+	i.access(address, 1)
 	AL := uint8(reg.EAX & 0xff)
-	ioOut8(address, AL)
+	i.ioOut8(address, AL)
 	reg.EIP += 1
 }
 
 func (i *IO) OutDXEAX() {
 	reg := i.reg
 	address := uint16(reg.EDX & 0xffff)
-	ioOut32(address, reg.EAX)
+	i.access(address, 4)
+	i.ioOut32(address, reg.EAX)
+	reg.EIP += 1
+}
+
+// in IN AX and EAX, imm8 or DX (E5, ED)
+func (i *IO) in(width uint, immediate bool) func() {
+	return func() {
+		reg := i.reg
+		port := i.port(immediate)
+		i.access(port, uint16(width/8))
+		reg.setAccumulator(width, i.ioIn32(port))
+	}
+}
+
+// out OUT imm8 or DX, AX and EAX (E7, EF)
+func (i *IO) out(width uint, immediate bool) func() {
+	return func() {
+		reg := i.reg
+		port := i.port(immediate)
+		i.access(port, uint16(width/8))
+		i.ioOut32(port, reg.accumulator(width))
+	}
+}
+
+// port reads the port of IN or OUT, imm8 or DX, and skips the instruction
+func (i *IO) port(immediate bool) uint16 {
+	reg := i.reg
+	if immediate {
+		port := uint16(i.mem.GetCode8(1))
+		reg.EIP += 2
+		return port
+	}
 	reg.EIP += 1
+	return uint16(reg.EDX)
 }
 
-func ioIn8(address uint16) uint8 {
+// access checks an I/O access of size bytes at port and records the I/O breakpoints it hits
+func (i *IO) access(port uint16, size uint16) {
+	i.checkPermission(port, size)
+	i.reg.watchIO(port, size)
+}
+
+// checkPermission I/O in protected mode needs CPL <= IOPL or clear bits in the TSS I/O permission
+// bitmap. Virtual-8086 tasks are always checked against the bitmap.
+func (i *IO) checkPermission(port uint16, size uint16) {
+	reg := i.reg
+	mem := i.mem
+	if reg.IsRealMode() || !reg.IsVM() && reg.CPL() <= reg.IOPL() {
+		return
+	}
+	if !ioPermitted(reg, mem, port, size) {
+		raiseWithCode(ExceptionGP, 0)
+	}
+}
+
+func (i *IO) ioIn8(address uint16) uint8 {
 	fmt.Println("ioIn8 input ...")
 	switch address {
+	case 0x0092: // System Control Port A: bit 1 is the fast A20 gate
+		if i.mem.IsA20() {
+			return 0x02
+		}
 	case 0x03c7: // Palette Address(Read Mode) on VGA
 		break
 	case 0x03c9: // Palette Data on VGA
@@ -64,12 +141,11 @@ func ioIn8(address uint16) uint8 {
 		var input []byte = make([]byte, 1)
 		os.Stdin.Read(input)
 		return uint8(input[0])
-		break
 	}
 	return 0
 }
 
-func ioIn32(address uint16) uint32 {
+func (i *IO) ioIn32(address uint16) uint32 {
 	fmt.Println("ioIn32 input ...")
 	switch address {
 	case 0x03c7: // Palette Address(Read Mode) on VGA
@@ -81,17 +157,18 @@ func ioIn32(address uint16) uint32 {
 	case 0x03f8: // COM1
 		var input = make([]byte, 4)
 		os.Stdin.Read(input)
-		var i uint32
+		var value uint32
 		buf := bytes.NewReader(input)
-		binary.Read(buf, binary.LittleEndian, &i)
-		return i
-		break
+		binary.Read(buf, binary.LittleEndian, &value)
+		return value
 	}
 	return 0
 }
 
-func ioOut8(address uint16, ascii uint8) {
+func (i *IO) ioOut8(address uint16, ascii uint8) {
 	switch address {
+	case 0x0092: // System Control Port A: bit 1 is the fast A20 gate
+		i.mem.SetA20(ascii&0x02 != 0)
 	case 0x03c2: // Miscellaneous Output Register on VGA
 		break
 	case 0x03c8: // Palette Address(Write Mode) on VGA
@@ -99,12 +176,12 @@ func ioOut8(address uint16, ascii uint8) {
 	case 0x03c9: // Palette Data on VGA
 		break
 	case 0x03f8: // COM1
-		fmt.Println(string(ascii))
+		fmt.Println(string(rune(ascii)))
 		break
 	}
 }
 
-func ioOut32(address uint16, ascii uint32) {
+func (i *IO) ioOut32(address uint16, ascii uint32) {
 	switch address {
 	case 0x03c2: // Miscellaneous Output Register on VGA
 		break
@@ -113,7 +190,7 @@ func ioOut32(address uint16, ascii uint32) {
 	case 0x03c9: // Palette Data on VGA
 		break
 	case 0x03f8: // COM1
-		fmt.Println(string(ascii))
+		fmt.Println(string(rune(ascii)))
 		break
 	}
 }
@@ -0,0 +1,833 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Linux user-mode emulation, as qemu-user does: a static program runs at CPL 3 on its own
+// address space and its system calls are served here by the host. Files resolve inside a
+// host directory taken as the root of the guest. Exceptions the program cannot recover from
+// kill it with the signal Linux would send.
+
+const (
+	linuxStackSize = 0x800000
+	// linuxGDT the page holding the GDT, a kernel page out of reach of the program
+	linuxGDT = 0xfffff000
+)
+
+// linuxABI the layout and the system calls of i386 or x86-64 processes
+type linuxABI struct {
+	stackTop uint64
+	mmapBase uint64
+	// word the size of a long
+	word uint64
+	// machine the uname machine and the AT_PLATFORM string
+	machine string
+	calls   map[uint64]func(*linux, [6]uint64) int64
+	// descriptors of the GDT by entry, and the selectors of the program
+	gdt  map[uint32]uint64
+	code uint16
+	data uint16
+}
+
+var linux32 = &linuxABI{
+	stackTop: 0xc0000000,
+	mmapBase: 0x40000000,
+	word:     4,
+	machine:  "i686",
+	calls:    linux32Calls,
+	gdt:      map[uint32]uint64{14: 0x00cffb000000ffff, 15: 0x00cff3000000ffff},
+	code:     14<<3 | 3,
+	data:     15<<3 | 3,
+}
+
+// Entries of the Linux GDT
+const (
+	linuxTLSEntry  = 6 // first of the three set_thread_area entries of i386
+	linuxTLSCount  = 3
+	linuxGDTLength = 32 * 8
+)
+
+// Linux error numbers
+const (
+	linuxEPERM   = 1
+	linuxENOENT  = 2
+	linuxEIO     = 5
+	linuxEBADF   = 9
+	linuxENOMEM  = 12
+	linuxEACCES  = 13
+	linuxEFAULT  = 14
+	linuxEEXIST  = 17
+	linuxENOTDIR = 20
+	linuxEISDIR  = 21
+	linuxEINVAL  = 22
+	linuxEMFILE  = 24
+	linuxENOTTY  = 25
+	linuxENOSYS  = 38
+)
+
+// Flags of open and mmap, and the ioctl requests
+const (
+	linuxOWronly    = 0x1
+	linuxORdwr      = 0x2
+	linuxOCreat     = 0x40
+	linuxOExcl      = 0x80
+	linuxOTrunc     = 0x200
+	linuxOAppend    = 0x400
+	linuxMapFixed   = 0x10
+	linuxMapAnon    = 0x20
+	linuxTCGETS     = 0x5401
+	linuxMaxFiles   = 1024
+	linuxMaxIO      = 1 << 20
+	linuxPageSize   = 0x1000
+	linuxClockTicks = 100
+)
+
+// Auxiliary vector entries of the initial stack
+const (
+	linuxAtNull     = 0
+	linuxAtPhdr     = 3
+	linuxAtPhent    = 4
+	linuxAtPhnum    = 5
+	linuxAtPagesz   = 6
+	linuxAtEntry    = 9
+	linuxAtUID      = 11
+	linuxAtEUID     = 12
+	linuxAtGID      = 13
+	linuxAtEGID     = 14
+	linuxAtPlatform = 15
+	linuxAtHwcap    = 16
+	linuxAtClktck   = 17
+	linuxAtSecure   = 23
+	linuxAtRandom   = 25
+)
+
+type linuxSignal struct {
+	name   string
+	number int
+}
+
+// linuxSignals the signal an exception kills the program with, SIGSEGV otherwise
+var linuxSignals = map[uint8]linuxSignal{
+	ExceptionDE: {"SIGFPE", 8},
+	ExceptionMF: {"SIGFPE", 8},
+	ExceptionXM: {"SIGFPE", 8},
+	ExceptionDB: {"SIGTRAP", 5},
+	ExceptionBP: {"SIGTRAP", 5},
+	ExceptionUD: {"SIGILL", 4},
+	ExceptionAC: {"SIGBUS", 7},
+}
+
+// linux32Calls the i386 system calls by number
+var linux32Calls = map[uint64]func(*linux, [6]uint64) int64{
+	1:   (*linux).exit,
+	3:   (*linux).read,
+	4:   (*linux).write,
+	5:   (*linux).open,
+	6:   (*linux).close,
+	45:  (*linux).brk,
+	54:  (*linux).ioctl,
+	78:  (*linux).gettimeofday,
+	90:  (*linux).oldMmap,
+	91:  (*linux).munmap,
+	122: (*linux).uname,
+	125: (*linux).mprotect,
+	146: (*linux).writev,
+	192: (*linux).mmap2,
+	243: (*linux).setThreadArea,
+	252: (*linux).exit,
+}
+
+// linux a static Linux program run in user mode
+type linux struct {
+	reg   *X86Registers
+	mem   *Memory
+	space *addressSpace
+	root  string
+	args  []string
+	env   []string
+	files []*os.File
+	abi   *linuxABI
+	// physical address of the GDT
+	gdt uint64
+	// program break: the heap spans brkStart..brkEnd
+	brkStart uint64
+	brkEnd   uint64
+	started  time.Time
+	debug    bool
+	exited   bool
+	code     int
+	killed   error
+}
+
+// WithLinux runs the program as a static Linux process in user mode: INT 0x80 and SYSENTER
+// are system calls served by the emulator, the paths of the program resolve inside the host
+// directory root, and args and env are passed on its initial stack
+func WithLinux(root string, args []string, env []string) Option {
+	return func(reg *X86Registers) {
+		reg.personality = &linux{root: root, args: args, env: env}
+	}
+}
+
+// boot maps the segments of prog with the stack at the top of the user address space and
+// the heap after the highest segment
+func (l *linux) boot(reg *X86Registers, prog *program, debug bool) (*Memory, error) {
+	l.abi = linux32
+	switch prog.bitMode {
+	case 32:
+	case 64:
+		if reg.features().ExtEDX&FeatureLM == 0 {
+			return nil, fmt.Errorf("CPU profile %s has no long mode", reg.profile.Name)
+		}
+		l.abi = linux64
+	default:
+		return nil, fmt.Errorf("Linux programs run in 32-bit or 64-bit mode, not %d-bit", prog.bitMode)
+	}
+	mem := NewMemory(reg, nil, 0, debug)
+	l.reg, l.mem, l.debug = reg, mem, debug
+	l.started = time.Now()
+	l.space = newAddressSpace(mem, l.abi == linux64)
+	l.files = []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	// segments sharing a page are all mapped before they are loaded in it
+	var end uint64
+	for _, s := range prog.segments {
+		l.space.mapArea(s.address&^0xfff, pageAlign(s.address+s.size), s.prot)
+		if pageAlign(s.address+s.size) > end {
+			end = pageAlign(s.address + s.size)
+		}
+	}
+	for _, s := range prog.segments {
+		if !l.space.load(s.address, s.data) {
+			return nil, fmt.Errorf("segment at 0x%X is not mapped", s.address)
+		}
+	}
+	l.brkStart, l.brkEnd = end, end
+	l.space.mapArea(l.abi.stackTop-linuxStackSize, l.abi.stackTop, protRead|protWrite)
+	l.userMode()
+	sp, ok := l.initialStack(prog)
+	if !ok {
+		return nil, errors.New("arguments and environment do not fit on the stack")
+	}
+	reg.EIP = uint32(prog.entry)
+	reg.ESP = uint32(sp)
+	if l.abi == linux64 {
+		l.longMode()
+		reg.X64.RIP, reg.X64.RSP = prog.entry, sp
+	}
+	return mem, nil
+}
+
+// userMode puts the processor at CPL 3 in the flat segments of Linux with paging on the
+// address space of the program, and the x87, SSE and AVX states enabled
+func (l *linux) userMode() {
+	reg := l.reg
+	l.space.mapArea(linuxGDT, linuxGDT+linuxPageSize, 0)
+	l.gdt = l.space.populate(linuxGDT, 0)
+	for entry, descriptor := range l.abi.gdt {
+		l.writeDescriptor(entry, descriptor)
+	}
+	reg.GDTR = DescriptorTable{Base: linuxGDT, Limit: linuxGDTLength - 1}
+	reg.IDTR = DescriptorTable{}
+	reg.CR3 = l.space.root
+	reg.CR0 |= CR0PE | CR0PG | CR0MP | CR0NE | CR0WP
+	features := reg.features()
+	if features.Leaf1EDX&FeatureFXSR != 0 {
+		reg.CR4 |= CR4OSFXSR | CR4OSXMMEXCPT
+	}
+	if features.Leaf1ECX&FeatureXSAVE != 0 {
+		reg.CR4 |= CR4OSXSAVE
+		reg.XCR0 = xstateX87 | xstateSSE
+		if features.Leaf1ECX&FeatureAVX != 0 {
+			reg.XCR0 |= xstateAVX
+		}
+	}
+	for i := SegES; i <= SegGS; i++ {
+		*reg.selectorIndex(i) = l.abi.data
+		reg.Segments[i] = flatData(3)
+	}
+	reg.CS = l.abi.code
+	reg.Segments[SegCS] = flatCode(3, false)
+	reg.FS, reg.GS = 0, 0
+	reg.Segments[SegFS], reg.Segments[SegGS] = SegmentCache{}, SegmentCache{}
+	reg.EFlags = 0x2 | FlagIF
+}
+
+// writeDescriptor stores descriptor in entry of the GDT
+func (l *linux) writeDescriptor(entry uint32, descriptor uint64) {
+	l.mem.WritePhys64(l.gdt+uint64(entry)*8, descriptor)
+}
+
+// initialStack pushes the strings of the arguments and the environment, then argc, argv,
+// envp and the auxiliary vector of prog, as the Linux ELF loader does; the stack pointer is
+// 16-byte aligned on argc
+func (l *linux) initialStack(prog *program) (uint64, bool) {
+	reg := l.reg
+	space := l.space
+	size := l.abi.word
+	sp := l.abi.stackTop
+	push := func(data []byte) (uint64, bool) {
+		sp -= uint64(len(data))
+		return sp, space.write(sp, data)
+	}
+	var random []byte
+	for i := 0; i < 2; i++ {
+		value, _ := reg.entropy.Random()
+		for j := 0; j < 8; j++ {
+			random = append(random, byte(value>>(8*j)))
+		}
+	}
+	randomAddress, ok := push(random)
+	platform, ok2 := push(append([]byte(l.abi.machine), 0))
+	if !ok || !ok2 {
+		return 0, false
+	}
+	strings := func(values []string) ([]uint64, bool) {
+		addresses := make([]uint64, len(values))
+		for i := len(values) - 1; i >= 0; i-- {
+			address, ok := push(append([]byte(values[i]), 0))
+			if !ok {
+				return nil, false
+			}
+			addresses[i] = address
+		}
+		return addresses, true
+	}
+	env, ok := strings(l.env)
+	if !ok {
+		return 0, false
+	}
+	args, ok := strings(l.args)
+	if !ok {
+		return 0, false
+	}
+	auxv := []uint64{
+		linuxAtHwcap, uint64(reg.features().Leaf1EDX),
+		linuxAtPagesz, linuxPageSize,
+		linuxAtClktck, linuxClockTicks,
+		linuxAtEntry, prog.entry,
+		linuxAtUID, uint64(os.Getuid()),
+		linuxAtEUID, uint64(os.Geteuid()),
+		linuxAtGID, uint64(os.Getgid()),
+		linuxAtEGID, uint64(os.Getegid()),
+		linuxAtSecure, 0,
+		linuxAtRandom, randomAddress,
+		linuxAtPlatform, platform,
+	}
+	if prog.headers != 0 {
+		auxv = append(auxv, linuxAtPhdr, prog.headers, linuxAtPhent, prog.headerSize, linuxAtPhnum, prog.headerCount)
+	}
+	auxv = append(auxv, linuxAtNull, 0)
+	words := []uint64{uint64(len(args))}
+	words = append(append(words, args...), 0)
+	words = append(append(words, env...), 0)
+	words = append(words, auxv...)
+	sp = (sp - uint64(len(words))*size) &^ 15
+	for i, word := range words {
+		if !space.writeWord(sp+uint64(i)*size, size, word) {
+			return 0, false
+		}
+	}
+	return sp, true
+}
+
+func (l *linux) done() bool {
+	return l.exited
+}
+
+func (l *linux) status() (int, error) {
+	return l.code, l.killed
+}
+
+// interrupt INT 0x80 is a system call of i386 processes and page faults in a mapping
+// populate its page, the other exceptions and interrupts kill the program
+func (l *linux) interrupt(e *Exception, software bool) bool {
+	reg := l.reg
+	switch {
+	case software && e.Vector == 0x80 && l.abi == linux32:
+		l.call32(reg.EBP)
+	case e.Vector == ExceptionPF && l.space.fault(reg.CR2, e.ErrorCode):
+		// the faulting instruction runs again
+	default:
+		l.kill(e)
+	}
+	return true
+}
+
+// systemCall SYSENTER of i386 processes returns to the next instruction, the program having
+// no vDSO to return to; as the Linux entry does, the sixth argument is read at [EBP].
+// SYSCALL is the system call of x86-64 processes.
+func (l *linux) systemCall(opcode uint8) bool {
+	reg := l.reg
+	switch {
+	case opcode == 0x34 && l.abi == linux32:
+		reg.EIP += 1
+		sixth, _ := l.space.readWord(uint64(reg.EBP), 4)
+		l.call32(uint32(sixth))
+	case opcode == 0x05 && l.abi == linux64:
+		l.call64()
+	default:
+		return false
+	}
+	return true
+}
+
+// kill ends the program with the signal of e
+func (l *linux) kill(e *Exception) {
+	reg := l.reg
+	signal, ok := linuxSignals[e.Vector]
+	if !ok {
+		signal = linuxSignal{"SIGSEGV", 11}
+	}
+	l.exited = true
+	l.code = 128 + signal.number
+	l.killed = fmt.Errorf("%s: %s at %04X:%X%s", signal.name, e.Error(), reg.CS, reg.ip(), reg.codeSymbol(reg.ip()))
+}
+
+// call32 the i386 convention: number in EAX, arguments in EBX, ECX, EDX, ESI, EDI and EBP,
+// result or negated error number in EAX
+func (l *linux) call32(sixth uint32) {
+	reg := l.reg
+	args := [6]uint64{uint64(reg.EBX), uint64(reg.ECX), uint64(reg.EDX), uint64(reg.ESI), uint64(reg.EDI), uint64(sixth)}
+	reg.EAX = uint32(l.call(uint64(reg.EAX), args))
+}
+
+// call runs system call number, -ENOSYS when there is none
+func (l *linux) call(number uint64, args [6]uint64) int64 {
+	result := int64(-linuxENOSYS)
+	if handler, ok := l.abi.calls[number]; ok {
+		result = handler(l, args)
+	}
+	if l.debug {
+		log.Printf("syscall %d(0x%X, 0x%X, 0x%X) = %d\n", number, args[0], args[1], args[2], result)
+	}
+	return result
+}
+
+// errno the negated Linux error number of a host error
+func errno(err error) int64 {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return -linuxENOENT
+	case errors.Is(err, fs.ErrExist):
+		return -linuxEEXIST
+	case errors.Is(err, fs.ErrPermission):
+		return -linuxEACCES
+	case errors.Is(err, syscall.EISDIR):
+		return -linuxEISDIR
+	case errors.Is(err, syscall.ENOTDIR):
+		return -linuxENOTDIR
+	}
+	return -linuxEIO
+}
+
+// hostPath the host file of a guest path, which cannot leave the root directory. The host
+// follows symbolic links, so the path is resolved here and refused with EACCES when a link
+// leads out of the root. A file to create must have its directory in the root.
+func (l *linux) hostPath(name string) (string, int64) {
+	root, err := filepath.EvalSymlinks(l.root)
+	if err != nil {
+		return "", errno(err)
+	}
+	host := filepath.Join(root, filepath.FromSlash(path.Clean("/"+name)))
+	resolved, err := filepath.EvalSymlinks(host)
+	if errors.Is(err, fs.ErrNotExist) {
+		// a dangling link would have the host create its target wherever it points
+		if _, err := os.Lstat(host); err == nil {
+			return "", -linuxEACCES
+		}
+		dir, err := filepath.EvalSymlinks(filepath.Dir(host))
+		if err != nil {
+			return "", errno(err)
+		}
+		resolved = filepath.Join(dir, filepath.Base(host))
+	} else if err != nil {
+		return "", errno(err)
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", -linuxEACCES
+	}
+	return resolved, 0
+}
+
+// file the open file of descriptor fd
+func (l *linux) file(fd uint64) (*os.File, bool) {
+	if fd >= uint64(len(l.files)) || l.files[fd] == nil {
+		return nil, false
+	}
+	return l.files[fd], true
+}
+
+// exit and exit_group end the program with status
+func (l *linux) exit(a [6]uint64) int64 {
+	l.exited = true
+	l.code = int(a[0] & 0xff)
+	return 0
+}
+
+// read(fd, buffer, count)
+func (l *linux) read(a [6]uint64) int64 {
+	f, ok := l.file(a[0])
+	if !ok {
+		return -linuxEBADF
+	}
+	count := a[2]
+	if count > linuxMaxIO {
+		count = linuxMaxIO
+	}
+	data := make([]byte, count)
+	n, err := f.Read(data)
+	if n == 0 && err != nil && err != io.EOF {
+		return errno(err)
+	}
+	if !l.space.write(a[1], data[:n]) {
+		return -linuxEFAULT
+	}
+	return int64(n)
+}
+
+// write(fd, buffer, count)
+func (l *linux) write(a [6]uint64) int64 {
+	f, ok := l.file(a[0])
+	if !ok {
+		return -linuxEBADF
+	}
+	count := a[2]
+	if count > linuxMaxIO {
+		count = linuxMaxIO
+	}
+	data, ok := l.space.read(a[1], count)
+	if !ok {
+		return -linuxEFAULT
+	}
+	n, err := f.Write(data)
+	if n == 0 && err != nil {
+		return errno(err)
+	}
+	return int64(n)
+}
+
+// writev(fd, iov, count) writes the buffers of the iovec array, stopping at a short write
+func (l *linux) writev(a [6]uint64) int64 {
+	word := l.abi.word
+	var total int64
+	for i := uint64(0); i < a[2]; i++ {
+		iov := a[1] + 2*word*i
+		base, ok := l.space.readWord(iov, word)
+		if !ok {
+			return -linuxEFAULT
+		}
+		length, ok := l.space.readWord(iov+word, word)
+		if !ok {
+			return -linuxEFAULT
+		}
+		n := l.write([6]uint64{a[0], base, length})
+		if n < 0 {
+			if total > 0 {
+				return total
+			}
+			return n
+		}
+		total += n
+		if uint64(n) < length {
+			break
+		}
+	}
+	return total
+}
+
+// open(path, flags, mode)
+func (l *linux) open(a [6]uint64) int64 {
+	guest, ok := l.space.readString(a[0])
+	if !ok {
+		return -linuxEFAULT
+	}
+	return l.openPath(guest, a[1], a[2])
+}
+
+// openPath opens the guest file at name, relative to the root directory
+func (l *linux) openPath(name string, flags uint64, mode uint64) int64 {
+	hostFlags := os.O_RDONLY
+	switch flags & 3 {
+	case linuxOWronly:
+		hostFlags = os.O_WRONLY
+	case linuxORdwr:
+		hostFlags = os.O_RDWR
+	}
+	for _, flag := range [][2]int{{linuxOCreat, os.O_CREATE}, {linuxOExcl, os.O_EXCL},
+		{linuxOTrunc, os.O_TRUNC}, {linuxOAppend, os.O_APPEND}} {
+		if flags&uint64(flag[0]) != 0 {
+			hostFlags |= flag[1]
+		}
+	}
+	host, result := l.hostPath(name)
+	if result != 0 {
+		return result
+	}
+	f, err := os.OpenFile(host, hostFlags, os.FileMode(mode&0o777))
+	if err != nil {
+		return errno(err)
+	}
+	for fd := range l.files {
+		if l.files[fd] == nil {
+			l.files[fd] = f
+			return int64(fd)
+		}
+	}
+	if len(l.files) == linuxMaxFiles {
+		f.Close()
+		return -linuxEMFILE
+	}
+	l.files = append(l.files, f)
+	return int64(len(l.files) - 1)
+}
+
+// close(fd): the standard streams of the emulator stay open on the host
+func (l *linux) close(a [6]uint64) int64 {
+	f, ok := l.file(a[0])
+	if !ok {
+		return -linuxEBADF
+	}
+	l.files[a[0]] = nil
+	if f == os.Stdin || f == os.Stdout || f == os.Stderr {
+		return 0
+	}
+	if err := f.Close(); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+// brk(end) moves the program break, returning the new one or the current one on failure
+func (l *linux) brk(a [6]uint64) int64 {
+	end := a[0]
+	if end < l.brkStart {
+		return int64(l.brkEnd)
+	}
+	mapped, wanted := pageAlign(l.brkEnd), pageAlign(end)
+	switch {
+	case wanted > mapped:
+		if start, ok := l.space.gap(mapped, wanted-mapped, l.abi.stackTop); !ok || start != mapped {
+			return int64(l.brkEnd)
+		}
+		l.space.mapArea(mapped, wanted, protRead|protWrite)
+	case wanted < mapped:
+		l.space.unmap(wanted, mapped)
+	}
+	l.brkEnd = end
+	return int64(end)
+}
+
+// ioctl(fd, request, argument): TCGETS alone, on a terminal
+func (l *linux) ioctl(a [6]uint64) int64 {
+	f, ok := l.file(a[0])
+	if !ok {
+		return -linuxEBADF
+	}
+	info, err := f.Stat()
+	if a[1] != linuxTCGETS || err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return -linuxENOTTY
+	}
+	// struct termios: c_iflag ICRNL|IXON, c_oflag OPOST|ONLCR, c_cflag B38400|CS8|CREAD,
+	// c_lflag ISIG|ICANON|ECHO|ECHOE|ECHOK|ECHOCTL|ECHOKE|IEXTEN, c_line, c_cc
+	termios := make([]byte, 36)
+	for i, flag := range []uint32{0x500, 0x5, 0xbf, 0x8a3b} {
+		for j := 0; j < 4; j++ {
+			termios[i*4+j] = byte(flag >> (8 * j))
+		}
+	}
+	copy(termios[17:], []byte{3, 0x1c, 0x7f, 0x15, 4, 0, 1, 0, 0x11, 0x13, 0x1a, 0, 0x12, 0xf, 0x17, 0x16})
+	if !l.space.write(a[2], termios) {
+		return -linuxEFAULT
+	}
+	return 0
+}
+
+// gettimeofday(tv, tz) with the host clock, the timezone being UTC
+func (l *linux) gettimeofday(a [6]uint64) int64 {
+	now := time.Now()
+	word := l.abi.word
+	if a[0] != 0 && (!l.space.writeWord(a[0], word, uint64(now.Unix())) ||
+		!l.space.writeWord(a[0]+word, word, uint64(now.Nanosecond()/1000))) {
+		return -linuxEFAULT
+	}
+	if a[1] != 0 && !l.space.writeWord(a[1], 8, 0) {
+		return -linuxEFAULT
+	}
+	return 0
+}
+
+// oldMmap mmap(args) with the six arguments in memory
+func (l *linux) oldMmap(a [6]uint64) int64 {
+	var args [6]uint64
+	for i := range args {
+		value, ok := l.space.readWord(a[0]+uint64(i)*4, 4)
+		if !ok {
+			return -linuxEFAULT
+		}
+		args[i] = value
+	}
+	return l.mmap(args[0], args[1], args[2], args[3], args[4], args[5])
+}
+
+// mmap2(address, length, prot, flags, fd, page offset)
+func (l *linux) mmap2(a [6]uint64) int64 {
+	return l.mmap(a[0], a[1], a[2], a[3], a[4], a[5]*linuxPageSize)
+}
+
+// mmap maps length bytes at address with MAP_FIXED, in the lowest gap between the mmap base
+// and the stack otherwise. A file mapping is a private copy of the file.
+func (l *linux) mmap(address, length, prot, flags, fd, offset uint64) int64 {
+	if length == 0 || address&0xfff != 0 || offset&0xfff != 0 {
+		return -linuxEINVAL
+	}
+	length = pageAlign(length)
+	var f *os.File
+	if flags&linuxMapAnon == 0 {
+		var ok bool
+		if f, ok = l.file(fd); !ok {
+			return -linuxEBADF
+		}
+	}
+	if flags&linuxMapFixed == 0 {
+		start, ok := l.space.gap(l.abi.mmapBase, length, l.abi.stackTop-linuxStackSize)
+		if !ok {
+			return -linuxENOMEM
+		}
+		address = start
+	}
+	l.space.mapArea(address, address+length, prot&(protRead|protWrite|protExec))
+	if f != nil {
+		if err := l.loadFile(f, address, length, offset); err != nil {
+			l.space.unmap(address, address+length)
+			return errno(err)
+		}
+	}
+	return int64(address)
+}
+
+// loadFile copies the file from offset to the length bytes mapped at address. Only the
+// pages the file covers are loaded, by chunks of at most linuxMaxIO whatever the length the
+// program asked for; the pages past its end are populated on demand, as anonymous ones.
+func (l *linux) loadFile(f *os.File, address, length, offset uint64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(info.Size())
+	if offset >= size {
+		return nil
+	}
+	if size-offset < length {
+		length = size - offset
+	}
+	chunk := length
+	if chunk > linuxMaxIO {
+		chunk = linuxMaxIO
+	}
+	data := make([]byte, chunk)
+	for done := uint64(0); done < length; {
+		if length-done < chunk {
+			data = data[:length-done]
+		}
+		n, err := f.ReadAt(data, int64(offset+done))
+		l.space.load(address+done, data[:n])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		done += uint64(n)
+	}
+	return nil
+}
+
+// munmap(address, length)
+func (l *linux) munmap(a [6]uint64) int64 {
+	if a[0]&0xfff != 0 || a[1] == 0 {
+		return -linuxEINVAL
+	}
+	l.space.unmap(a[0], a[0]+pageAlign(a[1]))
+	return 0
+}
+
+// mprotect(address, length, prot)
+func (l *linux) mprotect(a [6]uint64) int64 {
+	if a[0]&0xfff != 0 {
+		return -linuxEINVAL
+	}
+	if !l.space.protect(a[0], a[0]+pageAlign(a[1]), a[2]&(protRead|protWrite|protExec)) {
+		return -linuxENOMEM
+	}
+	return 0
+}
+
+// uname(buffer): six fields of 65 bytes
+func (l *linux) uname(a [6]uint64) int64 {
+	fields := []string{"Linux", "ia32emu", "5.15.0", "#1 SMP", l.abi.machine, "(none)"}
+	data := make([]byte, 65*len(fields))
+	for i, field := range fields {
+		copy(data[65*i:], field)
+	}
+	if !l.space.write(a[0], data) {
+		return -linuxEFAULT
+	}
+	return 0
+}
+
+// setThreadArea set_thread_area(user_desc) installs a TLS descriptor in one of the three
+// entries of the GDT, the first free one for entry number -1
+func (l *linux) setThreadArea(a [6]uint64) int64 {
+	desc, ok := l.space.read(a[0], 16)
+	if !ok {
+		return -linuxEFAULT
+	}
+	word := func(i int) uint32 {
+		return uint32(desc[i*4]) | uint32(desc[i*4+1])<<8 | uint32(desc[i*4+2])<<16 | uint32(desc[i*4+3])<<24
+	}
+	entry, base, limit, flags := word(0), word(1), word(2), word(3)
+	if entry == 0xffffffff {
+		for i := uint32(linuxTLSEntry); i < linuxTLSEntry+linuxTLSCount; i++ {
+			if l.mem.ReadPhys64(l.gdt+uint64(i)*8) == 0 {
+				entry = i
+				break
+			}
+		}
+		if entry == 0xffffffff {
+			return -linuxEINVAL
+		}
+		if !l.space.writeWord(a[0], 4, uint64(entry)) {
+			return -linuxEFAULT
+		}
+	}
+	if entry < linuxTLSEntry || entry >= linuxTLSEntry+linuxTLSCount {
+		return -linuxEINVAL
+	}
+	// seg_32bit, contents, read_exec_only, limit_in_pages, seg_not_present, useable
+	var descriptor uint64
+	if base != 0 || limit != 0 || flags&0x28 != 0x28 {
+		access := uint64(0xf1) | uint64(flags>>1&3)<<2
+		if flags&0x8 == 0 {
+			access |= 0x2
+		}
+		if flags&0x20 != 0 {
+			access &^= 0x80
+		}
+		granularity := uint64(flags&1)<<2 | uint64(flags>>4&1)<<3 | uint64(flags>>6&1)
+		descriptor = uint64(limit&0xffff) | uint64(base&0xffffff)<<16 | access<<40 |
+			uint64(limit>>16&0xf)<<48 | granularity<<52 | uint64(base>>24)<<56
+	}
+	l.writeDescriptor(entry, descriptor)
+	return 0
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// x86-64 Linux processes: 4-level paging, SYSCALL, and FS and GS bases set by arch_prctl.
+// There is no vDSO, the C library falls back to system calls.
+
+const (
+	linuxAtFdcwd             = -100
+	linuxArchSetGS           = 0x1001
+	linuxArchSetFS           = 0x1002
+	linuxArchGetFS           = 0x1003
+	linuxArchGetGS           = 0x1004
+	linuxClockRealtime       = 0
+	linuxClockRealtimeCoarse = 5
+)
+
+// linux64Calls the x86-64 system calls by number
+var linux64Calls = map[uint64]func(*linux, [6]uint64) int64{
+	0:   (*linux).read,
+	1:   (*linux).write,
+	2:   (*linux).open,
+	3:   (*linux).close,
+	9:   (*linux).mmap64,
+	10:  (*linux).mprotect,
+	11:  (*linux).munmap,
+	12:  (*linux).brk,
+	16:  (*linux).ioctl,
+	20:  (*linux).writev,
+	60:  (*linux).exit,
+	63:  (*linux).uname,
+	96:  (*linux).gettimeofday,
+	158: (*linux).archPrctl,
+	228: (*linux).clockGettime,
+	231: (*linux).exit,
+	257: (*linux).openat,
+	318: (*linux).getrandom,
+}
+
+var linux64 = &linuxABI{
+	stackTop: 0x7ffffffff000,
+	mmapBase: 0x7f0000000000,
+	word:     8,
+	machine:  "x86_64",
+	calls:    linux64Calls,
+	gdt:      map[uint32]uint64{4: 0x00cffb000000ffff, 5: 0x00cff3000000ffff, 6: 0x00affb000000ffff},
+	code:     6<<3 | 3,
+	data:     5<<3 | 3,
+}
+
+// longMode switches the user mode of the program to 64-bit mode on 4-level tables, with
+// SYSCALL enabled
+func (l *linux) longMode() {
+	reg := l.reg
+	reg.CR4 |= CR4PAE
+	reg.IA32Efer |= EFERLME | EFERLMA | EFERSCE
+	reg.Segments[SegCS] = flatCode(3, true)
+	reg.syncMode()
+}
+
+// call64 the x86-64 convention of SYSCALL: number in RAX, arguments in RDI, RSI, RDX, R10,
+// R8 and R9, result or negated error number in RAX. RCX and R11 are RIP and RFLAGS, as
+// SYSCALL leaves them.
+func (l *linux) call64() {
+	x := &l.reg.X64
+	x.RIP += 1
+	x.RCX, x.R11 = x.RIP, uint64(l.reg.EFlags)
+	args := [6]uint64{x.RDI, x.RSI, x.RDX, x.R10, x.R8, x.R9}
+	x.RAX = uint64(l.call(x.RAX, args))
+}
+
+// mmap64 mmap(address, length, prot, flags, fd, offset)
+func (l *linux) mmap64(a [6]uint64) int64 {
+	return l.mmap(a[0], a[1], a[2], a[3], a[4], a[5])
+}
+
+// openat(dirfd, path, flags, mode): a relative path is relative to the root directory with
+// AT_FDCWD, to the directory open at dirfd otherwise
+func (l *linux) openat(a [6]uint64) int64 {
+	guest, ok := l.space.readString(a[1])
+	if !ok {
+		return -linuxEFAULT
+	}
+	if !path.IsAbs(guest) && int32(a[0]) != linuxAtFdcwd {
+		f, ok := l.file(a[0])
+		if !ok {
+			return -linuxEBADF
+		}
+		dir, err := filepath.Rel(l.root, f.Name())
+		if err != nil {
+			return -linuxENOTDIR
+		}
+		guest = path.Join("/", filepath.ToSlash(dir), guest)
+	}
+	return l.openPath(guest, a[2], a[3])
+}
+
+// archPrctl arch_prctl(code, address) sets or reads the FS and GS bases
+func (l *linux) archPrctl(a [6]uint64) int64 {
+	x := &l.reg.X64
+	switch a[0] {
+	case linuxArchSetFS, linuxArchSetGS:
+		if !canonical(a[1]) {
+			return -linuxEPERM
+		}
+		if a[0] == linuxArchSetFS {
+			x.FSBase = a[1]
+		} else {
+			x.GSBase = a[1]
+		}
+		l.reg.syncBases()
+	case linuxArchGetFS:
+		if !l.space.writeWord(a[1], 8, x.FSBase) {
+			return -linuxEFAULT
+		}
+	case linuxArchGetGS:
+		if !l.space.writeWord(a[1], 8, x.GSBase) {
+			return -linuxEFAULT
+		}
+	default:
+		return -linuxEINVAL
+	}
+	return 0
+}
+
+// clockGettime clock_gettime(clock, timespec): the realtime clocks read the host time, the
+// others count from the start of the program
+func (l *linux) clockGettime(a [6]uint64) int64 {
+	var seconds, nanoseconds uint64
+	switch a[0] {
+	case linuxClockRealtime, linuxClockRealtimeCoarse:
+		now := time.Now()
+		seconds, nanoseconds = uint64(now.Unix()), uint64(now.Nanosecond())
+	default:
+		if a[0] > 11 {
+			return -linuxEINVAL
+		}
+		elapsed := time.Since(l.started)
+		seconds, nanoseconds = uint64(elapsed/time.Second), uint64(elapsed%time.Second)
+	}
+	if !l.space.writeWord(a[1], 8, seconds) || !l.space.writeWord(a[1]+8, 8, nanoseconds) {
+		return -linuxEFAULT
+	}
+	return 0
+}
+
+// getrandom(buffer, count, flags) from the source of RDRAND, so runs with the same seed repeat
+func (l *linux) getrandom(a [6]uint64) int64 {
+	count := a[1]
+	if count > linuxMaxIO {
+		count = linuxMaxIO
+	}
+	data := make([]byte, count)
+	for i := range data {
+		if i%8 == 0 {
+			value, _ := l.reg.entropy.Random()
+			for j := 0; j < 8 && i+j < len(data); j++ {
+				data[i+j] = byte(value >> (8 * j))
+			}
+		}
+	}
+	if !l.space.write(a[0], data) {
+		return -linuxEFAULT
+	}
+	return int64(count)
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bootLinux loads testdata/linux64.elf with its files in root, to make its system calls
+func bootLinux(t *testing.T, root string) *linux {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "linux64.elf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err := NewEmulator(64, 0, 0, data, false, WithLinux(root, []string{"linux64"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return emu.personality.(*linux)
+}
+
+func TestLinux64(t *testing.T) {
+	root := t.TempDir()
+	status := runProgram(t, 64, "linux64.elf", WithLinux(root, []string{"linux64", "arg"}, nil))
+	if status != 0 {
+		t.Fatalf("check %d of testdata/linux64.s failed", status)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello, x86-64\n" {
+		t.Errorf("out.txt = %q", data)
+	}
+}
+
+// Guest paths stay in the root directory, whatever the symbolic links there point to
+func TestHostPath(t *testing.T) {
+	base := t.TempDir()
+	root, outside := filepath.Join(base, "root"), filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "dir"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"escape":   outside,
+		"up":       "..",
+		"dangling": filepath.Join(outside, "new.txt"),
+		"inside":   "dir",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skip(err)
+		}
+	}
+	l := &linux{root: root}
+	tests := []struct {
+		name   string
+		host   string
+		result int64
+	}{
+		{"/dir", "dir", 0},
+		{"/../../dir", "dir", 0},
+		{"new.txt", "new.txt", 0},
+		{"/inside/new.txt", "dir/new.txt", 0},
+		{"/escape", "", -linuxEACCES},
+		{"/escape/new.txt", "", -linuxEACCES},
+		{"/up/outside", "", -linuxEACCES},
+		{"/dangling", "", -linuxEACCES},
+		{"/missing/new.txt", "", -linuxENOENT},
+	}
+	for _, test := range tests {
+		host, result := l.hostPath(test.name)
+		if result != test.result {
+			t.Errorf("hostPath(%q) = %d, want %d", test.name, result, test.result)
+			continue
+		}
+		if result != 0 {
+			continue
+		}
+		want, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want = filepath.Join(want, filepath.FromSlash(test.host)); host != want {
+			t.Errorf("hostPath(%q) = %s, want %s", test.name, host, want)
+		}
+	}
+}
+
+// A file mapping much longer than its file only loads what the file holds
+func TestMmapFile(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "in.txt"), []byte("mapped"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l := bootLinux(t, root)
+	f, err := os.Open(filepath.Join(root, "in.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	l.files = append(l.files, f)
+	ram := len(l.mem.ram)
+	const length = 1 << 36
+	address := l.mmap(0, length, protRead, 0, 3, 0)
+	if address < 0 {
+		t.Fatalf("mmap = %d", address)
+	}
+	if grown := len(l.mem.ram) - ram; grown > 0x10000 {
+		t.Errorf("mmap of %#x bytes grew the memory by %#x", length, grown)
+	}
+	if data, ok := l.space.read(uint64(address), 8); !ok || string(data) != "mapped\x00\x00" {
+		t.Errorf("first page = %q, %t", data, ok)
+	}
+	if data, ok := l.space.read(uint64(address)+length-1, 1); !ok || data[0] != 0 {
+		t.Errorf("last byte = %v, %t", data, ok)
+	}
+	if result := l.mmap(0, 0x1000, protRead, 0, 3, 0x1000); result < 0 {
+		t.Errorf("mmap past the end of the file = %d", result)
+	}
+}
@@ -0,0 +1,693 @@
+package core
+
+import "log"
+
+// 64-bit mode. Long mode runs the code segments with the L bit in 64-bit mode, decoded here:
+// REX prefixes select 64-bit operands and the registers R8-R15, addresses are 64-bit and may
+// be relative to RIP, and segmentation is flat except for the FS and GS bases. The other code
+// segments run in compatibility mode on the 16-bit and 32-bit tables. While 64-bit code runs
+// the general registers live in X64registers: their low halves are exchanged with EAX-EDI
+// and EIP when the processor enters or leaves 64-bit mode. The x87, MMX, SSE and AVX
+// instructions run the handlers of the legacy tables through extension64.
+
+// longModeTables physical address of the page tables built for a processor started in
+// 64-bit mode, out of the memory they map
+const longModeTables = 0xf00000000
+
+// Long the general-purpose instructions of 64-bit mode
+type Long struct {
+	reg  *X86Registers
+	mem  IMemory
+	intr *Interrupt
+}
+
+func NewLong(reg *X86Registers, mem IMemory) *Long {
+	return &Long{
+		reg:  reg,
+		mem:  mem,
+		intr: NewInterrupt(reg, mem),
+	}
+}
+
+// syncMode moves the general registers to the register file of the mode the processor runs
+func (r *X86Registers) syncMode() {
+	r.setMode64(r.Is64())
+}
+
+// setMode64 moves the general registers to X64registers, or back to EAX-EDI and EIP. The
+// upper halves are kept across compatibility mode.
+func (r *X86Registers) setMode64(on bool) {
+	if on == r.mode64 {
+		return
+	}
+	r.mode64 = on
+	x := &r.X64
+	for i := uint8(0); i < 8; i++ {
+		p := x.register(i)
+		if on {
+			*p = *p&^0xffffffff | uint64(r.GetByIndex(i))
+		} else {
+			r.SetByIndex(i, uint32(*p))
+		}
+	}
+	if on {
+		x.RIP = uint64(r.EIP)
+	} else {
+		r.EIP = uint32(x.RIP)
+	}
+}
+
+// ip the instruction pointer of the running mode
+func (r *X86Registers) ip() uint64 {
+	if r.mode64 {
+		return r.X64.RIP
+	}
+	return uint64(r.EIP)
+}
+
+// enterLongMode puts the processor in 64-bit mode at CPL 0, as a 64-bit boot loader leaves
+// it: page tables built above the guest memory identity map start..end with 4 KiB pages,
+// EFER.LME and LMA are set and every segment is flat, CS being a 64-bit code segment
+func (r *X86Registers) enterLongMode(mem IMemory, start uint64, end uint64) {
+	tables := newPageTables(mem, longModeTables)
+	for page := start &^ 0xfff; page < end; page += 0x1000 {
+		tables.mapPage(page, page, pageWritable)
+	}
+	r.flatMode()
+	r.Segments[SegCS].Big = false
+	r.Segments[SegCS].Long = true
+	r.CR3 = tables.root
+	r.CR4 |= CR4PAE
+	r.CR0 |= CR0PE | CR0PG
+	r.IA32Efer |= EFERLME | EFERLMA
+	r.syncMode()
+}
+
+// canonical bits 63-47 of a linear address are all equal
+func canonical(address uint64) bool {
+	return uint64(int64(address<<16)>>16) == address
+}
+
+// checkCanonical raises vector with error code 0 unless size bytes at address are canonical
+func checkCanonical(address uint64, size uint, vector uint8) {
+	if !canonical(address) || !canonical(address+uint64(size)-1) {
+		raiseWithCode(vector, 0)
+	}
+}
+
+// fetch64 reads size instruction bytes at RIP+offset
+func fetch64(reg *X86Registers, mem IMemory, offset int, size uint) uint64 {
+	address := reg.X64.RIP + uint64(offset)
+	checkCanonical(address, size, ExceptionGP)
+	var value uint64
+	for i := uint(0); i < size; i++ {
+		value |= uint64(mem.FetchLinear(address+uint64(i))) << (8 * i)
+	}
+	return value
+}
+
+// code8 the instruction byte at RIP+offset
+func (l *Long) code8(offset int) uint8 {
+	return uint8(fetch64(l.reg, l.mem, offset, 1))
+}
+
+// imm reads the size bytes immediate at RIP and steps over it
+func (l *Long) imm(size uint) uint64 {
+	value := fetch64(l.reg, l.mem, 0, size)
+	l.reg.X64.RIP += uint64(size)
+	return value
+}
+
+// immSigned reads an immediate sign-extended to 64 bits
+func (l *Long) immSigned(size uint) uint64 {
+	return uint64(signExtend(l.imm(size), size*8))
+}
+
+// immSize immediates are at most 32 bits, sign-extended for 64-bit operands
+func immSize(width uint) uint {
+	if width > 32 {
+		return 4
+	}
+	return width / 8
+}
+
+func (r *X86Registers) rexW() bool {
+	return r.rex&8 != 0
+}
+
+// width the operand size of the current instruction: 64 bits with REX.W, 16 with the 66
+// prefix, 32 otherwise
+func (l *Long) width() uint {
+	reg := l.reg
+	switch {
+	case reg.rexW():
+		return 64
+	case reg.opOverride:
+		return 16
+	}
+	return 32
+}
+
+// stackWidth the operand size of PUSH and POP: 64 bits, 16 with the 66 prefix
+func (l *Long) stackWidth() uint {
+	if l.reg.opOverride {
+		return 16
+	}
+	return 64
+}
+
+// addressMask RSI, RDI and RCX of the string instructions are 32-bit with the 67 prefix
+func (l *Long) addressMask() uint64 {
+	if l.reg.addrOverride {
+		return 0xffffffff
+	}
+	return ^uint64(0)
+}
+
+// getReg and setReg access a general register, index including the REX bit
+func (l *Long) getReg(index uint8, width uint) uint64 {
+	reg := l.reg
+	return reg.X64.Get(index, width, reg.rex != 0)
+}
+
+func (l *Long) setReg(index uint8, width uint, value uint64) {
+	reg := l.reg
+	reg.X64.Set(index, width, reg.rex != 0, value)
+}
+
+// opcodeReg the register in the low 3 bits of the opcode, extended by REX.B
+func (l *Long) opcodeReg() uint8 {
+	reg := l.reg
+	return l.code8(0)&7 | reg.rex&1<<3
+}
+
+// dataBase the base added to a data address: FS or GS with their override, 0 otherwise
+func (r *X86Registers) dataBase() uint64 {
+	switch r.segOverride {
+	case int8(SegFS):
+		return r.X64.FSBase
+	case int8(SegGS):
+		return r.X64.GSBase
+	}
+	return 0
+}
+
+// read and write access size bytes of data; vector is raised for a non-canonical address
+func (l *Long) read(address uint64, size uint, vector uint8) uint64 {
+	checkCanonical(address, size, vector)
+	return l.mem.ReadLinear(address, size)
+}
+
+func (l *Long) write(address uint64, size uint, value uint64, vector uint8) {
+	checkCanonical(address, size, vector)
+	l.mem.WriteLinear(address, size, value)
+}
+
+func (l *Long) push(width uint, value uint64) {
+	x := &l.reg.X64
+	rsp := x.RSP - uint64(width/8)
+	l.write(rsp, width/8, value, ExceptionSS)
+	x.RSP = rsp
+}
+
+func (l *Long) pop(width uint) uint64 {
+	x := &l.reg.X64
+	value := l.read(x.RSP, width/8, ExceptionSS)
+	x.RSP += uint64(width / 8)
+	return value
+}
+
+// readStack reads size bytes at RSP+offset without popping them
+func (l *Long) readStack(offset uint64, size uint) uint64 {
+	return l.read(l.reg.X64.RSP+offset, size, ExceptionSS)
+}
+
+// decode steps over the opcode byte and decodes the operands; immediate is the size of the
+// immediate that follows them
+func (l *Long) decode(immediate uint) ModRM64 {
+	reg := l.reg
+	reg.X64.RIP += 1
+	return NewModRM64(reg, l.mem, immediate)
+}
+
+// ModRM64 the ModRM operands of 64-bit mode. REX extends Rm, RegIndex and the SIB registers
+// to R8-R15; Opcode is the reg field without REX.R, the /digit of group opcodes.
+type ModRM64 struct {
+	reg *X86Registers
+	mem IMemory
+
+	Mod      uint8
+	Rm       uint8
+	RegIndex uint8
+	Opcode   uint8
+	Sib      uint8
+	Disp     uint64
+	// ripRelative mod 00 r/m 101: the displacement is relative to next, the address of the
+	// next instruction
+	ripRelative bool
+	next        uint64
+	// stack the base register is RSP or RBP: a non-canonical address raises #SS
+	stack bool
+}
+
+// NewModRM64 decodes the ModRM byte at RIP with its SIB byte and displacement. immediate
+// is the size of the immediate after them, which RIP-relative addresses step over.
+func NewModRM64(reg *X86Registers, mem IMemory, immediate uint) ModRM64 {
+	modrm := ModRM64{reg: reg, mem: mem}
+	code := uint8(fetch64(reg, mem, 0, 1))
+	x := &reg.X64
+	x.RIP += 1
+
+	modrm.Mod = code >> 6
+	modrm.Opcode = code >> 3 & 7
+	modrm.RegIndex = modrm.Opcode | reg.rex&4<<1
+	modrm.Rm = code&7 | reg.rex&1<<3
+	if modrm.Mod == 3 {
+		return modrm
+	}
+
+	base := code & 7
+	if base == 4 {
+		modrm.Sib = uint8(fetch64(reg, mem, 0, 1))
+		x.RIP += 1
+		base = modrm.Sib & 7
+	}
+	switch {
+	case modrm.Mod == 0 && code&7 == 5:
+		modrm.ripRelative = true
+		modrm.Disp = uint64(signExtend(fetch64(reg, mem, 0, 4), 32))
+		x.RIP += 4
+	case modrm.Mod == 2 || modrm.Mod == 0 && base == 5:
+		modrm.Disp = uint64(signExtend(fetch64(reg, mem, 0, 4), 32))
+		x.RIP += 4
+	case modrm.Mod == 1:
+		modrm.Disp = uint64(signExtend(fetch64(reg, mem, 0, 1), 8))
+		x.RIP += 1
+	}
+	// the default segment follows the REX.B extended base: R12 and R13 are not RSP and RBP
+	extended := base | reg.rex&1<<3
+	modrm.stack = (extended == 4 || extended == 5) && !(modrm.Mod == 0 && base == 5)
+	modrm.next = x.RIP + uint64(immediate)
+	return modrm
+}
+
+// offset the effective address of the memory operand, 32-bit with the 67 prefix
+func (modrm *ModRM64) offset() uint64 {
+	reg := modrm.reg
+	x := &reg.X64
+	var ea uint64
+	switch {
+	case modrm.ripRelative:
+		ea = modrm.next + modrm.Disp
+	case modrm.Rm&7 == 4:
+		base := modrm.Sib&7 | reg.rex&1<<3
+		index := modrm.Sib>>3&7 | reg.rex&2<<2
+		if modrm.Sib&7 != 5 || modrm.Mod != 0 {
+			ea = *x.register(base)
+		}
+		if index != 4 {
+			ea += *x.register(index) << (modrm.Sib >> 6)
+		}
+		ea += modrm.Disp
+	default:
+		ea = *x.register(modrm.Rm) + modrm.Disp
+	}
+	if reg.addrOverride {
+		ea &= 0xffffffff
+	}
+	return ea
+}
+
+// address the linear address of the memory operand
+func (modrm *ModRM64) address() uint64 {
+	return modrm.reg.dataBase() + modrm.offset()
+}
+
+func (modrm *ModRM64) vector() uint8 {
+	if modrm.stack {
+		return ExceptionSS
+	}
+	return ExceptionGP
+}
+
+// memory the linear address of an operand that must be in memory
+func (modrm *ModRM64) memory() uint64 {
+	if modrm.Mod == 3 {
+		raise(ExceptionUD)
+	}
+	return modrm.address()
+}
+
+func (modrm *ModRM64) load(address uint64, size uint) uint64 {
+	checkCanonical(address, size, modrm.vector())
+	return modrm.mem.ReadLinear(address, size)
+}
+
+func (modrm *ModRM64) store(address uint64, size uint, value uint64) {
+	checkCanonical(address, size, modrm.vector())
+	modrm.mem.WriteLinear(address, size, value)
+}
+
+func (modrm *ModRM64) GetRM(width uint) uint64 {
+	reg := modrm.reg
+	if modrm.Mod == 3 {
+		return reg.X64.Get(modrm.Rm, width, reg.rex != 0)
+	}
+	return modrm.load(modrm.address(), width/8)
+}
+
+func (modrm *ModRM64) SetRM(width uint, value uint64) {
+	reg := modrm.reg
+	if modrm.Mod == 3 {
+		reg.X64.Set(modrm.Rm, width, reg.rex != 0, value)
+		return
+	}
+	modrm.store(modrm.address(), width/8, value)
+}
+
+func (modrm *ModRM64) GetR(width uint) uint64 {
+	reg := modrm.reg
+	return reg.X64.Get(modrm.RegIndex, width, reg.rex != 0)
+}
+
+func (modrm *ModRM64) SetR(width uint, value uint64) {
+	reg := modrm.reg
+	reg.X64.Set(modrm.RegIndex, width, reg.rex != 0, value)
+}
+
+// step64 fetches and executes the instruction at RIP in 64-bit mode, then delivers its
+// debug traps
+func (cpu *CPU) step64() (err error) {
+	reg := cpu.reg
+	defer cpu.catch64(reg.X64.RIP, &err)
+	reg.retired++
+	cpu.instructionBreakpoint()
+	tf := reg.IsTF()
+	reg.resetPrefixes()
+	if cpu.debug {
+		log.Printf("CS:RIP = %04X:%X%s, Opcode = 0x%02X\n", reg.CS, reg.X64.RIP, reg.codeSymbol(reg.X64.RIP), cpu.long.code8(0))
+	}
+	cpu.execNext64()
+	return cpu.debugTrap(tf)
+}
+
+// catch64 delivers an exception raised by a 64-bit instruction, RIP restored to it
+func (cpu *CPU) catch64(rip uint64, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	e, ok := r.(*Exception)
+	if !ok {
+		panic(r)
+	}
+	cpu.reg.X64.RIP = rip
+	cpu.reg.pendingDB = 0
+	*err = cpu.exception(e)
+}
+
+func (cpu *CPU) execNext64() {
+	instr := cpu.instrSet64[cpu.long.code8(0)]
+	if instr == nil {
+		raise(ExceptionUD)
+	}
+	instr()
+}
+
+// prefix64 a legacy prefix in 64-bit mode; a REX prefix before it is ignored
+func (cpu *CPU) prefix64(apply func()) func() {
+	return func() {
+		reg := cpu.reg
+		reg.X64.RIP += 1
+		reg.rex = 0
+		apply()
+		cpu.execNext64()
+	}
+}
+
+// rex the REX prefixes 40-4F: W selects 64-bit operands, R, X and B extend the ModRM reg,
+// the SIB index and the ModRM r/m, SIB base or opcode register
+func (cpu *CPU) rex() {
+	reg := cpu.reg
+	reg.rex = cpu.long.code8(0)
+	reg.X64.RIP += 1
+	cpu.execNext64()
+}
+
+// lock64 the LOCK prefix in 64-bit mode
+func (cpu *CPU) lock64() {
+	reg := cpu.reg
+	reg.X64.RIP += 1
+	reg.rex = 0
+	if !lockable(cpu.long.code8, true) {
+		raise(ExceptionUD)
+	}
+	if reg.lockPrefix {
+		cpu.execNext64()
+		return
+	}
+	reg.lockPrefix = true
+	reg.bus.Lock()
+	defer reg.bus.Unlock()
+	cpu.execNext64()
+}
+
+// code0F64 the two-byte opcode escape in 64-bit mode: handlers see RIP on the second byte
+func (cpu *CPU) code0F64() {
+	reg := cpu.reg
+	reg.X64.RIP += 1
+	instr := cpu.instrSet0F64[cpu.long.code8(0)]
+	if instr == nil {
+		raise(ExceptionUD)
+	}
+	instr()
+}
+
+// extension64 runs a handler of the x87, SSE and AVX tables in 64-bit mode. Those handlers
+// count the bytes they decode in EIP, which starts at 0 here, and fetch them relative to
+// RIP; their ModRM decodes REX and 64-bit addresses. immediate is the size of the immediate
+// after the operands, which RIP-relative addresses are relative to the end of.
+func (cpu *CPU) extension64(instr func(), immediate uint32) func() {
+	return func() {
+		reg := cpu.reg
+		reg.EIP = 0
+		reg.immediate = immediate
+		instr()
+		reg.X64.RIP += uint64(reg.EIP)
+	}
+}
+
+// immediateSize the size of the immediate of an SSE or AVX instruction in the 0F (1), 0F 38
+// (2) or 0F 3A (3) opcode map
+func immediateSize(opcodeMap uint8, code uint8) uint32 {
+	switch {
+	case opcodeMap == 3:
+		return 1
+	case opcodeMap == 1 && (code >= 0x70 && code <= 0x73 || code == 0xc2 || code >= 0xc4 && code <= 0xc6):
+		return 1
+	}
+	return 0
+}
+
+func (cpu *CPU) createTable64() {
+	l := cpu.long
+	table := &cpu.instrSet64
+	for op := uint8(0); op < 8; op++ {
+		for form := uint8(0); form < 6; form++ {
+			table[op<<3|form] = l.arith(op<<3 | form)
+		}
+	}
+	table[0x0f] = cpu.code0F64
+	for _, index := range []uint8{SegES, SegCS, SegSS, SegDS, SegFS, SegGS} {
+		index := index
+		code := [6]uint8{0x26, 0x2e, 0x36, 0x3e, 0x64, 0x65}[index]
+		table[code] = cpu.prefix64(func() { cpu.reg.segOverride = int8(index) })
+	}
+	for code := 0x40; code <= 0x4f; code++ {
+		table[code] = cpu.rex
+	}
+	for code := 0x50; code <= 0x57; code++ {
+		table[code] = l.pushReg
+		table[code+8] = l.popReg
+	}
+	table[0x63] = l.movsxd
+	table[0x66] = cpu.prefix64(func() { cpu.reg.opOverride = true })
+	table[0x67] = cpu.prefix64(func() { cpu.reg.addrOverride = true })
+	table[0x68] = l.pushImm(4)
+	table[0x69] = l.imulImm(4)
+	table[0x6a] = l.pushImm(1)
+	table[0x6b] = l.imulImm(1)
+	for code := 0x70; code <= 0x7f; code++ {
+		table[code] = l.jcc(1)
+	}
+	table[0x80] = l.group1(0x80)
+	table[0x81] = l.group1(0x81)
+	table[0x83] = l.group1(0x83)
+	table[0x84] = l.test(8)
+	table[0x85] = l.test(0)
+	table[0x86] = l.xchg(8)
+	table[0x87] = l.xchg(0)
+	table[0x88] = l.movStore(8)
+	table[0x89] = l.movStore(0)
+	table[0x8a] = l.movLoad(8)
+	table[0x8b] = l.movLoad(0)
+	table[0x8c] = l.movFromSreg
+	table[0x8d] = l.lea
+	table[0x8e] = l.movToSreg
+	table[0x8f] = l.popRM
+	table[0x90] = l.nop
+	for code := 0x91; code <= 0x97; code++ {
+		table[code] = l.xchgAccumulator
+	}
+	table[0x98] = l.convert
+	table[0x99] = l.convertDouble
+	table[0x9b] = l.fwait
+	table[0x9c] = l.pushf
+	table[0x9d] = l.popf
+	table[0x9e] = l.sahf
+	table[0x9f] = l.lahf
+	table[0xa0] = l.movOffset(8, false)
+	table[0xa1] = l.movOffset(0, false)
+	table[0xa2] = l.movOffset(8, true)
+	table[0xa3] = l.movOffset(0, true)
+	table[0xa4] = l.str(stringMovs, 8)
+	table[0xa5] = l.str(stringMovs, 0)
+	table[0xa6] = l.str(stringCmps, 8)
+	table[0xa7] = l.str(stringCmps, 0)
+	table[0xa8] = l.testAccumulator(8)
+	table[0xa9] = l.testAccumulator(0)
+	table[0xaa] = l.str(stringStos, 8)
+	table[0xab] = l.str(stringStos, 0)
+	table[0xac] = l.str(stringLods, 8)
+	table[0xad] = l.str(stringLods, 0)
+	table[0xae] = l.str(stringScas, 8)
+	table[0xaf] = l.str(stringScas, 0)
+	for code := 0xb0; code <= 0xb7; code++ {
+		table[code] = l.movImm(8)
+		table[code+8] = l.movImm(0)
+	}
+	table[0xc0] = l.group2(8, shiftImm)
+	table[0xc1] = l.group2(0, shiftImm)
+	table[0xc2] = l.ret(true)
+	table[0xc3] = l.ret(false)
+	table[0xc4] = cpu.extension64(cpu.instrSet32[0xc4], 0)
+	table[0xc5] = cpu.extension64(cpu.instrSet32[0xc5], 0)
+	table[0xc6] = l.movStoreImm(8)
+	table[0xc7] = l.movStoreImm(0)
+	table[0xc8] = l.enter
+	table[0xc9] = l.leave
+	table[0xca] = l.retFar(true)
+	table[0xcb] = l.retFar(false)
+	table[0xcc] = l.int3
+	table[0xcd] = l.intImm8
+	table[0xcf] = l.iret
+	table[0xd0] = l.group2(8, shiftOne)
+	table[0xd1] = l.group2(0, shiftOne)
+	table[0xd2] = l.group2(8, shiftCL)
+	table[0xd3] = l.group2(0, shiftCL)
+	table[0xd7] = l.xlat
+	for code := 0xd8; code <= 0xdf; code++ {
+		table[code] = cpu.extension64(cpu.fpu.Escape, 0)
+	}
+	table[0xe0] = l.loop(loopNE)
+	table[0xe1] = l.loop(loopE)
+	table[0xe2] = l.loop(loopAlways)
+	table[0xe3] = l.jrcxz
+	table[0xe4] = cpu.io.port64(true, 8, true)
+	table[0xe5] = cpu.io.port64(true, 0, true)
+	table[0xe6] = cpu.io.port64(false, 8, true)
+	table[0xe7] = cpu.io.port64(false, 0, true)
+	table[0xe8] = l.callRel
+	table[0xe9] = l.jmpRel(4)
+	table[0xeb] = l.jmpRel(1)
+	table[0xec] = cpu.io.port64(true, 8, false)
+	table[0xed] = cpu.io.port64(true, 0, false)
+	table[0xee] = cpu.io.port64(false, 8, false)
+	table[0xef] = cpu.io.port64(false, 0, false)
+	table[0xf0] = cpu.lock64
+	table[0xf1] = l.int1
+	table[0xf2] = cpu.prefix64(func() { cpu.reg.repPrefix = 0xf2 })
+	table[0xf3] = cpu.prefix64(func() { cpu.reg.repPrefix = 0xf3 })
+	table[0xf4] = cpu.legacy64(cpu.system.Hlt, 1)
+	table[0xf5] = l.flag(FlagCF, flagComplement)
+	table[0xf6] = l.group3(8)
+	table[0xf7] = l.group3(0)
+	table[0xf8] = l.flag(FlagCF, flagClear)
+	table[0xf9] = l.flag(FlagCF, flagSet)
+	table[0xfa] = cpu.legacy64(cpu.system.Cli, 1)
+	table[0xfb] = cpu.legacy64(cpu.system.Sti, 1)
+	table[0xfc] = l.flag(FlagDF, flagClear)
+	table[0xfd] = l.flag(FlagDF, flagSet)
+	table[0xfe] = l.group4
+	table[0xff] = l.group5
+
+	s := cpu.system
+	table0F := &cpu.instrSet0F64
+	table0F[0x00] = s.group6
+	table0F[0x01] = s.group7
+	table0F[0x05] = s.syscall
+	table0F[0x06] = cpu.legacy64(s.Clts, 1)
+	table0F[0x07] = s.sysret
+	table0F[0x0b] = l.ud2
+	table0F[0x0d] = l.hintNop
+	for code := 0x18; code <= 0x1f; code++ {
+		table0F[code] = l.hintNop
+	}
+	table0F[0x20] = s.movFromCR
+	table0F[0x21] = s.movFromDR
+	table0F[0x22] = s.movToCR
+	table0F[0x23] = s.movToDR
+	table0F[0x30] = s.wrmsr64
+	table0F[0x31] = s.rdtsc64
+	table0F[0x32] = s.rdmsr64
+	for code := 0x40; code <= 0x4f; code++ {
+		table0F[code] = l.cmov
+	}
+	for code := 0x80; code <= 0x8f; code++ {
+		table0F[code] = l.jcc(4)
+	}
+	for code := 0x90; code <= 0x9f; code++ {
+		table0F[code] = l.setcc
+	}
+	table0F[0xa0] = l.pushSreg(SegFS)
+	table0F[0xa1] = l.popSreg(SegFS)
+	table0F[0xa2] = s.cpuid64
+	table0F[0xa3] = l.bitTest(bitTestOnly)
+	table0F[0xa4] = l.doubleShift(true, true)
+	table0F[0xa5] = l.doubleShift(true, false)
+	table0F[0xa8] = l.pushSreg(SegGS)
+	table0F[0xa9] = l.popSreg(SegGS)
+	table0F[0xab] = l.bitTest(bitTestSet)
+	table0F[0xac] = l.doubleShift(false, true)
+	table0F[0xad] = l.doubleShift(false, false)
+	table0F[0xae] = cpu.extension64(cpu.sse.Group15, 0)
+	table0F[0xaf] = l.imul
+	table0F[0xb0] = l.cmpxchg(8)
+	table0F[0xb1] = l.cmpxchg(0)
+	table0F[0xb3] = l.bitTest(bitTestReset)
+	table0F[0xb6] = l.movExtend(8, false)
+	table0F[0xb7] = l.movExtend(16, false)
+	table0F[0xb8] = l.popcnt
+	table0F[0xba] = l.group8
+	table0F[0xbb] = l.bitTest(bitTestFlip)
+	table0F[0xbc] = l.bitScan(false)
+	table0F[0xbd] = l.bitScan(true)
+	table0F[0xbe] = l.movExtend(8, true)
+	table0F[0xbf] = l.movExtend(16, true)
+	table0F[0xc0] = l.xadd(8)
+	table0F[0xc1] = l.xadd(0)
+	table0F[0xc7] = l.group9
+	for code := 0xc8; code <= 0xcf; code++ {
+		table0F[code] = l.bswap
+	}
+	simd := [][2]int{{0x10, 0x17}, {0x28, 0x2f}, {0x38, 0x38}, {0x50, 0x7f},
+		{0xc2, 0xc6}, {0xd0, 0xff}}
+	for _, r := range simd {
+		for code := r[0]; code <= r[1]; code++ {
+			if instr := cpu.instrSet0F32[code]; instr != nil {
+				table0F[code] = cpu.extension64(instr, immediateSize(1, uint8(code)))
+			}
+		}
+	}
+	table0F[0x3a] = cpu.extension64(cpu.instrSet0F32[0x3a], immediateSize(3, 0))
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestLong runs code in 64-bit mode from preset registers and checks registers and flags
+func TestLong(t *testing.T) {
+	const (
+		noncanonical = 0x8000000000000000
+		pattern      = 0xbe1edefcfabd75da
+	)
+	tests := []struct {
+		name  string
+		code  []byte
+		in    map[uint8]uint64 // registers by number
+		want  map[uint8]uint64
+		flags uint32 // EFLAGS bits that must be set
+		err   string
+	}{
+		// a non-canonical address raises #SS through RSP and RBP, #GP through R12 and R13
+		{"rsp", []byte{0x8b, 0x04, 0x24}, // mov (%rsp),%eax
+			map[uint8]uint64{4: noncanonical}, nil, 0, "#SS"},
+		{"rbp", []byte{0x8b, 0x45, 0x08}, // mov 0x8(%rbp),%eax
+			map[uint8]uint64{5: noncanonical}, nil, 0, "#SS"},
+		{"r12", []byte{0x41, 0x8b, 0x04, 0x24}, // mov (%r12),%eax
+			map[uint8]uint64{12: noncanonical}, nil, 0, "#GP"},
+		{"r13", []byte{0x41, 0x8b, 0x45, 0x08}, // mov 0x8(%r13),%eax
+			map[uint8]uint64{13: noncanonical}, nil, 0, "#GP"},
+		{"r12 sib", []byte{0x41, 0x8b, 0x04, 0x04}, // mov (%r12,%rax,1),%eax
+			map[uint8]uint64{12: noncanonical}, nil, 0, "#GP"},
+		{"r12 sse", []byte{0xf3, 0x41, 0x0f, 0x7e, 0x04, 0x24}, // movq (%r12),%xmm0
+			map[uint8]uint64{12: noncanonical}, nil, 0, "#GP"},
+		{"rsp sse", []byte{0xf3, 0x0f, 0x7e, 0x04, 0x24}, // movq (%rsp),%xmm0
+			map[uint8]uint64{4: noncanonical}, nil, 0, "#SS"},
+		// a masked count of zero keeps the flags but zero-extends a 32-bit register
+		{"rol cl", []byte{0xf9, 0xd3, 0xc0}, // stc; rol %cl,%eax
+			map[uint8]uint64{0: pattern, 1: 0x20}, map[uint8]uint64{0: 0xfabd75da}, FlagCF, ""},
+		{"shl 0", []byte{0xf9, 0xc1, 0xe2, 0x00}, // stc; shl $0,%edx
+			map[uint8]uint64{2: pattern}, map[uint8]uint64{2: 0xfabd75da}, FlagCF, ""},
+		{"shld cl", []byte{0xf9, 0x0f, 0xa5, 0xd8}, // stc; shld %cl,%ebx,%eax
+			map[uint8]uint64{0: pattern, 1: 0x20, 3: pattern}, map[uint8]uint64{0: 0xfabd75da}, FlagCF, ""},
+		{"shrd 0", []byte{0xf9, 0x0f, 0xac, 0xda, 0x00}, // stc; shrd $0,%ebx,%edx
+			map[uint8]uint64{2: pattern}, map[uint8]uint64{2: 0xfabd75da}, FlagCF, ""},
+		{"rol cl 64", []byte{0xf9, 0x48, 0xd3, 0xc0}, // stc; rol %cl,%rax
+			map[uint8]uint64{0: pattern, 1: 0x40}, map[uint8]uint64{0: pattern}, FlagCF, ""},
+		// BMI1 and BMI2 take 64-bit operands with VEX.W and any of the 16 registers in vvvv
+		{"andn", []byte{0xc4, 0xe2, 0xe0, 0xf2, 0xc1}, // andn %rcx,%rbx,%rax
+			map[uint8]uint64{1: ^uint64(0), 3: 0x00ff00ff00000000}, map[uint8]uint64{0: 0xff00ff00ffffffff}, FlagSF, ""},
+		{"andn r11", []byte{0xc4, 0x42, 0xa8, 0xf2, 0xd9}, // andn %r9,%r10,%r11
+			map[uint8]uint64{9: 0xff, 10: 0xf}, map[uint8]uint64{11: 0xf0}, 0, ""},
+		{"bextr", []byte{0xc4, 0xe2, 0xf0, 0xf7, 0xc3}, // bextr %rcx,%rbx,%rax
+			map[uint8]uint64{1: 0x0c28, 3: 0x123456789abcdef0}, map[uint8]uint64{0: 0x456}, 0, ""},
+		{"blsr", []byte{0xc4, 0xe2, 0xf8, 0xf3, 0xcb}, // blsr %rbx,%rax
+			map[uint8]uint64{3: 0x8000000100000000}, map[uint8]uint64{0: 0x8000000000000000}, FlagSF, ""},
+		{"blsmsk", []byte{0xc4, 0xe2, 0xf8, 0xf3, 0xd3}, // blsmsk %rbx,%rax
+			map[uint8]uint64{3: 0x100000000}, map[uint8]uint64{0: 0x1ffffffff}, 0, ""},
+		{"blsi r12", []byte{0xc4, 0xe2, 0x98, 0xf3, 0xdb}, // blsi %rbx,%r12
+			map[uint8]uint64{3: 0x8000000100000000}, map[uint8]uint64{12: 0x100000000}, FlagCF, ""},
+		{"bzhi", []byte{0xc4, 0xe2, 0xf0, 0xf5, 0xc3}, // bzhi %rcx,%rbx,%rax
+			map[uint8]uint64{1: 40, 3: ^uint64(0)}, map[uint8]uint64{0: 0xffffffffff}, 0, ""},
+		{"bzhi 64", []byte{0xc4, 0xe2, 0xf0, 0xf5, 0xc3},
+			map[uint8]uint64{1: 64, 3: ^uint64(0)}, map[uint8]uint64{0: ^uint64(0)}, FlagCF | FlagSF, ""},
+		{"pdep", []byte{0xc4, 0xe2, 0xe3, 0xf5, 0xc1}, // pdep %rcx,%rbx,%rax
+			map[uint8]uint64{1: 0xf000000000000001, 3: 5}, map[uint8]uint64{0: 0x2000000000000001}, 0, ""},
+		{"pext", []byte{0xc4, 0xe2, 0xe2, 0xf5, 0xc1}, // pext %rcx,%rbx,%rax
+			map[uint8]uint64{1: 0xf000000000000001, 3: 0x2000000000000001}, map[uint8]uint64{0: 5}, 0, ""},
+		{"shlx", []byte{0xc4, 0xe2, 0xf1, 0xf7, 0xc3}, // shlx %rcx,%rbx,%rax
+			map[uint8]uint64{1: 40, 3: 1}, map[uint8]uint64{0: 1 << 40}, 0, ""},
+		{"sarx", []byte{0xc4, 0xe2, 0xf2, 0xf7, 0xc3}, // sarx %rcx,%rbx,%rax
+			map[uint8]uint64{1: 63, 3: 1 << 63}, map[uint8]uint64{0: ^uint64(0)}, 0, ""},
+		{"shrx", []byte{0xc4, 0xe2, 0xf3, 0xf7, 0xc3}, // shrx %rcx,%rbx,%rax
+			map[uint8]uint64{1: 127, 3: 1 << 63}, map[uint8]uint64{0: 1}, 0, ""},
+		{"rorx", []byte{0xc4, 0xe3, 0xfb, 0xf0, 0xc3, 0x08}, // rorx $8,%rbx,%rax
+			map[uint8]uint64{3: 0x12}, map[uint8]uint64{0: 0x1200000000000000}, 0, ""},
+		{"mulx", []byte{0xc4, 0xe2, 0xfb, 0xf6, 0xcb}, // mulx %rbx,%rax,%rcx
+			map[uint8]uint64{2: ^uint64(0), 3: 2}, map[uint8]uint64{0: 0xfffffffffffffffe, 1: 1}, 0, ""},
+		{"mulx 32", []byte{0xc4, 0xe2, 0x7b, 0xf6, 0xcb}, // mulx %ebx,%eax,%ecx
+			map[uint8]uint64{0: pattern, 2: 0xffffffff00000003, 3: 0xffffffff80000002},
+			map[uint8]uint64{0: 0x80000006, 1: 1}, 0, ""},
+		// a zero source gives TZCNT the operand size and CF
+		{"tzcnt", []byte{0xf3, 0x48, 0x0f, 0xbc, 0xc3}, // tzcnt %rbx,%rax
+			map[uint8]uint64{3: 1 << 40}, map[uint8]uint64{0: 40}, 0, ""},
+		{"tzcnt zero", []byte{0xf3, 0x48, 0x0f, 0xbc, 0xc3},
+			map[uint8]uint64{3: 0}, map[uint8]uint64{0: 64}, FlagCF, ""},
+		// the generator seeded with zero delivers 0xe220a8397b1dcdaf first
+		{"rdrand", []byte{0x48, 0x0f, 0xc7, 0xf0}, // rdrand %rax
+			nil, map[uint8]uint64{0: 0xe220a8397b1dcdaf}, FlagCF, ""},
+		{"rdseed", []byte{0x48, 0x0f, 0xc7, 0xf8}, // rdseed %rax
+			nil, map[uint8]uint64{0: 0xe220a8397b1dcdaf}, FlagCF, ""},
+		{"rdrand 32", []byte{0x0f, 0xc7, 0xf0}, // rdrand %eax
+			map[uint8]uint64{0: pattern}, map[uint8]uint64{0: 0x7b1dcdaf}, FlagCF, ""},
+		{"rdrand memory", []byte{0x48, 0x0f, 0xc7, 0x30}, // rdrand on (%rax)
+			nil, nil, 0, "#UD"},
+	}
+	for _, test := range tests {
+		emu := newBare(t, 64, append(test.code, 0xf4))
+		cpu := emu.cpu.(*CPU)
+		cpu.reg.CR4 |= CR4OSFXSR
+		x := &cpu.reg.X64
+		for i, value := range test.in {
+			*x.register(i) = value
+		}
+		err := emu.Run()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for i, value := range test.want {
+			if got := *x.register(i); got != value {
+				t.Errorf("%s: register %d = %#x, want %#x", test.name, i, got, value)
+			}
+		}
+		if flags := cpu.reg.EFlags & test.flags; flags != test.flags {
+			t.Errorf("%s: EFLAGS %#x, want %#x set", test.name, cpu.reg.EFlags, test.flags)
+		}
+	}
+}
@@ -0,0 +1,1040 @@
+package core
+
+import "math/bits"
+
+// Arithmetic, logic, data transfer and string instructions of 64-bit mode. Operands are up
+// to 64 bits wide; 32-bit results zero-extend into the 64-bit registers.
+
+// ALU operations, the /digit of group 1 and bits 5:3 of the arithmetic opcodes 00-3D
+const (
+	aluAdd = 0
+	aluOr  = 1
+	aluAdc = 2
+	aluSbb = 3
+	aluAnd = 4
+	aluSub = 5
+	aluXor = 6
+	aluCmp = 7
+)
+
+// alu the operation op on a and b of width bits, with the carry in for ADC and SBB. It returns
+// the result and the arithmetic flags.
+func alu(op uint8, a uint64, b uint64, width uint, cf bool) (uint64, uint32) {
+	mask := laneMask(width)
+	a, b = a&mask, b&mask
+	var carry uint64
+	if cf && (op == aluAdc || op == aluSbb) {
+		carry = 1
+	}
+	var result, out uint64
+	switch op {
+	case aluOr:
+		result = a | b
+	case aluAnd:
+		result = a & b
+	case aluXor:
+		result = a ^ b
+	case aluAdd, aluAdc:
+		result, out = bits.Add64(a, b, carry)
+	default:
+		result, out = bits.Sub64(a, b, carry)
+	}
+	if op == aluOr || op == aluAnd || op == aluXor {
+		return result, resultFlags(result, width)
+	}
+	if width < 64 {
+		out = result >> width & 1
+	}
+	overflow := (a ^ result) & (b ^ result)
+	if op == aluSub || op == aluSbb || op == aluCmp {
+		overflow = (a ^ b) & (a ^ result)
+	}
+	flags := resultFlags(result, width) | carryFlag(out != 0)
+	if (a^b^result)&0x10 != 0 {
+		flags |= FlagAF
+	}
+	if overflow>>(width-1)&1 != 0 {
+		flags |= FlagOF
+	}
+	return result & mask, flags
+}
+
+// operate applies op to dst and src, stores the result unless op is CMP and sets the flags
+func (l *Long) operate(op uint8, dst uint64, src uint64, width uint, store func(value uint64)) {
+	reg := l.reg
+	result, flags := alu(op, dst, src, width, reg.IsCF())
+	if op != aluCmp {
+		store(result)
+	}
+	reg.setEFlags(flags, arithFlagsMask)
+}
+
+// byteWidth the operand size of an instruction with byte and full-size forms: 8 bits for
+// the byte form, otherwise that of the instruction
+func (l *Long) byteWidth(width uint) uint {
+	if width == 8 {
+		return 8
+	}
+	return l.width()
+}
+
+// arith ADD, OR, ADC, SBB, AND, SUB, XOR and CMP (00-3D): r/m, r; r, r/m; and the
+// accumulator with an immediate, sign-extended for 64-bit operands
+func (l *Long) arith(code uint8) func() {
+	op, form := code>>3, code&7
+	return func() {
+		width := l.width()
+		if form&1 == 0 {
+			width = 8
+		}
+		switch form {
+		case 0, 1:
+			modrm := l.decode(0)
+			l.operate(op, modrm.GetRM(width), modrm.GetR(width), width, func(v uint64) { modrm.SetRM(width, v) })
+		case 2, 3:
+			modrm := l.decode(0)
+			l.operate(op, modrm.GetR(width), modrm.GetRM(width), width, func(v uint64) { modrm.SetR(width, v) })
+		default:
+			l.reg.X64.RIP += 1
+			src := l.immSigned(immSize(width))
+			l.operate(op, l.getReg(0, width), src, width, func(v uint64) { l.setReg(0, width, v) })
+		}
+	}
+}
+
+// group1 the ALU operations on r/m with an immediate (80, 81, 83); 82 does not exist in
+// 64-bit mode
+func (l *Long) group1(code uint8) func() {
+	return func() {
+		width, size := uint(8), uint(1)
+		if code != 0x80 {
+			width = l.width()
+			size = immSize(width)
+		}
+		if code == 0x83 {
+			size = 1
+		}
+		modrm := l.decode(size)
+		src := l.immSigned(size)
+		l.operate(modrm.Opcode, modrm.GetRM(width), src, width, func(v uint64) { modrm.SetRM(width, v) })
+	}
+}
+
+// test TEST r/m, r (84, 85)
+func (l *Long) test(width uint) func() {
+	return func() {
+		width := l.byteWidth(width)
+		modrm := l.decode(0)
+		result := modrm.GetRM(width) & modrm.GetR(width)
+		l.reg.setEFlags(resultFlags(result, width), arithFlagsMask)
+	}
+}
+
+// testAccumulator TEST AL/AX/EAX/RAX, imm (A8, A9)
+func (l *Long) testAccumulator(width uint) func() {
+	return func() {
+		width := l.byteWidth(width)
+		l.reg.X64.RIP += 1
+		result := l.getReg(0, width) & l.immSigned(immSize(width))
+		l.reg.setEFlags(resultFlags(result, width), arithFlagsMask)
+	}
+}
+
+// xchg XCHG r/m, r (86, 87), locked with a memory operand
+func (l *Long) xchg(width uint) func() {
+	return func() {
+		reg := l.reg
+		width := l.byteWidth(width)
+		modrm := l.decode(0)
+		if modrm.Mod != 3 && !reg.lockPrefix {
+			reg.bus.Lock()
+			defer reg.bus.Unlock()
+		}
+		dst, src := modrm.GetRM(width), modrm.GetR(width)
+		modrm.SetRM(width, src)
+		modrm.SetR(width, dst)
+	}
+}
+
+// xchgAccumulator XCHG rAX, r (91-97)
+func (l *Long) xchgAccumulator() {
+	width := l.width()
+	index := l.opcodeReg()
+	l.reg.X64.RIP += 1
+	a, b := l.getReg(0, width), l.getReg(index, width)
+	l.setReg(0, width, b)
+	l.setReg(index, width, a)
+}
+
+// nop NOP and PAUSE (90, F3 90); with REX.B it is XCHG R8, rAX
+func (l *Long) nop() {
+	if l.reg.rex&1 != 0 {
+		l.xchgAccumulator()
+		return
+	}
+	l.reg.X64.RIP += 1
+}
+
+// hintNop the multi-byte NOP and prefetch hints (0F 0D, 0F 18-1F /r)
+func (l *Long) hintNop() {
+	l.decode(0)
+}
+
+func (l *Long) ud2() {
+	raise(ExceptionUD)
+}
+
+// fwait WAIT (9B) reports pending x87 exceptions
+func (l *Long) fwait() {
+	reg := l.reg
+	if reg.CR0&(CR0MP|CR0TS) == CR0MP|CR0TS {
+		raise(ExceptionNM)
+	}
+	fpuPending(reg)
+	reg.X64.RIP += 1
+}
+
+// movStore MOV r/m, r (88, 89)
+func (l *Long) movStore(width uint) func() {
+	return func() {
+		width := l.byteWidth(width)
+		modrm := l.decode(0)
+		modrm.SetRM(width, modrm.GetR(width))
+	}
+}
+
+// movLoad MOV r, r/m (8A, 8B)
+func (l *Long) movLoad(width uint) func() {
+	return func() {
+		width := l.byteWidth(width)
+		modrm := l.decode(0)
+		modrm.SetR(width, modrm.GetRM(width))
+	}
+}
+
+// movStoreImm MOV r/m, imm (C6 /0, C7 /0), the immediate sign-extended for 64-bit operands
+func (l *Long) movStoreImm(width uint) func() {
+	return func() {
+		width := l.byteWidth(width)
+		size := immSize(width)
+		modrm := l.decode(size)
+		if modrm.Opcode != 0 {
+			raise(ExceptionUD)
+		}
+		modrm.SetRM(width, l.immSigned(size))
+	}
+}
+
+// movImm MOV r, imm (B0-BF): the only instruction with a full 64-bit immediate
+func (l *Long) movImm(width uint) func() {
+	return func() {
+		width := l.byteWidth(width)
+		index := l.opcodeReg()
+		l.reg.X64.RIP += 1
+		l.setReg(index, width, l.imm(width/8))
+	}
+}
+
+// movOffset MOV AL/AX/EAX/RAX to and from moffs (A0-A3), a 64-bit absolute address, 32-bit with
+// the 67 prefix
+func (l *Long) movOffset(width uint, store bool) func() {
+	return func() {
+		reg := l.reg
+		width := l.byteWidth(width)
+		reg.X64.RIP += 1
+		size := uint(8)
+		if reg.addrOverride {
+			size = 4
+		}
+		offset := l.imm(size)
+		address := reg.dataBase() + offset
+		if store {
+			l.write(address, width/8, l.getReg(0, width), ExceptionGP)
+			return
+		}
+		l.setReg(0, width, l.read(address, width/8, ExceptionGP))
+	}
+}
+
+// lea LEA r, m (8D)
+func (l *Long) lea() {
+	width := l.width()
+	modrm := l.decode(0)
+	if modrm.Mod == 3 {
+		raise(ExceptionUD)
+	}
+	modrm.SetR(width, modrm.offset())
+}
+
+// movsxd MOVSXD r64, r/m32 (63); without REX.W it is a plain move
+func (l *Long) movsxd() {
+	width := l.width()
+	modrm := l.decode(0)
+	if width == 64 {
+		modrm.SetR(64, uint64(signExtend(modrm.GetRM(32), 32)))
+		return
+	}
+	modrm.SetR(width, modrm.GetRM(width))
+}
+
+// movExtend MOVZX and MOVSX r, r/m8 and r/m16 (0F B6, B7, BE, BF)
+func (l *Long) movExtend(from uint, signed bool) func() {
+	return func() {
+		width := l.width()
+		modrm := l.decode(0)
+		value := modrm.GetRM(from)
+		if signed {
+			value = uint64(signExtend(value, from))
+		}
+		modrm.SetR(width, value)
+	}
+}
+
+// convert CBW, CWDE and CDQE (98): sign-extends the lower half of rAX into it
+func (l *Long) convert() {
+	width := l.width()
+	l.reg.X64.RIP += 1
+	l.setReg(0, width, uint64(signExtend(l.getReg(0, width/2), width/2)))
+}
+
+// convertDouble CWD, CDQ and CQO (99): fills rDX with the sign of rAX
+func (l *Long) convertDouble() {
+	width := l.width()
+	l.reg.X64.RIP += 1
+	l.setReg(2, width, uint64(signExtend(l.getReg(0, width), width)>>63))
+}
+
+// xlat XLAT (D7): AL = [rBX + AL]
+func (l *Long) xlat() {
+	reg := l.reg
+	reg.X64.RIP += 1
+	offset := (reg.X64.RBX + reg.X64.RAX&0xff) & l.addressMask()
+	l.setReg(0, 8, l.read(reg.dataBase()+offset, 1, ExceptionGP))
+}
+
+// cmov CMOVcc r, r/m (0F 40-4F): the source is read even when the condition is false, and
+// a 32-bit destination is zero-extended either way
+func (l *Long) cmov() {
+	reg := l.reg
+	cc := l.code8(0) & 0xf
+	width := l.width()
+	modrm := l.decode(0)
+	value := modrm.GetRM(width)
+	if !reg.condition(cc) {
+		value = modrm.GetR(width)
+	}
+	modrm.SetR(width, value)
+}
+
+// setcc SETcc r/m8 (0F 90-9F)
+func (l *Long) setcc() {
+	cc := l.code8(0) & 0xf
+	modrm := l.decode(0)
+	var value uint64
+	if l.reg.condition(cc) {
+		value = 1
+	}
+	modrm.SetRM(8, value)
+}
+
+// Flag operations of CLC, STC, CMC, CLD and STD
+const (
+	flagClear      = 0
+	flagSet        = 1
+	flagComplement = 2
+)
+
+func (l *Long) flag(flag uint32, op int) func() {
+	return func() {
+		reg := l.reg
+		reg.X64.RIP += 1
+		switch op {
+		case flagClear:
+			reg.setEFlags(0, flag)
+		case flagSet:
+			reg.setEFlags(flag, flag)
+		default:
+			reg.setEFlags(reg.EFlags^flag, flag)
+		}
+	}
+}
+
+// sahf SAHF (9E) and lahf LAHF (9F) need CPUID.80000001H:ECX.LAHF in 64-bit mode
+func (l *Long) sahf() {
+	reg := l.reg
+	if reg.features().ExtECX&FeatureLAHF == 0 {
+		raise(ExceptionUD)
+	}
+	reg.X64.RIP += 1
+	reg.setEFlags(uint32(reg.X64.RAX>>8), FlagSF|FlagZF|FlagAF|FlagPF|FlagCF)
+}
+
+func (l *Long) lahf() {
+	reg := l.reg
+	if reg.features().ExtECX&FeatureLAHF == 0 {
+		raise(ExceptionUD)
+	}
+	reg.X64.RIP += 1
+	flags := reg.EFlags&(FlagSF|FlagZF|FlagAF|FlagPF|FlagCF) | 0x2
+	reg.X64.RAX = reg.X64.RAX&^0xff00 | uint64(flags)<<8
+}
+
+// group4 INC and DEC r/m8 (FE /0, /1)
+func (l *Long) group4() {
+	modrm := l.decode(0)
+	if modrm.Opcode > 1 {
+		raise(ExceptionUD)
+	}
+	l.incDec(&modrm, 8)
+}
+
+// incDec INC and DEC r/m: CF is left alone
+func (l *Long) incDec(modrm *ModRM64, width uint) {
+	op := uint8(aluAdd)
+	if modrm.Opcode == 1 {
+		op = aluSub
+	}
+	result, flags := alu(op, modrm.GetRM(width), 1, width, false)
+	modrm.SetRM(width, result)
+	l.reg.setEFlags(flags, arithFlagsMask&^FlagCF)
+}
+
+// group3 TEST r/m, imm, NOT, NEG, MUL, IMUL, DIV and IDIV (F6, F7)
+func (l *Long) group3(width uint) func() {
+	return func() {
+		reg := l.reg
+		width := l.byteWidth(width)
+		size := uint(0)
+		if l.code8(1)>>3&7 <= 1 {
+			size = immSize(width)
+		}
+		modrm := l.decode(size)
+		switch modrm.Opcode {
+		case 0, 1:
+			result := modrm.GetRM(width) & l.immSigned(size)
+			reg.setEFlags(resultFlags(result, width), arithFlagsMask)
+		case 2:
+			modrm.SetRM(width, ^modrm.GetRM(width))
+		case 3:
+			src := modrm.GetRM(width)
+			result, flags := alu(aluSub, 0, src, width, false)
+			modrm.SetRM(width, result)
+			reg.setEFlags(flags&^FlagCF|carryFlag(src&laneMask(width) != 0), arithFlagsMask)
+		case 4, 5:
+			l.multiply(modrm.GetRM(width), width, modrm.Opcode == 5)
+		default:
+			l.divide(modrm.GetRM(width), width, modrm.Opcode == 7)
+		}
+	}
+}
+
+// accumulatorPair reads rDX:rAX, or AX for byte operands
+func (l *Long) accumulatorPair(width uint) (uint64, uint64) {
+	if width == 8 {
+		ax := l.getReg(0, 16)
+		return ax >> 8, ax & 0xff
+	}
+	return l.getReg(2, width), l.getReg(0, width)
+}
+
+func (l *Long) setAccumulatorPair(width uint, high uint64, low uint64) {
+	if width == 8 {
+		l.setReg(0, 16, high<<8|low&0xff)
+		return
+	}
+	l.setReg(0, width, low)
+	l.setReg(2, width, high)
+}
+
+// multiply MUL and IMUL r/m: rDX:rAX = rAX * src; CF and OF tell whether the upper half is
+// significant
+func (l *Long) multiply(src uint64, width uint, signed bool) {
+	_, a := l.accumulatorPair(width)
+	high, low := multiplyWide(a, src, width, signed)
+	l.setAccumulatorPair(width, high, low)
+	l.multiplyFlags(high, low, width, signed)
+}
+
+// multiplyWide the double width product of a and b, width bits each, split in halves
+func multiplyWide(a uint64, b uint64, width uint, signed bool) (uint64, uint64) {
+	mask := laneMask(width)
+	if width == 64 {
+		high, low := bits.Mul64(a, b)
+		if signed {
+			if int64(a) < 0 {
+				high -= b
+			}
+			if int64(b) < 0 {
+				high -= a
+			}
+		}
+		return high, low
+	}
+	product := (a & mask) * (b & mask)
+	if signed {
+		product = uint64(signExtend(a, width) * signExtend(b, width))
+	}
+	return product >> width & mask, product & mask
+}
+
+func (l *Long) multiplyFlags(high uint64, low uint64, width uint, signed bool) {
+	significant := high != 0
+	if signed {
+		significant = high != uint64(signExtend(low, width)>>63)&laneMask(width)
+	}
+	var flags uint32
+	if significant {
+		flags = FlagCF | FlagOF
+	}
+	l.reg.setEFlags(flags|resultFlags(low, width), arithFlagsMask)
+}
+
+// divide DIV and IDIV r/m: rAX = rDX:rAX / src and rDX the remainder. #DE for a zero divisor
+// or a quotient out of range.
+func (l *Long) divide(src uint64, width uint, signed bool) {
+	high, low := l.accumulatorPair(width)
+	mask := laneMask(width)
+	src &= mask
+	if src == 0 {
+		raise(ExceptionDE)
+	}
+	var quotient, remainder uint64
+	switch {
+	case !signed && width == 64:
+		if high >= src {
+			raise(ExceptionDE)
+		}
+		quotient, remainder = bits.Div64(high, low, src)
+	case !signed:
+		dividend := high<<width | low
+		quotient, remainder = dividend/src, dividend%src
+		if quotient > mask {
+			raise(ExceptionDE)
+		}
+	case width == 64:
+		negative, divisorNegative := int64(high) < 0, int64(src) < 0
+		if negative {
+			low, high = negate128(high, low)
+		}
+		divisor := src
+		if divisorNegative {
+			divisor = -divisor
+		}
+		if high >= divisor {
+			raise(ExceptionDE)
+		}
+		quotient, remainder = bits.Div64(high, low, divisor)
+		if negative != divisorNegative {
+			if quotient > 1<<63 {
+				raise(ExceptionDE)
+			}
+			quotient = -quotient
+		} else if quotient >= 1<<63 {
+			raise(ExceptionDE)
+		}
+		if negative {
+			remainder = -remainder
+		}
+	default:
+		dividend := signExtend(high<<width|low, 2*width)
+		divisor := signExtend(src, width)
+		q, r := dividend/divisor, dividend%divisor
+		if q != signExtend(uint64(q), width) {
+			raise(ExceptionDE)
+		}
+		quotient, remainder = uint64(q)&mask, uint64(r)&mask
+	}
+	l.setAccumulatorPair(width, remainder, quotient)
+}
+
+// negate128 the two's complement of high:low, returned as low, high
+func negate128(high uint64, low uint64) (uint64, uint64) {
+	low, borrow := bits.Sub64(0, low, 0)
+	high, _ = bits.Sub64(0, high, borrow)
+	return low, high
+}
+
+// imul IMUL r, r/m (0F AF)
+func (l *Long) imul() {
+	width := l.width()
+	modrm := l.decode(0)
+	high, low := multiplyWide(modrm.GetR(width), modrm.GetRM(width), width, true)
+	modrm.SetR(width, low)
+	l.multiplyFlags(high, low, width, true)
+}
+
+// imulImm IMUL r, r/m, imm (69, 6B)
+func (l *Long) imulImm(size uint) func() {
+	return func() {
+		width := l.width()
+		if size != 1 {
+			size = immSize(width)
+		}
+		modrm := l.decode(size)
+		src := l.immSigned(size)
+		high, low := multiplyWide(modrm.GetRM(width), src, width, true)
+		modrm.SetR(width, low)
+		l.multiplyFlags(high, low, width, true)
+	}
+}
+
+// Shift count sources of group 2
+const (
+	shiftOne = iota // D0, D1
+	shiftCL         // D2, D3
+	shiftImm        // C0, C1
+)
+
+// group2 ROL, ROR, RCL, RCR, SHL, SHR, SAL and SAR r/m (C0, C1, D0-D3). The count is masked
+// to 6 bits for 64-bit operands, 5 otherwise; a zero count changes no flags.
+func (l *Long) group2(width uint, source int) func() {
+	return func() {
+		reg := l.reg
+		width := l.byteWidth(width)
+		size := uint(0)
+		if source == shiftImm {
+			size = 1
+		}
+		modrm := l.decode(size)
+		count := uint64(1)
+		switch source {
+		case shiftCL:
+			count = reg.X64.RCX & 0xff
+		case shiftImm:
+			count = l.imm(1)
+		}
+		if width == 64 {
+			count &= 63
+		} else {
+			count &= 31
+		}
+		value := modrm.GetRM(width)
+		if count == 0 {
+			// the flags stay, but a 32-bit register is still written and so zero-extended
+			if width == 32 && modrm.Mod == 3 {
+				modrm.SetRM(width, value)
+			}
+			return
+		}
+		result, flags, mask := shift(modrm.Opcode, value, uint(count), width, reg.IsCF())
+		modrm.SetRM(width, result)
+		reg.setEFlags(flags, mask)
+	}
+}
+
+// shift the group 2 operation op on value, returning the result, the flags and the flags
+// it changes
+func shift(op uint8, value uint64, count uint, width uint, cf bool) (uint64, uint32, uint32) {
+	mask := laneMask(width)
+	value &= mask
+	msb := func(v uint64) bool { return v>>(width-1)&1 != 0 }
+	var result uint64
+	var carry bool
+	switch op {
+	case 0, 1: // ROL, ROR
+		n := count % width
+		if op == 0 {
+			result = (value<<n | value>>(width-n)) & mask
+			carry = result&1 != 0
+		} else {
+			result = (value>>n | value<<(width-n)) & mask
+			carry = msb(result)
+		}
+		overflow := carry != msb(result)
+		if op == 1 {
+			overflow = msb(result) != (result>>(width-2)&1 != 0)
+		}
+		flags := carryFlag(carry)
+		if overflow {
+			flags |= FlagOF
+		}
+		return result, flags, FlagCF | FlagOF
+	case 2, 3: // RCL, RCR through the carry, a rotation of width+1 bits
+		n := count % (width + 1)
+		result, carry = value, cf
+		for i := uint(0); i < n; i++ {
+			if op == 2 {
+				out := msb(result)
+				result = (result<<1 | b2u(carry)) & mask
+				carry = out
+			} else {
+				out := result&1 != 0
+				result = result>>1 | b2u(carry)<<(width-1)
+				carry = out
+			}
+		}
+		overflow := carry != msb(result)
+		if op == 3 {
+			overflow = msb(result) != (result>>(width-2)&1 != 0)
+		}
+		flags := carryFlag(carry)
+		if overflow {
+			flags |= FlagOF
+		}
+		return result, flags, FlagCF | FlagOF
+	case 4, 6: // SHL, SAL
+		if count > width {
+			result, carry = 0, false
+		} else {
+			carry = value>>(width-count)&1 != 0
+			result = value << count & mask
+		}
+		flags := resultFlags(result, width) | carryFlag(carry)
+		if carry != msb(result) {
+			flags |= FlagOF
+		}
+		return result, flags, arithFlagsMask
+	case 5: // SHR
+		if count > width {
+			result, carry = 0, false
+		} else {
+			carry = value>>(count-1)&1 != 0
+			result = value >> count
+		}
+		flags := resultFlags(result, width) | carryFlag(carry)
+		if count == 1 && msb(value) {
+			flags |= FlagOF
+		}
+		return result, flags, arithFlagsMask
+	}
+	// SAR
+	signed := signExtend(value, width)
+	if count >= width {
+		count = width
+	}
+	carry = signed>>(count-1)&1 != 0
+	result = uint64(signed>>count) & mask
+	return result, resultFlags(result, width) | carryFlag(carry), arithFlagsMask
+}
+
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// doubleShift SHLD and SHRD r/m, r, imm8/CL (0F A4, A5, AC, AD)
+func (l *Long) doubleShift(left bool, immediate bool) func() {
+	return func() {
+		reg := l.reg
+		width := l.width()
+		size := uint(0)
+		if immediate {
+			size = 1
+		}
+		modrm := l.decode(size)
+		count := uint(reg.X64.RCX)
+		if immediate {
+			count = uint(l.imm(1))
+		}
+		if width == 64 {
+			count &= 63
+		} else {
+			count &= 31
+		}
+		dst := modrm.GetRM(width)
+		if count == 0 {
+			if width == 32 && modrm.Mod == 3 {
+				modrm.SetRM(width, dst)
+			}
+			return
+		}
+		src := modrm.GetR(width)
+		var result uint64
+		var carry bool
+		if left {
+			result = dst<<count | src>>(width-count)
+			carry = dst>>(width-count)&1 != 0
+		} else {
+			result = dst>>count | src<<(width-count)
+			carry = dst>>(count-1)&1 != 0
+		}
+		result &= laneMask(width)
+		modrm.SetRM(width, result)
+		flags := resultFlags(result, width) | carryFlag(carry)
+		if (result^dst)>>(width-1)&1 != 0 {
+			flags |= FlagOF
+		}
+		reg.setEFlags(flags, FlagZF|FlagSF|FlagPF|FlagCF|FlagOF)
+	}
+}
+
+// bitTest BT, BTS, BTR and BTC r/m, r (0F A3, AB, B3, BB); a memory operand is addressed
+// by the signed bit offset
+func (l *Long) bitTest(op uint8) func() {
+	return func() {
+		width := l.width()
+		modrm := l.decode(0)
+		offset := modrm.GetR(width)
+		if modrm.Mod == 3 {
+			l.bitTestRM(&modrm, width, op, uint(offset)%width)
+			return
+		}
+		displacement := signExtend(offset, width) >> bits.TrailingZeros(width) * int64(width/8)
+		address := modrm.address() + uint64(displacement)
+		l.bitTestMemory(&modrm, address, width, op, uint(offset)%width)
+	}
+}
+
+// group8 BT, BTS, BTR and BTC r/m, imm8 (0F BA /4-/7)
+func (l *Long) group8() {
+	width := l.width()
+	modrm := l.decode(1)
+	if modrm.Opcode < bitTestOnly {
+		raise(ExceptionUD)
+	}
+	bit := uint(l.imm(1)) % width
+	if modrm.Mod == 3 {
+		l.bitTestRM(&modrm, width, modrm.Opcode, bit)
+		return
+	}
+	l.bitTestMemory(&modrm, modrm.address(), width, modrm.Opcode, bit)
+}
+
+func (l *Long) bitTestRM(modrm *ModRM64, width uint, op uint8, bit uint) {
+	value := modrm.GetRM(width)
+	old := value>>bit&1 != 0
+	if op != bitTestOnly {
+		modrm.SetRM(width, bitChange64(value, bit, op))
+	}
+	l.reg.setEFlags(carryFlag(old), FlagCF)
+}
+
+func (l *Long) bitTestMemory(modrm *ModRM64, address uint64, width uint, op uint8, bit uint) {
+	value := modrm.load(address, width/8)
+	old := value>>bit&1 != 0
+	if op != bitTestOnly {
+		modrm.store(address, width/8, bitChange64(value, bit, op))
+	}
+	l.reg.setEFlags(carryFlag(old), FlagCF)
+}
+
+func bitChange64(value uint64, bit uint, op uint8) uint64 {
+	switch op {
+	case bitTestSet:
+		value |= 1 << bit
+	case bitTestReset:
+		value &^= 1 << bit
+	case bitTestFlip:
+		value ^= 1 << bit
+	}
+	return value
+}
+
+// bitScan BSF and BSR r, r/m (0F BC, BD), TZCNT and LZCNT with F3
+func (l *Long) bitScan(reverse bool) func() {
+	return func() {
+		reg := l.reg
+		width := l.width()
+		count := reg.repPrefix == 0xf3 && (!reverse && reg.features().Leaf7EBX&FeatureBMI1 != 0 ||
+			reverse && reg.features().ExtECX&FeatureABM != 0)
+		modrm := l.decode(0)
+		src := modrm.GetRM(width)
+		if count {
+			n := uint64(bits.TrailingZeros64(src | 1<<width))
+			if width == 64 {
+				n = uint64(bits.TrailingZeros64(src))
+			}
+			if reverse {
+				n = uint64(bits.LeadingZeros64(src)) - uint64(64-width)
+			}
+			modrm.SetR(width, n)
+			var flags uint32
+			if n == 0 {
+				flags = FlagZF
+			}
+			reg.setEFlags(flags|carryFlag(src == 0), FlagZF|FlagCF)
+			return
+		}
+		if src == 0 {
+			reg.setEFlags(FlagZF, FlagZF)
+			return
+		}
+		index := bits.TrailingZeros64(src)
+		if reverse {
+			index = 63 - bits.LeadingZeros64(src)
+		}
+		modrm.SetR(width, uint64(index))
+		reg.setEFlags(0, FlagZF)
+	}
+}
+
+// popcnt POPCNT r, r/m (F3 0F B8)
+func (l *Long) popcnt() {
+	reg := l.reg
+	if reg.repPrefix != 0xf3 || reg.features().Leaf1ECX&FeaturePOPCNT == 0 {
+		raise(ExceptionUD)
+	}
+	width := l.width()
+	modrm := l.decode(0)
+	src := modrm.GetRM(width)
+	modrm.SetR(width, uint64(bits.OnesCount64(src)))
+	var flags uint32
+	if src == 0 {
+		flags = FlagZF
+	}
+	reg.setEFlags(flags, arithFlagsMask)
+}
+
+// bswap BSWAP r (0F C8-CF); a 16-bit operand gives an undefined result, zero here
+func (l *Long) bswap() {
+	width := l.width()
+	index := l.opcodeReg()
+	l.reg.X64.RIP += 1
+	value := l.getReg(index, 64)
+	switch width {
+	case 64:
+		value = bits.ReverseBytes64(value)
+	case 32:
+		value = uint64(bits.ReverseBytes32(uint32(value)))
+	default:
+		value = 0
+	}
+	l.setReg(index, width, value)
+}
+
+// cmpxchg CMPXCHG r/m, r (0F B0, B1): compares the accumulator with r/m; when equal r/m = r,
+// else the accumulator = r/m. The operand is written either way.
+func (l *Long) cmpxchg(width uint) func() {
+	return func() {
+		reg := l.reg
+		width := l.byteWidth(width)
+		modrm := l.decode(0)
+		dst := modrm.GetRM(width)
+		acc := l.getReg(0, width)
+		_, flags := alu(aluCmp, acc, dst, width, false)
+		if acc == dst {
+			modrm.SetRM(width, modrm.GetR(width))
+		} else {
+			modrm.SetRM(width, dst)
+			l.setReg(0, width, dst)
+		}
+		reg.setEFlags(flags, arithFlagsMask)
+	}
+}
+
+// xadd XADD r/m, r (0F C0, C1)
+func (l *Long) xadd(width uint) func() {
+	return func() {
+		width := l.byteWidth(width)
+		modrm := l.decode(0)
+		dst, src := modrm.GetRM(width), modrm.GetR(width)
+		result, flags := alu(aluAdd, dst, src, width, false)
+		modrm.SetRM(width, result)
+		modrm.SetR(width, dst)
+		l.reg.setEFlags(flags, arithFlagsMask)
+	}
+}
+
+// group9 CMPXCHG8B and CMPXCHG16B m (0F C7 /1, with REX.W for 16 bytes, which must be
+// aligned), RDRAND (/6) and RDSEED (/7)
+func (l *Long) group9() {
+	reg := l.reg
+	modrm := l.decode(0)
+	if modrm.Opcode == 6 || modrm.Opcode == 7 {
+		l.random(&modrm)
+		return
+	}
+	if modrm.Opcode != 1 || modrm.Mod == 3 {
+		raise(ExceptionUD)
+	}
+	address := modrm.address()
+	if !reg.rexW() {
+		if reg.features().Leaf1EDX&FeatureCX8 == 0 {
+			raise(ExceptionUD)
+		}
+		value := modrm.load(address, 8)
+		if value == reg.X64.RDX<<32|reg.X64.RAX&0xffffffff {
+			modrm.store(address, 8, reg.X64.RCX<<32|reg.X64.RBX&0xffffffff)
+			reg.setEFlags(FlagZF, FlagZF)
+			return
+		}
+		modrm.store(address, 8, value)
+		l.setReg(0, 32, value)
+		l.setReg(2, 32, value>>32)
+		reg.setEFlags(0, FlagZF)
+		return
+	}
+	if reg.features().Leaf1ECX&FeatureCX16 == 0 {
+		raise(ExceptionUD)
+	}
+	if address&15 != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	low, high := modrm.load(address, 8), modrm.load(address+8, 8)
+	x := &reg.X64
+	if low == x.RAX && high == x.RDX {
+		modrm.store(address, 8, x.RBX)
+		modrm.store(address+8, 8, x.RCX)
+		reg.setEFlags(FlagZF, FlagZF)
+		return
+	}
+	modrm.store(address, 8, low)
+	modrm.store(address+8, 8, high)
+	x.RAX, x.RDX = low, high
+	reg.setEFlags(0, FlagZF)
+}
+
+// String operations
+const (
+	stringMovs = iota
+	stringCmps
+	stringStos
+	stringLods
+	stringScas
+)
+
+// str MOVS, CMPS, STOS, LODS and SCAS (A4-A7, AA-AF) with REP, REPE and REPNE. rSI is in
+// the data segment, which FS and GS override, rDI has no base; with the 67 prefix ESI, EDI
+// and ECX are used and zero-extended. An interrupt can only come
+// between instructions here, so a repeated string runs to completion in one step.
+func (l *Long) str(op int, width uint) func() {
+	return func() {
+		reg := l.reg
+		x := &reg.X64
+		width := l.byteWidth(width)
+		size := uint64(width / 8)
+		mask := l.addressMask()
+		reg.X64.RIP += 1
+		step := size
+		if reg.IsDF() {
+			step = -size
+		}
+		compare := op == stringCmps || op == stringScas
+		for {
+			if reg.repPrefix != 0 && x.RCX&mask == 0 {
+				return
+			}
+			src := reg.dataBase() + x.RSI&mask
+			dst := x.RDI & mask
+			switch op {
+			case stringMovs:
+				l.write(dst, uint(size), l.read(src, uint(size), ExceptionGP), ExceptionGP)
+			case stringCmps:
+				_, flags := alu(aluCmp, l.read(src, uint(size), ExceptionGP), l.read(dst, uint(size), ExceptionGP), width, false)
+				reg.setEFlags(flags, arithFlagsMask)
+			case stringStos:
+				l.write(dst, uint(size), l.getReg(0, width), ExceptionGP)
+			case stringLods:
+				l.setReg(0, width, l.read(src, uint(size), ExceptionGP))
+			case stringScas:
+				_, flags := alu(aluCmp, l.getReg(0, width), l.read(dst, uint(size), ExceptionGP), width, false)
+				reg.setEFlags(flags, arithFlagsMask)
+			}
+			if op == stringMovs || op == stringCmps || op == stringLods {
+				x.RSI = (x.RSI + step) & mask
+			}
+			if op != stringLods {
+				x.RDI = (x.RDI + step) & mask
+			}
+			if reg.repPrefix == 0 {
+				return
+			}
+			x.RCX = (x.RCX - 1) & mask
+			if compare && (reg.repPrefix == 0xf3) != reg.IsZF() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,621 @@
+package core
+
+// Control transfers, stack instructions and interrupts of 64-bit mode. Near branches and
+// stack operations are 64-bit; far transfers load CS from the GDT or LDT and may switch to
+// compatibility mode. Call gates, task gates and TSS targets do not exist here: they raise
+// #GP.
+
+// condition evaluates the condition code cc of Jcc, SETcc and CMOVcc
+func (r *X86Registers) condition(cc uint8) bool {
+	var result bool
+	switch cc >> 1 {
+	case 0:
+		result = r.IsOF()
+	case 1:
+		result = r.IsCF()
+	case 2:
+		result = r.IsZF()
+	case 3:
+		result = r.IsCF() || r.IsZF()
+	case 4:
+		result = r.IsSF()
+	case 5:
+		result = r.IsPF()
+	case 6:
+		result = r.IsSF() != r.IsOF()
+	default:
+		result = r.IsZF() || r.IsSF() != r.IsOF()
+	}
+	return result != (cc&1 != 0)
+}
+
+// jump sets RIP to a branch target, #GP(0) when it is not canonical
+func (l *Long) jump(target uint64) {
+	if !canonical(target) {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	l.reg.X64.RIP = target
+}
+
+// jcc Jcc rel8 and rel32 (70-7F, 0F 80-8F)
+func (l *Long) jcc(size uint) func() {
+	return func() {
+		reg := l.reg
+		cc := l.code8(0) & 0xf
+		reg.X64.RIP += 1
+		rel := l.immSigned(size)
+		if reg.condition(cc) {
+			l.jump(reg.X64.RIP + rel)
+		}
+	}
+}
+
+// jmpRel JMP rel8 and rel32 (EB, E9)
+func (l *Long) jmpRel(size uint) func() {
+	return func() {
+		reg := l.reg
+		reg.X64.RIP += 1
+		rel := l.immSigned(size)
+		l.jump(reg.X64.RIP + rel)
+	}
+}
+
+// callRel CALL rel32 (E8)
+func (l *Long) callRel() {
+	reg := l.reg
+	reg.X64.RIP += 1
+	rel := l.immSigned(4)
+	next := reg.X64.RIP
+	target := next + rel
+	if !canonical(target) {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	l.push(64, next)
+	reg.X64.RIP = target
+}
+
+// ret RET and RET imm16 (C3, C2)
+func (l *Long) ret(release bool) func() {
+	return func() {
+		reg := l.reg
+		var bytes uint64
+		if release {
+			bytes = fetch64(reg, l.mem, 1, 2)
+		}
+		target := l.readStack(0, 8)
+		l.jump(target)
+		reg.X64.RSP += 8 + bytes
+	}
+}
+
+// Loop conditions
+const (
+	loopNE     = iota // LOOPNE (E0)
+	loopE             // LOOPE (E1)
+	loopAlways        // LOOP (E2)
+)
+
+// loop decrements rCX, ECX with the 67 prefix, and jumps while it is not zero and the
+// condition holds
+func (l *Long) loop(kind int) func() {
+	return func() {
+		reg := l.reg
+		x := &reg.X64
+		x.RIP += 1
+		rel := l.immSigned(1)
+		mask := l.addressMask()
+		x.RCX = (x.RCX - 1) & mask
+		taken := x.RCX != 0
+		switch kind {
+		case loopNE:
+			taken = taken && !reg.IsZF()
+		case loopE:
+			taken = taken && reg.IsZF()
+		}
+		if taken {
+			l.jump(x.RIP + rel)
+		}
+	}
+}
+
+// jrcxz JRCXZ rel8 (E3), JECXZ with the 67 prefix
+func (l *Long) jrcxz() {
+	reg := l.reg
+	x := &reg.X64
+	x.RIP += 1
+	rel := l.immSigned(1)
+	if x.RCX&l.addressMask() == 0 {
+		l.jump(x.RIP + rel)
+	}
+}
+
+// pushReg PUSH r64 (50-57)
+func (l *Long) pushReg() {
+	width := l.stackWidth()
+	index := l.opcodeReg()
+	l.reg.X64.RIP += 1
+	l.push(width, l.getReg(index, width))
+}
+
+// popReg POP r64 (58-5F)
+func (l *Long) popReg() {
+	width := l.stackWidth()
+	index := l.opcodeReg()
+	l.reg.X64.RIP += 1
+	value := l.pop(width)
+	l.setReg(index, width, value)
+}
+
+// pushImm PUSH imm8 and imm32 (6A, 68), sign-extended to 64 bits
+func (l *Long) pushImm(size uint) func() {
+	return func() {
+		width := l.stackWidth()
+		l.reg.X64.RIP += 1
+		if width == 16 && size == 4 {
+			size = 2
+		}
+		l.push(width, l.immSigned(size))
+	}
+}
+
+// popRM POP r/m64 (8F /0): an address based on RSP is computed after the increment
+func (l *Long) popRM() {
+	reg := l.reg
+	width := l.stackWidth()
+	modrm := l.decode(0)
+	if modrm.Opcode != 0 {
+		raise(ExceptionUD)
+	}
+	value := l.readStack(0, width/8)
+	rsp := reg.X64.RSP
+	reg.X64.RSP += uint64(width / 8)
+	defer func() {
+		if r := recover(); r != nil {
+			reg.X64.RSP = rsp
+			panic(r)
+		}
+	}()
+	modrm.SetRM(width, value)
+}
+
+// pushf PUSHFQ (9C): VM and RF are pushed clear
+func (l *Long) pushf() {
+	reg := l.reg
+	width := l.stackWidth()
+	reg.X64.RIP += 1
+	l.push(width, uint64(reg.EFlags&^(FlagVM|FlagRF)))
+}
+
+// popf POPFQ (9D): IOPL is only loaded at CPL 0 and IF when CPL <= IOPL; VM, VIF and VIP
+// never are
+func (l *Long) popf() {
+	reg := l.reg
+	width := l.stackWidth()
+	flags := uint32(l.readStack(0, width/8))
+	mask := uint32(flagsMask &^ (FlagVM | FlagVIF | FlagVIP))
+	if width == 16 {
+		mask &= 0xffff
+	}
+	if reg.CPL() > 0 {
+		mask &^= FlagIOPL
+	}
+	if reg.CPL() > reg.IOPL() {
+		mask &^= FlagIF
+	}
+	reg.X64.RSP += uint64(width / 8)
+	reg.setEFlags(flags, mask)
+	reg.X64.RIP += 1
+}
+
+// enter ENTER imm16, imm8 (C8) with 64-bit frame pointers
+func (l *Long) enter() {
+	reg := l.reg
+	x := &reg.X64
+	size := fetch64(reg, l.mem, 1, 2)
+	level := fetch64(reg, l.mem, 3, 1) & 31
+	x.RIP += 4
+	l.push(64, x.RBP)
+	frame := x.RSP
+	for i := uint64(1); i < level; i++ {
+		l.push(64, l.read(x.RBP-8*i, 8, ExceptionSS))
+	}
+	if level > 0 {
+		l.push(64, frame)
+	}
+	x.RBP = frame
+	x.RSP -= size
+}
+
+// leave LEAVE (C9): RSP = RBP, then pops RBP
+func (l *Long) leave() {
+	reg := l.reg
+	x := &reg.X64
+	value := l.read(x.RBP, 8, ExceptionSS)
+	x.RSP = x.RBP + 8
+	x.RBP = value
+	x.RIP += 1
+}
+
+// movFromSreg MOV r/m, Sreg (8C): a register destination takes the zero-extended selector
+func (l *Long) movFromSreg() {
+	width := l.width()
+	modrm := l.decode(0)
+	if modrm.Opcode > SegGS {
+		raise(ExceptionUD)
+	}
+	selector := uint64(l.reg.GetSegment(modrm.Opcode))
+	if modrm.Mod != 3 {
+		width = 16
+	}
+	modrm.SetRM(width, selector)
+}
+
+// movToSreg MOV Sreg, r/m16 (8E); CS cannot be loaded
+func (l *Long) movToSreg() {
+	modrm := l.decode(0)
+	if modrm.Opcode > SegGS || modrm.Opcode == SegCS {
+		raise(ExceptionUD)
+	}
+	l.loadSegment(modrm.Opcode, uint16(modrm.GetRM(16)))
+}
+
+// loadSegment loads a data segment register in 64-bit mode. SS may hold a null selector
+// below CPL 3; FS and GS loads set the 32-bit base.
+func (l *Long) loadSegment(index uint8, selector uint16) {
+	reg := l.reg
+	if index == SegSS && selector&^3 == 0 && reg.CPL() < 3 && uint8(selector&3) == reg.CPL() {
+		reg.SS = selector
+		reg.Segments[SegSS] = nullStack(reg.CPL())
+		return
+	}
+	loadSegment(reg, l.mem, index, selector)
+}
+
+// nullStack the hidden part of SS holding a null selector in 64-bit mode
+func nullStack(cpl uint8) SegmentCache {
+	return SegmentCache{
+		Limit:  0xffffffff,
+		Access: accessPresent | accessNotSystem | accessWritable | cpl<<5,
+		Big:    true,
+	}
+}
+
+// pushSreg PUSH FS and GS (0F A0, A8)
+func (l *Long) pushSreg(index uint8) func() {
+	return func() {
+		width := l.stackWidth()
+		l.reg.X64.RIP += 1
+		l.push(width, uint64(l.reg.GetSegment(index)))
+	}
+}
+
+// popSreg POP FS and GS (0F A1, A9)
+func (l *Long) popSreg(index uint8) func() {
+	return func() {
+		reg := l.reg
+		width := l.stackWidth()
+		selector := uint16(l.readStack(0, width/8))
+		l.loadSegment(index, selector)
+		reg.X64.RSP += uint64(width / 8)
+		reg.X64.RIP += 1
+	}
+}
+
+// group5 INC, DEC, CALL, CALL far, JMP, JMP far and PUSH r/m (FF /0-/6)
+func (l *Long) group5() {
+	reg := l.reg
+	width := l.width()
+	modrm := l.decode(0)
+	switch modrm.Opcode {
+	case 0, 1:
+		l.incDec(&modrm, width)
+	case 2:
+		target := modrm.GetRM(64)
+		if !canonical(target) {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		l.push(64, reg.X64.RIP)
+		reg.X64.RIP = target
+	case 4:
+		l.jump(modrm.GetRM(64))
+	case 3, 5:
+		// m16:16, m16:32 or with REX.W m16:64
+		size := width / 8
+		address := modrm.memory()
+		offset := modrm.load(address, size)
+		selector := uint16(modrm.load(address+uint64(size), 2))
+		if modrm.Opcode == 3 {
+			l.callFar(selector, offset, size)
+		} else {
+			l.jumpFar(selector, offset)
+		}
+	case 6:
+		width := l.stackWidth()
+		l.push(width, modrm.GetRM(width))
+	default:
+		raise(ExceptionUD)
+	}
+}
+
+// farCode reads and checks the code segment of a far JMP or CALL
+func (l *Long) farCode(selector uint16) (uint32, Descriptor) {
+	reg := l.reg
+	if selector&^3 == 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	address := descriptorAddress(reg, selector)
+	desc := readDescriptor(l.mem, address)
+	if desc.IsSystem() {
+		// call gates of long mode are 16 bytes, task switches do not exist
+		raiseWithCode(ExceptionGP, uint32(selector&^3))
+	}
+	checkCodeTarget(&desc, selector, reg.CPL())
+	return address, desc
+}
+
+// setCode commits a code segment and the offset in it: a 64-bit segment takes a canonical
+// RIP, a compatibility mode one an offset within its limit
+func (l *Long) setCode(selector uint16, address uint32, desc Descriptor, offset uint64, cpl uint8) {
+	reg := l.reg
+	if desc.IsLong() && !desc.IsBig() {
+		if !canonical(offset) {
+			raiseWithCode(ExceptionGP, 0)
+		}
+	} else if offset > uint64(desc.Limit) {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	setCodeSegment(reg, l.mem, selector, address, desc, cpl)
+	reg.X64.RIP = offset
+}
+
+// jumpFar JMP to selector:offset, a code segment
+func (l *Long) jumpFar(selector uint16, offset uint64) {
+	address, desc := l.farCode(selector)
+	l.setCode(selector, address, desc, offset, l.reg.CPL())
+}
+
+// callFar CALL to selector:offset, pushing CS and RIP in size bytes slots
+func (l *Long) callFar(selector uint16, offset uint64, size uint) {
+	reg := l.reg
+	address, desc := l.farCode(selector)
+	rsp := reg.X64.RSP
+	l.push(size*8, uint64(reg.CS))
+	l.push(size*8, reg.X64.RIP)
+	defer func() {
+		if r := recover(); r != nil {
+			reg.X64.RSP = rsp
+			panic(r)
+		}
+	}()
+	l.setCode(selector, address, desc, offset, reg.CPL())
+}
+
+// retFar RETF and RETF imm16 (CB, CA): 32-bit slots, 64-bit with REX.W. A return to an
+// outer privilege level also pops SS:RSP.
+func (l *Long) retFar(release bool) func() {
+	return func() {
+		reg := l.reg
+		mem := l.mem
+		var bytes uint64
+		if release {
+			bytes = fetch64(reg, mem, 1, 2)
+		}
+		size := uint64(l.width() / 8)
+		offset := l.readStack(0, uint(size))
+		selector := uint16(l.readStack(size, 2))
+		cpl := reg.CPL()
+		rpl := uint8(selector & 3)
+		address, desc := l.returnCode(selector, cpl)
+		if rpl == cpl {
+			l.setCode(selector, address, desc, offset, cpl)
+			reg.X64.RSP += 2*size + bytes
+			return
+		}
+		rsp := l.readStack(2*size+bytes, uint(size))
+		ss := uint16(l.readStack(3*size+bytes, 2))
+		l.returnOuter(selector, address, desc, offset, ss, rsp+bytes)
+	}
+}
+
+// returnCode checks the code segment selector popped by RETF or IRET
+func (l *Long) returnCode(selector uint16, cpl uint8) (uint32, Descriptor) {
+	rpl := uint8(selector & 3)
+	errorCode := uint32(selector &^ 3)
+	if selector&^3 == 0 || rpl < cpl {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	address := descriptorAddress(l.reg, selector)
+	desc := readDescriptor(l.mem, address)
+	if !desc.IsCode() {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	if desc.IsConforming() && desc.DPL() > rpl || !desc.IsConforming() && desc.DPL() != rpl {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionNP, errorCode)
+	}
+	return address, desc
+}
+
+// returnOuter completes RETF or IRET to the privilege level of selector with the stack
+// ss:rsp. A 64-bit segment below CPL 3 may run with a null SS.
+func (l *Long) returnOuter(selector uint16, address uint32, desc Descriptor, offset uint64, ss uint16, rsp uint64) {
+	reg := l.reg
+	mem := l.mem
+	rpl := uint8(selector & 3)
+	long := desc.IsLong() && !desc.IsBig()
+	if long && rpl < 3 && ss&^3 == 0 && uint8(ss&3) == rpl {
+		l.setCode(selector, address, desc, offset, rpl)
+		reg.SS = ss
+		reg.Segments[SegSS] = nullStack(rpl)
+	} else {
+		ssAddress, ssDesc := checkStackSegment(reg, mem, ss, rpl, ExceptionGP)
+		l.setCode(selector, address, desc, offset, rpl)
+		setStackSegment(reg, mem, ss, ssAddress, ssDesc)
+	}
+	reg.X64.RSP = rsp
+	clearOuterSegments(reg)
+}
+
+// iret IRET, IRETD and IRETQ (CF): the frame always holds SS:RSP in 64-bit mode
+func (l *Long) iret() {
+	reg := l.reg
+	if reg.IsNT() {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	size := uint64(l.width() / 8)
+	offset := l.readStack(0, uint(size))
+	selector := uint16(l.readStack(size, 2))
+	flags := uint32(l.readStack(2*size, uint(size)))
+	rsp := l.readStack(3*size, uint(size))
+	ss := uint16(l.readStack(4*size, 2))
+	mask := uint32(flagsMask &^ (FlagVM | FlagVIF | FlagVIP))
+	if size == 2 {
+		mask &= 0xffff
+	}
+	cpl := reg.CPL()
+	if cpl > 0 {
+		mask &^= FlagIOPL
+	}
+	if cpl > reg.IOPL() {
+		mask &^= FlagIF
+	}
+	address, desc := l.returnCode(selector, cpl)
+	l.returnOuter(selector, address, desc, offset, ss, rsp)
+	reg.setEFlags(flags, mask)
+}
+
+// int3 INT3 (CC), intImm8 INT imm8 (CD) and int1 INT1 (F1)
+func (l *Long) int3() {
+	l.reg.X64.RIP += 1
+	l.intr.Deliver(&Exception{Vector: ExceptionBP}, true)
+}
+
+func (l *Long) intImm8() {
+	vector := l.code8(1)
+	l.reg.X64.RIP += 2
+	l.intr.Deliver(&Exception{Vector: vector}, true)
+}
+
+func (l *Long) int1() {
+	l.reg.X64.RIP += 1
+	l.intr.Deliver(&Exception{Vector: ExceptionDB}, false)
+}
+
+// TSS of long mode: the stack pointers of levels 0-2, then the 7 interrupt stack table
+// entries
+const (
+	tss64RSP0 = 0x04
+	tss64IST1 = 0x24
+)
+
+// readSystem64 reads the quadword at address of a descriptor table or the TSS
+func readSystem64(mem IMemory, address uint32) uint64 {
+	defer mem.Implicit()()
+	return uint64(mem.Read32(address)) | uint64(mem.Read32(address+4))<<32
+}
+
+// tssStack64 the stack of an interrupt handler from the 64-bit TSS: entry ist of the
+// interrupt stack table, or RSP0-RSP2 for level dpl when ist is 0
+func tssStack64(reg *X86Registers, mem IMemory, dpl uint8, ist uint8) uint64 {
+	tss := &reg.TRCache
+	errorCode := uint32(reg.TR &^ 3)
+	offset := tss64RSP0 + uint32(dpl)*8
+	if ist != 0 {
+		offset = tss64IST1 + uint32(ist-1)*8
+	}
+	if !tss.IsUsable() || offset+7 > tss.Limit {
+		raiseWithCode(ExceptionTS, errorCode)
+	}
+	rsp := readSystem64(mem, tss.Base+offset)
+	if !canonical(rsp) {
+		raiseWithCode(ExceptionSS, 0)
+	}
+	return rsp
+}
+
+// deliverLong delivers an interrupt in long mode through the 16-byte gates of the IDT. The
+// handler runs in a 64-bit code segment on a stack aligned to 16 bytes: the TSS stack of
+// its level when the privilege changes, or an interrupt stack table entry. The frame always
+// holds SS:RSP, and every slot is 64-bit.
+func (intr *Interrupt) deliverLong(e *Exception, software bool) {
+	reg := intr.reg
+	mem := intr.mem
+	reg.setMode64(true)
+	x := &reg.X64
+	var ext uint32
+	if !software {
+		ext = 1
+	}
+	idtCode := uint32(e.Vector)<<3 | 2 | ext
+	offset := uint32(e.Vector) * 16
+	if offset+15 > uint32(reg.IDTR.Limit) {
+		raiseWithCode(ExceptionGP, idtCode)
+	}
+	gate := readGate(mem, reg.IDTR.Base+offset)
+	if gate.Type() != descIntGate32 && gate.Type() != descTrapGate32 {
+		raiseWithCode(ExceptionGP, idtCode)
+	}
+	cpl := reg.CPL()
+	if software && gate.DPL() < cpl {
+		raiseWithCode(ExceptionGP, idtCode)
+	}
+	if !gate.IsPresent() {
+		raiseWithCode(ExceptionNP, idtCode)
+	}
+	rip := uint64(gate.Offset) | readSystem64(mem, reg.IDTR.Base+offset+8)<<32
+
+	selector := gate.Selector
+	selectorCode := uint32(selector&^3) | ext
+	if selector&^3 == 0 {
+		raiseWithCode(ExceptionGP, ext)
+	}
+	address := descriptorAddress(reg, selector)
+	desc := readDescriptor(mem, address)
+	if !desc.IsCode() || desc.DPL() > cpl || !desc.IsLong() || desc.IsBig() {
+		raiseWithCode(ExceptionGP, selectorCode)
+	}
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionNP, selectorCode)
+	}
+	newCPL := cpl
+	if !desc.IsConforming() {
+		newCPL = desc.DPL()
+	}
+	if !canonical(rip) {
+		raiseWithCode(ExceptionGP, ext)
+	}
+
+	ss, rsp := reg.SS, x.RSP
+	ist := gate.ParamCount & 7
+	if newCPL < cpl || ist != 0 {
+		x.RSP = tssStack64(reg, mem, newCPL, ist)
+	}
+	if newCPL < cpl {
+		// the frame is written at the privilege of the handler
+		defer mem.Implicit()()
+		reg.SS = uint16(newCPL)
+		reg.Segments[SegSS] = nullStack(newCPL)
+	}
+	x.RSP &^= 15
+	push := func(value uint64) {
+		x.RSP -= 8
+		checkCanonical(x.RSP, 8, ExceptionSS)
+		mem.WriteLinear(x.RSP, 8, value)
+	}
+	push(uint64(ss))
+	push(rsp)
+	push(uint64(reg.EFlags))
+	push(uint64(reg.CS))
+	push(x.RIP)
+	if e.HasErrorCode {
+		push(uint64(e.ErrorCode))
+	}
+	setCodeSegment(reg, mem, selector, address, desc, newCPL)
+	x.RIP = rip
+	reg.EFlags &^= FlagTF | FlagNT | FlagRF | FlagVM
+	if gate.Type() == descIntGate32 {
+		reg.EFlags &^= FlagIF
+	}
+}
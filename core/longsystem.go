@@ -0,0 +1,391 @@
+package core
+
+// System instructions of 64-bit mode: control and debug registers, descriptor tables, MSRs,
+// SYSCALL and SYSRET, and port I/O. GDTR, IDTR, LDTR and TR hold 32-bit bases, so the
+// descriptor tables and the TSS must lie in the first 4 GiB.
+
+// Model-specific registers of long mode
+const (
+	MSRSTAR         = 0xc0000081
+	MSRLSTAR        = 0xc0000082
+	MSRCSTAR        = 0xc0000083
+	MSRFMASK        = 0xc0000084
+	MSRFSBase       = 0xc0000100
+	MSRGSBase       = 0xc0000101
+	MSRKernelGSBase = 0xc0000102
+)
+
+// longMSR an MSR of X64registers. Addresses must be canonical; FMASK only has 32 bits.
+type longMSR struct {
+	field    func(x *X64registers) *uint64
+	writable uint64
+	address  bool
+}
+
+func (m longMSR) Read(reg *X86Registers) uint64 {
+	return *m.field(&reg.X64)
+}
+
+func (m longMSR) Write(reg *X86Registers, value uint64) {
+	if value&^m.writable != 0 || m.address && !canonical(value) {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	*m.field(&reg.X64) = value
+	reg.syncBases()
+}
+
+// registerLongMSRs installs the MSRs of long mode in f
+func registerLongMSRs(f *MSRFile) {
+	all := ^uint64(0)
+	f.Register(MSRSTAR, longMSR{func(x *X64registers) *uint64 { return &x.STAR }, all, false})
+	f.Register(MSRLSTAR, longMSR{func(x *X64registers) *uint64 { return &x.LSTAR }, all, true})
+	f.Register(MSRCSTAR, longMSR{func(x *X64registers) *uint64 { return &x.CSTAR }, all, true})
+	f.Register(MSRFMASK, longMSR{func(x *X64registers) *uint64 { return &x.FMASK }, 0xffffffff, false})
+	f.Register(MSRFSBase, longMSR{func(x *X64registers) *uint64 { return &x.FSBase }, all, true})
+	f.Register(MSRGSBase, longMSR{func(x *X64registers) *uint64 { return &x.GSBase }, all, true})
+	f.Register(MSRKernelGSBase, longMSR{func(x *X64registers) *uint64 { return &x.KernelGSBase }, all, true})
+}
+
+// syncBases copies the FS and GS bases of 64-bit mode to the segment registers, whose
+// 32-bit bases compatibility mode uses
+func (r *X86Registers) syncBases() {
+	r.Segments[SegFS].Base = uint32(r.X64.FSBase)
+	r.Segments[SegGS].Base = uint32(r.X64.GSBase)
+}
+
+// legacy64 runs a handler of the legacy tables that only uses EFLAGS and the system
+// registers. The EIP it advances is not live in 64-bit mode: RIP steps over size bytes.
+func (cpu *CPU) legacy64(instr func(), size uint64) func() {
+	return func() {
+		instr()
+		cpu.reg.X64.RIP += size
+	}
+}
+
+// decode64 steps over the second opcode byte of a 0F instruction and decodes its operands
+func (s *System) decode64() ModRM64 {
+	reg := s.reg
+	reg.X64.RIP += 1
+	return NewModRM64(reg, s.mem, 0)
+}
+
+// group6 SLDT, STR, LLDT, LTR, VERR and VERW (0F 00). The LDT and TSS descriptors of long
+// mode are 16 bytes, their bases must fit in 32 bits.
+func (s *System) group6() {
+	reg := s.reg
+	modrm := s.decode64()
+	width := uint(16)
+	if modrm.Mod == 3 {
+		width = 32
+		if reg.rexW() {
+			width = 64
+		}
+	}
+	switch modrm.Opcode {
+	case 0:
+		modrm.SetRM(width, uint64(reg.LDTR))
+	case 1:
+		modrm.SetRM(width, uint64(reg.TR))
+	case 2:
+		s.checkPrivileged()
+		loadLDT(reg, s.mem, uint16(modrm.GetRM(16)))
+	case 3:
+		s.checkPrivileged()
+		loadTR(reg, s.mem, uint16(modrm.GetRM(16)))
+	case 4:
+		s.verifySelector(uint16(modrm.GetRM(16)), false)
+	case 5:
+		s.verifySelector(uint16(modrm.GetRM(16)), true)
+	default:
+		raise(ExceptionUD)
+	}
+}
+
+// group7 SGDT, SIDT, LGDT, LIDT with 10-byte operands, XGETBV, XSETBV, SMSW, LMSW, INVLPG,
+// SWAPGS and RDTSCP (0F 01)
+func (s *System) group7() {
+	reg := s.reg
+	modrm := s.decode64()
+	switch modrm.Opcode {
+	case 0:
+		s.storeTable64(&modrm, &reg.GDTR)
+	case 1:
+		s.storeTable64(&modrm, &reg.IDTR)
+	case 2:
+		if modrm.Mod == 3 {
+			switch modrm.Rm & 7 {
+			case 0:
+				s.xgetbv()
+			case 1:
+				s.xsetbv()
+			default:
+				raise(ExceptionUD)
+			}
+			return
+		}
+		s.checkPrivileged()
+		s.loadTable64(&modrm, &reg.GDTR)
+	case 3:
+		s.checkPrivileged()
+		s.loadTable64(&modrm, &reg.IDTR)
+	case 4:
+		width := uint(16)
+		if modrm.Mod == 3 {
+			width = 32
+			if reg.rexW() {
+				width = 64
+			}
+		}
+		modrm.SetRM(width, reg.CR0)
+	case 6:
+		s.checkPrivileged()
+		s.lmsw(uint16(modrm.GetRM(16)))
+	case 7:
+		if modrm.Mod != 3 {
+			s.checkPrivileged()
+			s.mem.InvalidatePage(modrm.address())
+			return
+		}
+		switch modrm.Rm & 7 {
+		case 0:
+			s.swapgs()
+		case 1:
+			s.rdtscp64()
+		default:
+			raise(ExceptionUD)
+		}
+	default:
+		raise(ExceptionUD)
+	}
+}
+
+func (s *System) storeTable64(modrm *ModRM64, table *DescriptorTable) {
+	address := modrm.memory()
+	modrm.store(address, 2, uint64(table.Limit))
+	modrm.store(address+2, 8, uint64(table.Base))
+}
+
+// loadTable64 loads a 64-bit base, which must be canonical and, here, below 4 GiB
+func (s *System) loadTable64(modrm *ModRM64, table *DescriptorTable) {
+	address := modrm.memory()
+	limit := modrm.load(address, 2)
+	base := modrm.load(address+2, 8)
+	if base>>32 != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	table.Limit = uint16(limit)
+	table.Base = uint32(base)
+}
+
+// swapgs SWAPGS (0F 01 F8): exchanges the GS base with IA32_KERNEL_GS_BASE at CPL 0
+func (s *System) swapgs() {
+	reg := s.reg
+	s.checkPrivileged()
+	x := &reg.X64
+	x.GSBase, x.KernelGSBase = x.KernelGSBase, x.GSBase
+	reg.syncBases()
+}
+
+// rdtscp64 RDTSCP (0F 01 F9): EDX:EAX = time-stamp counter, ECX = IA32_TSC_AUX
+func (s *System) rdtscp64() {
+	reg := s.reg
+	if reg.features().ExtEDX&FeatureRDTSCP == 0 {
+		raise(ExceptionUD)
+	}
+	s.checkTSC()
+	tsc := reg.tsc()
+	x := &reg.X64
+	x.RAX, x.RDX = uint64(uint32(tsc)), tsc>>32
+	x.RCX = uint64(uint32(reg.msrs.lookup(MSRTSCAux).Read(reg)))
+}
+
+// rdtsc64 RDTSC (0F 31)
+func (s *System) rdtsc64() {
+	reg := s.reg
+	if reg.features().Leaf1EDX&FeatureTSC == 0 {
+		raise(ExceptionUD)
+	}
+	s.checkTSC()
+	tsc := reg.tsc()
+	reg.X64.RAX, reg.X64.RDX = uint64(uint32(tsc)), tsc>>32
+	reg.X64.RIP += 1
+}
+
+// rdmsr64 RDMSR (0F 32): EDX:EAX = MSR[ECX]
+func (s *System) rdmsr64() {
+	reg := s.reg
+	s.checkFeatureMSR()
+	s.checkPrivileged()
+	x := &reg.X64
+	value := reg.msrs.lookup(uint32(x.RCX)).Read(reg)
+	x.RAX, x.RDX = uint64(uint32(value)), value>>32
+	x.RIP += 1
+}
+
+// wrmsr64 WRMSR (0F 30): MSR[ECX] = EDX:EAX
+func (s *System) wrmsr64() {
+	reg := s.reg
+	s.checkFeatureMSR()
+	s.checkPrivileged()
+	x := &reg.X64
+	msr := reg.msrs.lookup(uint32(x.RCX))
+	oldEfer := reg.IA32Efer
+	msr.Write(reg, x.RDX<<32|x.RAX&0xffffffff)
+	if (oldEfer^reg.IA32Efer)&EFERNXE != 0 {
+		s.mem.FlushTLB(false)
+	}
+	x.RIP += 1
+}
+
+// cpuid64 CPUID (0F A2), the results zero-extended
+func (s *System) cpuid64() {
+	reg := s.reg
+	x := &reg.X64
+	a, b, c, d := cpuid(reg, uint32(x.RAX), uint32(x.RCX))
+	x.RAX, x.RBX, x.RCX, x.RDX = uint64(a), uint64(b), uint64(c), uint64(d)
+	x.RIP += 1
+}
+
+// movFromCR MOV r64, CRn (0F 20) and movToCR MOV CRn, r64 (0F 22); REX.R selects CR8-CR15,
+// which do not exist here
+func (s *System) movFromCR() {
+	reg := s.reg
+	s.checkPrivileged()
+	modrm := s.decode64()
+	reg.X64.Set(modrm.Rm, 64, true, s.readCR(modrm.RegIndex))
+}
+
+func (s *System) movToCR() {
+	reg := s.reg
+	s.checkPrivileged()
+	modrm := s.decode64()
+	s.writeCR(modrm.RegIndex, reg.X64.Get(modrm.Rm, 64, true))
+}
+
+// movFromDR MOV r64, DRn (0F 21) and movToDR MOV DRn, r64 (0F 23)
+func (s *System) movFromDR() {
+	reg := s.reg
+	s.checkPrivileged()
+	modrm := s.decode64()
+	if modrm.RegIndex > 7 {
+		raise(ExceptionUD)
+	}
+	reg.X64.Set(modrm.Rm, 64, true, uint64(*s.debugRegister(modrm.RegIndex)))
+}
+
+func (s *System) movToDR() {
+	reg := s.reg
+	s.checkPrivileged()
+	modrm := s.decode64()
+	if modrm.RegIndex > 7 {
+		raise(ExceptionUD)
+	}
+	value := reg.X64.Get(modrm.Rm, 64, true)
+	if value>>32 != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	s.writeDR(modrm.RegIndex, uint32(value))
+}
+
+// syscall SYSCALL (0F 05) with EFER.SCE: RCX = RIP and R11 = RFLAGS, then the flat ring 0
+// segments at STAR[47:32] and RIP = LSTAR, with the RFLAGS bits set in FMASK cleared
+func (s *System) syscall() {
+	reg := s.reg
+	if reg.IA32Efer&EFERSCE == 0 {
+		raise(ExceptionUD)
+	}
+	if p := reg.personality; p != nil && p.systemCall(0x05) {
+		return
+	}
+	x := &reg.X64
+	x.RIP += 1
+	x.RCX = x.RIP
+	x.R11 = uint64(reg.EFlags &^ FlagRF)
+	selector := uint16(x.STAR >> 32)
+	reg.CS = selector &^ 3
+	reg.Segments[SegCS] = flatCode(0, true)
+	reg.SS = selector&^3 + 8
+	reg.Segments[SegSS] = nullStack(0)
+	reg.EFlags &^= uint32(x.FMASK) | FlagRF
+	x.RIP = x.LSTAR
+}
+
+// sysret SYSRET (0F 07) at CPL 0: back to ring 3 at RCX with RFLAGS = R11. With REX.W the
+// 64-bit code segment is STAR[63:48]+16, otherwise the compatibility mode one at STAR[63:48];
+// SS is STAR[63:48]+8.
+func (s *System) sysret() {
+	reg := s.reg
+	if reg.IA32Efer&EFERSCE == 0 {
+		raise(ExceptionUD)
+	}
+	s.checkPrivileged()
+	x := &reg.X64
+	selector := uint16(x.STAR >> 48)
+	long := reg.rexW()
+	rip := x.RCX & 0xffffffff
+	if long {
+		if !canonical(x.RCX) {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		rip = x.RCX
+		selector += 16
+	}
+	reg.CS = selector | 3
+	reg.Segments[SegCS] = flatCode(3, long)
+	reg.SS = uint16(x.STAR>>48) + 8 | 3
+	reg.Segments[SegSS] = nullStack(3)
+	reg.EFlags = uint32(x.R11)&^(FlagRF|FlagVM) | 0x2
+	x.RIP = rip
+}
+
+// flatCode the hidden part of CS loaded by SYSCALL and SYSRET: a flat code segment at level
+// dpl, 64-bit or 32-bit
+func flatCode(dpl uint8, long bool) SegmentCache {
+	return SegmentCache{
+		Limit:  0xffffffff,
+		Access: realModeCodeAccess | dpl<<5,
+		Big:    !long,
+		Long:   long,
+	}
+}
+
+// flatData the hidden part of SS loaded by SYSENTER and SYSEXIT: a flat read/write segment
+// at level dpl
+func flatData(dpl uint8) SegmentCache {
+	return SegmentCache{
+		Limit:  0xffffffff,
+		Access: realModeDataAccess | dpl<<5,
+		Big:    true,
+	}
+}
+
+// port64 IN and OUT (E4-E7, EC-EF) with an immediate port or DX
+func (i *IO) port64(in bool, width uint, immediate bool) func() {
+	return func() {
+		reg := i.reg
+		x := &reg.X64
+		if width != 8 {
+			width = 32
+			if reg.opOverride {
+				width = 16
+			}
+		}
+		port := uint16(x.RDX)
+		x.RIP += 1
+		if immediate {
+			port = uint16(fetch64(reg, i.mem, 0, 1))
+			x.RIP += 1
+		}
+		i.access(port, uint16(width/8))
+		switch {
+		case in && width == 8:
+			x.Set(0, 8, true, uint64(i.ioIn8(port)))
+		case in:
+			x.Set(0, width, true, uint64(i.ioIn32(port)))
+		case width == 8:
+			i.ioOut8(port, uint8(x.RAX))
+		default:
+			i.ioOut32(port, uint32(x.RAX&laneMask(width)))
+		}
+	}
+}
@@ -1,12 +1,24 @@
 package core
 
+// openBus the byte read at a physical address backed by no memory, as on a floating data bus
+const openBus = 0xff
+
+// a20Mask clears the address line 20: addresses wrap at 1 MiB like on the 8086
+const a20Mask = ^uint32(1 << 20)
+
 type Memory struct {
 	addressBase uint32
 	addressEnd  uint64
 	reg         *X86Registers
 	//TODO must be cpu aligned!! 32/64 bit
-	ram   []byte
-	debug bool
+	ram []byte
+	// high sparse 4 KiB frames backing physical addresses above 4 GiB (PAE, PSE-36)
+	high map[uint64]*[0x1000]byte
+	a20  bool
+	tlb  *TLB
+	// implicit accesses to the descriptor tables and the TSS are supervisor accesses at any CPL
+	implicit bool
+	debug    bool
 }
 
 func NewMemory(reg *X86Registers, ram []byte, addressBase uint32, debug bool) *Memory {
@@ -15,10 +27,42 @@ func NewMemory(reg *X86Registers, ram []byte, addressBase uint32, debug bool) *M
 		addressBase: addressBase,
 		ram:         ram,
 		addressEnd:  uint64(addressBase) + uint64(len(ram)),
+		high:        make(map[uint64]*[0x1000]byte),
+		a20:         true,
+		tlb:         NewTLB(),
 		debug:       debug,
 	}
 }
 
+// SetA20 enables or disables the address line 20 (A20 gate)
+func (mem *Memory) SetA20(enabled bool) {
+	mem.a20 = enabled
+}
+
+func (mem *Memory) IsA20() bool {
+	return mem.a20
+}
+
+// Implicit makes the following accesses implicit supervisor accesses, as the processor makes
+// to the descriptor tables, the TSS and the stack of an inner level whatever the CPL, until
+// restore is called
+func (mem *Memory) Implicit() (restore func()) {
+	implicit := mem.implicit
+	mem.implicit = true
+	return func() {
+		mem.implicit = implicit
+	}
+}
+
+// translate converts a linear address to a physical address: paging, then the A20 gate
+func (mem *Memory) translate(address uint64, access pageAccess) uint64 {
+	physical := mem.linearToPhysical(address, access)
+	if !mem.a20 {
+		physical &= uint64(a20Mask) | 0xffffffff00000000
+	}
+	return physical
+}
+
 func (mem *Memory) GetAddressBase() uint32 {
 	return mem.addressBase
 }
@@ -37,8 +81,71 @@ func (mem *Memory) RamSize() uint64 {
 }
 
 func (mem *Memory) Read(address uint32) byte {
-	index := address - mem.addressBase
-	return mem.ram[index]
+	mem.reg.watchMemory(address, false)
+	return mem.ReadPhys8(mem.translate(uint64(address), pageRead))
+}
+
+func (mem *Memory) readCode(address uint32) byte {
+	return mem.ReadPhys8(mem.translate(uint64(address), pageFetch))
+}
+
+// ReadPhys8 reads a byte at a physical address, bypassing segmentation and paging
+func (mem *Memory) ReadPhys8(address uint64) uint8 {
+	if address >= 1<<32 {
+		if frame, ok := mem.high[address>>12]; ok {
+			return frame[address&0xfff]
+		}
+		return 0
+	}
+	if !mem.backed(address) {
+		return openBus
+	}
+	return mem.ram[uint32(address)-mem.addressBase]
+}
+
+// WritePhys8 writes a byte at a physical address, bypassing segmentation and paging
+func (mem *Memory) WritePhys8(address uint64, value uint8) {
+	if address >= 1<<32 {
+		frame, ok := mem.high[address>>12]
+		if !ok {
+			frame = new([0x1000]byte)
+			mem.high[address>>12] = frame
+		}
+		frame[address&0xfff] = value
+		return
+	}
+	if !mem.backed(address) {
+		return
+	}
+	mem.ram[uint32(address)-mem.addressBase] = value
+}
+
+// backed tells if the RAM holds a physical address below 4 GiB
+func (mem *Memory) backed(address uint64) bool {
+	return address >= uint64(mem.addressBase) && address < mem.addressEnd
+}
+
+func (mem *Memory) ReadPhys32(address uint64) uint32 {
+	var ret uint32
+	for i := uint64(0); i < 4; i++ {
+		ret |= uint32(mem.ReadPhys8(address+i)) << (8 * i)
+	}
+	return ret
+}
+
+func (mem *Memory) ReadPhys64(address uint64) uint64 {
+	return uint64(mem.ReadPhys32(address)) | uint64(mem.ReadPhys32(address+4))<<32
+}
+
+func (mem *Memory) WritePhys32(address uint64, value uint32) {
+	for i := uint64(0); i < 4; i++ {
+		mem.WritePhys8(address+i, byte(value>>(8*i)))
+	}
+}
+
+func (mem *Memory) WritePhys64(address uint64, value uint64) {
+	mem.WritePhys32(address, uint32(value))
+	mem.WritePhys32(address+4, uint32(value>>32))
 }
 
 func (mem *Memory) Read8(address uint32) uint8 {
@@ -62,8 +169,8 @@ func (mem *Memory) Read32(address uint32) uint32 {
 }
 
 func (mem *Memory) Write(address uint32, value byte) {
-	index := address - mem.addressBase
-	mem.ram[index] = value
+	mem.reg.watchMemory(address, true)
+	mem.WritePhys8(mem.translate(uint64(address), pageWrite), value)
 }
 
 func (mem *Memory) Write8(address uint32, value uint8) {
@@ -71,25 +178,64 @@ func (mem *Memory) Write8(address uint32, value uint8) {
 }
 
 func (mem *Memory) Write16(address uint32, value uint16) {
+	// fault on the last byte before writing anything when crossing a page
+	mem.translate(uint64(address+1), pageWrite)
 	for i := 0; i < 2; i++ {
 		mem.Write(address+uint32(i), byte(value>>(uint(i)*8)))
 	}
 }
 
 func (mem *Memory) Write32(address uint32, value uint32) {
+	// fault on the last byte before writing anything when crossing a page
+	mem.translate(uint64(address+3), pageWrite)
 	for i := 0; i < 4; i++ {
 		mem.Write(address+uint32(i), byte(value>>(uint(i)*8)))
 	}
 }
 
+// ReadLinear reads size bytes at a 64-bit linear address, for 64-bit mode
+func (mem *Memory) ReadLinear(address uint64, size uint) uint64 {
+	var ret uint64
+	for i := uint(0); i < size; i++ {
+		a := address + uint64(i)
+		if a < 1<<32 {
+			mem.reg.watchMemory(uint32(a), false)
+		}
+		ret |= uint64(mem.ReadPhys8(mem.translate(a, pageRead))) << (8 * i)
+	}
+	return ret
+}
+
+// WriteLinear writes size bytes at a 64-bit linear address, for 64-bit mode
+func (mem *Memory) WriteLinear(address uint64, size uint, value uint64) {
+	// fault on the last byte before writing anything when crossing a page
+	mem.translate(address+uint64(size)-1, pageWrite)
+	for i := uint(0); i < size; i++ {
+		a := address + uint64(i)
+		if a < 1<<32 {
+			mem.reg.watchMemory(uint32(a), true)
+		}
+		mem.WritePhys8(mem.translate(a, pageWrite), byte(value>>(8*i)))
+	}
+}
+
+// FetchLinear reads an instruction byte at a 64-bit linear address
+func (mem *Memory) FetchLinear(address uint64) uint8 {
+	return mem.ReadPhys8(mem.translate(address, pageFetch))
+}
+
+// GetCode8 reads the instruction byte at EIP+offset. The legacy handlers run in 64-bit mode
+// by extension64 count in EIP the bytes they decoded from RIP.
 func (mem *Memory) GetCode8(offset int) uint8 {
 	reg := mem.reg
-	return mem.Read(reg.EIP + uint32(offset))
+	if reg.mode64 {
+		return uint8(fetch64(reg, mem, int(reg.EIP)+offset, 1))
+	}
+	return mem.readCode(reg.CodeAddress(offset))
 }
 
 func (mem *Memory) GetSignCode8(offset int) int8 {
-	reg := mem.reg
-	return int8(mem.Read(reg.EIP + uint32(offset)))
+	return int8(mem.GetCode8(offset))
 }
 
 func (mem *Memory) GetCode16(offset int) uint16 {
@@ -120,30 +266,30 @@ func (mem *Memory) GetSignCode32(offset int) int32 {
 
 func (mem *Memory) Push16(value uint16) {
 	reg := mem.reg
-	address := reg.ESP - 2
-	reg.ESP = address
-	mem.Write16(address, value)
+	sp := (reg.StackPointer() - 2) & reg.stackMask()
+	mem.Write16(reg.segmentAddress(SegSS, sp, 2, true), value)
+	reg.SetStackPointer(sp)
 }
 
 func (mem *Memory) Push32(value uint32) {
 	reg := mem.reg
-	address := reg.ESP - 4
-	reg.ESP = address
-	mem.Write32(address, value)
+	sp := (reg.StackPointer() - 4) & reg.stackMask()
+	mem.Write32(reg.segmentAddress(SegSS, sp, 4, true), value)
+	reg.SetStackPointer(sp)
 }
 
 func (mem *Memory) Pop16() (ret uint16) {
 	reg := mem.reg
-	address := reg.ESP
-	value := mem.Read16(address)
-	reg.ESP = address + 2
+	sp := reg.StackPointer()
+	value := mem.Read16(reg.segmentAddress(SegSS, sp, 2, false))
+	reg.SetStackPointer(sp + 2)
 	return value
 }
 
 func (mem *Memory) Pop32() (ret uint32) {
 	reg := mem.reg
-	address := reg.ESP
-	value := mem.Read32(address)
-	reg.ESP = address + 4
+	sp := reg.StackPointer()
+	value := mem.Read32(reg.segmentAddress(SegSS, sp, 4, false))
+	reg.SetStackPointer(sp + 4)
 	return value
 }
@@ -0,0 +1,26 @@
+package core
+
+import "testing"
+
+func TestPhysicalOpenBus(t *testing.T) {
+	reg := NewIA32registers(0x1000, 0x2000, false)
+	mem := NewMemory(reg, make([]byte, 0x1000), 0x1000, false)
+	tests := []struct {
+		address uint64
+		want    uint8
+	}{
+		{0x100, openBus},
+		{0xfff, openBus},
+		{0x1000, 0x5a},
+		{0x1fff, 0x5a},
+		{0x2000, openBus},
+		{0xfffffff0, openBus},
+		{1 << 32, 0x5a},
+	}
+	for _, test := range tests {
+		mem.WritePhys8(test.address, 0x5a)
+		if got := mem.ReadPhys8(test.address); got != test.want {
+			t.Errorf("ReadPhys8(%#x) = %#x, want %#x", test.address, got, test.want)
+		}
+	}
+}
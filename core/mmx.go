@@ -0,0 +1,221 @@
+package core
+
+// MM returns MMi, the significand of the physical x87 register Ri
+func (r *X86Registers) MM(i uint8) uint64 {
+	return r.FPU.Regs[i&7].Mant
+}
+
+// SetMM writes MMi; the exponent and sign of Ri read as all ones, like a NaN
+func (r *X86Registers) SetMM(i uint8, value uint64) {
+	r.FPU.Regs[i&7] = Float80{Sign: true, Exp: float80MaxExp, Mant: value}
+}
+
+// MMX MMX instructions on the registers aliased onto the x87 register stack
+type MMX struct {
+	reg *X86Registers
+	mem IMemory
+}
+
+func NewMMX(reg *X86Registers, mem IMemory) *MMX {
+	return &MMX{
+		reg: reg,
+		mem: mem,
+	}
+}
+
+// check MMX instructions raise #UD with CR0.EM, #NM with CR0.TS, and #MF or IRQ13 for a
+// pending x87 exception
+func (m *MMX) check() {
+	reg := m.reg
+	if reg.features().Leaf1EDX&FeatureMMX == 0 || reg.CR0&CR0EM != 0 {
+		raise(ExceptionUD)
+	}
+	if reg.CR0&CR0TS != 0 {
+		raise(ExceptionNM)
+	}
+	fpuPending(reg)
+}
+
+// require instructions added to MMX by later extensions raise #UD without their feature
+func (m *MMX) require(feature uint32) {
+	if m.reg.features().Leaf1EDX&feature == 0 {
+		raise(ExceptionUD)
+	}
+}
+
+// enterMMX the x87 stack belongs to MMX: TOP is 0 and every register is tagged valid
+func (s *FPUState) enterMMX() {
+	s.setTop(0)
+	s.Tag = 0
+}
+
+func (m *MMX) enter() {
+	m.check()
+	m.reg.FPU.enterMMX()
+}
+
+// decode enters MMX state and decodes the ModRM byte after the second opcode byte
+func (m *MMX) decode() ModRM {
+	reg := m.reg
+	m.enter()
+	reg.EIP += 1
+	return NewModRM(reg, m.mem)
+}
+
+// source the mm/m64 operand
+func (m *MMX) source(modrm *ModRM) uint64 {
+	if modrm.Mod == 3 {
+		return m.reg.MM(modrm.Rm)
+	}
+	return readQword(m.mem, modrm.linear(8, false))
+}
+
+// MovdMMRM32 MOVD mm, r/m32 (0F 6E), MOVQ mm, r/m64 with REX.W: zero-extended
+func (m *MMX) MovdMMRM32() {
+	reg := m.reg
+	modrm := m.decode()
+	reg.SetMM(modrm.RegIndex, modrm.GetRMW())
+}
+
+// MovdRM32MM MOVD r/m32, mm (0F 7E), MOVQ r/m64, mm with REX.W
+func (m *MMX) MovdRM32MM() {
+	reg := m.reg
+	modrm := m.decode()
+	modrm.SetRMW(reg.MM(modrm.RegIndex))
+}
+
+// MovqMMRM64 MOVQ mm, mm/m64 (0F 6F)
+func (m *MMX) MovqMMRM64() {
+	reg := m.reg
+	modrm := m.decode()
+	reg.SetMM(modrm.RegIndex, m.source(&modrm))
+}
+
+// MovqRM64MM MOVQ mm/m64, mm (0F 7F)
+func (m *MMX) MovqRM64MM() {
+	reg := m.reg
+	mem := m.mem
+	modrm := m.decode()
+	value := reg.MM(modrm.RegIndex)
+	if modrm.Mod == 3 {
+		reg.SetMM(modrm.Rm, value)
+		return
+	}
+	writeQword(mem, modrm.linear(8, true), value)
+}
+
+// Packed mm = mm op mm/m64: the arithmetic, logic, compare, pack and unpack instructions
+// of packedOps
+func (m *MMX) Packed() {
+	reg := m.reg
+	code := m.mem.GetCode8(0)
+	if feature, ok := packedFeature[code]; ok {
+		m.require(feature)
+	}
+	op := packedOps[code]
+	modrm := m.decode()
+	reg.SetMM(modrm.RegIndex, op(reg.MM(modrm.RegIndex), m.source(&modrm)))
+}
+
+// Shift PSRL, PSRA and PSLL by the count in mm/m64
+func (m *MMX) Shift() {
+	reg := m.reg
+	shift := packedShifts[m.mem.GetCode8(0)]
+	modrm := m.decode()
+	count := m.source(&modrm)
+	reg.SetMM(modrm.RegIndex, shiftLanes(reg.MM(modrm.RegIndex), count, shift.width, shift.kind))
+}
+
+// ShiftImm groups 12-14 (0F 71-73): PSRLW/PSRAW/PSLLW, PSRLD/PSRAD/PSLLD, PSRLQ/PSLLQ mm, imm8
+func (m *MMX) ShiftImm() {
+	reg := m.reg
+	mem := m.mem
+	width := [3]uint{16, 32, 64}[mem.GetCode8(0)-0x71]
+	modrm := m.decode()
+	kind := modrm.Opcode
+	if modrm.Mod != 3 || kind != shiftRightLogical && kind != shiftLeft &&
+		(kind != shiftRightArithmetic || width == 64) {
+		raise(ExceptionUD)
+	}
+	count := uint64(mem.GetCode8(0))
+	reg.EIP += 1
+	reg.SetMM(modrm.Rm, shiftLanes(reg.MM(modrm.Rm), count, width, kind))
+}
+
+// Pshufw PSHUFW mm, mm/m64, imm8 (0F 70)
+func (m *MMX) Pshufw() {
+	reg := m.reg
+	m.require(FeatureSSE)
+	modrm := m.decode()
+	src := m.source(&modrm)
+	order := m.mem.GetCode8(0)
+	reg.EIP += 1
+	reg.SetMM(modrm.RegIndex, shuffleWords(src, order))
+}
+
+// Pinsrw PINSRW mm, r32/m16, imm8 (0F C4)
+func (m *MMX) Pinsrw() {
+	reg := m.reg
+	m.require(FeatureSSE)
+	modrm := m.decode()
+	value := uint64(modrm.GetRM16())
+	i := uint(m.mem.GetCode8(0) & 3)
+	reg.EIP += 1
+	mm := reg.MM(modrm.RegIndex)
+	reg.SetMM(modrm.RegIndex, mm&^(0xffff<<(16*i))|value<<(16*i))
+}
+
+// Pextrw PEXTRW r32, mm, imm8 (0F C5)
+func (m *MMX) Pextrw() {
+	reg := m.reg
+	m.require(FeatureSSE)
+	modrm := m.decode()
+	if modrm.Mod != 3 {
+		raise(ExceptionUD)
+	}
+	i := uint(m.mem.GetCode8(0) & 3)
+	reg.EIP += 1
+	modrm.SetR32(uint32(reg.MM(modrm.Rm) >> (16 * i) & 0xffff))
+}
+
+// Pmovmskb PMOVMSKB r32, mm (0F D7): the sign bits of the bytes
+func (m *MMX) Pmovmskb() {
+	reg := m.reg
+	m.require(FeatureSSE)
+	modrm := m.decode()
+	if modrm.Mod != 3 {
+		raise(ExceptionUD)
+	}
+	modrm.SetR32(byteSigns(reg.MM(modrm.Rm)))
+}
+
+// Movntq MOVNTQ m64, mm (0F E7): a non-temporal store
+func (m *MMX) Movntq() {
+	reg := m.reg
+	m.require(FeatureSSE)
+	modrm := m.decode()
+	if modrm.Mod == 3 {
+		raise(ExceptionUD)
+	}
+	writeQword(m.mem, modrm.linear(8, true), reg.MM(modrm.RegIndex))
+}
+
+// Maskmovq MASKMOVQ mm, mm (0F F7): stores the bytes of the first operand selected by the
+// sign bits of the second at DS:(E)DI
+func (m *MMX) Maskmovq() {
+	reg := m.reg
+	m.require(FeatureSSE)
+	modrm := m.decode()
+	if modrm.Mod != 3 {
+		raise(ExceptionUD)
+	}
+	maskedStore(reg, m.mem, []uint64{reg.MM(modrm.RegIndex)}, []uint64{reg.MM(modrm.Rm)})
+}
+
+// Emms EMMS (0F 77): empties the x87 register stack
+func (m *MMX) Emms() {
+	reg := m.reg
+	m.check()
+	reg.FPU.Tag = 0xffff
+	reg.EIP += 1
+}
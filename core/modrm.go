@@ -1,10 +1,5 @@
 package core
 
-import (
-	"fmt"
-	"os"
-)
-
 type ModRM struct {
 	reg *X86Registers
 	mem IMemory
@@ -16,6 +11,14 @@ type ModRM struct {
 	Sib      uint8
 	Disp8    int8
 	Disp32   uint32
+	// Address16 the operand uses the 16-bit addressing forms ([BX+SI], [BP+DI], ...)
+	Address16 bool
+	// long the operand is decoded in 64-bit mode: REX extends Rm, RegIndex and the SIB
+	// registers, and mod 00 r/m 101 addresses relative to next, the length of the
+	// instruction counted from RIP
+	long        bool
+	ripRelative bool
+	next        uint32
 }
 
 func NewModRM(reg *X86Registers, mem IMemory) ModRM {
@@ -26,14 +29,27 @@ func NewModRM(reg *X86Registers, mem IMemory) ModRM {
 	modrm.Opcode = (code & 0x38) >> 3
 	modrm.RegIndex = modrm.Opcode
 	modrm.Rm = code & 0x7
+	modrm.Address16 = !reg.mode64 && !reg.isAddress32()
 
 	reg.EIP += 1
 
+	if modrm.Address16 {
+		if (modrm.Mod == 0 && modrm.Rm == 6) || modrm.Mod == 2 {
+			modrm.Disp32 = uint32(mem.GetSignCode16(0))
+			reg.EIP += 2
+		} else if modrm.Mod == 1 {
+			modrm.Disp8 = mem.GetSignCode8(0)
+			modrm.Disp32 = uint32(modrm.Disp8)
+			reg.EIP += 1
+		}
+		return modrm
+	}
+
 	if modrm.Mod != 3 && modrm.Rm == 4 {
 		modrm.Sib = mem.GetCode8(0)
 		reg.EIP += 1
 	}
-	if (modrm.Mod == 0 && modrm.Rm == 5) || modrm.Mod == 2 {
+	if (modrm.Mod == 0 && modrm.Rm == 5) || modrm.Mod == 2 || (modrm.Mod == 0 && modrm.Rm == 4 && modrm.Sib&7 == 5) {
 		modrm.Disp32 = mem.GetCode32(0)
 		reg.EIP += 4
 	} else if modrm.Mod == 1 {
@@ -41,73 +57,108 @@ func NewModRM(reg *X86Registers, mem IMemory) ModRM {
 		modrm.Disp32 = uint32(modrm.Disp8)
 		reg.EIP += 1
 	}
+	if reg.mode64 {
+		modrm.extend64()
+	}
 	return modrm
 }
 
+// extend64 applies REX to the fields decoded in 64-bit mode, for the legacy handlers run by
+// extension64: R extends RegIndex and B the r/m register
+func (modrm *ModRM) extend64() {
+	reg := modrm.reg
+	modrm.long = true
+	modrm.ripRelative = modrm.Mod == 0 && modrm.Rm == 5
+	modrm.next = reg.EIP + reg.immediate
+	modrm.RegIndex |= reg.rex & 4 << 1
+	modrm.Rm |= reg.rex & 1 << 3
+}
+
 func (modrm *ModRM) SetRM8(value uint8) {
+	if modrm.long {
+		modrm.setRM64(8, uint64(value))
+		return
+	}
 	if modrm.Mod == 3 {
 		reg := modrm.reg
 		reg.Set8ByIndex(modrm.Rm, value)
 	} else {
 		mem := modrm.mem
-		address := modrm.calcAddress()
+		address := modrm.calcAddress(1, true)
 		mem.Write8(address, value)
 	}
 }
 
 func (modrm *ModRM) SetRM16(value uint16) {
+	if modrm.long {
+		modrm.setRM64(16, uint64(value))
+		return
+	}
 	if modrm.Mod == 3 {
 		reg := modrm.reg
 		reg.Set16ByIndex(modrm.Rm, value)
 	} else {
 		mem := modrm.mem
-		address := modrm.calcAddress()
+		address := modrm.calcAddress(2, true)
 		mem.Write16(address, value)
 	}
 }
 
 func (modrm *ModRM) SetRM32(value uint32) {
+	if modrm.long {
+		modrm.setRM64(32, uint64(value))
+		return
+	}
 	if modrm.Mod == 3 {
 		reg := modrm.reg
 		reg.SetByIndex(modrm.Rm, value)
 	} else {
 		mem := modrm.mem
-		address := modrm.calcAddress()
+		address := modrm.calcAddress(4, true)
 		mem.Write32(address, value)
 	}
 }
 
 func (modrm *ModRM) GetRM8() (result uint8) {
+	if modrm.long {
+		return uint8(modrm.getRM64(8))
+	}
 	if modrm.Mod == 3 {
 		reg := modrm.reg
 		result = reg.Get8ByIndex(modrm.Rm)
 	} else {
 		mem := modrm.mem
-		address := modrm.calcAddress()
+		address := modrm.calcAddress(1, false)
 		result = mem.Read8(address)
 	}
 	return result
 }
 
 func (modrm *ModRM) GetRM16() (result uint16) {
+	if modrm.long {
+		return uint16(modrm.getRM64(16))
+	}
 	if modrm.Mod == 3 {
 		reg := modrm.reg
 		result = reg.Get16ByIndex(modrm.Rm)
 	} else {
 		mem := modrm.mem
-		address := modrm.calcAddress()
+		address := modrm.calcAddress(2, false)
 		result = mem.Read16(address)
 	}
 	return result
 }
 
 func (modrm *ModRM) GetRM32() (result uint32) {
+	if modrm.long {
+		return uint32(modrm.getRM64(32))
+	}
 	if modrm.Mod == 3 {
 		reg := modrm.reg
 		result = reg.GetByIndex(modrm.Rm)
 	} else {
 		mem := modrm.mem
-		address := modrm.calcAddress()
+		address := modrm.calcAddress(4, false)
 		result = mem.Read32(address)
 	}
 	return result
@@ -115,57 +166,291 @@ func (modrm *ModRM) GetRM32() (result uint32) {
 
 func (modrm *ModRM) SetR8(value uint8) {
 	reg := modrm.reg
+	if modrm.long {
+		reg.X64.Set(modrm.RegIndex, 8, reg.rex != 0, uint64(value))
+		return
+	}
 	reg.Set8ByIndex(modrm.RegIndex, value)
 }
 
 func (modrm *ModRM) SetR16(value uint16) {
 	reg := modrm.reg
+	if modrm.long {
+		reg.X64.Set(modrm.RegIndex, 16, reg.rex != 0, uint64(value))
+		return
+	}
 	reg.Set16ByIndex(modrm.RegIndex, value)
 }
 
 func (modrm *ModRM) SetR32(value uint32) {
 	reg := modrm.reg
+	if modrm.long {
+		reg.X64.Set(modrm.RegIndex, 32, reg.rex != 0, uint64(value))
+		return
+	}
 	reg.SetByIndex(modrm.RegIndex, value)
 }
 
 func (modrm *ModRM) GetR8() uint8 {
 	reg := modrm.reg
+	if modrm.long {
+		return uint8(reg.X64.Get(modrm.RegIndex, 8, reg.rex != 0))
+	}
 	return reg.Get8ByIndex(modrm.RegIndex)
 }
 
 func (modrm *ModRM) GetR16() uint16 {
 	reg := modrm.reg
+	if modrm.long {
+		return uint16(reg.X64.Get(modrm.RegIndex, 16, reg.rex != 0))
+	}
 	return reg.Get16ByIndex(modrm.RegIndex)
 }
 
 func (modrm *ModRM) GetR32() uint32 {
 	reg := modrm.reg
+	if modrm.long {
+		return uint32(reg.X64.Get(modrm.RegIndex, 32, reg.rex != 0))
+	}
 	return reg.GetByIndex(modrm.RegIndex)
 }
 
-func (modrm *ModRM) calcAddress() uint32 {
-	if modrm.Mod == 0 {
-		if modrm.Rm == 4 {
-			fmt.Println("not implemented ModRM mod = 0, rm = 4")
-			os.Exit(0)
-		}
-		if modrm.Rm == 5 {
-			return modrm.Disp32
+// GetRM64, SetRM64, GetR64 and SetR64 the 64-bit operands of 64-bit mode
+func (modrm *ModRM) GetRM64() uint64 {
+	return modrm.getRM64(64)
+}
+
+func (modrm *ModRM) SetRM64(value uint64) {
+	modrm.setRM64(64, value)
+}
+
+func (modrm *ModRM) GetR64() uint64 {
+	reg := modrm.reg
+	return reg.X64.Get(modrm.RegIndex, 64, true)
+}
+
+func (modrm *ModRM) SetR64(value uint64) {
+	reg := modrm.reg
+	reg.X64.Set(modrm.RegIndex, 64, true, value)
+}
+
+// getRM64 and setRM64 the r/m operand of width bits in 64-bit mode
+func (modrm *ModRM) getRM64(width uint) uint64 {
+	reg := modrm.reg
+	if modrm.Mod == 3 {
+		return reg.X64.Get(modrm.Rm, width, reg.rex != 0)
+	}
+	return modrm.mem.ReadLinear(modrm.linear(uint32(width/8), false), width/8)
+}
+
+func (modrm *ModRM) setRM64(width uint, value uint64) {
+	reg := modrm.reg
+	if modrm.Mod == 3 {
+		reg.X64.Set(modrm.Rm, width, reg.rex != 0, value)
+		return
+	}
+	modrm.mem.WriteLinear(modrm.linear(uint32(width/8), true), width/8, value)
+}
+
+// wide REX.W, or VEX.W, selects the 64-bit general register operands of 64-bit mode
+func (modrm *ModRM) wide() bool {
+	return modrm.long && modrm.reg.rexW()
+}
+
+// GetRMW, SetRMW and SetRW the general register operands of the SSE and AVX instructions
+// moving them: r/m64 and r64 when wide, r/m32 and r32 otherwise
+func (modrm *ModRM) GetRMW() uint64 {
+	if modrm.wide() {
+		return modrm.GetRM64()
+	}
+	return uint64(modrm.GetRM32())
+}
+
+func (modrm *ModRM) SetRMW(value uint64) {
+	if modrm.wide() {
+		modrm.SetRM64(value)
+		return
+	}
+	modrm.SetRM32(uint32(value))
+}
+
+func (modrm *ModRM) SetRW(value uint64) {
+	if modrm.wide() {
+		modrm.SetR64(value)
+		return
+	}
+	modrm.SetR32(uint32(value))
+}
+
+// linear the linear address of a size bytes memory operand: calcAddress, or in 64-bit mode
+// the 64-bit address, which must be canonical
+func (modrm *ModRM) linear(size uint32, write bool) uint64 {
+	if !modrm.long {
+		return uint64(modrm.calcAddress(size, write))
+	}
+	address := modrm.reg.dataBase() + modrm.offset64()
+	vector := uint8(ExceptionGP)
+	if modrm.stack64() {
+		vector = ExceptionSS
+	}
+	checkCanonical(address, uint(size), vector)
+	return address
+}
+
+// element linear address of a size-byte element of an operand accessed element by element:
+// the 64-bit address in 64-bit mode, else offset in segment
+func (modrm *ModRM) element(address uint64, segment uint8, offset uint32, size uint32, write bool) uint64 {
+	if !modrm.long {
+		return uint64(modrm.reg.segmentAddress(segment, offset, size, write))
+	}
+	checkCanonical(address, uint(size), ExceptionGP)
+	return address
+}
+
+// offset64 the effective address of the memory operand in 64-bit mode, 32-bit with the 67
+// prefix
+func (modrm *ModRM) offset64() uint64 {
+	reg := modrm.reg
+	x := &reg.X64
+	var ea uint64
+	switch {
+	case modrm.ripRelative:
+		ea = x.RIP + uint64(modrm.next) + modrm.disp64()
+	case modrm.Rm&7 == 4:
+		ea = modrm.sibBase64()
+		if index := modrm.sibIndex64(); index != 4 {
+			ea += *x.register(index) << (modrm.Sib >> 6)
 		}
-		result := modrm.reg.GetByIndex(modrm.Rm)
-		return result
+	default:
+		ea = *x.register(modrm.Rm) + modrm.disp64()
+	}
+	if reg.addrOverride {
+		ea &= 0xffffffff
 	}
+	return ea
+}
 
-	if modrm.Mod == 1 {
-		if modrm.Rm == 4 {
-			fmt.Println("not implemented ModRM mod = 2, rm = 4")
-			os.Exit(0)
+func (modrm *ModRM) disp64() uint64 {
+	return uint64(int64(int32(modrm.Disp32)))
+}
+
+// sibBase64 the base and displacement of a SIB operand in 64-bit mode, without its index
+func (modrm *ModRM) sibBase64() uint64 {
+	reg := modrm.reg
+	var base uint64
+	if modrm.Sib&7 != 5 || modrm.Mod != 0 {
+		base = *reg.X64.register(modrm.Sib&7 | reg.rex&1<<3)
+	}
+	return base + modrm.disp64()
+}
+
+// sibIndex64 the SIB index register extended by REX.X, a vector register for VSIB
+func (modrm *ModRM) sibIndex64() uint8 {
+	return modrm.Sib>>3&7 | modrm.reg.rex&2<<2
+}
+
+// stack64 the base register is RSP or RBP: a non-canonical address raises #SS
+func (modrm *ModRM) stack64() bool {
+	base := modrm.Rm
+	if base&7 == 4 {
+		base = modrm.Sib&7 | modrm.reg.rex&1<<3
+	}
+	return (base == 4 || base == 5) && !(modrm.Mod == 0 && base&7 == 5)
+}
+
+// calcAddress linear address of a size bytes memory operand, after the segment checks
+func (modrm *ModRM) calcAddress(size uint32, write bool) uint32 {
+	offset, segment := modrm.calcOffset()
+	reg := modrm.reg
+	return reg.segmentAddress(reg.dataSegment(segment), offset, size, write)
+}
+
+// calcOffset effective address of the memory operand and its default segment
+func (modrm *ModRM) calcOffset() (uint32, uint8) {
+	if modrm.Address16 {
+		return modrm.calcOffset16()
+	}
+	return modrm.calcOffset32()
+}
+
+func (modrm *ModRM) calcOffset16() (uint32, uint8) {
+	reg := modrm.reg
+	bx := uint32(reg.Get16ByIndex(3))
+	bp := uint32(reg.Get16ByIndex(5))
+	si := uint32(reg.Get16ByIndex(6))
+	di := uint32(reg.Get16ByIndex(7))
+
+	var result uint32
+	segment := SegDS
+	switch modrm.Rm {
+	case 0:
+		result = bx + si
+	case 1:
+		result = bx + di
+	case 2:
+		result = bp + si
+		segment = SegSS
+	case 3:
+		result = bp + di
+		segment = SegSS
+	case 4:
+		result = si
+	case 5:
+		result = di
+	case 6:
+		if modrm.Mod == 0 {
+			return modrm.Disp32 & 0xffff, segment
 		}
-		result := modrm.reg.GetByIndex(modrm.Rm) + modrm.Disp32
-		return result
+		result = bp
+		segment = SegSS
+	case 7:
+		result = bx
+	}
+	return (result + modrm.Disp32) & 0xffff, segment
+}
+
+func (modrm *ModRM) calcOffset32() (uint32, uint8) {
+	reg := modrm.reg
+	if modrm.Rm == 4 {
+		return modrm.calcSib()
+	}
+	if modrm.Mod == 0 && modrm.Rm == 5 {
+		return modrm.Disp32, SegDS
 	}
+	segment := SegDS
+	if modrm.Rm == 5 {
+		segment = SegSS
+	}
+	return reg.GetByIndex(modrm.Rm) + modrm.Disp32, segment
+}
+
+func (modrm *ModRM) calcSib() (uint32, uint8) {
+	reg := modrm.reg
+	scale := modrm.Sib >> 6
+	index := (modrm.Sib >> 3) & 7
+
+	result, segment := modrm.sibBase()
+	if index != 4 {
+		result += reg.GetByIndex(index) << scale
+	}
+	return result, segment
+}
+
+// sibBase the base and displacement of a SIB operand without its index, and its default
+// segment. VSIB operands add an element of a vector register as index.
+func (modrm *ModRM) sibBase() (uint32, uint8) {
+	reg := modrm.reg
+	base := modrm.Sib & 7
 
-	fmt.Println("not implemented ModRM mod", modrm.Mod)
-	os.Exit(0)
-	return 0
+	var result uint32
+	segment := SegDS
+	if base == 5 && modrm.Mod == 0 {
+		result = 0
+	} else {
+		result = reg.GetByIndex(base)
+		if base == 4 || base == 5 {
+			segment = SegSS
+		}
+	}
+	return result + modrm.Disp32, segment
 }
@@ -0,0 +1,255 @@
+package core
+
+import "time"
+
+// Model-specific register indexes
+const (
+	MSRTSC             = 0x10
+	MSRAPICBase        = 0x1b
+	MSRMTRRCap         = 0xfe
+	MSRSysenterCS      = 0x174
+	MSRSysenterESP     = 0x175
+	MSRSysenterEIP     = 0x176
+	MSRMTRRPhysBase0   = 0x200 // variable ranges: base and mask pairs up to 0x20f
+	MSRMTRRFix64K      = 0x250
+	MSRMTRRFix16K80000 = 0x258
+	MSRMTRRFix16KA0000 = 0x259
+	MSRMTRRFix4KC0000  = 0x268 // 4 KiB fixed ranges up to 0x26f
+	MSRPAT             = 0x277
+	MSRMTRRDefType     = 0x2ff
+	MSREFER            = 0xc0000080
+	MSRTSCAux          = 0xc0000103
+)
+
+const (
+	mtrrVariableRanges = 8
+	// apicBaseDefault xAPIC at FEE00000, globally enabled, bootstrap processor
+	apicBaseDefault = 0xfee00900
+	patDefault      = 0x0007040600070406
+)
+
+// MSR a model-specific register. Write may raise #GP for values the register rejects.
+type MSR interface {
+	Read(reg *X86Registers) uint64
+	Write(reg *X86Registers, value uint64)
+}
+
+// MSRFile the model-specific registers of the processor by index. Registering an MSR
+// replaces the built-in one, RDMSR and WRMSR raise #GP for an index with no register.
+type MSRFile struct {
+	msrs map[uint32]MSR
+}
+
+// NewMSRFile returns the architectural MSRs in their power-on state
+func NewMSRFile() *MSRFile {
+	f := &MSRFile{msrs: make(map[uint32]MSR)}
+	f.Register(MSRTSC, tscMSR{})
+	f.Register(MSREFER, eferMSR{})
+	f.Register(MSRAPICBase, &StoredMSR{Value: apicBaseDefault, Writable: 0xfffff0900})
+	f.Register(MSRSysenterCS, &StoredMSR{Writable: 0xffff})
+	f.Register(MSRSysenterESP, &StoredMSR{Writable: 0xffffffff})
+	f.Register(MSRSysenterEIP, &StoredMSR{Writable: 0xffffffff})
+	f.Register(MSRPAT, patMSR{&StoredMSR{Value: patDefault}})
+	f.Register(MSRTSCAux, &StoredMSR{Writable: 0xffffffff})
+	// fixed ranges, write combining, variable ranges
+	f.Register(MSRMTRRCap, &StoredMSR{Value: 1<<10 | 1<<8 | mtrrVariableRanges})
+	f.Register(MSRMTRRDefType, &StoredMSR{Writable: 0xcff})
+	for i := uint32(0); i < 2*mtrrVariableRanges; i++ {
+		writable := uint64(1<<maxPhysAddr-1) &^ 0xf00
+		if i&1 != 0 {
+			writable = uint64(1<<maxPhysAddr-1) &^ 0x7ff
+		}
+		f.Register(MSRMTRRPhysBase0+i, &StoredMSR{Writable: writable})
+	}
+	fixed := []uint32{MSRMTRRFix64K, MSRMTRRFix16K80000, MSRMTRRFix16KA0000}
+	for i := uint32(0); i < 8; i++ {
+		fixed = append(fixed, MSRMTRRFix4KC0000+i)
+	}
+	for _, index := range fixed {
+		f.Register(index, &StoredMSR{Writable: ^uint64(0)})
+	}
+	registerLongMSRs(f)
+	return f
+}
+
+// Register installs msr at index
+func (f *MSRFile) Register(index uint32, msr MSR) {
+	f.msrs[index] = msr
+}
+
+func (f *MSRFile) lookup(index uint32) MSR {
+	msr, ok := f.msrs[index]
+	if !ok {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	return msr
+}
+
+// StoredMSR an MSR holding a value; setting a bit outside Writable raises #GP
+type StoredMSR struct {
+	Value    uint64
+	Writable uint64
+}
+
+func (m *StoredMSR) Read(reg *X86Registers) uint64 {
+	return m.Value
+}
+
+func (m *StoredMSR) Write(reg *X86Registers, value uint64) {
+	if value&^m.Writable != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	m.Value = value
+}
+
+// patMSR IA32_PAT: eight memory types, 2 and 3 are reserved
+type patMSR struct {
+	*StoredMSR
+}
+
+func (m patMSR) Write(reg *X86Registers, value uint64) {
+	for i := 0; i < 8; i++ {
+		kind := value >> (8 * i) & 0xff
+		if kind > 7 || kind == 2 || kind == 3 {
+			raiseWithCode(ExceptionGP, 0)
+		}
+	}
+	m.Value = value
+}
+
+// eferMSR IA32_EFER: SCE, LME and NXE are writable when CPUID reports their feature,
+// LMA only reflects the processor state
+type eferMSR struct{}
+
+func (eferMSR) Read(reg *X86Registers) uint64 {
+	return reg.IA32Efer
+}
+
+func (eferMSR) Write(reg *X86Registers, value uint64) {
+	features := reg.features()
+	writable := uint64(EFERLMA)
+	if features.ExtEDX&FeatureSYSCALL != 0 {
+		writable |= EFERSCE
+	}
+	if features.ExtEDX&FeatureLM != 0 {
+		writable |= EFERLME
+	}
+	if features.ExtEDX&FeatureNX != 0 {
+		writable |= EFERNXE
+	}
+	if value&^writable != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	// LME cannot change while paging is on
+	if reg.CR0&CR0PG != 0 && (reg.IA32Efer^value)&EFERLME != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	reg.IA32Efer = value&^EFERLMA | reg.IA32Efer&EFERLMA
+}
+
+// tscMSR IA32_TSC: writing it moves the time-stamp counter
+type tscMSR struct{}
+
+func (tscMSR) Read(reg *X86Registers) uint64 {
+	return reg.tsc()
+}
+
+func (tscMSR) Write(reg *X86Registers, value uint64) {
+	reg.tscOffset = value - reg.clock.Ticks(reg.retired)
+}
+
+// Clock drives the time-stamp counter
+type Clock interface {
+	// Ticks returns the cycles elapsed once retired instructions have executed
+	Ticks(retired uint64) uint64
+}
+
+// InstructionClock a deterministic clock ticking once per instruction
+type InstructionClock struct{}
+
+func (InstructionClock) Ticks(retired uint64) uint64 {
+	return retired
+}
+
+// HostClock ticks once per nanosecond of host time since its creation
+type HostClock struct {
+	start time.Time
+}
+
+func NewHostClock() *HostClock {
+	return &HostClock{start: time.Now()}
+}
+
+func (c *HostClock) Ticks(retired uint64) uint64 {
+	return uint64(time.Since(c.start).Nanoseconds())
+}
+
+// tsc current value of the time-stamp counter
+func (r *X86Registers) tsc() uint64 {
+	return r.clock.Ticks(r.retired) + r.tscOffset
+}
+
+// Rdmsr RDMSR (0F 32): EDX:EAX = MSR[ECX]
+func (s *System) Rdmsr() {
+	reg := s.reg
+	s.checkFeatureMSR()
+	s.checkPrivileged()
+	value := reg.msrs.lookup(reg.ECX).Read(reg)
+	reg.EAX = uint32(value)
+	reg.EDX = uint32(value >> 32)
+	reg.EIP += 1
+}
+
+// Wrmsr WRMSR (0F 30): MSR[ECX] = EDX:EAX
+func (s *System) Wrmsr() {
+	reg := s.reg
+	s.checkFeatureMSR()
+	s.checkPrivileged()
+	msr := reg.msrs.lookup(reg.ECX)
+	oldEfer := reg.IA32Efer
+	msr.Write(reg, uint64(reg.EDX)<<32|uint64(reg.EAX))
+	if (oldEfer^reg.IA32Efer)&EFERNXE != 0 {
+		s.mem.FlushTLB(false)
+	}
+	reg.EIP += 1
+}
+
+func (s *System) checkFeatureMSR() {
+	if s.reg.features().Leaf1EDX&FeatureMSR == 0 {
+		raise(ExceptionUD)
+	}
+}
+
+// checkTSC RDTSC and RDTSCP are restricted to ring 0 by CR4.TSD
+func (s *System) checkTSC() {
+	reg := s.reg
+	if reg.CR4&CR4TSD != 0 && reg.CPL() != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+}
+
+// Rdtsc RDTSC (0F 31): EDX:EAX = time-stamp counter
+func (s *System) Rdtsc() {
+	reg := s.reg
+	if reg.features().Leaf1EDX&FeatureTSC == 0 {
+		raise(ExceptionUD)
+	}
+	s.checkTSC()
+	tsc := reg.tsc()
+	reg.EAX = uint32(tsc)
+	reg.EDX = uint32(tsc >> 32)
+	reg.EIP += 1
+}
+
+// rdtscp RDTSCP (0F 01 F9): EDX:EAX = time-stamp counter, ECX = IA32_TSC_AUX
+func (s *System) rdtscp() {
+	reg := s.reg
+	if reg.features().ExtEDX&FeatureRDTSCP == 0 {
+		raise(ExceptionUD)
+	}
+	s.checkTSC()
+	tsc := reg.tsc()
+	reg.EAX = uint32(tsc)
+	reg.EDX = uint32(tsc >> 32)
+	reg.ECX = uint32(reg.msrs.lookup(MSRTSCAux).Read(reg))
+}
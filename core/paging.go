@@ -0,0 +1,387 @@
+package core
+
+// Page directory and page table entry bits
+const (
+	pagePresent      = 1 << 0
+	pageWritable     = 1 << 1
+	pageUser         = 1 << 2
+	pageWriteThrough = 1 << 3
+	pageCacheDisable = 1 << 4
+	pageAccessed     = 1 << 5
+	pageDirty        = 1 << 6
+	pageSize         = 1 << 7 // PDE only: 4 MiB page, 2 MiB with PAE
+	pageGlobal       = 1 << 8
+	pageNoExecute    = 1 << 63 // PAE entries with EFER.NXE
+)
+
+const (
+	// maxPhysAddr width of physical addresses produced by PAE and PSE-36 pages
+	maxPhysAddr = 36
+	// pageFrameMask physical frame bits of a 64-bit PAE entry
+	pageFrameMask = (1<<maxPhysAddr - 1) &^ 0xfff
+	// pdpteReserved bits 1, 2 and 5-8 of a PAE page-directory-pointer-table entry
+	pdpteReserved = 0x1e6
+)
+
+// Page fault error code bits
+const (
+	pfPresent  = 1 << 0 // protection violation, 0 = page not present
+	pfWrite    = 1 << 1
+	pfUser     = 1 << 2
+	pfReserved = 1 << 3
+	pfFetch    = 1 << 4
+)
+
+type pageAccess int
+
+const (
+	pageRead pageAccess = iota
+	pageWrite
+	pageFetch
+)
+
+type tlbEntry struct {
+	frame    uint64 // physical address of the 4 KiB page
+	writable bool
+	user     bool
+	dirty    bool
+	global   bool
+	noExec   bool
+}
+
+// TLB software translation lookaside buffer, indexed by linear page number
+type TLB struct {
+	entries map[uint64]tlbEntry
+}
+
+func NewTLB() *TLB {
+	return &TLB{entries: make(map[uint64]tlbEntry)}
+}
+
+// Flush drops every entry; global entries survive when keepGlobal is set (CR3 reload with CR4.PGE)
+func (t *TLB) Flush(keepGlobal bool) {
+	if !keepGlobal {
+		t.entries = make(map[uint64]tlbEntry)
+		return
+	}
+	for page, entry := range t.entries {
+		if !entry.global {
+			delete(t.entries, page)
+		}
+	}
+}
+
+// Invalidate drops the entry of the page containing address (INVLPG)
+func (t *TLB) Invalidate(address uint64) {
+	delete(t.entries, address>>12)
+}
+
+// allows the cached translation can be used without walking the tables again
+func (e *tlbEntry) allows(access pageAccess, user bool, wp bool) bool {
+	if user && !e.user {
+		return false
+	}
+	if access == pageFetch && e.noExec {
+		return false
+	}
+	if access == pageWrite {
+		if !e.dirty {
+			return false
+		}
+		if !e.writable && (user || wp) {
+			return false
+		}
+	}
+	return true
+}
+
+// linearToPhysical translates a linear address through the page tables when CR0.PG is set
+func (mem *Memory) linearToPhysical(address uint64, access pageAccess) uint64 {
+	reg := mem.reg
+	if reg.CR0&CR0PG == 0 {
+		return uint64(address)
+	}
+	user := reg.CPL() == 3 && !mem.implicit
+	wp := reg.CR0&CR0WP != 0
+	entry, ok := mem.tlb.entries[address>>12]
+	if !ok || !entry.allows(access, user, wp) {
+		entry = mem.walk(address, access, user, wp)
+	}
+	return entry.frame | address&0xfff
+}
+
+// walk reads the page tables, checks the access rights, updates the accessed
+// and dirty bits and fills the TLB. #PF is raised on failure.
+func (mem *Memory) walk(address uint64, access pageAccess, user bool, wp bool) tlbEntry {
+	var entry tlbEntry
+	switch {
+	case mem.reg.IA32Efer&EFERLMA != 0:
+		entry = mem.walk4(address, access, user, wp)
+	case mem.reg.CR4&CR4PAE != 0:
+		entry = mem.walkPAE(uint32(address), access, user, wp)
+	default:
+		entry = mem.walk32(uint32(address), access, user, wp)
+	}
+	mem.tlb.entries[address>>12] = entry
+	return entry
+}
+
+// walk32 two-level tables of 32-bit entries, 4 MiB pages with CR4.PSE (PSE-36 above 4 GiB)
+func (mem *Memory) walk32(address uint32, access pageAccess, user bool, wp bool) tlbEntry {
+	reg := mem.reg
+	pdeAddress := reg.CR3&0xfffff000 | uint64(address>>22)<<2
+	pde := mem.ReadPhys32(pdeAddress)
+	if pde&pagePresent == 0 {
+		mem.pageFault(uint64(address), access, user, 0)
+	}
+
+	var entry tlbEntry
+	if pde&pageSize != 0 && reg.CR4&CR4PSE != 0 {
+		entry = tlbEntry{
+			frame:    uint64(pde&0xffc00000|address&0x003ff000) | uint64(pde>>13&0xff)<<32&pageFrameMask,
+			writable: pde&pageWritable != 0,
+			user:     pde&pageUser != 0,
+			global:   pde&pageGlobal != 0 && reg.CR4&CR4PGE != 0,
+		}
+		mem.checkPage(&entry, uint64(address), access, user, wp)
+		pde |= pageAccessed
+		if access == pageWrite {
+			pde |= pageDirty
+		}
+		entry.dirty = pde&pageDirty != 0
+		mem.WritePhys32(pdeAddress, pde)
+		return entry
+	}
+
+	pteAddress := uint64(pde&0xfffff000 | ((address>>12)&0x3ff)<<2)
+	pte := mem.ReadPhys32(pteAddress)
+	if pte&pagePresent == 0 {
+		mem.pageFault(uint64(address), access, user, 0)
+	}
+	entry = tlbEntry{
+		frame:    uint64(pte & 0xfffff000),
+		writable: pde&pageWritable != 0 && pte&pageWritable != 0,
+		user:     pde&pageUser != 0 && pte&pageUser != 0,
+		global:   pte&pageGlobal != 0 && reg.CR4&CR4PGE != 0,
+	}
+	mem.checkPage(&entry, uint64(address), access, user, wp)
+	if pde&pageAccessed == 0 {
+		mem.WritePhys32(pdeAddress, pde|pageAccessed)
+	}
+	pte |= pageAccessed
+	if access == pageWrite {
+		pte |= pageDirty
+	}
+	entry.dirty = pte&pageDirty != 0
+	mem.WritePhys32(pteAddress, pte)
+	return entry
+}
+
+// walkPAE PDPT of 4 entries pointed by CR3, then tables of 64-bit entries, 2 MiB pages in the directory
+func (mem *Memory) walkPAE(address uint32, access pageAccess, user bool, wp bool) tlbEntry {
+	reg := mem.reg
+	nxe := reg.IA32Efer&EFERNXE != 0
+	reserved := ^uint64(0) >> 1 &^ (1<<maxPhysAddr - 1)
+	if !nxe {
+		reserved |= pageNoExecute
+	}
+
+	pdpteAddress := reg.CR3&0xffffffe0 | uint64(address>>30)<<3
+	pdpte := mem.ReadPhys64(pdpteAddress)
+	if pdpte&pagePresent == 0 {
+		mem.pageFault(uint64(address), access, user, 0)
+	}
+	if pdpte&(reserved|pageNoExecute|pdpteReserved) != 0 {
+		mem.pageFault(uint64(address), access, user, pfPresent|pfReserved)
+	}
+
+	pdeAddress := pdpte&pageFrameMask | uint64(address>>21&0x1ff)<<3
+	pde := mem.ReadPhys64(pdeAddress)
+	if pde&pagePresent == 0 {
+		mem.pageFault(uint64(address), access, user, 0)
+	}
+
+	var entry tlbEntry
+	if pde&pageSize != 0 {
+		// bits 13-20 of a 2 MiB page entry are reserved
+		if pde&(reserved|0x1fe000) != 0 {
+			mem.pageFault(uint64(address), access, user, pfPresent|pfReserved)
+		}
+		entry = tlbEntry{
+			frame:    pde&pageFrameMask&^0x1fffff | uint64(address&0x1ff000),
+			writable: pde&pageWritable != 0,
+			user:     pde&pageUser != 0,
+			global:   pde&pageGlobal != 0 && reg.CR4&CR4PGE != 0,
+			noExec:   nxe && pde&pageNoExecute != 0,
+		}
+		mem.checkPage(&entry, uint64(address), access, user, wp)
+		pde |= pageAccessed
+		if access == pageWrite {
+			pde |= pageDirty
+		}
+		entry.dirty = pde&pageDirty != 0
+		mem.WritePhys64(pdeAddress, pde)
+		return entry
+	}
+	if pde&reserved != 0 {
+		mem.pageFault(uint64(address), access, user, pfPresent|pfReserved)
+	}
+
+	pteAddress := pde&pageFrameMask | uint64(address>>12&0x1ff)<<3
+	pte := mem.ReadPhys64(pteAddress)
+	if pte&pagePresent == 0 {
+		mem.pageFault(uint64(address), access, user, 0)
+	}
+	if pte&reserved != 0 {
+		mem.pageFault(uint64(address), access, user, pfPresent|pfReserved)
+	}
+	entry = tlbEntry{
+		frame:    pte & pageFrameMask,
+		writable: pde&pageWritable != 0 && pte&pageWritable != 0,
+		user:     pde&pageUser != 0 && pte&pageUser != 0,
+		global:   pte&pageGlobal != 0 && reg.CR4&CR4PGE != 0,
+		noExec:   nxe && (pde|pte)&pageNoExecute != 0,
+	}
+	mem.checkPage(&entry, uint64(address), access, user, wp)
+	if pde&pageAccessed == 0 {
+		mem.WritePhys64(pdeAddress, pde|pageAccessed)
+	}
+	pte |= pageAccessed
+	if access == pageWrite {
+		pte |= pageDirty
+	}
+	entry.dirty = pte&pageDirty != 0
+	mem.WritePhys64(pteAddress, pte)
+	return entry
+}
+
+// walk4 the four levels of long mode: PML4, page-directory-pointer table, page directory and
+// page table, each of 512 64-bit entries indexed by 9 bits of the 48-bit linear address. The
+// directory maps 2 MiB pages and the pointer table 1 GiB pages. Bits 52-62 are ignored.
+func (mem *Memory) walk4(address uint64, access pageAccess, user bool, wp bool) tlbEntry {
+	reg := mem.reg
+	nxe := reg.IA32Efer&EFERNXE != 0
+	reserved := uint64(1<<52-1) &^ (1<<maxPhysAddr - 1)
+	if !nxe {
+		reserved |= pageNoExecute
+	}
+	page1GB := reg.features().ExtEDX&FeaturePage1GB != 0
+
+	table := reg.CR3 & pageFrameMask
+	writable, userPage, noExec := true, true, false
+	var entries [4]uint64
+	var addresses [4]uint64
+	for level := 3; ; level-- {
+		shift := uint(12 + 9*level)
+		entryAddress := table | address>>shift&0x1ff<<3
+		e := mem.ReadPhys64(entryAddress)
+		if e&pagePresent == 0 {
+			mem.pageFault(address, access, user, 0)
+		}
+		large := e&pageSize != 0 && (level == 1 || level == 2 && page1GB)
+		if e&reserved != 0 || e&pageSize != 0 && level > 0 && !large {
+			mem.pageFault(address, access, user, pfPresent|pfReserved)
+		}
+		// the frame of a large page is aligned on its size, above the PAT bit 12
+		if large && e&pageFrameMask&(1<<shift-1)&^0x1fff != 0 {
+			mem.pageFault(address, access, user, pfPresent|pfReserved)
+		}
+		entries[level], addresses[level] = e, entryAddress
+		writable = writable && e&pageWritable != 0
+		userPage = userPage && e&pageUser != 0
+		noExec = noExec || nxe && e&pageNoExecute != 0
+		if level > 0 && !large {
+			table = e & pageFrameMask
+			continue
+		}
+
+		entry := tlbEntry{
+			frame:    e&pageFrameMask&^(1<<shift-1) | address&(1<<shift-1)&^0xfff,
+			writable: writable,
+			user:     userPage,
+			global:   e&pageGlobal != 0 && reg.CR4&CR4PGE != 0,
+			noExec:   noExec,
+		}
+		mem.checkPage(&entry, address, access, user, wp)
+		for upper := 3; upper > level; upper-- {
+			if entries[upper]&pageAccessed == 0 {
+				mem.WritePhys64(addresses[upper], entries[upper]|pageAccessed)
+			}
+		}
+		e |= pageAccessed
+		if access == pageWrite {
+			e |= pageDirty
+		}
+		entry.dirty = e&pageDirty != 0
+		mem.WritePhys64(entryAddress, e)
+		return entry
+	}
+}
+
+func (mem *Memory) checkPage(entry *tlbEntry, address uint64, access pageAccess, user bool, wp bool) {
+	if user && !entry.user {
+		mem.pageFault(address, access, user, pfPresent)
+	}
+	if access == pageWrite && !entry.writable && (user || wp) {
+		mem.pageFault(address, access, user, pfPresent)
+	}
+	if access == pageFetch && entry.noExec {
+		mem.pageFault(address, access, user, pfPresent)
+	}
+}
+
+// pageFault loads CR2 with the faulting linear address and raises #PF.
+// errorCode holds the P and RSVD bits, the access bits are added here.
+func (mem *Memory) pageFault(address uint64, access pageAccess, user bool, errorCode uint32) {
+	reg := mem.reg
+	if access == pageWrite {
+		errorCode |= pfWrite
+	}
+	if user {
+		errorCode |= pfUser
+	}
+	if access == pageFetch && reg.CR4&CR4PAE != 0 && reg.IA32Efer&EFERNXE != 0 {
+		errorCode |= pfFetch
+	}
+	reg.CR2 = address
+	raiseWithCode(ExceptionPF, errorCode)
+}
+
+// FlushTLB invalidates the cached translations, keeping global pages if requested
+func (mem *Memory) FlushTLB(keepGlobal bool) {
+	mem.tlb.Flush(keepGlobal)
+}
+
+// InvalidatePage invalidates the cached translation of a linear address
+func (mem *Memory) InvalidatePage(address uint64) {
+	mem.tlb.Invalidate(address)
+}
+
+// pageTables builds 4-level page tables in physical memory: the PML4 at root, the lower
+// tables allocated in the pages that follow it
+type pageTables struct {
+	mem  IMemory
+	root uint64
+	next uint64
+}
+
+func newPageTables(mem IMemory, root uint64) *pageTables {
+	return &pageTables{mem: mem, root: root, next: root + 0x1000}
+}
+
+// mapPage maps the 4 KiB page at linear to physical, present with flags. The upper levels
+// grant every access, the leaf entry alone decides.
+func (t *pageTables) mapPage(linear uint64, physical uint64, flags uint64) {
+	table := t.root
+	for level := 3; level > 0; level-- {
+		entry := table + (linear>>(12+9*uint(level))&0x1ff)*8
+		value := t.mem.ReadPhys64(entry)
+		if value&pagePresent == 0 {
+			value = t.next | pagePresent | pageWritable | pageUser
+			t.mem.WritePhys64(entry, value)
+			t.next += 0x1000
+		}
+		table = value & pageFrameMask
+	}
+	t.mem.WritePhys64(table+(linear>>12&0x1ff)*8, physical&pageFrameMask|flags|pagePresent)
+}
@@ -0,0 +1,212 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+// gateBytes encodes an interrupt, trap or call gate
+func gateBytes(selector uint16, offset uint32, access uint8) uint64 {
+	return uint64(offset&0xffff) | uint64(selector)<<16 | uint64(access)<<40 | uint64(offset>>16)<<48
+}
+
+// userModeCPU a 32-bit CPU with paging on, running the code at 0x8000 at CPL 3. The page
+// tables, the GDT, the IDT, the TSS, the handlers and their stack are in supervisor pages;
+// INT 80h returns to the program, INT 81h halts.
+func userModeCPU(t *testing.T, code []byte) (*Emulator, *CPU) {
+	t.Helper()
+	emu, err := NewEmulator(32, 0, 0x10000, make([]byte, 0x10000), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := emu.cpu.(*CPU)
+	reg, mem := cpu.reg, cpu.mem
+	mem.WritePhys32(0x1000, 0x2000|pagePresent|pageWritable|pageUser)
+	for page := uint32(0); page < 0x10; page++ {
+		flags := uint32(pagePresent | pageWritable)
+		if page >= 8 {
+			flags |= pageUser
+		}
+		mem.WritePhys32(0x2000+uint64(page)*4, page<<12|flags)
+	}
+	gdt := []uint64{
+		0,
+		descriptorBytes(0, 0xfffff, 0x9a, 0xc),
+		descriptorBytes(0, 0xfffff, 0x92, 0xc),
+		descriptorBytes(0, 0xfffff, 0xfa, 0xc),
+		descriptorBytes(0, 0xfffff, 0xf2, 0xc),
+		descriptorBytes(0x4800, tss32MinLimit, 0x89, 0),
+	}
+	for i, desc := range gdt {
+		mem.WritePhys64(0x3000+uint64(i)*8, desc)
+	}
+	mem.WritePhys64(0x4000+0x80*8, gateBytes(0x08, 0x5000, 0xef))
+	mem.WritePhys64(0x4000+0x81*8, gateBytes(0x08, 0x5001, 0xee))
+	mem.WritePhys32(0x4800+tss32ESP0, 0x7000)
+	mem.WritePhys32(0x4800+tss32ESP0+4, 0x10)
+	mem.WritePhys8(0x5000, 0xcf) // iret
+	mem.WritePhys8(0x5001, 0xf4) // hlt
+	for i, b := range code {
+		mem.WritePhys8(0x8000+uint64(i), b)
+	}
+	reg.GDTR = DescriptorTable{Base: 0x3000, Limit: uint16(len(gdt)*8 - 1)}
+	reg.IDTR = DescriptorTable{Base: 0x4000, Limit: 0x7ff}
+	reg.CR3 = 0x1000
+	reg.CR0 |= CR0PE | CR0PG | CR0WP
+	loadTR(reg, mem, 0x28)
+	reg.CS, reg.Segments[SegCS] = 0x1b, flatCode(3, false)
+	for _, i := range []uint8{SegES, SegSS, SegDS, SegFS, SegGS} {
+		*reg.selectorIndex(i) = 0x23
+		reg.Segments[i] = flatData(3)
+	}
+	reg.EIP, reg.ESP, reg.EFlags = 0x8000, 0x9ff0, 0x2
+	return emu, cpu
+}
+
+func TestImplicitSupervisorAccesses(t *testing.T) {
+	tests := []struct {
+		name string
+		code []byte
+		cs   uint16
+		eip  uint32
+		err  string
+	}{
+		// the IDT, the TSS and the kernel stack are read and written at CPL 3
+		{"int", []byte{0xcd, 0x81}, 0x08, 0x5002, ""},
+		// IRET sets the accessed bit of the user code descriptor
+		{"iret", []byte{0xcd, 0x80, 0xcd, 0x81}, 0x08, 0x5002, ""},
+		// the program itself cannot read the GDT: #PF with U/S set, no handler
+		{"explicit", []byte{0x8b, 0x05, 0x00, 0x30, 0x00, 0x00}, 0, 0, "#PF(0x5)"},
+	}
+	for _, test := range tests {
+		emu, cpu := userModeCPU(t, test.code)
+		err := emu.Run()
+		reg := cpu.reg
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if reg.CS != test.cs || reg.EIP != test.eip {
+			t.Errorf("%s: CS:EIP = %04X:%X, want %04X:%X", test.name, reg.CS, reg.EIP, test.cs, test.eip)
+		}
+		if access := cpu.mem.ReadPhys8(0x3000 + 3*8 + 5); test.name == "iret" && access&accessAccessed == 0 {
+			t.Errorf("%s: user code descriptor not accessed", test.name)
+		}
+	}
+}
+
+// translate walks the page tables for address, returning the physical address or the #PF
+func translate(mem *Memory, address uint64, access pageAccess, user bool, wp bool) (physical uint64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(*Exception)
+		}
+	}()
+	entry := mem.walk(address, access, user, wp)
+	return entry.frame | address&0xfff, nil
+}
+
+func TestPageWalk(t *testing.T) {
+	const (
+		user     = pagePresent | pageWritable | pageUser
+		readOnly = pagePresent | pageUser
+	)
+	tests := []struct {
+		name    string
+		cr4     uint64
+		nxe     bool
+		entries map[uint64]uint64 // the tables at CR3 = 0x1000, by physical address
+		address uint64
+		access  pageAccess
+		user    bool
+		wp      bool
+		want    uint64
+		err     string
+	}{
+		{"4k", 0, false, map[uint64]uint64{0x1000: 0x2000 | user, 0x2014: 0x7000 | user},
+			0x5123, pageRead, true, false, 0x7123, ""},
+		{"pse 4m", CR4PSE, false, map[uint64]uint64{0x1004: 0xc00000 | pageSize | user},
+			0x412345, pageWrite, true, false, 0xc12345, ""},
+		// PSE-36: bits 13-16 of the directory entry are bits 32-35 of the page
+		{"pse-36", CR4PSE, false, map[uint64]uint64{0x1004: 0x400000 | 1<<13 | pageSize | user},
+			0x401234, pageRead, false, false, 0x100401234, ""},
+		{"not present", 0, false, map[uint64]uint64{},
+			0x5123, pageRead, false, false, 0, "#PF(0x0)"},
+		{"not present user write", 0, false, map[uint64]uint64{0x1000: 0x2000 | user},
+			0x5123, pageWrite, true, false, 0, "#PF(0x6)"},
+		{"user on supervisor page", 0, false,
+			map[uint64]uint64{0x1000: 0x2000 | user, 0x2014: 0x7000 | pagePresent | pageWritable},
+			0x5123, pageRead, true, false, 0, "#PF(0x5)"},
+		{"user write read-only", 0, false, map[uint64]uint64{0x1000: 0x2000 | user, 0x2014: 0x7000 | readOnly},
+			0x5123, pageWrite, true, false, 0, "#PF(0x7)"},
+		// supervisor writes to read-only pages only fault with CR0.WP
+		{"supervisor write wp", 0, false, map[uint64]uint64{0x1000: 0x2000 | user, 0x2014: 0x7000 | readOnly},
+			0x5123, pageWrite, false, true, 0, "#PF(0x3)"},
+		{"supervisor write", 0, false, map[uint64]uint64{0x1000: 0x2000 | user, 0x2014: 0x7000 | readOnly},
+			0x5123, pageWrite, false, false, 0x7123, ""},
+
+		{"pae 4k", CR4PAE, false,
+			map[uint64]uint64{0x1000: 0x2000 | pagePresent, 0x2000: 0x3000 | user, 0x3028: 0x7000 | user},
+			0x5123, pageRead, true, false, 0x7123, ""},
+		{"pae 2m", CR4PAE, false,
+			map[uint64]uint64{0x1000: 0x2000 | pagePresent, 0x2008: 0x600000 | pageSize | user},
+			0x212345, pageRead, true, false, 0x612345, ""},
+		{"pae above 4g", CR4PAE, false,
+			map[uint64]uint64{0x1000: 0x2000 | pagePresent, 0x2000: 0x3000 | user, 0x3028: 0x300007000 | user},
+			0x5123, pageRead, false, false, 0x300007123, ""},
+		// with EFER.NXE, fetches from NX pages fault with I/D set; without it NX is reserved
+		{"pae nx fetch", CR4PAE, true,
+			map[uint64]uint64{0x1000: 0x2000 | pagePresent, 0x2000: 0x3000 | user, 0x3028: 0x7000 | user | pageNoExecute},
+			0x5123, pageFetch, false, false, 0, "#PF(0x11)"},
+		{"pae nx read", CR4PAE, true,
+			map[uint64]uint64{0x1000: 0x2000 | pagePresent, 0x2000: 0x3000 | user, 0x3028: 0x7000 | user | pageNoExecute},
+			0x5123, pageRead, false, false, 0x7123, ""},
+		{"pae nx without nxe", CR4PAE, false,
+			map[uint64]uint64{0x1000: 0x2000 | pagePresent, 0x2000: 0x3000 | user, 0x3028: 0x7000 | user | pageNoExecute},
+			0x5123, pageRead, false, false, 0, "#PF(0x9)"},
+		{"pae fetch not present", CR4PAE, true, map[uint64]uint64{0x1000: 0x2000 | pagePresent},
+			0x5123, pageFetch, true, false, 0, "#PF(0x14)"},
+		{"pae reserved pdpte", CR4PAE, false, map[uint64]uint64{0x1000: 0x2000 | pagePresent | pageWritable},
+			0x5123, pageRead, false, false, 0, "#PF(0x9)"},
+		{"pae reserved 2m", CR4PAE, false,
+			map[uint64]uint64{0x1000: 0x2000 | pagePresent, 0x2008: 0x600000 | 1<<13 | pageSize | user},
+			0x212345, pageWrite, false, false, 0, "#PF(0xB)"},
+		{"pae supervisor write wp", CR4PAE, false,
+			map[uint64]uint64{0x1000: 0x2000 | pagePresent, 0x2000: 0x3000 | user, 0x3028: 0x7000 | readOnly},
+			0x5123, pageWrite, false, true, 0, "#PF(0x3)"},
+	}
+	for _, test := range tests {
+		reg := NewIA32registers(0, 0x10000, false)
+		mem := NewMemory(reg, make([]byte, 0x10000), 0, false)
+		reg.CR0 |= CR0PE | CR0PG
+		reg.CR3, reg.CR4 = 0x1000, test.cr4
+		if test.nxe {
+			reg.IA32Efer |= EFERNXE
+		}
+		for address, entry := range test.entries {
+			if test.cr4&CR4PAE != 0 {
+				mem.WritePhys64(address, entry)
+			} else {
+				mem.WritePhys32(address, uint32(entry))
+			}
+		}
+		got, err := translate(mem, test.address, test.access, test.user, test.wp)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %s", test.name, err, test.err)
+			} else if reg.CR2 != test.address {
+				t.Errorf("%s: CR2 = %#x, want %#x", test.name, reg.CR2, test.address)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s: %#x, %v, want %#x", test.name, got, err, test.want)
+		}
+	}
+}
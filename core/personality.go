@@ -0,0 +1,19 @@
+package core
+
+// personality the operating system a program runs on in user mode. There is no kernel code in
+// the guest: the personality builds the process, and services the system calls and the
+// exceptions of the program in place of the IDT.
+type personality interface {
+	// boot maps the segments of prog and sets the registers to start it
+	boot(reg *X86Registers, prog *program, debug bool) (*Memory, error)
+	// interrupt handles an exception or a software interrupt; false delivers it through the
+	// IVT or IDT
+	interrupt(e *Exception, software bool) bool
+	// systemCall handles SYSENTER (34) or SYSCALL (05) with the instruction pointer on the
+	// opcode byte; false runs the instruction
+	systemCall(opcode uint8) bool
+	// done the program has ended
+	done() bool
+	// status the exit status of the program, and how it was killed when it did not exit
+	status() (int, error)
+}
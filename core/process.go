@@ -0,0 +1,369 @@
+package core
+
+import "sort"
+
+// Protection of a mapping, as the PROT_ flags of mmap
+const (
+	protRead  = 0x1
+	protWrite = 0x2
+	protExec  = 0x4
+)
+
+// area a mapping of a process: the pages of start..end with their protection
+type area struct {
+	start uint64
+	end   uint64
+	prot  uint64
+}
+
+// addressSpace the memory of a process run in user mode. The pages of a mapping get a frame
+// when the program or a system call first touches them: frames are appended to the physical
+// memory and recycled once unmapped. The page tables are 32-bit two-level tables, 4-level
+// tables in long mode.
+type addressSpace struct {
+	mem    *Memory
+	root   uint64
+	levels uint
+	areas  []area
+	free   []uint64
+}
+
+func newAddressSpace(mem *Memory, long bool) *addressSpace {
+	s := &addressSpace{mem: mem, levels: 2}
+	if long {
+		s.levels = 4
+	}
+	s.root = s.frame()
+	return s
+}
+
+// pageAlign rounds address up to a page boundary
+func pageAlign(address uint64) uint64 {
+	return (address + 0xfff) &^ 0xfff
+}
+
+// frame a zeroed page frame
+func (s *addressSpace) frame() uint64 {
+	mem := s.mem
+	if n := len(s.free); n > 0 {
+		frame := s.free[n-1]
+		s.free = s.free[:n-1]
+		page := mem.ram[frame : frame+0x1000]
+		for i := range page {
+			page[i] = 0
+		}
+		return frame
+	}
+	frame := uint64(len(mem.ram))
+	mem.SetRam(append(mem.ram, make([]byte, 0x1000)...))
+	return frame
+}
+
+// index the entry of linear in its table at level, 0 being the page tables
+func (s *addressSpace) index(linear uint64, level uint) uint64 {
+	if s.levels == 2 {
+		return (linear >> (12 + 10*level) & 0x3ff) * 4
+	}
+	return (linear >> (12 + 9*level) & 0x1ff) * 8
+}
+
+func (s *addressSpace) readEntry(address uint64) uint64 {
+	if s.levels == 2 {
+		return uint64(s.mem.ReadPhys32(address))
+	}
+	return s.mem.ReadPhys64(address)
+}
+
+func (s *addressSpace) writeEntry(address uint64, value uint64) {
+	if s.levels == 2 {
+		s.mem.WritePhys32(address, uint32(value))
+		return
+	}
+	s.mem.WritePhys64(address, value)
+}
+
+// entry the physical address of the page table entry of linear. Missing tables are
+// allocated when create is set, false is returned otherwise.
+func (s *addressSpace) entry(linear uint64, create bool) (uint64, bool) {
+	table := s.root
+	for level := s.levels - 1; level > 0; level-- {
+		address := table + s.index(linear, level)
+		value := s.readEntry(address)
+		if value&pagePresent == 0 {
+			if !create {
+				return 0, false
+			}
+			value = s.frame() | pagePresent | pageWritable | pageUser
+			s.writeEntry(address, value)
+		}
+		table = value & pageFrameMask
+	}
+	return table + s.index(linear, 0), true
+}
+
+// populate gives the page at linear a frame, accessible to the program with prot. Without
+// protection the page belongs to the kernel: only supervisor accesses reach it.
+func (s *addressSpace) populate(linear uint64, prot uint64) uint64 {
+	entry, _ := s.entry(linear, true)
+	frame := s.frame()
+	s.writeEntry(entry, frame|pageFlags(prot))
+	return frame
+}
+
+// pageFlags the flags of the page table entries of a mapping with prot
+func pageFlags(prot uint64) uint64 {
+	switch {
+	case prot == 0:
+		return pagePresent | pageWritable
+	case prot&protWrite != 0:
+		return pagePresent | pageWritable | pageUser
+	}
+	return pagePresent | pageUser
+}
+
+// find the mapping containing address
+func (s *addressSpace) find(address uint64) *area {
+	for i := range s.areas {
+		if a := &s.areas[i]; a.start <= address && address < a.end {
+			return a
+		}
+	}
+	return nil
+}
+
+// page the physical address of the byte at linear, populating its page when it is mapped;
+// false when the access is not allowed
+func (s *addressSpace) page(linear uint64, write bool) (uint64, bool) {
+	if entry, ok := s.entry(linear, false); ok {
+		if value := s.readEntry(entry); value&pagePresent != 0 {
+			if write && value&pageWritable == 0 {
+				return 0, false
+			}
+			return value&pageFrameMask | linear&0xfff, true
+		}
+	}
+	a := s.find(linear)
+	if a == nil || a.prot == 0 || write && a.prot&protWrite == 0 {
+		return 0, false
+	}
+	return s.populate(linear&^0xfff, a.prot) | linear&0xfff, true
+}
+
+// fault populates the page of a page fault on a page not present; false when the program
+// has no right to access it
+func (s *addressSpace) fault(address uint64, errorCode uint32) bool {
+	if errorCode&pfPresent != 0 {
+		return false
+	}
+	_, ok := s.page(address, errorCode&pfWrite != 0)
+	return ok
+}
+
+// mapArea maps start..end with prot, replacing the mappings there
+func (s *addressSpace) mapArea(start uint64, end uint64, prot uint64) {
+	s.unmap(start, end)
+	s.areas = append(s.areas, area{start: start, end: end, prot: prot})
+	sort.Slice(s.areas, func(i, j int) bool { return s.areas[i].start < s.areas[j].start })
+}
+
+// unmap removes the mappings of start..end and recycles the frames of their pages
+func (s *addressSpace) unmap(start uint64, end uint64) {
+	var areas []area
+	for _, a := range s.areas {
+		if a.end <= start || end <= a.start {
+			areas = append(areas, a)
+			continue
+		}
+		if a.start < start {
+			areas = append(areas, area{start: a.start, end: start, prot: a.prot})
+		}
+		if end < a.end {
+			areas = append(areas, area{start: end, end: a.end, prot: a.prot})
+		}
+		from, to := a.start, a.end
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+		for page := from; page < to; page += 0x1000 {
+			entry, ok := s.entry(page, false)
+			if !ok {
+				continue
+			}
+			if value := s.readEntry(entry); value&pagePresent != 0 {
+				s.free = append(s.free, value&pageFrameMask)
+				s.writeEntry(entry, 0)
+				s.mem.InvalidatePage(page)
+			}
+		}
+	}
+	s.areas = areas
+}
+
+// protect gives the mappings of start..end the protection prot, updating the pages already
+// populated; false when part of the range is not mapped
+func (s *addressSpace) protect(start uint64, end uint64, prot uint64) bool {
+	for address := start; address < end; {
+		a := s.find(address)
+		if a == nil {
+			return false
+		}
+		address = a.end
+	}
+	var areas []area
+	for _, a := range s.areas {
+		if a.end <= start || end <= a.start {
+			areas = append(areas, a)
+			continue
+		}
+		if a.start < start {
+			areas = append(areas, area{start: a.start, end: start, prot: a.prot})
+		}
+		if end < a.end {
+			areas = append(areas, area{start: end, end: a.end, prot: a.prot})
+		}
+		from, to := a.start, a.end
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+		areas = append(areas, area{start: from, end: to, prot: prot})
+		for page := from; page < to; page += 0x1000 {
+			entry, ok := s.entry(page, false)
+			if !ok {
+				continue
+			}
+			if value := s.readEntry(entry); value&pagePresent != 0 {
+				s.writeEntry(entry, value&pageFrameMask|pageFlags(prot))
+				s.mem.InvalidatePage(page)
+			}
+		}
+	}
+	sort.Slice(areas, func(i, j int) bool { return areas[i].start < areas[j].start })
+	s.areas = areas
+	return true
+}
+
+// gap the lowest address from start on where length bytes are unmapped, below limit
+func (s *addressSpace) gap(start uint64, length uint64, limit uint64) (uint64, bool) {
+	for _, a := range s.areas {
+		if a.end <= start {
+			continue
+		}
+		if start+length <= a.start {
+			break
+		}
+		start = a.end
+	}
+	return start, start+length <= limit
+}
+
+// mapped tells if the length bytes at address all lie in mappings the program may access,
+// with the protection bits of prot
+func (s *addressSpace) mapped(address uint64, length uint64, prot uint64) bool {
+	end := address + length
+	if end < address {
+		return false
+	}
+	for address < end {
+		a := s.find(address)
+		if a == nil || a.prot == 0 || a.prot&prot != prot {
+			return false
+		}
+		address = a.end
+	}
+	return true
+}
+
+// read copies length bytes of the process at address; false when they are not readable
+func (s *addressSpace) read(address uint64, length uint64) ([]byte, bool) {
+	if !s.mapped(address, length, 0) {
+		return nil, false
+	}
+	data := make([]byte, 0, length)
+	for length > 0 {
+		physical, ok := s.page(address, false)
+		if !ok {
+			return nil, false
+		}
+		n := 0x1000 - address&0xfff
+		if n > length {
+			n = length
+		}
+		data = append(data, s.mem.ram[physical:physical+n]...)
+		address += n
+		length -= n
+	}
+	return data, true
+}
+
+// write copies data to the process at address; false when it is not writable
+func (s *addressSpace) write(address uint64, data []byte) bool {
+	return s.store(address, data, true)
+}
+
+// load copies data to the process at address whatever the protection of its mapping, as
+// the loader of a program or a file mapping does
+func (s *addressSpace) load(address uint64, data []byte) bool {
+	return s.store(address, data, false)
+}
+
+// store copies data to address; a write on behalf of the program needs a writable mapping
+// for all of it, whereas kernel pages are writable to the supervisor
+func (s *addressSpace) store(address uint64, data []byte, write bool) bool {
+	if write && !s.mapped(address, uint64(len(data)), protWrite) {
+		return false
+	}
+	for len(data) > 0 {
+		physical, ok := s.page(address, write)
+		if !ok {
+			return false
+		}
+		n := copy(s.mem.ram[physical:physical+0x1000-address&0xfff], data)
+		address += uint64(n)
+		data = data[n:]
+	}
+	return true
+}
+
+// readString reads the NUL-terminated string at address, up to a page long
+func (s *addressSpace) readString(address uint64) (string, bool) {
+	var text []byte
+	for len(text) < 0x1000 {
+		b, ok := s.read(address+uint64(len(text)), 1)
+		if !ok {
+			return "", false
+		}
+		if b[0] == 0 {
+			return string(text), true
+		}
+		text = append(text, b[0])
+	}
+	return "", false
+}
+
+// readWord reads a little-endian value of size bytes at address
+func (s *addressSpace) readWord(address uint64, size uint64) (uint64, bool) {
+	data, ok := s.read(address, size)
+	if !ok {
+		return 0, false
+	}
+	var value uint64
+	for i := range data {
+		value |= uint64(data[i]) << (8 * i)
+	}
+	return value, true
+}
+
+// writeWord writes value as size little-endian bytes at address
+func (s *addressSpace) writeWord(address uint64, size uint64, value uint64) bool {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(value >> (8 * i))
+	}
+	return s.write(address, data)
+}
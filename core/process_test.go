@@ -0,0 +1,101 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddressSpaceRead(t *testing.T) {
+	reg := NewIA32registers(0, 0, false)
+	space := newAddressSpace(NewMemory(reg, nil, 0, false), false)
+	space.mapArea(0x10000, 0x12000, protRead|protWrite)
+	space.mapArea(0x12000, 0x13000, 0)
+	tests := []struct {
+		address uint64
+		length  uint64
+		ok      bool
+	}{
+		{0x10000, 0x10, true},
+		{0x10ff8, 0x10, true},
+		{0x10000, 0x2000, true},
+		{0x10000, 0x2001, false},
+		{0xfff0, 0x20, false},
+		{0x10000, ^uint64(0), false},
+		{^uint64(0) - 4, 0x10, false},
+	}
+	for _, test := range tests {
+		if _, ok := space.read(test.address, test.length); ok != test.ok {
+			t.Errorf("read(%#x, %#x) = %t, want %t", test.address, test.length, ok, test.ok)
+		}
+	}
+}
+
+func TestAddressSpaceProtect(t *testing.T) {
+	reg := NewIA32registers(0, 0, false)
+	space := newAddressSpace(NewMemory(reg, nil, 0, false), false)
+	space.mapArea(0x10000, 0x13000, protRead|protWrite)
+	if !space.write(0x11000, []byte{1}) {
+		t.Fatal("write before mprotect failed")
+	}
+	if space.protect(0x12000, 0x14000, protRead) {
+		t.Error("protect of an unmapped page succeeded")
+	}
+	if !space.protect(0x11000, 0x12000, protRead) {
+		t.Fatal("protect failed")
+	}
+	if len(space.areas) != 3 {
+		t.Errorf("%d areas, want 3", len(space.areas))
+	}
+	if _, ok := space.page(0x11000, true); ok {
+		t.Error("populated page still writable")
+	}
+	if _, ok := space.page(0x12000, true); !ok {
+		t.Error("page after the range not writable")
+	}
+	if data, ok := space.read(0x11000, 1); !ok || data[0] != 1 {
+		t.Errorf("read = %v, %t", data, ok)
+	}
+}
+
+// System calls writing to the kernel page of the GDT or to a read-only mapping fail with
+// EFAULT and leave it alone
+func TestSystemCallFault(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "in.txt"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l := bootLinux(t, root)
+	f, err := os.Open(filepath.Join(root, "in.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	l.files = append(l.files, f)
+	const readOnly = 0x70000000
+	l.space.mapArea(readOnly, readOnly+linuxPageSize, protRead)
+	gdt := append([]byte(nil), l.mem.ram[l.gdt:l.gdt+linuxPageSize]...)
+	tests := []struct {
+		name   string
+		number uint64
+		args   [6]uint64
+	}{
+		{"read", 0, [6]uint64{3, linuxGDT, 4}},
+		{"clock_gettime", 228, [6]uint64{linuxClockRealtime, linuxGDT}},
+		{"arch_prctl", 158, [6]uint64{linuxArchGetFS, linuxGDT + 8}},
+		{"getrandom", 318, [6]uint64{linuxGDT + 0xff8, 0x10}},
+		{"read-only", 318, [6]uint64{readOnly, 8}},
+	}
+	for _, test := range tests {
+		if result := l.call(test.number, test.args); result != -linuxEFAULT {
+			t.Errorf("%s = %d, want %d", test.name, result, -linuxEFAULT)
+		}
+	}
+	if !bytes.Equal(l.mem.ram[l.gdt:l.gdt+linuxPageSize], gdt) {
+		t.Error("GDT page changed")
+	}
+	if data, ok := l.space.read(readOnly, 8); !ok || !bytes.Equal(data, make([]byte, 8)) {
+		t.Errorf("read-only page = %v, %t", data, ok)
+	}
+}
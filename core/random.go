@@ -0,0 +1,75 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// Entropy feeds RDRAND and RDSEED
+type Entropy interface {
+	// Random returns the next random value, false when none is available
+	Random() (uint64, bool)
+}
+
+// SeededEntropy a deterministic SplitMix64 generator, so runs with the same seed repeat
+type SeededEntropy struct {
+	state uint64
+}
+
+func NewSeededEntropy(seed uint64) *SeededEntropy {
+	return &SeededEntropy{state: seed}
+}
+
+func (e *SeededEntropy) Random() (uint64, bool) {
+	e.state += 0x9e3779b97f4a7c15
+	z := e.state
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31, true
+}
+
+// HostEntropy reads the random number generator of the host
+type HostEntropy struct{}
+
+func (HostEntropy) Random() (uint64, bool) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(b[:]), true
+}
+
+// random RDRAND r (0F C7 /6) and RDSEED r (0F C7 /7): CF is set when a value was
+// delivered, the register is zero otherwise; OF, SF, ZF, AF and PF are cleared
+func (a *ALU) random(modrm *ModRM, width uint) {
+	reg := a.reg
+	value := reg.random(modrm.Opcode, modrm.Mod)
+	setRM(modrm, width, uint32(value))
+}
+
+// random RDRAND and RDSEED r16, r32 and r64 in 64-bit mode
+func (l *Long) random(modrm *ModRM64) {
+	reg := l.reg
+	width := l.width()
+	value := reg.random(modrm.Opcode, modrm.Mod)
+	modrm.SetRM(width, value)
+}
+
+// random the value of RDRAND (/6) or RDSEED (/7), which set the flags; #UD without the
+// feature, for a memory operand or with F3 or F2
+func (r *X86Registers) random(op uint8, mod uint8) uint64 {
+	features := r.features()
+	supported := features.Leaf1ECX&FeatureRDRAND != 0
+	if op == 7 {
+		supported = features.Leaf7EBX&FeatureRDSEED != 0
+	}
+	if !supported || mod != 3 || r.repPrefix != 0 {
+		raise(ExceptionUD)
+	}
+	value, ok := r.entropy.Random()
+	if !ok {
+		value = 0
+	}
+	r.setEFlags(carryFlag(ok), arithFlagsMask)
+	return value
+}
@@ -0,0 +1,566 @@
+package core
+
+import "log"
+
+// Segment register indexes, in the order used by the ModRM reg field
+const (
+	SegES uint8 = iota
+	SegCS
+	SegSS
+	SegDS
+	SegFS
+	SegGS
+)
+
+const (
+	realModeLimit      = 0xffff
+	realModeDataAccess = 0x93 // present, DPL 0, read/write data, accessed
+	realModeCodeAccess = 0x9b // present, DPL 0, execute/read code, accessed
+)
+
+// Access byte of a segment descriptor
+const (
+	accessAccessed   = 0x01
+	accessWritable   = 0x02 // data segments
+	accessReadable   = 0x02 // code segments
+	accessExpandDown = 0x04 // data segments
+	accessConforming = 0x04 // code segments
+	accessCode       = 0x08
+	accessNotSystem  = 0x10
+	accessPresent    = 0x80
+)
+
+// System descriptor types
+const (
+	descTSS16Available = 0x1
+	descLDT            = 0x2
+	descTSS16Busy      = 0x3
+	descCallGate16     = 0x4
+	descTaskGate       = 0x5
+	descIntGate16      = 0x6
+	descTrapGate16     = 0x7
+	descTSS32Available = 0x9
+	descTSS32Busy      = 0xb
+	descCallGate32     = 0xc
+	descIntGate32      = 0xe
+	descTrapGate32     = 0xf
+)
+
+// SegmentCache Hidden part of a segment register, filled when the selector is loaded
+type SegmentCache struct {
+	Base   uint32
+	Limit  uint32
+	Access uint8
+	Big    bool // D/B bit: 32-bit code or stack segment
+	Long   bool // L bit: 64-bit code segment
+}
+
+// DescriptorTable GDTR and IDTR: linear base address and limit of the table
+type DescriptorTable struct {
+	Base  uint32
+	Limit uint16
+}
+
+// Descriptor Segment or gate descriptor as stored in the GDT, LDT or IDT
+type Descriptor struct {
+	Base   uint32
+	Limit  uint32 // already scaled by the granularity bit
+	Access uint8
+	Flags  uint8 // G, D/B, L and AVL bits (high nibble of byte 6)
+}
+
+func parseDescriptor(raw uint64) Descriptor {
+	d := Descriptor{
+		Base:   uint32(raw>>16)&0xffffff | uint32(raw>>56)<<24,
+		Limit:  uint32(raw)&0xffff | uint32(raw>>48)&0xf<<16,
+		Access: uint8(raw >> 40),
+		Flags:  uint8(raw>>52) & 0xf,
+	}
+	if d.IsGranular() {
+		d.Limit = d.Limit<<12 | 0xfff
+	}
+	return d
+}
+
+func (d *Descriptor) IsPresent() bool {
+	return d.Access&accessPresent != 0
+}
+
+func (d *Descriptor) DPL() uint8 {
+	return (d.Access >> 5) & 3
+}
+
+func (d *Descriptor) IsSystem() bool {
+	return d.Access&accessNotSystem == 0
+}
+
+// Type descriptor type field (bits 0-3 of the access byte)
+func (d *Descriptor) Type() uint8 {
+	return d.Access & 0xf
+}
+
+func (d *Descriptor) IsCode() bool {
+	return !d.IsSystem() && d.Access&accessCode != 0
+}
+
+func (d *Descriptor) IsData() bool {
+	return !d.IsSystem() && d.Access&accessCode == 0
+}
+
+func (d *Descriptor) IsConforming() bool {
+	return d.IsCode() && d.Access&accessConforming != 0
+}
+
+// IsReadable data segments and readable code segments
+func (d *Descriptor) IsReadable() bool {
+	return d.IsData() || (d.IsCode() && d.Access&accessReadable != 0)
+}
+
+func (d *Descriptor) IsWritable() bool {
+	return d.IsData() && d.Access&accessWritable != 0
+}
+
+func (d *Descriptor) IsGranular() bool {
+	return d.Flags&0x8 != 0
+}
+
+func (d *Descriptor) IsBig() bool {
+	return d.Flags&0x4 != 0
+}
+
+// IsLong the L bit of a code segment: 64-bit code in long mode
+func (d *Descriptor) IsLong() bool {
+	return d.IsCode() && d.Flags&0x2 != 0
+}
+
+func (d *Descriptor) cache() SegmentCache {
+	return SegmentCache{
+		Base:   d.Base,
+		Limit:  d.Limit,
+		Access: d.Access,
+		Big:    d.IsBig(),
+		Long:   d.IsLong(),
+	}
+}
+
+// Gate Call, interrupt, trap or task gate descriptor
+type Gate struct {
+	Selector   uint16
+	Offset     uint32
+	Access     uint8
+	ParamCount uint8 // call gates: stack parameters copied on a privilege change
+}
+
+func parseGate(raw uint64) Gate {
+	return Gate{
+		Selector:   uint16(raw >> 16),
+		Offset:     uint32(raw)&0xffff | uint32(raw>>48)<<16,
+		Access:     uint8(raw >> 40),
+		ParamCount: uint8(raw>>32) & 0x1f,
+	}
+}
+
+func (g *Gate) IsPresent() bool {
+	return g.Access&accessPresent != 0
+}
+
+func (g *Gate) DPL() uint8 {
+	return (g.Access >> 5) & 3
+}
+
+// Type gate type with the S bit, so code and data descriptors never match a gate type
+func (g *Gate) Type() uint8 {
+	return g.Access & 0x1f
+}
+
+// Is32 32-bit gates push 32-bit frames and use the full offset
+func (g *Gate) Is32() bool {
+	return g.Access&0x8 != 0
+}
+
+func readGate(mem IMemory, address uint32) Gate {
+	defer mem.Implicit()()
+	raw := uint64(mem.Read32(address)) | uint64(mem.Read32(address+4))<<32
+	return parseGate(raw)
+}
+
+func (c *SegmentCache) IsUsable() bool {
+	return c.Access&accessPresent != 0
+}
+
+func (c *SegmentCache) isCode() bool {
+	return c.Access&accessCode != 0
+}
+
+// withinLimit offset..offset+size-1 is inside the segment, honouring expand-down data segments
+func (c *SegmentCache) withinLimit(offset uint32, size uint32) bool {
+	last := offset + size - 1
+	if last < offset {
+		return false
+	}
+	if !c.isCode() && c.Access&accessExpandDown != 0 {
+		upper := uint32(0xffff)
+		if c.Big {
+			upper = 0xffffffff
+		}
+		return offset > c.Limit && last <= upper
+	}
+	return last <= c.Limit
+}
+
+func (r *X86Registers) selectorIndex(index uint8) *uint16 {
+	switch index {
+	case SegES:
+		return &r.ES
+	case SegCS:
+		return &r.CS
+	case SegSS:
+		return &r.SS
+	case SegDS:
+		return &r.DS
+	case SegFS:
+		return &r.FS
+	case SegGS:
+		return &r.GS
+	}
+	log.Fatal("UNDEFINED segment index", index)
+	return &r.ES
+}
+
+// GetSegment returns the visible selector of a segment register
+func (r *X86Registers) GetSegment(index uint8) uint16 {
+	return *r.selectorIndex(index)
+}
+
+// SegmentBase returns the base address held in the hidden part of a segment register
+func (r *X86Registers) SegmentBase(index uint8) uint32 {
+	return r.Segments[index].Base
+}
+
+// loadRealModeSegment loads a selector in real mode: base = selector * 16.
+// The limit and the access rights are left untouched, like real hardware does.
+func (r *X86Registers) loadRealModeSegment(index uint8, selector uint16) {
+	*r.selectorIndex(index) = selector
+	r.Segments[index].Base = uint32(selector) << 4
+}
+
+// resetSegment puts a segment register in the state found after reset or in real mode
+func (r *X86Registers) resetSegment(index uint8, selector uint16) {
+	*r.selectorIndex(index) = selector
+	access := uint8(realModeDataAccess)
+	if index == SegCS {
+		access = realModeCodeAccess
+	}
+	r.Segments[index] = SegmentCache{
+		Base:   uint32(selector) << 4,
+		Limit:  realModeLimit,
+		Access: access,
+	}
+}
+
+// loadV86Segment loads a segment register on entry to virtual-8086 mode: base = selector * 16,
+// 64 KiB limit, DPL 3
+func (r *X86Registers) loadV86Segment(index uint8, selector uint16) {
+	r.resetSegment(index, selector)
+	r.Segments[index].Access |= 3 << 5
+}
+
+// flatSegment sets a 4 GiB segment with base 0, as left by a 32-bit boot loader
+func (r *X86Registers) flatSegment(index uint8) {
+	*r.selectorIndex(index) = 0
+	access := uint8(realModeDataAccess)
+	if index == SegCS {
+		access = realModeCodeAccess
+	}
+	r.Segments[index] = SegmentCache{
+		Base:   0,
+		Limit:  0xffffffff,
+		Access: access,
+		Big:    true,
+	}
+}
+
+// IsRealMode Protection Enable (CR0 bit 0) is clear
+func (r *X86Registers) IsRealMode() bool {
+	return r.CR0&CR0PE == 0
+}
+
+// IsV86 virtual-8086 mode: VM is set in protected mode
+func (r *X86Registers) IsV86() bool {
+	return !r.IsRealMode() && r.IsVM()
+}
+
+// realSegments segment registers load as selector * 16: real mode and virtual-8086 mode
+func (r *X86Registers) realSegments() bool {
+	return r.IsRealMode() || r.IsVM()
+}
+
+// CPL current privilege level, the RPL of CS; virtual-8086 tasks always run at 3
+func (r *X86Registers) CPL() uint8 {
+	if r.IsRealMode() {
+		return 0
+	}
+	if r.IsVM() {
+		return 3
+	}
+	return uint8(r.CS & 3)
+}
+
+// IsCode32 the current code segment has a 32-bit default operand and address size
+func (r *X86Registers) IsCode32() bool {
+	return r.Segments[SegCS].Big
+}
+
+// Is64 64-bit mode: long mode is active and the code segment has its L bit set. Other code
+// segments run in compatibility mode, like in protected mode.
+func (r *X86Registers) Is64() bool {
+	return r.IA32Efer&EFERLMA != 0 && r.Segments[SegCS].Long
+}
+
+// IsStack32 the current stack segment uses ESP instead of SP
+func (r *X86Registers) IsStack32() bool {
+	return r.Segments[SegSS].Big
+}
+
+// CodeAddress linear address of CS:EIP+offset, IP wraps at 64 KiB in 16-bit code
+func (r *X86Registers) CodeAddress(offset int) uint32 {
+	ip := r.EIP + uint32(offset)
+	if !r.IsCode32() {
+		ip &= 0xffff
+	}
+	cs := &r.Segments[SegCS]
+	if ip > cs.Limit {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	return cs.Base + ip
+}
+
+// StackPointer returns ESP or SP, depending on the stack segment size
+func (r *X86Registers) StackPointer() uint32 {
+	if r.IsStack32() {
+		return r.ESP
+	}
+	return r.ESP & 0xffff
+}
+
+// stackMask keeps the stack pointer inside 64 KiB for 16-bit stack segments
+func (r *X86Registers) stackMask() uint32 {
+	if r.IsStack32() {
+		return 0xffffffff
+	}
+	return 0xffff
+}
+
+// SetStackPointer updates ESP or only SP, depending on the stack segment size
+func (r *X86Registers) SetStackPointer(value uint32) {
+	if r.IsStack32() {
+		r.ESP = value
+	} else {
+		r.ESP = (r.ESP & 0xffff0000) | (value & 0xffff)
+	}
+}
+
+// segmentAddress checks an access of size bytes at segment:offset and returns its linear address
+func (r *X86Registers) segmentAddress(index uint8, offset uint32, size uint32, write bool) uint32 {
+	cache := &r.Segments[index]
+	vector := uint8(ExceptionGP)
+	if index == SegSS {
+		vector = ExceptionSS
+	}
+	if !r.realSegments() {
+		if !cache.IsUsable() {
+			raiseWithCode(vector, 0)
+		}
+		if write && (cache.isCode() || cache.Access&accessWritable == 0) {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		if !write && cache.isCode() && cache.Access&accessReadable == 0 {
+			raiseWithCode(ExceptionGP, 0)
+		}
+	}
+	if !cache.withinLimit(offset, size) {
+		raiseWithCode(vector, 0)
+	}
+	return cache.Base + offset
+}
+
+// descriptorAddress linear address of the GDT or LDT entry referenced by selector
+func descriptorAddress(reg *X86Registers, selector uint16) uint32 {
+	base := reg.GDTR.Base
+	limit := uint32(reg.GDTR.Limit)
+	if selector&4 != 0 {
+		if !reg.LDTCache.IsUsable() {
+			raiseWithCode(ExceptionGP, uint32(selector&^3))
+		}
+		base = reg.LDTCache.Base
+		limit = reg.LDTCache.Limit
+	}
+	offset := uint32(selector &^ 7)
+	if offset+7 > limit {
+		raiseWithCode(ExceptionGP, uint32(selector&^3))
+	}
+	return base + offset
+}
+
+func readDescriptor(mem IMemory, address uint32) Descriptor {
+	defer mem.Implicit()()
+	raw := uint64(mem.Read32(address)) | uint64(mem.Read32(address+4))<<32
+	return parseDescriptor(raw)
+}
+
+// loadSegment loads a segment register. In protected mode the descriptor is fetched from
+// the GDT or LDT, checked and copied into the hidden part of the register.
+func loadSegment(reg *X86Registers, mem IMemory, index uint8, selector uint16) {
+	if reg.realSegments() {
+		reg.loadRealModeSegment(index, selector)
+		return
+	}
+	if selector&^3 == 0 {
+		if index == SegCS || index == SegSS {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		*reg.selectorIndex(index) = selector
+		reg.Segments[index] = SegmentCache{}
+		reg.loadBase(index)
+		return
+	}
+	errorCode := uint32(selector &^ 3)
+	address := descriptorAddress(reg, selector)
+	desc := readDescriptor(mem, address)
+	cpl := reg.CPL()
+	rpl := uint8(selector & 3)
+	switch index {
+	case SegCS:
+		if !desc.IsCode() {
+			raiseWithCode(ExceptionGP, errorCode)
+		}
+	case SegSS:
+		if !desc.IsWritable() || rpl != cpl || desc.DPL() != cpl {
+			raiseWithCode(ExceptionGP, errorCode)
+		}
+		if !desc.IsPresent() {
+			raiseWithCode(ExceptionSS, errorCode)
+		}
+	default:
+		if !desc.IsReadable() {
+			raiseWithCode(ExceptionGP, errorCode)
+		}
+		// data and non-conforming code segments must be at least as privileged as CPL and RPL
+		if !desc.IsConforming() && (desc.DPL() < cpl || desc.DPL() < rpl) {
+			raiseWithCode(ExceptionGP, errorCode)
+		}
+	}
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionNP, errorCode)
+	}
+	markAccessed(mem, address, &desc)
+	*reg.selectorIndex(index) = selector
+	reg.Segments[index] = desc.cache()
+	reg.loadBase(index)
+}
+
+// loadBase loading FS or GS also sets the 64-bit base used in 64-bit mode
+func (r *X86Registers) loadBase(index uint8) {
+	switch index {
+	case SegFS:
+		r.X64.FSBase = uint64(r.Segments[SegFS].Base)
+	case SegGS:
+		r.X64.GSBase = uint64(r.Segments[SegGS].Base)
+	}
+}
+
+// markAccessed sets the accessed bit of a descriptor being loaded in a segment register
+func markAccessed(mem IMemory, address uint32, desc *Descriptor) {
+	if desc.Access&accessAccessed == 0 {
+		defer mem.Implicit()()
+		desc.Access |= accessAccessed
+		mem.Write8(address+5, desc.Access)
+	}
+}
+
+// checkCodeTarget privilege checks of a far JMP or CALL to a code segment: a conforming segment
+// can be reached from a less privileged level, a non-conforming one only from its own level
+func checkCodeTarget(desc *Descriptor, selector uint16, cpl uint8) {
+	errorCode := uint32(selector &^ 3)
+	if !desc.IsCode() {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	if desc.IsConforming() {
+		if desc.DPL() > cpl {
+			raiseWithCode(ExceptionGP, errorCode)
+		}
+	} else if uint8(selector&3) > cpl || desc.DPL() != cpl {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionNP, errorCode)
+	}
+}
+
+// checkStackSegment checks the SS selector loaded by a change to privilege level cpl.
+// vector is #TS for a stack read from the TSS and #GP for a return to an outer level.
+func checkStackSegment(reg *X86Registers, mem IMemory, selector uint16, cpl uint8, vector uint8) (uint32, Descriptor) {
+	errorCode := uint32(selector &^ 3)
+	if selector&^3 == 0 {
+		raiseWithCode(vector, 0)
+	}
+	address := descriptorAddress(reg, selector)
+	desc := readDescriptor(mem, address)
+	if uint8(selector&3) != cpl || desc.DPL() != cpl || !desc.IsWritable() {
+		raiseWithCode(vector, errorCode)
+	}
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionSS, errorCode)
+	}
+	return address, desc
+}
+
+// setStackSegment commits a checked stack segment descriptor to SS
+func setStackSegment(reg *X86Registers, mem IMemory, selector uint16, address uint32, desc Descriptor) {
+	markAccessed(mem, address, &desc)
+	reg.SS = selector
+	reg.Segments[SegSS] = desc.cache()
+}
+
+// clearOuterSegments nulls ES, DS, FS and GS after a return to an outer privilege level
+// when they hold segments the new CPL cannot access
+func clearOuterSegments(reg *X86Registers) {
+	cpl := reg.CPL()
+	for _, index := range []uint8{SegES, SegDS, SegFS, SegGS} {
+		cache := &reg.Segments[index]
+		conforming := cache.isCode() && cache.Access&accessConforming != 0
+		if !conforming && (cache.Access>>5)&3 < cpl {
+			*reg.selectorIndex(index) = 0
+			*cache = SegmentCache{}
+		}
+	}
+}
+
+// setCodeSegment commits a checked code segment descriptor to CS, running at privilege level cpl
+func setCodeSegment(reg *X86Registers, mem IMemory, selector uint16, address uint32, desc Descriptor, cpl uint8) {
+	markAccessed(mem, address, &desc)
+	reg.CS = selector&^3 | uint16(cpl)
+	reg.Segments[SegCS] = desc.cache()
+}
+
+// loadLDT loads LDTR with a selector referring to an LDT descriptor in the GDT
+func loadLDT(reg *X86Registers, mem IMemory, selector uint16) {
+	if selector&^3 == 0 {
+		reg.LDTR = selector
+		reg.LDTCache = SegmentCache{}
+		return
+	}
+	errorCode := uint32(selector &^ 3)
+	if selector&4 != 0 {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	desc := readDescriptor(mem, descriptorAddress(reg, selector))
+	if !desc.IsSystem() || desc.Type() != descLDT {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionNP, errorCode)
+	}
+	reg.LDTR = selector
+	reg.LDTCache = desc.cache()
+}
@@ -0,0 +1,403 @@
+package core
+
+// Lane-wise integer operations on 64-bit values, shared by the MMX registers and the
+// quadwords of the XMM registers
+
+func laneMask(width uint) uint64 {
+	if width == 64 {
+		return ^uint64(0)
+	}
+	return 1<<width - 1
+}
+
+func signExtend(v uint64, width uint) int64 {
+	return int64(v<<(64-width)) >> (64 - width)
+}
+
+// lanes applies op to each pair of lanes of width bits of a and b
+func lanes(a uint64, b uint64, width uint, op func(x uint64, y uint64) uint64) uint64 {
+	mask := laneMask(width)
+	var r uint64
+	for s := uint(0); s < 64; s += width {
+		r |= op(a>>s&mask, b>>s&mask) & mask << s
+	}
+	return r
+}
+
+// saturate clamps v to the signed or unsigned range of width bits
+func saturate(v int64, width uint, unsigned bool) uint64 {
+	lo, hi := -int64(1)<<(width-1), int64(1)<<(width-1)-1
+	if unsigned {
+		lo, hi = 0, int64(1)<<width-1
+	}
+	if v < lo {
+		v = lo
+	} else if v > hi {
+		v = hi
+	}
+	return uint64(v) & laneMask(width)
+}
+
+func addLanes(width uint) func(a uint64, b uint64) uint64 {
+	return func(a uint64, b uint64) uint64 {
+		return lanes(a, b, width, func(x uint64, y uint64) uint64 { return x + y })
+	}
+}
+
+func subLanes(width uint) func(a uint64, b uint64) uint64 {
+	return func(a uint64, b uint64) uint64 {
+		return lanes(a, b, width, func(x uint64, y uint64) uint64 { return x - y })
+	}
+}
+
+// addSaturate PADDS and PADDUS
+func addSaturate(width uint, unsigned bool) func(a uint64, b uint64) uint64 {
+	return func(a uint64, b uint64) uint64 {
+		return lanes(a, b, width, func(x uint64, y uint64) uint64 {
+			if unsigned {
+				return saturate(int64(x+y), width, true)
+			}
+			return saturate(signExtend(x, width)+signExtend(y, width), width, false)
+		})
+	}
+}
+
+// subSaturate PSUBS and PSUBUS
+func subSaturate(width uint, unsigned bool) func(a uint64, b uint64) uint64 {
+	return func(a uint64, b uint64) uint64 {
+		return lanes(a, b, width, func(x uint64, y uint64) uint64 {
+			if unsigned {
+				return saturate(int64(x)-int64(y), width, true)
+			}
+			return saturate(signExtend(x, width)-signExtend(y, width), width, false)
+		})
+	}
+}
+
+// compareLanes PCMPEQ and PCMPGT (signed): all ones where the condition holds
+func compareLanes(width uint, greater bool) func(a uint64, b uint64) uint64 {
+	return func(a uint64, b uint64) uint64 {
+		return lanes(a, b, width, func(x uint64, y uint64) uint64 {
+			if greater && signExtend(x, width) > signExtend(y, width) || !greater && x == y {
+				return ^uint64(0)
+			}
+			return 0
+		})
+	}
+}
+
+// minMaxLanes PMINUB, PMAXUB, PMINSW and PMAXSW
+func minMaxLanes(width uint, signed bool, max bool) func(a uint64, b uint64) uint64 {
+	return func(a uint64, b uint64) uint64 {
+		return lanes(a, b, width, func(x uint64, y uint64) uint64 {
+			less := x < y
+			if signed {
+				less = signExtend(x, width) < signExtend(y, width)
+			}
+			if less != max {
+				return x
+			}
+			return y
+		})
+	}
+}
+
+// averageLanes PAVGB and PAVGW: the unsigned average rounded up
+func averageLanes(width uint) func(a uint64, b uint64) uint64 {
+	return func(a uint64, b uint64) uint64 {
+		return lanes(a, b, width, func(x uint64, y uint64) uint64 { return (x + y + 1) >> 1 })
+	}
+}
+
+// psadbw sums the absolute differences of the unsigned bytes into the low word
+func psadbw(a uint64, b uint64) uint64 {
+	var sum uint64
+	for s := uint(0); s < 64; s += 8 {
+		x, y := a>>s&0xff, b>>s&0xff
+		if x > y {
+			sum += x - y
+		} else {
+			sum += y - x
+		}
+	}
+	return sum
+}
+
+// unpackLow interleaves the low halves of a and b, lanes of a first
+func unpackLow(a uint64, b uint64, width uint) uint64 {
+	return interleave(a, b, width)
+}
+
+// unpackHigh interleaves the high halves of a and b
+func unpackHigh(a uint64, b uint64, width uint) uint64 {
+	return interleave(a>>32, b>>32, width)
+}
+
+func interleave(a uint64, b uint64, width uint) uint64 {
+	mask := laneMask(width)
+	var r uint64
+	for i := uint(0); i < 32/width; i++ {
+		r |= (a >> (i * width) & mask) << (2 * i * width)
+		r |= (b >> (i * width) & mask) << ((2*i + 1) * width)
+	}
+	return r
+}
+
+// pack narrows the signed lanes of width bits of a, then of b, to half their width with
+// signed or unsigned saturation
+func pack(a uint64, b uint64, width uint, unsigned bool) uint64 {
+	half := width / 2
+	n := 64 / width
+	var r uint64
+	for i, v := range [2]uint64{a, b} {
+		for j := uint(0); j < n; j++ {
+			x := signExtend(v>>(j*width)&laneMask(width), width)
+			r |= saturate(x, half, unsigned) << ((uint(i)*n + j) * half)
+		}
+	}
+	return r
+}
+
+// pmaddwd multiplies the signed words and adds the adjacent products into dwords
+func pmaddwd(a uint64, b uint64) uint64 {
+	var r uint64
+	for i := uint(0); i < 2; i++ {
+		var sum int64
+		for j := uint(0); j < 2; j++ {
+			s := 32*i + 16*j
+			sum += signExtend(a>>s&0xffff, 16) * signExtend(b>>s&0xffff, 16)
+		}
+		r |= uint64(uint32(sum)) << (32 * i)
+	}
+	return r
+}
+
+// Packed shift kinds
+const (
+	shiftRightLogical    = 2
+	shiftRightArithmetic = 4
+	shiftLeft            = 6
+)
+
+// shiftLanes shifts each lane of width bits by count, numbered like the reg field of the
+// immediate forms. Counts beyond the lane clear it, or fill it with the sign.
+func shiftLanes(a uint64, count uint64, width uint, kind uint8) uint64 {
+	if count >= uint64(width) {
+		if kind != shiftRightArithmetic {
+			return 0
+		}
+		count = uint64(width) - 1
+	}
+	c := uint(count)
+	return lanes(a, 0, width, func(x uint64, y uint64) uint64 {
+		switch kind {
+		case shiftLeft:
+			return x << c
+		case shiftRightArithmetic:
+			return uint64(signExtend(x, width) >> c)
+		}
+		return x >> c
+	})
+}
+
+// packedOps the lane-wise operations of the MMX instructions by second opcode byte
+var packedOps = map[uint8]func(a uint64, b uint64) uint64{
+	0x60: func(a uint64, b uint64) uint64 { return unpackLow(a, b, 8) },
+	0x61: func(a uint64, b uint64) uint64 { return unpackLow(a, b, 16) },
+	0x62: func(a uint64, b uint64) uint64 { return unpackLow(a, b, 32) },
+	0x63: func(a uint64, b uint64) uint64 { return pack(a, b, 16, false) },
+	0x64: compareLanes(8, true),
+	0x65: compareLanes(16, true),
+	0x66: compareLanes(32, true),
+	0x67: func(a uint64, b uint64) uint64 { return pack(a, b, 16, true) },
+	0x68: func(a uint64, b uint64) uint64 { return unpackHigh(a, b, 8) },
+	0x69: func(a uint64, b uint64) uint64 { return unpackHigh(a, b, 16) },
+	0x6a: func(a uint64, b uint64) uint64 { return unpackHigh(a, b, 32) },
+	0x6b: func(a uint64, b uint64) uint64 { return pack(a, b, 32, false) },
+	0x74: compareLanes(8, false),
+	0x75: compareLanes(16, false),
+	0x76: compareLanes(32, false),
+	0xd4: addLanes(64),
+	0xd5: func(a uint64, b uint64) uint64 {
+		return lanes(a, b, 16, func(x uint64, y uint64) uint64 { return x * y })
+	},
+	0xd8: subSaturate(8, true),
+	0xd9: subSaturate(16, true),
+	0xda: minMaxLanes(8, false, false),
+	0xdb: func(a uint64, b uint64) uint64 { return a & b },
+	0xdc: addSaturate(8, true),
+	0xdd: addSaturate(16, true),
+	0xde: minMaxLanes(8, false, true),
+	0xdf: func(a uint64, b uint64) uint64 { return ^a & b },
+	0xe0: averageLanes(8),
+	0xe3: averageLanes(16),
+	0xe4: func(a uint64, b uint64) uint64 {
+		return lanes(a, b, 16, func(x uint64, y uint64) uint64 { return x * y >> 16 })
+	},
+	0xe5: func(a uint64, b uint64) uint64 {
+		return lanes(a, b, 16, func(x uint64, y uint64) uint64 {
+			return uint64(signExtend(x, 16) * signExtend(y, 16) >> 16)
+		})
+	},
+	0xe8: subSaturate(8, false),
+	0xe9: subSaturate(16, false),
+	0xea: minMaxLanes(16, true, false),
+	0xeb: func(a uint64, b uint64) uint64 { return a | b },
+	0xec: addSaturate(8, false),
+	0xed: addSaturate(16, false),
+	0xee: minMaxLanes(16, true, true),
+	0xef: func(a uint64, b uint64) uint64 { return a ^ b },
+	0xf4: func(a uint64, b uint64) uint64 { return (a & 0xffffffff) * (b & 0xffffffff) },
+	0xf5: pmaddwd,
+	0xf6: psadbw,
+	0xf8: subLanes(8),
+	0xf9: subLanes(16),
+	0xfa: subLanes(32),
+	0xfb: subLanes(64),
+	0xfc: addLanes(8),
+	0xfd: addLanes(16),
+	0xfe: addLanes(32),
+}
+
+// packedFeature the CPUID leaf 1 EDX feature of the packed operations added by SSE and SSE2
+var packedFeature = map[uint8]uint32{
+	0xd4: FeatureSSE2,
+	0xda: FeatureSSE,
+	0xde: FeatureSSE,
+	0xe0: FeatureSSE,
+	0xe3: FeatureSSE,
+	0xe4: FeatureSSE,
+	0xea: FeatureSSE,
+	0xee: FeatureSSE,
+	0xf4: FeatureSSE2,
+	0xf6: FeatureSSE,
+	0xfb: FeatureSSE2,
+}
+
+// packedShifts the width and kind of the shifts by register or memory count
+var packedShifts = map[uint8]struct {
+	width uint
+	kind  uint8
+}{
+	0xd1: {16, shiftRightLogical},
+	0xd2: {32, shiftRightLogical},
+	0xd3: {64, shiftRightLogical},
+	0xe1: {16, shiftRightArithmetic},
+	0xe2: {32, shiftRightArithmetic},
+	0xf1: {16, shiftLeft},
+	0xf2: {32, shiftLeft},
+	0xf3: {64, shiftLeft},
+}
+
+// readQword reads 8 bytes at the linear address of an operand, which is 64-bit in 64-bit mode
+func readQword(mem IMemory, address uint64) uint64 {
+	return mem.ReadLinear(address, 8)
+}
+
+func writeQword(mem IMemory, address uint64, value uint64) {
+	mem.WriteLinear(address, 8, value)
+}
+
+// readDword, writeDword, readWord and writeWord the 4 and 2 byte accesses of readQword
+func readDword(mem IMemory, address uint64) uint32 {
+	return uint32(mem.ReadLinear(address, 4))
+}
+
+func writeDword(mem IMemory, address uint64, value uint32) {
+	mem.WriteLinear(address, 4, uint64(value))
+}
+
+func readWord(mem IMemory, address uint64) uint16 {
+	return uint16(mem.ReadLinear(address, 2))
+}
+
+func writeWord(mem IMemory, address uint64, value uint16) {
+	mem.WriteLinear(address, 2, uint64(value))
+}
+
+// XMM 128-bit SSE register as two quadwords, the low one first
+type XMM [2]uint64
+
+// lane the i-th lane of width bits
+func (x XMM) lane(i uint, width uint) uint64 {
+	return x[i*width/64] >> (i * width % 64) & laneMask(width)
+}
+
+func (x *XMM) setLane(i uint, width uint, value uint64) {
+	q, s := i*width/64, i*width%64
+	x[q] = x[q]&^(laneMask(width)<<s) | value&laneMask(width)<<s
+}
+
+// packed128 applies a packedOps operation to the XMM registers a and b. The pack and unpack
+// instructions work across the quadwords: unpacks interleave the low or high halves of
+// the registers, packs narrow all of a then all of b.
+func packed128(code uint8, a XMM, b XMM) XMM {
+	switch code {
+	case 0x60, 0x61, 0x62:
+		return unpack128(a[0], b[0], 8<<(code&3))
+	case 0x68, 0x69, 0x6a:
+		return unpack128(a[1], b[1], 8<<(code&3))
+	case 0x6c:
+		return XMM{a[0], b[0]}
+	case 0x6d:
+		return XMM{a[1], b[1]}
+	case 0x63, 0x67, 0x6b:
+		op := packedOps[code]
+		return XMM{op(a[0], a[1]), op(b[0], b[1])}
+	}
+	op := packedOps[code]
+	return XMM{op(a[0], b[0]), op(a[1], b[1])}
+}
+
+// unpack128 interleaves the lanes of the quadwords a and b into a register
+func unpack128(a uint64, b uint64, width uint) XMM {
+	return XMM{unpackLow(a, b, width), unpackHigh(a, b, width)}
+}
+
+// shuffleWords PSHUFW: word i of the result is the word of v selected by bits 2i+1:2i of order
+func shuffleWords(v uint64, order uint8) uint64 {
+	var r uint64
+	for i := uint(0); i < 4; i++ {
+		r |= v >> (16 * uint(order>>(2*i)&3)) & 0xffff << (16 * i)
+	}
+	return r
+}
+
+// byteSigns PMOVMSKB: the sign bits of the bytes of v
+func byteSigns(v uint64) uint32 {
+	var r uint32
+	for i := uint(0); i < 8; i++ {
+		r |= uint32(v>>(8*i+7)&1) << i
+	}
+	return r
+}
+
+// maskedStore MASKMOVQ and MASKMOVDQU: writes the bytes of the quadwords of data whose byte
+// in mask has its sign bit set, from DS:(E)DI upwards
+func maskedStore(reg *X86Registers, mem IMemory, data []uint64, mask []uint64) {
+	for q := range data {
+		for i := uint(0); i < 8; i++ {
+			if mask[q]>>(8*i+7)&1 == 0 {
+				continue
+			}
+			mem.WriteLinear(maskedAddress(reg, uint32(q)*8+uint32(i)), 1, data[q]>>(8*i))
+		}
+	}
+}
+
+// maskedAddress the linear address of the byte at DS:(E)DI+offset, RDI+offset in 64-bit mode
+func maskedAddress(reg *X86Registers, offset uint32) uint64 {
+	if reg.mode64 {
+		address := reg.dataBase() + reg.X64.RDI + uint64(offset)
+		if reg.addrOverride {
+			address = reg.dataBase() + uint64(uint32(reg.X64.RDI)+offset)
+		}
+		checkCanonical(address, 1, ExceptionGP)
+		return address
+	}
+	di := reg.EDI
+	if !reg.isAddress32() {
+		di &= 0xffff
+	}
+	return uint64(reg.segmentAddress(reg.dataSegment(SegDS), di+offset, 1, true))
+}
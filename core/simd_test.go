@@ -0,0 +1,10 @@
+package core
+
+import "testing"
+
+func TestSIMD64(t *testing.T) {
+	status := runProgram(t, 64, "simd64.elf", WithLinux(t.TempDir(), []string{"simd64"}, nil))
+	if status != 0 {
+		t.Errorf("check %d of testdata/simd64.s failed", status)
+	}
+}
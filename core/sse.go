@@ -0,0 +1,536 @@
+package core
+
+// MXCSR fields
+const (
+	mxcsrInit = 0x1f80
+	mxcsrDAZ  = 1 << 6 // denormals are zeros
+	mxcsrUM   = 1 << 11
+	mxcsrFZ   = 1 << 15 // flush to zero
+	// mxcsrMask the writable bits; others raise #GP on LDMXCSR
+	mxcsrMask = 0xffff
+)
+
+// SSE SSE and SSE2 instructions on the XMM registers
+type SSE struct {
+	reg *X86Registers
+	mem IMemory
+}
+
+func NewSSE(reg *X86Registers, mem IMemory) *SSE {
+	return &SSE{
+		reg: reg,
+		mem: mem,
+	}
+}
+
+// check SSE instructions raise #UD without feature, with CR0.EM or without CR4.OSFXSR, and
+// #NM with CR0.TS
+func (s *SSE) check(feature uint32) {
+	reg := s.reg
+	if reg.features().Leaf1EDX&feature == 0 || reg.CR0&CR0EM != 0 || reg.CR4&CR4OSFXSR == 0 {
+		raise(ExceptionUD)
+	}
+	if reg.CR0&CR0TS != 0 {
+		raise(ExceptionNM)
+	}
+}
+
+// decode checks the instruction and decodes the ModRM byte after the second opcode byte
+func (s *SSE) decode(feature uint32) ModRM {
+	reg := s.reg
+	s.check(feature)
+	reg.EIP += 1
+	return NewModRM(reg, s.mem)
+}
+
+// decodeMMX like decode for the forms with an MMX register operand, which also report a
+// pending x87 exception and move the x87 stack to MMX
+func (s *SSE) decodeMMX(feature uint32) ModRM {
+	modrm := s.decode(feature)
+	fpuPending(s.reg)
+	s.reg.FPU.enterMMX()
+	return modrm
+}
+
+// address linear address of a memory operand of size bytes; 16-byte operands of the aligned
+// forms raise #GP(0) unless aligned on 16 bytes
+func (s *SSE) address(modrm *ModRM, size uint32, write bool, aligned bool) uint64 {
+	address := modrm.linear(size, write)
+	if aligned && address&15 != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	return address
+}
+
+// read the xmm/m operand: a whole register, or size bytes of memory zero-extended
+func (s *SSE) read(modrm *ModRM, size uint32, aligned bool) XMM {
+	if modrm.Mod == 3 {
+		return s.reg.XMM[modrm.Rm]
+	}
+	return s.load(s.address(modrm, size, false, aligned), size)
+}
+
+// write the low size bytes of value to the xmm/m operand; a register is written whole
+func (s *SSE) write(modrm *ModRM, size uint32, aligned bool, value XMM) {
+	if modrm.Mod == 3 {
+		s.reg.XMM[modrm.Rm] = value
+		return
+	}
+	s.store(s.address(modrm, size, true, aligned), size, value)
+}
+
+func (s *SSE) load(address uint64, size uint32) XMM {
+	mem := s.mem
+	switch size {
+	case 4:
+		return XMM{uint64(readDword(mem, address))}
+	case 8:
+		return XMM{readQword(mem, address)}
+	}
+	return XMM{readQword(mem, address), readQword(mem, address+8)}
+}
+
+func (s *SSE) store(address uint64, size uint32, value XMM) {
+	mem := s.mem
+	switch size {
+	case 4:
+		writeDword(mem, address, uint32(value[0]))
+	case 8:
+		writeQword(mem, address, value[0])
+	default:
+		writeQword(mem, address, value[0])
+		writeQword(mem, address+8, value[1])
+	}
+}
+
+// memoryOperand the address of the m operand of forms without a register encoding
+func (s *SSE) memoryOperand(modrm *ModRM, size uint32, write bool, aligned bool) uint64 {
+	if modrm.Mod == 3 {
+		raise(ExceptionUD)
+	}
+	return s.address(modrm, size, write, aligned)
+}
+
+// imm8 the immediate byte after the operands
+func (s *SSE) imm8() uint8 {
+	value := s.mem.GetCode8(0)
+	s.reg.EIP += 1
+	return value
+}
+
+// Mov MOVUPS, MOVAPS, MOVUPD, MOVAPD, MOVDQU and MOVDQA xmm, xmm/m128 (0F 10, 28, 6F)
+func (s *SSE) Mov(feature uint32, aligned bool) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(feature)
+		reg.XMM[modrm.RegIndex] = s.read(&modrm, 16, aligned)
+	}
+}
+
+// MovStore the stores xmm/m128, xmm of Mov (0F 11, 29, 7F)
+func (s *SSE) MovStore(feature uint32, aligned bool) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(feature)
+		s.write(&modrm, 16, aligned, reg.XMM[modrm.RegIndex])
+	}
+}
+
+// Movnt MOVNTPS, MOVNTPD and MOVNTDQ m128, xmm (0F 2B, E7): non-temporal stores
+func (s *SSE) Movnt(feature uint32) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(feature)
+		s.store(s.memoryOperand(&modrm, 16, true, true), 16, reg.XMM[modrm.RegIndex])
+	}
+}
+
+// MovScalar MOVSS and MOVSD xmm, xmm/m (F3/F2 0F 10): a register moves the low lane only,
+// memory is zero-extended
+func (s *SSE) MovScalar(width uint) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(floatFeature(width))
+		if modrm.Mod == 3 {
+			reg.XMM[modrm.RegIndex].setLane(0, width, reg.XMM[modrm.Rm].lane(0, width))
+			return
+		}
+		reg.XMM[modrm.RegIndex] = s.read(&modrm, uint32(width/8), false)
+	}
+}
+
+// MovScalarStore MOVSS and MOVSD xmm/m, xmm (F3/F2 0F 11)
+func (s *SSE) MovScalarStore(width uint) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(floatFeature(width))
+		value := reg.XMM[modrm.RegIndex]
+		if modrm.Mod == 3 {
+			reg.XMM[modrm.Rm].setLane(0, width, value.lane(0, width))
+			return
+		}
+		s.store(s.address(&modrm, uint32(width/8), true, false), uint32(width/8), value)
+	}
+}
+
+// MovHalf MOVLPS, MOVLPD, MOVHPS and MOVHPD xmm, m64 (0F 12, 16), loading quadword half.
+// The register forms without 66 are MOVHLPS and MOVLHPS, which move the other half of the
+// source.
+func (s *SSE) MovHalf(feature uint32, half int) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(feature)
+		if modrm.Mod == 3 {
+			if feature != FeatureSSE {
+				raise(ExceptionUD)
+			}
+			reg.XMM[modrm.RegIndex][half] = reg.XMM[modrm.Rm][1-half]
+			return
+		}
+		reg.XMM[modrm.RegIndex][half] = s.load(s.address(&modrm, 8, false, false), 8)[0]
+	}
+}
+
+// MovHalfStore MOVLPS, MOVLPD, MOVHPS and MOVHPD m64, xmm (0F 13, 17)
+func (s *SSE) MovHalfStore(feature uint32, half int) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(feature)
+		address := s.memoryOperand(&modrm, 8, true, false)
+		writeQword(s.mem, address, reg.XMM[modrm.RegIndex][half])
+	}
+}
+
+// Movmsk MOVMSKPS and MOVMSKPD r32, xmm (0F 50): the sign bits of the lanes
+func (s *SSE) Movmsk(width uint) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(floatFeature(width))
+		if modrm.Mod != 3 {
+			raise(ExceptionUD)
+		}
+		modrm.SetR32(laneSigns(reg.XMM[modrm.Rm], width))
+	}
+}
+
+// laneSigns MOVMSKPS and MOVMSKPD: the sign bits of the lanes of width bits of x
+func laneSigns(x XMM, width uint) uint32 {
+	var mask uint32
+	for i := uint(0); i < 128/width; i++ {
+		mask |= uint32(x.lane(i, width)>>(width-1)) << i
+	}
+	return mask
+}
+
+// MovdXMMRM32 MOVD xmm, r/m32 (66 0F 6E), MOVQ xmm, r/m64 with REX.W: zero-extended
+func (s *SSE) MovdXMMRM32() {
+	reg := s.reg
+	modrm := s.decode(FeatureSSE2)
+	reg.XMM[modrm.RegIndex] = XMM{modrm.GetRMW()}
+}
+
+// MovdRM32XMM MOVD r/m32, xmm (66 0F 7E), MOVQ r/m64, xmm with REX.W
+func (s *SSE) MovdRM32XMM() {
+	reg := s.reg
+	modrm := s.decode(FeatureSSE2)
+	modrm.SetRMW(reg.XMM[modrm.RegIndex][0])
+}
+
+// MovqXMMRM64 MOVQ xmm, xmm/m64 (F3 0F 7E): zero-extended
+func (s *SSE) MovqXMMRM64() {
+	reg := s.reg
+	modrm := s.decode(FeatureSSE2)
+	reg.XMM[modrm.RegIndex] = XMM{s.read(&modrm, 8, false)[0]}
+}
+
+// MovqRM64XMM MOVQ xmm/m64, xmm (66 0F D6): a register destination is zero-extended
+func (s *SSE) MovqRM64XMM() {
+	reg := s.reg
+	modrm := s.decode(FeatureSSE2)
+	s.write(&modrm, 8, false, XMM{reg.XMM[modrm.RegIndex][0]})
+}
+
+// Movq2dq MOVQ2DQ xmm, mm (F3 0F D6)
+func (s *SSE) Movq2dq() {
+	reg := s.reg
+	modrm := s.decodeMMX(FeatureSSE2)
+	if modrm.Mod != 3 {
+		raise(ExceptionUD)
+	}
+	reg.XMM[modrm.RegIndex] = XMM{reg.MM(modrm.Rm)}
+}
+
+// Movdq2q MOVDQ2Q mm, xmm (F2 0F D6)
+func (s *SSE) Movdq2q() {
+	reg := s.reg
+	modrm := s.decodeMMX(FeatureSSE2)
+	if modrm.Mod != 3 {
+		raise(ExceptionUD)
+	}
+	reg.SetMM(modrm.RegIndex, reg.XMM[modrm.Rm][0])
+}
+
+// Movnti MOVNTI m32, r32 (0F C3), MOVNTI m64, r64 with REX.W
+func (s *SSE) Movnti() {
+	modrm := s.decode(FeatureSSE2)
+	if modrm.wide() {
+		writeQword(s.mem, s.memoryOperand(&modrm, 8, true, false), modrm.GetR64())
+		return
+	}
+	writeDword(s.mem, s.memoryOperand(&modrm, 4, true, false), modrm.GetR32())
+}
+
+// Maskmovdqu MASKMOVDQU xmm, xmm (66 0F F7)
+func (s *SSE) Maskmovdqu() {
+	reg := s.reg
+	modrm := s.decode(FeatureSSE2)
+	if modrm.Mod != 3 {
+		raise(ExceptionUD)
+	}
+	data, mask := reg.XMM[modrm.RegIndex], reg.XMM[modrm.Rm]
+	maskedStore(reg, s.mem, data[:], mask[:])
+}
+
+// Logic ANDPS, ANDNPS, ORPS, XORPS and their PD forms (0F 54-57) with the packedOps
+// operation of PAND, PANDN, POR and PXOR
+func (s *SSE) Logic(feature uint32, code uint8) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(feature)
+		src := s.read(&modrm, 16, true)
+		reg.XMM[modrm.RegIndex] = packed128(code, reg.XMM[modrm.RegIndex], src)
+	}
+}
+
+// Packed xmm = xmm op xmm/m128 with the operations of packedOps (66 0F 60-6D, 74-76, D4-FE)
+func (s *SSE) Packed() {
+	reg := s.reg
+	code := s.mem.GetCode8(0)
+	modrm := s.decode(FeatureSSE2)
+	src := s.read(&modrm, 16, true)
+	reg.XMM[modrm.RegIndex] = packed128(code, reg.XMM[modrm.RegIndex], src)
+}
+
+// Shift PSRL, PSRA and PSLL xmm by the count in the low quadword of xmm/m128
+func (s *SSE) Shift() {
+	reg := s.reg
+	shift := packedShifts[s.mem.GetCode8(0)]
+	modrm := s.decode(FeatureSSE2)
+	count := s.read(&modrm, 16, true)[0]
+	reg.XMM[modrm.RegIndex] = shift128(reg.XMM[modrm.RegIndex], count, shift.width, shift.kind)
+}
+
+func shift128(x XMM, count uint64, width uint, kind uint8) XMM {
+	return XMM{shiftLanes(x[0], count, width, kind), shiftLanes(x[1], count, width, kind)}
+}
+
+// ShiftImm groups 12-14 on xmm (66 0F 71-73), with PSRLDQ (/3) and PSLLDQ (/7) shifting the
+// whole register by bytes
+func (s *SSE) ShiftImm() {
+	reg := s.reg
+	width := [3]uint{16, 32, 64}[s.mem.GetCode8(0)-0x71]
+	modrm := s.decode(FeatureSSE2)
+	kind := modrm.Opcode
+	if modrm.Mod != 3 {
+		raise(ExceptionUD)
+	}
+	count := uint64(s.imm8())
+	reg.XMM[modrm.Rm] = shiftImm128(reg.XMM[modrm.Rm], count, width, kind)
+}
+
+// shiftImm128 the operation /kind of the groups 12-14 on x; reserved ones raise #UD
+func shiftImm128(x XMM, count uint64, width uint, kind uint8) XMM {
+	switch {
+	case width == 64 && (kind == 3 || kind == 7):
+		return shiftBytes(x, uint(count), kind == 7)
+	case kind == shiftRightLogical || kind == shiftLeft || kind == shiftRightArithmetic && width != 64:
+		return shift128(x, count, width, kind)
+	}
+	raise(ExceptionUD)
+	return x
+}
+
+// shiftBytes PSRLDQ and PSLLDQ: shifts x by count bytes, clearing it beyond 15
+func shiftBytes(x XMM, count uint, left bool) XMM {
+	if count > 15 {
+		return XMM{}
+	}
+	var r XMM
+	for i := uint(0); i < 16; i++ {
+		j := i + count
+		if left {
+			j = i - count
+		}
+		if j < 16 {
+			r.setLane(i, 8, x.lane(j, 8))
+		}
+	}
+	return r
+}
+
+// Pshufd PSHUFD xmm, xmm/m128, imm8 (66 0F 70): each dword selected by two bits of imm8
+func (s *SSE) Pshufd() {
+	reg := s.reg
+	modrm := s.decode(FeatureSSE2)
+	src := s.read(&modrm, 16, true)
+	reg.XMM[modrm.RegIndex] = shuffleDwords(src, src, s.imm8())
+}
+
+// shuffleDwords the low dwords of the result from a, the high ones from b, each selected by
+// two bits of order
+func shuffleDwords(a XMM, b XMM, order uint8) XMM {
+	var r XMM
+	for i := uint(0); i < 4; i++ {
+		from := a
+		if i >= 2 {
+			from = b
+		}
+		r.setLane(i, 32, from.lane(uint(order>>(2*i)&3), 32))
+	}
+	return r
+}
+
+// PshufHalf PSHUFLW and PSHUFHW xmm, xmm/m128, imm8 (F2/F3 0F 70): shuffles the words of
+// the quadword half, copying the other one
+func (s *SSE) PshufHalf(half int) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(FeatureSSE2)
+		src := s.read(&modrm, 16, true)
+		src[half] = shuffleWords(src[half], s.imm8())
+		reg.XMM[modrm.RegIndex] = src
+	}
+}
+
+// Pinsrw PINSRW xmm, r32/m16, imm8 (66 0F C4)
+func (s *SSE) Pinsrw() {
+	reg := s.reg
+	modrm := s.decode(FeatureSSE2)
+	value := uint64(modrm.GetRM16())
+	reg.XMM[modrm.RegIndex].setLane(uint(s.imm8()&7), 16, value)
+}
+
+// Pextrw PEXTRW r32, xmm, imm8 (66 0F C5)
+func (s *SSE) Pextrw() {
+	reg := s.reg
+	modrm := s.decode(FeatureSSE2)
+	if modrm.Mod != 3 {
+		raise(ExceptionUD)
+	}
+	value := reg.XMM[modrm.Rm].lane(uint(s.imm8()&7), 16)
+	modrm.SetR32(uint32(value))
+}
+
+// Pmovmskb PMOVMSKB r32, xmm (66 0F D7)
+func (s *SSE) Pmovmskb() {
+	reg := s.reg
+	modrm := s.decode(FeatureSSE2)
+	if modrm.Mod != 3 {
+		raise(ExceptionUD)
+	}
+	x := reg.XMM[modrm.Rm]
+	modrm.SetR32(byteSigns(x[0]) | byteSigns(x[1])<<8)
+}
+
+// Shufps SHUFPS xmm, xmm/m128, imm8 (0F C6): the low dwords from the destination, the high
+// ones from the source, each selected by two bits of imm8
+func (s *SSE) Shufps() {
+	reg := s.reg
+	modrm := s.decode(FeatureSSE)
+	src := s.read(&modrm, 16, true)
+	reg.XMM[modrm.RegIndex] = shuffleDwords(reg.XMM[modrm.RegIndex], src, s.imm8())
+}
+
+// Shufpd SHUFPD xmm, xmm/m128, imm8 (66 0F C6)
+func (s *SSE) Shufpd() {
+	reg := s.reg
+	modrm := s.decode(FeatureSSE2)
+	src := s.read(&modrm, 16, true)
+	order := s.imm8()
+	dst := reg.XMM[modrm.RegIndex]
+	reg.XMM[modrm.RegIndex] = XMM{dst[order&1], src[order>>1&1]}
+}
+
+// Unpack UNPCKLPS, UNPCKHPS, UNPCKLPD and UNPCKHPD (0F 14, 15): interleave the low or high
+// halves of the registers
+func (s *SSE) Unpack(width uint, half int) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(floatFeature(width))
+		src := s.read(&modrm, 16, true)
+		reg.XMM[modrm.RegIndex] = unpackFloat(reg.XMM[modrm.RegIndex], src, width, half)
+	}
+}
+
+func unpackFloat(a XMM, b XMM, width uint, half int) XMM {
+	if width == 64 {
+		return XMM{a[half], b[half]}
+	}
+	return unpack128(a[half], b[half], width)
+}
+
+// Group15 0F AE: FXSAVE (/0), FXRSTOR (/1), LDMXCSR (/2), STMXCSR (/3), XSAVE (/4) and
+// XRSTOR (/5), and with a register operand LFENCE (/5), MFENCE (/6) and SFENCE (/7)
+func (s *SSE) Group15() {
+	reg := s.reg
+	reg.EIP += 1
+	modrm := NewModRM(reg, s.mem)
+	if modrm.Mod == 3 {
+		fence(reg, modrm.Opcode)
+		return
+	}
+	switch modrm.Opcode {
+	case 0:
+		s.fxsave(&modrm)
+	case 1:
+		s.fxrstor(&modrm)
+	case 2:
+		s.ldmxcsr(&modrm)
+	case 3:
+		s.stmxcsr(&modrm)
+	case 4:
+		s.xsave(&modrm)
+	case 5:
+		s.xrstor(&modrm)
+	default:
+		raise(ExceptionUD)
+	}
+}
+
+// fence LFENCE, MFENCE and SFENCE: instructions execute in order, so they only order the
+// memory accesses against those of the other processors on the bus
+func fence(reg *X86Registers, op uint8) {
+	feature := uint32(FeatureSSE2)
+	if op == 7 {
+		feature = FeatureSSE
+	}
+	if op < 5 || reg.features().Leaf1EDX&feature == 0 {
+		raise(ExceptionUD)
+	}
+	reg.bus.Lock()
+	reg.bus.Unlock()
+}
+
+// ldmxcsr LDMXCSR m32: reserved bits raise #GP(0)
+func (s *SSE) ldmxcsr(modrm *ModRM) {
+	reg := s.reg
+	s.check(FeatureSSE)
+	value := readDword(s.mem, modrm.linear(4, false))
+	if value&^mxcsrMask != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	reg.MXCSR = value
+}
+
+func (s *SSE) stmxcsr(modrm *ModRM) {
+	s.check(FeatureSSE)
+	writeDword(s.mem, modrm.linear(4, true), s.reg.MXCSR)
+}
+
+// Prefetch PREFETCHNTA, PREFETCHT0, PREFETCHT1 and PREFETCHT2 (0F 18): hints without effect;
+// the other encodings are reserved NOPs
+func (s *SSE) Prefetch() {
+	reg := s.reg
+	reg.EIP += 1
+	NewModRM(reg, s.mem)
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSSEFloat(t *testing.T) {
+	const (
+		nearest  = mxcsrInit
+		down     = mxcsrInit | 1<<13
+		up       = mxcsrInit | 2<<13
+		truncate = mxcsrInit | 3<<13
+	)
+	tests := []struct {
+		name   string
+		code   []byte
+		mxcsr  uint32
+		legacy bool // CR4.OSXMMEXCPT clear
+		a, b   uint64
+		eax    uint32
+		xmm0   uint64 // its low quadword
+		want   uint32 // MXCSR
+		err    string
+	}{
+		// the rounding control applies to conversions and arithmetic
+		{"cvtss2si nearest", []byte{0xf3, 0x0f, 0x2d, 0xc0}, // cvtss2si %xmm0,%eax
+			nearest, false, 0x40200000, 0, 2, 0x40200000, nearest | fswPE, ""},
+		{"cvtss2si down", []byte{0xf3, 0x0f, 0x2d, 0xc0},
+			down, false, 0xc0200000, 0, 0xfffffffd, 0xc0200000, down | fswPE, ""},
+		{"cvtss2si up", []byte{0xf3, 0x0f, 0x2d, 0xc0},
+			up, false, 0x40200000, 0, 3, 0x40200000, up | fswPE, ""},
+		{"cvtss2si truncate", []byte{0xf3, 0x0f, 0x2d, 0xc0},
+			truncate, false, 0xc0200000, 0, 0xfffffffe, 0xc0200000, truncate | fswPE, ""},
+		{"cvttss2si", []byte{0xf3, 0x0f, 0x2c, 0xc0}, // cvttss2si %xmm0,%eax
+			up, false, 0x40200000, 0, 2, 0x40200000, up | fswPE, ""},
+		{"cvtsd2si overflow", []byte{0xf2, 0x0f, 0x2d, 0xc0}, // cvtsd2si %xmm0,%eax
+			nearest, false, 0x4202a05f20000000, 0, 0x80000000, 0x4202a05f20000000, nearest | fswIE, ""},
+		{"addss nearest", []byte{0xf3, 0x0f, 0x58, 0xc1}, // addss %xmm1,%xmm0
+			nearest, false, 0x3f800000, 0x33800000, 0, 0x3f800000, nearest | fswPE, ""},
+		{"addss up", []byte{0xf3, 0x0f, 0x58, 0xc1},
+			up, false, 0x3f800000, 0x33800000, 0, 0x3f800001, up | fswPE, ""},
+		// a denormal operand sets DE, or reads as zero with DAZ
+		{"addss denormal", []byte{0xf3, 0x0f, 0x58, 0xc1},
+			nearest, false, 0, 1, 0, 1, nearest | fswDE, ""},
+		{"addss daz", []byte{0xf3, 0x0f, 0x58, 0xc1},
+			nearest | mxcsrDAZ, false, 0, 1, 0, 0, nearest | mxcsrDAZ, ""},
+		{"sqrtsd invalid", []byte{0xf2, 0x0f, 0x51, 0xc1}, // sqrtsd %xmm1,%xmm0
+			nearest, false, 0, 0xbff0000000000000, 0, 0xfff8000000000000, nearest | fswIE, ""},
+		{"divss masked", []byte{0xf3, 0x0f, 0x5e, 0xc1}, // divss %xmm1,%xmm0
+			nearest, false, 0x3f800000, 0, 0, 0x7f800000, nearest | fswZE, ""},
+		// an unmasked exception raises #XM, or #UD without CR4.OSXMMEXCPT
+		{"divss unmasked", []byte{0xf3, 0x0f, 0x5e, 0xc1},
+			nearest &^ fswZE << 7, false, 0x3f800000, 0, 0, 0x3f800000, 0, "#XM"},
+		{"divss unmasked legacy", []byte{0xf3, 0x0f, 0x5e, 0xc1},
+			nearest &^ fswZE << 7, true, 0x3f800000, 0, 0, 0x3f800000, 0, "#UD"},
+		// LDMXCSR of a reserved bit
+		{"ldmxcsr reserved", []byte{0x0f, 0xae, 0x15, 0x00, 0x18, 0x00, 0x00}, // ldmxcsr 0x1800
+			nearest, false, 0, 0, 0, 0, 0, "#GP"},
+	}
+	for _, test := range tests {
+		emu := newBare(t, 32, append(test.code, 0xf4))
+		cpu := emu.cpu.(*CPU)
+		reg := cpu.reg
+		reg.CR4 |= CR4OSFXSR | CR4OSXMMEXCPT
+		if test.legacy {
+			reg.CR4 &^= CR4OSXMMEXCPT
+		}
+		reg.MXCSR = test.mxcsr
+		reg.XMM[0], reg.XMM[1] = XMM{test.a}, XMM{test.b}
+		cpu.mem.Write32(0x1800, 1<<16)
+		err := emu.Run()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if reg.EAX != test.eax || reg.XMM[0][0] != test.xmm0 || reg.MXCSR != test.want {
+			t.Errorf("%s: EAX, XMM0, MXCSR = %#x, %#x, %#x, want %#x, %#x, %#x", test.name,
+				reg.EAX, reg.XMM[0][0], reg.MXCSR, test.eax, test.xmm0, test.want)
+		}
+	}
+}
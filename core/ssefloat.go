@@ -0,0 +1,374 @@
+package core
+
+// SIMD floating-point instructions: the lanes are converted to Float80 and the results
+// rounded once to their format with the MXCSR rounding control. The MXCSR exception flags
+// and masks sit at the bit positions of the x87 flags.
+
+// vecShape lanes a floating-point instruction works on: packed or scalar single or double
+// precision
+type vecShape struct {
+	width  uint
+	scalar bool
+}
+
+var (
+	shapePS = vecShape{32, false}
+	shapeSS = vecShape{32, true}
+	shapePD = vecShape{64, false}
+	shapeSD = vecShape{64, true}
+)
+
+func (v vecShape) count() uint {
+	if v.scalar {
+		return 1
+	}
+	return 128 / v.width
+}
+
+// size bytes of a memory operand
+func (v vecShape) size() uint32 {
+	if v.scalar {
+		return uint32(v.width / 8)
+	}
+	return 16
+}
+
+// floatFeature single precision instructions are SSE, double precision ones SSE2
+func floatFeature(width uint) uint32 {
+	if width == 64 {
+		return FeatureSSE2
+	}
+	return FeatureSSE
+}
+
+// ieeeLayout the rounding format and the fraction and exponent widths of lanes of width bits
+func ieeeLayout(width uint) (floatFormat, uint, uint) {
+	if width == 64 {
+		return formatDouble, 52, 11
+	}
+	return formatSingle, 23, 8
+}
+
+// SIMD operations besides those of arith
+const (
+	simdMin   = 8
+	simdMax   = 9
+	simdSqrt  = 10
+	simdRcp   = 11
+	simdRsqrt = 12
+)
+
+func (s *SSE) rc() uint16 {
+	return uint16(s.reg.MXCSR >> 13 & 3)
+}
+
+// signal records the exception flags in MXCSR. An unmasked exception raises #XM, or #UD
+// without CR4.OSXMMEXCPT, before the destination is written.
+func (s *SSE) signal(flags uint16) {
+	reg := s.reg
+	flags &= fswExceptions
+	reg.MXCSR |= uint32(flags)
+	if uint32(flags)&^(reg.MXCSR>>7) == 0 {
+		return
+	}
+	if reg.CR4&CR4OSXMMEXCPT == 0 {
+		raise(ExceptionUD)
+	}
+	raise(ExceptionXM)
+}
+
+// fromLane converts a lane of width bits; with MXCSR.DAZ denormals read as zeros
+func (s *SSE) fromLane(bits uint64, width uint) (Float80, uint16) {
+	_, frac, exp := ieeeLayout(width)
+	if s.reg.MXCSR&mxcsrDAZ != 0 && bits>>frac&(1<<exp-1) == 0 {
+		bits &^= 1<<frac - 1
+	}
+	return float80FromIEEE(bits, frac, exp)
+}
+
+// toLane rounds v to a lane of width bits. With MXCSR.FZ and underflow masked, denormal
+// results flush to zero and raise UE and PE.
+func (s *SSE) toLane(v Float80, width uint) (uint64, uint16) {
+	reg := s.reg
+	format, frac, exp := ieeeLayout(width)
+	bits, flags := v.toIEEE(format, frac, exp, s.rc())
+	if reg.MXCSR&mxcsrFZ != 0 && reg.MXCSR&mxcsrUM != 0 && bits>>frac&(1<<exp-1) == 0 &&
+		bits&(1<<frac-1) != 0 {
+		return bits &^ (1<<frac - 1), flags | fswUE | fswPE
+	}
+	return bits, flags
+}
+
+// floatLane one lane of the arithmetic instructions: a is the destination lane, b the source
+// one. A NaN operand gives the first NaN quieted; MIN and MAX return the source instead.
+func (s *SSE) floatLane(op uint8, a uint64, b uint64, width uint) (uint64, uint16) {
+	format, _, _ := ieeeLayout(width)
+	x, xFlags := s.fromLane(a, width)
+	y, yFlags := s.fromLane(b, width)
+	var result Float80
+	var flags uint16
+	switch op {
+	case simdMin, simdMax:
+		order, _ := compare80(x, y, true)
+		switch {
+		case order == cmpUnordered:
+			return b, xFlags | yFlags | fswIE
+		case op == simdMin && order == cmpLess, op == simdMax && order == cmpGreater:
+			return a, xFlags | yFlags
+		}
+		return b, xFlags | yFlags
+	case simdSqrt:
+		result, flags = sqrt80(y, format, s.rc())
+		flags |= yFlags
+	case simdRcp, simdRsqrt:
+		// the approximations are the exact values rounded to nearest, without exceptions
+		if op == simdRsqrt {
+			y, _ = sqrt80(y, formatExtended, 0)
+		}
+		result, _ = arith(fpDiv, float80FromInt(1), y, format, 0)
+		bits, _ := s.toLane(result, width)
+		return bits, 0
+	default:
+		flags = xFlags | yFlags
+		switch {
+		case x.isNaN():
+			result = x
+		case y.isNaN():
+			result = y
+		default:
+			var f uint16
+			result, f = arith(op, x, y, format, s.rc())
+			flags |= f
+		}
+	}
+	bits, f := s.toLane(result, width)
+	return bits, flags | f
+}
+
+// Arith ADD, SUB, MUL, DIV, MIN, MAX, SQRT, RCP and RSQRT xmm, xmm/m on the lanes of shape
+// (0F 51-53, 58, 59, 5C-5F). Scalar forms keep the upper lanes of the destination.
+func (s *SSE) Arith(op uint8, shape vecShape) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(floatFeature(shape.width))
+		src := s.read(&modrm, shape.size(), !shape.scalar)
+		result, flags := s.arithLanes(op, shape, reg.XMM[modrm.RegIndex], src)
+		s.signal(flags)
+		reg.XMM[modrm.RegIndex] = result
+	}
+}
+
+// arithLanes applies op to the lanes of shape of a and b, keeping the others of a
+func (s *SSE) arithLanes(op uint8, shape vecShape, a XMM, b XMM) (XMM, uint16) {
+	var flags uint16
+	for i := uint(0); i < shape.count(); i++ {
+		v, f := s.floatLane(op, a.lane(i, shape.width), b.lane(i, shape.width), shape.width)
+		a.setLane(i, shape.width, v)
+		flags |= f
+	}
+	return a, flags
+}
+
+// predicateOrders the orders for which each compare predicate holds, one bit per order
+// from cmpLess to cmpUnordered: EQ, LT, LE, UNORD, NEQ, NLT, NLE and ORD for 0-7, then
+// EQ_UQ, NGE, NGT, FALSE, NEQ_OQ, GE, GT and TRUE
+var predicateOrders = [16]uint8{2, 1, 3, 8, 13, 14, 12, 7, 10, 9, 11, 0, 5, 6, 4, 15}
+
+// comparePredicate evaluates the predicates 0-31 of CMPPS and VCMPPS. LT, LE, NLT, NLE and
+// their variants raise IE for QNaN operands; predicates 16-31 swap signaling and quiet.
+func comparePredicate(predicate uint8, x Float80, y Float80) (bool, uint16) {
+	quiet := (predicate&3 == 0 || predicate&3 == 3) != (predicate&16 != 0)
+	order, flags := compare80(x, y, quiet)
+	return predicateOrders[predicate&15]>>uint(order+1)&1 != 0, flags
+}
+
+// Cmp CMPPS, CMPPD, CMPSS and CMPSD xmm, xmm/m, imm8 (0F C2): all ones in the lanes where the
+// predicate holds
+func (s *SSE) Cmp(shape vecShape) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(floatFeature(shape.width))
+		src := s.read(&modrm, shape.size(), !shape.scalar)
+		result, flags := s.compareLanes(s.imm8()&7, shape, reg.XMM[modrm.RegIndex], src)
+		s.signal(flags)
+		reg.XMM[modrm.RegIndex] = result
+	}
+}
+
+// compareLanes compares the lanes of shape of a and b, keeping the other lanes of a
+func (s *SSE) compareLanes(predicate uint8, shape vecShape, a XMM, b XMM) (XMM, uint16) {
+	var flags uint16
+	for i := uint(0); i < shape.count(); i++ {
+		x, xFlags := s.fromLane(a.lane(i, shape.width), shape.width)
+		y, yFlags := s.fromLane(b.lane(i, shape.width), shape.width)
+		holds, f := comparePredicate(predicate, x, y)
+		var v uint64
+		if holds {
+			v = ^uint64(0)
+		}
+		a.setLane(i, shape.width, v)
+		flags |= xFlags | yFlags | f
+	}
+	return a, flags
+}
+
+// Comis COMISS, COMISD, UCOMISS and UCOMISD xmm, xmm/m (0F 2E, 2F): ZF, PF and CF from the
+// order of the low lanes, OF, SF and AF cleared. COMIS raises IE for QNaN operands too.
+func (s *SSE) Comis(width uint, quiet bool) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(floatFeature(width))
+		src := s.read(&modrm, uint32(width/8), false)
+		s.compareFlags(width, quiet, reg.XMM[modrm.RegIndex].lane(0, width), src.lane(0, width))
+	}
+}
+
+// compareFlags sets EFLAGS from the order of the lanes a and b of width bits
+func (s *SSE) compareFlags(width uint, quiet bool, a uint64, b uint64) {
+	reg := s.reg
+	x, xFlags := s.fromLane(a, width)
+	y, yFlags := s.fromLane(b, width)
+	order, flags := compare80(x, y, quiet)
+	s.signal(xFlags | yFlags | flags)
+	var eflags uint32
+	switch order {
+	case cmpUnordered:
+		eflags = FlagZF | FlagPF | FlagCF
+	case cmpLess:
+		eflags = FlagCF
+	case cmpEqual:
+		eflags = FlagZF
+	}
+	reg.setEFlags(eflags, FlagZF|FlagPF|FlagCF|FlagOF|FlagSF|FlagAF)
+}
+
+// Operands of the conversions
+const (
+	operandXMM = iota // xmm or memory
+	operandMM         // mm or memory
+	operandGPR        // r32, or r/m32 as source; r64 and r/m64 with REX.W
+)
+
+// Conversion kinds
+const (
+	cvtFloat    = iota // between single and double precision
+	cvtFromInt         // from signed dwords
+	cvtToInt           // to signed dwords, rounded with MXCSR.RC
+	cvtTruncate        // to signed dwords, rounded toward zero
+)
+
+// conversion a CVT instruction: count lanes of width from, read from a memory operand of
+// size bytes, become lanes of width to. With merge the other lanes of an XMM destination
+// are kept, else cleared.
+type conversion struct {
+	feature  uint32
+	src, dst int
+	size     uint32
+	count    uint
+	from, to uint
+	kind     int
+	merge    bool
+}
+
+var (
+	cvtpi2ps  = conversion{FeatureSSE, operandMM, operandXMM, 8, 2, 32, 32, cvtFromInt, true}
+	cvtpi2pd  = conversion{FeatureSSE2, operandMM, operandXMM, 8, 2, 32, 64, cvtFromInt, false}
+	cvtsi2ss  = conversion{FeatureSSE, operandGPR, operandXMM, 4, 1, 32, 32, cvtFromInt, true}
+	cvtsi2sd  = conversion{FeatureSSE2, operandGPR, operandXMM, 4, 1, 32, 64, cvtFromInt, true}
+	cvttps2pi = conversion{FeatureSSE, operandXMM, operandMM, 8, 2, 32, 32, cvtTruncate, false}
+	cvttpd2pi = conversion{FeatureSSE2, operandXMM, operandMM, 16, 2, 64, 32, cvtTruncate, false}
+	cvttss2si = conversion{FeatureSSE, operandXMM, operandGPR, 4, 1, 32, 32, cvtTruncate, false}
+	cvttsd2si = conversion{FeatureSSE2, operandXMM, operandGPR, 8, 1, 64, 32, cvtTruncate, false}
+	cvtps2pi  = conversion{FeatureSSE, operandXMM, operandMM, 8, 2, 32, 32, cvtToInt, false}
+	cvtpd2pi  = conversion{FeatureSSE2, operandXMM, operandMM, 16, 2, 64, 32, cvtToInt, false}
+	cvtss2si  = conversion{FeatureSSE, operandXMM, operandGPR, 4, 1, 32, 32, cvtToInt, false}
+	cvtsd2si  = conversion{FeatureSSE2, operandXMM, operandGPR, 8, 1, 64, 32, cvtToInt, false}
+	cvtps2pd  = conversion{FeatureSSE2, operandXMM, operandXMM, 8, 2, 32, 64, cvtFloat, false}
+	cvtpd2ps  = conversion{FeatureSSE2, operandXMM, operandXMM, 16, 2, 64, 32, cvtFloat, false}
+	cvtss2sd  = conversion{FeatureSSE2, operandXMM, operandXMM, 4, 1, 32, 64, cvtFloat, true}
+	cvtsd2ss  = conversion{FeatureSSE2, operandXMM, operandXMM, 8, 1, 64, 32, cvtFloat, true}
+	cvtdq2ps  = conversion{FeatureSSE2, operandXMM, operandXMM, 16, 4, 32, 32, cvtFromInt, false}
+	cvtps2dq  = conversion{FeatureSSE2, operandXMM, operandXMM, 16, 4, 32, 32, cvtToInt, false}
+	cvttps2dq = conversion{FeatureSSE2, operandXMM, operandXMM, 16, 4, 32, 32, cvtTruncate, false}
+	cvtdq2pd  = conversion{FeatureSSE2, operandXMM, operandXMM, 8, 2, 32, 64, cvtFromInt, false}
+	cvtpd2dq  = conversion{FeatureSSE2, operandXMM, operandXMM, 16, 2, 64, 32, cvtToInt, false}
+	cvttpd2dq = conversion{FeatureSSE2, operandXMM, operandXMM, 16, 2, 64, 32, cvtTruncate, false}
+)
+
+// convertLane converts one lane; integers out of range give the integer indefinite with IE
+func (s *SSE) convertLane(c conversion, v uint64) (uint64, uint16) {
+	if c.kind == cvtFromInt {
+		return s.toLane(float80FromInt(signExtend(v, c.from)), c.to)
+	}
+	x, flags := s.fromLane(v, c.from)
+	if c.kind == cvtFloat {
+		bits, f := s.toLane(x, c.to)
+		return bits, flags | f
+	}
+	n, f := x.toInt(c.to, s.rc(), c.kind == cvtTruncate)
+	return uint64(n) & laneMask(c.to), flags | f
+}
+
+// widen the conversion of the REX.W and VEX.W forms in 64-bit mode, whose general register
+// operand is r/m64 or r64
+func (c conversion) widen(modrm *ModRM) conversion {
+	if modrm.wide() {
+		switch {
+		case c.src == operandGPR:
+			c.from, c.size = 64, 8
+		case c.dst == operandGPR:
+			c.to = 64
+		}
+	}
+	return c
+}
+
+// Convert the CVT instructions (0F 2A, 2C, 2D, 5A, 5B, E6). Those with an MMX register
+// move the x87 stack to MMX.
+func (s *SSE) Convert(c conversion) func() {
+	return func() {
+		reg := s.reg
+		modrm := s.decode(c.feature)
+		c := c.widen(&modrm)
+		if c.dst == operandMM || c.src == operandMM && modrm.Mod == 3 {
+			fpuPending(reg)
+			reg.FPU.enterMMX()
+		}
+		var src XMM
+		switch {
+		case c.src == operandGPR:
+			src = XMM{modrm.GetRMW()}
+		case c.src == operandMM && modrm.Mod == 3:
+			src = XMM{reg.MM(modrm.Rm)}
+		default:
+			src = s.read(&modrm, c.size, c.size == 16)
+		}
+		wide, flags := s.convertLanes(c, c.count, YMM{src[0], src[1]})
+		result := wide.half(0)
+		s.signal(flags)
+		switch {
+		case c.dst == operandGPR:
+			modrm.SetRW(result[0])
+		case c.dst == operandMM:
+			reg.SetMM(modrm.RegIndex, result[0])
+		case c.merge:
+			for i := uint(0); i < c.count; i++ {
+				reg.XMM[modrm.RegIndex].setLane(i, c.to, result.lane(i, c.to))
+			}
+		default:
+			reg.XMM[modrm.RegIndex] = result
+		}
+	}
+}
+
+// convertLanes converts count lanes of src
+func (s *SSE) convertLanes(c conversion, count uint, src YMM) (YMM, uint16) {
+	var result YMM
+	var flags uint16
+	for i := uint(0); i < count; i++ {
+		v, f := s.convertLane(c, src.lane(i, c.from))
+		result.setLane(i, c.to, v)
+		flags |= f
+	}
+	return result, flags
+}
@@ -31,7 +31,7 @@ func (s *Stack) Push32Imm32() {
 func (s *Stack) Push32Imm8() {
 	reg := s.reg
 	mem := s.mem
-	value := mem.GetCode8(1)
+	value := mem.GetSignCode8(1)
 	mem.Push32(uint32(value))
 	reg.EIP += 2
 }
@@ -54,7 +54,7 @@ func (s *Stack) Push32ES() {
 func (s *Stack) Pop32ES() {
 	reg := s.reg
 	mem := s.mem
-	reg.ES = uint16(mem.Pop32())
+	loadSegment(reg, mem, SegES, uint16(mem.Pop32()))
 	reg.EIP += 1
 }
 
@@ -65,17 +65,6 @@ func (s *Stack) Push32CS() {
 	reg.EIP += 1
 }
 
-func (s *Stack) Pop32CS() {
-	reg := s.reg
-	mem := s.mem
-	reg.CS = uint16(mem.Pop32())
-	reg.EIP += 1
-}
-
-func (s *Stack) Code0Fb32() {
-	s.Pop32CS()
-}
-
 func (s *Stack) Push32SS() {
 	reg := s.reg
 	mem := s.mem
@@ -86,7 +75,7 @@ func (s *Stack) Push32SS() {
 func (s *Stack) Pop32SS() {
 	reg := s.reg
 	mem := s.mem
-	reg.SS = uint16(mem.Pop32())
+	loadSegment(reg, mem, SegSS, uint16(mem.Pop32()))
 	reg.EIP += 1
 }
 
@@ -100,7 +89,7 @@ func (s *Stack) Push32DS() {
 func (s *Stack) Pop32DS() {
 	reg := s.reg
 	mem := s.mem
-	reg.DS = uint16(mem.Pop32())
+	loadSegment(reg, mem, SegDS, uint16(mem.Pop32()))
 	reg.EIP += 1
 }
 
@@ -114,7 +103,7 @@ func (s *Stack) Push16ES() {
 func (s *Stack) Pop16ES() {
 	reg := s.reg
 	mem := s.mem
-	reg.ES = mem.Pop16()
+	loadSegment(reg, mem, SegES, mem.Pop16())
 	reg.EIP += 1
 }
 
@@ -125,17 +114,6 @@ func (s *Stack) Push16CS() {
 	reg.EIP += 1
 }
 
-func (s *Stack) Pop16CS() {
-	reg := s.reg
-	mem := s.mem
-	reg.CS = mem.Pop16()
-	reg.EIP += 1
-}
-
-func (s *Stack) Code0F16() {
-	s.Pop16CS()
-}
-
 func (s *Stack) Push16SS() {
 	reg := s.reg
 	mem := s.mem
@@ -146,7 +124,7 @@ func (s *Stack) Push16SS() {
 func (s *Stack) Pop16SS() {
 	reg := s.reg
 	mem := s.mem
-	reg.SS = mem.Pop16()
+	loadSegment(reg, mem, SegSS, mem.Pop16())
 	reg.EIP += 1
 }
 
@@ -160,7 +138,7 @@ func (s *Stack) Push16DS() {
 func (s *Stack) Pop16DS() {
 	reg := s.reg
 	mem := s.mem
-	reg.DS = mem.Pop16()
+	loadSegment(reg, mem, SegDS, mem.Pop16())
 	reg.EIP += 1
 }
 
@@ -175,7 +153,7 @@ func (s *Stack) Push16Imm16() {
 func (s *Stack) Push16Imm8() {
 	reg := s.reg
 	mem := s.mem
-	value := mem.GetCode8(1)
+	value := mem.GetSignCode8(1)
 	mem.Push16(uint16(value))
 	reg.EIP += 2
 }
@@ -195,3 +173,213 @@ func (s *Stack) PopR16() {
 	reg.Set16ByIndex(regIndex, mem.Pop16())
 	reg.EIP += 1
 }
+
+func (s *Stack) Push32FS() {
+	reg := s.reg
+	mem := s.mem
+	mem.Push32(uint32(reg.FS))
+	reg.EIP += 1
+}
+
+func (s *Stack) Pop32FS() {
+	reg := s.reg
+	mem := s.mem
+	loadSegment(reg, mem, SegFS, uint16(mem.Pop32()))
+	reg.EIP += 1
+}
+
+func (s *Stack) Push32GS() {
+	reg := s.reg
+	mem := s.mem
+	mem.Push32(uint32(reg.GS))
+	reg.EIP += 1
+}
+
+func (s *Stack) Pop32GS() {
+	reg := s.reg
+	mem := s.mem
+	loadSegment(reg, mem, SegGS, uint16(mem.Pop32()))
+	reg.EIP += 1
+}
+
+func (s *Stack) Push16FS() {
+	reg := s.reg
+	mem := s.mem
+	mem.Push16(reg.FS)
+	reg.EIP += 1
+}
+
+func (s *Stack) Pop16FS() {
+	reg := s.reg
+	mem := s.mem
+	loadSegment(reg, mem, SegFS, mem.Pop16())
+	reg.EIP += 1
+}
+
+func (s *Stack) Push16GS() {
+	reg := s.reg
+	mem := s.mem
+	mem.Push16(reg.GS)
+	reg.EIP += 1
+}
+
+func (s *Stack) Pop16GS() {
+	reg := s.reg
+	mem := s.mem
+	loadSegment(reg, mem, SegGS, mem.Pop16())
+	reg.EIP += 1
+}
+
+// Pushf16 PUSHF (9C). A virtual-8086 task below IOPL 3 traps to the monitor with #GP(0),
+// unless VME is on: VIF is then pushed as IF, with IOPL 3.
+func (s *Stack) Pushf16() {
+	reg := s.reg
+	mem := s.mem
+	flags := reg.EFlags
+	if reg.IsV86() && reg.IOPL() < 3 {
+		if reg.CR4&CR4VME == 0 {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		flags = flags&^FlagIF | (flags&FlagVIF)>>10 | FlagIOPL
+	}
+	mem.Push16(uint16(flags))
+	reg.EIP += 1
+}
+
+// Pushf32 PUSHFD (9C): VM and RF are pushed clear
+func (s *Stack) Pushf32() {
+	reg := s.reg
+	mem := s.mem
+	if reg.IsV86() && reg.IOPL() < 3 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	mem.Push32(reg.EFlags &^ (FlagVM | FlagRF))
+	reg.EIP += 1
+}
+
+// Popf16 POPF (9D)
+func (s *Stack) Popf16() {
+	s.popf(2)
+}
+
+// Popf32 POPFD (9D)
+func (s *Stack) Popf32() {
+	s.popf(4)
+}
+
+// popf IOPL is only loaded at CPL 0 and IF when CPL <= IOPL; VM, VIF and VIP never are.
+// A virtual-8086 task below IOPL 3 traps to the monitor, unless VME lets a 16-bit POPF set
+// VIF from the popped IF.
+func (s *Stack) popf(size uint32) {
+	reg := s.reg
+	mem := s.mem
+	flags := readStack(reg, mem, 0, size)
+	mask := uint32(flagsMask &^ (FlagVM | FlagVIF | FlagVIP))
+	if size == 2 {
+		mask &= 0xffff
+	}
+	if reg.IsV86() {
+		mask &^= FlagIOPL
+		if reg.IOPL() < 3 {
+			if reg.CR4&CR4VME == 0 || size != 2 {
+				raiseWithCode(ExceptionGP, 0)
+			}
+			if flags&FlagTF != 0 || flags&FlagIF != 0 && reg.IsVIP() {
+				raiseWithCode(ExceptionGP, 0)
+			}
+			mask &^= FlagIF
+			reg.EFlags = reg.EFlags&^FlagVIF | (flags&FlagIF)<<10
+		}
+	} else if !reg.IsRealMode() {
+		if reg.CPL() > 0 {
+			mask &^= FlagIOPL
+		}
+		if reg.CPL() > reg.IOPL() {
+			mask &^= FlagIF
+		}
+	}
+	reg.SetStackPointer(reg.StackPointer() + size)
+	reg.setEFlags(flags, mask)
+	reg.EIP += 1
+}
+
+// readStack reads size bytes at SS:ESP+offset without popping them
+func readStack(reg *X86Registers, mem IMemory, offset uint32, size uint32) uint32 {
+	sp := (reg.StackPointer() + offset) & reg.stackMask()
+	address := reg.segmentAddress(SegSS, sp, size, false)
+	if size == 2 {
+		return uint32(mem.Read16(address))
+	}
+	return mem.Read32(address)
+}
+
+// keepStack restores ESP when the instruction faults part way through its pushes
+func keepStack(reg *X86Registers) func() {
+	esp := reg.ESP
+	return func() {
+		if r := recover(); r != nil {
+			reg.ESP = esp
+			panic(r)
+		}
+	}
+}
+
+// popRM POP r/m (8F /0): ESP is incremented before the address of the operand is computed
+func (s *Stack) popRM(width uint) func() {
+	return func() {
+		reg := s.reg
+		mem := s.mem
+		reg.EIP += 1
+		modrm := NewModRM(reg, mem)
+		if modrm.Opcode != 0 {
+			raise(ExceptionUD)
+		}
+		size := uint32(width / 8)
+		value := readStack(reg, mem, 0, size)
+		defer keepStack(reg)()
+		reg.SetStackPointer(reg.StackPointer() + size)
+		setRM(&modrm, width, value)
+	}
+}
+
+// pusha PUSHA and PUSHAD (60): eAX, eCX, eDX, eBX, the original eSP, eBP, eSI and eDI
+func (s *Stack) pusha(width uint) func() {
+	return func() {
+		reg := s.reg
+		mem := s.mem
+		defer keepStack(reg)()
+		sp := reg.ESP
+		for index := uint8(0); index < 8; index++ {
+			value := reg.GetByIndex(index)
+			if index == 4 {
+				value = sp
+			}
+			if width == 16 {
+				mem.Push16(uint16(value))
+			} else {
+				mem.Push32(value)
+			}
+		}
+		reg.EIP += 1
+	}
+}
+
+// popa POPA and POPAD (61): the saved eSP is skipped
+func (s *Stack) popa(width uint) func() {
+	return func() {
+		reg := s.reg
+		mem := s.mem
+		size := uint32(width / 8)
+		var values [8]uint32
+		for i := range values {
+			values[7-i] = readStack(reg, mem, uint32(i)*size, size)
+		}
+		for index := uint8(0); index < 8; index++ {
+			if index != 4 {
+				reg.setRegister(index, width, values[index])
+			}
+		}
+		reg.SetStackPointer(reg.StackPointer() + 8*size)
+		reg.EIP += 1
+	}
+}
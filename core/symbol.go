@@ -0,0 +1,58 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+)
+
+// symbol a function or an object of a program, size bytes long at address
+type symbol struct {
+	name    string
+	address uint64
+	size    uint64
+}
+
+// symbolTable the symbols of a program sorted by address, naming the code addresses in the
+// trace, the exceptions and the register dump
+type symbolTable struct {
+	symbols []symbol
+}
+
+func newSymbolTable(symbols []symbol) *symbolTable {
+	sort.SliceStable(symbols, func(i, j int) bool { return symbols[i].address < symbols[j].address })
+	return &symbolTable{symbols: symbols}
+}
+
+// lookup the symbol containing address, as name+0x12; false when address follows no symbol
+// or lies past the end of the symbol before it
+func (t *symbolTable) lookup(address uint64) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	i := sort.Search(len(t.symbols), func(i int) bool { return t.symbols[i].address > address }) - 1
+	if i < 0 {
+		return "", false
+	}
+	s := t.symbols[i]
+	offset := address - s.address
+	if s.size != 0 && offset >= s.size {
+		return "", false
+	}
+	if offset == 0 {
+		return s.name, true
+	}
+	return fmt.Sprintf("%s+0x%x", s.name, offset), true
+}
+
+// codeSymbol the symbol of the code at CS:ip as " <name+0x12>", empty without one
+func (r *X86Registers) codeSymbol(ip uint64) string {
+	address := ip
+	if !r.mode64 {
+		address = uint64(r.Segments[SegCS].Base + uint32(ip))
+	}
+	name, ok := r.symbols.lookup(address)
+	if !ok {
+		return ""
+	}
+	return " <" + name + ">"
+}
@@ -0,0 +1,500 @@
+package core
+
+// CR0 bits
+const (
+	CR0PE = 1 << 0  // Protection Enable
+	CR0MP = 1 << 1  // Monitor Coprocessor
+	CR0EM = 1 << 2  // Emulation
+	CR0TS = 1 << 3  // Task Switched
+	CR0ET = 1 << 4  // Extension Type
+	CR0NE = 1 << 5  // Numeric Error
+	CR0WP = 1 << 16 // Write Protect
+	CR0AM = 1 << 18 // Alignment Mask
+	CR0NW = 1 << 29 // Not Write-through
+	CR0CD = 1 << 30 // Cache Disable
+	CR0PG = 1 << 31 // Paging
+)
+
+// CR4 bits
+const (
+	CR4VME        = 1 << 0  // Virtual-8086 Mode Extensions
+	CR4PVI        = 1 << 1  // Protected-Mode Virtual Interrupts
+	CR4TSD        = 1 << 2  // Time Stamp Disable
+	CR4DE         = 1 << 3  // Debugging Extensions
+	CR4PSE        = 1 << 4  // Page Size Extensions
+	CR4PAE        = 1 << 5  // Physical Address Extension
+	CR4MCE        = 1 << 6  // Machine-Check Enable
+	CR4PGE        = 1 << 7  // Page Global Enable
+	CR4PCE        = 1 << 8  // Performance-Monitoring Counter Enable
+	CR4OSFXSR     = 1 << 9  // OS support for FXSAVE and FXRSTOR
+	CR4OSXMMEXCPT = 1 << 10 // OS support for unmasked SIMD floating-point exceptions
+	CR4OSXSAVE    = 1 << 18 // XSAVE and processor extended states enable
+)
+
+// IA32_EFER bits
+const (
+	EFERSCE = 1 << 0  // SYSCALL Enable
+	EFERLME = 1 << 8  // Long Mode Enable
+	EFERLMA = 1 << 10 // Long Mode Active
+	EFERNXE = 1 << 11 // No-Execute Enable
+)
+
+type System struct {
+	reg    *X86Registers
+	mem    IMemory
+	halted bool
+}
+
+func NewSystem(reg *X86Registers, memory IMemory) *System {
+	return &System{
+		reg: reg,
+		mem: memory,
+	}
+}
+
+func (s *System) IsHalted() bool {
+	return s.halted
+}
+
+// checkPrivileged raises #GP(0) when a privileged instruction runs outside ring 0
+func (s *System) checkPrivileged() {
+	reg := s.reg
+	if reg.CPL() != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+}
+
+// checkIOPL CLI and STI need CPL <= IOPL in protected mode, IOPL 3 in virtual-8086 mode
+func (s *System) checkIOPL() {
+	reg := s.reg
+	if !reg.IsRealMode() && reg.CPL() > reg.IOPL() {
+		raiseWithCode(ExceptionGP, 0)
+	}
+}
+
+func (s *System) Hlt() {
+	reg := s.reg
+	s.checkPrivileged()
+	reg.EIP += 1
+	s.halted = true
+}
+
+// virtualInterrupts CLI and STI act on VIF instead of IF: IOPL below 3 in virtual-8086 mode
+// with CR4.VME, or at CPL 3 with CR4.PVI
+func (s *System) virtualInterrupts() bool {
+	reg := s.reg
+	if reg.IsRealMode() || reg.IOPL() == 3 {
+		return false
+	}
+	if reg.IsVM() {
+		return reg.CR4&CR4VME != 0
+	}
+	return reg.CPL() == 3 && reg.CR4&CR4PVI != 0
+}
+
+func (s *System) Cli() {
+	reg := s.reg
+	if s.virtualInterrupts() {
+		reg.RemoveVIF()
+		reg.EIP += 1
+		return
+	}
+	s.checkIOPL()
+	reg.RemoveIF()
+	reg.EIP += 1
+}
+
+// Sti STI: with virtual interrupts a pending one (VIP) traps to the monitor with #GP(0)
+func (s *System) Sti() {
+	reg := s.reg
+	if s.virtualInterrupts() {
+		if reg.IsVIP() {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		reg.SetVIF()
+		reg.EIP += 1
+		return
+	}
+	s.checkIOPL()
+	reg.SetIF()
+	reg.EIP += 1
+}
+
+func (s *System) Clts() {
+	reg := s.reg
+	s.checkPrivileged()
+	reg.CR0 &^= CR0TS
+	reg.EIP += 1
+}
+
+// Code0F00 group 6: SLDT, STR, LLDT, LTR, VERR, VERW; LLDT and LTR are privileged
+func (s *System) Code0F00() {
+	reg := s.reg
+	reg.EIP += 1
+	if reg.realSegments() {
+		raise(ExceptionUD)
+	}
+	modrm := NewModRM(s.reg, s.mem)
+	switch modrm.Opcode {
+	case 0:
+		s.sldt(&modrm)
+	case 1:
+		s.str(&modrm)
+	case 2:
+		s.checkPrivileged()
+		s.lldt(&modrm)
+	case 3:
+		s.checkPrivileged()
+		s.ltr(&modrm)
+	case 4:
+		s.verify(&modrm, false)
+	case 5:
+		s.verify(&modrm, true)
+	default:
+		raise(ExceptionUD)
+	}
+}
+
+// Code0F01b16 group 7 with 16-bit operand size: LGDT and LIDT load a 24-bit base
+func (s *System) Code0F01b16() {
+	s.code0F01(0x00ffffff)
+}
+
+// Code0F01b32 group 7 with 32-bit operand size
+func (s *System) Code0F01b32() {
+	s.code0F01(0xffffffff)
+}
+
+func (s *System) code0F01(baseMask uint32) {
+	reg := s.reg
+	reg.EIP += 1
+	modrm := NewModRM(s.reg, s.mem)
+	switch modrm.Opcode {
+	case 0:
+		s.storeTable(&modrm, &reg.GDTR)
+	case 1:
+		s.storeTable(&modrm, &reg.IDTR)
+	case 2:
+		if modrm.Mod == 3 {
+			// register forms: XGETBV is 0F 01 D0, XSETBV 0F 01 D1
+			switch modrm.Rm {
+			case 0:
+				s.xgetbv()
+			case 1:
+				s.xsetbv()
+			default:
+				raise(ExceptionUD)
+			}
+			return
+		}
+		s.checkPrivileged()
+		s.loadTable(&modrm, &reg.GDTR, baseMask)
+	case 3:
+		s.checkPrivileged()
+		s.loadTable(&modrm, &reg.IDTR, baseMask)
+	case 4:
+		modrm.SetRM16(uint16(reg.CR0))
+	case 6:
+		s.checkPrivileged()
+		s.lmsw(modrm.GetRM16())
+	case 7:
+		if modrm.Mod == 3 {
+			// register forms: RDTSCP is 0F 01 F9
+			if modrm.Rm != 1 {
+				raise(ExceptionUD)
+			}
+			s.rdtscp()
+			return
+		}
+		s.checkPrivileged()
+		s.invlpg(&modrm)
+	default:
+		raise(ExceptionUD)
+	}
+}
+
+func (s *System) storeTable(modrm *ModRM, table *DescriptorTable) {
+	if modrm.Mod == 3 {
+		raise(ExceptionUD)
+	}
+	mem := s.mem
+	address := modrm.calcAddress(6, true)
+	mem.Write16(address, table.Limit)
+	mem.Write32(address+2, table.Base)
+}
+
+func (s *System) loadTable(modrm *ModRM, table *DescriptorTable, baseMask uint32) {
+	if modrm.Mod == 3 {
+		raise(ExceptionUD)
+	}
+	mem := s.mem
+	address := modrm.calcAddress(6, false)
+	table.Limit = mem.Read16(address)
+	table.Base = mem.Read32(address+2) & baseMask
+}
+
+// lmsw loads PE, MP, EM and TS; PE can be set but not cleared
+func (s *System) lmsw(value uint16) {
+	reg := s.reg
+	mask := uint64(CR0PE | CR0MP | CR0EM | CR0TS)
+	cr0 := reg.CR0&^(mask&^CR0PE) | uint64(value)&mask
+	reg.CR0 = cr0
+}
+
+// invlpg invalidates the TLB entry of the page containing the memory operand
+func (s *System) invlpg(modrm *ModRM) {
+	reg := s.reg
+	mem := s.mem
+	if modrm.Mod == 3 {
+		raise(ExceptionUD)
+	}
+	offset, segment := modrm.calcOffset()
+	mem.InvalidatePage(uint64(reg.SegmentBase(reg.dataSegment(segment)) + offset))
+}
+
+func (s *System) sldt(modrm *ModRM) {
+	reg := s.reg
+	if modrm.Mod == 3 && reg.IsCode32() != reg.opOverride {
+		modrm.SetRM32(uint32(reg.LDTR))
+		return
+	}
+	modrm.SetRM16(reg.LDTR)
+}
+
+func (s *System) str(modrm *ModRM) {
+	reg := s.reg
+	if modrm.Mod == 3 && reg.IsCode32() != reg.opOverride {
+		modrm.SetRM32(uint32(reg.TR))
+		return
+	}
+	modrm.SetRM16(reg.TR)
+}
+
+func (s *System) ltr(modrm *ModRM) {
+	reg := s.reg
+	mem := s.mem
+	loadTR(reg, mem, modrm.GetRM16())
+}
+
+func (s *System) lldt(modrm *ModRM) {
+	reg := s.reg
+	mem := s.mem
+	loadLDT(reg, mem, modrm.GetRM16())
+}
+
+// verify VERR/VERW: ZF is set when the segment can be read or written
+func (s *System) verify(modrm *ModRM, write bool) {
+	s.verifySelector(modrm.GetRM16(), write)
+}
+
+func (s *System) verifySelector(selector uint16, write bool) {
+	reg := s.reg
+	mem := s.mem
+	reg.RemoveZF()
+	if selector&^3 == 0 {
+		return
+	}
+	base, limit := reg.GDTR.Base, uint32(reg.GDTR.Limit)
+	if selector&4 != 0 {
+		base, limit = reg.LDTCache.Base, reg.LDTCache.Limit
+	}
+	if uint32(selector&^7)+7 > limit {
+		return
+	}
+	desc := readDescriptor(mem, base+uint32(selector&^7))
+	if (write && desc.IsWritable()) || (!write && desc.IsReadable()) {
+		reg.SetZF()
+	}
+}
+
+// MovR32CR MOV r32, CRn (0F 20): the mod field is ignored, the operand is always a register
+func (s *System) MovR32CR() {
+	reg := s.reg
+	s.checkPrivileged()
+	reg.EIP += 1
+	modrm := NewModRM(s.reg, s.mem)
+	reg.SetByIndex(modrm.Rm, uint32(s.readCR(modrm.RegIndex)))
+}
+
+func (s *System) readCR(index uint8) uint64 {
+	reg := s.reg
+	switch index {
+	case 0:
+		return reg.CR0
+	case 2:
+		return reg.CR2
+	case 3:
+		return reg.CR3
+	case 4:
+		return reg.CR4
+	}
+	raise(ExceptionUD)
+	return 0
+}
+
+// MovCRR32 MOV CRn, r32 (0F 22)
+func (s *System) MovCRR32() {
+	reg := s.reg
+	s.checkPrivileged()
+	reg.EIP += 1
+	modrm := NewModRM(s.reg, s.mem)
+	s.writeCR(modrm.RegIndex, uint64(reg.GetByIndex(modrm.Rm)))
+}
+
+// writeCR loads a control register. Turning paging on with EFER.LME set activates long
+// mode, which needs CR4.PAE; turning it off deactivates long mode, but not from 64-bit code.
+func (s *System) writeCR(index uint8, value uint64) {
+	reg := s.reg
+	switch index {
+	case 0:
+		if value&CR0PG != 0 && value&CR0PE == 0 {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		if value&CR0NW != 0 && value&CR0CD == 0 {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		if value>>32 != 0 {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		enable := value&CR0PG != 0 && reg.CR0&CR0PG == 0
+		disable := value&CR0PG == 0 && reg.CR0&CR0PG != 0
+		switch {
+		case enable && reg.IA32Efer&EFERLME != 0:
+			if reg.CR4&CR4PAE == 0 {
+				raiseWithCode(ExceptionGP, 0)
+			}
+			reg.IA32Efer |= EFERLMA
+		case disable && reg.IA32Efer&EFERLMA != 0:
+			if reg.Is64() {
+				raiseWithCode(ExceptionGP, 0)
+			}
+			reg.IA32Efer &^= EFERLMA
+		}
+		if (reg.CR0^value)&(CR0PG|CR0WP|CR0PE) != 0 {
+			s.mem.FlushTLB(false)
+		}
+		reg.CR0 = value | CR0ET
+	case 2:
+		reg.CR2 = value
+	case 3:
+		reg.CR3 = value
+		s.mem.FlushTLB(reg.CR4&CR4PGE != 0)
+	case 4:
+		if value&CR4OSXSAVE != 0 && reg.features().Leaf1ECX&FeatureXSAVE == 0 {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		if value&CR4PAE == 0 && reg.IA32Efer&EFERLMA != 0 {
+			raiseWithCode(ExceptionGP, 0)
+		}
+		if (reg.CR4^value)&(CR4PSE|CR4PGE|CR4PAE) != 0 {
+			s.mem.FlushTLB(false)
+		}
+		reg.CR4 = value
+	default:
+		raise(ExceptionUD)
+	}
+}
+
+// debugRegister maps the DR number of MOV DRn: DR4 and DR5 alias DR6 and DR7 unless CR4.DE
+// is set, then they are invalid. With DR7.GD set the access raises a #DB fault instead.
+func (s *System) debugRegister(index uint8) *uint32 {
+	reg := s.reg
+	if index == 4 || index == 5 {
+		if reg.CR4&CR4DE != 0 {
+			raise(ExceptionUD)
+		}
+		index += 2
+	}
+	if reg.DR7&DR7GD != 0 {
+		reg.DR7 &^= DR7GD
+		reg.DR6 |= DR6BD
+		raise(ExceptionDB)
+	}
+	switch index {
+	case 6:
+		return &reg.DR6
+	case 7:
+		return &reg.DR7
+	}
+	return &reg.DR[index]
+}
+
+// MovR32DR MOV r32, DRn (0F 21): the mod field is ignored, the operand is always a register
+func (s *System) MovR32DR() {
+	reg := s.reg
+	s.checkPrivileged()
+	reg.EIP += 1
+	modrm := NewModRM(s.reg, s.mem)
+	reg.SetByIndex(modrm.Rm, *s.debugRegister(modrm.RegIndex))
+}
+
+// MovDRR32 MOV DRn, r32 (0F 23)
+func (s *System) MovDRR32() {
+	reg := s.reg
+	s.checkPrivileged()
+	reg.EIP += 1
+	modrm := NewModRM(s.reg, s.mem)
+	s.writeDR(modrm.RegIndex, reg.GetByIndex(modrm.Rm))
+}
+
+func (s *System) writeDR(index uint8, value uint32) {
+	reg := s.reg
+	dr := s.debugRegister(index)
+	switch dr {
+	case &reg.DR6:
+		value = value&^dr6Reserved | dr6Reserved
+	case &reg.DR7:
+		value = value&dr7Mask | dr7Reserved
+	}
+	*dr = value
+}
+
+// Sysenter SYSENTER (0F 34): fast call to the flat ring 0 code at IA32_SYSENTER_CS:EIP on
+// the stack IA32_SYSENTER_ESP, SS being the next descriptor. In long mode the code segment
+// is 64-bit.
+func (s *System) Sysenter() {
+	reg := s.reg
+	if reg.features().Leaf1EDX&FeatureSEP == 0 {
+		raise(ExceptionUD)
+	}
+	if p := reg.personality; p != nil && p.systemCall(0x34) {
+		return
+	}
+	selector := uint16(reg.msrs.lookup(MSRSysenterCS).Read(reg))
+	if reg.IsRealMode() || selector&^3 == 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	long := reg.IA32Efer&EFERLMA != 0
+	reg.EFlags &^= FlagVM | FlagIF | FlagRF
+	reg.CS = selector &^ 3
+	reg.Segments[SegCS] = flatCode(0, long)
+	reg.SS = selector&^3 + 8
+	reg.Segments[SegSS] = flatData(0)
+	esp := reg.msrs.lookup(MSRSysenterESP).Read(reg)
+	eip := reg.msrs.lookup(MSRSysenterEIP).Read(reg)
+	reg.ESP, reg.EIP = uint32(esp), uint32(eip)
+	if long {
+		reg.syncMode()
+		reg.X64.RSP, reg.X64.RIP = esp, eip
+	}
+}
+
+// Sysexit SYSEXIT (0F 35) at CPL 0: back to the flat ring 3 code at IA32_SYSENTER_CS+16:EDX
+// with ESP = ECX, SS being IA32_SYSENTER_CS+24
+func (s *System) Sysexit() {
+	reg := s.reg
+	if reg.features().Leaf1EDX&FeatureSEP == 0 {
+		raise(ExceptionUD)
+	}
+	selector := uint16(reg.msrs.lookup(MSRSysenterCS).Read(reg))
+	if reg.IsRealMode() || selector&^3 == 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	s.checkPrivileged()
+	reg.CS = selector&^3 + 16 | 3
+	reg.Segments[SegCS] = flatCode(3, false)
+	reg.SS = selector&^3 + 24 | 3
+	reg.Segments[SegSS] = flatData(3)
+	reg.ESP = reg.ECX
+	reg.EIP = reg.EDX
+}
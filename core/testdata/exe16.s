@@ -0,0 +1,102 @@
+# exe16: a DOS MZ executable, its header and relocation table written out here. The code,
+# far code and data are separate segments and the stack lies in the minimum allocation after
+# the image; the loader relocates the segment values the table points to. It exits with the
+# number of the first failing check, 0 when all pass.
+#
+#   as --32 -o exe16.o exe16.s
+#   ld -m elf_i386 -Ttext 0 --oformat binary -s -o exe16.exe exe16.o
+
+.code16
+.text
+.globl _start
+header:
+	.ascii "MZ"
+	.word (end - header) % 512		# bytes in the last page
+	.word (end - header + 511) / 512	# pages
+	.word (relocations_end - relocations) / 4
+	.word (image - header) / 16		# header paragraphs
+	.word 0x10				# minimum paragraphs after the image, the stack
+	.word 0xffff				# maximum
+	.word (end - image) / 16		# SS
+	.word 0x100				# SP
+	.word 0					# checksum
+	.word _start - code			# IP
+	.word (code - image) / 16		# CS
+	.word relocations - header
+	.word 0					# overlay
+# offset and segment in the image of the words to relocate
+relocations:
+	.word data_segment + 1 - image, 0
+	.word far_pointer + 2 - data, (data - image) / 16
+	.word far_segment + 3 - image, 0
+relocations_end:
+
+	.balign 16
+image:
+	.ascii "image"
+
+	.balign 16
+code:
+_start:
+	# 1: DS from a relocated immediate
+	mov $1, %bp
+data_segment:
+	mov $(data - image) / 16, %ax
+	mov %ax, %ds
+	cmpw $0x1234, (magic - data)
+	jne fail
+
+	# 2: CS, DS and SS keep their distances in the image
+	mov $2, %bp
+	mov %cs, %ax
+	mov %ds, %bx
+	sub %ax, %bx
+	cmp $(data - code) / 16, %bx
+	jne fail
+	mov %ss, %bx
+	sub %ax, %bx
+	cmp $(end - code) / 16, %bx
+	jne fail
+	cmp $0x100, %sp
+	jne fail
+
+	# 3: ES is the PSP, 0x10 paragraphs below the image
+	mov $3, %bp
+	mov %es, %bx
+	sub %bx, %ax
+	cmp $0x10 + (code - image) / 16, %ax
+	jne fail
+
+	# 4: a far call through a relocated far pointer
+	mov $4, %bp
+	xor %dx, %dx
+	lcall *(far_pointer - data)
+	cmp $0x5678, %dx
+	jne fail
+
+	# 5: a far jump to a relocated immediate segment, which exits
+	mov $5, %bp
+far_segment:
+	ljmp $(far_code - image) / 16, $far_exit - far_code
+
+fail:
+	mov %bp, %ax
+	mov $0x4c, %ah
+	int $0x21
+
+	.balign 16
+far_code:
+far_procedure:
+	mov $0x5678, %dx
+	lret
+far_exit:
+	mov $0x4c00, %ax
+	int $0x21
+
+	.balign 16
+data:
+magic:       .word 0x1234
+far_pointer: .word far_procedure - far_code, (far_code - image) / 16
+
+	.balign 16
+end:
@@ -0,0 +1,155 @@
+# files16: a DOS .COM program going through the integer instructions of the 16-bit opcode
+# table and the INT 21h file services. It writes a file, reads it back, renames it to
+# FILES.OUT and exits with the number of the first failing check, 0 when all pass.
+#
+#   as --32 -o files16.o files16.s
+#   ld -m elf_i386 -Ttext 0x100 --oformat binary -s -o files16.com files16.o
+
+.code16
+.text
+.globl _start
+_start:
+	cld
+
+	# 1: arithmetic, group 1 and INC/DEC on 16-bit operands
+	mov $1, %bp
+	mov $0xfff0, %ax
+	add $0x20, %ax
+	jnc fail
+	adc $0, %ax
+	cmp $0x11, %ax
+	jne fail
+	inc %ax
+	dec %ax
+	jz fail
+	sub $0x12, %ax
+	jns fail
+	cmpw $0x1234, value
+	jne fail
+	orw $0x8000, value
+	cmpw $0x9234, value
+	jne fail
+
+	# 2: shifts, MUL, DIV and the 66-prefixed 32-bit forms
+	mov $2, %bp
+	mov $0x8421, %ax
+	rol $4, %ax
+	cmp $0x4218, %ax
+	jne fail
+	mov $1000, %ax
+	mov $300, %cx
+	mul %cx
+	cmp $0x0004, %dx
+	jne fail
+	cmp $0x93e0, %ax
+	jne fail
+	div %cx
+	cmp $1000, %ax
+	jne fail
+	mov $0x12345678, %eax
+	shr $16, %eax
+	cmp $0x1234, %ax
+	jne fail
+
+	# 3: strings, LOOP, MOVZX and SETcc with 16-bit addresses
+	mov $3, %bp
+	mov $name, %si
+	mov $copy, %di
+	mov $5, %cx
+	rep movsb
+	mov $name, %si
+	mov $copy, %di
+	mov $5, %cx
+	repe cmpsb
+	jne fail
+	xor %ax, %ax
+	mov $4, %cx
+1:	add %cx, %ax
+	loop 1b
+	cmp $10, %ax
+	jne fail
+	movzbw name, %bx
+	cmp $'F', %bx
+	jne fail
+	setz %al
+	cmp $1, %al
+	{disp16} jne fail
+
+	# 4: create, write and close FILES.TMP
+	mov $4, %bp
+	mov $0x3c, %ah
+	xor %cx, %cx
+	mov $name, %dx
+	int $0x21
+	jc fail
+	mov %ax, %bx
+	mov $0x40, %ah
+	mov $message_end-message, %cx
+	mov $message, %dx
+	int $0x21
+	jc fail
+	cmp $message_end-message, %ax
+	jne fail
+	mov $0x3e, %ah
+	int $0x21
+	jc fail
+
+	# 5: open it again, seek past the first word and read the rest back
+	mov $5, %bp
+	mov $0x3d00, %ax
+	mov $name, %dx
+	int $0x21
+	jc fail
+	mov %ax, %bx
+	mov $0x4200, %ax
+	xor %cx, %cx
+	mov $6, %dx
+	int $0x21
+	jc fail
+	cmp $6, %ax
+	jne fail
+	mov $0x3f, %ah
+	mov $64, %cx
+	mov $buffer, %dx
+	int $0x21
+	jc fail
+	cmp $message_end-message-6, %ax
+	jne fail
+	mov %ax, %cx
+	mov $message+6, %si
+	mov $buffer, %di
+	repe cmpsb
+	jne fail
+	mov $0x3e, %ah
+	int $0x21
+	jc fail
+
+	# 6: rename it, a missing file fails to open
+	mov $6, %bp
+	mov $0x56, %ah
+	mov $name, %dx
+	mov $renamed, %di
+	int $0x21
+	jc fail
+	mov $0x3d00, %ax
+	mov $name, %dx
+	int $0x21
+	jnc fail
+	cmp $2, %ax
+	jne fail
+
+	mov $0x4c00, %ax
+	int $0x21
+
+fail:
+	mov %bp, %ax
+	mov $0x4c, %ah
+	int $0x21
+
+name:    .asciz "FILES.TMP"
+renamed: .asciz "FILES.OUT"
+message: .ascii "hello, dos\r\n"
+message_end:
+value:   .word 0x1234
+copy:    .space 16
+buffer:  .space 64
@@ -0,0 +1,340 @@
+# integer32: the integer instructions of the 32-bit opcode tables, checked one after the
+# other. The program exits with the number of the first failing check, 0 when all pass.
+#
+#   as --32 -o integer32.o integer32.s
+#   ld -m elf_i386 -N -s -o integer32.elf integer32.o
+
+.code32
+.data
+text:   .ascii "hello, i386\0"
+copy:   .space 16
+digits: .byte 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39
+value:  .long 0x12345678
+slot:   .long 0
+far:    .long 0, 0
+jumps:  .long 0
+
+.text
+.globl _start
+_start:
+	cld
+
+	# 1: ADC and SBB (11-1D), group 1 (80, 81, 83)
+	mov $1, %ebp
+	mov $0xffffffff, %eax
+	add $1, %eax
+	adc $0, %eax
+	cmp $1, %eax
+	jne fail
+	stc
+	mov $5, %ebx
+	sbb %eax, %ebx
+	cmp $3, %ebx
+	jne fail
+	stc
+	mov $0x10, %cl
+	adcb $0x20, %cl
+	cmpb $0x31, %cl
+	jne fail
+	stc
+	mov $0x1000, %edx
+	sbbl $0x100, %edx
+	cmp $0xeff, %edx
+	jne fail
+
+	# 2: AND r/m8 (20), CMP (38-3A), TEST (84, 85, A8, A9)
+	mov $2, %ebp
+	mov $0xf0, %al
+	mov $0x3c, %bl
+	and %bl, %al
+	cmp %al, %bl
+	jbe fail
+	mov $value, %esi
+	cmp (%esi), %al
+	je fail
+	mov $0x78, %al
+	cmp (%esi), %al
+	jne fail
+	cmp %eax, (%esi)
+	je fail
+	test %bl, %al
+	jz fail
+	test %eax, %ebx
+	jz fail
+	test $0x80, %al
+	jnz fail
+	mov $0x10000, %eax
+	test $0x10000, %eax
+	jz fail
+
+	# 3: LEA (8D), MOV r/m8, imm8 (C6), moffs (A0-A3)
+	mov $3, %ebp
+	mov $0x100, %eax
+	mov $0x20, %ebx
+	lea 4(%eax,%ebx,2), %ecx
+	cmp $0x144, %ecx
+	jne fail
+	movb $0x7f, slot
+	cmpb $0x7f, slot
+	jne fail
+	mov value, %eax
+	cmp $0x12345678, %eax
+	jne fail
+	mov %eax, slot
+	movb value, %al
+	cmp $0x12345678, %eax
+	jne fail
+	mov $0xaa, %al
+	mov %al, slot
+	cmpl $0x123456aa, slot
+	jne fail
+
+	# 4: shifts and rotates (C0, C1, D0-D3)
+	mov $4, %ebp
+	mov $0x81, %al
+	shl $3, %al
+	cmp $0x08, %al
+	jne fail
+	mov $0x80000001, %eax
+	rol $4, %eax
+	cmp $0x18, %eax
+	jne fail
+	sar %eax
+	cmp $0x0c, %eax
+	jne fail
+	mov $0xf0000000, %eax
+	mov $4, %cl
+	sar %cl, %eax
+	cmp $0xff000000, %eax
+	jne fail
+	mov $0x81, %bl
+	shr %cl, %bl
+	cmp $0x08, %bl
+	jne fail
+	stc
+	mov $0x80, %dl
+	rcl %dl
+	jnc fail
+	cmp $0x01, %dl
+	jne fail
+
+	# 5: string instructions (A4-AF) with REP, REPE and REPNE
+	mov $5, %ebp
+	mov $text, %edi
+	mov $-1, %ecx
+	xor %al, %al
+	repne scasb
+	not %ecx
+	dec %ecx
+	cmp $11, %ecx
+	jne fail
+	mov $text, %esi
+	mov $copy, %edi
+	inc %ecx
+	rep movsb
+	mov $text, %esi
+	mov $copy, %edi
+	mov $12, %ecx
+	repe cmpsb
+	jne fail
+	test %ecx, %ecx
+	jne fail
+	mov $copy, %edi
+	mov $0x41424344, %eax
+	stosl
+	mov $copy, %esi
+	lodsb
+	cmp $0x44, %al
+	jne fail
+	lodsb
+	cmp $0x43, %al
+	jne fail
+	std
+	mov $copy+3, %esi
+	lodsb
+	cld
+	cmp $0x41, %al
+	jne fail
+	cmp $copy+2, %esi
+	jne fail
+
+	# 6: LOOP, LOOPE, LOOPNE and JECXZ (E0-E3)
+	mov $6, %ebp
+	xor %eax, %eax
+	mov $10, %ecx
+1:	add %ecx, %eax
+	loop 1b
+	cmp $55, %eax
+	jne fail
+	mov $5, %ecx
+	xor %eax, %eax
+2:	inc %eax
+	cmp $3, %eax
+	loopne 2b
+	cmp $3, %eax
+	jne fail
+	cmp $2, %ecx
+	jne fail
+	xor %ecx, %ecx
+	jecxz 3f
+	jmp fail
+3:
+
+	# 7: IMUL (69, 6B, 0F AF)
+	mov $7, %ebp
+	mov $-7, %ebx
+	imul $1000, %ebx, %ecx
+	cmp $-7000, %ecx
+	jne fail
+	imul $-3, %ecx, %edx
+	cmp $21000, %edx
+	jne fail
+	imul %ebx, %edx
+	cmp $-147000, %edx
+	jne fail
+	mov $0x10000, %eax
+	imul %eax, %eax
+	jno fail
+
+	# 8: MOVZX and MOVSX (0F B6, B7, BE, BF), SETcc (0F 90-9F), CMOVcc (0F 40-4F)
+	mov $8, %ebp
+	mov $0xfffe8081, %eax
+	movzbl %al, %ebx
+	cmp $0x81, %ebx
+	jne fail
+	movsbl %al, %ebx
+	cmp $0xffffff81, %ebx
+	jne fail
+	movzwl %ax, %ebx
+	cmp $0x8081, %ebx
+	jne fail
+	movswl slot, %ebx
+	cmp $0x56aa, %ebx
+	jne fail
+	mov $-1, %eax
+	cmp $1, %eax
+	setl %bl
+	setae %bh
+	setbe %cl
+	movzwl %bx, %ebx
+	cmp $0x0101, %ebx
+	jne fail
+	cmp $0, %cl
+	jne fail
+	mov $5, %eax
+	mov $9, %edx
+	cmp %edx, %eax
+	cmovg %edx, %eax
+	cmp $5, %eax
+	jne fail
+	cmp %edx, %eax
+	cmovl %edx, %eax
+	cmp $9, %eax
+	jne fail
+
+	# 9: near Jcc (0F 80-8F)
+	mov $9, %ebp
+	xor %eax, %eax
+	{disp32} jnz fail
+	{disp32} jz 4f
+	jmp fail
+4:
+
+	# 10: group 5 (FF), group 4 (FE), POP r/m (8F), PUSHA and POPA (60, 61)
+	mov $10, %ebp
+	mov $5f, %eax
+	call *%eax
+	cmp $0x5a, %edx
+	jne fail
+	movl $6f, jumps
+	jmp *jumps
+	jmp fail
+5:	mov $0x5a, %edx
+	ret
+6:	pushl value
+	popl slot
+	mov slot, %eax
+	cmp value, %eax
+	jne fail
+	movb $0xff, slot
+	incb slot
+	jnz fail
+	decl slot
+	cmpl $0x123455ff, slot
+	jne fail
+	mov $1, %eax
+	mov $2, %ebx
+	pusha
+	xor %eax, %eax
+	xor %ebx, %ebx
+	popa
+	cmp $1, %eax
+	jne fail
+	cmp $2, %ebx
+	jne fail
+
+	# 11: CDQ, CWDE, XLAT, SAHF, LAHF, BSWAP, ENTER, RET imm16, LDS
+	mov $11, %ebp
+	mov $0xff80, %eax
+	cwtl
+	cmp $0xffffff80, %eax
+	jne fail
+	cltd
+	cmp $-1, %edx
+	jne fail
+	mov $digits, %ebx
+	mov $7, %al
+	xlat
+	cmp $0x37, %al
+	jne fail
+	mov $0x4100, %eax
+	sahf
+	jnz fail
+	lahf
+	cmp $0x43, %ah
+	jne fail
+	mov $0x11223344, %eax
+	bswap %eax
+	cmp $0x44332211, %eax
+	jne fail
+	mov %esp, %esi
+	push $3
+	call 7f
+	cmp %esi, %esp
+	jne fail
+	cmp $3, %eax
+	jne fail
+	movl $0x1234, far
+	mov %ds, far+4
+	lds far, %ecx
+	cmp $0x1234, %ecx
+	jne fail
+
+	# 12: DAA and AAM
+	mov $12, %ebp
+	mov $0x19, %al
+	add $0x28, %al
+	daa
+	cmp $0x47, %al
+	jne fail
+	mov $47, %al
+	aam
+	cmp $7, %al
+	jne fail
+	cmp $4, %ah
+	jne fail
+
+	mov $1, %eax
+	xor %ebx, %ebx
+	int $0x80
+
+7:	enter $8, $0
+	mov 8(%ebp), %eax
+	movl $0, -4(%ebp)
+	leave
+	ret $4
+
+fail:
+	mov $1, %eax
+	mov %ebp, %ebx
+	int $0x80
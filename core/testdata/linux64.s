@@ -0,0 +1,146 @@
+# linux64: the start of a static x86-64 program and the system calls a C library makes
+# before main. The program exits with the number of the first failing check, 0 when all
+# pass, and leaves "hello, x86-64\n" in out.txt.
+#
+#   as --64 -o linux64.o linux64.s
+#   ld -N -s -o linux64.elf linux64.o
+
+.data
+tls:    .quad 0, 0
+name:   .asciz "out.txt"
+hello:  .ascii "hello, "
+arch:   .ascii "x86-64\n"
+iov:    .quad hello, 7, arch, 7
+ts:     .quad 0, 0
+random: .space 16
+
+.text
+.globl _start
+_start:
+	# 1: argc and argv on the initial stack
+	mov $1, %ebp
+	cmpq $2, (%rsp)
+	jne fail
+	mov 16(%rsp), %rsi
+	cmpl $0x677261, (%rsi) # "arg\0"
+	jne fail
+
+	# 2: the auxiliary vector after envp has AT_PAGESZ
+	mov $2, %ebp
+	lea 32(%rsp), %rbx
+1:	cmpq $0, (%rbx)
+	lea 8(%rbx), %rbx
+	jne 1b
+1:	mov (%rbx), %rax
+	test %rax, %rax
+	je fail
+	add $16, %rbx
+	cmp $6, %rax
+	jne 1b
+	cmpq $4096, -8(%rbx)
+	jne fail
+
+	# 3: arch_prctl sets and reads the FS base
+	mov $3, %ebp
+	lea tls(%rip), %rsi
+	mov %rsi, (%rsi)
+	mov $0x1002, %edi
+	mov $158, %eax
+	syscall
+	test %rax, %rax
+	jne fail
+	mov %fs:0, %rax
+	lea tls(%rip), %rsi
+	cmp %rsi, %rax
+	jne fail
+	mov $0x1003, %edi
+	lea tls+8(%rip), %rsi
+	mov $158, %eax
+	syscall
+	lea tls(%rip), %rsi
+	cmp %rsi, tls+8(%rip)
+	jne fail
+
+	# 4: brk grows the heap
+	mov $4, %ebp
+	xor %edi, %edi
+	mov $12, %eax
+	syscall
+	mov %rax, %rbx
+	lea 0x2000(%rax), %rdi
+	mov $12, %eax
+	syscall
+	lea 0x2000(%rbx), %rdx
+	cmp %rdx, %rax
+	jne fail
+	movq $1, 0x1ff8(%rbx)
+
+	# 5: an anonymous mmap above 4 GiB, made read-only by mprotect
+	mov $5, %ebp
+	xor %edi, %edi
+	mov $0x2000, %esi
+	mov $3, %edx
+	mov $0x22, %r10d
+	mov $-1, %r8
+	xor %r9d, %r9d
+	mov $9, %eax
+	syscall
+	mov %rax, %rbx
+	shr $32, %rax
+	je fail
+	movq $5, 0x1000(%rbx)
+	mov %rbx, %rdi
+	mov $0x2000, %esi
+	mov $1, %edx
+	mov $10, %eax
+	syscall
+	test %rax, %rax
+	jne fail
+	cmpq $5, 0x1000(%rbx)
+	jne fail
+
+	# 6: openat, writev and close
+	mov $6, %ebp
+	mov $-100, %rdi
+	lea name(%rip), %rsi
+	mov $0x241, %edx
+	mov $0644, %r10d
+	mov $257, %eax
+	syscall
+	test %rax, %rax
+	js fail
+	mov %rax, %rbx
+	mov %rax, %rdi
+	lea iov(%rip), %rsi
+	mov $2, %edx
+	mov $20, %eax
+	syscall
+	cmp $14, %rax
+	jne fail
+	mov %rbx, %rdi
+	mov $3, %eax
+	syscall
+	test %rax, %rax
+	jne fail
+
+	# 7: clock_gettime and getrandom
+	mov $7, %ebp
+	mov $1, %edi
+	lea ts(%rip), %rsi
+	mov $228, %eax
+	syscall
+	test %rax, %rax
+	jne fail
+	lea random(%rip), %rdi
+	mov $16, %esi
+	xor %edx, %edx
+	mov $318, %eax
+	syscall
+	cmp $16, %rax
+	jne fail
+
+	xor %ebp, %ebp
+fail:
+	mov %ebp, %edi
+	mov $231, %eax
+	syscall
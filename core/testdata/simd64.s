@@ -0,0 +1,150 @@
+# simd64: the x87, SSE and AVX instructions in 64-bit mode, with REX and VEX registers above
+# 7 and RIP-relative operands. The program exits with the number of the first failing
+# check, 0 when all pass.
+#
+#   as --64 -o simd64.o simd64.s
+#   ld -N -s -o simd64.elf simd64.o
+
+.data
+.balign 32
+words:  .long 1, 2, 3, 4, 5, 6, 7, 8
+ones:   .long 1, 1, 1, 1, 1, 1, 1, 1
+pi:     .double 3.25
+slot:   .quad 0
+area:   .space 16
+.balign 64
+xarea:  .space 1024
+
+.text
+.globl _start
+_start:
+	# 1: MOVDQA and MOVQ through REX.R and REX.B, RIP-relative
+	mov $1, %ebp
+	movdqa words(%rip), %xmm9
+	movq %xmm9, %r10
+	mov $0x200000001, %rax
+	cmp %rax, %r10
+	jne fail
+	movd %xmm9, %r11d
+	cmp $1, %r11
+	jne fail
+
+	# 2: PXOR, PADDD and PSHUFD, the immediate after a RIP-relative operand
+	mov $2, %ebp
+	pxor %xmm12, %xmm12
+	paddd ones(%rip), %xmm12
+	paddd %xmm9, %xmm12
+	pshufd $0x1b, words(%rip), %xmm13
+	movd %xmm13, %eax
+	cmp $4, %eax
+	jne fail
+	pextrw $2, %xmm12, %ecx
+	cmp $3, %ecx
+	jne fail
+
+	# 3: 64-bit conversions with REX.W
+	mov $3, %ebp
+	mov $0x123456789, %rax
+	cvtsi2sdq %rax, %xmm8
+	cvttsd2si %xmm8, %rbx
+	cmp %rax, %rbx
+	jne fail
+	cvttsd2si pi(%rip), %ecx
+	cmp $3, %ecx
+	jne fail
+
+	# 4: operands on the stack above 4 GiB
+	mov $4, %ebp
+	sub $32, %rsp
+	movdqu %xmm9, 8(%rsp)
+	mov 12(%rsp), %eax
+	cmp $2, %eax
+	jne fail
+	movq 8(%rsp), %xmm14
+	movq %xmm14, %rbx
+	cmp %r10, %rbx
+	jne fail
+	add $32, %rsp
+
+	# 5: VEX with VEX.vvvv and the registers above 7
+	mov $5, %ebp
+	vmovdqu words(%rip), %ymm13
+	vmovdqu ones(%rip), %ymm14
+	vpaddd %ymm14, %ymm13, %ymm15
+	vextracti128 $1, %ymm15, %xmm11
+	vmovq %xmm11, %rax
+	mov $0x700000006, %rbx
+	cmp %rbx, %rax
+	jne fail
+	vmovd %xmm15, %ecx
+	cmp $2, %ecx
+	jne fail
+
+	# 6: x87 with RIP-relative operands
+	mov $6, %ebp
+	fldl pi(%rip)
+	fadd %st(0), %st(0)
+	fistpl slot(%rip)
+	cmpl $6, slot(%rip)
+	jne fail
+	fnstsw %ax
+	test $0x3800, %ax
+	jne fail
+
+	# 7: MOVNTI and CVTSI2SS with 64-bit registers
+	mov $7, %ebp
+	mov $-5, %rax
+	movnti %rax, area(%rip)
+	cmpq $-5, area(%rip)
+	jne fail
+	cvtsi2ssq area(%rip), %xmm10
+	cvtss2si %xmm10, %rcx
+	cmp $-5, %rcx
+	jne fail
+
+	# 8: FXSAVE and FXRSTOR hold XMM8-XMM15
+	mov $8, %ebp
+	movdqa words(%rip), %xmm15
+	fxsave xarea(%rip)
+	cmpl $1, xarea+400(%rip)
+	jne fail
+	pxor %xmm15, %xmm15
+	fxrstor xarea(%rip)
+	movd %xmm15, %eax
+	cmp $1, %eax
+	jne fail
+
+	# 9: XSAVE holds the upper halves of YMM8-YMM15, VZEROUPPER clears them
+	mov $9, %ebp
+	vmovdqu words(%rip), %ymm15
+	mov $7, %eax
+	xor %edx, %edx
+	xsave xarea(%rip)
+	cmpl $5, xarea+576+240(%rip)
+	jne fail
+	vzeroupper
+	vextracti128 $1, %ymm15, %xmm0
+	vmovq %xmm0, %rax
+	test %rax, %rax
+	jne fail
+	mov $7, %eax
+	xrstor xarea(%rip)
+	vextracti128 $1, %ymm15, %xmm0
+	vmovd %xmm0, %eax
+	cmp $5, %eax
+	jne fail
+
+	# 10: XRSTOR without the SSE state in XSTATE_BV clears XMM8-XMM15
+	mov $10, %ebp
+	andq $~2, xarea+512(%rip)
+	mov $2, %eax
+	xrstor xarea(%rip)
+	movq %xmm15, %rax
+	test %rax, %rax
+	jne fail
+
+	xor %ebp, %ebp
+fail:
+	mov %ebp, %edi
+	mov $60, %eax
+	syscall
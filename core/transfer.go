@@ -78,6 +78,16 @@ func (t *Transfer) MovR16Imm16() {
 	reg.EIP += 3
 }
 
+func (t *Transfer) MovRM8Imm8() {
+	reg := t.reg
+	mem := t.mem
+	reg.EIP += 1
+	modrm := NewModRM(t.reg, t.mem)
+	imm8 := mem.GetCode8(0)
+	reg.EIP += 1
+	modrm.SetRM8(imm8)
+}
+
 func (t *Transfer) MovRM16Imm16() {
 	reg := t.reg
 	mem := t.mem
@@ -106,3 +116,67 @@ func (t *Transfer) MovRM32Imm32() {
 	reg.EIP += 4
 	modrm.SetRM32(imm32)
 }
+
+func (t *Transfer) MovRM16Sreg() {
+	reg := t.reg
+	reg.EIP += 1
+	modrm := NewModRM(t.reg, t.mem)
+	if modrm.RegIndex > SegGS {
+		raise(ExceptionUD)
+	}
+	modrm.SetRM16(reg.GetSegment(modrm.RegIndex))
+}
+
+func (t *Transfer) MovSregRM16() {
+	reg := t.reg
+	mem := t.mem
+	reg.EIP += 1
+	modrm := NewModRM(t.reg, t.mem)
+	if modrm.RegIndex == SegCS || modrm.RegIndex > SegGS {
+		raise(ExceptionUD)
+	}
+	rm16 := modrm.GetRM16()
+	loadSegment(reg, mem, modrm.RegIndex, rm16)
+}
+
+// movOffset MOV AL/AX/EAX to and from moffs (A0-A3), an offset of the address size in the
+// data segment
+func (t *Transfer) movOffset(width uint, store bool) func() {
+	return func() {
+		reg := t.reg
+		mem := t.mem
+		var offset uint32
+		if reg.isAddress32() {
+			offset = mem.GetCode32(1)
+			reg.EIP += 5
+		} else {
+			offset = uint32(mem.GetCode16(1))
+			reg.EIP += 3
+		}
+		address := reg.segmentAddress(reg.dataSegment(SegDS), offset, uint32(width/8), store)
+		if store {
+			writeOperand(mem, address, width, reg.accumulator(width))
+			return
+		}
+		reg.setAccumulator(width, readOperand(mem, address, width))
+	}
+}
+
+// loadFar LES, LDS, LSS, LFS and LGS r, m16:16/32 (C4, C5, 0F B2, B4, B5): loads the segment
+// register with the selector after the offset, then r with the offset
+func (t *Transfer) loadFar(index uint8, width uint) func() {
+	return func() {
+		reg := t.reg
+		mem := t.mem
+		reg.EIP += 1
+		modrm := NewModRM(reg, mem)
+		if modrm.Mod == 3 {
+			raise(ExceptionUD)
+		}
+		size := uint32(width / 8)
+		address := modrm.calcAddress(size+2, false)
+		offset := readOperand(mem, address, width)
+		loadSegment(reg, mem, index, mem.Read16(address+size))
+		setR(&modrm, width, offset)
+	}
+}
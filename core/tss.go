@@ -0,0 +1,321 @@
+package core
+
+// Offsets of the TSS fields
+const (
+	tss16SP0   = 0x02
+	tss32ESP0  = 0x04
+	tss32IOMap = 0x66 // offset of the I/O permission bitmap
+)
+
+// accessBusy type bit of a TSS descriptor telling a busy task from an available one
+const accessBusy = 0x02
+
+func (c *SegmentCache) is32TSS() bool {
+	return c.Access&0x8 != 0
+}
+
+// loadTR loads the task register with a selector referring to an available TSS in the GDT.
+// The descriptor is marked busy.
+func loadTR(reg *X86Registers, mem IMemory, selector uint16) {
+	defer mem.Implicit()()
+	errorCode := uint32(selector &^ 3)
+	if selector&^3 == 0 || selector&4 != 0 {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	address := descriptorAddress(reg, selector)
+	desc := readDescriptor(mem, address)
+	if !desc.IsSystem() || (desc.Type() != descTSS16Available && desc.Type() != descTSS32Available) {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionNP, errorCode)
+	}
+	desc.Access |= accessBusy
+	mem.Write8(address+5, desc.Access)
+	reg.TR = selector
+	reg.TRCache = desc.cache()
+}
+
+// taskLink the back link of the current TSS, the task a nested task returns to
+func taskLink(reg *X86Registers, mem IMemory) uint16 {
+	defer mem.Implicit()()
+	return mem.Read16(reg.TRCache.Base)
+}
+
+// tssStack returns the SS:ESP of privilege level dpl saved in the current TSS
+func tssStack(reg *X86Registers, mem IMemory, dpl uint8) (uint16, uint32) {
+	defer mem.Implicit()()
+	tss := &reg.TRCache
+	errorCode := uint32(reg.TR &^ 3)
+	if !tss.IsUsable() {
+		raiseWithCode(ExceptionTS, errorCode)
+	}
+	if tss.is32TSS() {
+		offset := tss32ESP0 + uint32(dpl)*8
+		if offset+5 > tss.Limit {
+			raiseWithCode(ExceptionTS, errorCode)
+		}
+		return mem.Read16(tss.Base + offset + 4), mem.Read32(tss.Base + offset)
+	}
+	offset := tss16SP0 + uint32(dpl)*4
+	if offset+3 > tss.Limit {
+		raiseWithCode(ExceptionTS, errorCode)
+	}
+	return mem.Read16(tss.Base + offset + 2), uint32(mem.Read16(tss.Base + offset))
+}
+
+// ioPermitted the I/O permission bitmap of the current 32-bit TSS allows size ports from port
+func ioPermitted(reg *X86Registers, mem IMemory, port uint16, size uint16) bool {
+	defer mem.Implicit()()
+	tss := &reg.TRCache
+	if !tss.IsUsable() || !tss.is32TSS() || tss.Limit < tss32IOMap+1 {
+		return false
+	}
+	offset := uint32(mem.Read16(tss.Base+tss32IOMap)) + uint32(port>>3)
+	if offset+1 > tss.Limit {
+		return false
+	}
+	bits := uint32(mem.Read16(tss.Base + offset))
+	mask := uint32(1<<size-1) << (port & 7)
+	return bits&mask == 0
+}
+
+// interruptRedirected VME: the interrupt redirection bitmap, the 32 bytes below the I/O permission
+// bitmap, sends INT vector of a virtual-8086 task to its own IVT when the vector bit is clear
+func interruptRedirected(reg *X86Registers, mem IMemory, vector uint8) bool {
+	defer mem.Implicit()()
+	tss := &reg.TRCache
+	if !tss.IsUsable() || !tss.is32TSS() || tss.Limit < tss32IOMap+1 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	offset := uint32(mem.Read16(tss.Base+tss32IOMap)) - 32 + uint32(vector>>3)
+	if offset > tss.Limit {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	return mem.Read8(tss.Base+offset)&(1<<(vector&7)) == 0
+}
+
+// taskSource what started a task switch
+type taskSource int
+
+const (
+	taskJump taskSource = iota
+	taskCall            // CALL, INT and exceptions: the new task is nested and links back
+	taskIret            // IRET with NT set: return to the task in the back link
+)
+
+// Offsets of the state saved in a 32-bit and a 16-bit TSS
+const (
+	tss32CR3       = 0x1c
+	tss32EIP       = 0x20
+	tss32EFlags    = 0x24
+	tss32Registers = 0x28
+	tss32Segments  = 0x48
+	tss32LDT       = 0x60
+	tss32Trap      = 0x64 // bit 0: debug trap on entry to the task
+	tss32MinLimit  = 0x67
+
+	tss16IP        = 0x0e
+	tss16Flags     = 0x10
+	tss16Registers = 0x12
+	tss16Segments  = 0x22
+	tss16LDT       = 0x2a
+	tss16MinLimit  = 0x2b
+)
+
+func (d *Descriptor) isTSS() bool {
+	if !d.IsSystem() {
+		return false
+	}
+	switch d.Type() {
+	case descTSS16Available, descTSS16Busy, descTSS32Available, descTSS32Busy:
+		return true
+	}
+	return false
+}
+
+// taskDescriptor reads the TSS descriptor referenced by a task gate or a back link, faulting with vector
+func taskDescriptor(reg *X86Registers, mem IMemory, selector uint16, vector uint8) (uint32, Descriptor) {
+	errorCode := uint32(selector &^ 3)
+	if selector&^3 == 0 || selector&4 != 0 {
+		raiseWithCode(vector, errorCode)
+	}
+	address := descriptorAddress(reg, selector)
+	desc := readDescriptor(mem, address)
+	if !desc.isTSS() {
+		raiseWithCode(vector, errorCode)
+	}
+	return address, desc
+}
+
+// switchTask saves the state of the current task in its TSS, then loads the task whose TSS
+// descriptor is at address. The busy bits, the back link and NT follow the source of the switch.
+// The local breakpoints of DR7 belong to the old task and are disabled.
+func switchTask(reg *X86Registers, mem IMemory, selector uint16, address uint32, desc Descriptor, source taskSource) {
+	defer mem.Implicit()()
+	errorCode := uint32(selector &^ 3)
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionNP, errorCode)
+	}
+	minLimit := uint32(tss16MinLimit)
+	if desc.Type()&0x8 != 0 {
+		minLimit = tss32MinLimit
+	}
+	if desc.Limit < minLimit {
+		raiseWithCode(ExceptionTS, errorCode)
+	}
+	busy := desc.Type()&accessBusy != 0
+	if source == taskIret && !busy {
+		raiseWithCode(ExceptionTS, errorCode)
+	}
+	if source != taskIret && busy {
+		raiseWithCode(ExceptionGP, errorCode)
+	}
+	old := reg.TRCache
+	if !old.IsUsable() {
+		raiseWithCode(ExceptionTS, uint32(reg.TR&^3))
+	}
+
+	flags := reg.EFlags
+	if source != taskCall {
+		flags &^= FlagNT
+	}
+	saveTask(reg, mem, &old, flags)
+	if source != taskCall {
+		oldAddress := reg.GDTR.Base + uint32(reg.TR&^7)
+		mem.Write8(oldAddress+5, mem.Read8(oldAddress+5)&^accessBusy)
+	}
+	if source == taskCall {
+		mem.Write16(desc.Base, reg.TR)
+	}
+	if source != taskIret {
+		desc.Access |= accessBusy
+		mem.Write8(address+5, desc.Access)
+	}
+	reg.TR = selector
+	reg.TRCache = desc.cache()
+	reg.CR0 |= CR0TS
+	reg.DR7 &^= dr7Local
+	loadTask(reg, mem, source == taskCall)
+}
+
+// saveTask writes the dynamic fields of the current task in its TSS
+func saveTask(reg *X86Registers, mem IMemory, tss *SegmentCache, flags uint32) {
+	base := tss.Base
+	if tss.is32TSS() {
+		mem.Write32(base+tss32EIP, reg.EIP)
+		mem.Write32(base+tss32EFlags, flags)
+		for i := uint8(0); i < 8; i++ {
+			mem.Write32(base+tss32Registers+uint32(i)*4, reg.GetByIndex(i))
+		}
+		for i := SegES; i <= SegGS; i++ {
+			mem.Write16(base+tss32Segments+uint32(i)*4, reg.GetSegment(i))
+		}
+		return
+	}
+	mem.Write16(base+tss16IP, uint16(reg.EIP))
+	mem.Write16(base+tss16Flags, uint16(flags))
+	for i := uint8(0); i < 8; i++ {
+		mem.Write16(base+tss16Registers+uint32(i)*2, reg.Get16ByIndex(i))
+	}
+	for i := SegES; i <= SegDS; i++ {
+		mem.Write16(base+tss16Segments+uint32(i)*2, reg.GetSegment(i))
+	}
+}
+
+// loadTask loads the state of the task in TR. The segment registers are checked once the
+// whole state is loaded, so their faults are raised in the context of the new task.
+func loadTask(reg *X86Registers, mem IMemory, nested bool) {
+	tss := &reg.TRCache
+	base := tss.Base
+	var selectors [6]uint16
+	var ldt uint16
+	var flags uint32
+	if tss.is32TSS() {
+		if reg.CR0&CR0PG != 0 {
+			reg.CR3 = uint64(mem.Read32(base + tss32CR3))
+			mem.FlushTLB(reg.CR4&CR4PGE != 0)
+		}
+		reg.EIP = mem.Read32(base + tss32EIP)
+		flags = mem.Read32(base + tss32EFlags)
+		for i := uint8(0); i < 8; i++ {
+			reg.SetByIndex(i, mem.Read32(base+tss32Registers+uint32(i)*4))
+		}
+		for i := SegES; i <= SegGS; i++ {
+			selectors[i] = mem.Read16(base + tss32Segments + uint32(i)*4)
+		}
+		ldt = mem.Read16(base + tss32LDT)
+		if mem.Read16(base+tss32Trap)&1 != 0 {
+			reg.pendingDB |= DR6BT
+		}
+	} else {
+		reg.EIP = uint32(mem.Read16(base + tss16IP))
+		flags = uint32(mem.Read16(base + tss16Flags))
+		for i := uint8(0); i < 8; i++ {
+			reg.Set16ByIndex(i, mem.Read16(base+tss16Registers+uint32(i)*2))
+		}
+		for i := SegES; i <= SegDS; i++ {
+			selectors[i] = mem.Read16(base + tss16Segments + uint32(i)*2)
+		}
+		ldt = mem.Read16(base + tss16LDT)
+	}
+	if nested {
+		flags |= FlagNT
+	}
+	reg.setEFlags(flags, flagsMask)
+	for i := SegES; i <= SegGS; i++ {
+		*reg.selectorIndex(i) = selectors[i]
+	}
+	if reg.IsVM() {
+		// a virtual-8086 task: the segment registers load as in real mode
+		for i := SegES; i <= SegGS; i++ {
+			reg.loadV86Segment(i, selectors[i])
+		}
+		asTaskFault(func() {
+			loadLDT(reg, mem, ldt)
+		})
+		return
+	}
+
+	asTaskFault(func() {
+		loadLDT(reg, mem, ldt)
+		loadTaskCode(reg, mem, selectors[SegCS])
+		cpl := reg.CPL()
+		address, desc := checkStackSegment(reg, mem, selectors[SegSS], cpl, ExceptionTS)
+		setStackSegment(reg, mem, selectors[SegSS], address, desc)
+		for _, index := range []uint8{SegES, SegDS, SegFS, SegGS} {
+			loadSegment(reg, mem, index, selectors[index])
+		}
+	})
+}
+
+// loadTaskCode loads CS of the new task, its RPL becomes the CPL
+func loadTaskCode(reg *X86Registers, mem IMemory, selector uint16) {
+	errorCode := uint32(selector &^ 3)
+	if selector&^3 == 0 {
+		raiseWithCode(ExceptionTS, 0)
+	}
+	rpl := uint8(selector & 3)
+	address := descriptorAddress(reg, selector)
+	desc := readDescriptor(mem, address)
+	if !desc.IsCode() || desc.IsConforming() && desc.DPL() > rpl || !desc.IsConforming() && desc.DPL() != rpl {
+		raiseWithCode(ExceptionTS, errorCode)
+	}
+	if !desc.IsPresent() {
+		raiseWithCode(ExceptionNP, errorCode)
+	}
+	setCodeSegment(reg, mem, selector, address, desc, rpl)
+}
+
+// asTaskFault runs load, reporting the #GP raised by the segment checks as #TS
+func asTaskFault(load func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(*Exception); ok && e.Vector == ExceptionGP {
+				e.Vector = ExceptionTS
+			}
+			panic(r)
+		}
+	}()
+	load()
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+// descriptorBytes encodes a segment or system descriptor
+func descriptorBytes(base uint32, limit uint32, access uint8, flags uint8) uint64 {
+	return uint64(limit&0xffff) | uint64(base&0xffffff)<<16 | uint64(access)<<40 |
+		uint64(limit>>16&0xf)<<48 | uint64(flags)<<52 | uint64(base>>24)<<56
+}
+
+// taskSwitchCPU a flat 32-bit CPU with selectors 0x08 and 0x10, at 0x1000 running the task
+// of TSS 0x18, whose code is a far jump to the task of TSS 0x20 starting at 0x1100
+func taskSwitchCPU(t *testing.T) *CPU {
+	t.Helper()
+	cpu := newBare(t, 32, nil).cpu.(*CPU)
+	reg, mem := cpu.reg, cpu.mem
+	gdt := []uint64{
+		0,
+		descriptorBytes(0, 0xfffff, 0x9a, 0xc),
+		descriptorBytes(0, 0xfffff, 0x92, 0xc),
+		descriptorBytes(0x1800, tss32MinLimit, 0x89, 0),
+		descriptorBytes(0x1900, tss32MinLimit, 0x89, 0),
+	}
+	for i, desc := range gdt {
+		mem.Write32(0x1a00+uint32(i)*8, uint32(desc))
+		mem.Write32(0x1a04+uint32(i)*8, uint32(desc>>32))
+	}
+	reg.GDTR = DescriptorTable{Base: 0x1a00, Limit: uint16(len(gdt)*8 - 1)}
+	loadTR(reg, mem, 0x18)
+	for i := SegES; i <= SegGS; i++ {
+		*reg.selectorIndex(i) = 0x10
+	}
+	reg.CS = 0x08
+	mem.Write32(0x1900+tss32EIP, 0x1100)
+	mem.Write32(0x1900+tss32EFlags, 0x2)
+	mem.Write32(0x1900+tss32Registers+4*4, 0x1f00)
+	for i := SegES; i <= SegGS; i++ {
+		mem.Write16(0x1900+tss32Segments+uint32(i)*4, 0x10)
+	}
+	mem.Write16(0x1900+tss32Segments+uint32(SegCS)*4, 0x08)
+	for i, b := range []byte{0xea, 0, 0, 0, 0, 0x20, 0, 0xf4} {
+		mem.Write8(0x1000+uint32(i), b)
+	}
+	return cpu
+}
+
+func TestTaskSwitchDebugRegisters(t *testing.T) {
+	cpu := taskSwitchCPU(t)
+	reg := cpu.reg
+	reg.DR7 = dr7Reserved | 0xff
+	if err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if reg.TR != 0x20 || reg.EIP != 0x1100 {
+		t.Fatalf("TR:EIP = %04X:%X, want 0020:1100", reg.TR, reg.EIP)
+	}
+	if want := uint32(dr7Reserved | 0xaa); reg.DR7 != want {
+		t.Errorf("DR7 = %#x, want %#x", reg.DR7, want)
+	}
+}
+
+func TestTaskSwitch(t *testing.T) {
+	jmp := []byte{0xea, 0, 0, 0, 0, 0x20, 0}  // jmp 0x20:0
+	call := []byte{0x9a, 0, 0, 0, 0, 0x20, 0} // call 0x20:0
+	tests := []struct {
+		name   string
+		code   []byte // at 0x1000, in the task of TSS 0x18
+		task   []byte // at 0x1100, in the task of TSS 0x20
+		setup  func(cpu *CPU)
+		steps  int
+		tr     uint16
+		eip    uint32
+		nt     bool
+		link   uint16 // of TSS 0x20
+		busy18 bool
+		busy20 bool
+		err    string
+	}{
+		// JMP frees the old task, CALL keeps it busy and links the new one back to it
+		{"jmp", jmp, nil, nil, 1, 0x20, 0x1100, false, 0, false, true, ""},
+		{"call", call, nil, nil, 1, 0x20, 0x1100, true, 0x18, true, true, ""},
+		// IRET with NT returns to the task in the back link and frees the nested one
+		{"call iret", call, []byte{0xcf}, nil, 2, 0x18, 0x1007, false, 0x18, true, false, ""},
+		{"jmp busy", jmp, nil, func(cpu *CPU) { cpu.mem.Write8(0x1a00+0x20+5, 0x8b) },
+			1, 0, 0, false, 0, false, false, "#GP(0x20)"},
+		{"call busy", call, nil, func(cpu *CPU) { cpu.mem.Write8(0x1a00+0x20+5, 0x8b) },
+			1, 0, 0, false, 0, false, false, "#GP(0x20)"},
+		// IRET with NT to a task that is not busy
+		{"iret free", []byte{0xcf}, nil, func(cpu *CPU) {
+			cpu.reg.EFlags |= FlagNT
+			cpu.mem.Write16(0x1800, 0x20)
+		}, 1, 0, 0, false, 0, false, false, "#TS(0x20)"},
+	}
+	for _, test := range tests {
+		cpu := taskSwitchCPU(t)
+		reg, mem := cpu.reg, cpu.mem
+		for i, b := range test.code {
+			mem.Write8(0x1000+uint32(i), b)
+		}
+		for i, b := range test.task {
+			mem.Write8(0x1100+uint32(i), b)
+		}
+		if test.setup != nil {
+			test.setup(cpu)
+		}
+		var err error
+		for i := 0; i < test.steps && err == nil; i++ {
+			err = cpu.Step()
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if reg.TR != test.tr || reg.EIP != test.eip {
+			t.Errorf("%s: TR:EIP = %04X:%X, want %04X:%X", test.name, reg.TR, reg.EIP, test.tr, test.eip)
+		}
+		if nt := reg.EFlags&FlagNT != 0; nt != test.nt {
+			t.Errorf("%s: NT = %v, want %v", test.name, nt, test.nt)
+		}
+		if link := mem.Read16(0x1900); link != test.link {
+			t.Errorf("%s: back link %04X, want %04X", test.name, link, test.link)
+		}
+		busy18 := mem.Read8(0x1a00+0x18+5)&accessBusy != 0
+		busy20 := mem.Read8(0x1a00+0x20+5)&accessBusy != 0
+		if busy18 != test.busy18 || busy20 != test.busy20 {
+			t.Errorf("%s: busy %v, %v, want %v, %v", test.name, busy18, busy20, test.busy18, test.busy20)
+		}
+	}
+}
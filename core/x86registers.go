@@ -30,17 +30,18 @@ type X86Registers struct {
 
 	// FLAGS Register
 	EFlags uint32
-	// MMX registers (MM0 through MM7)
-	MM0 uint64
-	MM1 uint64
-	MM2 uint64
-	MM3 uint64
-	MM4 uint64
-	MM5 uint64
-	MM6 uint64
-	MM7 uint64
-	// TODO: XMM registers (XMM0 through XMM15) and the MXCSR register
-	// uint128 doesn't existed
+	// 64-bit general registers, which hold the live register state in 64-bit mode
+	X64 X64registers
+	// mode64 the general registers live in X64: the processor runs 64-bit code
+	mode64 bool
+	// x87 FPU registers; MMX registers MM0 through MM7 alias their significands
+	FPU FPUState
+	// SSE registers: XMM0 through XMM7, XMM8 through XMM15 in long mode
+	XMM [16]XMM
+	// upper halves of the AVX registers YMM0 through YMM15, whose low halves are XMM0-XMM15
+	YMMH [16]XMM
+	// SIMD floating-point control and status
+	MXCSR uint32
 
 	// Control Registers
 	CR0 uint64
@@ -51,6 +52,59 @@ type X86Registers struct {
 	CR5 uint64
 	CR6 uint64
 	CR7 uint64
+	// Extended Feature Enable Register
+	IA32Efer uint64
+	// Extended Control Register 0: the state components managed by XSAVE
+	XCR0 uint64
+
+	// Debug Registers: breakpoint addresses, status and control
+	DR  [4]uint32
+	DR6 uint32
+	DR7 uint32
+
+	// Hidden descriptor caches of ES, CS, SS, DS, FS, GS
+	Segments [6]SegmentCache
+
+	// Descriptor Table Registers
+	GDTR     DescriptorTable
+	IDTR     DescriptorTable
+	LDTR     uint16
+	LDTCache SegmentCache
+	// Task Register
+	TR      uint16
+	TRCache SegmentCache
+
+	// Prefixes of the instruction being decoded
+	segOverride  int8
+	opOverride   bool
+	addrOverride bool
+	// F2 (REPNE) or F3 (REP), also the mandatory prefix of SSE instructions
+	repPrefix uint8
+	vex       vexPrefix
+	// REX prefix of a 64-bit instruction, 0 when absent
+	rex uint8
+	// immediate the size of the immediate after the operands of an instruction run by
+	// extension64, which RIP-relative addresses are relative to the end of
+	immediate uint32
+	// LOCK, which holds the bus of the processors sharing memory
+	lockPrefix bool
+	bus        *Bus
+	// DR6 bits of the breakpoints hit by the instruction being executed
+	pendingDB uint32
+	// processor model reported by CPUID
+	profile *Profile
+	// model-specific registers
+	msrs *MSRFile
+	// time-stamp counter: clock ticks after retired instructions, moved by writes to IA32_TSC
+	clock     Clock
+	retired   uint64
+	tscOffset uint64
+	// source of RDRAND and RDSEED
+	entropy Entropy
+	// operating system serving a program run in user mode, nil on bare metal
+	personality personality
+	// symbols of the program, nil when it has none
+	symbols *symbolTable
 
 	//baseAddress  uint32
 	//stackAddress uint32
@@ -61,7 +115,12 @@ func NewIA32registers(baseAddress uint32, stackAddress uint32, debug bool) *X86R
 	r := &X86Registers{
 		//baseAddress:  baseAddress,
 		//stackAddress: stackAddress,
-		debug: debug,
+		debug:   debug,
+		profile: profiles[DefaultProfile],
+		msrs:    NewMSRFile(),
+		clock:   InstructionClock{},
+		entropy: NewSeededEntropy(0),
+		bus:     &Bus{},
 	}
 	r.init(baseAddress, stackAddress)
 	return r
@@ -79,24 +138,18 @@ func (r *X86Registers) init(baseAddress uint32, stackAddress uint32) {
 
 	r.EIP = baseAddress
 
-	r.CS = 0
-	r.DS = 0
-	r.SS = 0
-	r.ES = 0
-	r.FS = 0
-	r.GS = 0
+	for i := SegES; i <= SegGS; i++ {
+		r.resetSegment(i, 0)
+	}
+	r.resetPrefixes()
 
 	// Reserved 1st bit, it's always 1 in EFlags.
 	r.EFlags = 2
 
-	r.MM0 = 0
-	r.MM1 = 0
-	r.MM2 = 0
-	r.MM3 = 0
-	r.MM4 = 0
-	r.MM5 = 0
-	r.MM6 = 0
-	r.MM7 = 0
+	r.FPU.init()
+	r.XMM = [16]XMM{}
+	r.YMMH = [16]XMM{}
+	r.MXCSR = mxcsrInit
 
 	r.CR0 = 0
 	r.CR1 = 0
@@ -106,6 +159,98 @@ func (r *X86Registers) init(baseAddress uint32, stackAddress uint32) {
 	r.CR5 = 0
 	r.CR6 = 0
 	r.CR7 = 0
+	r.IA32Efer = 0
+	r.X64 = X64registers{}
+	r.mode64 = false
+	r.XCR0 = xstateX87
+	r.DR = [4]uint32{}
+	r.DR6 = dr6Reserved
+	r.DR7 = dr7Reserved
+
+	r.GDTR = DescriptorTable{}
+	r.IDTR = DescriptorTable{Limit: 0x3ff}
+	r.LDTR = 0
+	r.LDTCache = SegmentCache{}
+	r.TR = 0
+	r.TRCache = SegmentCache{}
+}
+
+// Reset sets the state of the processor after RESET: execution starts at F000:FFF0 in real mode
+func (r *X86Registers) Reset() {
+	r.EFlags = 2
+	r.CR0 = CR0ET
+	r.CR2 = 0
+	r.CR3 = 0
+	r.CR4 = 0
+	r.IA32Efer = 0
+	r.X64 = X64registers{}
+	r.mode64 = false
+	r.XCR0 = xstateX87
+	r.DR = [4]uint32{}
+	r.DR6 = dr6Reserved
+	r.DR7 = dr7Reserved
+	r.FPU.reset()
+	r.XMM = [16]XMM{}
+	r.YMMH = [16]XMM{}
+	r.MXCSR = mxcsrInit
+	r.EIP = 0xfff0
+	r.GDTR = DescriptorTable{}
+	r.IDTR = DescriptorTable{Limit: 0x3ff}
+	r.LDTR = 0
+	r.LDTCache = SegmentCache{}
+	r.TR = 0
+	r.TRCache = SegmentCache{}
+	for i := SegES; i <= SegGS; i++ {
+		r.resetSegment(i, 0)
+	}
+	r.resetSegment(SegCS, 0xf000)
+	r.resetPrefixes()
+}
+
+// flatMode sets every segment to a flat 4 GiB 32-bit segment
+func (r *X86Registers) flatMode() {
+	for i := SegES; i <= SegGS; i++ {
+		r.flatSegment(i)
+	}
+}
+
+func (r *X86Registers) resetPrefixes() {
+	r.segOverride = -1
+	r.opOverride = false
+	r.addrOverride = false
+	r.repPrefix = 0
+	r.vex = vexPrefix{}
+	r.rex = 0
+	r.immediate = 0
+	r.lockPrefix = false
+}
+
+// mandatoryPrefix the prefix selecting the form of an SSE instruction: F2 or F3 when
+// present, else 66, else 0. VEX encodes it in its pp field.
+func (r *X86Registers) mandatoryPrefix() uint8 {
+	if r.vex.present {
+		return [4]uint8{0, 0x66, 0xf3, 0xf2}[r.vex.pp]
+	}
+	if r.repPrefix != 0 {
+		return r.repPrefix
+	}
+	if r.opOverride {
+		return 0x66
+	}
+	return 0
+}
+
+// isAddress32 the current instruction uses 32-bit addressing
+func (r *X86Registers) isAddress32() bool {
+	return r.IsCode32() != r.addrOverride
+}
+
+// dataSegment returns the segment used by a memory operand, honouring the override prefix
+func (r *X86Registers) dataSegment(defaultIndex uint8) uint8 {
+	if r.segOverride >= 0 {
+		return uint8(r.segOverride)
+	}
+	return defaultIndex
 }
 
 func (r *X86Registers) registerIndex(index uint8) *uint32 {
@@ -136,7 +281,8 @@ func (r *X86Registers) Dump() {
 	t := v.Type()
 
 	fmt.Println("==================== registers ====================")
-	for i := 0; i < 24; i++ {
+	// general, instruction pointer, segment and flags registers
+	for i := 0; i < 16; i++ {
 		registerName := t.Field(i).Name
 		registerValue := v.Field(i).Interface()
 
@@ -144,11 +290,25 @@ func (r *X86Registers) Dump() {
 		case "EFlags":
 			fmt.Printf("%02d: %s = 0x%X (%032b)\n",
 				i+1, registerName, registerValue, registerValue)
+		case "EIP":
+			fmt.Printf("%02d: %s = 0x%X%s\n",
+				i+1, registerName, registerValue, r.codeSymbol(uint64(r.EIP)))
 		default:
 			fmt.Printf("%02d: %s = 0x%X\n",
 				i+1, registerName, registerValue)
 		}
 	}
+	for i := uint8(0); i < 8; i++ {
+		fmt.Printf("%02d: MM%d = 0x%X\n", 17+i, i, r.MM(i))
+	}
+	for i := 0; i < 8; i++ {
+		y := r.YMM(uint8(i))
+		fmt.Printf("%02d: YMM%d = 0x%016X%016X%016X%016X\n", 25+i, i, y[3], y[2], y[1], y[0])
+	}
+	fmt.Printf("33: MXCSR = 0x%X\n", r.MXCSR)
+	if r.mode64 {
+		r.X64.Dump(r.codeSymbol(r.X64.RIP))
+	}
 }
 
 func (r *X86Registers) GetByIndex(index uint8) uint32 {
@@ -163,9 +323,12 @@ func (r *X86Registers) Get16ByIndex(index uint8) uint16 {
 }
 
 func (r *X86Registers) Get8ByIndex(index uint8) uint8 {
-	value32 := r.registerIndex(index)
-	value8 := uint8(*value32 & 0xFF)
-	return value8
+	if index <= 3 {
+		value32 := r.registerIndex(index)
+		return uint8(*value32 & 0xFF)
+	}
+	value32 := r.registerIndex(index - 4)
+	return uint8((*value32 >> 8) & 0xFF)
 }
 
 func (r *X86Registers) SetByIndex(index uint8, value uint32) {
@@ -182,7 +345,7 @@ func (r *X86Registers) Set16ByIndex(index uint8, value uint16) {
 func (r *X86Registers) Set8ByIndex(index uint8, value uint8) {
 	if index <= 3 {
 		v := r.registerIndex(index)
-		value8 := (*v & 0xFFFF00FF) + (uint32(value) << 8)
+		value8 := (*v & 0xFFFFFF00) + uint32(value)
 		*v = value8
 	} else {
 		value32 := r.registerIndex(index - 4)
@@ -427,6 +590,35 @@ func (r *X86Registers) updateEFlagsImul32(result uint64) {
 	}
 }
 
+// EFLAGS bits
+const (
+	FlagCF   = 1 << 0
+	FlagPF   = 1 << 2
+	FlagAF   = 1 << 4
+	FlagZF   = 1 << 6
+	FlagSF   = 1 << 7
+	FlagTF   = 1 << 8
+	FlagIF   = 1 << 9
+	FlagDF   = 1 << 10
+	FlagOF   = 1 << 11
+	FlagIOPL = 3 << 12
+	FlagNT   = 1 << 14
+	FlagRF   = 1 << 16
+	FlagVM   = 1 << 17
+	FlagAC   = 1 << 18
+	FlagVIF  = 1 << 19
+	FlagVIP  = 1 << 20
+	FlagID   = 1 << 21
+
+	// flagsMask every defined EFLAGS bit
+	flagsMask = 0x3f7fd5
+)
+
+// setEFlags replaces the EFLAGS bits selected by mask, the reserved bit 1 stays set
+func (r *X86Registers) setEFlags(value uint32, mask uint32) {
+	r.EFlags = r.EFlags&^mask | value&mask&flagsMask | 2
+}
+
 // IsCF FLAGS Register Carry Flag (0 bit)
 func (r *X86Registers) IsCF() bool {
 	return (r.EFlags & 1) != 0
@@ -554,18 +746,23 @@ func (r *X86Registers) RemoveOF() {
 	r.EFlags &= uint32(mask)
 }
 
-// IsIOPL I/O Privilege Level Field (12-13bit)
+// IsIOPL I/O Privilege Level Field (12-13bit) is not zero
 func (r *X86Registers) IsIOPL() bool {
-	return (r.EFlags & 4096) != 0
+	return (r.EFlags & FlagIOPL) != 0
 }
 
+// SetIOPL sets IOPL to 3
 func (r *X86Registers) SetIOPL() {
-	r.EFlags = r.EFlags | 4096 // TODO: fix
+	r.EFlags = r.EFlags | FlagIOPL
 }
 
 func (r *X86Registers) RemoveIOPL() {
-	mask := ^4096 // TODO: fix
-	r.EFlags &= uint32(mask)
+	r.EFlags &^= FlagIOPL
+}
+
+// IOPL privilege level required for I/O and for changing IF
+func (r *X86Registers) IOPL() uint8 {
+	return uint8((r.EFlags & FlagIOPL) >> 12)
 }
 
 // IsNT Nested Task Flag (14bit)
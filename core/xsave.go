@@ -0,0 +1,360 @@
+package core
+
+// XSAVE state components, the bits of XCR0
+const (
+	xstateX87 = 1 << 0
+	xstateSSE = 1 << 1
+	xstateAVX = 1 << 2 // upper halves of the YMM registers
+	// xstateSupported the components XSETBV accepts and CPUID leaf 0xD reports
+	xstateSupported = xstateX87 | xstateSSE | xstateAVX
+)
+
+// Layout of the FXSAVE image, the legacy region of the XSAVE area, followed by the XSAVE
+// header holding XSTATE_BV and XCOMP_BV
+const (
+	fxsaveSize      = 512
+	fxsaveRegs      = 32  // ST0-ST7 in 16-byte slots
+	fxsaveXMM       = 160 // XMM registers
+	xsaveHeader     = fxsaveSize
+	xsaveHeaderSize = 64
+	xsaveYMMH       = xsaveHeader + xsaveHeaderSize // the AVX component
+	xsaveYMMHSize   = 256
+)
+
+// xsaveSize bytes of an XSAVE area holding the components of mask. The x87 and SSE state
+// live in the legacy region, the AVX state after the header.
+func xsaveSize(mask uint64) uint32 {
+	if mask&xstateAVX != 0 {
+		return xsaveYMMH + xsaveYMMHSize
+	}
+	return fxsaveSize + xsaveHeaderSize
+}
+
+// saveFX writes the x87 fields of the FXSAVE image: the control and status words, the
+// abridged tag word with one bit per non-empty physical register, the last instruction and
+// operand pointers and ST0-ST7. The 64-bit form of FXSAVE64 and XSAVE64 stores the pointers
+// as quadwords without selectors.
+func (s *FPUState) saveFX(mem IMemory, address uint64, wide bool) {
+	var tags uint16
+	for p := uint16(0); p < 8; p++ {
+		if s.tag(p) != tagEmpty {
+			tags |= 1 << p
+		}
+	}
+	writeWord(mem, address, s.Control)
+	writeWord(mem, address+2, s.Status)
+	writeWord(mem, address+4, tags)
+	writeWord(mem, address+6, s.FOP)
+	if wide {
+		writeQword(mem, address+8, uint64(s.FIP))
+		writeQword(mem, address+16, uint64(s.FDP))
+	} else {
+		writeDword(mem, address+8, s.FIP)
+		writeDword(mem, address+12, uint32(s.FCS))
+		writeDword(mem, address+16, s.FDP)
+		writeDword(mem, address+20, uint32(s.FDS))
+	}
+	for i := uint8(0); i < 8; i++ {
+		slot := address + fxsaveRegs + 16*uint64(i)
+		write80(mem, slot, s.st(i))
+		writeWord(mem, slot+10, 0)
+		writeDword(mem, slot+12, 0)
+	}
+}
+
+// restoreFX reloads the x87 fields written by saveFX; the full tags follow from the values
+func (s *FPUState) restoreFX(mem IMemory, address uint64, wide bool) {
+	s.Control = readWord(mem, address)&fcwMask | 0x40
+	s.Status = readWord(mem, address+2)
+	tags := uint8(mem.ReadLinear(address+4, 1))
+	s.FOP = readWord(mem, address+6) & 0x7ff
+	s.FIP = readDword(mem, address+8)
+	s.FDP = readDword(mem, address+16)
+	if wide {
+		s.FCS, s.FDS = 0, 0
+	} else {
+		s.FCS = readWord(mem, address+12)
+		s.FDS = readWord(mem, address+20)
+	}
+	for i := uint8(0); i < 8; i++ {
+		s.Regs[s.phys(i)] = read80(mem, address+fxsaveRegs+16*uint64(i))
+	}
+	s.Tag = 0
+	for p := uint16(0); p < 8; p++ {
+		if tags>>p&1 == 0 {
+			s.setTag(p, tagEmpty)
+		}
+	}
+	s.retag()
+	s.updateES()
+}
+
+// isInit the x87 state is the one set by FNINIT with zeroed registers
+func (s *FPUState) isInit() bool {
+	return s.Control == fcwInit && s.Status == 0 && s.Tag == 0xffff && s.FOP == 0 &&
+		s.FIP == 0 && s.FCS == 0 && s.FDP == 0 && s.FDS == 0 && s.Regs == [8]Float80{}
+}
+
+// saveXMM writes XMM0-XMM7 of the FXSAVE image, XMM0-XMM15 in 64-bit mode
+func (s *SSE) saveXMM(address uint64) {
+	reg := s.reg
+	for i := 0; i < reg.vectorRegisters(); i++ {
+		s.store(address+fxsaveXMM+16*uint64(i), 16, reg.XMM[i])
+	}
+}
+
+func (s *SSE) restoreXMM(address uint64) {
+	reg := s.reg
+	for i := 0; i < reg.vectorRegisters(); i++ {
+		reg.XMM[i] = s.load(address+fxsaveXMM+16*uint64(i), 16)
+	}
+}
+
+func (s *SSE) saveYMMH(address uint64) {
+	reg := s.reg
+	for i := 0; i < reg.vectorRegisters(); i++ {
+		s.store(address+xsaveYMMH+16*uint64(i), 16, reg.YMMH[i])
+	}
+}
+
+func (s *SSE) restoreYMMH(address uint64) {
+	reg := s.reg
+	for i := 0; i < reg.vectorRegisters(); i++ {
+		reg.YMMH[i] = s.load(address+xsaveYMMH+16*uint64(i), 16)
+	}
+}
+
+// saveMXCSR writes MXCSR and MXCSR_MASK of the FXSAVE image
+func (s *SSE) saveMXCSR(address uint64) {
+	writeDword(s.mem, address+24, s.reg.MXCSR)
+	writeDword(s.mem, address+28, mxcsrMask)
+}
+
+// restoreMXCSR raises #GP(0) for reserved bits
+func (s *SSE) restoreMXCSR(address uint64) {
+	value := readDword(s.mem, address+24)
+	if value&^mxcsrMask != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	s.reg.MXCSR = value
+}
+
+// saveArea the address of a save area of size bytes aligned on align bytes, else #GP(0)
+func (s *SSE) saveArea(modrm *ModRM, size uint32, align uint32, write bool) uint64 {
+	address := modrm.linear(size, write)
+	if address&uint64(align-1) != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	return address
+}
+
+// checkFXSR FXSAVE and FXRSTOR raise #UD without FXSR and #NM with CR0.EM or CR0.TS
+func (s *SSE) checkFXSR() {
+	reg := s.reg
+	if reg.features().Leaf1EDX&FeatureFXSR == 0 {
+		raise(ExceptionUD)
+	}
+	if reg.CR0&(CR0EM|CR0TS) != 0 {
+		raise(ExceptionNM)
+	}
+}
+
+// fxsave FXSAVE m512 (0F AE /0): the x87, MXCSR and XMM state, without reinitializing the FPU
+func (s *SSE) fxsave(modrm *ModRM) {
+	reg := s.reg
+	s.checkFXSR()
+	address := s.saveArea(modrm, fxsaveSize, 16, true)
+	reg.FPU.saveFX(s.mem, address, modrm.wide())
+	s.saveMXCSR(address)
+	s.saveXMM(address)
+}
+
+// fxrstor FXRSTOR m512 (0F AE /1)
+func (s *SSE) fxrstor(modrm *ModRM) {
+	reg := s.reg
+	s.checkFXSR()
+	address := s.saveArea(modrm, fxsaveSize, 16, false)
+	s.restoreMXCSR(address)
+	reg.FPU.restoreFX(s.mem, address, modrm.wide())
+	s.restoreXMM(address)
+}
+
+// checkXSAVE XSAVE and XRSTOR raise #UD without XSAVE or CR4.OSXSAVE and #NM with CR0.TS
+func (s *SSE) checkXSAVE() {
+	reg := s.reg
+	if reg.features().Leaf1ECX&FeatureXSAVE == 0 || reg.CR4&CR4OSXSAVE == 0 {
+		raise(ExceptionUD)
+	}
+	if reg.CR0&CR0TS != 0 {
+		raise(ExceptionNM)
+	}
+}
+
+// requestedFeatures RFBM, the components of XCR0 selected by EDX:EAX
+func (s *SSE) requestedFeatures() uint64 {
+	reg := s.reg
+	return reg.XCR0 & reg.edxEAX()
+}
+
+// edxEAX EDX:EAX, taken from the low halves of RDX and RAX in 64-bit mode
+func (r *X86Registers) edxEAX() uint64 {
+	if r.mode64 {
+		return r.X64.RDX<<32 | r.X64.RAX&0xffffffff
+	}
+	return uint64(r.EDX)<<32 | uint64(r.EAX)
+}
+
+// setEDXEAX zero-extends the halves to RDX and RAX in 64-bit mode
+func (r *X86Registers) setEDXEAX(value uint64) {
+	if r.mode64 {
+		r.X64.RAX, r.X64.RDX = uint64(uint32(value)), value>>32
+		return
+	}
+	r.EAX, r.EDX = uint32(value), uint32(value>>32)
+}
+
+// inUse XINUSE: the components not in their initial configuration
+func (s *SSE) inUse() uint64 {
+	reg := s.reg
+	var mask uint64
+	if !reg.FPU.isInit() {
+		mask |= xstateX87
+	}
+	for i := 0; i < reg.vectorRegisters(); i++ {
+		if reg.XMM[i] != (XMM{}) {
+			mask |= xstateSSE
+		}
+		if reg.YMMH[i] != (XMM{}) {
+			mask |= xstateAVX
+		}
+	}
+	return mask
+}
+
+// xsave XSAVE mem (0F AE /4): the requested components in the standard format. XSTATE_BV
+// tells which of them were in use; its other bits are kept.
+func (s *SSE) xsave(modrm *ModRM) {
+	reg := s.reg
+	mem := s.mem
+	s.checkXSAVE()
+	rfbm := s.requestedFeatures()
+	address := s.saveArea(modrm, xsaveSize(reg.XCR0), 64, true)
+	if rfbm&xstateX87 != 0 {
+		reg.FPU.saveFX(mem, address, modrm.wide())
+	}
+	if rfbm&(xstateSSE|xstateAVX) != 0 {
+		s.saveMXCSR(address)
+	}
+	if rfbm&xstateSSE != 0 {
+		s.saveXMM(address)
+	}
+	if rfbm&xstateAVX != 0 {
+		s.saveYMMH(address)
+	}
+	bv := readQword(mem, address+xsaveHeader)
+	writeQword(mem, address+xsaveHeader, bv&^rfbm|s.inUse()&rfbm)
+}
+
+// xrstor XRSTOR mem (0F AE /5): loads the requested components present in XSTATE_BV and
+// initializes the others. The header must be in the standard format with known components.
+func (s *SSE) xrstor(modrm *ModRM) {
+	reg := s.reg
+	mem := s.mem
+	s.checkXSAVE()
+	rfbm := s.requestedFeatures()
+	address := s.saveArea(modrm, xsaveSize(reg.XCR0), 64, false)
+	bv := readQword(mem, address+xsaveHeader)
+	if bv&^reg.XCR0 != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	for offset := uint64(8); offset < xsaveHeaderSize; offset += 8 {
+		if readQword(mem, address+xsaveHeader+offset) != 0 {
+			raiseWithCode(ExceptionGP, 0)
+		}
+	}
+	if rfbm&(xstateSSE|xstateAVX) != 0 {
+		s.restoreMXCSR(address)
+	}
+	if rfbm&xstateX87 != 0 {
+		if bv&xstateX87 != 0 {
+			reg.FPU.restoreFX(mem, address, modrm.wide())
+		} else {
+			reg.FPU.init()
+			reg.FPU.Regs = [8]Float80{}
+		}
+	}
+	if rfbm&xstateSSE != 0 {
+		if bv&xstateSSE != 0 {
+			s.restoreXMM(address)
+		} else {
+			for i := 0; i < reg.vectorRegisters(); i++ {
+				reg.XMM[i] = XMM{}
+			}
+		}
+	}
+	if rfbm&xstateAVX != 0 {
+		if bv&xstateAVX != 0 {
+			s.restoreYMMH(address)
+		} else {
+			reg.YMMH = [16]XMM{}
+		}
+	}
+}
+
+// checkXCR XGETBV and XSETBV raise #UD without CR4.OSXSAVE; only XCR0 exists
+func (s *System) checkXCR() {
+	reg := s.reg
+	if reg.features().Leaf1ECX&FeatureXSAVE == 0 || reg.CR4&CR4OSXSAVE == 0 {
+		raise(ExceptionUD)
+	}
+	ecx := reg.ECX
+	if reg.mode64 {
+		ecx = uint32(reg.X64.RCX)
+	}
+	if ecx != 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+}
+
+// xgetbv XGETBV (0F 01 D0): EDX:EAX = XCR[ECX]
+func (s *System) xgetbv() {
+	reg := s.reg
+	s.checkXCR()
+	reg.setEDXEAX(reg.XCR0)
+}
+
+// xsetbv XSETBV (0F 01 D1): XCR[ECX] = EDX:EAX at CPL 0. The x87 state is always enabled,
+// the AVX state needs the SSE state and unsupported components raise #GP(0).
+func (s *System) xsetbv() {
+	reg := s.reg
+	s.checkXCR()
+	s.checkPrivileged()
+	value := reg.edxEAX()
+	if value&xstateX87 == 0 || value&^xstateSupported != 0 ||
+		value&xstateAVX != 0 && value&xstateSSE == 0 {
+		raiseWithCode(ExceptionGP, 0)
+	}
+	reg.XCR0 = value
+}
+
+// xsaveLeaf CPUID leaf 0xD: subleaf 0 reports the supported components and the sizes of the
+// XSAVE area for XCR0 and for all of them, subleaf 2 the size and offset of the AVX state.
+// None of XSAVEOPT, XSAVEC or XSAVES exists.
+func xsaveLeaf(reg *X86Registers, subleaf uint32) (uint32, uint32, uint32, uint32) {
+	if reg.features().Leaf1ECX&FeatureXSAVE == 0 {
+		return 0, 0, 0, 0
+	}
+	supported := uint64(xstateX87 | xstateSSE)
+	if reg.features().Leaf1ECX&FeatureAVX != 0 {
+		supported |= xstateAVX
+	}
+	switch subleaf {
+	case 0:
+		return uint32(supported), xsaveSize(reg.XCR0), xsaveSize(supported), uint32(supported >> 32)
+	case 2:
+		if supported&xstateAVX != 0 {
+			return xsaveYMMHSize, xsaveYMMH, 0, 0
+		}
+	}
+	return 0, 0, 0, 0
+}
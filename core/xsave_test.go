@@ -0,0 +1,49 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestXSETBV(t *testing.T) {
+	tests := []struct {
+		name    string
+		ecx     uint32
+		value   uint64
+		osxsave bool
+		want    uint64
+		err     string
+	}{
+		{"sse", 0, xstateX87 | xstateSSE, true, xstateX87 | xstateSSE, ""},
+		{"avx", 0, xstateX87 | xstateSSE | xstateAVX, true, xstateX87 | xstateSSE | xstateAVX, ""},
+		// the x87 state is always on, the AVX state needs the SSE state
+		{"no x87", 0, xstateSSE, true, 0, "#GP(0x0)"},
+		{"avx alone", 0, xstateX87 | xstateAVX, true, 0, "#GP(0x0)"},
+		{"unsupported", 0, xstateX87 | 1<<3, true, 0, "#GP(0x0)"},
+		{"xcr1", 1, xstateX87, true, 0, "#GP(0x0)"},
+		{"no osxsave", 0, xstateX87, false, 0, "#UD"},
+	}
+	for _, test := range tests {
+		emu := newBare(t, 32, []byte{0x0f, 0x01, 0xd1, 0xf4}) // xsetbv; hlt
+		reg := emu.cpu.(*CPU).reg
+		if test.osxsave {
+			reg.CR4 |= CR4OSXSAVE
+		}
+		reg.ECX = test.ecx
+		reg.EAX, reg.EDX = uint32(test.value), uint32(test.value>>32)
+		err := emu.Run()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if reg.XCR0 != test.want {
+			t.Errorf("%s: XCR0 = %#x, want %#x", test.name, reg.XCR0, test.want)
+		}
+	}
+}